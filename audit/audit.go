@@ -0,0 +1,97 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Package audit implements a trail of security relevant events (handshakes, MAC
+// failures, key rotations and rejected peers), delivered in a structured form to
+// registered subscribers, so they can be fed into external monitoring tools.
+package audit
+
+import (
+	"sync"
+	"time"
+)
+
+// Kinds of security events.
+const (
+	HandshakeSuccess = "handshake-success" // Session authenticated and established
+	HandshakeFailure = "handshake-failure" // Session negotiation failed or was refused
+	MacFailure       = "mac-failure"       // Message integrity verification failed
+	KeyRotation      = "key-rotation"      // Authentication key replaced
+	PeerRejected     = "peer-rejected"     // Authenticated peer denied admission
+)
+
+// A single security event.
+type Event struct {
+	Time      time.Time `json:"time"`             // Time of the occurrence
+	Kind      string    `json:"kind"`             // Type of the event, one of the above kinds
+	Component string    `json:"component"`        // Protocol layer reporting the event
+	Remote    string    `json:"remote,omitempty"` // Network address of the remote side, if any
+	Peer      string    `json:"peer,omitempty"`   // Claimed identity of the remote side, if known
+	Detail    string    `json:"detail,omitempty"` // Further details (e.g. failure cause), if any
+}
+
+// Receiver of the security events. Events are delivered synchronously from the
+// reporting protocol layer, so the handler should not block.
+type Subscriber interface {
+	HandleAudit(event *Event)
+}
+
+var (
+	subs []Subscriber // Currently registered event subscribers
+	lock sync.RWMutex // Mutex to protect the subscriber list
+)
+
+// Registers a subscriber to receive all subsequent security events.
+func Subscribe(sub Subscriber) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	subs = append(subs, sub)
+}
+
+// Removes a previously registered subscriber.
+func Unsubscribe(sub Subscriber) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	for i, s := range subs {
+		if s == sub {
+			subs = append(subs[:i:i], subs[i+1:]...) // Copy to keep snapshots intact
+			return
+		}
+	}
+}
+
+// Reports a security event to all the subscribers, timestamping it if needed.
+func Emit(event *Event) {
+	// Snapshot the subscribers (removals never modify the list in place)
+	lock.RLock()
+	list := subs
+	lock.RUnlock()
+
+	if len(list) == 0 {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	for _, sub := range list {
+		sub.HandleAudit(event)
+	}
+}
@@ -0,0 +1,65 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package audit
+
+import (
+	"sync"
+	"testing"
+)
+
+// Subscriber collecting all the received events.
+type recorder struct {
+	events []*Event
+	lock   sync.Mutex
+}
+
+func (r *recorder) HandleAudit(event *Event) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.events = append(r.events, event)
+}
+
+func TestAudit(t *testing.T) {
+	// Events without subscribers should be discarded
+	Emit(&Event{Kind: KeyRotation})
+
+	// Register a few subscribers and ensure they all receive the events
+	recs := []*recorder{new(recorder), new(recorder)}
+	for _, rec := range recs {
+		Subscribe(rec)
+	}
+	Emit(&Event{Kind: MacFailure, Component: "test"})
+	Unsubscribe(recs[0])
+	Emit(&Event{Kind: PeerRejected, Component: "test"})
+	Unsubscribe(recs[1])
+
+	for i, rec := range recs {
+		if len(rec.events) != i+1 {
+			t.Fatalf("subscriber %d: event count mismatch: have %v, want %v.", i, len(rec.events), i+1)
+		}
+		if event := rec.events[0]; event.Kind != MacFailure || event.Time.IsZero() {
+			t.Fatalf("subscriber %d: event mismatch: have %+v.", i, event)
+		}
+	}
+	if kind := recs[1].events[1].Kind; kind != PeerRejected {
+		t.Fatalf("event kind mismatch: have %v, want %v.", kind, PeerRejected)
+	}
+}
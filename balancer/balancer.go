@@ -19,13 +19,13 @@
 
 // Package balancer implements a capacity based load balancer where each entity
 // periodically reports its actual processing capacity and the balancer issues
-// requests based on those numbers.
+// requests based on those numbers, picking the targets through a pluggable
+// strategy (capacity weighted random by default).
 package balancer
 
 import (
 	"fmt"
 	"math/big"
-	"math/rand"
 	"sort"
 	"sync"
 )
@@ -34,16 +34,28 @@ import (
 type Balancer struct {
 	members  entitySlice  // Entries to which to balace to
 	capacity int          // Total message capacity of the topic
+	strategy Strategy     // Strategy picking the balancing targets
+	local    *big.Int     // Id of the balancing node for locality aware strategies
 	lock     sync.RWMutex // Mutex to allow reentrant balancing
 }
 
 // Creates a new - empty - load balancer.
 func New() *Balancer {
 	return &Balancer{
-		members: []*entity{},
+		members:  []*entity{},
+		strategy: Weighted(),
 	}
 }
 
+// Sets the strategy to pick the balancing targets with, local identifying the
+// balancing node itself.
+func (b *Balancer) SetStrategy(strategy Strategy, local *big.Int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.strategy, b.local = strategy, local
+}
+
 // Registers an entity to load balance to (no duplicate checks are done).
 func (b *Balancer) Register(id *big.Int) {
 	b.lock.Lock()
@@ -92,8 +104,9 @@ func (b *Balancer) Update(id *big.Int, cap int) error {
 		b.capacity -= b.members[idx].cap
 		b.capacity += cap
 
-		// Update local capacity
+		// Update local capacity and restart the outstanding count
 		b.members[idx].cap = cap
+		b.members[idx].pend = 0
 	} else {
 		return fmt.Errorf("non-registered entity: %v", id)
 	}
@@ -104,39 +117,55 @@ func (b *Balancer) Update(id *big.Int, cap int) error {
 // nil) is used to exclude an entity from balancing to (if it's the only one
 // available then this guarantee will be forfeit).
 func (b *Balancer) Balance(ex *big.Int) (*big.Int, error) {
-	b.lock.RLock()
-	defer b.lock.RUnlock()
+	return b.balance(ex, nil)
+}
+
+// Returns an id to which to send the next urgent message to, picking the least
+// loaded entity regardless of the configured strategy, so that latency critical
+// messages steer clear of backlogged members. The ex is as in Balance.
+func (b *Balancer) BalanceUrgent(ex *big.Int) (*big.Int, error) {
+	return b.balance(ex, LeastOutstanding())
+}
+
+// Returns an id to which to send the next message with the given affinity key,
+// picking the same entity for the same key as long as the candidates do not
+// change (rendezvous hashing, so membership changes only remap the keys of the
+// affected entities). The ex is as in Balance.
+func (b *Balancer) BalanceKey(ex *big.Int, key string) (*big.Int, error) {
+	return b.balance(ex, affinity(key))
+}
+
+// Picks the balancing target with the given strategy (the configured one if nil),
+// excluding ex if possible.
+func (b *Balancer) balance(ex *big.Int, strategy Strategy) (*big.Int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
 
 	// Make sure there is actually somebody to balance to
 	if b.capacity == 0 {
 		return nil, fmt.Errorf("no capacity to balance")
 	}
-	// Calculate the available capacity with ex excluded
-	available := b.capacity
-	exclude := -1
-	if ex != nil {
-		idx := b.members.Search(ex)
-		if idx < len(b.members) && b.members[idx].id.Cmp(ex) == 0 {
-			if available != b.members[idx].cap {
-				available -= b.members[idx].cap
-				exclude = idx
-			}
+	// Collect the candidates with ex excluded (unless it's the only one)
+	cands := make([]*entity, 0, len(b.members))
+	for _, m := range b.members {
+		if ex == nil || len(b.members) == 1 || m.id.Cmp(ex) != 0 {
+			cands = append(cands, m)
 		}
 	}
-	// Generate a uniform random capacity and send to the associated entity
-	cap := rand.Intn(available)
-	for i, m := range b.members {
-		// Skip the excluded source entity
-		if i == exclude {
-			continue
-		}
-		cap -= m.cap
-		if cap < 0 {
-			return m.id, nil
-		}
+	views := make([]Member, len(cands))
+	for i, m := range cands {
+		views[i] = Member{Id: m.id, Capacity: m.cap, Pending: m.pend}
+	}
+	// Let the strategy pick, guarding against misbehaving custom ones
+	if strategy == nil {
+		strategy = b.strategy
+	}
+	idx := strategy.Pick(views, b.local)
+	if idx < 0 || idx >= len(cands) {
+		return nil, fmt.Errorf("strategy picked out of bounds: %d", idx)
 	}
-	// Just in case to prevent bugs
-	panic("balanced out of bounds")
+	cands[idx].pend++
+	return cands[idx].id, nil
 }
 
 // Returns the total capacity that the balancer can handle, optionally with ex
@@ -29,8 +29,9 @@ import (
 
 // Entity and related information.
 type entity struct {
-	id  *big.Int // Unique identifier of the entity
-	cap int      // Message capacity as reported by entity
+	id   *big.Int // Unique identifier of the entity
+	cap  int      // Message capacity as reported by entity
+	pend int      // Messages balanced to the entity since its last report
 }
 
 // Entity slice implementing sort.Interface.
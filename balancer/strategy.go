@@ -0,0 +1,187 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the balancing strategies, picking the destination of each
+// message out of the registered entities.
+
+package balancer
+
+import (
+	"hash/fnv"
+	"math/big"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// Balancing candidate as seen by a strategy.
+type Member struct {
+	Id       *big.Int // Unique identifier of the entity
+	Capacity int      // Message capacity as reported by the entity
+	Pending  int      // Messages balanced to the entity since its last report
+}
+
+// Strategy picking the target of the next balanced message. Implementations must
+// be safe for use by multiple go-routines.
+type Strategy interface {
+	// Returns the index of the member to balance to (there is at least one). The
+	// local id is that of the balancing node (possibly nil, or not a member).
+	Pick(members []Member, local *big.Int) int
+}
+
+// Strategy picking randomly, weighted by the reported capacities.
+type weighted struct{}
+
+// Creates a strategy picking members randomly, in proportion to their reported
+// capacities (the default).
+func Weighted() Strategy {
+	return weighted{}
+}
+
+// Implements Strategy.Pick.
+func (weighted) Pick(members []Member, local *big.Int) int {
+	total := 0
+	for _, m := range members {
+		total += m.Capacity
+	}
+	cap := rand.Intn(total)
+	for i, m := range members {
+		if cap -= m.Capacity; cap < 0 {
+			return i
+		}
+	}
+	// Just in case to prevent bugs
+	panic("balanced out of bounds")
+}
+
+// Strategy cycling through the members.
+type roundRobin struct {
+	next uint32 // Counter of the picks so far (atomic)
+}
+
+// Creates a strategy cycling through the members in id order, disregarding their
+// capacities.
+func RoundRobin() Strategy {
+	return new(roundRobin)
+}
+
+// Implements Strategy.Pick.
+func (r *roundRobin) Pick(members []Member, local *big.Int) int {
+	return int((atomic.AddUint32(&r.next, 1) - 1) % uint32(len(members)))
+}
+
+// Strategy picking the least loaded member.
+type leastOutstanding struct{}
+
+// Creates a strategy picking the member with the fewest messages outstanding
+// relative to its capacity. As completions are not observable, messages count
+// as outstanding until the member's next capacity report.
+func LeastOutstanding() Strategy {
+	return leastOutstanding{}
+}
+
+// Implements Strategy.Pick.
+func (leastOutstanding) Pick(members []Member, local *big.Int) int {
+	best := 0
+	for i := 1; i < len(members); i++ {
+		// Compare pending/capacity ratios without division
+		if members[i].Pending*members[best].Capacity < members[best].Pending*members[i].Capacity {
+			best = i
+		}
+	}
+	return best
+}
+
+// Strategy preferring the local node.
+type localBiased struct {
+	fallback Strategy
+}
+
+// Creates a strategy picking the balancing node itself whenever it's a member,
+// falling back to the given strategy (weighted if nil) otherwise.
+func LocalBiased(fallback Strategy) Strategy {
+	if fallback == nil {
+		fallback = Weighted()
+	}
+	return &localBiased{fallback: fallback}
+}
+
+// Implements Strategy.Pick.
+func (l *localBiased) Pick(members []Member, local *big.Int) int {
+	if local != nil {
+		for i, m := range members {
+			if m.Id.Cmp(local) == 0 {
+				return i
+			}
+		}
+	}
+	return l.fallback.Pick(members, local)
+}
+
+// Strategy preferring the local node, then the nearest member.
+type nearest struct {
+	latency  func(id *big.Int) (time.Duration, bool)
+	fallback Strategy
+}
+
+// Creates a strategy picking the balancing node itself whenever it's a member,
+// otherwise the member with the lowest round trip time as reported by latency
+// (false if not measured), falling back to the given strategy (weighted if nil)
+// if none of the members were measured.
+func Nearest(latency func(id *big.Int) (time.Duration, bool), fallback Strategy) Strategy {
+	if fallback == nil {
+		fallback = Weighted()
+	}
+	return &nearest{latency: latency, fallback: fallback}
+}
+
+// Implements Strategy.Pick.
+func (n *nearest) Pick(members []Member, local *big.Int) int {
+	best, bestRtt := -1, time.Duration(0)
+	for i, m := range members {
+		if local != nil && m.Id.Cmp(local) == 0 {
+			return i
+		}
+		if rtt, ok := n.latency(m.Id); ok && (best < 0 || rtt < bestRtt) {
+			best, bestRtt = i, rtt
+		}
+	}
+	if best >= 0 {
+		return best
+	}
+	return n.fallback.Pick(members, local)
+}
+
+// Strategy pinning an affinity key to a member.
+type affinity string
+
+// Implements Strategy.Pick, selecting the member with the highest hash of the
+// key and the member id.
+func (a affinity) Pick(members []Member, local *big.Int) int {
+	best, bestSum := 0, uint64(0)
+	for i, m := range members {
+		hash := fnv.New64a()
+		hash.Write([]byte(a))
+		hash.Write(m.Id.Bytes())
+		if sum := hash.Sum64(); i == 0 || sum > bestSum {
+			best, bestSum = i, sum
+		}
+	}
+	return best
+}
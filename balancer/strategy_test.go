@@ -0,0 +1,206 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package balancer
+
+import (
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// Creates a balancer with the given strategy and entity capacities.
+func newTestBalancer(strategy Strategy, local *big.Int, caps ...int) (*Balancer, []*big.Int) {
+	bal := New()
+	bal.SetStrategy(strategy, local)
+
+	ids := make([]*big.Int, len(caps))
+	for i, cap := range caps {
+		ids[i] = big.NewInt(int64(i + 1))
+		bal.Register(ids[i])
+		bal.Update(ids[i], cap)
+	}
+	return bal, ids
+}
+
+func TestRoundRobin(t *testing.T) {
+	bal, ids := newTestBalancer(RoundRobin(), nil, 1, 5, 10)
+	for i := 0; i < 9; i++ {
+		id, err := bal.Balance(nil)
+		if err != nil {
+			t.Fatalf("failed to balance: %v.", err)
+		}
+		if id.Cmp(ids[i%3]) != 0 {
+			t.Fatalf("pick %d mismatch: have %v, want %v.", i, id, ids[i%3])
+		}
+	}
+	// Excluded entities should be skipped, unless the only one
+	for i := 0; i < 4; i++ {
+		if id, _ := bal.Balance(ids[0]); id.Cmp(ids[0]) == 0 {
+			t.Fatalf("pick %d balanced to excluded entity.", i)
+		}
+	}
+	single, ids := newTestBalancer(RoundRobin(), nil, 1)
+	if id, _ := single.Balance(ids[0]); id.Cmp(ids[0]) != 0 {
+		t.Fatalf("single entity pick mismatch: have %v, want %v.", id, ids[0])
+	}
+}
+
+func TestLeastOutstanding(t *testing.T) {
+	bal, ids := newTestBalancer(LeastOutstanding(), nil, 1, 3)
+
+	// Picks should follow the capacities until the next report
+	hist := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		id, err := bal.Balance(nil)
+		if err != nil {
+			t.Fatalf("failed to balance: %v.", err)
+		}
+		hist[id.String()]++
+	}
+	if hist[ids[0].String()] != 2 || hist[ids[1].String()] != 6 {
+		t.Fatalf("pick histogram mismatch: have %v, want 2 and 6.", hist)
+	}
+	// Reports should reset the outstanding counts
+	bal.Update(ids[0], 1)
+	if id, _ := bal.Balance(nil); id.Cmp(ids[0]) != 0 {
+		t.Fatalf("pick after report mismatch: have %v, want %v.", id, ids[0])
+	}
+}
+
+func TestLocalBiased(t *testing.T) {
+	local := big.NewInt(2)
+	bal, ids := newTestBalancer(LocalBiased(RoundRobin()), local, 1, 1, 1)
+	for i := 0; i < 10; i++ {
+		if id, _ := bal.Balance(nil); id.Cmp(local) != 0 {
+			t.Fatalf("pick %d mismatch: have %v, want %v.", i, id, local)
+		}
+	}
+	// Excluding the local node should fall back to the secondary strategy
+	hist := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		id, _ := bal.Balance(local)
+		hist[id.String()]++
+	}
+	if hist[ids[0].String()] != 5 || hist[ids[2].String()] != 5 {
+		t.Fatalf("fallback histogram mismatch: have %v, want 5 and 5.", hist)
+	}
+}
+
+// Strategy picking a fixed, possibly invalid index.
+type fixed int
+
+func (f fixed) Pick(members []Member, local *big.Int) int {
+	return int(f)
+}
+
+func TestCustomStrategy(t *testing.T) {
+	bal, ids := newTestBalancer(fixed(1), nil, 1, 1)
+	if id, err := bal.Balance(nil); err != nil || id.Cmp(ids[1]) != 0 {
+		t.Fatalf("custom pick mismatch: have %v/%v, want %v.", id, err, ids[1])
+	}
+	bal.SetStrategy(fixed(2), nil)
+	if _, err := bal.Balance(nil); err == nil {
+		t.Fatalf("out of bounds pick accepted.")
+	}
+}
+
+func TestBalanceUrgent(t *testing.T) {
+	bal, ids := newTestBalancer(fixed(0), nil, 1, 1, 1)
+
+	// Backlog the first entity through the configured strategy
+	for i := 0; i < 3; i++ {
+		bal.Balance(nil)
+	}
+	// Urgent picks should avoid it, spreading over the idle ones
+	hist := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		id, err := bal.BalanceUrgent(nil)
+		if err != nil {
+			t.Fatalf("failed to balance: %v.", err)
+		}
+		hist[id.String()]++
+	}
+	if hist[ids[0].String()] != 0 || hist[ids[1].String()] != 2 || hist[ids[2].String()] != 2 {
+		t.Fatalf("urgent pick histogram mismatch: have %v, want 0, 2 and 2.", hist)
+	}
+	// The configured strategy should remain in effect for the rest
+	if id, _ := bal.Balance(nil); id.Cmp(ids[0]) != 0 {
+		t.Fatalf("regular pick mismatch: have %v, want %v.", id, ids[0])
+	}
+}
+
+func TestNearest(t *testing.T) {
+	rtts := map[int64]time.Duration{2: 30 * time.Millisecond, 3: 10 * time.Millisecond}
+	latency := func(id *big.Int) (time.Duration, bool) {
+		rtt, ok := rtts[id.Int64()]
+		return rtt, ok
+	}
+	// The local member should be preferred, then the nearest measured one
+	bal, ids := newTestBalancer(Nearest(latency, nil), big.NewInt(1), 1, 1, 1)
+	if id, _ := bal.Balance(nil); id.Cmp(ids[0]) != 0 {
+		t.Fatalf("local pick mismatch: have %v, want %v.", id, ids[0])
+	}
+	if id, _ := bal.Balance(ids[0]); id.Cmp(ids[2]) != 0 {
+		t.Fatalf("nearest pick mismatch: have %v, want %v.", id, ids[2])
+	}
+	// Unmeasured members should fall back to the secondary strategy
+	rtts = nil
+	bal, ids = newTestBalancer(Nearest(latency, fixed(1)), nil, 1, 1, 1)
+	if id, _ := bal.Balance(nil); id.Cmp(ids[1]) != 0 {
+		t.Fatalf("fallback pick mismatch: have %v, want %v.", id, ids[1])
+	}
+}
+
+func TestBalanceKey(t *testing.T) {
+	bal, ids := newTestBalancer(RoundRobin(), nil, 1, 1, 1, 1)
+
+	// Same keys should stick to the same entity, different ones spread out
+	pinned := make(map[string]*big.Int)
+	hist := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("session-%d", i)
+		id, err := bal.BalanceKey(nil, key)
+		if err != nil {
+			t.Fatalf("failed to balance: %v.", err)
+		}
+		for j := 0; j < 3; j++ {
+			if again, _ := bal.BalanceKey(nil, key); again.Cmp(id) != 0 {
+				t.Fatalf("key %s moved: have %v, want %v.", key, again, id)
+			}
+		}
+		pinned[key] = id
+		hist[id.String()]++
+	}
+	if len(hist) != len(ids) {
+		t.Fatalf("keys not spread: have %v, want all %d entities.", hist, len(ids))
+	}
+	// Removing an entity should only remap the keys pinned to it
+	bal.Unregister(ids[0])
+	for key, old := range pinned {
+		id, _ := bal.BalanceKey(nil, key)
+		if old.Cmp(ids[0]) != 0 && id.Cmp(old) != 0 {
+			t.Fatalf("unaffected key %s moved: have %v, want %v.", key, id, old)
+		}
+		if id.Cmp(ids[0]) == 0 {
+			t.Fatalf("key %s pinned to removed entity.", key)
+		}
+	}
+}
@@ -26,6 +26,8 @@ import (
 	"crypto/md5"
 	"math/big"
 	"time"
+
+	"code.google.com/p/go.crypto/hkdf"
 )
 
 // Cyclic group for the STS cryptography (2448 bits).
@@ -126,18 +128,35 @@ var StsSigHash = crypto.MD5
 // Hash type for the HMAC within HKDF.
 var HkdfHash = crypto.MD5
 
+// Key derivation function expanding the negotiated secrets into link keys.
+var SessionKdf Kdf = hkdf.New
+
 // Salt value for the HKDF key extraction.
 var HkdfSalt = []byte("iris.proto.session.hkdf.salt")
 
-// Info value for the HKDF key expansion.
+// Info value for the HKDF key expansion (legacy, unbound derivation).
 var HkdfInfo = []byte("iris.proto.session.hkdf.info")
 
+// Versioned label prefixing the identity bound HKDF key expansion info.
+var HkdfLabel = []byte("iris.proto.session.hkdf.v2")
+
+// Whether to accept peers still using the legacy, unbound key derivation.
+var HkdfLegacy = true
+
+// Lowest session handshake version to accept from remote peers. Version 1 means
+// the unversioned legacy handshake, whereas 2 requires the negotiated parameters
+// to be bound into the session keys (set once all the peers are upgraded).
+var SessionMinVersion = 1
+
 // Symmetric cipher to use for session encryption.
 var SessionCipher = aes.NewCipher
 
 // Key size for the session symmetric cipher (bits).
 var SessionCipherBits = 128
 
+// Cipher suite of the session links ("" = pick by hardware AES support).
+var SessionSuite = ""
+
 // Hash creator for the session HMAC.
 var SessionHash = md5.New
 
@@ -153,8 +172,30 @@ var SessionShakeTimeout = 3 * time.Second
 // Maximum allowed time to complete the session data channel setup.
 var SessionLinkTimeout = time.Second
 
-// Time allowance to gracefully terminate a session link.
-var SessionGraceTimeout = 3 * time.Second
+// Time allowance to flush the queued messages when terminating a session link.
+var SessionFlushTimeout = 3 * time.Second
+
+// Time allowance to drain inbound messages until the remote side closes the link.
+var SessionDrainTimeout = 3 * time.Second
+
+// Time allowance for any transfer still pending on the socket when closing it.
+var SessionCloseTimeout = time.Second
+
+// Number of times to retry a session handshake failing with a transient error.
+var SessionShakeRetries = 2
+
+// Initial delay before retrying a failed session handshake (doubled each time).
+var SessionShakeBackoff = 250 * time.Millisecond
+
+// Upper limit on the delay between two session handshake retries.
+var SessionShakeMaxBackoff = 2 * time.Second
+
+// Validity period of a session resumption ticket (0 disables resumption).
+var SessionTicketLifetime = 10 * time.Minute
+
+// File to append the link key material to for decoding captured traffic (empty
+// disables it). Anyone reading the log can decrypt the headers, debug use only!
+var SessionKeyLog = ""
 
 // Symmetric cipher for the temporary message encryption.
 var PacketCipher = aes.NewCipher
@@ -162,8 +203,21 @@ var PacketCipher = aes.NewCipher
 // Key size for the temporary cipher (bits).
 var PacketCipherBits = 128
 
-// Bootstrapping ports to use.
-var BootPorts = []int{14142, 27182, 31415, 45654, 22222, 33333}
+// Bootstrapping ports to use: single ports, inclusive "first-last" ranges, or 0 to
+// fall back to an ephemeral one (found only through its probes and beacons).
+var BootPorts = []string{"14142", "27182", "31415", "45654", "22222", "33333"}
+
+// Seed nodes (host:port of their overlay listeners) to dial on startup.
+var BootSeeds = []string{}
+
+// File listing further seed nodes, one host:port per line (empty to disable).
+var BootSeedFile = ""
+
+// Multicast group to send discovery beacons to (empty to disable).
+var BootMulticast = "239.192.14.142:14142"
+
+// Whether to probe and scan the local networks port by port for peers.
+var BootProbing = true
 
 // Number of heartbeats to queue before blocking.
 var BootBeatsBuffer = 32
@@ -201,6 +255,19 @@ var PastryBeatPeriod = 3 * time.Second
 // Number of missed heartbeats after which to consider a node down.
 var PastryKillCount = 3
 
+// Number of virtual overlay nodes (ids) hosted by a single physical node.
+var PastryVirtualNodes = 1
+
+// Suspicion level (phi) of a silent peer at which to consider it down (0 disables
+// the adaptive detection, using PastryKillCount only).
+var PastryPhiThreshold = 8.0
+
+// Number of heartbeat intervals sampled per peer to estimate the suspicion from.
+var PastryPhiWindow = 100
+
+// Minimum deviation of the heartbeat intervals, tolerating small network delays.
+var PastryPhiJitter = 500 * time.Millisecond
+
 // Maximum time to queue an authenticated session connection before dropping it.
 var PastryAcceptTimeout = time.Second
 
@@ -210,6 +277,9 @@ var PastryInitTimeout = 5 * time.Second
 // Time limit for sending a message before the connection is dropped.
 var PastrySendTimeout = 3 * time.Second
 
+// Maximum number of overlay hops a routed message may take before being dropped.
+var PastryMaxHops = 32
+
 // Messages to buffer to and from the network.
 var PastryNetBuffer = 64
 
@@ -219,6 +289,76 @@ var PastryAuthThreads = 8
 // Maximum number of state exchanges allowed concurrently.
 var PastryExchThreads = 128
 
+// Networks (CIDR) whose listener addresses to advertise, in order of preference.
+// An empty list advertises all listener addresses.
+var PastryAdvertise = []string{}
+
+// Whether to prefer publicly routable addresses over private ones when ranking.
+var PastryPreferPublic = false
+
+// Extra host:port addresses to advertise beside the listeners, reaching the node
+// through e.g. a VPN or a port forwarded WAN endpoint.
+var PastryAnnounce = []string{}
+
+// Period of checking the local interfaces for address changes, rebinding the
+// listeners and notifying the peers.
+var PastryAddrPeriod = 10 * time.Second
+
+// Whether to map the listener ports of private interfaces on a NAT gateway.
+var PastryNatMapping = false
+
+// Time limit for locating a NAT gateway and for the individual mapping requests.
+var PastryNatTimeout = 3 * time.Second
+
+// Lease duration of the NAT port mappings, refreshed at half-life.
+var PastryNatLease = 20 * time.Minute
+
+// STUN servers (host:port) to query for the public address of private listeners.
+// An empty list disables the discovery.
+var PastryStunServers = []string{}
+
+// Period of re-querying the STUN servers to track public address changes.
+var PastryStunPeriod = 10 * time.Minute
+
+// Whether to retry forwarding through another close peer if the next hop fails.
+var PastryRouteRetry = true
+
+// Time to remember the overlay broadcasts seen, suppressing their duplicates.
+var PastryBroadcastMemory = time.Minute
+
+// Whether to rendezvous through the overlay for hole punching unreachable peers.
+var PastryHolePunch = false
+
+// IP time to live of the hole punching packets (expire before the remote NAT).
+var PastryPunchTtl = 3
+
+// Time allowance of a single hole punching connection attempt.
+var PastryPunchTimeout = 500 * time.Millisecond
+
+// Period of reprobing peers lost to failures, healing network partitions.
+var PastryMergePeriod = 30 * time.Second
+
+// Number of lost peers to probe per period, keeping the probing rate low.
+var PastryMergeBatch = 4
+
+// Time after which a lost peer is considered gone for good and not probed more.
+var PastryMergeExpiry = time.Hour
+
+// Period of the round trip time probes sent to the routing peers.
+var PastryRttPeriod = 10 * time.Second
+
+// Number of round trip time samples retained per peer for the latency statistics.
+var PastryRttWindow = 32
+
+// File persisting the node id and last known peers across restarts (empty disables).
+var PastryStateFile = ""
+
+// Whether node ids are derived from per-node keys and verified on connection.
+var PastryVerifyIds = false
+
+// Leading zero bits required of the verifiable node id puzzle (generation cost).
+var PastryIdDifficulty = 8
+
 // Heartbeat period to distribute current CPU load and also check liveliness (ms).
 var ScribeBeatPeriod = time.Second
 
@@ -231,12 +371,76 @@ var ScribeSpace = 32
 // Number of messages to buffer for application delivery before dropping.
 var ScribeAppBuffer = 128
 
+// Maximum time an event may be held back at an interior node for coalescing with
+// others towards the same child (0 disables batching).
+var ScribeBatchDelay = time.Duration(0)
+
+// Maximum payload size of an event to be eligible for batching (bytes).
+var ScribeBatchEvent = 1024
+
+// Maximum number of events in a single batch, flushed immediately when reached.
+var ScribeBatchLimit = 64
+
+// Number of nodes storing a replica of each DHT entry (the closest to its key).
+var DhtReplicas = 3
+
 // Number of sub-clusters an app cluster or topic is split into.
 var IrisClusterSplits = 5
 
 // Maximum number of handlers allowed concurrently per Iris application.
 var IrisHandlerThreads = 16
 
+// Maximum number of handlers allowed concurrently per target (cluster, topic or
+// tunnel) of an Iris application, leaving the remaining ones to other targets.
+var IrisQueueThreads = 8
+
+// Minimum time left of a queued request for it to still be passed to the handler,
+// rejecting it as expired otherwise.
+var IrisShedMargin = 10 * time.Millisecond
+
+// Whether events are also relayed to wildcard subscriptions (an extra publish
+// for each topic level).
+var IrisWildcards = true
+
+// Time limit of context bound operations whose context carries no deadline.
+var IrisContextTimeout = 30 * time.Second
+
+// Period of the cluster instances re-announcing their presence to the watchers.
+var IrisPresencePeriod = 10 * time.Second
+
+// Time after which a silent cluster instance is reported gone to the watchers.
+var IrisPresenceTimeout = 30 * time.Second
+
+// Maximum number of events buffered for an offline durable subscription.
+var IrisDurableLimit = 1024
+
+// Maximum time an event is buffered for an offline durable subscription.
+var IrisDurableRetention = time.Hour
+
+// Maximum time an ordered broadcast is held back waiting for a missing earlier one.
+var IrisOrderTimeout = time.Second
+
+// Maximum time a delayed publish may be held back by the topic root.
+var IrisDelayLimit = 24 * time.Hour
+
+// Payload size above which requests, replies and publishes are sent in chunks.
+var IrisChunkSize = 64 * 1024
+
+// Maximum payload size of a chunked message accepted for reassembly.
+var IrisMessageLimit = 64 * 1024 * 1024
+
+// Maximum time to wait for the missing chunks of a partially received message.
+var IrisChunkTimeout = 30 * time.Second
+
+// Number of member responses buffered per scatter-gather request.
+var IrisGatherBuffer = 1024
+
+// Maximum total size of the keys and values of the metadata attached to a message.
+var IrisMetadataLimit = 4 * 1024
+
+// Time to retain sent publishes and broadcasts for dead lettering failure reports.
+var IrisDeadLetterWindow = 10 * time.Second
+
 // Maximum time to queue an established tunnel stream before dropping it.
 var IrisTunnelAcceptTimeout = time.Second
 
@@ -246,15 +450,66 @@ var IrisTunnelInitTimeout = time.Second
 // Send and receive window for tunnel ordering and throttling.
 var IrisTunnelBuffer = 256
 
+// Delay between the attempts to re-dial a broken resumable tunnel.
+var IrisTunnelRedial = 250 * time.Millisecond
+
+// Maximum payload size of a frame written through a tunnel byte stream.
+var IrisTunnelFrame = 32 * 1024
+
+// Receive window of a tunnel sub-stream, bounding the data buffered per stream.
+var IrisMuxWindow = 256 * 1024
+
+// Maximum number of remotely opened sub-streams waiting to be accepted.
+var IrisMuxBacklog = 64
+
 // Use in case of federated applications.
 var AppParentId = []byte(nil)
 
 // Protocol version to ensure compatible connections.
 var ProtocolVersion = "v0.1-pre"
 
+// Maximum number of relay clients connected at once (0 for unlimited).
+var RelayClientLimit = 0
+
+// Messages queued per relay connection before disconnecting it as a slow consumer.
+var RelayOutboundQueue = 1024
+
+// Time alloted to a relay client to accept its final queued messages when closing.
+var RelayWriteTimeout = 3 * time.Second
+
 // Maximum number of handlers allowed concurrently per relay connection.
 var RelayHandlerThreads = 8
 
+// Outbound requests allowed per second per relay connection (0 for unlimited).
+var RelayRequestRate = 0.0
+
+// Outbound publishes and broadcasts allowed per second per relay connection (0 for unlimited).
+var RelayPublishRate = 0.0
+
+// Inbound handler invocations allowed per second per relay connection (0 for unlimited).
+var RelayHandlerRate = 0.0
+
+// Concurrent tunnels allowed per relay connection (0 for unlimited).
+var RelayTunnelQuota = 0
+
+// Pending outbound requests allowed per relay connection (0 for unlimited).
+var RelayRequestQuota = 0
+
+// Topic subscriptions allowed per relay connection (0 for unlimited).
+var RelaySubscriptionQuota = 0
+
+// Inbound bytes per second allowed per relay connection (0 for unlimited).
+var RelayBandwidthQuota = 0
+
+// Time alloted to the in-flight requests of a relay connection to finish during a handoff.
+var RelayHandoffTimeout = 5 * time.Second
+
+// Time alloted to the in-flight requests and tunnels of a relay connection to finish during a shutdown.
+var RelayDrainTimeout = 5 * time.Second
+
+// Time alloted to an inbound relay connection to complete its handshake.
+var RelayHandshakeTimeout = 5 * time.Second
+
 // Number of messages to buffer per outbound tunnel.
 var RelayTunnelBuffer = 128
 
@@ -21,6 +21,9 @@ package config
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
 	"io"
 	"math/big"
@@ -121,3 +124,152 @@ func TestPastry(t *testing.T) {
 		t.Errorf("config (overlay): strange network buffer size: have %v, want from [16..128].", PastryNetBuffer)
 	}
 }
+
+func TestValidate(t *testing.T) {
+	// The shipped defaults must pass validation
+	if err := Validate(); err != nil {
+		t.Fatalf("config (validate): default configuration rejected: %v.", err)
+	}
+	// Break a few settings and check the reported violations
+	base, ports, nets, announce := PastryBase, BootPorts, PastryAdvertise, PastryAnnounce
+	defer func() { PastryBase, BootPorts, PastryAdvertise, PastryAnnounce = base, ports, nets, announce }()
+
+	PastryBase = 0
+	BootPorts = []string{"1", "70000"}
+	PastryAdvertise = []string{"10.0.0.0/8", "bogus"}
+	PastryAnnounce = []string{"10.0.0.1"}
+
+	err := Validate()
+	errs, ok := err.(ValidationError)
+	if !ok {
+		t.Fatalf("config (validate): unstructured validation error: %v.", err)
+	}
+	want := []string{"PastryBase", "BootPorts[1]", "PastryAdvertise[1]", "PastryAnnounce[0]"}
+	for _, field := range want {
+		found := false
+		for _, ferr := range errs {
+			if ferr.Field == field {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("config (validate): violation of %v not reported: %v.", field, err)
+		}
+	}
+	if len(errs) != len(want) {
+		t.Errorf("config (validate): violation count mismatch: have %v, want %v.", len(errs), len(want))
+	}
+}
+
+func TestFips(t *testing.T) {
+	// Save the primitives and restore them after the test
+	stsCipher, stsHash, hkdfHash := StsCipher, StsSigHash, HkdfHash
+	sesCipher, sesHash, pktCipher := SessionCipher, SessionHash, PacketCipher
+	defer func() {
+		StsCipher, StsSigHash, HkdfHash = stsCipher, stsHash, hkdfHash
+		SessionCipher, SessionHash, PacketCipher = sesCipher, sesHash, pktCipher
+		FipsMode = false
+	}()
+	// The FIPS primitives must pass the restricted validation
+	EnableFips()
+	if err := Validate(); err != nil {
+		t.Fatalf("config (fips): approved configuration rejected: %v.", err)
+	}
+	// Downgrading a hash must be caught
+	StsSigHash = crypto.MD5
+	errs, ok := Validate().(ValidationError)
+	if !ok || len(errs) != 1 || errs[0].Field != "StsSigHash" {
+		t.Fatalf("config (fips): unapproved hash not reported: %v.", errs)
+	}
+}
+
+func TestSuite(t *testing.T) {
+	// Save the suite selection and restore it after the test
+	suite, hardware := SessionSuite, hardwareAes
+	defer func() { SessionSuite, hardwareAes, FipsMode = suite, hardware, false }()
+
+	// Automatic selection must follow the hardware support
+	SessionSuite = ""
+	for _, tt := range []struct {
+		hardware bool
+		suite    string
+	}{{true, SuiteAes}, {false, SuiteChaCha}} {
+		hardwareAes = tt.hardware
+		if s := Suite(); s != tt.suite {
+			t.Fatalf("config (suite): automatic suite mismatch (hardware: %v): have %v, want %v.", tt.hardware, s, tt.suite)
+		}
+	}
+	// Explicit overrides take precedence, except in FIPS mode
+	SessionSuite = SuiteChaCha
+	hardwareAes = true
+	if s := Suite(); s != SuiteChaCha {
+		t.Fatalf("config (suite): overridden suite mismatch: have %v, want %v.", s, SuiteChaCha)
+	}
+	FipsMode = true
+	if s := Suite(); s != SuiteAes {
+		t.Fatalf("config (suite): fips suite mismatch: have %v, want %v.", s, SuiteAes)
+	}
+	FipsMode = false
+
+	// Unknown suites must be rejected
+	SessionSuite = "rot13"
+	errs, ok := Validate().(ValidationError)
+	if !ok || len(errs) != 1 || errs[0].Field != "SessionSuite" {
+		t.Fatalf("config (suite): unknown suite not reported: %v.", errs)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	// Save the primitives and restore them after the test
+	stsCipher, stsHash, hkdfHash, kdf := StsCipher, StsSigHash, HkdfHash, SessionKdf
+	sesCipher, sesHash, pktCipher := SessionCipher, SessionHash, PacketCipher
+	defer func() {
+		StsCipher, StsSigHash, HkdfHash, SessionKdf = stsCipher, stsHash, hkdfHash, kdf
+		SessionCipher, SessionHash, PacketCipher = sesCipher, sesHash, pktCipher
+	}()
+	// Register a custom cipher and select it along with a built in hash
+	used := false
+	RegisterCipher("test-aes", func(key []byte) (cipher.Block, error) {
+		used = true
+		return aes.NewCipher(key)
+	})
+	if err := Select(&Primitives{SessionCipher: "test-aes", HkdfHash: "sha256"}); err != nil {
+		t.Fatalf("config (registry): failed to select primitives: %v.", err)
+	}
+	if _, err := SessionCipher(make([]byte, 16)); err != nil || !used {
+		t.Fatalf("config (registry): custom cipher not selected: %v.", err)
+	}
+	if HkdfHash != crypto.SHA256 || StsSigHash != stsHash {
+		t.Fatalf("config (registry): hash selection mismatch: have %v/%v, want %v/%v.", HkdfHash, StsSigHash, crypto.SHA256, stsHash)
+	}
+	// Unknown names must be reported without touching the config
+	errs, ok := Select(&Primitives{StsSigHash: "sha256", SessionHash: "crc32", SessionKdf: "pbkdf"}).(ValidationError)
+	if !ok || len(errs) != 2 || errs[0].Field != "SessionKdf" || errs[1].Field != "SessionHash" {
+		t.Fatalf("config (registry): unknown names not reported: %v.", errs)
+	}
+	if StsSigHash != stsHash {
+		t.Fatalf("config (registry): failed selection modified the config.")
+	}
+}
+
+func TestParsePorts(t *testing.T) {
+	ports, err := ParsePorts([]string{"14142", "40000-40003", "40002", " 0 "})
+	if err != nil {
+		t.Fatalf("config (ports): failed to parse valid specs: %v.", err)
+	}
+	want := []int{14142, 40000, 40001, 40002, 40003, 0}
+	if len(ports) != len(want) {
+		t.Fatalf("config (ports): port list mismatch: have %v, want %v.", ports, want)
+	}
+	for i, port := range want {
+		if ports[i] != port {
+			t.Fatalf("config (ports): port list mismatch: have %v, want %v.", ports, want)
+		}
+	}
+	for _, spec := range []string{"", "port", "-1", "65536", "0-10", "20-10", "1-65536", "1-2-3"} {
+		if _, err := ParsePorts([]string{spec}); err == nil {
+			t.Fatalf("config (ports): invalid spec %q accepted.", spec)
+		}
+	}
+}
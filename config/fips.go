@@ -0,0 +1,74 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the FIPS compatible crypto mode, restricting the primitives
+// to AES, the SHA-2 family and RSA of approved sizes. It is switched on either
+// at runtime via EnableFips, or at build time with the fips build tag.
+
+package config
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/sha256"
+	_ "crypto/sha512"
+	"fmt"
+)
+
+// Whether the cryptographic primitives are restricted to a FIPS approved set,
+// refusing peers outside it.
+var FipsMode = false
+
+// Minimum RSA key size accepted in FIPS mode (bits).
+var FipsRsaBits = 2048
+
+// Hashes approved for signatures and key derivation in FIPS mode.
+var fipsHashes = []crypto.Hash{crypto.SHA256, crypto.SHA384, crypto.SHA512}
+
+// Switches the cryptographic primitives over to the FIPS approved set.
+func EnableFips() {
+	StsCipher, StsSigHash = aes.NewCipher, crypto.SHA256
+	HkdfHash = crypto.SHA256
+	SessionCipher, SessionHash = aes.NewCipher, sha256.New
+	PacketCipher = aes.NewCipher
+	FipsMode = true
+}
+
+// Verifies that the configured primitives conform to the FIPS approved set.
+func (v *validator) fips() {
+	approved := func(hash crypto.Hash) bool {
+		for _, h := range fipsHashes {
+			if h == hash {
+				return true
+			}
+		}
+		return false
+	}
+	v.check(approved(StsSigHash), "StsSigHash", fmt.Sprintf("FIPS approved hash %v", fipsHashes), StsSigHash)
+	v.check(approved(HkdfHash), "HkdfHash", fmt.Sprintf("FIPS approved hash %v", fipsHashes), HkdfHash)
+	v.check(SessionHash().Size() >= sha256.Size, "SessionHash", "SHA-256 or stronger", SessionHash().Size()*8)
+	for _, c := range []struct {
+		field string
+		bits  int
+	}{{"StsCipherBits", StsCipherBits}, {"SessionCipherBits", SessionCipherBits}, {"PacketCipherBits", PacketCipherBits}} {
+		v.check(c.bits == 128 || c.bits == 192 || c.bits == 256, c.field, "AES key size (128, 192 or 256)", c.bits)
+	}
+	v.check(SessionSuite != SuiteChaCha, "SessionSuite", "FIPS approved suite "+SuiteAes, SessionSuite)
+	v.check(FipsRsaBits >= 2048, "FipsRsaBits", ">= 2048", FipsRsaBits)
+}
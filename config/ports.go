@@ -0,0 +1,64 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Expands a list of port specifications (single ports, inclusive "first-last"
+// ranges, or 0 for an ephemeral port) into the individual ports, dropping any
+// duplicates but otherwise retaining the order.
+func ParsePorts(specs []string) ([]int, error) {
+	ports := []int{}
+	seen := make(map[int]struct{})
+	for _, spec := range specs {
+		first, last, err := parsePortSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+		for port := first; port <= last; port++ {
+			if _, ok := seen[port]; !ok {
+				seen[port] = struct{}{}
+				ports = append(ports, port)
+			}
+		}
+	}
+	return ports, nil
+}
+
+// Parses a single port specification into the bounds of the port range.
+func parsePortSpec(spec string) (int, int, error) {
+	bounds := strings.SplitN(strings.TrimSpace(spec), "-", 2)
+	first, err := strconv.Atoi(bounds[0])
+	if err != nil || first < 0 || first > 65535 {
+		return 0, 0, fmt.Errorf("invalid port: %q", spec)
+	}
+	if len(bounds) == 1 {
+		return first, first, nil
+	}
+	last, err := strconv.Atoi(bounds[1])
+	if err != nil || first == 0 || last < first || last > 65535 {
+		return 0, 0, fmt.Errorf("invalid port range: %q", spec)
+	}
+	return first, last, nil
+}
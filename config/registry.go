@@ -0,0 +1,185 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the registry of the named cryptographic primitives. Forks
+// can register additional ciphers, hashes and key derivation functions from an
+// init function and switch the configuration over to them via Select, without
+// touching the defaults in config.go.
+
+package config
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	_ "crypto/md5"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"code.google.com/p/go.crypto/hkdf"
+)
+
+// Block cipher constructor taking the symmetric key.
+type Cipher func(key []byte) (cipher.Block, error)
+
+// Key derivation function expanding a secret into an arbitrarily long key stream.
+type Kdf func(hash func() hash.Hash, secret, salt, info []byte) io.Reader
+
+// Named primitives available for selection.
+var (
+	ciphers = make(map[string]Cipher)
+	hashes  = make(map[string]crypto.Hash)
+	kdfs    = make(map[string]Kdf)
+
+	registryLock sync.RWMutex
+)
+
+// Registers the built in primitives.
+func init() {
+	RegisterCipher("aes", aes.NewCipher)
+
+	RegisterHash("md5", crypto.MD5)
+	RegisterHash("sha1", crypto.SHA1)
+	RegisterHash("sha224", crypto.SHA224)
+	RegisterHash("sha256", crypto.SHA256)
+	RegisterHash("sha384", crypto.SHA384)
+	RegisterHash("sha512", crypto.SHA512)
+
+	RegisterKdf("hkdf", hkdf.New)
+}
+
+// Registers a block cipher under the given name, replacing any previous one.
+func RegisterCipher(name string, ctor Cipher) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	ciphers[name] = ctor
+}
+
+// Registers a hash under the given name, replacing any previous one. Custom
+// implementations must first be linked in via crypto.RegisterHash, since the
+// signatures need the standard hash identifiers.
+func RegisterHash(name string, hash crypto.Hash) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	hashes[name] = hash
+}
+
+// Registers a key derivation function under the given name, replacing any
+// previous one.
+func RegisterKdf(name string, kdf Kdf) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	kdfs[name] = kdf
+}
+
+// Names of the primitives to configure. Empty fields leave the current choice
+// untouched.
+type Primitives struct {
+	StsCipher     string // Cipher for the STS encryption
+	StsSigHash    string // Hash for the RSA signatures
+	HkdfHash      string // Hash for the HMAC within the key derivation
+	SessionKdf    string // Key derivation function of the sessions
+	SessionCipher string // Cipher for the session encryption
+	SessionHash   string // Hash for the session HMAC
+	PacketCipher  string // Cipher for the packet payload encryption
+}
+
+// Looks up the named primitives and, if all are registered, switches the config
+// over to them. Otherwise a ValidationError with the unknown names is returned
+// and nothing is changed.
+func Select(p *Primitives) error {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	// Collect the available names for the error reports
+	var cipherNames, hashNames, kdfNames []string
+	for name := range ciphers {
+		cipherNames = append(cipherNames, name)
+	}
+	for name := range hashes {
+		hashNames = append(hashNames, name)
+	}
+	for name := range kdfs {
+		kdfNames = append(kdfNames, name)
+	}
+	// Resolve all the names, collecting the unknown ones
+	v := new(validator)
+	cipherOf := func(field, name string) Cipher {
+		ctor, ok := ciphers[name]
+		v.check(ok || name == "", field, "registered cipher "+registered(cipherNames), name)
+		return ctor
+	}
+	hashOf := func(field, name string) crypto.Hash {
+		hash, ok := hashes[name]
+		v.check(ok || name == "", field, "registered hash "+registered(hashNames), name)
+		v.check(!ok || hash.Available(), field, "hash linked into binary", name)
+		return hash
+	}
+	stsCipher := cipherOf("StsCipher", p.StsCipher)
+	stsSigHash := hashOf("StsSigHash", p.StsSigHash)
+	hkdfHash := hashOf("HkdfHash", p.HkdfHash)
+	sessionKdf, ok := kdfs[p.SessionKdf]
+	v.check(ok || p.SessionKdf == "", "SessionKdf", "registered kdf "+registered(kdfNames), p.SessionKdf)
+	sessionCipher := cipherOf("SessionCipher", p.SessionCipher)
+	sessionHash := hashOf("SessionHash", p.SessionHash)
+	packetCipher := cipherOf("PacketCipher", p.PacketCipher)
+
+	if len(v.errs) > 0 {
+		return v.errs
+	}
+	// All names valid, switch over the selected primitives
+	if stsCipher != nil {
+		StsCipher = stsCipher
+	}
+	if p.StsSigHash != "" {
+		StsSigHash = stsSigHash
+	}
+	if p.HkdfHash != "" {
+		HkdfHash = hkdfHash
+	}
+	if sessionKdf != nil {
+		SessionKdf = sessionKdf
+	}
+	if sessionCipher != nil {
+		SessionCipher = sessionCipher
+	}
+	if p.SessionHash != "" {
+		SessionHash = sessionHash.New
+	}
+	if packetCipher != nil {
+		PacketCipher = packetCipher
+	}
+	return nil
+}
+
+// Formats the sorted names of a registry for error reports.
+func registered(names []string) string {
+	sort.Strings(names)
+	return fmt.Sprintf("[%s]", strings.Join(names, " "))
+}
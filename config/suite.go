@@ -0,0 +1,92 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the runtime selection of the session cipher suite. Hosts
+// with hardware accelerated AES (AES-NI on x86, the crypto extensions on ARM)
+// prefer the AES based suite, others ChaCha20 which is faster in software.
+
+package config
+
+import (
+	"bufio"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// Cipher suites supported by the session links.
+const (
+	SuiteAes    = "aes-ctr"  // SessionCipher in counter mode
+	SuiteChaCha = "chacha20" // ChaCha20 stream cipher
+)
+
+// Whether the host CPU has hardware accelerated AES, detected at startup.
+var hardwareAes = detectAes()
+
+// Reports whether the host CPU was detected to accelerate AES.
+func HardwareAes() bool {
+	return hardwareAes
+}
+
+// Returns the cipher suite preferred by the local node: AES in FIPS mode, the
+// configured SessionSuite if any, or otherwise the one suiting the hardware.
+func Suite() string {
+	switch {
+	case FipsMode:
+		return SuiteAes
+	case SessionSuite != "":
+		return SessionSuite
+	case hardwareAes:
+		return SuiteAes
+	default:
+		return SuiteChaCha
+	}
+}
+
+// Detects the AES instruction set support of the host CPU from the feature flags
+// reported by the kernel. Where these are unavailable, the 64 bit x86 and ARM
+// platforms are assumed to be accelerated. Both AES-NI (x86 "flags") and the ARM
+// crypto extensions ("Features") are reported as "aes".
+func detectAes() bool {
+	fallback := runtime.GOARCH == "amd64" || runtime.GOARCH == "arm64"
+
+	file, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return fallback
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if name := strings.TrimSpace(parts[0]); name != "flags" && name != "Features" {
+			continue
+		}
+		for _, flag := range strings.Fields(parts[1]) {
+			if flag == "aes" {
+				return true
+			}
+		}
+		return false
+	}
+	return fallback
+}
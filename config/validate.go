@@ -0,0 +1,268 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the sanity checks of the configuration values, reporting
+// every violation with the offending setting, the broken constraint and the
+// actual value, so that a bad deployment is rejected before booting.
+
+package config
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A single configuration constraint violation.
+type FieldError struct {
+	Field      string      // Path of the offending setting (e.g. PastryAdvertise[1])
+	Constraint string      // Requirement the setting violates
+	Value      interface{} // Actual value of the setting
+}
+
+// Implements the error interface.
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: have %v, want %s", e.Field, e.Value, e.Constraint)
+}
+
+// List of constraint violations found during a configuration validation.
+type ValidationError []*FieldError
+
+// Implements the error interface.
+func (e ValidationError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("invalid configuration: %s", strings.Join(msgs, "; "))
+}
+
+// Accumulator for the constraint violations.
+type validator struct {
+	errs ValidationError
+}
+
+// Records a violation if the condition does not hold.
+func (v *validator) check(ok bool, field, constraint string, value interface{}) {
+	if !ok {
+		v.errs = append(v.errs, &FieldError{Field: field, Constraint: constraint, Value: value})
+	}
+}
+
+// Checks that a count or size parameter is strictly positive.
+func (v *validator) positive(field string, value int) {
+	v.check(value > 0, field, "> 0", value)
+}
+
+// Checks that a timeout or period is strictly positive.
+func (v *validator) period(field string, value time.Duration) {
+	v.check(value > 0, field, "> 0", value)
+}
+
+// Checks that a symmetric cipher can be instantiated with the given key size.
+func (v *validator) cipher(field string, ctor func([]byte) (cipher.Block, error), bits int) {
+	ok := bits > 0 && bits%8 == 0
+	if ok {
+		_, err := ctor(make([]byte, bits/8))
+		ok = err == nil
+	}
+	v.check(ok, field, "key size supported by the cipher", bits)
+}
+
+// Verifies the current configuration values, returning a ValidationError with
+// all the constraint violations if any, or nil otherwise.
+func Validate() error {
+	v := new(validator)
+
+	// Cryptographic primitives
+	v.cipher("StsCipherBits", StsCipher, StsCipherBits)
+	v.check(StsSigHash.Available(), "StsSigHash", "hash linked into binary", StsSigHash)
+	v.check(HkdfHash.Available(), "HkdfHash", "hash linked into binary", HkdfHash)
+	v.check(len(HkdfSalt) > 0, "HkdfSalt", "non-empty", HkdfSalt)
+	v.check(len(HkdfInfo) > 0, "HkdfInfo", "non-empty", HkdfInfo)
+	v.check(!bytes.Equal(HkdfSalt, HkdfInfo), "HkdfInfo", "distinct from HkdfSalt", HkdfInfo)
+	v.check(len(HkdfLabel) > 0, "HkdfLabel", "non-empty", HkdfLabel)
+	v.cipher("SessionCipherBits", SessionCipher, SessionCipherBits)
+	v.cipher("PacketCipherBits", PacketCipher, PacketCipherBits)
+	v.positive("SessionMinVersion", SessionMinVersion)
+	v.check(SessionSuite == "" || SessionSuite == SuiteAes || SessionSuite == SuiteChaCha, "SessionSuite",
+		fmt.Sprintf("empty, %s or %s", SuiteAes, SuiteChaCha), SessionSuite)
+	if FipsMode {
+		v.fips()
+	}
+
+	// Session handshake
+	v.period("SessionDialTimeout", SessionDialTimeout)
+	v.period("SessionAcceptTimeout", SessionAcceptTimeout)
+	v.period("SessionShakeTimeout", SessionShakeTimeout)
+	v.period("SessionLinkTimeout", SessionLinkTimeout)
+	v.period("SessionFlushTimeout", SessionFlushTimeout)
+	v.period("SessionDrainTimeout", SessionDrainTimeout)
+	v.period("SessionCloseTimeout", SessionCloseTimeout)
+	v.check(SessionShakeRetries >= 0, "SessionShakeRetries", ">= 0", SessionShakeRetries)
+	v.check(SessionShakeBackoff >= 0, "SessionShakeBackoff", ">= 0", SessionShakeBackoff)
+	v.check(SessionShakeMaxBackoff >= SessionShakeBackoff, "SessionShakeMaxBackoff", ">= SessionShakeBackoff", SessionShakeMaxBackoff)
+	v.check(SessionTicketLifetime >= 0, "SessionTicketLifetime", ">= 0", SessionTicketLifetime)
+
+	// Bootstrapping
+	v.check(len(BootPorts) > 0, "BootPorts", "non-empty", BootPorts)
+	for i, spec := range BootPorts {
+		_, _, err := parsePortSpec(spec)
+		v.check(err == nil, fmt.Sprintf("BootPorts[%d]", i), "port [0..65535] or range [1..65535]", spec)
+	}
+	for i, seed := range BootSeeds {
+		_, _, err := net.SplitHostPort(seed)
+		v.check(err == nil, fmt.Sprintf("BootSeeds[%d]", i), "host:port address", seed)
+	}
+	if BootSeedFile != "" {
+		_, err := os.Stat(BootSeedFile)
+		v.check(err == nil, "BootSeedFile", "existing file", BootSeedFile)
+	}
+	if BootMulticast != "" {
+		group, err := net.ResolveUDPAddr("udp4", BootMulticast)
+		v.check(err == nil && group.IP.IsMulticast(), "BootMulticast", "IPv4 multicast group address", BootMulticast)
+	}
+	v.check(BootProbing || BootMulticast != "", "BootProbing", "enabled if multicast is disabled", BootProbing)
+	v.positive("BootBeatsBuffer", BootBeatsBuffer)
+	v.positive("BootFastProbe", BootFastProbe)
+	v.positive("BootSlowProbe", BootSlowProbe)
+	v.positive("BootScan", BootScan)
+
+	// Pastry overlay
+	v.check(PastryBase >= 1, "PastryBase", ">= 1", PastryBase)
+	if PastryBase >= 1 {
+		v.check(PastrySpace > 0 && PastrySpace%PastryBase == 0, "PastrySpace", fmt.Sprintf("positive multiple of PastryBase (%d)", PastryBase), PastrySpace)
+		v.check(PastryLeaves == 1<<uint(PastryBase-1) || PastryLeaves == 1<<uint(PastryBase), "PastryLeaves",
+			fmt.Sprintf("%d or %d", 1<<uint(PastryBase-1), 1<<uint(PastryBase)), PastryLeaves)
+	}
+	v.check(PastryResolver().Size()*8 >= PastrySpace, "PastryResolver", fmt.Sprintf(">= %d output bits", PastrySpace), PastryResolver().Size()*8)
+	v.period("PastryBootTimeout", PastryBootTimeout)
+	v.period("PastryConvTimeout", PastryConvTimeout)
+	v.period("PastryBeatPeriod", PastryBeatPeriod)
+	v.positive("PastryKillCount", PastryKillCount)
+	v.positive("PastryVirtualNodes", PastryVirtualNodes)
+	v.check(PastryPhiThreshold >= 0, "PastryPhiThreshold", ">= 0", PastryPhiThreshold)
+	v.positive("PastryPhiWindow", PastryPhiWindow)
+	v.period("PastryPhiJitter", PastryPhiJitter)
+	v.period("PastryAcceptTimeout", PastryAcceptTimeout)
+	v.period("PastryInitTimeout", PastryInitTimeout)
+	v.period("PastrySendTimeout", PastrySendTimeout)
+	v.positive("PastryMaxHops", PastryMaxHops)
+	v.period("PastryBroadcastMemory", PastryBroadcastMemory)
+	v.positive("PastryNetBuffer", PastryNetBuffer)
+	v.positive("PastryAuthThreads", PastryAuthThreads)
+	v.positive("PastryExchThreads", PastryExchThreads)
+	for i, cidr := range PastryAdvertise {
+		_, _, err := net.ParseCIDR(cidr)
+		v.check(err == nil, fmt.Sprintf("PastryAdvertise[%d]", i), "CIDR network", cidr)
+	}
+	for i, addr := range PastryAnnounce {
+		_, err := net.ResolveTCPAddr("tcp", addr)
+		v.check(err == nil, fmt.Sprintf("PastryAnnounce[%d]", i), "host:port address", addr)
+	}
+	v.period("PastryAddrPeriod", PastryAddrPeriod)
+	v.period("PastryNatTimeout", PastryNatTimeout)
+	v.period("PastryNatLease", PastryNatLease)
+	for i, server := range PastryStunServers {
+		_, _, err := net.SplitHostPort(server)
+		v.check(err == nil, fmt.Sprintf("PastryStunServers[%d]", i), "host:port address", server)
+	}
+	v.period("PastryStunPeriod", PastryStunPeriod)
+	v.check(PastryPunchTtl >= 1 && PastryPunchTtl <= 255, "PastryPunchTtl", "[1..255]", PastryPunchTtl)
+	v.period("PastryPunchTimeout", PastryPunchTimeout)
+	v.period("PastryMergePeriod", PastryMergePeriod)
+	v.positive("PastryMergeBatch", PastryMergeBatch)
+	v.period("PastryMergeExpiry", PastryMergeExpiry)
+	v.period("PastryRttPeriod", PastryRttPeriod)
+	v.positive("PastryRttWindow", PastryRttWindow)
+	v.check(PastryIdDifficulty >= 0 && PastryIdDifficulty <= 32, "PastryIdDifficulty", "[0..32]", PastryIdDifficulty)
+	if PastryVerifyIds {
+		v.check(PastrySpace <= 256, "PastrySpace", "<= 256 with verifiable ids", PastrySpace)
+	}
+	if PastryStateFile != "" {
+		info, err := os.Stat(filepath.Dir(PastryStateFile))
+		v.check(err == nil && info.IsDir(), "PastryStateFile", "path in an existing directory", PastryStateFile)
+	}
+
+	// Scribe topics
+	v.period("ScribeBeatPeriod", ScribeBeatPeriod)
+	v.positive("ScribeKillCount", ScribeKillCount)
+	v.check(ScribeSpace > 0 && ScribeSpace <= 64, "ScribeSpace", "[1..64]", ScribeSpace)
+	v.positive("ScribeAppBuffer", ScribeAppBuffer)
+	v.check(ScribeBatchDelay >= 0, "ScribeBatchDelay", ">= 0", ScribeBatchDelay)
+	v.positive("ScribeBatchEvent", ScribeBatchEvent)
+	v.positive("ScribeBatchLimit", ScribeBatchLimit)
+
+	// Distributed hash table
+	v.positive("DhtReplicas", DhtReplicas)
+
+	// Iris and relay
+	v.positive("IrisClusterSplits", IrisClusterSplits)
+	v.positive("IrisHandlerThreads", IrisHandlerThreads)
+	v.positive("IrisQueueThreads", IrisQueueThreads)
+	v.period("IrisShedMargin", IrisShedMargin)
+	v.check(IrisQueueThreads <= IrisHandlerThreads, "IrisQueueThreads", "<= IrisHandlerThreads", IrisQueueThreads)
+	v.period("IrisContextTimeout", IrisContextTimeout)
+	v.period("IrisPresencePeriod", IrisPresencePeriod)
+	v.check(IrisPresenceTimeout > IrisPresencePeriod, "IrisPresenceTimeout", "> IrisPresencePeriod", IrisPresenceTimeout)
+	v.positive("IrisDurableLimit", IrisDurableLimit)
+	v.period("IrisDurableRetention", IrisDurableRetention)
+	v.period("IrisOrderTimeout", IrisOrderTimeout)
+	v.period("IrisDelayLimit", IrisDelayLimit)
+	v.positive("IrisChunkSize", IrisChunkSize)
+	v.period("IrisChunkTimeout", IrisChunkTimeout)
+	v.positive("IrisGatherBuffer", IrisGatherBuffer)
+	v.positive("IrisMetadataLimit", IrisMetadataLimit)
+	v.period("IrisDeadLetterWindow", IrisDeadLetterWindow)
+	v.period("IrisTunnelAcceptTimeout", IrisTunnelAcceptTimeout)
+	v.period("IrisTunnelInitTimeout", IrisTunnelInitTimeout)
+	v.positive("IrisTunnelBuffer", IrisTunnelBuffer)
+	v.period("IrisTunnelRedial", IrisTunnelRedial)
+	v.positive("IrisTunnelFrame", IrisTunnelFrame)
+	v.positive("IrisMuxWindow", IrisMuxWindow)
+	v.positive("IrisMuxBacklog", IrisMuxBacklog)
+	v.check(ProtocolVersion != "", "ProtocolVersion", "non-empty", ProtocolVersion)
+	v.check(RelayClientLimit >= 0, "RelayClientLimit", ">= 0", RelayClientLimit)
+	v.check(RelayOutboundQueue >= 2, "RelayOutboundQueue", ">= 2", RelayOutboundQueue)
+	v.period("RelayWriteTimeout", RelayWriteTimeout)
+	v.positive("RelayHandlerThreads", RelayHandlerThreads)
+	v.check(RelayRequestRate >= 0, "RelayRequestRate", ">= 0", RelayRequestRate)
+	v.check(RelayPublishRate >= 0, "RelayPublishRate", ">= 0", RelayPublishRate)
+	v.check(RelayHandlerRate >= 0, "RelayHandlerRate", ">= 0", RelayHandlerRate)
+	v.check(RelayTunnelQuota >= 0, "RelayTunnelQuota", ">= 0", RelayTunnelQuota)
+	v.check(RelayRequestQuota >= 0, "RelayRequestQuota", ">= 0", RelayRequestQuota)
+	v.check(RelaySubscriptionQuota >= 0, "RelaySubscriptionQuota", ">= 0", RelaySubscriptionQuota)
+	v.check(RelayBandwidthQuota >= 0, "RelayBandwidthQuota", ">= 0", RelayBandwidthQuota)
+	v.period("RelayHandoffTimeout", RelayHandoffTimeout)
+	v.period("RelayDrainTimeout", RelayDrainTimeout)
+	v.period("RelayHandshakeTimeout", RelayHandshakeTimeout)
+	v.positive("RelayTunnelBuffer", RelayTunnelBuffer)
+	v.positive("RelayTunnelTimeout", RelayTunnelTimeout)
+	v.positive("RelayTunnelPoll", RelayTunnelPoll)
+
+	if len(v.errs) > 0 {
+		return v.errs
+	}
+	return nil
+}
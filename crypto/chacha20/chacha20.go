@@ -0,0 +1,130 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Package chacha20 implements the ChaCha20 stream cipher as specified by RFC 7539,
+// a software friendly alternative to AES on hosts without hardware acceleration.
+//
+// The block counter carries over into the first nonce word instead of wrapping,
+// so a single stream can safely encrypt more than the 256GB allowed by the RFC.
+//
+// Reference: https://tools.ietf.org/html/rfc7539
+package chacha20
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+)
+
+// Size of the ChaCha20 key in bytes.
+const KeySize = 32
+
+// Size of the ChaCha20 nonce in bytes.
+const NonceSize = 12
+
+// Size of a single key stream block in bytes.
+const blockSize = 64
+
+// The "expand 32-byte k" constants of the initial state.
+var sigma = [4]uint32{0x61707865, 0x3320646e, 0x79622d32, 0x6b206574}
+
+// ChaCha20 key stream generator.
+type stream struct {
+	state [16]uint32      // Initial state of the next block
+	block [blockSize]byte // Key stream of the current block
+	used  int             // Number of key stream bytes already consumed
+}
+
+// Creates a new ChaCha20 stream cipher with the given key and nonce, starting
+// with a zero block counter.
+func New(key, nonce []byte) (cipher.Stream, error) {
+	if len(key) != KeySize {
+		return nil, errors.New("chacha20: invalid key size")
+	}
+	if len(nonce) != NonceSize {
+		return nil, errors.New("chacha20: invalid nonce size")
+	}
+	s := &stream{used: blockSize}
+	copy(s.state[:4], sigma[:])
+	for i := 0; i < 8; i++ {
+		s.state[4+i] = binary.LittleEndian.Uint32(key[4*i:])
+	}
+	for i := 0; i < 3; i++ {
+		s.state[13+i] = binary.LittleEndian.Uint32(nonce[4*i:])
+	}
+	return s, nil
+}
+
+// XORs each byte in the given slice with a byte from the cipher's key stream.
+// Dst and src may overlap entirely or not at all.
+func (s *stream) XORKeyStream(dst, src []byte) {
+	if len(dst) < len(src) {
+		panic("chacha20: output smaller than input")
+	}
+	for i := range src {
+		if s.used == blockSize {
+			s.generate()
+		}
+		dst[i] = src[i] ^ s.block[s.used]
+		s.used++
+	}
+}
+
+// Computes the next key stream block and advances the block counter.
+func (s *stream) generate() {
+	x := s.state
+	for i := 0; i < 10; i++ {
+		// Column rounds
+		quarterRound(&x, 0, 4, 8, 12)
+		quarterRound(&x, 1, 5, 9, 13)
+		quarterRound(&x, 2, 6, 10, 14)
+		quarterRound(&x, 3, 7, 11, 15)
+
+		// Diagonal rounds
+		quarterRound(&x, 0, 5, 10, 15)
+		quarterRound(&x, 1, 6, 11, 12)
+		quarterRound(&x, 2, 7, 8, 13)
+		quarterRound(&x, 3, 4, 9, 14)
+	}
+	for i := range x {
+		binary.LittleEndian.PutUint32(s.block[4*i:], x[i]+s.state[i])
+	}
+	s.used = 0
+
+	// Advance the counter, carrying into the nonce on overflow
+	if s.state[12]++; s.state[12] == 0 {
+		s.state[13]++
+	}
+}
+
+// The ChaCha quarter round on four words of the state.
+func quarterRound(x *[16]uint32, a, b, c, d int) {
+	x[a] += x[b]
+	x[d] ^= x[a]
+	x[d] = x[d]<<16 | x[d]>>16
+	x[c] += x[d]
+	x[b] ^= x[c]
+	x[b] = x[b]<<12 | x[b]>>20
+	x[a] += x[b]
+	x[d] ^= x[a]
+	x[d] = x[d]<<8 | x[d]>>24
+	x[c] += x[d]
+	x[b] ^= x[c]
+	x[b] = x[b]<<7 | x[b]>>25
+}
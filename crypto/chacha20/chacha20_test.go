@@ -0,0 +1,103 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package chacha20
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Test vector from RFC 7539, section 2.4.2 (block counter starting at 1).
+var testKey = []byte{
+	0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f,
+	0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18, 0x19, 0x1a, 0x1b, 0x1c, 0x1d, 0x1e, 0x1f,
+}
+var testNonce = []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x4a, 0x00, 0x00, 0x00, 0x00}
+var testPlain = []byte("Ladies and Gentlemen of the class of '99: If I could offer you only one tip for the future, sunscreen would be it.")
+var testCipher = []byte{
+	0x6e, 0x2e, 0x35, 0x9a, 0x25, 0x68, 0xf9, 0x80, 0x41, 0xba, 0x07, 0x28, 0xdd, 0x0d, 0x69, 0x81,
+	0xe9, 0x7e, 0x7a, 0xec, 0x1d, 0x43, 0x60, 0xc2, 0x0a, 0x27, 0xaf, 0xcc, 0xfd, 0x9f, 0xae, 0x0b,
+	0xf9, 0x1b, 0x65, 0xc5, 0x52, 0x47, 0x33, 0xab, 0x8f, 0x59, 0x3d, 0xab, 0xcd, 0x62, 0xb3, 0x57,
+	0x16, 0x39, 0xd6, 0x24, 0xe6, 0x51, 0x52, 0xab, 0x8f, 0x53, 0x0c, 0x35, 0x9f, 0x08, 0x61, 0xd8,
+	0x07, 0xca, 0x0d, 0xbf, 0x50, 0x0d, 0x6a, 0x61, 0x56, 0xa3, 0x8e, 0x08, 0x8a, 0x22, 0xb6, 0x5e,
+	0x52, 0xbc, 0x51, 0x4d, 0x16, 0xcc, 0xf8, 0x06, 0x81, 0x8c, 0xe9, 0x1a, 0xb7, 0x79, 0x37, 0x36,
+	0x5a, 0xf9, 0x0b, 0xbf, 0x74, 0xa3, 0x5b, 0xe6, 0xb4, 0x0b, 0x8e, 0xed, 0xf2, 0x78, 0x5e, 0x42,
+	0x87, 0x4d,
+}
+
+func TestVector(t *testing.T) {
+	strm, err := New(testKey, testNonce)
+	if err != nil {
+		t.Fatalf("failed to create cipher: %v.", err)
+	}
+	// Skip the first block, the vector starts with counter 1
+	strm.XORKeyStream(make([]byte, blockSize), make([]byte, blockSize))
+
+	out := make([]byte, len(testPlain))
+	strm.XORKeyStream(out, testPlain)
+	if !bytes.Equal(out, testCipher) {
+		t.Fatalf("ciphertext mismatch: have %x, want %x.", out, testCipher)
+	}
+}
+
+func TestChunking(t *testing.T) {
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	// Encrypt in one go
+	strm, _ := New(testKey, testNonce)
+	whole := make([]byte, len(data))
+	strm.XORKeyStream(whole, data)
+
+	// Encrypt in odd sized chunks, in place
+	strm, _ = New(testKey, testNonce)
+	parts := append([]byte{}, data...)
+	for i := 0; i < len(parts); i += 37 {
+		end := i + 37
+		if end > len(parts) {
+			end = len(parts)
+		}
+		strm.XORKeyStream(parts[i:end], parts[i:end])
+	}
+	if !bytes.Equal(whole, parts) {
+		t.Fatalf("chunked key stream mismatch.")
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	if _, err := New(testKey[:16], testNonce); err == nil {
+		t.Fatalf("short key accepted.")
+	}
+	if _, err := New(testKey, testNonce[:8]); err == nil {
+		t.Fatalf("short nonce accepted.")
+	}
+}
+
+func BenchmarkStream(b *testing.B) {
+	strm, _ := New(testKey, testNonce)
+	data := make([]byte, 4096)
+
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		strm.XORKeyStream(data, data)
+	}
+}
@@ -0,0 +1,121 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the decode developer tool, turning a captured TCP direction
+// of a link into a human readable frame listing, given the key log of one of the
+// endpoints (see config.SessionKeyLog).
+
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/karalabe/iris/proto"
+	"github.com/karalabe/iris/proto/link"
+)
+
+// Prints the usage of the decode tool and its options.
+func decodeUsage(flags *flag.FlagSet) func() {
+	return func() {
+		fmt.Printf("Decodes a captured link direction into human readable frames.\n\n")
+		fmt.Printf("Usage:\n\n")
+		fmt.Printf("\t%s decode [options]\n\n", os.Args[0])
+
+		fmt.Printf("The options are:\n\n")
+		flags.VisitAll(func(f *flag.Flag) {
+			fmt.Printf("\t-%-20s%s\n", f.Name, f.Usage)
+		})
+		fmt.Printf("\n")
+	}
+}
+
+// Runs the decode tool with the given arguments, returning the exit code.
+func decode(args []string) int {
+	flags := flag.NewFlagSet("decode", flag.ExitOnError)
+	keyPath := flags.String("keys", "", "path to the key log of one of the endpoints")
+	capPath := flags.String("in", "", "path to the raw capture of a single TCP direction")
+	source := flags.String("from", "", "sender address of the captured direction (host:port)")
+	payload := flags.Bool("payload", false, "decrypt and dump the message payloads too")
+	flags.Usage = decodeUsage(flags)
+	flags.Parse(args)
+
+	if *keyPath == "" || *capPath == "" || *source == "" {
+		flags.Usage()
+		return -1
+	}
+	// Find the key material of the captured direction
+	keyFile, err := os.Open(*keyPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open key log: %v.\n", err)
+		return -1
+	}
+	entries, err := link.ParseKeyLog(keyFile)
+	keyFile.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to parse key log: %v.\n", err)
+		return -1
+	}
+	var keys *link.KeyLogEntry
+	for _, entry := range entries {
+		if entry.Source == *source {
+			keys = entry
+		}
+	}
+	if keys == nil {
+		fmt.Fprintf(os.Stderr, "No keys logged for source %v.\n", *source)
+		return -1
+	}
+	dec, err := link.NewDecoder(keys.Keys, keys.Suite)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create decoder: %v.\n", err)
+		return -1
+	}
+	// Decode the capture, dumping each frame
+	capture, err := os.Open(*capPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open capture: %v.\n", err)
+		return -1
+	}
+	defer capture.Close()
+
+	fmt.Printf("Decoding %v -> %v (%s)\n\n", keys.Source, keys.Destination, keys.Suite)
+	err = dec.DecodeStream(capture, func(frame *link.Frame) {
+		fmt.Printf("frame #%d: envelope v%d, suite %s, kind %s\n", frame.Index, frame.Envelope, frame.Suite, frame.Kind())
+		fmt.Printf("\tmeta:    %+v\n", frame.Head.Meta)
+		fmt.Printf("\tpayload: %d bytes, encrypted: %v\n", len(frame.Data), frame.Head.Key != nil)
+		if *payload && len(frame.Data) > 0 {
+			msg := &proto.Message{Head: frame.Head, Data: frame.Data}
+			if msg.Head.Key != nil {
+				if err := msg.Decrypt(); err != nil {
+					fmt.Printf("\tfailed to decrypt payload: %v\n", err)
+					return
+				}
+			}
+			fmt.Printf("%s", hex.Dump(msg.Data))
+		}
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to decode capture: %v.\n", err)
+		return -1
+	}
+	return 0
+}
@@ -29,8 +29,9 @@ import (
 
 // Entity and related information.
 type entity struct {
-	id   *big.Int // Unique identifier of the entity
-	tick int      // Tick of the last recorded activity
+	id     *big.Int  // Unique identifier of the entity
+	tick   int       // Tick of the last recorded activity
+	detect *detector // Adaptive failure detector (nil if tick based)
 }
 
 // Entity slice implementing sort.Interface.
@@ -42,6 +42,10 @@ type Heart struct {
 	beat time.Duration // Time duration of a beat cycle
 	kill int           // Number of missed ticks before and entity is reported dead
 
+	phi    float64       // Suspicion level to report a dead entity at (0 = tick based)
+	window int           // Number of inter-arrival samples to estimate from
+	jitter time.Duration // Minimum deviation of the inter-arrival times
+
 	call Callback // Application callback to notify of events
 
 	quit chan chan error // Quit synchronizer to ensure cleanup
@@ -60,6 +64,15 @@ func New(beat time.Duration, kill int, handler Callback) *Heart {
 	}
 }
 
+// Switches the failure detection from the fixed kill count to an adaptive, phi
+// accrual one: an entity is reported dead when the suspicion level of its silence
+// reaches threshold, estimated from the last window ping intervals, deviating by
+// at least jitter. Entities without ping history still obey the kill count. Must
+// be called before starting.
+func (h *Heart) SetAdaptive(threshold float64, window int, jitter time.Duration) {
+	h.phi, h.window, h.jitter = threshold, window, jitter
+}
+
 // Starts the beater and event notifier.
 func (h *Heart) Start() {
 	go h.beater()
@@ -82,7 +95,11 @@ func (h *Heart) Monitor(id *big.Int) error {
 	if idx < len(h.mems) && h.mems[idx].id.Cmp(id) == 0 {
 		return fmt.Errorf("duplicate entry")
 	}
-	h.mems = append(h.mems, &entity{id: id, tick: h.tick})
+	ent := &entity{id: id, tick: h.tick}
+	if h.phi > 0 {
+		ent.detect = newDetector(time.Now())
+	}
+	h.mems = append(h.mems, ent)
 	sort.Sort(h.mems)
 	return nil
 }
@@ -114,11 +131,30 @@ func (h *Heart) Ping(id *big.Int) error {
 	idx := h.mems.Search(id)
 	if idx < len(h.mems) && h.mems[idx].id.Cmp(id) == 0 {
 		h.mems[idx].tick = h.tick
+		if detect := h.mems[idx].detect; detect != nil {
+			detect.record(time.Now(), h.window)
+		}
 		return nil
 	}
 	return fmt.Errorf("non-monitored entity")
 }
 
+// Retrieves the current suspicion level of an entity's failure (always zero if
+// the adaptive detection is disabled).
+func (h *Heart) Phi(id *big.Int) (float64, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	idx := h.mems.Search(id)
+	if idx < len(h.mems) && h.mems[idx].id.Cmp(id) == 0 {
+		if detect := h.mems[idx].detect; detect != nil {
+			return detect.phi(time.Now(), h.beat, h.jitter), nil
+		}
+		return 0, nil
+	}
+	return 0, fmt.Errorf("non-monitored entity")
+}
+
 // Beater function meant to run as a separate go routine to keep pinging each
 // monitored entity and report when some fail to respond within alloted time.
 func (h *Heart) beater() {
@@ -139,8 +175,13 @@ func (h *Heart) beater() {
 			h.lock.Lock()
 			h.tick++
 			dead = dead[:0]
+			now := time.Now()
 			for _, m := range h.mems {
-				if h.tick-m.tick >= h.kill {
+				if m.detect != nil && len(m.detect.samples) > 0 {
+					if m.detect.phi(now, h.beat, h.jitter) >= h.phi {
+						dead = append(dead, m.id)
+					}
+				} else if h.tick-m.tick >= h.kill {
 					dead = append(dead, m.id)
 				}
 			}
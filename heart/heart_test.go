@@ -127,3 +127,62 @@ func TestHeart(t *testing.T) {
 	}
 	call.assertDead(t, 1)
 }
+
+func TestAdaptive(t *testing.T) {
+	// Some predefined ids
+	alice := big.NewInt(314)
+	bob := big.NewInt(241)
+
+	// Heartbeat parameters
+	beat := time.Duration(25 * time.Millisecond)
+	kill := 100
+	call := &testCallback{dead: []*big.Int{}}
+
+	// Create an adaptive heartbeat mechanism and monitor some entities
+	heart := New(beat, kill, call)
+	heart.SetAdaptive(8, 10, 5*time.Millisecond)
+
+	if err := heart.Monitor(alice); err != nil {
+		t.Fatalf("failed to monitor alice: %v.", err)
+	}
+	if err := heart.Monitor(bob); err != nil {
+		t.Fatalf("failed to monitor bob: %v.", err)
+	}
+	heart.Start()
+	defer heart.Terminate()
+
+	// Ping both regularly, make sure neither is suspected
+	for i := 0; i < 10; i++ {
+		time.Sleep(beat)
+		heart.Ping(alice)
+		heart.Ping(bob)
+	}
+	for _, id := range []*big.Int{alice, bob} {
+		if phi, err := heart.Phi(id); err != nil || phi > 1 {
+			t.Fatalf("live entity %v suspicion mismatch: have %v/%v, want <= 1.", id, phi, err)
+		}
+	}
+	call.assertDead(t, 0)
+
+	// Silence alice and make sure she's reported long before the kill count
+	for i := 0; i < 10; i++ {
+		time.Sleep(beat)
+		heart.Ping(bob)
+	}
+	call.lock.RLock()
+	if len(call.dead) == 0 || call.dead[0].Cmp(alice) != 0 {
+		call.lock.RUnlock()
+		t.Fatalf("dead entity mismatch: have %v, want [%v].", call.dead, alice)
+	}
+	for _, id := range call.dead {
+		if id.Cmp(bob) == 0 {
+			call.lock.RUnlock()
+			t.Fatalf("live entity reported dead: %v.", bob)
+		}
+	}
+	call.lock.RUnlock()
+
+	if phi, err := heart.Phi(alice); err != nil || phi < 8 {
+		t.Fatalf("silent entity suspicion mismatch: have %v/%v, want >= 8.", phi, err)
+	}
+}
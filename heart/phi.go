@@ -0,0 +1,86 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the adaptive (phi accrual) failure detector: instead of a
+// fixed number of missed beats, the inter-arrival times of each entity's pings
+// are sampled, and an entity is reported dead once the suspicion level phi of
+// the current silence exceeds a threshold. Jittery links thus get more leeway,
+// while failures on stable links are still detected promptly.
+
+package heart
+
+import (
+	"math"
+	"time"
+)
+
+// Sliding window of ping inter-arrival times of a single entity.
+type detector struct {
+	samples []float64 // Inter-arrival times in the window (ns)
+	next    int       // Index of the next sample to overwrite when full
+	last    time.Time // Time of the last recorded activity
+}
+
+// Creates a failure detector, starting from the given activity time.
+func newDetector(now time.Time) *detector {
+	return &detector{last: now}
+}
+
+// Records a new activity, keeping at most window samples.
+func (d *detector) record(now time.Time, window int) {
+	gap := float64(now.Sub(d.last))
+	d.last = now
+
+	if len(d.samples) < window {
+		d.samples = append(d.samples, gap)
+	} else {
+		d.samples[d.next] = gap
+		d.next = (d.next + 1) % len(d.samples)
+	}
+}
+
+// Calculates the suspicion level of the silence since the last activity. Since
+// activity is expected at least once every beat, the mean is never considered
+// shorter than that, and the deviation is lower bounded to tolerate small delays.
+func (d *detector) phi(now time.Time, beat, deviation time.Duration) float64 {
+	if len(d.samples) == 0 {
+		return 0
+	}
+	// Estimate the distribution of the inter-arrival times
+	mean, vari := 0.0, 0.0
+	for _, sample := range d.samples {
+		mean += sample
+	}
+	mean /= float64(len(d.samples))
+	for _, sample := range d.samples {
+		vari += (sample - mean) * (sample - mean)
+	}
+	std := math.Sqrt(vari / float64(len(d.samples)))
+
+	mean = math.Max(mean, float64(beat))
+	std = math.Max(std, float64(deviation))
+
+	// Logistic approximation of the normal CDF's tail (as used by Akka)
+	y := (float64(now.Sub(d.last)) - mean) / std
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if y > 0 {
+		return -math.Log10(e / (1 + e))
+	}
+	return -math.Log10(1 - 1/(1+e))
+}
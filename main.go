@@ -22,6 +22,7 @@ package main
 import (
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
 	"flag"
@@ -33,8 +34,10 @@ import (
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
+	"strconv"
 	"strings"
 
+	"github.com/karalabe/iris/config"
 	"github.com/karalabe/iris/proto/iris"
 	"github.com/karalabe/iris/service/relay"
 )
@@ -42,8 +45,31 @@ import (
 // Command line flags
 var devMode = flag.Bool("dev", false, "start in local developer mode (random cluster and key)")
 var relayPort = flag.Int("port", 55555, "relay endpoint for locally connecting clients")
+var wsAddress = flag.String("ws", "", "WebSocket relay endpoint (host:port) for browser and remote clients (empty to disable)")
+var unixPath = flag.String("unix", "", "Unix domain socket relay endpoint for co-located clients (empty to disable)")
+var unixMode = flag.String("unixmode", "0600", "file permissions (octal) of the Unix domain socket endpoint")
+var tlsAddress = flag.String("tls", "", "TLS relay endpoint (host:port) for clients on other hosts (empty to disable)")
+var tlsCert = flag.String("tlscert", "", "path to the PEM certificate (chain) of the TLS relay endpoint")
+var tlsKey = flag.String("tlskey", "", "path to the PEM private key of the TLS relay endpoint")
+var statAddress = flag.String("status", "", "HTTP status endpoint (host:port) reporting the relay state as JSON (empty to disable)")
+var authFile = flag.String("auth", "", "path to the credentials file of the relay clients (empty for open access)")
+var aclFile = flag.String("acl", "", "path to the access control lists of the relay client identities (empty for unrestricted)")
+var opLogRate = flag.Float64("oplog", 0, "fraction of the relay operations to log, payloads redacted (0 to disable)")
 var clusterName = flag.String("net", "", "name of the cluster to join or create")
 var rsaKeyPath = flag.String("rsa", "", "path to the RSA private key to use for data security")
+var extraNets = flag.String("nets", "", "comma separated additional networks (name=rsa key path) clients may join as cluster@name")
+var validate = flag.Bool("validate", false, "validate the node configuration and exit")
+var fipsMode = flag.Bool("fips", false, "restrict the crypto primitives to a FIPS approved set")
+var cipherSuite = flag.String("suite", "", "session cipher suite override (aes-ctr or chacha20)")
+var natMapping = flag.Bool("nat", false, "map the listener ports on a UPnP or NAT-PMP gateway")
+var stunServers = flag.String("stun", "", "comma separated STUN servers to discover the public address with")
+var holePunch = flag.Bool("punch", false, "hole punch towards unreachable peers via overlay rendezvous")
+var seedNodes = flag.String("seeds", "", "comma separated seed nodes (host:port) to join through")
+var seedFile = flag.String("seedfile", "", "path to a file listing seed nodes, one host:port per line")
+var multicast = flag.String("mcast", config.BootMulticast, "multicast group to discover LAN peers through (empty to disable)")
+var stateFile = flag.String("state", "", "path to persist the node id and known peers in across restarts")
+var verifyIds = flag.Bool("verifyids", false, "derive node ids from per-node keys and verify those of peers")
+var noProbe = flag.Bool("noprobe", false, "disable port probing, relying on multicast and seed discovery")
 
 var cpuProfile = flag.String("cpuprof", "", "path to CPU profiling results")
 var blockProfile = flag.String("blockprof", "", "path to lock contention profiling results")
@@ -52,7 +78,8 @@ var blockProfile = flag.String("blockprof", "", "path to lock contention profili
 func usage() {
 	fmt.Printf("Server node of the Iris decentralized messaging framework.\n\n")
 	fmt.Printf("Usage:\n\n")
-	fmt.Printf("\t%s [options]\n\n", os.Args[0])
+	fmt.Printf("\t%s [options]\n", os.Args[0])
+	fmt.Printf("\t%s decode [options]\n\n", os.Args[0])
 
 	fmt.Printf("The options are:\n\n")
 	flag.VisitAll(func(f *flag.Flag) {
@@ -76,18 +103,76 @@ func usage() {
 }
 
 // Parses the command line flags and checks their validity
-func parseFlags() (int, string, *rsa.PrivateKey) {
+func parseFlags() (int, string, *rsa.PrivateKey, map[string]*rsa.PrivateKey) {
 	var rsaKey *rsa.PrivateKey
 
 	// Read the command line arguments
 	flag.Usage = usage
 	flag.Parse()
 
+	// Reject invalid configurations before anything else, exiting if only a check was requested
+	if *fipsMode {
+		config.EnableFips()
+	}
+	if *cipherSuite != "" {
+		config.SessionSuite = *cipherSuite
+	}
+	if *natMapping {
+		config.PastryNatMapping = true
+	}
+	if *stunServers != "" {
+		config.PastryStunServers = strings.Split(*stunServers, ",")
+	}
+	if *holePunch {
+		config.PastryHolePunch = true
+	}
+	if *seedNodes != "" {
+		config.BootSeeds = strings.Split(*seedNodes, ",")
+	}
+	config.BootMulticast = *multicast
+	if *noProbe {
+		config.BootProbing = false
+	}
+	if *verifyIds {
+		config.PastryVerifyIds = true
+	}
+	if *stateFile != "" {
+		config.PastryStateFile = *stateFile
+	}
+	if *seedFile != "" {
+		config.BootSeedFile = *seedFile
+	}
+	if err := config.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n")
+		for _, ferr := range err.(config.ValidationError) {
+			fmt.Fprintf(os.Stderr, "\t%v\n", ferr)
+		}
+		os.Exit(-1)
+	}
+	if *validate {
+		fmt.Printf("Configuration valid.\n")
+		os.Exit(0)
+	}
 	// Check the relay port range
 	if *relayPort <= 0 || *relayPort >= 65536 {
 		fmt.Fprintf(os.Stderr, "Invalid relay port: have %v, want [1-65535].\n", *relayPort)
 		os.Exit(-1)
 	}
+	// Check the Unix socket permissions
+	if _, err := strconv.ParseUint(*unixMode, 8, 32); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid Unix socket permissions: have %v, want octal mode.\n", *unixMode)
+		os.Exit(-1)
+	}
+	// Check that the TLS endpoint has its certificate
+	if *tlsAddress != "" && (*tlsCert == "" || *tlsKey == "") {
+		fmt.Fprintf(os.Stderr, "TLS endpoint requires both a certificate (-tlscert) and a key (-tlskey).\n")
+		os.Exit(-1)
+	}
+	// Check the operation log sampling rate
+	if *opLogRate < 0 || *opLogRate > 1 {
+		fmt.Fprintf(os.Stderr, "Invalid operation log rate: have %v, want [0-1].\n", *opLogRate)
+		os.Exit(-1)
+	}
 	// User random cluster id and RSA key in developer mode
 	if *devMode {
 		// Generate a secure RSA key
@@ -115,35 +200,59 @@ func parseFlags() (int, string, *rsa.PrivateKey) {
 			fmt.Fprintf(os.Stderr, "No RSA key specified (-rsa), did you intend developer mode (-dev)?\n")
 			os.Exit(-1)
 		}
-		if rsaData, err := ioutil.ReadFile(*rsaKeyPath); err != nil {
-			fmt.Fprintf(os.Stderr, "Reading RSA key failed: %v.\n", err)
-			os.Exit(-1)
-		} else {
-			// Try processing as PEM format
-			if block, _ := pem.Decode(rsaData); block != nil {
-				if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
-					fmt.Fprintf(os.Stderr, "Parsing RSA key from PEM format failed: %v.\n", err)
-					os.Exit(-1)
-				} else {
-					rsaKey = key
-				}
-			} else {
-				// Give it a shot as simple binary DER
-				if key, err := x509.ParsePKCS1PrivateKey(rsaData); err != nil {
-					fmt.Fprintf(os.Stderr, "Failed to parse RSA key from both PEM and DER format.\n")
-					os.Exit(-1)
-				} else {
-					rsaKey = key
-				}
+		rsaKey = loadRsaKey(*rsaKeyPath)
+	}
+	// Load the keys of the additional networks to serve
+	extras := make(map[string]*rsa.PrivateKey)
+	if *extraNets != "" {
+		for _, spec := range strings.Split(*extraNets, ",") {
+			parts := strings.SplitN(spec, "=", 2)
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				fmt.Fprintf(os.Stderr, "Invalid additional network: have %v, want name=rsa key path.\n", spec)
+				os.Exit(-1)
 			}
+			if _, ok := extras[parts[0]]; ok || parts[0] == *clusterName {
+				fmt.Fprintf(os.Stderr, "Duplicate network: %v.\n", parts[0])
+				os.Exit(-1)
+			}
+			extras[parts[0]] = loadRsaKey(parts[1])
 		}
 	}
-	return *relayPort, *clusterName, rsaKey
+	return *relayPort, *clusterName, rsaKey, extras
+}
+
+// Loads an RSA private key in either PEM or DER format, exiting on failure.
+func loadRsaKey(path string) *rsa.PrivateKey {
+	rsaData, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Reading RSA key failed: %v.\n", err)
+		os.Exit(-1)
+	}
+	// Try processing as PEM format
+	if block, _ := pem.Decode(rsaData); block != nil {
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Parsing RSA key from PEM format failed: %v.\n", err)
+			os.Exit(-1)
+		}
+		return key
+	}
+	// Give it a shot as simple binary DER
+	key, err := x509.ParsePKCS1PrivateKey(rsaData)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to parse RSA key from both PEM and DER format.\n")
+		os.Exit(-1)
+	}
+	return key
 }
 
 func main() {
+	// Run the frame decoder developer tool if requested
+	if len(os.Args) > 1 && os.Args[1] == "decode" {
+		os.Exit(decode(os.Args[2:]))
+	}
 	// Extract the command line arguments
-	relayPort, clusterId, rsaKey := parseFlags()
+	relayPort, clusterId, rsaKey, extraKeys := parseFlags()
 
 	// Check for CPU profiling
 	if *cpuProfile != "" {
@@ -165,6 +274,7 @@ func main() {
 	}
 
 	// Create and boot a new carrier
+	log.Printf("main: preferred session cipher suite: %s (hardware aes: %v).", config.Suite(), config.HardwareAes())
 	log.Printf("main: booting iris overlay...")
 	overlay := iris.New(clusterId, rsaKey)
 	if peers, err := overlay.Boot(); err != nil {
@@ -172,9 +282,64 @@ func main() {
 	} else {
 		log.Printf("main: iris overlay converged with %v remote connections.", peers)
 	}
+	extras := make(map[string]*iris.Overlay)
+	for name, key := range extraKeys {
+		log.Printf("main: booting additional iris overlay %s...", name)
+		extra := iris.New(name, key)
+		if peers, err := extra.Boot(); err != nil {
+			log.Fatalf("main: failed to boot iris overlay %s: %v.", name, err)
+		} else {
+			log.Printf("main: iris overlay %s converged with %v remote connections.", name, peers)
+		}
+		extras[name] = extra
+	}
 	// Create and boot a new relay
 	log.Printf("main: booting relay service...")
-	rel, err := relay.New(relayPort, overlay)
+	opts := []relay.Option{}
+	for name, extra := range extras {
+		opts = append(opts, relay.WithOverlay(name, extra))
+	}
+	if *wsAddress != "" {
+		opts = append(opts, relay.WithWebSocket(*wsAddress))
+	}
+	if *unixPath != "" {
+		mode, _ := strconv.ParseUint(*unixMode, 8, 32)
+		opts = append(opts, relay.WithUnixSocket(*unixPath, os.FileMode(mode)))
+	}
+	if *tlsAddress != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatalf("main: failed to load relay TLS certificate: %v.", err)
+		}
+		opts = append(opts, relay.WithTLS(*tlsAddress, &tls.Config{Certificates: []tls.Certificate{cert}}))
+	}
+	if *statAddress != "" {
+		opts = append(opts, relay.WithStatus(*statAddress))
+	}
+	if *authFile != "" {
+		creds, err := relay.LoadCredentials(*authFile)
+		if err != nil {
+			log.Fatalf("main: failed to load relay credentials: %v.", err)
+		}
+		opts = append(opts, relay.WithAuth(creds))
+	}
+	if *aclFile != "" {
+		acls, err := relay.LoadACL(*aclFile)
+		if err != nil {
+			log.Fatalf("main: failed to load relay access control lists: %v.", err)
+		}
+		opts = append(opts, relay.WithACL(acls))
+	}
+	if *opLogRate > 0 {
+		opts = append(opts, relay.WithOpLog(log.New(os.Stderr, "", log.LstdFlags), *opLogRate))
+	}
+	if conn, err := inheritHandoff(); err != nil {
+		log.Fatalf("main: failed to inherit relay handoff socket: %v.", err)
+	} else if conn != nil {
+		log.Printf("main: taking over relay clients from predecessor...")
+		opts = append(opts, relay.WithHandoff(conn))
+	}
+	rel, err := relay.New(relayPort, overlay, opts...)
 	if err != nil {
 		log.Fatalf("main: failed to create relay service: %v.", err)
 	}
@@ -182,22 +347,43 @@ func main() {
 		log.Fatalf("main: failed to boot relay: %v.", err)
 	}
 
-	// Capture termination signals
+	// Capture termination and upgrade signals
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt)
 
+	handoff := make(chan os.Signal, 1)
+	if len(upgradeSignals) > 0 {
+		signal.Notify(handoff, upgradeSignals...)
+	}
 	// Report success
 	log.Printf("main: iris successfully booted, listening on port %d.", relayPort)
 
-	// Wait for termination request, clean up and exit
-	<-quit
-	log.Printf("main: terminating relay service...")
-	if err := rel.Terminate(); err != nil {
-		log.Printf("main: failed to terminate relay service: %v.", err)
+	// Wait for termination or a successful handoff request, clean up and exit
+	for done := false; !done; {
+		select {
+		case <-quit:
+			log.Printf("main: draining relay service...")
+			if err := rel.Drain("node shutting down"); err != nil {
+				log.Printf("main: failed to terminate relay service: %v.", err)
+			}
+			done = true
+		case <-handoff:
+			log.Printf("main: handing relay clients off to upgraded binary...")
+			if err := upgrade(rel); err != nil {
+				log.Printf("main: relay handoff failed, continuing: %v.", err)
+			} else {
+				done = true
+			}
+		}
 	}
 	log.Printf("main: terminating carrier...")
 	if err := overlay.Shutdown(); err != nil {
 		log.Printf("main: failed to shutdown iris overlay: %v.", err)
 	}
+	for name, extra := range extras {
+		if err := extra.Shutdown(); err != nil {
+			log.Printf("main: failed to shutdown iris overlay %s: %v.", name, err)
+		}
+	}
 	log.Printf("main: iris terminated.")
 }
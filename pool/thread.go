@@ -118,6 +118,14 @@ func (t *ThreadPool) Clear() {
 	t.tasks.Reset()
 }
 
+// Returns the number of tasks waiting for an idle worker.
+func (t *ThreadPool) Pending() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.tasks.Size()
+}
+
 // Runs an initial task, fetching new ones until available.
 func (t *ThreadPool) runner(task Task) {
 	// Make sure the idle count is incremented back even if we panic
@@ -242,3 +242,33 @@ func TestTerminate(t *testing.T) {
 		}
 	}
 }
+
+// Tests that the pending task count tracks the tasks waiting for a worker.
+func TestPending(t *testing.T) {
+	t.Parallel()
+
+	workers := 4
+	block := make(chan struct{})
+
+	// Schedule more work than workers before starting
+	pool := NewThreadPool(workers)
+	for i := 0; i < workers*2; i++ {
+		if err := pool.Schedule(func() { <-block }); err != nil {
+			t.Fatalf("failed to schedule task: %v.", err)
+		}
+	}
+	if pend := pool.Pending(); pend != workers*2 {
+		t.Fatalf("pending mismatch before start: have %d, want %d.", pend, workers*2)
+	}
+	// Start the pool and check that only the excess remains queued
+	pool.Start()
+	if pend := pool.Pending(); pend != workers {
+		t.Fatalf("pending mismatch after start: have %d, want %d.", pend, workers)
+	}
+	close(block)
+	pool.Terminate(false)
+
+	if pend := pool.Pending(); pend != 0 {
+		t.Fatalf("pending mismatch after termination: have %d, want %d.", pend, 0)
+	}
+}
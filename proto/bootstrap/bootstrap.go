@@ -21,15 +21,21 @@
 // the local network (single interface) for other running instances.
 //
 // In every scanning cycle all configured UDP ports are checked (to prevent
-// slowdowns due to large config space).
+// slowdowns due to large config space). If none of them are free, a port of 0
+// binds an ephemeral one instead, which others won't scan for, but still learn
+// about from the probes and multicast beacons sent from it.
 //
 // Since the heartbeats are on UDP, each one is flagged as a beat request or
 // response (i.e. reply to requests, but don't loop indefinitely).
+//
+// On multicast capable interfaces beacons are also sent to a LAN group, which
+// finds peers regardless of their ports, and allows disabling probing entirely.
 package bootstrap
 
 import (
 	"bytes"
 	"fmt"
+	"log"
 	"math/big"
 	"math/rand"
 	"net"
@@ -66,13 +72,20 @@ type Bootstrapper struct {
 	mask *net.IPMask
 
 	magic    []byte // Filters side-by-side Iris networks
+	ports    []int  // Bootstrap ports to listen on and scan
 	request  []byte // Pre-generated request packet
 	response []byte // Pre-generated response packet
 
+	mcast  *net.UDPConn // Multicast group listener (nil if unavailable)
+	group  *net.UDPAddr // Multicast group to send the beacons to
+	digest []byte       // Hash of the magic, identifying the overlay in beacons
+	beacon []byte       // Pre-generated multicast beacon packet
+
 	gob *gobber.Gobber // Datagram gobber to decode the network messages
 
 	beats chan *Event     // Channel on which to report bootstrap events
 	quit  chan chan error // Quit channel to synchronize bootstrapper termination
+	tasks int             // Number of routines to synchronize on termination
 
 	fast bool
 }
@@ -82,14 +95,25 @@ type Bootstrapper struct {
 // is used to filter multiple Iris networks in the same physical network, while
 // the overlay is the TCP listener port of the DHT.
 func New(ipnet *net.IPNet, magic []byte, node *big.Int, overlay int) (*Bootstrapper, chan *Event, error) {
+	ports, err := config.ParsePorts(config.BootPorts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return NewPorts(ipnet, magic, node, overlay, ports)
+}
+
+// Creates a new bootstrapper similarly to New, but listening on and scanning an
+// explicit set of ports instead of the globally configured ones.
+func NewPorts(ipnet *net.IPNet, magic []byte, node *big.Int, overlay int, ports []int) (*Bootstrapper, chan *Event, error) {
 	bs := &Bootstrapper{
 		magic: magic,
+		ports: ports,
 		beats: make(chan *Event, config.BootBeatsBuffer),
 		fast:  true,
 	}
 	// Open the server socket
 	var err error
-	for _, port := range config.BootPorts {
+	for _, port := range bs.ports {
 		bs.addr, err = net.ResolveUDPAddr("udp", net.JoinHostPort(ipnet.IP.String(), strconv.Itoa(port)))
 		if err != nil {
 			return nil, nil, err
@@ -100,6 +124,9 @@ func New(ipnet *net.IPNet, magic []byte, node *big.Int, overlay int) (*Bootstrap
 		} else {
 			bs.addr.Port = bs.sock.LocalAddr().(*net.UDPAddr).Port
 			bs.mask = &ipnet.Mask
+			if port == 0 {
+				log.Printf("bootstrap: no configured port free on %v, bound ephemeral %d.", ipnet.IP, bs.addr.Port)
+			}
 			break
 		}
 	}
@@ -132,17 +159,30 @@ func New(ipnet *net.IPNet, magic []byte, node *big.Int, overlay int) (*Bootstrap
 		bs.response = make([]byte, len(buf))
 		copy(bs.response, buf)
 	}
+	// Join the multicast group if available (probing still covers the interface)
+	if err := bs.multicast(msg); err != nil {
+		log.Printf("bootstrap: failed to join multicast group: %v.", err)
+	}
 	// Return the ready-to-boot bootstrapper
 	return bs, bs.beats, nil
 }
 
 // Starts accepting bootstrap events and initiates peer discovery.
 func (bs *Bootstrapper) Boot() error {
-	bs.quit = make(chan chan error, 3)
+	bs.quit = make(chan chan error, 5)
 
+	bs.tasks = 1
 	go bs.accept()
-	go bs.probe()
-	go bs.scan()
+	if config.BootProbing {
+		bs.tasks += 2
+		go bs.probe()
+		go bs.scan()
+	}
+	if bs.mcast != nil {
+		bs.tasks += 2
+		go bs.listen()
+		go bs.announce()
+	}
 
 	return nil
 }
@@ -153,8 +193,8 @@ func (bs *Bootstrapper) Terminate() error {
 	if bs.quit == nil {
 		return fmt.Errorf("non-booted bootstrapper")
 	}
-	// Retrieve three errors for the acceptor, prober and scanner routines
-	errc := make([]chan error, 3)
+	// Retrieve an error from each of the running routines
+	errc := make([]chan error, bs.tasks)
 	errs := []error{}
 	for i := 0; i < len(errc); i++ {
 		errc[i] = make(chan error, 1)
@@ -165,6 +205,8 @@ func (bs *Bootstrapper) Terminate() error {
 			errs = append(errs, err)
 		}
 	}
+	close(bs.beats)
+
 	// Report the errors and return
 	switch len(errs) {
 	case 0:
@@ -220,7 +262,6 @@ func (bs *Bootstrapper) accept() {
 		}
 	}
 	// Clean up resources and report results
-	close(bs.beats)
 	errc <- bs.sock.Close()
 }
 
@@ -248,8 +289,11 @@ func (bs *Bootstrapper) probe() {
 					subip >>= 8
 				}
 			}
-			// Iterate over every bootstrap port
-			for _, port := range config.BootPorts {
+			// Iterate over every bootstrap port (ephemeral ones can't be probed)
+			for _, port := range bs.ports {
+				if port == 0 {
+					continue
+				}
 				dest := net.JoinHostPort(host.String(), strconv.Itoa(port))
 
 				// Resolve the address, connect to it and send a beat request
@@ -325,9 +369,9 @@ func (bs *Bootstrapper) scan() {
 				scanip >>= 8
 			}
 			// Iterate over every bootstrap port
-			for _, port := range config.BootPorts {
-				// Don't connect to ourselves
-				if port == bs.addr.Port && host.Equal(bs.addr.IP) {
+			for _, port := range bs.ports {
+				// Don't connect to ourselves (nor to ephemeral ports)
+				if port == 0 || port == bs.addr.Port && host.Equal(bs.addr.IP) {
 					continue
 				}
 				dest := net.JoinHostPort(host.String(), strconv.Itoa(port))
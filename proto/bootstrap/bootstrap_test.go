@@ -21,8 +21,10 @@ package bootstrap
 
 import (
 	"github.com/karalabe/iris/config"
+	"io/ioutil"
 	"math/big"
 	"net"
+	"os"
 	"testing"
 	"time"
 )
@@ -156,3 +158,159 @@ func TestMagic(t *testing.T) {
 
 // Missing test for probing. A bit complicated as a small subnet is needed with
 // scanning disabled. Delay for now.
+
+func TestSeeds(t *testing.T) {
+	// Write a seed file with some comments and blank lines
+	file, err := ioutil.TempFile("", "iris-seeds")
+	if err != nil {
+		t.Fatalf("failed to create seed file: %v.", err)
+	}
+	defer os.Remove(file.Name())
+
+	file.WriteString("# Seed nodes\n127.0.0.1:20001\n\n  127.0.0.1:20002  # trailing comment\n")
+	file.Close()
+
+	// Swap out the seed configuration
+	seeds, seedFile := config.BootSeeds, config.BootSeedFile
+	defer func() { config.BootSeeds, config.BootSeedFile = seeds, seedFile }()
+
+	config.BootSeeds = []string{"127.0.0.1:20000", "invalid seed"}
+	config.BootSeedFile = file.Name()
+
+	// Make sure all valid seeds are collected
+	addrs, err := Seeds()
+	if err != nil {
+		t.Fatalf("failed to collect seeds: %v.", err)
+	}
+	if len(addrs) != 3 {
+		t.Fatalf("seed count mismatch: have %v, want %v.", len(addrs), 3)
+	}
+	for i, addr := range addrs {
+		if !addr.IP.Equal(net.IPv4(127, 0, 0, 1)) || addr.Port != 20000+i {
+			t.Fatalf("seed %d mismatch: have %v, want 127.0.0.1:%d.", i, addr, 20000+i)
+		}
+	}
+	// Make sure a missing seed file is reported
+	config.BootSeedFile = file.Name() + ".missing"
+	if _, err := Seeds(); err == nil {
+		t.Fatalf("missing seed file accepted.")
+	}
+}
+
+func TestMulticast(t *testing.T) {
+	// Find a multicast capable interface to test on
+	var ipnet *net.IPNet
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if in, ok := addr.(*net.IPNet); ok && multicastInterface(in.IP) != nil {
+				ipnet = in
+				break
+			}
+		}
+	}
+	if ipnet == nil {
+		t.Skip("no multicast capable interface found.")
+	}
+	// Disable probing to rely on the beacons only
+	probing := config.BootProbing
+	config.BootProbing = false
+	defer func() { config.BootProbing = probing }()
+
+	// Start up two bootstrappers on unrelated ports
+	bs1, evs1, err := NewPorts(ipnet, []byte("magic"), big.NewInt(1), 33333, []int{40001})
+	if err != nil {
+		t.Fatalf("failed to create first booter: %v.", err)
+	}
+	if err := bs1.Boot(); err != nil {
+		t.Fatalf("failed to boot first booter: %v.", err)
+	}
+	defer bs1.Terminate()
+
+	bs2, evs2, err := NewPorts(ipnet, []byte("magic"), big.NewInt(2), 55555, []int{40002})
+	if err != nil {
+		t.Fatalf("failed to create second booter: %v.", err)
+	}
+	if err := bs2.Boot(); err != nil {
+		t.Fatalf("failed to boot second booter: %v.", err)
+	}
+	defer bs2.Terminate()
+
+	// Make sure they found each other and not themselves
+	timeout := time.After(time.Second)
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-evs1:
+			if e.Peer.Int64() != 2 || e.Addr.Port != 55555 {
+				t.Fatalf("invalid peer on first booter: have %v/%v, want %v/%v.", e.Peer, e.Addr.Port, 2, 55555)
+			}
+		case e := <-evs2:
+			if e.Peer.Int64() != 1 || e.Addr.Port != 33333 {
+				t.Fatalf("invalid peer on second booter: have %v/%v, want %v/%v.", e.Peer, e.Addr.Port, 1, 33333)
+			}
+		case <-timeout:
+			t.Fatalf("beacon discovery timed out.")
+		}
+	}
+}
+
+func TestEphemeralPort(t *testing.T) {
+	// Define some local constants
+	over1, _ := net.ResolveTCPAddr("tcp", "127.0.0.3:33333")
+	over2, _ := net.ResolveTCPAddr("tcp", "127.0.0.5:55555")
+	ipnet1 := &net.IPNet{
+		IP:   over1.IP,
+		Mask: over1.IP.DefaultMask(),
+	}
+	ipnet2 := &net.IPNet{
+		IP:   over2.IP,
+		Mask: over2.IP.DefaultMask(),
+	}
+	// Occupy the only fixed port on the second interface
+	ports := []int{14142, 0}
+	busy, err := net.ListenUDP("udp", &net.UDPAddr{IP: over2.IP, Port: ports[0]})
+	if err != nil {
+		t.Fatalf("failed to occupy bootstrap port: %v.", err)
+	}
+	defer busy.Close()
+
+	// Start up two bootstrappers, the second falling back to an ephemeral port
+	bs1, evs1, err := NewPorts(ipnet1, []byte("magic"), big.NewInt(1), over1.Port, ports)
+	if err != nil {
+		t.Fatalf("failed to create first booter: %v.", err)
+	}
+	if err := bs1.Boot(); err != nil {
+		t.Fatalf("failed to boot first booter: %v.", err)
+	}
+	defer bs1.Terminate()
+
+	bs2, evs2, err := NewPorts(ipnet2, []byte("magic"), big.NewInt(2), over2.Port, ports)
+	if err != nil {
+		t.Fatalf("failed to create second booter: %v.", err)
+	}
+	if bs2.addr.Port == ports[0] || bs2.addr.Port == 0 {
+		t.Fatalf("ephemeral port mismatch: have %v.", bs2.addr.Port)
+	}
+	if err := bs2.Boot(); err != nil {
+		t.Fatalf("failed to boot second booter: %v.", err)
+	}
+	defer bs2.Terminate()
+
+	// The ephemeral one should still find and be found by the fixed one
+	timeout := time.After(time.Second)
+	select {
+	case e1 := <-evs1:
+		if !e1.Addr.IP.Equal(over2.IP) || e1.Addr.Port != over2.Port {
+			t.Fatalf("invalid address on first booter: have %v, want %v.", e1.Addr, over2)
+		}
+	case <-timeout:
+		t.Fatalf("first booter didn't find the ephemeral one.")
+	}
+	select {
+	case e2 := <-evs2:
+		if !e2.Addr.IP.Equal(over1.IP) || e2.Addr.Port != over1.Port {
+			t.Fatalf("invalid address on second booter: have %v, want %v.", e2.Addr, over1)
+		}
+	case <-timeout:
+		t.Fatalf("ephemeral booter didn't find the first one.")
+	}
+}
@@ -0,0 +1,170 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the multicast discovery mode: beacons carrying a hash of
+// the overlay id are periodically sent to a LAN multicast group, letting nodes
+// find each other instantly, regardless of the bootstrap ports they bound.
+
+package bootstrap
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Finds the multicast capable network interface owning the given IPv4 address,
+// or nil if there is none.
+func multicastInterface(ip net.IP) *net.Interface {
+	if ip.To4() == nil || ip.IsLoopback() {
+		return nil
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	for i, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+				return &ifaces[i]
+			}
+		}
+	}
+	return nil
+}
+
+// Joins the configured multicast group on the bootstrapper's interface and
+// generates the beacon packet. Interfaces incapable of multicasting (or with it
+// disabled) are silently skipped.
+func (bs *Bootstrapper) multicast(msg Message) error {
+	if config.BootMulticast == "" {
+		return nil
+	}
+	iface := multicastInterface(bs.addr.IP)
+	if iface == nil {
+		return nil
+	}
+	group, err := net.ResolveUDPAddr("udp4", config.BootMulticast)
+	if err != nil {
+		return err
+	}
+	mcast, err := net.ListenMulticastUDP("udp4", iface, group)
+	if err != nil {
+		return err
+	}
+	bs.group = group
+
+	// Beacons carry the hash of the magic, not the overlay id itself
+	digest := sha256.Sum256(bs.magic)
+	bs.digest = digest[:]
+
+	msg.Magic, msg.Request = bs.digest, true
+	buf, err := bs.gob.Encode(msg)
+	if err != nil {
+		mcast.Close()
+		return fmt.Errorf("beacon encode failed: %v.", err)
+	}
+	bs.beacon = make([]byte, len(buf))
+	copy(bs.beacon, buf)
+	bs.mcast = mcast
+
+	return nil
+}
+
+// Multicast beacon acceptor routine. Beacons of the same overlay are answered
+// with a unicast heartbeat response (as if they were probes) and reported to
+// the maintenance thread.
+func (bs *Bootstrapper) listen() {
+	buf := make([]byte, 1500) // UDP MTU
+	var errc chan error
+
+	// Repeat the packet processing until termination is requested
+	for errc == nil {
+		select {
+		case errc = <-bs.quit:
+			break
+		default:
+			// Wait for a UDP packet (with a reasonable timeout)
+			bs.mcast.SetReadDeadline(time.Now().Add(acceptTimeout))
+			size, from, err := bs.mcast.ReadFromUDP(buf)
+			if err != nil {
+				continue
+			}
+			// Discard our own beacons looped back
+			if from.Port == bs.addr.Port && from.IP.Equal(bs.addr.IP) {
+				continue
+			}
+			msg := new(Message)
+			if err := bs.gob.Decode(buf[:size], msg); err != nil {
+				continue
+			}
+			if config.ProtocolVersion != msg.Version || !msg.Request || !bytes.Equal(bs.digest, msg.Magic) {
+				continue
+			}
+			// Answer the beacon directly and notify the maintenance routine
+			bs.sock.WriteToUDP(bs.response, from)
+
+			host := net.JoinHostPort(from.IP.String(), strconv.Itoa(msg.Overlay))
+			if addr, err := net.ResolveTCPAddr("tcp", host); err == nil {
+				bs.beats <- &Event{
+					Peer: msg.NodeId,
+					Addr: addr,
+					Resp: false,
+				}
+			}
+		}
+	}
+	// Clean up resources and report results
+	errc <- bs.mcast.Close()
+}
+
+// Periodically sends the beacon to the multicast group from the unicast socket,
+// so that responses arrive through the standard acceptor.
+func (bs *Bootstrapper) announce() {
+	var errc chan error
+	for errc == nil {
+		bs.sock.WriteToUDP(bs.beacon, bs.group)
+
+		// Wait for the next cycle
+		var wake <-chan time.Time
+		if bs.fast {
+			wake = time.After(time.Duration(config.BootFastProbe) * time.Millisecond)
+		} else {
+			wake = time.After(time.Duration(config.BootSlowProbe) * time.Millisecond)
+		}
+		select {
+		case errc = <-bs.quit:
+		case <-wake:
+		}
+	}
+	// Report termination
+	errc <- nil
+}
@@ -0,0 +1,78 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the static seed list, complementing the local network
+// probing with explicitly configured overlay nodes (i.e. for WAN deployments).
+
+package bootstrap
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Collects the seed nodes from the configured list and seed file (one host:port
+// per line, blank lines and # comments ignored), resolving each. Unresolvable
+// seeds are skipped, only a failure to read the file is reported.
+func Seeds() ([]*net.TCPAddr, error) {
+	return SeedsFrom(config.BootSeeds, config.BootSeedFile)
+}
+
+// Collects the seed nodes similarly to Seeds, but from an explicit list and seed
+// file (empty for none) instead of the globally configured ones.
+func SeedsFrom(list []string, path string) ([]*net.TCPAddr, error) {
+	seeds := append([]string{}, list...)
+	if path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if i := strings.Index(line, "#"); i >= 0 {
+				line = line[:i]
+			}
+			if line = strings.TrimSpace(line); line != "" {
+				seeds = append(seeds, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read seed file: %v", err)
+		}
+	}
+	addrs := make([]*net.TCPAddr, 0, len(seeds))
+	for _, seed := range seeds {
+		addr, err := net.ResolveTCPAddr("tcp", seed)
+		if err != nil {
+			log.Printf("bootstrap: failed to resolve seed %v: %v.", seed, err)
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
@@ -0,0 +1,157 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Package decrypt contains a receive side helper pipeline, which takes the
+// messages arriving on a link and decrypts their payloads concurrently on a
+// pool of workers, handing them upstream in the exact order they arrived.
+//
+// Since the link layer only authenticates and the payload crypto is left to
+// the caller, running it on the goroutine consuming the link would serialize
+// all the heavy lifting of a connection on a single core.
+package decrypt
+
+import (
+	"log"
+	"sync"
+
+	"github.com/karalabe/iris/pool"
+	"github.com/karalabe/iris/proto"
+)
+
+// A single message in flight, waiting to be decrypted.
+type slot struct {
+	msg  *proto.Message // Message being decrypted
+	err  error          // Failure (if any) during decryption
+	done chan struct{}  // Channel to signal decryption completion
+}
+
+// Ordered parallel decryption pipeline.
+type Pipeline struct {
+	Sink chan *proto.Message // Channel of decrypted messages, in arrival order
+
+	source  <-chan *proto.Message // Channel of encrypted input messages
+	workers *pool.ThreadPool      // Thread pool limiting the concurrent decryptions
+	order   chan *slot            // Pending slots in their arrival order
+
+	term     chan struct{} // Channel to signal termination to blocked go-routines
+	termOnce sync.Once     // Guard against closing the termination channel twice
+	done     chan struct{} // Channel to signal the termination of the emitter
+}
+
+// Creates a new decryption pipeline fed from source, running at most threads
+// concurrent decryptions with up to buffer messages in flight.
+func New(source <-chan *proto.Message, threads int, buffer int) *Pipeline {
+	return &Pipeline{
+		Sink:    make(chan *proto.Message, buffer),
+		source:  source,
+		workers: pool.NewThreadPool(threads),
+		order:   make(chan *slot, buffer),
+		term:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Starts the decryption workers, the dispatcher and the emitter.
+func (p *Pipeline) Start() {
+	p.workers.Start()
+	go p.dispatcher()
+	go p.emitter()
+}
+
+// Terminates the pipeline, dropping any messages still in flight. The sink is
+// closed afterwards. Closing an already closed pipeline is a no-op.
+func (p *Pipeline) Close() error {
+	// Signal the termination to all blocked go-routines
+	p.termOnce.Do(func() { close(p.term) })
+
+	// Wait for the emitter to quit, and drain the slots until the dispatcher does
+	<-p.done
+	for _ = range p.order {
+	}
+
+	// Wait for all pending decryptions to finish
+	p.workers.Terminate(true)
+	return nil
+}
+
+// Fetches the messages arriving on the source channel and schedules them for
+// decryption, queuing up the matching slots in arrival order.
+func (p *Pipeline) dispatcher() {
+	defer close(p.order)
+
+	for {
+		select {
+		case <-p.term:
+			return
+		case msg, ok := <-p.source:
+			// Source closed, flush and terminate
+			if !ok {
+				return
+			}
+			s := &slot{
+				msg:  msg,
+				done: make(chan struct{}),
+			}
+			// Schedule the decryption, skipping messages without a secure payload
+			if msg.Head.Key == nil {
+				close(s.done)
+			} else if err := p.workers.Schedule(func() { p.decrypt(s) }); err != nil {
+				s.err = err
+				close(s.done)
+			}
+			// Queue up the slot to preserve ordering
+			select {
+			case p.order <- s:
+			case <-p.term:
+				return
+			}
+		}
+	}
+}
+
+// Decrypts the payload contained within a single slot, signalling completion.
+func (p *Pipeline) decrypt(s *slot) {
+	s.err = s.msg.Decrypt()
+	close(s.done)
+}
+
+// Waits for the pending slots to finish in order and pushes them upstream.
+func (p *Pipeline) emitter() {
+	defer close(p.done)
+	defer close(p.Sink)
+
+	for s := range p.order {
+		// Wait for the slot to finish or the pipeline to terminate
+		select {
+		case <-s.done:
+		case <-p.term:
+			return
+		}
+		// Drop any messages that failed decryption
+		if s.err != nil {
+			log.Printf("decrypt: failed to decrypt message: %v.", s.err)
+			continue
+		}
+		select {
+		case p.Sink <- s.msg:
+		case <-p.term:
+			return
+		}
+	}
+}
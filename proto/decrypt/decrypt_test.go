@@ -0,0 +1,146 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package decrypt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/proto"
+)
+
+// Creates an encrypted message with the given sequence number as the payload.
+func makeMessage(t *testing.T, seq uint32) *proto.Message {
+	data := make([]byte, 1024)
+	binary.BigEndian.PutUint32(data, seq)
+
+	msg := &proto.Message{Head: proto.Header{Meta: seq}, Data: data}
+	if err := msg.Encrypt(); err != nil {
+		t.Fatalf("failed to encrypt message: %v.", err)
+	}
+	return msg
+}
+
+// Tests that messages are decrypted and delivered in their arrival order.
+func TestOrdering(t *testing.T) {
+	t.Parallel()
+
+	source := make(chan *proto.Message, 16)
+	pipe := New(source, 8, 16)
+	pipe.Start()
+
+	// Feed a lot of encrypted messages into the pipeline
+	count := 10000
+	go func() {
+		for i := 0; i < count; i++ {
+			source <- makeMessage(t, uint32(i))
+		}
+		close(source)
+	}()
+	// Verify the order and the contents of the decrypted messages
+	for i := 0; i < count; i++ {
+		select {
+		case msg, ok := <-pipe.Sink:
+			if !ok {
+				t.Fatalf("sink closed prematurely at %d.", i)
+			}
+			if seq := msg.Head.Meta.(uint32); seq != uint32(i) {
+				t.Fatalf("message order mismatch: have %v, want %v.", seq, i)
+			}
+			want := make([]byte, 1024)
+			binary.BigEndian.PutUint32(want, uint32(i))
+			if !bytes.Equal(msg.Data, want) {
+				t.Fatalf("payload mismatch for message %d.", i)
+			}
+			if msg.Head.Key != nil || msg.Head.Iv != nil {
+				t.Fatalf("crypto headers not cleared for message %d.", i)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("sink receive timed out at %d.", i)
+		}
+	}
+	// Closing the source should close the sink too
+	select {
+	case _, ok := <-pipe.Sink:
+		if ok {
+			t.Fatalf("extra message in the sink.")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("sink not closed after source.")
+	}
+	if err := pipe.Close(); err != nil {
+		t.Fatalf("failed to close pipeline: %v.", err)
+	}
+}
+
+// Tests that plaintext messages pass through and invalid ones get dropped.
+func TestPassthrough(t *testing.T) {
+	t.Parallel()
+
+	source := make(chan *proto.Message, 3)
+	pipe := New(source, 2, 4)
+	pipe.Start()
+
+	// Feed a plaintext, a corrupt and an encrypted message
+	plain := &proto.Message{Head: proto.Header{Meta: uint32(0)}, Data: []byte("plain")}
+	corrupt := makeMessage(t, 1)
+	corrupt.Head.Key = []byte{0x00}
+
+	source <- plain
+	source <- corrupt
+	source <- makeMessage(t, 2)
+
+	for _, seq := range []uint32{0, 2} {
+		select {
+		case msg := <-pipe.Sink:
+			if have := msg.Head.Meta.(uint32); have != seq {
+				t.Fatalf("message mismatch: have %v, want %v.", have, seq)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("sink receive timed out for %d.", seq)
+		}
+	}
+	if !bytes.Equal(plain.Data, []byte("plain")) {
+		t.Fatalf("plaintext payload modified: %v.", plain.Data)
+	}
+	// Ensure the pipeline can be torn down with the source still open
+	if err := pipe.Close(); err != nil {
+		t.Fatalf("failed to close pipeline: %v.", err)
+	}
+	if _, ok := <-pipe.Sink; ok {
+		t.Fatalf("sink not closed after termination.")
+	}
+}
+
+// Tests that closing a pipeline multiple times is allowed.
+func TestDoubleClose(t *testing.T) {
+	t.Parallel()
+
+	pipe := New(make(chan *proto.Message), 2, 4)
+	pipe.Start()
+
+	for i := 0; i < 2; i++ {
+		if err := pipe.Close(); err != nil {
+			t.Fatalf("close %d: failed to close pipeline: %v.", i, err)
+		}
+	}
+}
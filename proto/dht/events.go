@@ -0,0 +1,237 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the overlay event handlers: the delivered DHT operations and the
+// membership notifications driving the replica repairs.
+
+package dht
+
+import (
+	"log"
+	"math/big"
+	"sort"
+
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto"
+	"github.com/karalabe/iris/proto/pastry"
+)
+
+// Sorts ids by ascending distance to a key in the id space of an overlay.
+type byDistance struct {
+	over *pastry.Overlay
+	key  *big.Int
+	ids  []*big.Int
+}
+
+func (s byDistance) Len() int      { return len(s.ids) }
+func (s byDistance) Swap(i, j int) { s.ids[i], s.ids[j] = s.ids[j], s.ids[i] }
+func (s byDistance) Less(i, j int) bool {
+	return s.over.Distance(s.ids[i], s.key).Cmp(s.over.Distance(s.ids[j], s.key)) < 0
+}
+
+// Collects the ids of the nodes known from a routing snapshot: the leafset along
+// with all the live neighbors (the leafset alone may be sparse while converging).
+func known(snap *pastry.Snapshot) []*big.Int {
+	ids := append([]*big.Int{}, snap.Leaves...)
+	for sid := range snap.Peers {
+		if id, ok := new(big.Int).SetString(sid, 10); ok && !contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Selects the nodes responsible for a key from the known ones: those numerically
+// closest to it, as many as the replication factor.
+func (o *Overlay) replicas(key *big.Int, nodes []*big.Int) []*big.Int {
+	ids := append([]*big.Int{}, nodes...)
+	sort.Sort(byDistance{o.pastry, key, ids})
+	if len(ids) > config.DhtReplicas {
+		ids = ids[:config.DhtReplicas]
+	}
+	return ids
+}
+
+// Checks whether an id is contained in a set.
+func contains(ids []*big.Int, id *big.Int) bool {
+	for _, other := range ids {
+		if other.Cmp(id) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Callback method for pastry, executed when a DHT operation reaches its
+// destination: the node closest to the routed key.
+func (o *Overlay) Deliver(msg *proto.Message, key *big.Int) {
+	head := msg.Head.Meta.(*header)
+	switch head.Op {
+	case opPut:
+		// Root of the key, store the value and replicate to the others responsible
+		if err := msg.Decrypt(); err != nil {
+			log.Printf("dht: failed to decrypt put: %v.", err)
+			return
+		}
+		ent := &entry{value: msg.Data, version: head.Version}
+		o.save(head.Key, ent)
+
+		self := o.pastry.Self()
+		for _, id := range o.replicas(key, known(o.pastry.Snapshot())) {
+			if id.Cmp(self) != 0 {
+				o.sendStore(id, head.Key, ent)
+			}
+		}
+	case opStore:
+		if err := msg.Decrypt(); err != nil {
+			log.Printf("dht: failed to decrypt replica: %v.", err)
+			return
+		}
+		o.save(head.Key, &entry{value: msg.Data, version: head.Version})
+
+	case opGet:
+		o.lock.RLock()
+		ent := o.store[head.Key]
+		o.lock.RUnlock()
+
+		o.sendValue(head.Sender, head.Req, ent)
+
+	case opValue:
+		if head.Found {
+			if err := msg.Decrypt(); err != nil {
+				log.Printf("dht: failed to decrypt lookup answer: %v.", err)
+				return
+			}
+		}
+		o.lock.RLock()
+		reply, ok := o.reqs[head.Req]
+		o.lock.RUnlock()
+
+		if ok {
+			select {
+			case reply <- msg:
+			default:
+				// Duplicate answer, drop
+			}
+		}
+	default:
+		log.Printf("dht: unknown opcode received: %v, %v", head.Op, head)
+	}
+}
+
+// Callback method for pastry, executed when a DHT operation passes through the
+// local node. Messages are always forwarded.
+func (o *Overlay) Forward(msg *proto.Message, key *big.Int) bool {
+	return true
+}
+
+// Stores an entry locally, unless a newer version is already present.
+func (o *Overlay) save(key string, ent *entry) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if old, ok := o.store[key]; !ok || old.version < ent.version {
+		o.store[key] = ent
+	}
+}
+
+// Implements pastry.Events.PeerJoined, the repairs are driven by the route changes.
+func (o *Overlay) PeerJoined(id *big.Int) {}
+
+// Implements pastry.Events.PeerLeft, the repairs are driven by the route changes.
+func (o *Overlay) PeerLeft(id *big.Int) {}
+
+// Implements pastry.Events.Converged, nothing to do.
+func (o *Overlay) Converged(peers int) {}
+
+// Implements pastry.Events.RouteChanged, scheduling a replica repair against the
+// new routing state. Only the latest one is kept if the repairer lags behind.
+func (o *Overlay) RouteChanged(snap *pastry.Snapshot) {
+	nodes := known(snap)
+
+	o.lock.Lock()
+	o.pending = nodes
+	o.lock.Unlock()
+
+	select {
+	case o.notify <- struct{}{}:
+		// Notification sent
+	default:
+		// Notification already pending
+	}
+}
+
+// Waits for routing changes and repairs the replicas of the local entries until
+// termination is requested.
+func (o *Overlay) repairer() {
+	for {
+		select {
+		case done := <-o.quit:
+			close(done)
+			return
+		case <-o.notify:
+			o.lock.Lock()
+			nodes := o.pending
+			o.lock.Unlock()
+
+			o.repair(nodes)
+		}
+	}
+}
+
+// Ensures that every local entry is stored at all the nodes responsible for it
+// according to the given known nodes. Nodes entering the responsible set receive
+// a copy, whilst entries the local node is no longer responsible for are handed
+// over to those that are, and dropped.
+func (o *Overlay) repair(nodes []*big.Int) {
+	o.lock.Lock()
+	prev := o.known
+	o.known = nodes
+
+	entries := make(map[string]*entry, len(o.store))
+	for key, ent := range o.store {
+		entries[key] = ent
+	}
+	o.lock.Unlock()
+
+	self := o.pastry.Self()
+	for key, ent := range entries {
+		id := o.pastry.Resolve(key)
+		now, old := o.replicas(id, nodes), o.replicas(id, prev)
+
+		// Hand the entry over if the local node isn't responsible any more
+		if !contains(now, self) {
+			for _, node := range now {
+				o.sendStore(node, key, ent)
+			}
+			o.lock.Lock()
+			if o.store[key] == ent {
+				delete(o.store, key)
+			}
+			o.lock.Unlock()
+			continue
+		}
+		// Otherwise copy to the newly responsible nodes
+		for _, node := range now {
+			if node.Cmp(self) != 0 && !contains(old, node) {
+				o.sendStore(node, key, ent)
+			}
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Package dht implements a replicated key-value store on top of the pastry
+// overlay. Each entry is stored at the nodes numerically closest to the hash of
+// its key, and handed over whenever the responsible set changes due to churn.
+package dht
+
+import (
+	"crypto/rsa"
+	"errors"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/karalabe/iris/proto"
+	"github.com/karalabe/iris/proto/pastry"
+)
+
+// Failures reported by the lookups.
+var (
+	ErrNotFound = errors.New("key not found")
+	ErrTimeout  = errors.New("lookup timeout")
+)
+
+// Value stored under a key, versioned to resolve conflicting writes.
+type entry struct {
+	value   []byte // Plaintext value of the entry
+	version int64  // Write timestamp, the latest one wins
+}
+
+// The overlay implementation, storing the entries the local node is responsible
+// for and serving the lookups routed to it.
+type Overlay struct {
+	pastry *pastry.Overlay // Overlay network to route the messages
+
+	store  map[string]*entry              // Entries replicated at the local node
+	reqs   map[uint64]chan *proto.Message // Pending lookups, keyed by request id
+	reqIdx uint64                         // Request id of the last lookup
+
+	known   []*big.Int         // Nodes the replicas were last placed according to
+	pending []*big.Int         // Most recently known nodes waiting for repairs
+	notify  chan struct{}      // Notifier for routing changes
+	quit    chan chan struct{} // Quit sync channel for the repairer
+
+	lock sync.RWMutex
+}
+
+// Creates a new DHT overlay.
+func New(overId string, key *rsa.PrivateKey) *Overlay {
+	o := &Overlay{
+		store:  make(map[string]*entry),
+		reqs:   make(map[uint64]chan *proto.Message),
+		notify: make(chan struct{}, 1), // Buffer one notification
+		quit:   make(chan chan struct{}),
+	}
+	o.pastry = pastry.New(overId, key, o)
+	o.pastry.Subscribe(o)
+	return o
+}
+
+// Returns the pastry overlay underneath, to allow configuring it before booting.
+func (o *Overlay) Pastry() *pastry.Overlay {
+	return o.pastry
+}
+
+// Boots the overlay, returning the number of remote peers.
+func (o *Overlay) Boot() (int, error) {
+	log.Printf("dht: booting with id %v.", o.pastry.Self())
+
+	go o.repairer()
+	return o.pastry.Boot()
+}
+
+// Terminates the overlay and all lower layer network primitives.
+func (o *Overlay) Shutdown() error {
+	done := make(chan struct{})
+	o.quit <- done
+	<-done
+
+	return o.pastry.Shutdown()
+}
+
+// Stores a value under the given key at the responsible nodes. The write is
+// asynchronous, a concurrent write to the same key with a later timestamp wins.
+func (o *Overlay) Put(key string, value []byte) error {
+	msg := &proto.Message{Data: append([]byte{}, value...)}
+	if err := msg.Encrypt(); err != nil {
+		return err
+	}
+	o.sendPut(o.pastry.Resolve(key), key, time.Now().UnixNano(), msg)
+	return nil
+}
+
+// Retrieves the value stored under the given key, waiting at most timeout for
+// the responsible node to answer.
+func (o *Overlay) Get(key string, timeout time.Duration) ([]byte, error) {
+	// Register the pending lookup
+	reply := make(chan *proto.Message, 1)
+
+	o.lock.Lock()
+	o.reqIdx++
+	reqId := o.reqIdx
+	o.reqs[reqId] = reply
+	o.lock.Unlock()
+
+	defer func() {
+		o.lock.Lock()
+		delete(o.reqs, reqId)
+		o.lock.Unlock()
+	}()
+	// Route the lookup to the key and wait for the answer
+	o.sendGet(o.pastry.Resolve(key), key, reqId)
+
+	select {
+	case msg := <-reply:
+		if !msg.Head.Meta.(*header).Found {
+			return nil, ErrNotFound
+		}
+		return msg.Data, nil
+	case <-time.After(timeout):
+		return nil, ErrTimeout
+	}
+}
@@ -0,0 +1,101 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the wire protocol for the DHT layer communication.
+
+package dht
+
+import (
+	"encoding/gob"
+	"log"
+	"math/big"
+
+	"github.com/karalabe/iris/proto"
+)
+
+// DHT operation code type.
+type opcode uint8
+
+// DHT operation types.
+const (
+	opPut   opcode = iota // Write routed to the key
+	opStore               // Replica placement at a responsible node
+	opGet                 // Lookup routed to the key
+	opValue               // Lookup answer
+)
+
+// Extra headers for the DHT.
+type header struct {
+	Op     opcode   // The operation to execute
+	Sender *big.Int // Origin overlay node
+
+	Key     string // Key of the entry (puts, stores and gets)
+	Version int64  // Write timestamp of the entry (puts and stores)
+	Req     uint64 // Id of the lookup (gets and values)
+	Found   bool   // Whether the key was found (values)
+}
+
+// Make sure the header struct is registered with gob.
+func init() {
+	gob.Register(&header{})
+}
+
+// Envelopes a DHT header into the message container and sends it to its
+// destination via the overlay transport.
+func (o *Overlay) sendPacket(dest *big.Int, head *header, msg *proto.Message) {
+	head.Sender = o.pastry.Self()
+	msg.Head.Meta = head
+	o.pastry.Send(dest, msg)
+}
+
+// Assembles a write, consisting of the put opcode, the key and the version of
+// the (encrypted) value, sending it towards the key.
+func (o *Overlay) sendPut(dest *big.Int, key string, version int64, msg *proto.Message) {
+	o.sendPacket(dest, &header{Op: opPut, Key: key, Version: version}, msg)
+}
+
+// Assembles a replica of an entry and sends it to a responsible node.
+func (o *Overlay) sendStore(dest *big.Int, key string, ent *entry) {
+	msg := &proto.Message{Data: append([]byte{}, ent.value...)}
+	if err := msg.Encrypt(); err != nil {
+		log.Printf("dht: failed to encrypt replica: %v.", err)
+		return
+	}
+	o.sendPacket(dest, &header{Op: opStore, Key: key, Version: ent.version}, msg)
+}
+
+// Assembles a lookup, consisting of the get opcode, the key and the request id,
+// sending it towards the key.
+func (o *Overlay) sendGet(dest *big.Int, key string, reqId uint64) {
+	o.sendPacket(dest, &header{Op: opGet, Key: key, Req: reqId}, new(proto.Message))
+}
+
+// Assembles a lookup answer with the value if found and sends it back to the
+// requesting node.
+func (o *Overlay) sendValue(dest *big.Int, reqId uint64, ent *entry) {
+	msg := new(proto.Message)
+	if ent != nil {
+		msg.Data = append([]byte{}, ent.value...)
+		if err := msg.Encrypt(); err != nil {
+			log.Printf("dht: failed to encrypt lookup answer: %v.", err)
+			return
+		}
+	}
+	o.sendPacket(dest, &header{Op: opValue, Req: reqId, Found: ent != nil}, msg)
+}
@@ -0,0 +1,113 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the delivery acknowledgement tracking of publishes and broadcasts, and
+// the acknowledged (optionally sampled) broadcasts.
+
+package iris
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Delivery acknowledgements collected for a single message.
+type tracker struct {
+	want int32         // Acknowledgements to wait for (zero if unbounded)
+	have int32         // Acknowledgements received so far (atomic)
+	done chan struct{} // Closed when the wanted acknowledgements arrived
+}
+
+// Notes a delivery, signaling completion if the wanted count was reached.
+func (t *tracker) note() {
+	if have := atomic.AddInt32(&t.have, 1); have == t.want {
+		close(t.done)
+	}
+}
+
+// Starts tracking the acknowledgements of a new message, returning its id.
+func (c *Connection) track(want int) (uint64, *tracker) {
+	acked := &tracker{
+		want: int32(want),
+		done: make(chan struct{}),
+	}
+	c.ackLock.Lock()
+	defer c.ackLock.Unlock()
+
+	id := c.ackIdx
+	c.ackIdx++
+	c.ackPend[id] = acked
+	return id, acked
+}
+
+// Stops tracking the acknowledgements of a message.
+func (c *Connection) untrack(id uint64) {
+	c.ackLock.Lock()
+	defer c.ackLock.Unlock()
+
+	delete(c.ackPend, id)
+}
+
+// Broadcasts a message to the members of an iris cluster, returning the number
+// of members that acknowledged its receipt within the timeout. If fanout is
+// positive, the message is sent only to that many members picked by the cluster
+// balancer (duplicates possible, hence the reached subset may be smaller), and
+// the call returns as soon as all of them acknowledged.
+func (c *Connection) BroadcastAck(cluster string, msg []byte, fanout int, timeout time.Duration) (int, error) {
+	o := c.carrier()
+
+	ackId, acked := c.track(fanout)
+	defer c.untrack(ackId)
+
+	meta, span := c.traceOut(context.Background(), CallBroadcast, cluster, nil)
+	_, err := intercept(c.outbound, CallBroadcast, cluster, msg, func(msg []byte) ([]byte, error) {
+		if !c.ratePub.take() {
+			return nil, ErrRateLimited
+		}
+		o.count(MetricBroadcastSent)
+		c.statCluster(cluster, func(s *TargetStats) { s.BroadcastsSent++ })
+		if fanout <= 0 {
+			return nil, c.disseminate(cluster, c.retain(CallBroadcast, cluster, attach(c.assembleBroadcast(ackId, msg), meta)))
+		}
+		// Sample the members through the balancer (messages are encrypted in place)
+		for i := 0; i < fanout; i++ {
+			prefixIdx := int(atomic.AddUint32(&c.splitId, 1)) % config.IrisClusterSplits
+			data := append([]byte(nil), msg...)
+			if err := o.scribe.Balance(clusterPrefixes[prefixIdx]+cluster, attach(c.assembleBroadcast(ackId, data), meta)); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+	finish(span, err)
+	if err != nil {
+		return 0, err
+	}
+	// Collect the acknowledgements until the deadline (or all sampled arrived)
+	select {
+	case <-c.term:
+		return int(atomic.LoadInt32(&acked.have)), ErrTerminating
+	case <-time.After(timeout):
+	case <-acked.done:
+	}
+	return int(atomic.LoadInt32(&acked.have)), nil
+}
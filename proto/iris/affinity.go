@@ -0,0 +1,72 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the sticky request affinity. Requests carrying the same affinity key
+// are all routed to the same cluster member while it stays alive: the key picks
+// a fixed split of the cluster, the request is balanced down from the split's
+// topic root (instead of being caught in flight), each hop picking the subtree
+// by rendezvous hashing, and finally the instance within the chosen node too.
+// If the member leaves, only the keys pinned to it are remapped.
+
+package iris
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/fnv"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Executes a synchronous request to the cluster member the affinity key is pinned
+// to, otherwise behaving the same as Request.
+func (c *Connection) RequestAffinity(cluster string, key string, req []byte, timeout time.Duration) ([]byte, error) {
+	return intercept(c.outbound, CallRequest, cluster, req, func(req []byte) ([]byte, error) {
+		return c.retried(context.Background(), func() ([]byte, error) {
+			rep, _, err := c.request(context.Background(), cluster, req, nil, timeout, route{key: key})
+			return rep, err
+		})
+	})
+}
+
+// Retrieves the cluster split the requests of an affinity key are balanced in.
+func affinitySplit(key string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return int(hash.Sum32() % uint32(config.IrisClusterSplits))
+}
+
+// Picks the local connection an affinity key is pinned to, the one with the
+// highest hash of the key and the connection id.
+func affinityConn(key string, conns []uint64) uint64 {
+	best, bestSum := conns[0], uint64(0)
+	for i, id := range conns {
+		var raw [8]byte
+		binary.BigEndian.PutUint64(raw[:], id)
+
+		hash := fnv.New64a()
+		hash.Write([]byte(key))
+		hash.Write(raw[:])
+		if sum := hash.Sum64(); i == 0 || sum > bestSum {
+			best, bestSum = id, sum
+		}
+	}
+	return best
+}
@@ -0,0 +1,98 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package iris
+
+import (
+	"crypto/x509"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Request handler replying with its own index.
+type identifier struct {
+	self byte // Index of the handler
+}
+
+func (i *identifier) HandleBroadcast(msg []byte) {
+	panic("Broadcast passed to request handler")
+}
+
+func (i *identifier) HandleRequest(req []byte, timeout time.Duration) ([]byte, error) {
+	return []byte{i.self}, nil
+}
+
+func (i *identifier) HandleTunnel(tun *Tunnel) {
+	panic("Inbound tunnel on request handler")
+}
+
+func (i *identifier) HandleDrop(reason error) {
+	panic("Connection dropped on request handler")
+}
+
+// Tests that requests with the same affinity key stick to the same member.
+func TestRequestAffinity(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("affinity-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	members := 4
+	for i := 0; i < members; i++ {
+		serv, err := node.Connect("affinity-test", &identifier{byte(i)})
+		if err != nil {
+			t.Fatalf("failed to connect to the iris overlay: %v.", err)
+		}
+		defer serv.Close()
+	}
+	conn, err := node.Connect("affinity-test-client", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer conn.Close()
+
+	// Issue repeated requests per key and check they all hit the same member
+	hit := make(map[byte]bool)
+	for i := 0; i < 20; i++ {
+		session := fmt.Sprintf("session-%d", i)
+		var pinned byte
+		for j := 0; j < 5; j++ {
+			rep, err := conn.RequestAffinity("affinity-test", session, nil, time.Second)
+			if err != nil {
+				t.Fatalf("failed to execute request: %v.", err)
+			}
+			if j == 0 {
+				pinned = rep[0]
+			} else if rep[0] != pinned {
+				t.Fatalf("session %s moved: have member %d, want %d.", session, rep[0], pinned)
+			}
+		}
+		hit[pinned] = true
+	}
+	if len(hit) < 2 {
+		t.Fatalf("sessions not spread: have %d members hit, want at least 2.", len(hit))
+	}
+}
@@ -22,6 +22,7 @@ package iris
 import (
 	"crypto/x509"
 	"fmt"
+	"math/big"
 	"sync"
 	"testing"
 	"time"
@@ -43,7 +44,7 @@ func (b *broadcaster) HandleBroadcast(msg []byte) {
 	}
 }
 
-func (b *broadcaster) HandleRequest(req []byte, timeout time.Duration) []byte {
+func (b *broadcaster) HandleRequest(req []byte, timeout time.Duration) ([]byte, error) {
 	panic("Request passed to broadcast handler")
 }
 
@@ -75,9 +76,7 @@ func testBroadcast(t *testing.T, nodes, conns, msgs int) {
 	defer swapConfigs()
 
 	olds := config.BootPorts
-	for i := 0; i < nodes; i++ {
-		config.BootPorts = append(config.BootPorts, 65000+i)
-	}
+	config.BootPorts = append(config.BootPorts, fmt.Sprintf("65000-%d", 65000+nodes-1))
 	defer func() { config.BootPorts = olds }()
 
 	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
@@ -152,3 +151,175 @@ func testBroadcast(t *testing.T, nodes, conns, msgs int) {
 		}
 	}
 }
+
+// Tests that acknowledged broadcasts count the receipts and honor the fanout.
+func TestBroadcastAck(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("broadcast-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	// Start a few cluster members and a separate sender
+	members := make([]*broadcaster, 3)
+	for i := 0; i < len(members); i++ {
+		members[i] = &broadcaster{make(chan []byte, 10)}
+		conn, err := node.Connect("broadcast-test-ack", members[i])
+		if err != nil {
+			t.Fatalf("failed to connect to the iris overlay: %v.", err)
+		}
+		defer conn.Close()
+	}
+	sender, err := node.Connect("broadcast-test-sender", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer sender.Close()
+
+	// Full broadcasts should be acknowledged by all members
+	if acks, err := sender.BroadcastAck("broadcast-test-ack", []byte{0x00}, 0, 250*time.Millisecond); err != nil {
+		t.Fatalf("failed to broadcast: %v.", err)
+	} else if acks != len(members) {
+		t.Fatalf("acknowledgement count mismatch: have %d, want %d.", acks, len(members))
+	}
+	// Sampled broadcasts should reach at most fanout members, returning early
+	start := time.Now()
+	if acks, err := sender.BroadcastAck("broadcast-test-ack", []byte{0x01}, 2, 5*time.Second); err != nil {
+		t.Fatalf("failed to broadcast: %v.", err)
+	} else if acks != 2 {
+		t.Fatalf("sampled acknowledgement count mismatch: have %d, want %d.", acks, 2)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("sampled broadcast returned slowly: have %v, want < 1s.", elapsed)
+	}
+	received := 0
+	for _, member := range members {
+		received += len(member.msgs)
+	}
+	if received != len(members)+2 {
+		t.Fatalf("delivery count mismatch: have %d, want %d.", received, len(members)+2)
+	}
+}
+
+func TestBroadcastOrdered(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := NewOverlay("broadcast-test", key, WithOrderedBroadcast("broadcast-test-ordered"))
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	// Start a few cluster members and a few concurrent senders
+	members := make([]*broadcaster, 3)
+	for i := 0; i < len(members); i++ {
+		members[i] = &broadcaster{make(chan []byte, 1000)}
+		conn, err := node.Connect("broadcast-test-ordered", members[i], WithHandlerThreads(8))
+		if err != nil {
+			t.Fatalf("failed to connect to the iris overlay: %v.", err)
+		}
+		defer conn.Close()
+	}
+	var pend sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		sender, err := node.Connect("broadcast-test-sender", nil)
+		if err != nil {
+			t.Fatalf("failed to connect to the iris overlay: %v.", err)
+		}
+		defer sender.Close()
+
+		pend.Add(1)
+		go func(id int) {
+			defer pend.Done()
+			for j := 0; j < 50; j++ {
+				if err := sender.Broadcast("broadcast-test-ordered", []byte{byte(id), byte(j)}); err != nil {
+					panic(fmt.Sprintf("failed to broadcast: %v.", err))
+				}
+			}
+		}(i)
+	}
+	pend.Wait()
+
+	// All members should receive the same sequence of events
+	seqs := make([][]string, len(members))
+	for i, member := range members {
+		for j := 0; j < 200; j++ {
+			select {
+			case msg := <-member.msgs:
+				seqs[i] = append(seqs[i], fmt.Sprintf("%v", msg))
+			case <-time.After(time.Second):
+				t.Fatalf("member %d: broadcast receive timeout after %d events.", i, j)
+			}
+		}
+	}
+	for i := 1; i < len(seqs); i++ {
+		for j := 0; j < len(seqs[i]); j++ {
+			if seqs[i][j] != seqs[0][j] {
+				t.Fatalf("member %d, event %d: order mismatch: have %v, want %v.", i, j, seqs[i][j], seqs[0][j])
+			}
+		}
+	}
+}
+
+func TestBroadcastReorder(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	timeout := config.IrisOrderTimeout
+	config.IrisOrderTimeout = 100 * time.Millisecond
+	defer func() { config.IrisOrderTimeout = timeout }()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := NewOverlay("broadcast-test", key, WithOrderedBroadcast("broadcast-test-reorder"))
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	member := &broadcaster{make(chan []byte, 10)}
+	conn, err := node.Connect("broadcast-test-reorder", member)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer conn.Close()
+
+	// Feed a shuffled sequence with a gap, checking the delivery order
+	topic, root := clusterPrefixes[0]+"broadcast-test-reorder", big.NewInt(1)
+	for _, seq := range []uint64{1, 3, 2, 5, 6, 2} {
+		node.HandleOrdered(root, topic, root, seq, conn.assembleBroadcast(0, []byte{byte(seq)}))
+	}
+	for _, want := range []byte{1, 2, 3, 5, 6} {
+		select {
+		case msg := <-member.msgs:
+			if msg[0] != want {
+				t.Fatalf("event order mismatch: have %v, want %v.", msg[0], want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("broadcast receive timeout, want %v.", want)
+		}
+	}
+	select {
+	case msg := <-member.msgs:
+		t.Fatalf("duplicate event delivered: %v.", msg)
+	case <-time.After(200 * time.Millisecond):
+	}
+	// A changed topic root should restart the sequence
+	node.HandleOrdered(root, topic, big.NewInt(2), 42, conn.assembleBroadcast(0, []byte{42}))
+	select {
+	case msg := <-member.msgs:
+		if msg[0] != 42 {
+			t.Fatalf("event mismatch: have %v, want %v.", msg[0], 42)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("broadcast receive timeout after root change.")
+	}
+}
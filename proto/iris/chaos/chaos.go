@@ -0,0 +1,257 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Package chaos implements a fault injecting wrapper around an iris connection,
+// delaying, dropping and reordering the outbound messages according to a test
+// scenario, so that applications can verify their behavior on a degraded mesh.
+//
+// A scenario is a JSON document with an optional random seed and a list of rules,
+// the first rule matching an operation and its target deciding the faults:
+//
+//	{
+//	  "seed": 42,
+//	  "rules": [
+//	    {"op": "request", "target": "db-*", "latency": 200, "jitter": 50},
+//	    {"op": "publish", "drop": 0.1, "reorder": 0.2, "window": 500}
+//	  ]
+//	}
+//
+// Operations are broadcast, request and publish; an empty op or target matches
+// everything, otherwise targets are path.Match patterns on the cluster or topic.
+// Latencies, jitters and reorder windows are in milliseconds. Subscriptions and
+// tunnels pass through untouched.
+package chaos
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/karalabe/iris/proto/iris"
+)
+
+// Operations subject to fault injection.
+const (
+	OpBroadcast = "broadcast"
+	OpRequest   = "request"
+	OpPublish   = "publish"
+)
+
+// Client side view of an iris connection, implemented both by the real one and
+// by the fault injecting wrapper.
+type Conn interface {
+	Broadcast(cluster string, msg []byte) error
+	Request(cluster string, req []byte, timeout time.Duration) ([]byte, error)
+	Subscribe(topic string, handler iris.SubscriptionHandler) error
+	SubscribePull(topic string, handler iris.SubscriptionHandler) error
+	Credit(topic string, credits int) error
+	Publish(topic string, msg []byte) error
+	Unsubscribe(topic string) error
+	Tunnel(cluster string, timeout time.Duration) (*iris.Tunnel, error)
+	Close() error
+}
+
+// Make sure the real connection can be wrapped.
+var _ Conn = (*iris.Connection)(nil)
+
+// A single fault injection rule.
+type Rule struct {
+	Op      string  `json:"op"`      // Operation to match (empty matches all)
+	Target  string  `json:"target"`  // Cluster or topic pattern to match (empty matches all)
+	Latency int     `json:"latency"` // Fixed delay added to each message (ms)
+	Jitter  int     `json:"jitter"`  // Random delay added on top of the latency (ms)
+	Drop    float64 `json:"drop"`    // Probability of silently dropping a message
+	Reorder float64 `json:"reorder"` // Probability of holding a message back behind later ones
+	Window  int     `json:"window"`  // Extra delay of held back messages (ms)
+}
+
+// Checks whether the rule applies to an operation on a target.
+func (r *Rule) match(op, target string) bool {
+	if r.Op != "" && r.Op != op {
+		return false
+	}
+	if r.Target == "" {
+		return true
+	}
+	ok, _ := path.Match(r.Target, target)
+	return ok
+}
+
+// Fault injection scenario: a list of rules, the first matching one applying.
+type Scenario struct {
+	Seed  int64   `json:"seed"`  // Seed for the fault decisions (0 = time based)
+	Rules []*Rule `json:"rules"` // Rules in order of precedence
+}
+
+// Parses a JSON encoded scenario.
+func ParseScenario(data []byte) (*Scenario, error) {
+	scen := new(Scenario)
+	if err := json.Unmarshal(data, scen); err != nil {
+		return nil, err
+	}
+	return scen, nil
+}
+
+// Loads a JSON encoded scenario from a file.
+func LoadScenario(file string) (*Scenario, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParseScenario(data)
+}
+
+// Fault injecting wrapper around an iris connection.
+type Connection struct {
+	conn Conn      // Wrapped connection to forward to
+	scen *Scenario // Fault scenario to enforce
+
+	rng  *rand.Rand // Source of the fault decisions
+	lock sync.Mutex // Mutex to protect the random source
+
+	pend sync.WaitGroup // Delayed messages still in flight
+	term chan struct{}  // Channel to signal termination to delayed messages
+}
+
+// Wraps a connection, injecting faults into its traffic as the scenario dictates.
+func Wrap(conn Conn, scen *Scenario) *Connection {
+	seed := scen.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &Connection{
+		conn: conn,
+		scen: scen,
+		rng:  rand.New(rand.NewSource(seed)),
+		term: make(chan struct{}),
+	}
+}
+
+// Decides the fate of a message: whether to drop it and how long to delay it.
+func (c *Connection) fault(op, target string) (bool, time.Duration) {
+	for _, rule := range c.scen.Rules {
+		if !rule.match(op, target) {
+			continue
+		}
+		c.lock.Lock()
+		defer c.lock.Unlock()
+
+		if rule.Drop > 0 && c.rng.Float64() < rule.Drop {
+			return true, 0
+		}
+		delay := rule.Latency
+		if rule.Jitter > 0 {
+			delay += c.rng.Intn(rule.Jitter + 1)
+		}
+		if rule.Reorder > 0 && c.rng.Float64() < rule.Reorder {
+			delay += rule.Window
+		}
+		return false, time.Duration(delay) * time.Millisecond
+	}
+	return false, 0
+}
+
+// Executes an asynchronous send after the fault delay, unless dropped.
+func (c *Connection) send(op, target string, fn func() error) error {
+	drop, delay := c.fault(op, target)
+	switch {
+	case drop:
+		return nil
+	case delay == 0:
+		return fn()
+	}
+	c.pend.Add(1)
+	go func() {
+		defer c.pend.Done()
+		select {
+		case <-c.term:
+			// Connection closed, discard
+		case <-time.After(delay):
+			fn()
+		}
+	}()
+	return nil
+}
+
+// Broadcasts a message to a cluster through the faulty mesh.
+func (c *Connection) Broadcast(cluster string, msg []byte) error {
+	return c.send(OpBroadcast, cluster, func() error { return c.conn.Broadcast(cluster, msg) })
+}
+
+// Executes a request through the faulty mesh. Delays are charged against the
+// timeout, and dropped requests time out.
+func (c *Connection) Request(cluster string, req []byte, timeout time.Duration) ([]byte, error) {
+	drop, delay := c.fault(OpRequest, cluster)
+	if drop || delay >= timeout {
+		select {
+		case <-c.term:
+			return nil, iris.ErrTerminating
+		case <-time.After(timeout):
+			return nil, iris.ErrTimeout
+		}
+	}
+	if delay > 0 {
+		select {
+		case <-c.term:
+			return nil, iris.ErrTerminating
+		case <-time.After(delay):
+		}
+	}
+	return c.conn.Request(cluster, req, timeout-delay)
+}
+
+// Subscribes to a topic, passing through to the wrapped connection.
+func (c *Connection) Subscribe(topic string, handler iris.SubscriptionHandler) error {
+	return c.conn.Subscribe(topic, handler)
+}
+
+// Subscribes to a topic in pull mode, passing through to the wrapped connection.
+func (c *Connection) SubscribePull(topic string, handler iris.SubscriptionHandler) error {
+	return c.conn.SubscribePull(topic, handler)
+}
+
+// Grants credits to a pull subscription, passing through to the wrapped connection.
+func (c *Connection) Credit(topic string, credits int) error {
+	return c.conn.Credit(topic, credits)
+}
+
+// Publishes an event to a topic through the faulty mesh.
+func (c *Connection) Publish(topic string, msg []byte) error {
+	return c.send(OpPublish, topic, func() error { return c.conn.Publish(topic, msg) })
+}
+
+// Unsubscribes from a topic, passing through to the wrapped connection.
+func (c *Connection) Unsubscribe(topic string) error {
+	return c.conn.Unsubscribe(topic)
+}
+
+// Opens a tunnel, passing through to the wrapped connection.
+func (c *Connection) Tunnel(cluster string, timeout time.Duration) (*iris.Tunnel, error) {
+	return c.conn.Tunnel(cluster, timeout)
+}
+
+// Discards all delayed messages still in flight and closes the wrapped connection.
+func (c *Connection) Close() error {
+	close(c.term)
+	c.pend.Wait()
+	return c.conn.Close()
+}
@@ -0,0 +1,121 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package chaos
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/proto/iris"
+)
+
+// Make sure the wrapper can stand in for a real connection.
+var _ Conn = (*Connection)(nil)
+
+// Connection recording the sent messages instead of forwarding them.
+type recorder struct {
+	sent []string
+	lock sync.Mutex
+}
+
+func (r *recorder) record(msg []byte) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.sent = append(r.sent, string(msg))
+	return nil
+}
+
+func (r *recorder) messages() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return append([]string{}, r.sent...)
+}
+
+func (r *recorder) Broadcast(cluster string, msg []byte) error { return r.record(msg) }
+func (r *recorder) Request(cluster string, req []byte, timeout time.Duration) ([]byte, error) {
+	r.record(req)
+	return req, nil
+}
+func (r *recorder) Subscribe(topic string, handler iris.SubscriptionHandler) error     { return nil }
+func (r *recorder) SubscribePull(topic string, handler iris.SubscriptionHandler) error { return nil }
+func (r *recorder) Credit(topic string, credits int) error                             { return nil }
+func (r *recorder) Publish(topic string, msg []byte) error                             { return r.record(msg) }
+func (r *recorder) Unsubscribe(topic string) error                                     { return nil }
+func (r *recorder) Tunnel(cluster string, timeout time.Duration) (*iris.Tunnel, error) {
+	return nil, nil
+}
+func (r *recorder) Close() error { return nil }
+
+func TestScenario(t *testing.T) {
+	scen, err := ParseScenario([]byte(`{
+		"seed": 1,
+		"rules": [
+			{"op": "publish", "target": "drop-*", "drop": 1},
+			{"op": "publish", "target": "slow", "latency": 50},
+			{"op": "broadcast", "reorder": 1, "window": 50}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("failed to parse scenario: %v.", err)
+	}
+	rec := new(recorder)
+	conn := Wrap(rec, scen)
+
+	// Dropped, delayed and untouched publishes
+	conn.Publish("drop-me", []byte("dropped"))
+	conn.Publish("slow", []byte("delayed"))
+	conn.Publish("fast", []byte("direct"))
+	if msgs := rec.messages(); len(msgs) != 1 || msgs[0] != "direct" {
+		t.Fatalf("immediate delivery mismatch: have %v, want [direct].", msgs)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if msgs := rec.messages(); len(msgs) != 2 || msgs[1] != "delayed" {
+		t.Fatalf("delayed delivery mismatch: have %v, want [direct delayed].", msgs)
+	}
+	// Held back broadcasts must arrive after a later request
+	conn.Broadcast("cluster", []byte("held"))
+	if _, err := conn.Request("cluster", []byte("request"), time.Second); err != nil {
+		t.Fatalf("failed to execute request: %v.", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if msgs := rec.messages(); len(msgs) != 4 || msgs[2] != "request" || msgs[3] != "held" {
+		t.Fatalf("reordered delivery mismatch: have %v, want [... request held].", msgs)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatalf("failed to close connection: %v.", err)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	scen := &Scenario{Rules: []*Rule{{Op: OpRequest, Latency: 1000}}}
+	conn := Wrap(new(recorder), scen)
+	defer conn.Close()
+
+	start := time.Now()
+	if _, err := conn.Request("cluster", []byte("request"), 50*time.Millisecond); err != iris.ErrTimeout {
+		t.Fatalf("request error mismatch: have %v, want %v.", err, iris.ErrTimeout)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Fatalf("request timeout mismatch: have %v, want 50ms.", elapsed)
+	}
+}
@@ -0,0 +1,192 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the transparent chunking of large messages. Requests, replies and
+// publishes with payloads above the chunk size are split into separately routed
+// chunks, each carrying the checksum of the whole, and reassembled by the remote
+// overlay before reaching the handlers. Since every balanced message may land on
+// a different member, only the first chunk of a request is balanced: the chosen
+// member pulls the rest directly from the requester.
+
+package iris
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+	"sync/atomic"
+	"time"
+
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto"
+)
+
+// Kind of the reply transfers reported to the progress handlers.
+const CallReply = "reply"
+
+// Advancement of a chunked transfer.
+type Progress struct {
+	Call    string // Kind of the transfer (CallRequest, CallReply or CallPublish)
+	Target  string // Cluster or topic of the transfer (empty for replies)
+	Inbound bool   // Whether the chunks are being received or sent
+	Done    int    // Number of chunks transferred so far
+	Total   int    // Total number of chunks of the message
+}
+
+// Callback notified after every chunk of a large outbound message handed to the
+// network, or of an inbound request or reply reassembled.
+type ProgressHandler func(p Progress)
+
+// Remaining chunks of an outbound request, waiting for the member to pull them.
+type pullable struct {
+	cluster string           // Cluster the request was sent to
+	chunks  []*proto.Message // Chunks following the balanced first one
+}
+
+// Partially received chunked message.
+type assembly struct {
+	head  *header     // Header of the first chunk, carrying the message metadata
+	parts [][]byte    // Payload chunks received so far, indexed by position
+	have  int         // Number of distinct chunks received
+	timer *time.Timer // Timer dropping the transfer if it stalls
+}
+
+// Splits an assembled message into chunks if its payload exceeds the chunk size,
+// or returns the message itself otherwise. The chunks get copies of the payload,
+// as messages are encrypted in place.
+func (c *Connection) split(msg *proto.Message) []*proto.Message {
+	size := config.IrisChunkSize
+	if len(msg.Data) <= size {
+		return []*proto.Message{msg}
+	}
+	head := msg.Head.Meta.(*header)
+	sum := sha256.Sum256(msg.Data)
+	id := atomic.AddUint64(&c.chunkIdx, 1)
+
+	count := (len(msg.Data) + size - 1) / size
+	chunks := make([]*proto.Message, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * size
+		if end > len(msg.Data) {
+			end = len(msg.Data)
+		}
+		part := *head
+		part.ChunkId, part.ChunkIdx, part.ChunkCnt, part.ChunkSum = id, i, count, sum[:]
+		chunks = append(chunks, c.assemblePacket(&part, append([]byte(nil), msg.Data[i*size:end]...)))
+	}
+	return chunks
+}
+
+// Sends the chunks of a message one after the other, reporting the progress of
+// multi chunk transfers.
+func (c *Connection) transmit(call, target string, chunks []*proto.Message, send func(*proto.Message) error) error {
+	for i, chunk := range chunks {
+		if err := send(chunk); err != nil {
+			return err
+		}
+		if len(chunks) > 1 {
+			c.report(Progress{Call: call, Target: target, Done: i + 1, Total: len(chunks)})
+		}
+	}
+	return nil
+}
+
+// Notifies the progress handler of the connection, if any.
+func (c *Connection) report(p Progress) {
+	if c.progress != nil {
+		c.progress(p)
+	}
+}
+
+// Sends the remaining chunks of an outbound request to the member that received
+// the first one.
+func (c *Connection) handlePull(srcNode *big.Int, srcConn uint64, chunkId uint64) {
+	c.chunkLock.Lock()
+	pull, ok := c.chunkPull[chunkId]
+	delete(c.chunkPull, chunkId)
+	c.chunkLock.Unlock()
+
+	if !ok {
+		return
+	}
+	total := len(pull.chunks) + 1
+	for i, chunk := range pull.chunks {
+		chunk.Head.Meta.(*header).Dest = srcConn
+		c.carrier().scribe.Direct(srcNode, chunk)
+		c.report(Progress{Call: CallRequest, Target: pull.cluster, Done: i + 2, Total: total})
+	}
+}
+
+// Inserts a received chunk into its transfer, returning the reassembled message
+// once complete (nil before), along with the number of chunks received so far.
+func (o *Overlay) assemble(src *big.Int, msg *proto.Message) (*proto.Message, int) {
+	head := msg.Head.Meta.(*header)
+
+	// Drop transfers that cannot be chunked or would exceed the message limit
+	limit := (config.IrisMessageLimit + config.IrisChunkSize - 1) / config.IrisChunkSize
+	if head.ChunkCnt <= 1 || head.ChunkCnt > limit {
+		o.logger.Printf("iris: invalid chunk count: have %v, want [2, %v].", head.ChunkCnt, limit)
+		return nil, 0
+	}
+	if head.ChunkIdx < 0 || head.ChunkIdx >= head.ChunkCnt {
+		o.logger.Printf("iris: invalid chunk index: have %v, want [0, %v).", head.ChunkIdx, head.ChunkCnt)
+		return nil, 0
+	}
+	key := fmt.Sprintf("%v/%d/%d", src, head.Src, head.ChunkId)
+
+	o.chunkLock.Lock()
+	defer o.chunkLock.Unlock()
+
+	// Fetch or start the transfer, dropping it if it stalls
+	a, ok := o.chunks[key]
+	if !ok {
+		a = &assembly{parts: make([][]byte, head.ChunkCnt)}
+		a.timer = time.AfterFunc(config.IrisChunkTimeout, func() {
+			o.chunkLock.Lock()
+			defer o.chunkLock.Unlock()
+
+			if o.chunks[key] == a {
+				delete(o.chunks, key)
+				o.logger.Printf("iris: dropping stalled chunked transfer: %v of %v chunks.", a.have, len(a.parts))
+			}
+		})
+		o.chunks[key] = a
+	}
+	if len(a.parts) != head.ChunkCnt || a.parts[head.ChunkIdx] != nil {
+		return nil, a.have
+	}
+	if head.ChunkIdx == 0 {
+		a.head = head
+	}
+	a.parts[head.ChunkIdx] = msg.Data
+	if a.have++; a.have < len(a.parts) {
+		return nil, a.have
+	}
+	// Transfer complete, verify and reassemble the message
+	delete(o.chunks, key)
+	a.timer.Stop()
+
+	data := bytes.Join(a.parts, nil)
+	if sum := sha256.Sum256(data); !bytes.Equal(sum[:], a.head.ChunkSum) {
+		o.logger.Printf("iris: chunked transfer integrity check failed.")
+		return nil, a.have
+	}
+	return &proto.Message{Head: proto.Header{Meta: a.head}, Data: data}, a.have
+}
@@ -0,0 +1,214 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package iris
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto"
+)
+
+// Progress handler recording the last reported state of each transfer kind.
+type progressLog struct {
+	last map[string]Progress
+	lock sync.Mutex
+}
+
+func (p *progressLog) handle(prog Progress) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	key := prog.Call
+	if prog.Inbound {
+		key += "/in"
+	}
+	p.last[key] = prog
+}
+
+func (p *progressLog) fetch(key string) Progress {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.last[key]
+}
+
+func (p *progressLog) reset() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.last = make(map[string]Progress)
+}
+
+func TestChunkedRequest(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	size := config.IrisChunkSize
+	config.IrisChunkSize = 1024
+	defer func() { config.IrisChunkSize = size }()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("chunk-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	// Connect an echo server and a client, both tracking the progress
+	server, client := &progressLog{last: make(map[string]Progress)}, &progressLog{last: make(map[string]Progress)}
+	serv, err := node.Connect("chunk-test-server", &requester{}, WithProgress(server.handle))
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer serv.Close()
+
+	conn, err := node.Connect("chunk-test-client", nil, WithProgress(client.handle))
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer conn.Close()
+
+	// Send a large request and verify the echoed reply
+	req := make([]byte, 10*1024+1)
+	rand.Read(req)
+
+	rep, err := conn.Request("chunk-test-server", req, 5*time.Second)
+	if err != nil {
+		t.Fatalf("failed to execute chunked request: %v.", err)
+	}
+	if !bytes.Equal(rep, req) {
+		t.Fatalf("reply mismatch: have %d bytes, want %d.", len(rep), len(req))
+	}
+	// Verify that all the transfers were reported complete
+	for _, check := range []struct {
+		log *progressLog
+		key string
+	}{
+		{client, CallRequest}, {client, CallReply + "/in"},
+		{server, CallRequest + "/in"}, {server, CallReply},
+	} {
+		prog := check.log.fetch(check.key)
+		for end := time.Now().Add(time.Second); prog.Done != prog.Total && time.Now().Before(end); {
+			time.Sleep(10 * time.Millisecond)
+			prog = check.log.fetch(check.key)
+		}
+		if prog.Total != 11 || prog.Done != prog.Total {
+			t.Fatalf("%s progress mismatch: have %d/%d, want 11/11.", check.key, prog.Done, prog.Total)
+		}
+	}
+	// Small requests should pass without chunking
+	client.reset()
+	if rep, err := conn.Request("chunk-test-server", []byte{0x00}, time.Second); err != nil || !bytes.Equal(rep, []byte{0x00}) {
+		t.Fatalf("failed to execute small request: %v %v.", rep, err)
+	}
+	if prog := client.fetch(CallRequest); prog.Total != 0 {
+		t.Fatalf("progress reported for small request: %v.", prog)
+	}
+}
+
+func TestChunkedPublish(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	size := config.IrisChunkSize
+	config.IrisChunkSize = 1024
+	defer func() { config.IrisChunkSize = size }()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("chunk-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	conn, err := node.Connect("chunk-test", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer conn.Close()
+
+	// Subscribe both directly and through a pattern
+	direct, wild := &subscriber{make(chan []byte, 10)}, &subscriber{make(chan []byte, 10)}
+	if err := conn.Subscribe("chunk/test", direct); err != nil {
+		t.Fatalf("failed to subscribe: %v.", err)
+	}
+	if err := conn.Subscribe("chunk/#", wild); err != nil {
+		t.Fatalf("failed to subscribe to pattern: %v.", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Publish a large event and verify both deliveries
+	msg := make([]byte, 4*1024)
+	rand.Read(msg)
+	if err := conn.Publish("chunk/test", msg); err != nil {
+		t.Fatalf("failed to publish chunked event: %v.", err)
+	}
+	for _, sub := range []*subscriber{direct, wild} {
+		select {
+		case event := <-sub.msgs:
+			if !bytes.Equal(event, msg) {
+				t.Fatalf("event mismatch: have %d bytes, want %d.", len(event), len(msg))
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("chunked event receive timeout.")
+		}
+	}
+	// Make sure no partial events leak through
+	select {
+	case event := <-direct.msgs:
+		t.Fatalf("extra event delivered: %d bytes.", len(event))
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestChunkedLimits(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("chunk-test", key)
+
+	// Feed chunks with out of bound counts and ensure none are tracked
+	limit := (config.IrisMessageLimit + config.IrisChunkSize - 1) / config.IrisChunkSize
+	for i, count := range []int{-1, 0, 1, limit + 1, 1 << 30} {
+		msg := &proto.Message{
+			Head: proto.Header{Meta: &header{Op: opPub, Src: 1, ChunkId: uint64(i), ChunkCnt: count}},
+			Data: []byte{0x00},
+		}
+		if done, have := node.assemble(big.NewInt(1), msg); done != nil || have != 0 {
+			t.Fatalf("chunk count %v: invalid transfer accepted: have %v chunks.", count, have)
+		}
+	}
+	node.chunkLock.Lock()
+	defer node.chunkLock.Unlock()
+	if len(node.chunks) != 0 {
+		t.Fatalf("invalid transfers tracked: %v.", len(node.chunks))
+	}
+}
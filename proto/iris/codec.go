@@ -0,0 +1,145 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the typed payload codecs. A connection may be configured with a codec
+// through which Go values can be broadcast, requested and published directly,
+// the payloads being marshaled automatically and tagged with their content type
+// in the message metadata. Receivers decode them with the same codec, checking
+// the content type if the sender attached one.
+
+package iris
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var ErrContentType = errors.New("content type mismatch")
+
+// Metadata key carrying the content type of the encoded payloads.
+const ContentTypeKey = "content-type"
+
+// Marshaling scheme of the typed payloads. Other formats (e.g. protobuf) can be
+// used by implementing it.
+type Codec interface {
+	// Returns the content type tagging the encoded payloads.
+	ContentType() string
+
+	// Encodes a value into a payload.
+	Marshal(v interface{}) ([]byte, error)
+
+	// Decodes a payload into the value pointed to by v.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// Codecs of the standard library formats.
+var (
+	JSONCodec Codec = jsonCodec{}
+	GobCodec  Codec = gobCodec{}
+)
+
+// Codec of JSON encoded payloads.
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string                        { return "application/json" }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// Codec of gob encoded payloads.
+type gobCodec struct{}
+
+func (gobCodec) ContentType() string { return "application/x-gob" }
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// Retrieves the codec of the connection, JSON if none was configured.
+func (c *Connection) coder() Codec {
+	if c.codec == nil {
+		return JSONCodec
+	}
+	return c.codec
+}
+
+// Encodes a value with the connection's codec, returning the payload and the
+// metadata tagging its content type (e.g. to reply to a request with).
+func (c *Connection) Encode(v interface{}) ([]byte, Metadata, error) {
+	codec := c.coder()
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, Metadata{ContentTypeKey: codec.ContentType()}, nil
+}
+
+// Decodes a payload with the connection's codec into the value pointed to by v.
+// If the metadata carries a content type, it must match the codec's, otherwise
+// ErrContentType is returned.
+func (c *Connection) Decode(data []byte, meta Metadata, v interface{}) error {
+	codec := c.coder()
+	if kind, ok := meta[ContentTypeKey]; ok && kind != codec.ContentType() {
+		return ErrContentType
+	}
+	return codec.Unmarshal(data, v)
+}
+
+// Broadcasts an encoded value to all members of an iris cluster.
+func (c *Connection) BroadcastValue(cluster string, v interface{}) error {
+	msg, meta, err := c.Encode(v)
+	if err != nil {
+		return err
+	}
+	return c.BroadcastMeta(cluster, msg, meta)
+}
+
+// Executes a synchronous request with an encoded value to cluster, decoding the
+// reply into the value pointed to by rep. Otherwise it behaves the same as
+// Request.
+func (c *Connection) RequestValue(cluster string, req interface{}, rep interface{}, timeout time.Duration) error {
+	msg, meta, err := c.Encode(req)
+	if err != nil {
+		return err
+	}
+	data, repMeta, err := c.RequestMeta(cluster, msg, meta, timeout)
+	if err != nil {
+		return err
+	}
+	return c.Decode(data, repMeta, rep)
+}
+
+// Publishes an encoded value asynchronously to topic.
+func (c *Connection) PublishValue(topic string, v interface{}) error {
+	msg, meta, err := c.Encode(v)
+	if err != nil {
+		return err
+	}
+	return c.PublishMeta(topic, msg, meta)
+}
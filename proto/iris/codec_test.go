@@ -0,0 +1,118 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package iris
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+// Typed payload of the codec tests.
+type sum struct {
+	A, B int
+}
+
+// Connection handler summing the decoded requests.
+type summer struct {
+	conn *Connection
+}
+
+func (s *summer) HandleBroadcast(msg []byte) {
+	panic("Broadcast passed to summer handler")
+}
+
+func (s *summer) HandleBroadcastMeta(msg []byte, meta Metadata) {
+	panic("Broadcast passed to summer handler")
+}
+
+func (s *summer) HandleRequest(req []byte, timeout time.Duration) ([]byte, error) {
+	panic("Plain request passed to summer handler")
+}
+
+func (s *summer) HandleRequestMeta(req []byte, meta Metadata, timeout time.Duration) ([]byte, Metadata, error) {
+	var args sum
+	if err := s.conn.Decode(req, meta, &args); err != nil {
+		return nil, nil, err
+	}
+	return s.conn.Encode(args.A + args.B)
+}
+
+func (s *summer) HandleTunnel(tun *Tunnel) {
+	panic("Inbound tunnel on summer handler")
+}
+
+func (s *summer) HandleDrop(reason error) {
+	panic("Connection dropped on summer handler")
+}
+
+// Tests that typed values are marshaled and tagged by the configured codec.
+func TestCodec(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("codec-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	for _, codec := range []Codec{JSONCodec, GobCodec} {
+		cluster := "codec-test-" + codec.ContentType()
+
+		handler := new(summer)
+		conn, err := node.Connect(cluster, handler, WithCodec(codec))
+		if err != nil {
+			t.Fatalf("%s: failed to connect to the iris overlay: %v.", codec.ContentType(), err)
+		}
+		handler.conn = conn
+
+		var res int
+		if err := conn.RequestValue(cluster, sum{A: 1, B: 2}, &res, time.Second); err != nil {
+			t.Fatalf("%s: failed to execute typed request: %v.", codec.ContentType(), err)
+		}
+		if res != 3 {
+			t.Fatalf("%s: result mismatch: have %v, want %v.", codec.ContentType(), res, 3)
+		}
+		conn.Close()
+	}
+	// Mismatching content types should be rejected by the receiver
+	handler := new(summer)
+	server, err := node.Connect("codec-test-gob", handler, WithCodec(GobCodec))
+	if err != nil {
+		t.Fatalf("failed to connect server to the iris overlay: %v.", err)
+	}
+	defer server.Close()
+	handler.conn = server
+
+	client, err := node.Connect("codec-test-json", nil)
+	if err != nil {
+		t.Fatalf("failed to connect client to the iris overlay: %v.", err)
+	}
+	defer client.Close()
+
+	var res int
+	err = client.RequestValue("codec-test-gob", sum{A: 1, B: 2}, &res, time.Second)
+	if rerr, ok := err.(*RemoteError); !ok || rerr.Message != ErrContentType.Error() {
+		t.Fatalf("content type mismatch error: have %v, want %v.", err, ErrContentType)
+	}
+}
@@ -20,14 +20,17 @@
 package iris
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math/big"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/karalabe/iris/config"
 	"github.com/karalabe/iris/pool"
+	"github.com/karalabe/iris/proto"
 )
 
 // Iris specific errors
@@ -35,10 +38,16 @@ var ErrTerminating = errors.New("terminating")
 var ErrTimeout = errors.New("timeout")
 var ErrSubscribed = errors.New("already subscribed")
 var ErrNotSubscribed = errors.New("not subscribed")
+var ErrPushMode = errors.New("subscription in push mode")
+var ErrInvalidPattern = errors.New("invalid topic pattern")
+var ErrPatternPull = errors.New("pattern subscription in pull mode")
+var ErrPatternTopic = errors.New("wildcard in published topic")
+var ErrRateLimited = errors.New("rate limit exceeded")
 
 // Prefixes for multi-clustering.
 var clusterPrefixes []string
 var topicPrefixes []string
+var wildcardPrefixes []string
 
 // Creates the cluster split prefix tags.
 func init() {
@@ -50,6 +59,10 @@ func init() {
 	for i := 0; i < len(topicPrefixes); i++ {
 		topicPrefixes[i] = fmt.Sprintf("t#%d-", i)
 	}
+	wildcardPrefixes = make([]string, config.IrisClusterSplits)
+	for i := 0; i < len(wildcardPrefixes); i++ {
+		wildcardPrefixes[i] = fmt.Sprintf("w#%d-", i)
+	}
 }
 
 // Handler for the connection scope events: application requests, application
@@ -59,9 +72,12 @@ type ConnectionHandler interface {
 	HandleBroadcast(msg []byte)
 
 	// Handles the request, returning the reply that should be forwarded back to
-	// the caller. If the method crashes, nothing is returned and the caller will
-	// eventually time out.
-	HandleRequest(req []byte, timeout time.Duration) []byte
+	// the caller, or the failure to report to it as a *RemoteError (codes are
+	// kept if the failure is a *RemoteError itself). The timeout is the time left
+	// of the caller's limit, excluding the time spent queued. If the method
+	// crashes or returns neither, nothing is sent and the caller will eventually
+	// time out.
+	HandleRequest(req []byte, timeout time.Duration) ([]byte, error)
 
 	// Handles the request to open a direct tunnel.
 	HandleTunnel(tun *Tunnel)
@@ -76,111 +92,324 @@ type SubscriptionHandler interface {
 // Connection through which to interact with other iris clients.
 type Connection struct {
 	// Application layer fields
-	id      uint64            // Auto-incremented connection id
-	cluster string            // Cluster to which the client registers
-	handler ConnectionHandler // Handler for connection events
-	iris    *Overlay          // Interface into the distributed carrier
-
-	reqIdx  uint64                 // Index to assign the next request
-	reqPend map[uint64]chan []byte // Active requests waiting for a reply
-	reqLock sync.RWMutex           // Mutex to protect the request map
+	id       uint64            // Auto-incremented connection id, unique across overlays
+	cluster  string            // Cluster to which the client registers
+	handler  ConnectionHandler // Handler for connection events
+	iris     *Overlay          // Interface into the distributed carrier (use carrier)
+	irisLock sync.RWMutex      // Mutex to protect the carrier swapped on reconnection
+
+	reqIdx  uint64                    // Index to assign the next request
+	reqPend map[uint64]chan *reply    // Active requests waiting for a reply
+	reqFail map[uint64]chan error     // Failure notifications of the active requests
+	reqAll  map[uint64]chan *Response // Active scatter-gather requests collecting responses
+	reqLock sync.RWMutex              // Mutex to protect the request maps
 
 	subLive map[string]SubscriptionHandler // Active subscriptions
-	subLock sync.RWMutex                   // Mutex to protect the subscription map
-
-	tunIdx  uint64             // Index to assign the next tunnel
-	tunLive map[uint64]*Tunnel // Tunnels either live, or being established
-	tunLock sync.RWMutex       // Mutex to protect the tunnel map
+	subCred map[string]*int32              // Remaining event credits of pull mode subscriptions (atomic)
+	subWild map[string]SubscriptionHandler // Active wildcard pattern subscriptions
+	subFan  map[string]*fanout             // Handler fanouts of the topics subscribed via AddHandler
+	fanIdx  uint64                         // Index to assign the next fanout handler
+	subLock sync.RWMutex                   // Mutex to protect the subscription maps
+
+	ackIdx  uint64              // Index to assign the next acknowledged publish or broadcast
+	ackPend map[uint64]*tracker // Acknowledged messages waiting for deliveries
+	ackLock sync.RWMutex        // Mutex to protect the acknowledgement map
+
+	chunkIdx  uint64               // Index to assign the next chunked transfer (atomic)
+	chunkPull map[uint64]*pullable // Chunks of large requests waiting to be pulled
+	chunkLock sync.Mutex           // Mutex to protect the pullable chunks
+	progress  ProgressHandler      // Optional handler of the chunked transfer progress
+
+	presWatch map[string]*watcher // Presence state of the watched clusters
+	presLock  sync.RWMutex        // Mutex to protect the presence state
+	elect     *elector            // Leadership state within the cluster (nil if not competing)
+
+	retry    *RetryPolicy  // Optional retry policy of the requests
+	redial   *redialer     // Optional reconnection to a restarted carrier
+	codec    Codec         // Optional codec of the typed payloads (JSON if none)
+	spans    Tracer        // Optional tracer of the issued and handled calls
+	outbound []Interceptor // Interceptors of the issued calls
+	inbound  []Interceptor // Interceptors of the handler invocations
+
+	dead       DeadLetterHandler      // Optional handler of the undeliverable messages
+	letterIdx  uint64                 // Index to assign the next retained message
+	letters    map[uint64]*DeadLetter // Sent messages retained for dead lettering
+	letterLock sync.Mutex             // Mutex to protect the retained messages
+
+	tunIdx   uint64             // Index to assign the next tunnel
+	tunLive  map[uint64]*Tunnel // Tunnels either live, or being established
+	tunLock  sync.RWMutex       // Mutex to protect the tunnel map
+	tunGrace time.Duration      // Resumption grace period of the opened tunnels (0 if none)
 
 	// Quality of service fields
-	workers *pool.ThreadPool // Concurrent threads handling the connection
-	splitId uint32           // Id of the next prefix for split cluster round-robin
+	workers   *pool.ThreadPool     // Concurrent threads handling the connection
+	limits    *HandlerLimits       // Optional bounds of the handler queues
+	queues    map[string]*subQueue // Per target sub-queues sharing the workers
+	queueLock sync.Mutex           // Mutex to protect the sub-queue map
+	splitId   uint32               // Id of the next prefix for split cluster round-robin
+	rateReq   *bucket              // Rate limiter of the outbound requests (nil if unlimited)
+	ratePub   *bucket              // Rate limiter of the outbound publishes and broadcasts
+	rateHand  *bucket              // Rate limiter of the inbound handler invocations
+	tracer    tracer               // Traffic statistics per cluster and topic
 
 	// Bookkeeping fields
-	quit chan chan error // Quit channel to synchronize termination
-	term chan struct{}   // Channel to signal termination to blocked go-routines
+	quit   chan chan error // Quit channel to synchronize termination
+	term   chan struct{}   // Channel to signal termination to blocked go-routines
+	drain  chan struct{}   // Channel to signal draining, turning away inbound work
+	idle   chan struct{}   // Notifications of finished work during a drain
+	closed int32           // Whether the connection was closed or drained already (atomic)
 }
 
-// Connects to the iris overlay.
-func (o *Overlay) Connect(cluster string, handler ConnectionHandler) (*Connection, error) {
+// Index of the last assigned connection id. Ids are unique across the overlays of
+// the process, so a reconnecting connection keeps its own on the new carrier (zero
+// is a special case with gob, so it's skipped).
+var connIdx uint64
+
+// Connects to the iris overlay, configured by the given options.
+func (o *Overlay) Connect(cluster string, handler ConnectionHandler, opts ...ConnectionOption) (*Connection, error) {
 	// Create the connection object
 	c := &Connection{
 		cluster: cluster,
 		handler: handler,
 		iris:    o,
 
-		reqPend: make(map[uint64]chan []byte),
+		reqPend: make(map[uint64]chan *reply),
+		reqFail: make(map[uint64]chan error),
+		reqAll:  make(map[uint64]chan *Response),
 		subLive: make(map[string]SubscriptionHandler),
+		subCred: make(map[string]*int32),
+		subWild: make(map[string]SubscriptionHandler),
+		subFan:  make(map[string]*fanout),
+		ackIdx:  1, // Zero means no acknowledgement, skip it
+		ackPend: make(map[uint64]*tracker),
 		tunLive: make(map[uint64]*Tunnel),
+		letters: make(map[uint64]*DeadLetter),
+
+		chunkPull: make(map[uint64]*pullable),
+		presWatch: make(map[string]*watcher),
 
 		// Quality of service
 		workers: pool.NewThreadPool(config.IrisHandlerThreads),
+		queues:  make(map[string]*subQueue),
 
 		// Bookkeeping
-		quit: make(chan chan error),
-		term: make(chan struct{}),
+		quit:  make(chan chan error),
+		term:  make(chan struct{}),
+		drain: make(chan struct{}),
+		idle:  make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		opt(c)
 	}
 	// Assign a connection id and track it
+	c.id = atomic.AddUint64(&connIdx, 1)
+
 	o.lock.Lock()
-	c.id, o.autoid = o.autoid, o.autoid+1
 	o.conns[c.id] = c
 	o.lock.Unlock()
 
 	// Subscribe to the multi-group
 	for _, prefix := range clusterPrefixes {
-		if err := c.iris.subscribe(c.id, prefix+cluster); err != nil {
+		if err := c.carrier().subscribe(c.id, prefix+cluster); err != nil {
 			return nil, err
 		}
 	}
 	c.workers.Start()
 
+	// Announce the new instance to the cluster watchers
+	if err := c.join(); err != nil {
+		return nil, err
+	}
+	// Compete for the cluster leadership if requested
+	if c.elect != nil {
+		if err := c.Watch(cluster, c.elect); err != nil {
+			return nil, err
+		}
+	}
+	// Watch the carrier if reconnection was requested
+	if c.redial != nil {
+		go c.reconnector()
+	}
 	return c, nil
 }
 
 // Broadcasts asynchronously a message to all members of an iris cluster. No
 // guarantees are made that all nodes receive the message (best effort).
 func (c *Connection) Broadcast(cluster string, msg []byte) error {
-	prefixIdx := int(atomic.AddUint32(&c.splitId, 1)) % config.IrisClusterSplits
-	return c.iris.scribe.Publish(clusterPrefixes[prefixIdx]+cluster, c.assembleBroadcast(msg))
+	return c.broadcast(cluster, msg, nil)
+}
+
+// Broadcasts a message with the given metadata attached (nil if none).
+func (c *Connection) broadcast(cluster string, msg []byte, meta Metadata) error {
+	_, err := intercept(c.outbound, CallBroadcast, cluster, msg, func(msg []byte) ([]byte, error) {
+		if !c.ratePub.take() {
+			return nil, ErrRateLimited
+		}
+		c.carrier().count(MetricBroadcastSent)
+		c.statCluster(cluster, func(s *TargetStats) { s.BroadcastsSent++ })
+
+		meta, span := c.traceOut(context.Background(), CallBroadcast, cluster, meta)
+		err := c.disseminate(cluster, c.retain(CallBroadcast, cluster, attach(c.assembleBroadcast(0, msg), meta)))
+		finish(span, err)
+		return nil, err
+	})
+	return err
 }
 
 // Executes a synchronous request to cluster (load balanced between all active),
-// and returns the received reply, or an error if a timeout is reached.
+// and returns the received reply, or an error if a timeout is reached. If the
+// request is reported lost in transit before reaching any member, the failure
+// (a *pastry.ForwardError) is returned without waiting for the timeout, as are
+// the rejections of saturated members (an *OverloadError). If the connection
+// has a retry policy, failed attempts are retried accordingly, each with the
+// full timeout.
 func (c *Connection) Request(cluster string, req []byte, timeout time.Duration) ([]byte, error) {
-	// Create a reply channel for the results
+	return intercept(c.outbound, CallRequest, cluster, req, func(req []byte) ([]byte, error) {
+		return c.retried(context.Background(), func() ([]byte, error) {
+			rep, _, err := c.request(context.Background(), cluster, req, nil, timeout, route{})
+			return rep, err
+		})
+	})
+}
+
+// Executes a request attempt, retrying it according to the retry policy until it
+// succeeds, fails permanently or the context is done.
+func (c *Connection) retried(ctx context.Context, attempt func() ([]byte, error)) ([]byte, error) {
+	rep, err := attempt()
+	if c.retry == nil {
+		return rep, err
+	}
+	for retry := 1; err != nil && retry < c.retry.Attempts && c.retry.retriable(err); retry++ {
+		select {
+		case <-c.term:
+			return nil, ErrTerminating
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(c.retry.wait(retry, err)):
+		}
+		rep, err = attempt()
+	}
+	return rep, err
+}
+
+// Routing preferences of a request.
+type route struct {
+	prio Priority // Priority of the request (high ones are also balanced urgently)
+	key  string   // Affinity key pinning the request to a member ("" if none)
+	node *big.Int // Node of the member to send the request to directly (nil if none)
+	conn uint64   // Connection of the member to send the request to directly
+}
+
+// Executes a single attempt of a synchronous request with the given metadata
+// attached (nil if none), aborting it if the context is done before the timeout.
+func (c *Connection) request(ctx context.Context, cluster string, req []byte, meta Metadata, timeout time.Duration, r route) ([]byte, Metadata, error) {
+	o := c.carrier()
+
+	if !c.rateReq.take() {
+		return nil, nil, ErrRateLimited
+	}
+	start := time.Now()
+	c.statCluster(cluster, func(s *TargetStats) { s.RequestsSent++ })
+
+	meta, span := c.traceOut(ctx, CallRequest, cluster, meta)
+
+	// Create a reply and failure channel for the results
 	c.reqLock.Lock()
-	reqCh := make(chan []byte, 1)
+	reqCh := make(chan *reply, 1)
+	errCh := make(chan error, 1)
 	reqId := c.reqIdx
 	c.reqIdx++
 	c.reqPend[reqId] = reqCh
+	c.reqFail[reqId] = errCh
 	c.reqLock.Unlock()
 
-	// Make sure reply channel is cleaned up
+	// Make sure reply channels are cleaned up
 	defer func() {
 		c.reqLock.Lock()
 		defer c.reqLock.Unlock()
 
 		delete(c.reqPend, reqId)
+		delete(c.reqFail, reqId)
 		close(reqCh)
+		close(errCh)
+		c.settle()
 	}()
-	// Send the request
-	prefixIdx := int(reqId) % config.IrisClusterSplits
-	c.iris.scribe.Balance(clusterPrefixes[prefixIdx]+cluster, c.assembleRequest(reqId, req, timeout))
+	// Send the request, keeping back all but the first chunk of a large one
+	o.count(MetricRequestSent)
+	chunks := c.split(attach(c.assembleRequest(reqId, req, timeout, r), meta))
+	if len(chunks) > 1 && r.node == nil {
+		chunkId := chunks[0].Head.Meta.(*header).ChunkId
+
+		c.chunkLock.Lock()
+		c.chunkPull[chunkId] = &pullable{cluster: cluster, chunks: chunks[1:]}
+		c.chunkLock.Unlock()
+
+		defer func() {
+			c.chunkLock.Lock()
+			delete(c.chunkPull, chunkId)
+			c.chunkLock.Unlock()
+		}()
+	}
+	switch prefixIdx := int(reqId) % config.IrisClusterSplits; {
+	case r.node != nil:
+		for _, chunk := range chunks {
+			chunk.Head.Meta.(*header).Dest = r.conn
+			o.scribe.Direct(r.node, chunk)
+		}
+	case r.key != "":
+		o.scribe.BalanceKey(clusterPrefixes[affinitySplit(r.key)]+cluster, r.key, chunks[0])
+	case r.prio > PriorityNormal:
+		o.scribe.BalanceUrgent(clusterPrefixes[prefixIdx]+cluster, chunks[0])
+	default:
+		o.scribe.Balance(clusterPrefixes[prefixIdx]+cluster, chunks[0])
+	}
+	if len(chunks) > 1 {
+		c.report(Progress{Call: CallRequest, Target: cluster, Done: 1, Total: len(chunks)})
+	}
 
 	// Retrieve the results, time out or fail if terminating
+	var err error
 	select {
 	case <-c.term:
-		return nil, ErrTerminating
+		err = ErrTerminating
+	case <-ctx.Done():
+		err = ctx.Err()
 	case <-time.After(timeout):
-		return nil, ErrTimeout
+		err = ErrTimeout
 	case rep := <-reqCh:
-		return rep, nil
+		c.statCluster(cluster, func(s *TargetStats) { s.RequestLatency.add(time.Since(start)) })
+		finish(span, nil)
+		return rep.data, rep.meta, nil
+	case err = <-errCh:
 	}
+	c.statCluster(cluster, func(s *TargetStats) { s.RequestsFailed++ })
+	finish(span, err)
+	return nil, nil, err
 }
 
 // Subscribes to topic, using handler as the callback for arriving events. An
-// error is returned if subscription fails.
+// error is returned if subscription fails. The topic may also be a pattern, with
+// "+" matching a single level and a trailing "#" any number of levels.
 func (c *Connection) Subscribe(topic string, handler SubscriptionHandler) error {
+	return c.subscribe(topic, handler, false)
+}
+
+// Subscribes to topic in pull mode, using handler as the callback for arriving
+// events. No events are delivered until credits are granted via Credit.
+func (c *Connection) SubscribePull(topic string, handler SubscriptionHandler) error {
+	return c.subscribe(topic, handler, true)
+}
+
+// Subscribes to topic either in push or pull mode.
+func (c *Connection) subscribe(topic string, handler SubscriptionHandler, pull bool) error {
+	o := c.carrier()
+
+	if isPattern(topic) {
+		if pull {
+			return ErrPatternPull
+		}
+		return c.subscribeWild(topic, handler)
+	}
 	// Make sure there are no double subscriptions and not closing
 	c.subLock.Lock()
 	select {
@@ -192,30 +421,238 @@ func (c *Connection) Subscribe(topic string, handler SubscriptionHandler) error
 			c.subLock.Unlock()
 			return ErrSubscribed
 		}
+		cred := new(int32)
 		for _, prefix := range topicPrefixes {
 			c.subLive[prefix+topic] = handler
+			if pull {
+				c.subCred[prefix+topic] = cred
+			}
 		}
 	}
 	c.subLock.Unlock()
 
-	// Subscribe through the carrier
+	// Subscribe through the carrier and update the local allowance
 	for _, prefix := range topicPrefixes {
-		if err := c.iris.subscribe(c.id, prefix+topic); err != nil {
+		if err := o.subscribe(c.id, prefix+topic); err != nil {
 			return err
 		}
 	}
+	o.credit(topic)
+	return nil
+}
+
+// Subscribes to a wildcard pattern, joining the channel of its literal root if no
+// other pattern of the connection did so already.
+func (c *Connection) subscribeWild(pattern string, handler SubscriptionHandler) error {
+	if err := checkPattern(pattern); err != nil {
+		return err
+	}
+	root := patternRoot(pattern)
+
+	c.subLock.Lock()
+	select {
+	case <-c.term:
+		c.subLock.Unlock()
+		return ErrTerminating
+	default:
+		if _, ok := c.subWild[pattern]; ok {
+			c.subLock.Unlock()
+			return ErrSubscribed
+		}
+	}
+	joined := c.rooted(root)
+	c.subWild[pattern] = handler
+	c.subLock.Unlock()
+
+	if !joined {
+		for _, prefix := range wildcardPrefixes {
+			if err := c.carrier().subscribe(c.id, prefix+root); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Unsubscribes from a wildcard pattern, leaving the channel of its root if no
+// other pattern of the connection needs it.
+func (c *Connection) unsubscribeWild(pattern string) error {
+	c.subLock.Lock()
+	select {
+	case <-c.term:
+		c.subLock.Unlock()
+		return ErrTerminating
+	default:
+		if _, ok := c.subWild[pattern]; !ok {
+			c.subLock.Unlock()
+			return ErrNotSubscribed
+		}
+	}
+	delete(c.subWild, pattern)
+	delete(c.subFan, pattern)
+	root := patternRoot(pattern)
+	joined := c.rooted(root)
+	c.subLock.Unlock()
+
+	if !joined {
+		for _, prefix := range wildcardPrefixes {
+			if err := c.carrier().unsubscribe(c.id, prefix+root); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Checks whether any pattern subscription is rooted at root. The subscription
+// lock is assumed held.
+func (c *Connection) rooted(root string) bool {
+	for pattern, _ := range c.subWild {
+		if patternRoot(pattern) == root {
+			return true
+		}
+	}
+	return false
+}
+
+// Grants an additional number of events to a pull mode subscription. The carrier
+// tree limits event forwarding accordingly, and any surplus events that are
+// still in flight are dropped locally.
+func (c *Connection) Credit(topic string, credits int) error {
+	c.subLock.RLock()
+	cred, ok := c.subCred[topicPrefixes[0]+topic]
+	if !ok {
+		_, live := c.subLive[topicPrefixes[0]+topic]
+		c.subLock.RUnlock()
+		if live {
+			return ErrPushMode
+		}
+		return ErrNotSubscribed
+	}
+	atomic.AddInt32(cred, int32(credits))
+	c.subLock.RUnlock()
+
+	// Propagate the new allowance into the carrier
+	c.carrier().credit(topic)
 	return nil
 }
 
+// Returns the remaining credits of a (prefixed) topic subscription, or -1 if it
+// is in push mode.
+func (c *Connection) credits(topic string) int {
+	c.subLock.RLock()
+	defer c.subLock.RUnlock()
+
+	if cred, ok := c.subCred[topic]; ok {
+		return int(atomic.LoadInt32(cred))
+	}
+	return -1
+}
+
 // Publishes an event asynchronously to topic. No guarantees are made that all
 // subscribers receive the message.
 func (c *Connection) Publish(topic string, msg []byte) error {
+	return c.publish(topic, msg, nil, 0)
+}
+
+// Publishes an event to topic, blocking until at least acks subscribers reported
+// its delivery, or returning a timeout error otherwise. Events are acknowledged
+// once taken by the subscription handlers, not when buffered or dropped.
+func (c *Connection) PublishAck(topic string, msg []byte, acks int, timeout time.Duration) error {
+	return c.publishAck(context.Background(), topic, msg, acks, timeout)
+}
+
+// Publishes an acknowledged event, aborting the wait if the context is done
+// before the timeout.
+func (c *Connection) publishAck(ctx context.Context, topic string, msg []byte, acks int, timeout time.Duration) error {
+	if acks <= 0 {
+		return c.Publish(topic, msg)
+	}
+	ackId, acked := c.track(acks)
+	defer c.untrack(ackId)
+
+	// Send the event and wait for the acknowledgements
+	if err := c.publish(topic, msg, nil, ackId); err != nil {
+		return err
+	}
+	select {
+	case <-c.term:
+		return ErrTerminating
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(timeout):
+		return ErrTimeout
+	case <-acked.done:
+		return nil
+	}
+}
+
+// Publishes an event with the given metadata (nil if none) to topic and, if
+// enabled, to the roots of the matching patterns, requesting the delivery
+// acknowledgements if the id is non-zero.
+func (c *Connection) publish(topic string, msg []byte, meta Metadata, ackId uint64) error {
+	if isPattern(topic) {
+		return ErrPatternTopic
+	}
+	_, err := intercept(c.outbound, CallPublish, topic, msg, func(msg []byte) ([]byte, error) {
+		return nil, c.send(topic, msg, meta, ackId)
+	})
+	return err
+}
+
+// Sends an event into the channels of its topic and pattern roots, or into one
+// of its partitions if the topic is partitioned.
+func (c *Connection) send(topic string, msg []byte, meta Metadata, ackId uint64) error {
+	if ok, err := c.spread(topic, msg, meta, ackId); ok {
+		return err
+	}
+	return c.emit(topic, msg, meta, ackId, c.carrier().scribe.Publish)
+}
+
+// Sends an event into the channels of its topic and pattern roots through the
+// given scribe publisher.
+func (c *Connection) emit(topic string, msg []byte, meta Metadata, ackId uint64, publisher func(string, *proto.Message) error) (err error) {
+	if !c.ratePub.take() {
+		return ErrRateLimited
+	}
+	c.carrier().count(MetricPublishSent)
+	c.statTopic(topic, func(s *TargetStats) { s.PublishesSent++ })
+
+	meta, span := c.traceOut(context.Background(), CallPublish, topic, meta)
+	defer func() { finish(span, err) }()
+
 	prefixIdx := int(atomic.AddUint32(&c.splitId, 1)) % config.IrisClusterSplits
-	return c.iris.scribe.Publish(topicPrefixes[prefixIdx]+topic, c.assemblePublish(msg))
+	publish := func(topic string) func(*proto.Message) error {
+		return func(msg *proto.Message) error { return publisher(topic, msg) }
+	}
+	if !config.IrisWildcards {
+		return c.transmit(CallPublish, topic, c.split(c.retain(CallPublish, topic, attach(c.assemblePublish(ackId, msg), meta))), publish(topicPrefixes[prefixIdx]+topic))
+	}
+	// Relay the event to the pattern roots too (messages are encrypted in place)
+	data := append([]byte(nil), msg...)
+	if err := c.transmit(CallPublish, topic, c.split(c.retain(CallPublish, topic, attach(c.assemblePublish(ackId, msg), meta))), publish(topicPrefixes[prefixIdx]+topic)); err != nil {
+		return err
+	}
+	for _, root := range topicRoots(topic) {
+		relay := append([]byte(nil), data...)
+		for _, chunk := range c.split(attach(c.assembleWildcard(topic, ackId, relay), meta)) {
+			if err := publisher(wildcardPrefixes[prefixIdx]+root, chunk); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
-// Unsubscribes from topic, receiving no more event notifications for it.
+// Unsubscribes from topic, receiving no more event notifications for it. Any
+// durable subscription to the topic is removed along with its buffered events,
+// and any handlers registered via AddHandler along with the subscription.
 func (c *Connection) Unsubscribe(topic string) error {
+	o := c.carrier()
+
+	if isPattern(topic) {
+		return c.unsubscribeWild(topic)
+	}
 	// Remove subscription if present
 	c.subLock.Lock()
 	select {
@@ -230,15 +667,19 @@ func (c *Connection) Unsubscribe(topic string) error {
 	}
 	for _, prefix := range topicPrefixes {
 		delete(c.subLive, prefix+topic)
+		delete(c.subCred, prefix+topic)
 	}
+	delete(c.subFan, topic)
 	c.subLock.Unlock()
 
-	// Notify the carrier of the removal
+	// Notify the carrier of the removal and update the remaining allowance
 	for _, prefix := range topicPrefixes {
-		if err := c.iris.unsubscribe(c.id, prefix+topic); err != nil {
+		if err := o.unsubscribe(c.id, prefix+topic); err != nil {
 			return err
 		}
 	}
+	c.forget(topic)
+	o.credit(topic)
 	return nil
 }
 
@@ -246,6 +687,11 @@ func (c *Connection) Unsubscribe(topic string) error {
 // and order-guaranteed message passing between them. The method blocks until
 // either the newly created tunnel is set up, or a timeout is reached.
 func (c *Connection) Tunnel(cluster string, timeout time.Duration) (*Tunnel, error) {
+	return c.tunnel(context.Background(), cluster, timeout)
+}
+
+// Opens a direct tunnel, aborting if the context is done before the timeout.
+func (c *Connection) tunnel(ctx context.Context, cluster string, timeout time.Duration) (*Tunnel, error) {
 	c.tunLock.RLock()
 	select {
 	case <-c.term:
@@ -253,12 +699,38 @@ func (c *Connection) Tunnel(cluster string, timeout time.Duration) (*Tunnel, err
 		return nil, ErrTerminating
 	default:
 		c.tunLock.RUnlock()
-		return c.initiateTunnel(cluster, timeout)
+		c.carrier().count(MetricTunnelSent)
+		return c.initiateTunnel(ctx, cluster, timeout)
 	}
 }
 
-// Gracefully terminates the connection, all subscriptions and all tunnels.
+// Gracefully terminates the connection, all subscriptions and all tunnels. If
+// the connection was already closed or is being drained, ErrTerminating is
+// returned.
 func (c *Connection) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return ErrTerminating
+	}
+	return c.close()
+}
+
+// Retrieves the carrier the connection is currently bound to.
+func (c *Connection) carrier() *Overlay {
+	c.irisLock.RLock()
+	defer c.irisLock.RUnlock()
+
+	return c.iris
+}
+
+// Returns a channel which is closed when the connection starts terminating.
+func (c *Connection) Done() <-chan struct{} {
+	return c.term
+}
+
+// Terminates the connection, all subscriptions and all tunnels.
+func (c *Connection) close() error {
+	o := c.carrier()
+
 	// Signal the connection as terminating
 	close(c.term)
 
@@ -269,16 +741,29 @@ func (c *Connection) Close() error {
 	}
 	c.tunLock.Unlock()*/
 
-	// Remove all topic subscriptions
+	// Suspend the durable subscriptions and remove all topic subscriptions
+	c.suspend()
 	c.subLock.Lock()
 	for topic, _ := range c.subLive {
-		c.iris.unsubscribe(c.id, topic)
+		o.unsubscribe(c.id, topic)
+	}
+	roots := make(map[string]struct{})
+	for pattern, _ := range c.subWild {
+		roots[patternRoot(pattern)] = struct{}{}
+	}
+	for root, _ := range roots {
+		for _, prefix := range wildcardPrefixes {
+			o.unsubscribe(c.id, prefix+root)
+		}
 	}
 	c.subLock.Unlock()
 
-	// Leave the cluster and close the carrier connection
-	for _, prefix := range clusterPrefixes {
-		c.iris.unsubscribe(c.id, prefix+c.cluster)
+	// Leave the cluster (unless drained already) and close the carrier connection
+	c.leave()
+	if !c.draining() {
+		for _, prefix := range clusterPrefixes {
+			o.unsubscribe(c.id, prefix+c.cluster)
+		}
 	}
 	// Terminate the worker pool
 	c.workers.Terminate(true)
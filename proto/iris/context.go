@@ -0,0 +1,96 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the context bound variants of the client operations. The remaining
+// time of the context's deadline is used as the operation timeout (and is also
+// the time limit communicated to remote handlers), whereas cancelling it aborts
+// the operations in flight. Passing deadlines are reported as ErrTimeout, same
+// as with the fixed duration variants.
+
+package iris
+
+import (
+	"context"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Calculates the time limit of a context bound operation: the time left until the
+// context's deadline, or config.IrisContextTimeout if it has none.
+func contextTimeout(ctx context.Context) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		return deadline.Sub(time.Now())
+	}
+	return config.IrisContextTimeout
+}
+
+// Converts an exceeded context deadline into the iris timeout error.
+func contextError(err error) error {
+	if err == context.DeadlineExceeded {
+		return ErrTimeout
+	}
+	return err
+}
+
+// Broadcasts asynchronously a message to all members of an iris cluster, unless
+// the context is already done.
+func (c *Connection) BroadcastContext(ctx context.Context, cluster string, msg []byte) error {
+	if err := ctx.Err(); err != nil {
+		return contextError(err)
+	}
+	return c.Broadcast(cluster, msg)
+}
+
+// Executes a synchronous request to cluster, bound by the context. Retries of the
+// connection's policy are attempted only while the context is not done, sharing
+// its deadline.
+func (c *Connection) RequestContext(ctx context.Context, cluster string, req []byte) ([]byte, error) {
+	rep, err := intercept(c.outbound, CallRequest, cluster, req, func(req []byte) ([]byte, error) {
+		return c.retried(ctx, func() ([]byte, error) {
+			rep, _, err := c.request(ctx, cluster, req, nil, contextTimeout(ctx), route{})
+			return rep, err
+		})
+	})
+	return rep, contextError(err)
+}
+
+// Publishes an event asynchronously to topic, unless the context is already done.
+func (c *Connection) PublishContext(ctx context.Context, topic string, msg []byte) error {
+	if err := ctx.Err(); err != nil {
+		return contextError(err)
+	}
+	return c.Publish(topic, msg)
+}
+
+// Publishes an event to topic, blocking until at least acks subscribers reported
+// its delivery, or the context is done.
+func (c *Connection) PublishAckContext(ctx context.Context, topic string, msg []byte, acks int) error {
+	if err := ctx.Err(); err != nil {
+		return contextError(err)
+	}
+	return contextError(c.publishAck(ctx, topic, msg, acks, contextTimeout(ctx)))
+}
+
+// Opens a direct tunnel to a member of cluster, blocking until either the tunnel
+// is set up, or the context is done.
+func (c *Connection) TunnelContext(ctx context.Context, cluster string) (*Tunnel, error) {
+	tun, err := c.tunnel(ctx, cluster, contextTimeout(ctx))
+	return tun, contextError(err)
+}
@@ -0,0 +1,85 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package iris
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+// Tests that the context bound operations honor deadlines and cancellations.
+func TestContext(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("context-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	conn, err := node.Connect("context-test", &requester{0, 0})
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer conn.Close()
+
+	// Requests within the deadline should succeed
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if rep, err := conn.RequestContext(ctx, "context-test", []byte{0x00}); err != nil {
+		t.Fatalf("failed to execute request: %v.", err)
+	} else if !bytes.Equal(rep, []byte{0x00}) {
+		t.Fatalf("reply mismatch: have %v, want %v.", rep, []byte{0x00})
+	}
+	// Deadlines should time out and cancellations abort early
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := conn.RequestContext(ctx, "context-test-missing", []byte{0x00}); err != ErrTimeout {
+		t.Fatalf("expired request error mismatch: have %v, want %v.", err, ErrTimeout)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	if _, err := conn.TunnelContext(ctx, "context-test-missing"); err != context.Canceled {
+		t.Fatalf("cancelled tunnel error mismatch: have %v, want %v.", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("tunnel aborted slowly: have %v, want < 1s.", elapsed)
+	}
+	// Asynchronous operations should refuse done contexts
+	if err := conn.PublishContext(ctx, "context-test-topic", nil); err != context.Canceled {
+		t.Fatalf("cancelled publish error mismatch: have %v, want %v.", err, context.Canceled)
+	}
+	if err := conn.BroadcastContext(ctx, "context-test", nil); err != context.Canceled {
+		t.Fatalf("cancelled broadcast error mismatch: have %v, want %v.", err, context.Canceled)
+	}
+	if err := conn.PublishAckContext(ctx, "context-test-topic", nil, 1); err != context.Canceled {
+		t.Fatalf("cancelled acknowledged publish error mismatch: have %v, want %v.", err, context.Canceled)
+	}
+}
@@ -0,0 +1,126 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the dead lettering of undeliverable publishes and broadcasts. If the
+// connection has a dead letter handler, a copy of each sent message is retained
+// for a while, and should the overlay report it undeliverable (no members in the
+// topic or cluster) or lost before reaching any, the copy is passed to the
+// handler along with the reason, instead of the message silently vanishing.
+
+package iris
+
+import (
+	"time"
+
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto"
+)
+
+// Metadata keys describing the failure of a message republished into a dead
+// letter topic.
+const (
+	DeadCallKey   = "dead-call"
+	DeadTargetKey = "dead-target"
+	DeadReasonKey = "dead-reason"
+)
+
+// Publish or broadcast that could not be delivered.
+type DeadLetter struct {
+	Call   string   // Kind of the undelivered message (CallBroadcast or CallPublish)
+	Target string   // Cluster or topic the message was sent to
+	Msg    []byte   // Payload of the message
+	Meta   Metadata // Metadata attached to the message
+	Reason error    // Failure of the delivery (a *pastry.ForwardError)
+}
+
+// Handler of the undeliverable messages sent through a connection.
+type DeadLetterHandler interface {
+	// Handles a publish or broadcast that could not be delivered.
+	HandleDeadLetter(letter *DeadLetter)
+}
+
+// Dead letter handler republishing the undelivered messages into a topic, with
+// the failure details attached as metadata.
+type deadTopic struct {
+	conn  *Connection
+	topic string
+}
+
+// Implements DeadLetterHandler.HandleDeadLetter, republishing the letter. The
+// letters of the dead letter topic itself are dropped to prevent looping.
+func (d *deadTopic) HandleDeadLetter(letter *DeadLetter) {
+	if letter.Call == CallPublish && letter.Target == d.topic {
+		d.conn.carrier().logger.Printf("iris: dropping undeliverable dead letter: %v.", letter.Reason)
+		return
+	}
+	meta := Metadata{DeadCallKey: letter.Call, DeadTargetKey: letter.Target, DeadReasonKey: letter.Reason.Error()}
+	for key, val := range letter.Meta {
+		meta[key] = val
+	}
+	if err := d.conn.publish(d.topic, letter.Msg, meta, 0); err != nil {
+		d.conn.carrier().logger.Printf("iris: failed to republish dead letter: %v.", err)
+	}
+}
+
+// Retains a copy of an assembled publish or broadcast for dead lettering, tagging
+// the message with its id. Nothing is retained if dead lettering is disabled. The
+// copy is released after config.IrisDeadLetterWindow.
+func (c *Connection) retain(call, target string, msg *proto.Message) *proto.Message {
+	if c.dead == nil {
+		return msg
+	}
+	head := msg.Head.Meta.(*header)
+	letter := &DeadLetter{
+		Call:   call,
+		Target: target,
+		Msg:    append([]byte(nil), msg.Data...),
+		Meta:   head.Metadata,
+	}
+	c.letterLock.Lock()
+	c.letterIdx++
+	id := c.letterIdx
+	c.letters[id] = letter
+	c.letterLock.Unlock()
+
+	head.Letter = id
+	time.AfterFunc(config.IrisDeadLetterWindow, func() { c.release(id) })
+	return msg
+}
+
+// Releases a retained message, returning it if it was still retained.
+func (c *Connection) release(id uint64) *DeadLetter {
+	c.letterLock.Lock()
+	defer c.letterLock.Unlock()
+
+	letter, ok := c.letters[id]
+	if ok {
+		delete(c.letters, id)
+	}
+	return letter
+}
+
+// Passes a retained message reported undeliverable to the dead letter handler.
+// Repeated reports of the same message (e.g. multiple chunks) are dropped.
+func (c *Connection) handleUndelivered(id uint64, err error) {
+	if letter := c.release(id); letter != nil {
+		letter.Reason = err
+		c.carrier().count(MetricDeadLetter)
+		c.dead.HandleDeadLetter(letter)
+	}
+}
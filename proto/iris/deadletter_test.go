@@ -0,0 +1,147 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package iris
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/proto/pastry"
+)
+
+// Dead letter handler collecting the undelivered messages.
+type collector struct {
+	letters chan *DeadLetter
+}
+
+func (c *collector) HandleDeadLetter(letter *DeadLetter) {
+	c.letters <- letter
+}
+
+// Tests that publishes and broadcasts without recipients are dead lettered.
+func TestDeadLetter(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("deadletter-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	handler := &collector{make(chan *DeadLetter, 2)}
+	conn, err := node.Connect("deadletter-test", nil, WithDeadLetters(handler))
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer conn.Close()
+
+	// Send messages nobody's listening for
+	if err := conn.PublishMeta("deadletter-missing-topic", []byte("event"), Metadata{"id": "1"}); err != nil {
+		t.Fatalf("failed to publish event: %v.", err)
+	}
+	if err := conn.Broadcast("deadletter-missing-cluster", []byte("broadcast")); err != nil {
+		t.Fatalf("failed to broadcast message: %v.", err)
+	}
+	want := map[string]*DeadLetter{
+		CallPublish:   {Call: CallPublish, Target: "deadletter-missing-topic", Msg: []byte("event")},
+		CallBroadcast: {Call: CallBroadcast, Target: "deadletter-missing-cluster", Msg: []byte("broadcast")},
+	}
+	for len(want) > 0 {
+		select {
+		case letter := <-handler.letters:
+			exp, ok := want[letter.Call]
+			if !ok {
+				t.Fatalf("unexpected dead letter: %v.", letter)
+			}
+			if letter.Target != exp.Target || string(letter.Msg) != string(exp.Msg) {
+				t.Fatalf("dead letter mismatch: have %v, want %v.", letter, exp)
+			}
+			if fail, ok := letter.Reason.(*pastry.ForwardError); !ok || fail.Reason != pastry.ErrUndeliverable {
+				t.Fatalf("dead letter reason mismatch: have %v, want %v.", letter.Reason, pastry.ErrUndeliverable)
+			}
+			if letter.Call == CallPublish && letter.Meta["id"] != "1" {
+				t.Fatalf("dead letter metadata mismatch: have %v, want %v.", letter.Meta, Metadata{"id": "1"})
+			}
+			delete(want, letter.Call)
+		case <-time.After(time.Second):
+			t.Fatalf("message not dead lettered.")
+		}
+	}
+	// Delivered messages should not be dead lettered
+	if err := conn.Subscribe("deadletter-topic", &subscriber{msgs: make(chan []byte, 1)}); err != nil {
+		t.Fatalf("failed to subscribe to topic: %v.", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := conn.Publish("deadletter-topic", []byte("delivered")); err != nil {
+		t.Fatalf("failed to publish event: %v.", err)
+	}
+	select {
+	case letter := <-handler.letters:
+		t.Fatalf("delivered message dead lettered: %v.", letter)
+	case <-time.After(250 * time.Millisecond):
+	}
+}
+
+// Tests that dead letters can be republished into a topic.
+func TestDeadLetterTopic(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("deadletter-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	handler := &metaHandler{make(chan Metadata, 1), make(chan Metadata, 1)}
+	monitor, err := node.Connect("deadletter-monitor", handler)
+	if err != nil {
+		t.Fatalf("failed to connect monitor to the iris overlay: %v.", err)
+	}
+	defer monitor.Close()
+
+	if err := monitor.Subscribe("deadletter-dead", handler); err != nil {
+		t.Fatalf("failed to subscribe to dead letter topic: %v.", err)
+	}
+	conn, err := node.Connect("deadletter-test", nil, WithDeadLetterTopic("deadletter-dead"))
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	if err := conn.Publish("deadletter-missing-topic", []byte("event")); err != nil {
+		t.Fatalf("failed to publish event: %v.", err)
+	}
+	select {
+	case meta := <-handler.events:
+		if meta[DeadCallKey] != CallPublish || meta[DeadTargetKey] != "deadletter-missing-topic" || meta[DeadReasonKey] == "" {
+			t.Fatalf("dead letter metadata mismatch: have %v.", meta)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("dead letter not republished.")
+	}
+}
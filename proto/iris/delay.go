@@ -0,0 +1,59 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the delayed publishes. A delayed event is sent to the root of one of
+// its topic's split trees (and to the pattern roots), where it is held back
+// until the due time, being distributed as a regular event after. Delayed events are not
+// partitioned, and are lost if the holding root leaves the overlay before due.
+
+package iris
+
+import (
+	"errors"
+	"time"
+
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto"
+)
+
+var ErrDelayLimit = errors.New("publish delay beyond limit")
+
+// Publishes an event asynchronously to topic, delivered to the subscribers only
+// after the given delay.
+func (c *Connection) PublishDelayed(topic string, msg []byte, delay time.Duration) error {
+	return c.PublishAt(topic, msg, time.Now().Add(delay))
+}
+
+// Publishes an event asynchronously to topic, delivered to the subscribers only
+// at the given time (as measured by the topic root). Past times are delivered
+// immediately by the root.
+func (c *Connection) PublishAt(topic string, msg []byte, due time.Time) error {
+	if isPattern(topic) {
+		return ErrPatternTopic
+	}
+	if due.Sub(time.Now()) > config.IrisDelayLimit {
+		return ErrDelayLimit
+	}
+	_, err := intercept(c.outbound, CallPublish, topic, msg, func(msg []byte) ([]byte, error) {
+		return nil, c.emit(topic, msg, nil, 0, func(topic string, msg *proto.Message) error {
+			return c.carrier().scribe.Delay(topic, due, msg)
+		})
+	})
+	return err
+}
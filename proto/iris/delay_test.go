@@ -0,0 +1,81 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package iris
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Tests that delayed events are held back until due.
+func TestDelay(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("delay-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	conn, err := node.Connect("delay-test", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer conn.Close()
+
+	handler := &subscriber{make(chan []byte, 2)}
+	if err := conn.Subscribe("delay-test-topic", handler); err != nil {
+		t.Fatalf("failed to subscribe to topic: %v.", err)
+	}
+	time.Sleep(250 * time.Millisecond)
+
+	// Publish a delayed event and an immediate one, checking the arrival order
+	delay := 500 * time.Millisecond
+	start := time.Now()
+	if err := conn.PublishDelayed("delay-test-topic", []byte{0x01}, delay); err != nil {
+		t.Fatalf("failed to publish delayed event: %v.", err)
+	}
+	if err := conn.Publish("delay-test-topic", []byte{0x02}); err != nil {
+		t.Fatalf("failed to publish event: %v.", err)
+	}
+	for _, want := range []byte{0x02, 0x01} {
+		select {
+		case msg := <-handler.msgs:
+			if len(msg) != 1 || msg[0] != want {
+				t.Fatalf("event mismatch: have %v, want %v.", msg, []byte{want})
+			}
+		case <-time.After(2 * delay):
+			t.Fatalf("event %v not delivered.", want)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Fatalf("delayed event delivered early: have %v, want >= %v.", elapsed, delay)
+	}
+	// Delays beyond the limit should be rejected
+	if err := conn.PublishDelayed("delay-test-topic", nil, 2*config.IrisDelayLimit); err != ErrDelayLimit {
+		t.Fatalf("delay limit error mismatch: have %v, want %v.", err, ErrDelayLimit)
+	}
+}
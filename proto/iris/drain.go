@@ -0,0 +1,110 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the graceful draining of a connection. A draining connection leaves
+// its cluster so no new requests or broadcasts are balanced to it, turns away
+// any inbound work still arriving (requests being rejected as overloaded so the
+// callers may retry elsewhere), and closes once the already accepted handler
+// invocations and its own pending requests finish.
+
+package iris
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Gracefully drains the connection, closing it when all in-flight handler
+// invocations and outbound requests finished. Replies keep flowing during the
+// drain, but no new inbound work is accepted. If the timeout is reached before
+// everything finishes, the connection is closed anyway and ErrTimeout returned:
+// pending outbound requests are aborted and queued work discarded, but like on
+// Close, handler invocations already running are waited for. If the connection
+// was already closed or is being drained, ErrTerminating is returned.
+func (c *Connection) Drain(timeout time.Duration) error {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return ErrTerminating
+	}
+	// Stop accepting new work and leave the cluster's balancing tree
+	close(c.drain)
+	for _, prefix := range clusterPrefixes {
+		c.carrier().unsubscribe(c.id, prefix+c.cluster)
+	}
+	// Wait for the in-flight work to finish, bounded by the timeout
+	var err error
+	deadline := time.After(timeout)
+	for err == nil && c.busy() {
+		select {
+		case <-c.idle:
+		case <-deadline:
+			err = ErrTimeout
+		}
+	}
+	c.close()
+	return err
+}
+
+// Checks whether the connection is being drained.
+func (c *Connection) draining() bool {
+	select {
+	case <-c.drain:
+		return true
+	default:
+		return false
+	}
+}
+
+// Checks whether a sub-queue holds inbound work of the application handlers,
+// which is turned away during a drain.
+func inbound(name string) bool {
+	switch {
+	case name == queueRequest, name == queueBroadcast:
+		return true
+	case strings.HasPrefix(name, "topic/"), strings.HasPrefix(name, "ordered/"), strings.HasPrefix(name, "tunnel/"):
+		return true
+	}
+	return false
+}
+
+// Checks whether any inbound handler invocation or outbound request is still in
+// flight.
+func (c *Connection) busy() bool {
+	c.queueLock.Lock()
+	for name, _ := range c.queues {
+		if inbound(name) {
+			c.queueLock.Unlock()
+			return true
+		}
+	}
+	c.queueLock.Unlock()
+
+	c.reqLock.RLock()
+	defer c.reqLock.RUnlock()
+
+	return len(c.reqPend) > 0 || len(c.reqAll) > 0
+}
+
+// Notifies a pending drain that some in-flight work finished.
+func (c *Connection) settle() {
+	select {
+	case c.idle <- struct{}{}:
+	default:
+	}
+}
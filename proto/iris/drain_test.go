@@ -0,0 +1,158 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package iris
+
+import (
+	"crypto/x509"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Tests that draining waits for the in-flight requests before closing.
+func TestDrain(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("drain-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	handler := &sleeper{delay: 250 * time.Millisecond}
+	server, err := node.Connect("drain-server", handler)
+	if err != nil {
+		t.Fatalf("failed to connect server to the iris overlay: %v.", err)
+	}
+	client, err := node.Connect("drain-client", nil)
+	if err != nil {
+		t.Fatalf("failed to connect client to the iris overlay: %v.", err)
+	}
+	defer client.Close()
+
+	// Start a request and drain the server while it's being served
+	errc := make(chan error, 1)
+	go func() {
+		_, err := client.Request("drain-server", []byte("slow"), time.Second)
+		errc <- err
+	}()
+	for atomic.LoadInt32(&handler.calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := server.Drain(time.Second); err != nil {
+		t.Fatalf("failed to drain server: %v.", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("in-flight request failed during drain: %v.", err)
+	}
+}
+
+// Tests that draining is bounded by its timeout.
+func TestDrainTimeout(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("drain-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	handler := &sleeper{delay: time.Second}
+	server, err := node.Connect("drain-server", handler)
+	if err != nil {
+		t.Fatalf("failed to connect server to the iris overlay: %v.", err)
+	}
+	defer server.Close()
+
+	client, err := node.Connect("drain-client", nil)
+	if err != nil {
+		t.Fatalf("failed to connect client to the iris overlay: %v.", err)
+	}
+	// Drain the client while one of its own requests is stuck
+	errc := make(chan error, 1)
+	go func() {
+		_, err := client.Request("drain-server", []byte("stuck"), 2*time.Second)
+		errc <- err
+	}()
+	for atomic.LoadInt32(&handler.calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	start := time.Now()
+	if err := client.Drain(100 * time.Millisecond); err != ErrTimeout {
+		t.Fatalf("drain error mismatch: have %v, want %v.", err, ErrTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("drain overran its timeout: %v.", elapsed)
+	}
+	if err := <-errc; err != ErrTerminating {
+		t.Fatalf("stuck request error mismatch: have %v, want %v.", err, ErrTerminating)
+	}
+}
+
+// Tests that a terminated connection can be neither closed nor drained again.
+func TestDrainClosed(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("drain-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	for _, drain := range []bool{false, true} {
+		conn, err := node.Connect("drain-closed", nil)
+		if err != nil {
+			t.Fatalf("failed to connect to the iris overlay: %v.", err)
+		}
+		select {
+		case <-conn.Done():
+			t.Fatalf("live connection reported done.")
+		default:
+		}
+		if drain {
+			err = conn.Drain(time.Second)
+		} else {
+			err = conn.Close()
+		}
+		if err != nil {
+			t.Fatalf("failed to terminate connection (drain: %v): %v.", drain, err)
+		}
+		select {
+		case <-conn.Done():
+		default:
+			t.Fatalf("terminated connection not reported done (drain: %v).", drain)
+		}
+		if err := conn.Close(); err != ErrTerminating {
+			t.Fatalf("repeated close error mismatch (drain: %v): have %v, want %v.", drain, err, ErrTerminating)
+		}
+		if err := conn.Drain(time.Second); err != ErrTerminating {
+			t.Fatalf("repeated drain error mismatch (drain: %v): have %v, want %v.", drain, err, ErrTerminating)
+		}
+	}
+}
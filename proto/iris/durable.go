@@ -0,0 +1,298 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the durable subscriptions. A durable subscription is identified by a
+// name and outlives the connection that made it: after the connection closes,
+// the local node stays subscribed to the topic, buffering the events into a
+// store, and replays them when a connection resumes the subscription.
+
+package iris
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+var ErrDurableTopic = errors.New("durable subscription topic mismatch")
+var ErrPatternDurable = errors.New("pattern subscription durable")
+
+// Id of the pseudo-connection buffering the events of offline subscriptions.
+const bufferConn = 0
+
+// Storage of the events published while a durable subscription was offline.
+// Implementations must be safe for use by multiple go-routines.
+type Store interface {
+	// Buffers an event for the named subscription.
+	Append(name string, msg []byte) error
+
+	// Retrieves and removes all the events buffered for the named subscription,
+	// oldest first.
+	Replay(name string) ([][]byte, error)
+
+	// Discards all the events buffered for the named subscription.
+	Drop(name string) error
+}
+
+// A durable subscription and the connection currently owning it (nil if offline).
+type durable struct {
+	topic string
+	conn  *Connection
+}
+
+// Subscribes to topic with a durable subscription, using handler as the callback
+// for arriving events. If the named subscription already exists but is offline,
+// it is resumed, replaying the events buffered since to the handler first.
+func (c *Connection) SubscribeDurable(name, topic string, handler SubscriptionHandler) error {
+	if isPattern(topic) {
+		return ErrPatternDurable
+	}
+	// Claim the durable subscription, creating it if needed
+	o := c.carrier()
+	o.lock.Lock()
+	sub, resume := o.durable[name]
+	switch {
+	case resume && sub.conn != nil:
+		o.lock.Unlock()
+		return ErrSubscribed
+	case resume && sub.topic != topic:
+		o.lock.Unlock()
+		return ErrDurableTopic
+	case !resume:
+		sub = &durable{topic: topic}
+		o.durable[name] = sub
+	}
+	sub.conn = c
+	last := resume && o.offline(topic) == 0
+	o.lock.Unlock()
+
+	// Subscribe live before replaying to not lose events in between
+	if err := c.subscribe(topic, handler, false); err != nil {
+		o.lock.Lock()
+		if resume {
+			sub.conn = nil
+		} else {
+			delete(o.durable, name)
+		}
+		o.lock.Unlock()
+		return err
+	}
+	if !resume {
+		return nil
+	}
+	msgs, err := o.store.Replay(name)
+	if err != nil {
+		o.logger.Printf("iris: failed to replay durable subscription: %v.", err)
+	}
+	if len(msgs) > 0 {
+		c.schedule(topicQueue(topicPrefixes[0]+topic), func() {
+			for _, msg := range msgs {
+				c.deliver(topic, handler, msg, nil)
+			}
+		})
+	}
+	if last {
+		return o.release(topic)
+	}
+	return nil
+}
+
+// Retrieves the durable subscriptions owned by a connection, keyed by name.
+func (c *Connection) durables() map[string]string {
+	o := c.carrier()
+
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	subs := make(map[string]string)
+	for name, sub := range o.durable {
+		if sub.conn == c {
+			subs[name] = sub.topic
+		}
+	}
+	return subs
+}
+
+// Disowns the durable subscriptions of a closing connection, buffering their
+// events until resumed.
+func (c *Connection) suspend() {
+	o := c.carrier()
+
+	for name, topic := range c.durables() {
+		o.lock.Lock()
+		o.durable[name].conn = nil
+		first := o.offline(topic) == 1
+		o.lock.Unlock()
+
+		if first {
+			if err := o.retain(topic); err != nil {
+				o.logger.Printf("iris: failed to retain durable subscription: %v.", err)
+			}
+		}
+	}
+}
+
+// Permanently removes the durable subscriptions of a connection to a topic.
+func (c *Connection) forget(topic string) {
+	o := c.carrier()
+
+	for name, subTopic := range c.durables() {
+		if subTopic != topic {
+			continue
+		}
+		o.lock.Lock()
+		delete(o.durable, name)
+		o.lock.Unlock()
+
+		if err := o.store.Drop(name); err != nil {
+			o.logger.Printf("iris: failed to drop durable subscription: %v.", err)
+		}
+	}
+}
+
+// Counts the offline durable subscriptions of a topic. The overlay lock is
+// assumed held.
+func (o *Overlay) offline(topic string) int {
+	count := 0
+	for _, sub := range o.durable {
+		if sub.topic == topic && sub.conn == nil {
+			count++
+		}
+	}
+	return count
+}
+
+// Subscribes the buffer to topic, keeping the events flowing to the local node
+// after the first durable subscription goes offline.
+func (o *Overlay) retain(topic string) error {
+	for _, prefix := range topicPrefixes {
+		if err := o.subscribe(bufferConn, prefix+topic); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unsubscribes the buffer from topic once the last offline durable subscription
+// was resumed.
+func (o *Overlay) release(topic string) error {
+	for _, prefix := range topicPrefixes {
+		if err := o.unsubscribe(bufferConn, prefix+topic); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Buffers an event of a (prefixed) topic for all its offline durable subscriptions.
+func (o *Overlay) buffer(topic string, msg []byte) {
+	topic = topic[len(topicPrefixes[0]):]
+
+	o.lock.RLock()
+	names := []string{}
+	for name, sub := range o.durable {
+		if sub.topic == topic && sub.conn == nil {
+			names = append(names, name)
+		}
+	}
+	o.lock.RUnlock()
+
+	for _, name := range names {
+		if err := o.store.Append(name, msg); err != nil {
+			o.logger.Printf("iris: failed to buffer durable event: %v.", err)
+		}
+	}
+}
+
+// Event buffered in memory, along with its arrival time.
+type storedEvent struct {
+	msg    []byte
+	stored time.Time
+}
+
+// In-memory store bounding the buffered events both in count and in age.
+type memoryStore struct {
+	limit     int                      // Maximum number of events per subscription
+	retention time.Duration            // Maximum age of the buffered events
+	events    map[string][]storedEvent // Buffered events of each subscription
+	lock      sync.Mutex               // Mutex to protect the event buffers
+}
+
+// Creates an in-memory store, keeping at most limit events per subscription, none
+// older than retention.
+func NewMemoryStore(limit int, retention time.Duration) Store {
+	return &memoryStore{
+		limit:     limit,
+		retention: retention,
+		events:    make(map[string][]storedEvent),
+	}
+}
+
+// Creates an in-memory store bounded by the configured durable limits.
+func newMemoryStore() Store {
+	return NewMemoryStore(config.IrisDurableLimit, config.IrisDurableRetention)
+}
+
+// Implements Store.Append, evicting the oldest events beyond the limits.
+func (s *memoryStore) Append(name string, msg []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	events := append(s.expire(s.events[name]), storedEvent{msg, time.Now()})
+	if len(events) > s.limit {
+		events = events[len(events)-s.limit:]
+	}
+	s.events[name] = events
+	return nil
+}
+
+// Implements Store.Replay.
+func (s *memoryStore) Replay(name string) ([][]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	events := s.expire(s.events[name])
+	delete(s.events, name)
+
+	msgs := make([][]byte, len(events))
+	for i, event := range events {
+		msgs[i] = event.msg
+	}
+	return msgs, nil
+}
+
+// Implements Store.Drop.
+func (s *memoryStore) Drop(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.events, name)
+	return nil
+}
+
+// Discards the events older than the retention period.
+func (s *memoryStore) expire(events []storedEvent) []storedEvent {
+	cutoff := time.Now().Add(-s.retention)
+	for len(events) > 0 && events[0].stored.Before(cutoff) {
+		events = events[1:]
+	}
+	return events
+}
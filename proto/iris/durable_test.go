@@ -0,0 +1,159 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package iris
+
+import (
+	"crypto/x509"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore(3, 50*time.Millisecond)
+
+	// Buffer more events than the limit, the oldest should be evicted
+	for i := 0; i < 5; i++ {
+		if err := store.Append("sub", []byte{byte(i)}); err != nil {
+			t.Fatalf("failed to buffer event: %v.", err)
+		}
+	}
+	msgs, err := store.Replay("sub")
+	if err != nil {
+		t.Fatalf("failed to replay events: %v.", err)
+	}
+	if len(msgs) != 3 {
+		t.Fatalf("replay count mismatch: have %d, want %d.", len(msgs), 3)
+	}
+	for i, msg := range msgs {
+		if msg[0] != byte(i+2) {
+			t.Fatalf("replay %d mismatch: have %v, want %v.", i, msg[0], i+2)
+		}
+	}
+	// Replay should clear the buffer, and retention expire old events
+	if msgs, _ := store.Replay("sub"); len(msgs) != 0 {
+		t.Fatalf("replay count mismatch after drain: have %d, want %d.", len(msgs), 0)
+	}
+	store.Append("sub", []byte{0})
+	time.Sleep(100 * time.Millisecond)
+	store.Append("sub", []byte{1})
+	if msgs, _ := store.Replay("sub"); len(msgs) != 1 || msgs[0][0] != 1 {
+		t.Fatalf("replay mismatch after expiry: have %v, want [[1]].", msgs)
+	}
+	// Dropped buffers should be gone
+	store.Append("sub", []byte{0})
+	if err := store.Drop("sub"); err != nil {
+		t.Fatalf("failed to drop buffer: %v.", err)
+	}
+	if msgs, _ := store.Replay("sub"); len(msgs) != 0 {
+		t.Fatalf("replay count mismatch after drop: have %d, want %d.", len(msgs), 0)
+	}
+}
+
+// Tests that events published while a durable subscription is offline get
+// replayed on resuming it.
+func TestPubSubDurable(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	topic := "pubsub-test-topic-durable"
+
+	// Boot a single iris node with a publisher and a durable subscriber
+	node := New("pubsub-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := node.Shutdown(); err != nil {
+			t.Fatalf("failed to terminate iris node: %v.", err)
+		}
+	}()
+	pub, err := node.Connect("pubsub-test-durable-pub", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer pub.Close()
+
+	conn, err := node.Connect("pubsub-test-durable-sub", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	first := &subscriber{make(chan []byte, 100)}
+	if err := conn.SubscribeDurable("durable", topic, first); err != nil {
+		t.Fatalf("failed to subscribe durably: %v.", err)
+	}
+	if err := conn.SubscribeDurable("durable", topic, first); err != ErrSubscribed {
+		t.Fatalf("double subscription error mismatch: have %v, want %v.", err, ErrSubscribed)
+	}
+	publish := func(count int) {
+		for i := 0; i < count; i++ {
+			if err := pub.Publish(topic, []byte(fmt.Sprintf("%d", i))); err != nil {
+				t.Fatalf("failed to publish event: %v.", err)
+			}
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	publish(5)
+	if n := len(first.msgs); n != 5 {
+		t.Fatalf("live event count mismatch: have %d, want %d.", n, 5)
+	}
+	// Go offline, publish a few more and resume with a new connection
+	if err := conn.Close(); err != nil {
+		t.Fatalf("failed to close iris connection: %v.", err)
+	}
+	publish(10)
+
+	conn, err = node.Connect("pubsub-test-durable-sub", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	if err := conn.SubscribeDurable("durable", topic+"-other", first); err != ErrDurableTopic {
+		t.Fatalf("topic mismatch error: have %v, want %v.", err, ErrDurableTopic)
+	}
+	second := &subscriber{make(chan []byte, 100)}
+	if err := conn.SubscribeDurable("durable", topic, second); err != nil {
+		t.Fatalf("failed to resume durable subscription: %v.", err)
+	}
+	time.Sleep(250 * time.Millisecond)
+	if n := len(second.msgs); n != 10 {
+		t.Fatalf("replayed event count mismatch: have %d, want %d.", n, 10)
+	}
+	for i := 0; i < 10; i++ {
+		if msg := string(<-second.msgs); msg != fmt.Sprintf("%d", i) {
+			t.Fatalf("replayed event %d mismatch: have %s, want %d.", i, msg, i)
+		}
+	}
+	// Live events should flow again, and unsubscribing should end the durable
+	publish(3)
+	if n := len(second.msgs); n != 3 {
+		t.Fatalf("live event count mismatch: have %d, want %d.", n, 3)
+	}
+	if err := conn.Unsubscribe(topic); err != nil {
+		t.Fatalf("failed to unsubscribe: %v.", err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatalf("failed to close iris connection: %v.", err)
+	}
+	if _, ok := node.durable["durable"]; ok {
+		t.Fatalf("durable subscription not removed on unsubscribe.")
+	}
+}
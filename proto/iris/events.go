@@ -22,12 +22,14 @@
 package iris
 
 import (
-	"log"
 	"math/big"
 	"math/rand"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/karalabe/iris/proto"
+	"github.com/karalabe/iris/proto/pastry"
 )
 
 // Implements proto.iris.ConnectionCallback.HandlePublish. Extracts the data from
@@ -35,30 +37,71 @@ import (
 func (o *Overlay) HandlePublish(src *big.Int, topic string, msg *proto.Message) {
 	head := msg.Head.Meta.(*header)
 
+	// Reassemble chunked events before anything else
+	if head.ChunkCnt > 1 {
+		if msg, _ = o.assemble(src, msg); msg == nil {
+			return
+		}
+		head = msg.Head.Meta.(*header)
+	}
+
 	// Fetch the message recipients
 	o.lock.RLock()
 	subs, ok := o.subLive[topic]
 	if !ok {
 		o.lock.RUnlock()
-		log.Printf("iris: non-existent topic: %v.", topic)
+		o.logger.Printf("iris: non-existent topic: %v.", topic)
 		return
 	}
-	conns := make([]*Connection, len(subs))
-	for i, id := range subs {
-		conns[i] = o.conns[id]
+	conns := make([]*Connection, 0, len(subs))
+	buffered := false
+	for _, id := range subs {
+		if id == bufferConn {
+			buffered = true
+		} else {
+			conns = append(conns, o.conns[id])
+		}
 	}
 	o.lock.RUnlock()
 
+	// Buffer events for the offline durable subscriptions
+	if buffered && head.Op == opPub && head.Topic == "" {
+		o.buffer(topic, msg.Data)
+	}
+
 	// Publish to every live subscription
 	for i := 0; i < len(conns); i++ {
 		conn := conns[i] // Closure
 		switch head.Op {
 		case opBcast:
-			conn.workers.Schedule(func() { conn.handleBroadcast(msg.Data) })
+			o.count(MetricBroadcastRecv)
+			conn.schedule(queueBroadcast, func() {
+				if conn.handleBroadcast(msg.Data, head.Metadata) && head.AckId != 0 {
+					o.scribe.Direct(src, conn.assembleAck(head.Src, head.AckId))
+				}
+			})
+		case opJoin, opLeave, opProbe:
+			conn.schedule(queuePresence, func() { conn.handlePresence(src, head) })
 		case opPub:
-			conn.workers.Schedule(func() { conn.handlePublish(topic, msg.Data) })
+			o.count(MetricPublishRecv)
+			conn.schedule(topicQueue(topic), func() {
+				var delivered bool
+				if head.Topic != "" {
+					delivered = conn.handleWildcard(head.Topic, msg.Data, head.Metadata)
+				} else {
+					delivered = conn.handlePublish(topic, msg.Data, head.Metadata)
+				}
+				if delivered && head.AckId != 0 {
+					o.scribe.Direct(src, conn.assembleAck(head.Src, head.AckId))
+				}
+			})
+		case opReq:
+			o.count(MetricRequestRecv)
+			arrived := time.Now()
+			conn.admit(queueRequest, head.ReqPrio, func() { conn.handleRequest(src, head.Src, head.ReqId, msg.Data, head.Metadata, head.ReqTime, arrived) },
+				func() { conn.reject(src, head.Src, head.ReqId, failOverloaded) })
 		default:
-			log.Printf("iris: invalid publish opcode: %v.", head.Op)
+			o.logger.Printf("iris: invalid publish opcode: %v.", head.Op)
 		}
 	}
 }
@@ -68,25 +111,65 @@ func (o *Overlay) HandlePublish(src *big.Int, topic string, msg *proto.Message)
 func (o *Overlay) HandleBalance(src *big.Int, topic string, msg *proto.Message) {
 	head := msg.Head.Meta.(*header)
 
-	// Fetch the possible message recipients and pick one at random
+	// Fetch the possible message recipients and pick one at random (or pinned)
 	o.lock.RLock()
 	subs, ok := o.subLive[topic]
 	if !ok {
 		o.lock.RUnlock()
-		log.Printf("iris: non-existent topic: %v.", topic)
+		o.logger.Printf("iris: non-existent topic: %v.", topic)
 		return
 	}
-	conn := o.conns[subs[rand.Intn(len(subs))]]
+	var conn *Connection
+	switch {
+	case head.Op == opReq && head.ReqKey != "":
+		conn = o.conns[affinityConn(head.ReqKey, subs)]
+	case head.Op == opPub:
+		conn = o.partitionOwner(subs, head.Part)
+	default:
+		conn = o.conns[subs[rand.Intn(len(subs))]]
+	}
 	o.lock.RUnlock()
 
+	if conn == nil {
+		o.logger.Printf("iris: no live subscriber of topic: %v.", topic)
+		return
+	}
+
 	// Balance to the chose one
 	switch head.Op {
+	case opBcast:
+		o.count(MetricBroadcastRecv)
+		conn.schedule(queueBroadcast, func() {
+			if conn.handleBroadcast(msg.Data, head.Metadata) && head.AckId != 0 {
+				o.scribe.Direct(src, conn.assembleAck(head.Src, head.AckId))
+			}
+		})
 	case opReq:
-		conn.workers.Schedule(func() { conn.handleRequest(src, head.Src, head.ReqId, msg.Data, head.ReqTime) })
+		// Large requests are retrieved directly by the chosen member
+		if head.ChunkCnt > 1 {
+			_, have := o.assemble(src, msg)
+			conn.report(Progress{Call: CallRequest, Target: conn.cluster, Inbound: true, Done: have, Total: head.ChunkCnt})
+			o.scribe.Direct(src, conn.assemblePull(head.Src, head.ChunkId))
+			return
+		}
+		o.count(MetricRequestRecv)
+		arrived := time.Now()
+		conn.admit(queueRequest, head.ReqPrio, func() { conn.handleRequest(src, head.Src, head.ReqId, msg.Data, head.Metadata, head.ReqTime, arrived) },
+			func() { conn.reject(src, head.Src, head.ReqId, failOverloaded) })
+	case opPub:
+		o.count(MetricPublishRecv)
+		conn.serialize(partitionQueue(topic, head.Part), func() {
+			if conn.handlePublish(topic, msg.Data, head.Metadata) && head.AckId != 0 {
+				o.scribe.Direct(src, conn.assembleAck(head.Src, head.AckId))
+			}
+		})
 	case opTun:
-		conn.workers.Schedule(func() { conn.handleTunnelRequest(head.Src, head.TunId, head.TunKey, head.TunAddrs, head.TunTime) })
+		o.count(MetricTunnelRecv)
+		conn.schedule(tunnelQueue(head.Src, head.TunId), func() {
+			conn.handleTunnelRequest(head.Src, head.TunId, head.TunKey, head.TunAddrs, head.TunTime, head.TunGrace, head.Metadata)
+		})
 	default:
-		log.Printf("iris: invalid balance opcode: %v.", head.Op)
+		o.logger.Printf("iris: invalid balance opcode: %v.", head.Op)
 	}
 }
 
@@ -100,64 +183,256 @@ func (o *Overlay) HandleDirect(src *big.Int, msg *proto.Message) {
 	conn, ok := o.conns[head.Dest]
 	o.lock.RUnlock()
 	if !ok {
-		log.Printf("iris: non-existent direct recipient: %v", head.Dest)
+		o.logger.Printf("iris: non-existent direct recipient: %v", head.Dest)
 		return
 	}
+	// Reassemble chunked requests and replies
+	if head.ChunkCnt > 1 {
+		call, target := CallReply, ""
+		if head.Op == opReq {
+			call, target = CallRequest, conn.cluster
+		}
+		full, have := o.assemble(src, msg)
+		conn.report(Progress{Call: call, Target: target, Inbound: true, Done: have, Total: head.ChunkCnt})
+		if full == nil {
+			return
+		}
+		msg, head = full, full.Head.Meta.(*header)
+	}
 	// Pass the message to the connection to handle
 	switch head.Op {
+	case opReq:
+		o.count(MetricRequestRecv)
+		arrived := time.Now()
+		conn.admit(queueRequest, head.ReqPrio, func() { conn.handleRequest(src, head.Src, head.ReqId, msg.Data, head.Metadata, head.ReqTime, arrived) },
+			func() { conn.reject(src, head.Src, head.ReqId, failOverloaded) })
+	case opPull:
+		conn.schedule(queueReply, func() { conn.handlePull(src, head.Src, head.ChunkId) })
 	case opRep:
-		conn.workers.Schedule(func() { conn.handleReply(head.ReqId, msg.Data) })
+		o.count(MetricReplyRecv)
+		if head.RepFail != failNone {
+			conn.schedule(queueReply, func() { conn.handleFailure(src, head.Src, head.ReqId, head.failure()) })
+			return
+		}
+		conn.schedule(queueReply, func() { conn.handleReply(src, head.Src, head.ReqId, msg.Data, head.Metadata) })
+	case opAck:
+		conn.schedule(queueReply, func() { conn.handleAck(head.AckId) })
+	case opJoin:
+		conn.schedule(queuePresence, func() { conn.handlePresence(src, head) })
 	default:
-		log.Printf("iris: invalid direct opcode: %v.", head.Op)
+		o.logger.Printf("iris: invalid direct opcode: %v.", head.Op)
 	}
 }
 
-// Passes the broadcast message up to the application handler.
-func (c *Connection) handleBroadcast(msg []byte) {
-	c.handler.HandleBroadcast(msg)
+// Implements proto.scribe.FailureCallback.HandleFailure. Fails pending requests
+// fast if they were lost before reaching any cluster member, and dead letters
+// the retained publishes and broadcasts that could not be delivered. Other losses
+// (e.g. replies) are left to time out, as the remote side might already have
+// acted.
+func (o *Overlay) HandleFailure(msg *proto.Message, err *pastry.ForwardError) {
+	head := msg.Head.Meta.(*header)
+	if head.Op != opReq && head.Letter == 0 {
+		return
+	}
+	// Fetch the originating connection
+	o.lock.RLock()
+	conn, ok := o.conns[head.Src]
+	o.lock.RUnlock()
+	if !ok {
+		return
+	}
+	switch head.Op {
+	case opReq:
+		conn.handleFailure(nil, 0, head.ReqId, err)
+	case opBcast, opPub:
+		conn.schedule(queueReply, func() { conn.handleUndelivered(head.Letter, err) })
+	}
+}
+
+// Passes the broadcast message through the inbound interceptors up to the
+// application handler, reporting whether it was let through.
+func (c *Connection) handleBroadcast(msg []byte, meta Metadata) bool {
+	meta, span := c.traceIn(CallBroadcast, c.cluster, meta)
+	_, err := intercept(c.inbound, CallBroadcast, c.cluster, msg, func(msg []byte) ([]byte, error) {
+		c.statCluster(c.cluster, func(s *TargetStats) { s.BroadcastsRecv++ })
+		if ext, ok := c.handler.(MetadataHandler); ok {
+			ext.HandleBroadcastMeta(msg, meta)
+		} else {
+			c.handler.HandleBroadcast(msg)
+		}
+		return nil, nil
+	})
+	finish(span, err)
+	return err == nil
+}
+
+// Looks up the failure channel for the pending request and inserts the failure
+// (or collects it, if the request is a scatter-gather one, src and srcConn being
+// the failing member). If the channel doesn't exist any more, or a failure was
+// already reported, the new one is silently dropped.
+func (c *Connection) handleFailure(srcNode *big.Int, srcConn uint64, reqId uint64, err error) {
+	c.reqLock.RLock()
+	defer c.reqLock.RUnlock()
+
+	if ch, ok := c.reqFail[reqId]; ok {
+		select {
+		case ch <- err:
+		default:
+		}
+		return
+	}
+	if srcNode != nil {
+		c.gather(reqId, &Response{Instance: instanceId(srcNode, srcConn), Err: err})
+	}
 }
 
-// Passes the request up to the application handler, also specifying the timeout
-// under which the reply must be sent back. Only a non-nil reply is forwarded to
-// the requester.
-func (c *Connection) handleRequest(srcNode *big.Int, srcConn uint64, reqId uint64, msg []byte, timeout time.Duration) {
-	if rep := c.handler.HandleRequest(msg, timeout); rep != nil {
-		c.iris.scribe.Direct(srcNode, c.assembleReply(srcConn, reqId, rep))
+// Passes the request up to the application handler, also specifying the time
+// left under which the reply must be sent back. Requests expired while queued
+// are rejected instead. Only a non-nil reply let through by the inbound
+// interceptors is forwarded to the requester, or the failure of the handler
+// (or a *RemoteError returned by an interceptor); other interceptor aborts are
+// left to time out.
+func (c *Connection) handleRequest(srcNode *big.Int, srcConn uint64, reqId uint64, msg []byte, meta Metadata, timeout time.Duration, arrived time.Time) {
+	o := c.carrier()
+
+	timeout, ok := remaining(arrived, timeout)
+	if !ok {
+		o.count(MetricRequestShed)
+		c.reject(srcNode, srcConn, reqId, failExpired)
+		return
+	}
+	var (
+		failed  error
+		repMeta Metadata
+	)
+	start := time.Now()
+	meta, span := c.traceIn(CallRequest, c.cluster, meta)
+	rep, err := intercept(c.inbound, CallRequest, c.cluster, msg, func(msg []byte) ([]byte, error) {
+		var rep []byte
+		if ext, ok := c.handler.(MetadataHandler); ok {
+			rep, repMeta, failed = ext.HandleRequestMeta(msg, meta, timeout)
+		} else {
+			rep, failed = c.handler.HandleRequest(msg, timeout)
+		}
+		return rep, failed
+	})
+	c.statCluster(c.cluster, func(s *TargetStats) {
+		s.RequestsServed++
+		s.ServeLatency.add(time.Since(start))
+	})
+	finish(span, err)
+	if err != nil {
+		remote, ok := err.(*RemoteError)
+		if !ok && err == failed {
+			remote, ok = &RemoteError{Message: err.Error()}, true
+		}
+		if ok {
+			o.scribe.Direct(srcNode, c.assembleError(srcConn, reqId, remote))
+		}
+		return
+	}
+	if rep != nil {
+		if err := repMeta.validate(); err != nil {
+			o.logger.Printf("iris: dropping reply metadata: %v.", err)
+			repMeta = nil
+		}
+		c.transmit(CallReply, "", c.split(attach(c.assembleReply(srcConn, reqId, rep), repMeta)), func(msg *proto.Message) error {
+			o.scribe.Direct(srcNode, msg)
+			return nil
+		})
 	}
 }
 
-// Looks up the result channel for the pending request and inserts the reply. If
-// the channel doesn't exist any more the reply is silently dropped.
-func (c *Connection) handleReply(reqId uint64, rep []byte) {
+// Looks up the result channel for the pending request and inserts the reply (or
+// collects it, if the request is a scatter-gather one, src and srcConn being the
+// replying member). If the channel doesn't exist any more the reply is silently
+// dropped.
+func (c *Connection) handleReply(srcNode *big.Int, srcConn uint64, reqId uint64, rep []byte, meta Metadata) {
 	c.reqLock.RLock()
 	defer c.reqLock.RUnlock()
 
 	// Make sure the request is still alive and don't block if dying
 	if ch, ok := c.reqPend[reqId]; ok {
-		ch <- rep
+		ch <- &reply{data: rep, meta: meta}
+		return
 	}
+	c.gather(reqId, &Response{Instance: instanceId(srcNode, srcConn), Reply: rep, Metadata: meta})
 }
 
-// Delivers a topic event to a subscribed handler. If the subscription does not
-// exist the message is silently dropped.
-func (c *Connection) handlePublish(topic string, msg []byte) {
-	// Fetch the handler
+// Looks up the tracker of the acknowledged message and notes a delivery. If the
+// message isn't awaited any more, the acknowledgement is silently dropped.
+func (c *Connection) handleAck(ackId uint64) {
+	c.ackLock.RLock()
+	acked, ok := c.ackPend[ackId]
+	c.ackLock.RUnlock()
+
+	if ok {
+		acked.note()
+	}
+}
+
+// Delivers a topic event to a subscribed handler, reporting whether it did so. If
+// the subscription does not exist the message is silently dropped.
+func (c *Connection) handlePublish(topic string, msg []byte, meta Metadata) bool {
+	// Fetch the handler and the credits if in pull mode
 	c.subLock.RLock()
 	handler, ok := c.subLive[topic]
+	cred, pull := c.subCred[topic]
 	c.subLock.RUnlock()
 
+	// Consume a credit for pull subscriptions, dropping the event if none's left
+	if pull {
+		for {
+			left := atomic.LoadInt32(cred)
+			if left <= 0 {
+				return false
+			}
+			if atomic.CompareAndSwapInt32(cred, left, left-1) {
+				break
+			}
+		}
+	}
 	// Deliver the event
 	if ok {
-		handler.HandleEvent(msg)
+		return c.deliver(topic[strings.IndexByte(topic, '-')+1:], handler, msg, meta)
 	}
+	return false
+}
+
+// Delivers a relayed event to all the pattern subscriptions matching its topic,
+// reporting whether any did.
+func (c *Connection) handleWildcard(topic string, msg []byte, meta Metadata) bool {
+	c.subLock.RLock()
+	handlers := []SubscriptionHandler{}
+	for pattern, handler := range c.subWild {
+		if matchPattern(pattern, topic) {
+			handlers = append(handlers, handler)
+		}
+	}
+	c.subLock.RUnlock()
+
+	delivered := false
+	for _, handler := range handlers {
+		if c.deliver(topic, handler, msg, meta) {
+			delivered = true
+		}
+	}
+	return delivered
 }
 
 // Accepts the inbound tunnel, notifies the remote endpoint of the success and
 // starts the local handler.
-func (c *Connection) handleTunnelRequest(conn uint64, id uint64, key []byte, addrs []string, timeout time.Duration) {
-	if tun, err := c.buildTunnel(conn, id, key, addrs, timeout); err != nil {
-		log.Printf("iris: failed to accept tunnel: %v.", err)
-	} else {
-		c.handler.HandleTunnel(tun)
+func (c *Connection) handleTunnelRequest(conn uint64, id uint64, key []byte, addrs []string, timeout, grace time.Duration, meta Metadata) {
+	_, span := c.traceIn(CallTunnel, c.cluster, meta)
+	tun, err := c.buildTunnel(conn, id, key, addrs, timeout, grace)
+	if err != nil {
+		c.carrier().logger.Printf("iris: failed to accept tunnel: %v.", err)
+		finish(span, err)
+		return
+	}
+	if span != nil {
+		tun.trace = span.Context()
 	}
+	c.handler.HandleTunnel(tun)
+	finish(span, nil)
 }
@@ -0,0 +1,161 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the fanout subscriptions, where a topic is subscribed to only once,
+// but the events are delivered to any number of independently registered (and
+// removed) handlers. A crashing handler is isolated from the others, its panic
+// being logged instead of tearing down the event delivery.
+
+package iris
+
+import (
+	"sync"
+)
+
+// Subscription handler distributing the events of a topic to a set of handlers.
+type fanout struct {
+	conn     *Connection
+	topic    string
+	handlers []*fanned // Registered handlers in registration order
+	lock     sync.RWMutex
+}
+
+// Handler registered into a fanout subscription, along with its id.
+type fanned struct {
+	id      uint64
+	handler SubscriptionHandler
+}
+
+// Implements SubscriptionHandler.HandleEvent, passing the event on to all the
+// registered handlers.
+func (f *fanout) HandleEvent(msg []byte) {
+	f.HandleEventMeta(msg, nil)
+}
+
+// Implements MetadataEventHandler.HandleEventMeta, passing the event and its
+// metadata on to all the registered handlers, each receiving its own copy.
+func (f *fanout) HandleEventMeta(msg []byte, meta Metadata) {
+	f.lock.RLock()
+	handlers := append([]*fanned(nil), f.handlers...)
+	f.lock.RUnlock()
+
+	for _, fan := range handlers {
+		f.invoke(fan.handler, append([]byte(nil), msg...), meta)
+	}
+}
+
+// Invokes a single handler, recovering and logging any panic it raises.
+func (f *fanout) invoke(handler SubscriptionHandler, msg []byte, meta Metadata) {
+	defer func() {
+		if r := recover(); r != nil {
+			f.conn.carrier().logger.Printf("iris: topic %v handler panicked: %v.", f.topic, r)
+		}
+	}()
+	if ext, ok := handler.(MetadataEventHandler); ok {
+		ext.HandleEventMeta(msg, meta)
+	} else {
+		handler.HandleEvent(msg)
+	}
+}
+
+// Registers an additional handler for the events of topic (or pattern), the
+// topic being subscribed to when its first handler is added. The returned id
+// can be used to remove the handler. Topics subscribed to directly via Subscribe
+// cannot have handlers added, ErrSubscribed being returned.
+func (c *Connection) AddHandler(topic string, handler SubscriptionHandler) (uint64, error) {
+	c.subLock.Lock()
+	select {
+	case <-c.term:
+		c.subLock.Unlock()
+		return 0, ErrTerminating
+	default:
+	}
+	fan, ok := c.subFan[topic]
+	if !ok {
+		if c.subscribed(topic) {
+			c.subLock.Unlock()
+			return 0, ErrSubscribed
+		}
+		fan = &fanout{conn: c, topic: topic}
+		c.subFan[topic] = fan
+	}
+	c.fanIdx++
+	id := c.fanIdx
+
+	fan.lock.Lock()
+	fan.handlers = append(fan.handlers, &fanned{id: id, handler: handler})
+	fan.lock.Unlock()
+	c.subLock.Unlock()
+
+	// Subscribe to the topic if this is the first handler
+	if !ok {
+		if err := c.Subscribe(topic, fan); err != nil {
+			c.subLock.Lock()
+			delete(c.subFan, topic)
+			c.subLock.Unlock()
+			return 0, err
+		}
+	}
+	return id, nil
+}
+
+// Removes a handler previously registered via AddHandler, unsubscribing from
+// the topic if it was the last one.
+func (c *Connection) RemoveHandler(topic string, id uint64) error {
+	c.subLock.Lock()
+	fan, ok := c.subFan[topic]
+	if !ok {
+		c.subLock.Unlock()
+		return ErrNotSubscribed
+	}
+	fan.lock.Lock()
+	removed := false
+	for i, fanned := range fan.handlers {
+		if fanned.id == id {
+			fan.handlers = append(fan.handlers[:i], fan.handlers[i+1:]...)
+			removed = true
+			break
+		}
+	}
+	last := len(fan.handlers) == 0
+	fan.lock.Unlock()
+	if last {
+		delete(c.subFan, topic)
+	}
+	c.subLock.Unlock()
+
+	if !removed {
+		return ErrNotSubscribed
+	}
+	if last {
+		return c.Unsubscribe(topic)
+	}
+	return nil
+}
+
+// Checks whether a topic or pattern is subscribed to. The subscription lock is
+// assumed held.
+func (c *Connection) subscribed(topic string) bool {
+	if isPattern(topic) {
+		_, ok := c.subWild[topic]
+		return ok
+	}
+	_, ok := c.subLive[topicPrefixes[0]+topic]
+	return ok
+}
@@ -0,0 +1,113 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package iris
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+// Subscription handler crashing on every event.
+type crasher struct{}
+
+func (c *crasher) HandleEvent(msg []byte) {
+	panic("crashing event handler")
+}
+
+// Tests that multiple handlers can be registered to and removed from a topic,
+// each receiving the events in isolation.
+func TestFanout(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("fanout-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	conn, err := node.Connect("fanout-test", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer conn.Close()
+
+	// Register a crashing handler between two healthy ones
+	first, second := &subscriber{msgs: make(chan []byte, 10)}, &subscriber{msgs: make(chan []byte, 10)}
+	firstId, err := conn.AddHandler("fanout-topic", first)
+	if err != nil {
+		t.Fatalf("failed to add first handler: %v.", err)
+	}
+	if _, err := conn.AddHandler("fanout-topic", &crasher{}); err != nil {
+		t.Fatalf("failed to add crashing handler: %v.", err)
+	}
+	if _, err := conn.AddHandler("fanout-topic", second); err != nil {
+		t.Fatalf("failed to add second handler: %v.", err)
+	}
+	if err := conn.Subscribe("fanout-topic", first); err != ErrSubscribed {
+		t.Fatalf("double subscription error mismatch: have %v, want %v.", err, ErrSubscribed)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Both healthy handlers should receive the event
+	if err := conn.Publish("fanout-topic", []byte("fanned")); err != nil {
+		t.Fatalf("failed to publish event: %v.", err)
+	}
+	for i, handler := range []*subscriber{first, second} {
+		select {
+		case msg := <-handler.msgs:
+			if string(msg) != "fanned" {
+				t.Fatalf("handler %d: event mismatch: have %s, want %s.", i, msg, "fanned")
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("handler %d: event not delivered.", i)
+		}
+	}
+	// Removed handlers should not receive any more events
+	if err := conn.RemoveHandler("fanout-topic", firstId); err != nil {
+		t.Fatalf("failed to remove first handler: %v.", err)
+	}
+	if err := conn.RemoveHandler("fanout-topic", firstId); err != ErrNotSubscribed {
+		t.Fatalf("double removal error mismatch: have %v, want %v.", err, ErrNotSubscribed)
+	}
+	if err := conn.Publish("fanout-topic", []byte("again")); err != nil {
+		t.Fatalf("failed to publish event: %v.", err)
+	}
+	select {
+	case <-second.msgs:
+	case <-time.After(time.Second):
+		t.Fatalf("remaining handler: event not delivered.")
+	}
+	select {
+	case msg := <-first.msgs:
+		t.Fatalf("removed handler received event: %s.", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// Unsubscribing should remove all the handlers
+	if err := conn.Unsubscribe("fanout-topic"); err != nil {
+		t.Fatalf("failed to unsubscribe: %v.", err)
+	}
+	if _, err := conn.AddHandler("fanout-topic", first); err != nil {
+		t.Fatalf("failed to resubscribe via handler: %v.", err)
+	}
+}
@@ -0,0 +1,104 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the scatter-gather requests. The request is disseminated to every
+// member of the destination cluster like a broadcast, each member serving it as
+// a regular request (queueing, shedding and all) and replying directly to the
+// requester, where the responses are collected into a channel as they arrive.
+
+package iris
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto"
+)
+
+// Response of a single cluster member to a scatter-gather request.
+type Response struct {
+	Instance string   // Id of the responding cluster instance (as reported by presence)
+	Reply    []byte   // Reply of the member (nil if it failed)
+	Metadata Metadata // Metadata attached to the reply
+	Err      error    // Failure reported by the member (e.g. a *RemoteError)
+}
+
+// Sends a request to every member of cluster, collecting their responses (or
+// per-member failures) into the returned channel as they arrive. The channel is
+// closed once the timeout expires (or the connection terminates), and holds up
+// to config.IrisGatherBuffer unread responses, dropping any further ones.
+func (c *Connection) RequestAll(cluster string, req []byte, timeout time.Duration) (<-chan *Response, error) {
+	o := c.carrier()
+
+	if !c.rateReq.take() {
+		return nil, ErrRateLimited
+	}
+	c.statCluster(cluster, func(s *TargetStats) { s.RequestsSent++ })
+	// Register the response collector
+	c.reqLock.Lock()
+	respCh := make(chan *Response, config.IrisGatherBuffer)
+	reqId := c.reqIdx
+	c.reqIdx++
+	c.reqAll[reqId] = respCh
+	c.reqLock.Unlock()
+
+	release := func() {
+		c.reqLock.Lock()
+		defer c.reqLock.Unlock()
+
+		delete(c.reqAll, reqId)
+		close(respCh)
+		c.settle()
+	}
+	// Disseminate the request to all the members
+	_, err := intercept(c.outbound, CallRequest, cluster, req, func(req []byte) ([]byte, error) {
+		o.count(MetricRequestSent)
+		prefixIdx := int(atomic.AddUint32(&c.splitId, 1)) % config.IrisClusterSplits
+		return nil, c.transmit(CallRequest, cluster, c.split(c.assembleRequest(reqId, req, timeout, route{})), func(msg *proto.Message) error {
+			return o.scribe.Publish(clusterPrefixes[prefixIdx]+cluster, msg)
+		})
+	})
+	if err != nil {
+		release()
+		return nil, err
+	}
+	// Stop collecting after the timeout
+	go func() {
+		select {
+		case <-c.term:
+		case <-time.After(timeout):
+		}
+		release()
+	}()
+	return respCh, nil
+}
+
+// Collects the response of a member to a pending scatter-gather request. If the
+// request isn't live any more, or the buffer is full, the response is dropped.
+// The request lock must be held.
+func (c *Connection) gather(reqId uint64, resp *Response) {
+	if ch, ok := c.reqAll[reqId]; ok {
+		select {
+		case ch <- resp:
+		default:
+			c.carrier().logger.Printf("iris: dropping scatter-gather response, buffer full.")
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package iris
+
+import (
+	"bytes"
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+// Tests that scatter-gather requests collect the responses of all members.
+func TestRequestAll(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("gather-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	// Connect a few healthy members and a failing one
+	members := 3
+	for i := 0; i < members; i++ {
+		serv, err := node.Connect("gather-test", &requester{0, 0})
+		if err != nil {
+			t.Fatalf("failed to connect to the iris overlay: %v.", err)
+		}
+		defer serv.Close()
+	}
+	fail, err := node.Connect("gather-test", &failer{err: &RemoteError{Code: 1, Message: "failed"}})
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer fail.Close()
+
+	conn, err := node.Connect("gather-test-client", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer conn.Close()
+	time.Sleep(250 * time.Millisecond)
+
+	// Scatter a request and check the gathered responses
+	start := time.Now()
+	resps, err := conn.RequestAll("gather-test", []byte{0x00}, 500*time.Millisecond)
+	if err != nil {
+		t.Fatalf("failed to execute request: %v.", err)
+	}
+	seen := make(map[string]bool)
+	replies, failures := 0, 0
+	for resp := range resps {
+		if seen[resp.Instance] {
+			t.Fatalf("duplicate response from %v.", resp.Instance)
+		}
+		seen[resp.Instance] = true
+
+		if resp.Err != nil {
+			if remote, ok := resp.Err.(*RemoteError); !ok || remote.Code != 1 {
+				t.Fatalf("member failure mismatch: have %v, want remote error 1.", resp.Err)
+			}
+			failures++
+		} else {
+			if !bytes.Equal(resp.Reply, []byte{0x00}) {
+				t.Fatalf("reply mismatch: have %v, want %v.", resp.Reply, []byte{0x00})
+			}
+			replies++
+		}
+	}
+	if replies != members || failures != 1 {
+		t.Fatalf("response count mismatch: have %d/%d, want %d/%d.", replies, failures, members, 1)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Fatalf("responses closed early: have %v, want >= 500ms.", elapsed)
+	}
+}
@@ -0,0 +1,68 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the interceptor chains of a connection. Outbound interceptors wrap the
+// broadcasts, requests and publishes issued through the connection, inbound ones
+// the invocations of the application handlers, allowing cross-cutting concerns
+// (auth, metrics, tracing, validation) to be layered on without wrapping them.
+
+package iris
+
+// Kinds of calls passed through the interceptors.
+const (
+	CallBroadcast = "broadcast"
+	CallRequest   = "request"
+	CallPublish   = "publish"
+)
+
+// Continuation of an interceptor chain, executing the remaining interceptors and
+// finally the call itself. The reply is nil for all but requests.
+type Invoker func(msg []byte) ([]byte, error)
+
+// Interceptor of a call with the given target (cluster or topic), which may
+// inspect or modify the payload and the reply, or abort the call by returning
+// an error instead of invoking next.
+type Interceptor func(call, target string, msg []byte, next Invoker) ([]byte, error)
+
+// Passes a call through an interceptor chain, the first interceptor outermost.
+func intercept(chain []Interceptor, call, target string, msg []byte, final Invoker) ([]byte, error) {
+	if len(chain) == 0 {
+		return final(msg)
+	}
+	return chain[0](call, target, msg, func(msg []byte) ([]byte, error) {
+		return intercept(chain[1:], call, target, msg, final)
+	})
+}
+
+// Delivers a topic event to a subscription handler through the inbound chain,
+// reporting whether it was let through.
+func (c *Connection) deliver(topic string, handler SubscriptionHandler, msg []byte, meta Metadata) bool {
+	meta, span := c.traceIn(CallPublish, topic, meta)
+	_, err := intercept(c.inbound, CallPublish, topic, msg, func(msg []byte) ([]byte, error) {
+		c.statTopic(topic, func(s *TargetStats) { s.PublishesRecv++ })
+		if ext, ok := handler.(MetadataEventHandler); ok {
+			ext.HandleEventMeta(msg, meta)
+		} else {
+			handler.HandleEvent(msg)
+		}
+		return nil, nil
+	})
+	finish(span, err)
+	return err == nil
+}
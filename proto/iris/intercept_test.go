@@ -0,0 +1,120 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package iris
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInterceptChain(t *testing.T) {
+	trace := []string{}
+	tracer := func(name string) Interceptor {
+		return func(call, target string, msg []byte, next Invoker) ([]byte, error) {
+			trace = append(trace, name+">")
+			rep, err := next(append(msg, name...))
+			trace = append(trace, "<"+name)
+			return rep, err
+		}
+	}
+	rep, err := intercept([]Interceptor{tracer("a"), tracer("b")}, CallRequest, "target", []byte("x"), func(msg []byte) ([]byte, error) {
+		trace = append(trace, string(msg))
+		return msg, nil
+	})
+	if err != nil {
+		t.Fatalf("failed to execute chain: %v.", err)
+	}
+	if string(rep) != "xab" {
+		t.Fatalf("reply mismatch: have %s, want %s.", rep, "xab")
+	}
+	if want := []string{"a>", "b>", "xab", "<b", "<a"}; !reflect.DeepEqual(trace, want) {
+		t.Fatalf("trace mismatch: have %v, want %v.", trace, want)
+	}
+}
+
+// Tests that the interceptors wrap the outbound calls and inbound invocations.
+func TestInterceptors(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("intercept-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	// Record the outbound calls and reject the inbound empty payloads
+	calls := []string{}
+	lock := new(sync.Mutex)
+	outbound := func(call, target string, msg []byte, next Invoker) ([]byte, error) {
+		lock.Lock()
+		calls = append(calls, call+":"+target)
+		lock.Unlock()
+		return next(msg)
+	}
+	rejected := errors.New("empty payload")
+	inbound := func(call, target string, msg []byte, next Invoker) ([]byte, error) {
+		if len(msg) == 0 {
+			return nil, rejected
+		}
+		return next(msg)
+	}
+	conn, err := node.Connect("intercept-test", &requester{0, 0}, WithOutbound(outbound), WithInbound(inbound))
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer conn.Close()
+
+	events := &subscriber{make(chan []byte, 10)}
+	if err := conn.Subscribe("intercept-test-topic", events); err != nil {
+		t.Fatalf("failed to subscribe to the topic: %v.", err)
+	}
+	if rep, err := conn.Request("intercept-test", []byte{0x00}, time.Second); err != nil {
+		t.Fatalf("failed to execute request: %v.", err)
+	} else if !bytes.Equal(rep, []byte{0x00}) {
+		t.Fatalf("reply mismatch: have %v, want %v.", rep, []byte{0x00})
+	}
+	if _, err := conn.Request("intercept-test", nil, 100*time.Millisecond); err != ErrTimeout {
+		t.Fatalf("rejected request error mismatch: have %v, want %v.", err, ErrTimeout)
+	}
+	for _, msg := range [][]byte{{0x01}, nil} {
+		if err := conn.Publish("intercept-test-topic", msg); err != nil {
+			t.Fatalf("failed to publish event: %v.", err)
+		}
+	}
+	time.Sleep(250 * time.Millisecond)
+	if n := len(events.msgs); n != 1 {
+		t.Fatalf("delivered event count mismatch: have %d, want %d.", n, 1)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+
+	want := []string{"request:intercept-test", "request:intercept-test", "publish:intercept-test-topic", "publish:intercept-test-topic"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Fatalf("outbound calls mismatch: have %v, want %v.", calls, want)
+	}
+}
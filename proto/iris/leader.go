@@ -0,0 +1,141 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the exclusive consumer (leader) mode of clusters. The leader of a
+// cluster is the live instance with the lowest id, as seen through the presence
+// watch of the cluster. Leader requests are sent directly to it instead of being
+// balanced, failing over to the next instance once the leader departs (or goes
+// silent). Members opting into leadership watch their own cluster and are told
+// when they are elected or deposed. As the presence views converge eventually,
+// two members may briefly both consider themselves leaders during churn.
+
+package iris
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNoLeader = errors.New("no live cluster instance")
+
+// Handler notified of the leadership changes of a connection within its cluster.
+type LeaderHandler interface {
+	// Handles the connection becoming the leader of its cluster.
+	HandleElected()
+
+	// Handles the connection losing the leadership of its cluster.
+	HandleDeposed()
+}
+
+// Leadership state of a connection, re-evaluated on every presence change of its
+// own cluster.
+type elector struct {
+	conn    *Connection   // Connection competing for leadership
+	handler LeaderHandler // Handler notified of the leadership changes
+	leader  bool          // Whether the connection is currently the leader
+	lock    sync.Mutex    // Mutex serializing the elections and notifications
+}
+
+// Implements PresenceHandler.HandleJoin.
+func (e *elector) HandleJoin(instance string) {
+	e.elect()
+}
+
+// Implements PresenceHandler.HandleLeave.
+func (e *elector) HandleLeave(instance string) {
+	e.elect()
+}
+
+// Checks whether the connection is the leader, notifying the handler if it
+// changed since the last election.
+func (e *elector) elect() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	leader, err := e.conn.Leader(e.conn.cluster)
+	self := err == nil && leader == instanceId(e.conn.carrier().scribe.Pastry().Self(), e.conn.id)
+	if self == e.leader {
+		return
+	}
+	e.leader = self
+	if self {
+		e.handler.HandleElected()
+	} else {
+		e.handler.HandleDeposed()
+	}
+}
+
+// Retrieves the instance currently leading a watched cluster.
+func (c *Connection) Leader(cluster string) (string, error) {
+	instances, err := c.Instances(cluster)
+	if err != nil {
+		return "", err
+	}
+	if len(instances) == 0 {
+		return "", ErrNoLeader
+	}
+	leader := instances[0]
+	for _, instance := range instances[1:] {
+		if instance < leader {
+			leader = instance
+		}
+	}
+	return leader, nil
+}
+
+// Executes a synchronous request to the leader of a watched cluster, otherwise
+// behaving the same as Request. Retries are sent to the leader at the time.
+func (c *Connection) RequestLeader(cluster string, req []byte, timeout time.Duration) ([]byte, error) {
+	return intercept(c.outbound, CallRequest, cluster, req, func(req []byte) ([]byte, error) {
+		return c.retried(context.Background(), func() ([]byte, error) {
+			leader, err := c.Leader(cluster)
+			if err != nil {
+				return nil, err
+			}
+			node, conn, err := parseInstance(leader)
+			if err != nil {
+				return nil, err
+			}
+			rep, _, err := c.request(context.Background(), cluster, req, nil, timeout, route{node: node, conn: conn})
+			return rep, err
+		})
+	})
+}
+
+// Splits a textual instance id into the node and connection ids.
+func parseInstance(instance string) (*big.Int, uint64, error) {
+	idx := strings.LastIndex(instance, "/")
+	if idx < 0 {
+		return nil, 0, errors.New("invalid instance id")
+	}
+	node, ok := new(big.Int).SetString(instance[:idx], 10)
+	if !ok {
+		return nil, 0, errors.New("invalid instance node id")
+	}
+	conn, err := strconv.ParseUint(instance[idx+1:], 10, 64)
+	if err != nil {
+		return nil, 0, err
+	}
+	return node, conn, nil
+}
@@ -0,0 +1,151 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package iris
+
+import (
+	"crypto/x509"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Leader handler forwarding the leadership changes into a channel.
+type candidate struct {
+	changes chan bool
+}
+
+func (c *candidate) HandleElected() {
+	c.changes <- true
+}
+
+func (c *candidate) HandleDeposed() {
+	c.changes <- false
+}
+
+// Tests that exactly one cluster member is elected, receiving the leader requests,
+// and that the leadership fails over when it departs.
+func TestLeader(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("leader-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	// Start a few competing members and a client watching the cluster
+	members := make([]*Connection, 3)
+	handlers := make([]*sleeper, len(members))
+	candidates := make([]*candidate, len(members))
+	for i := range members {
+		handlers[i], candidates[i] = new(sleeper), &candidate{make(chan bool, 8)}
+
+		conn, err := node.Connect("leader-test", handlers[i], WithLeadership(candidates[i]))
+		if err != nil {
+			t.Fatalf("member %d: failed to connect to the iris overlay: %v.", i, err)
+		}
+		members[i] = conn
+	}
+	closed := -1
+	defer func() {
+		for i, member := range members {
+			if i != closed {
+				member.Close()
+			}
+		}
+	}()
+	client, err := node.Connect("leader-test-client", nil)
+	if err != nil {
+		t.Fatalf("failed to connect client to the iris overlay: %v.", err)
+	}
+	defer client.Close()
+
+	if err := client.Watch("leader-test", &presenceCollector{make(chan string, 8), make(chan string, 8)}); err != nil {
+		t.Fatalf("failed to watch the cluster: %v.", err)
+	}
+	time.Sleep(250 * time.Millisecond)
+
+	// Check that the elected member receives all the leader requests
+	leader := -1
+	for i, cand := range candidates {
+		elected := false
+		for len(cand.changes) > 0 {
+			elected = <-cand.changes
+		}
+		if elected {
+			if leader != -1 {
+				t.Fatalf("multiple leaders: %d and %d.", leader, i)
+			}
+			leader = i
+		}
+	}
+	if leader == -1 {
+		t.Fatalf("no leader elected.")
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := client.RequestLeader("leader-test", []byte{byte(i)}, time.Second); err != nil {
+			t.Fatalf("failed to execute leader request: %v.", err)
+		}
+	}
+	for i, handler := range handlers {
+		want := int32(0)
+		if i == leader {
+			want = 10
+		}
+		if have := atomic.LoadInt32(&handler.calls); have != want {
+			t.Fatalf("member %d: request count mismatch: have %v, want %v.", i, have, want)
+		}
+	}
+	// Drop the leader and check that the leadership fails over
+	members[leader].Close()
+	closed = leader
+	time.Sleep(250 * time.Millisecond)
+
+	next := -1
+	for i, cand := range candidates {
+		if i == leader {
+			continue
+		}
+		select {
+		case elected := <-cand.changes:
+			if !elected || next != -1 {
+				t.Fatalf("member %d: invalid leadership change: %v.", i, elected)
+			}
+			next = i
+		default:
+		}
+	}
+	if next == -1 {
+		t.Fatalf("leadership not failed over.")
+	}
+	if _, err := client.RequestLeader("leader-test", []byte{0x00}, time.Second); err != nil {
+		t.Fatalf("failed to execute leader request: %v.", err)
+	}
+	if have := atomic.LoadInt32(&handlers[next].calls); have != 1 {
+		t.Fatalf("new leader request count mismatch: have %v, want %v.", have, 1)
+	}
+	// Requests to unwatched clusters should be rejected
+	if _, err := client.RequestLeader("leader-test-unwatched", nil, time.Second); err != ErrNotSubscribed {
+		t.Fatalf("unwatched leader request error mismatch: have %v, want %v.", err, ErrNotSubscribed)
+	}
+}
@@ -0,0 +1,124 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the message metadata: small key/value maps attached to broadcasts,
+// requests, replies and publishes, delivered alongside the payload (e.g. to carry
+// correlation ids, content types or auth tokens). Handlers opt in to receiving
+// them by implementing the metadata extensions of their interfaces, others get
+// the bare payloads as before. Events replayed from durable subscription buffers
+// carry no metadata.
+
+package iris
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto"
+)
+
+var ErrMetadataSize = errors.New("metadata size limit exceeded")
+
+// Key/value metadata attached to a message.
+type Metadata map[string]string
+
+// Optional extension of the ConnectionHandler, receiving the metadata attached to
+// the inbound broadcasts and requests, and attaching metadata to the replies.
+// If implemented, these are called instead of the plain HandleBroadcast and
+// HandleRequest methods.
+type MetadataHandler interface {
+	// Handles a broadcast message along with its metadata.
+	HandleBroadcastMeta(msg []byte, meta Metadata)
+
+	// Handles a request along with its metadata, same as HandleRequest, returning
+	// also the metadata to attach to the reply.
+	HandleRequestMeta(req []byte, meta Metadata, timeout time.Duration) ([]byte, Metadata, error)
+}
+
+// Optional extension of the SubscriptionHandler, receiving the metadata attached
+// to the events. If implemented, it is called instead of HandleEvent.
+type MetadataEventHandler interface {
+	// Handles an event published to the subscribed topic along with its metadata.
+	HandleEventMeta(msg []byte, meta Metadata)
+}
+
+// Reply to a pending request, along with its metadata.
+type reply struct {
+	data []byte
+	meta Metadata
+}
+
+// Checks that the total size of the metadata is within config.IrisMetadataLimit.
+func (m Metadata) validate() error {
+	size := 0
+	for key, val := range m {
+		size += len(key) + len(val)
+	}
+	if size > config.IrisMetadataLimit {
+		return ErrMetadataSize
+	}
+	return nil
+}
+
+// Attaches the metadata to an assembled message (before splitting it).
+func attach(msg *proto.Message, meta Metadata) *proto.Message {
+	if len(meta) > 0 {
+		msg.Head.Meta.(*header).Metadata = meta
+	}
+	return msg
+}
+
+// Broadcasts asynchronously a message with the attached metadata to all members
+// of an iris cluster.
+func (c *Connection) BroadcastMeta(cluster string, msg []byte, meta Metadata) error {
+	if err := meta.validate(); err != nil {
+		return err
+	}
+	return c.broadcast(cluster, msg, meta)
+}
+
+// Executes a synchronous request with the attached metadata to cluster, returning
+// the reply along with its metadata. Otherwise it behaves the same as Request.
+func (c *Connection) RequestMeta(cluster string, req []byte, meta Metadata, timeout time.Duration) ([]byte, Metadata, error) {
+	if err := meta.validate(); err != nil {
+		return nil, nil, err
+	}
+	var repMeta Metadata
+	rep, err := intercept(c.outbound, CallRequest, cluster, req, func(req []byte) ([]byte, error) {
+		return c.retried(context.Background(), func() ([]byte, error) {
+			rep, got, err := c.request(context.Background(), cluster, req, meta, timeout, route{})
+			repMeta = got
+			return rep, err
+		})
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return rep, repMeta, nil
+}
+
+// Publishes an event with the attached metadata asynchronously to topic.
+func (c *Connection) PublishMeta(topic string, msg []byte, meta Metadata) error {
+	if err := meta.validate(); err != nil {
+		return err
+	}
+	return c.publish(topic, msg, meta, 0)
+}
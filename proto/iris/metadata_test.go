@@ -0,0 +1,143 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package iris
+
+import (
+	"bytes"
+	"crypto/x509"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Connection and subscription handler receiving the attached metadata.
+type metaHandler struct {
+	bcasts chan Metadata // Metadata of the received broadcasts
+	events chan Metadata // Metadata of the received events
+}
+
+func (m *metaHandler) HandleBroadcast(msg []byte) {
+	panic("Plain broadcast passed to metadata handler")
+}
+
+func (m *metaHandler) HandleBroadcastMeta(msg []byte, meta Metadata) {
+	m.bcasts <- meta
+}
+
+func (m *metaHandler) HandleRequest(req []byte, timeout time.Duration) ([]byte, error) {
+	panic("Plain request passed to metadata handler")
+}
+
+func (m *metaHandler) HandleRequestMeta(req []byte, meta Metadata, timeout time.Duration) ([]byte, Metadata, error) {
+	return req, Metadata{"echo": meta["id"]}, nil
+}
+
+func (m *metaHandler) HandleTunnel(tun *Tunnel) {
+	panic("Inbound tunnel on metadata handler")
+}
+
+func (m *metaHandler) HandleDrop(reason error) {
+	panic("Connection dropped on metadata handler")
+}
+
+func (m *metaHandler) HandleEvent(msg []byte) {
+	panic("Plain event passed to metadata handler")
+}
+
+func (m *metaHandler) HandleEventMeta(msg []byte, meta Metadata) {
+	m.events <- meta
+}
+
+// Tests that metadata is delivered alongside the payloads of all operations.
+func TestMetadata(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("metadata-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	handler := &metaHandler{make(chan Metadata, 1), make(chan Metadata, 1)}
+	conn, err := node.Connect("metadata-test", handler)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer conn.Close()
+
+	if err := conn.Subscribe("metadata-test-topic", handler); err != nil {
+		t.Fatalf("failed to subscribe to topic: %v.", err)
+	}
+	time.Sleep(250 * time.Millisecond)
+
+	meta := Metadata{"id": "1234", "type": "text/plain"}
+
+	// Check requests and replies
+	rep, repMeta, err := conn.RequestMeta("metadata-test", []byte{0x00}, meta, time.Second)
+	if err != nil {
+		t.Fatalf("failed to execute request: %v.", err)
+	}
+	if !bytes.Equal(rep, []byte{0x00}) {
+		t.Fatalf("reply mismatch: have %v, want %v.", rep, []byte{0x00})
+	}
+	if want := (Metadata{"echo": "1234"}); !reflect.DeepEqual(repMeta, want) {
+		t.Fatalf("reply metadata mismatch: have %v, want %v.", repMeta, want)
+	}
+	// Check broadcasts and publishes
+	if err := conn.BroadcastMeta("metadata-test", []byte{0x01}, meta); err != nil {
+		t.Fatalf("failed to broadcast: %v.", err)
+	}
+	if err := conn.PublishMeta("metadata-test-topic", []byte{0x02}, meta); err != nil {
+		t.Fatalf("failed to publish: %v.", err)
+	}
+	for _, ch := range []chan Metadata{handler.bcasts, handler.events} {
+		select {
+		case have := <-ch:
+			if !reflect.DeepEqual(have, meta) {
+				t.Fatalf("delivered metadata mismatch: have %v, want %v.", have, meta)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message not delivered.")
+		}
+	}
+	// Plain operations should deliver no metadata
+	if err := conn.Broadcast("metadata-test", []byte{0x03}); err != nil {
+		t.Fatalf("failed to broadcast: %v.", err)
+	}
+	select {
+	case have := <-handler.bcasts:
+		if len(have) != 0 {
+			t.Fatalf("plain broadcast metadata mismatch: have %v, want none.", have)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("broadcast not delivered.")
+	}
+	// Oversized metadata should be rejected
+	huge := Metadata{"blob": strings.Repeat("x", config.IrisMetadataLimit)}
+	if err := conn.PublishMeta("metadata-test-topic", nil, huge); err != ErrMetadataSize {
+		t.Fatalf("oversized metadata error mismatch: have %v, want %v.", err, ErrMetadataSize)
+	}
+}
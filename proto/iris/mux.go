@@ -0,0 +1,366 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the multiplexing of lightweight sub-streams within an established
+// tunnel. Opening a sub-stream needs no round trip: the first frame announces
+// it. Each sub-stream is flow controlled by its own credit window, which the
+// receiver replenishes as the application consumes the data, so a stalled
+// reader blocks only its own writer, not the whole tunnel.
+//
+// Every frame starts with a kind byte and the big endian stream id. Both ends
+// allocate ids independently, so the frames of streams opened by the sender are
+// flagged to keep the two id spaces apart.
+
+package iris
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+var ErrStreamClosed = errors.New("sub-stream closed")
+
+// Sub-stream frame kinds.
+const (
+	frameOpen   byte = iota // Announces a new sub-stream
+	frameData               // Carries a chunk of sub-stream data
+	frameCredit             // Grants additional send window to the remote writer
+	frameClose              // Terminates the sender's side of a sub-stream
+
+	frameOpener byte = 0x80 // Flags frames of sub-streams opened by the sender
+)
+
+// Size of the sub-stream frame header (kind and stream id).
+const frameHeader = 5
+
+// Multiplexer of sub-streams over a single tunnel.
+type TunnelMux struct {
+	tun *Tunnel // Tunnel carrying the sub-stream frames
+
+	streams map[uint64]*SubStream // Live sub-streams keyed by id and opener
+	nextId  uint32                // Id to assign to the next locally opened stream
+	accept  chan *SubStream       // Remotely opened streams waiting to be accepted
+	sendMu  sync.Mutex            // Serializes the frames handed to the tunnel
+	lock    sync.Mutex            // Mutex to protect the stream state
+
+	err  error         // Failure that terminated the demultiplexer
+	quit chan struct{} // Channel closed when the demultiplexer terminates
+}
+
+// Independently flow controlled stream within a tunnel, implementing the
+// io.ReadWriteCloser interface.
+type SubStream struct {
+	mux    *TunnelMux // Multiplexer owning the sub-stream
+	id     uint32     // Stream id within the opener's id space
+	opener bool       // Whether the stream was opened locally
+
+	buf    []byte // Received data not yet read by the application
+	used   int    // Bytes consumed since the last credit grant
+	credit int    // Bytes the remote side is still willing to buffer
+
+	readEnd  bool // Remote side closed, no more data is coming
+	writeEnd bool // Local side closed, no more data may be sent
+
+	writeMu sync.Mutex // Serializes the writers to keep the data in order
+	cond    *sync.Cond // Signals data, credit and close arrivals (on mux lock)
+}
+
+// Creates a sub-stream multiplexer on top of the tunnel and starts demultiplexing
+// the inbound frames. The tunnel should not be used otherwise concurrently.
+func (t *Tunnel) Mux() *TunnelMux {
+	m := &TunnelMux{
+		tun:     t,
+		streams: make(map[uint64]*SubStream),
+		accept:  make(chan *SubStream, config.IrisMuxBacklog),
+		quit:    make(chan struct{}),
+	}
+	go m.demux()
+	return m
+}
+
+// Opens a new sub-stream to the remote side of the tunnel.
+func (m *TunnelMux) Open() (*SubStream, error) {
+	m.lock.Lock()
+	if m.err != nil {
+		m.lock.Unlock()
+		return nil, m.err
+	}
+	m.nextId++
+	s := m.newStream(m.nextId, true)
+	m.lock.Unlock()
+
+	if err := m.send(frameOpen, s, nil); err != nil {
+		m.lock.Lock()
+		delete(m.streams, streamKey(s.id, true))
+		m.lock.Unlock()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Retrieves a sub-stream opened by the remote side. If none is pending, the call
+// blocks until either one arrives or a timeout is reached.
+func (m *TunnelMux) Accept(timeout time.Duration) (*SubStream, error) {
+	select {
+	case s := <-m.accept:
+		return s, nil
+	case <-m.quit:
+		return nil, m.err
+	case <-time.After(timeout):
+		return nil, ErrTimeout
+	}
+}
+
+// Closes the underlying tunnel, terminating all the sub-streams.
+func (m *TunnelMux) Close() error {
+	return m.tun.Close()
+}
+
+// Creates and registers a sub-stream. The mux lock must be held.
+func (m *TunnelMux) newStream(id uint32, opener bool) *SubStream {
+	s := &SubStream{
+		mux:    m,
+		id:     id,
+		opener: opener,
+		credit: config.IrisMuxWindow,
+		cond:   sync.NewCond(&m.lock),
+	}
+	m.streams[streamKey(id, opener)] = s
+	return s
+}
+
+// Unregisters a sub-stream if both of its sides are done.
+func (m *TunnelMux) release(s *SubStream) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if s.readEnd && s.writeEnd {
+		delete(m.streams, streamKey(s.id, s.opener))
+	}
+}
+
+// Generates the lookup key of a sub-stream.
+func streamKey(id uint32, opener bool) uint64 {
+	key := uint64(id) << 1
+	if opener {
+		key |= 1
+	}
+	return key
+}
+
+// Assembles and sends a frame of a sub-stream through the tunnel.
+func (m *TunnelMux) send(kind byte, s *SubStream, data []byte) error {
+	frame := make([]byte, frameHeader+len(data))
+	if s.opener {
+		kind |= frameOpener
+	}
+	frame[0] = kind
+	binary.BigEndian.PutUint32(frame[1:], s.id)
+	copy(frame[frameHeader:], data)
+
+	m.sendMu.Lock()
+	defer m.sendMu.Unlock()
+	return m.tun.Send(frame)
+}
+
+// Dispatches the inbound frames to the sub-streams until the tunnel fails.
+func (m *TunnelMux) demux() {
+	var err error
+	for err == nil {
+		var frame []byte
+		if frame, err = m.tun.recv(nil); err == nil {
+			m.dispatch(frame)
+		}
+	}
+	if err == ErrTerminating {
+		err = ErrStreamClosed
+	}
+	// Tunnel dead, fail all the sub-streams and pending accepts
+	m.lock.Lock()
+	m.err = err
+	for _, s := range m.streams {
+		s.readEnd, s.writeEnd = true, true
+		s.cond.Broadcast()
+	}
+	m.streams = make(map[uint64]*SubStream)
+	m.lock.Unlock()
+
+	close(m.quit)
+}
+
+// Handles a single inbound frame.
+func (m *TunnelMux) dispatch(frame []byte) {
+	if len(frame) < frameHeader {
+		m.tun.owner.carrier().logger.Printf("iris: dropping malformed sub-stream frame: %d bytes.", len(frame))
+		return
+	}
+	// The opener flag is relative to the sender, flip it to the local view
+	kind, opener := frame[0]&^frameOpener, frame[0]&frameOpener == 0
+	id := binary.BigEndian.Uint32(frame[1:])
+	data := frame[frameHeader:]
+
+	m.lock.Lock()
+	s, ok := m.streams[streamKey(id, opener)]
+	if kind == frameOpen {
+		if ok || opener {
+			m.lock.Unlock()
+			m.tun.owner.carrier().logger.Printf("iris: dropping invalid sub-stream open: %d.", id)
+			return
+		}
+		s = m.newStream(id, false)
+		m.lock.Unlock()
+
+		select {
+		case m.accept <- s:
+		default:
+			// Accept backlog full, reject the stream
+			m.tun.owner.carrier().logger.Printf("iris: sub-stream accept backlog full, rejecting %d.", id)
+			s.Close()
+			m.lock.Lock()
+			s.readEnd = true
+			m.lock.Unlock()
+			m.release(s)
+		}
+		return
+	}
+	defer m.lock.Unlock()
+	if !ok {
+		// Late frames of released streams are expected, drop silently
+		return
+	}
+	switch kind {
+	case frameData:
+		if len(s.buf)+len(data) > config.IrisMuxWindow {
+			m.tun.owner.carrier().logger.Printf("iris: sub-stream %d overran its window.", id)
+			return
+		}
+		s.buf = append(s.buf, data...)
+	case frameCredit:
+		if len(data) != 4 {
+			return
+		}
+		s.credit += int(binary.BigEndian.Uint32(data))
+	case frameClose:
+		s.readEnd = true
+		if s.writeEnd {
+			delete(m.streams, streamKey(s.id, s.opener))
+		}
+	}
+	s.cond.Broadcast()
+}
+
+// Reads data from the sub-stream, blocking until at least one byte is available.
+// The io.EOF error is returned after the remote side closes the stream.
+func (s *SubStream) Read(p []byte) (int, error) {
+	m := s.mux
+
+	m.lock.Lock()
+	for len(s.buf) == 0 && !s.readEnd {
+		s.cond.Wait()
+	}
+	if len(s.buf) == 0 {
+		err := m.err
+		m.lock.Unlock()
+		if err == nil {
+			err = io.EOF
+		}
+		return 0, err
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+
+	// Replenish the remote window once half of it has been consumed
+	s.used += n
+	grant := 0
+	if s.used >= config.IrisMuxWindow/2 && !s.readEnd {
+		grant, s.used = s.used, 0
+	}
+	m.lock.Unlock()
+
+	if grant > 0 {
+		credit := make([]byte, 4)
+		binary.BigEndian.PutUint32(credit, uint32(grant))
+		if err := m.send(frameCredit, s, credit); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Writes data into the sub-stream, blocking while the remote window is exhausted.
+func (s *SubStream) Write(p []byte) (int, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	m, written := s.mux, 0
+	for written < len(p) {
+		// Wait until the remote side can accept more data
+		m.lock.Lock()
+		for s.credit == 0 && !s.writeEnd {
+			s.cond.Wait()
+		}
+		if s.writeEnd {
+			err := m.err
+			m.lock.Unlock()
+			if err == nil {
+				err = ErrStreamClosed
+			}
+			return written, err
+		}
+		size := len(p) - written
+		if size > s.credit {
+			size = s.credit
+		}
+		if limit := config.IrisTunnelFrame - frameHeader; size > limit && limit > 0 {
+			size = limit
+		}
+		s.credit -= size
+		m.lock.Unlock()
+
+		if err := m.send(frameData, s, p[written:written+size]); err != nil {
+			return written, err
+		}
+		written += size
+	}
+	return written, nil
+}
+
+// Closes the local side of the sub-stream. Pending data can still be read until
+// the remote side closes too.
+func (s *SubStream) Close() error {
+	m := s.mux
+
+	m.lock.Lock()
+	if s.writeEnd {
+		m.lock.Unlock()
+		return nil
+	}
+	s.writeEnd = true
+	s.cond.Broadcast()
+	m.lock.Unlock()
+
+	err := m.send(frameClose, s, nil)
+	m.release(s)
+	return err
+}
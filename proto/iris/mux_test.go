@@ -0,0 +1,190 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package iris
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Connection handler echoing every sub-stream of the inbound tunnels.
+type muxer struct{}
+
+func (r *muxer) HandleBroadcast(msg []byte) {
+	panic("Broadcast passed to mux handler")
+}
+
+func (r *muxer) HandleRequest(req []byte, timeout time.Duration) ([]byte, error) {
+	panic("Request passed to mux handler")
+}
+
+func (r *muxer) HandleTunnel(tun *Tunnel) {
+	mux := tun.Mux()
+	defer mux.Close()
+
+	for {
+		strm, err := mux.Accept(3 * time.Second)
+		if err != nil {
+			return
+		}
+		go func() {
+			io.Copy(strm, strm)
+			strm.Close()
+		}()
+	}
+}
+
+func (r *muxer) HandleDrop(reason error) {
+	panic("Connection dropped on mux handler")
+}
+
+// Creates a single node overlay with an echoing mux server, returning a client
+// side multiplexer and the cleanup function.
+func setupMux(t *testing.T) (*TunnelMux, func()) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("mux-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	conn, err := node.Connect("mux-test", &muxer{})
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	tun, err := conn.Tunnel("mux-test", time.Second)
+	if err != nil {
+		t.Fatalf("failed to establish tunnel: %v.", err)
+	}
+	mux := tun.Mux()
+	return mux, func() {
+		mux.Close()
+		conn.Close()
+		node.Shutdown()
+	}
+}
+
+func TestMuxConcurrentStreams(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	window := config.IrisMuxWindow
+	config.IrisMuxWindow = 4096
+	defer func() { config.IrisMuxWindow = window }()
+
+	mux, cleanup := setupMux(t)
+	defer cleanup()
+
+	// Push a blob through many sub-streams in parallel
+	streams := 16
+	errs := make(chan error, streams)
+	pend := new(sync.WaitGroup)
+	for i := 0; i < streams; i++ {
+		pend.Add(1)
+		go func() {
+			defer pend.Done()
+
+			strm, err := mux.Open()
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer strm.Close()
+
+			data := make([]byte, 64*1024)
+			rand.Read(data)
+			go strm.Write(data)
+
+			echo := make([]byte, len(data))
+			if _, err := io.ReadFull(strm, echo); err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(echo, data) {
+				errs <- io.ErrUnexpectedEOF
+			}
+		}()
+	}
+	pend.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("sub-stream transfer failed: %v.", err)
+	}
+}
+
+func TestMuxIndependentFlowControl(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	window := config.IrisMuxWindow
+	config.IrisMuxWindow = 4096
+	defer func() { config.IrisMuxWindow = window }()
+
+	mux, cleanup := setupMux(t)
+	defer cleanup()
+
+	// Stall a sub-stream by never reading its echo
+	stalled, err := mux.Open()
+	if err != nil {
+		t.Fatalf("failed to open sub-stream: %v.", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		stalled.Write(make([]byte, 16*config.IrisMuxWindow))
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatalf("stalled sub-stream write completed.")
+	case <-time.After(250 * time.Millisecond):
+	}
+	// Make sure a different sub-stream is still unaffected
+	strm, err := mux.Open()
+	if err != nil {
+		t.Fatalf("failed to open sub-stream: %v.", err)
+	}
+	defer strm.Close()
+
+	msg := []byte("hello")
+	if _, err := strm.Write(msg); err != nil {
+		t.Fatalf("failed to write sub-stream: %v.", err)
+	}
+	echo := make([]byte, len(msg))
+	if _, err := io.ReadFull(strm, echo); err != nil {
+		t.Fatalf("failed to read sub-stream: %v.", err)
+	}
+	if !bytes.Equal(echo, msg) {
+		t.Fatalf("echo mismatch: have %q, want %q.", echo, msg)
+	}
+	// Drain the stalled stream and verify it recovers
+	go io.Copy(io.Discard, stalled)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("stalled sub-stream failed to recover.")
+	}
+}
@@ -0,0 +1,393 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the functional options of the overlay and connection
+// constructors, consolidating the knobs of the lower layers into a single
+// extensible API.
+
+package iris
+
+import (
+	"crypto/rsa"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/karalabe/iris/balancer"
+	"github.com/karalabe/iris/pool"
+	"github.com/karalabe/iris/proto/pastry"
+	"github.com/karalabe/iris/proto/scribe"
+	"github.com/karalabe/iris/proto/session"
+)
+
+// Events counted by the metrics collector.
+const (
+	MetricBroadcastSent = "broadcast-sent"
+	MetricBroadcastRecv = "broadcast-recv"
+	MetricRequestSent   = "request-sent"
+	MetricRequestRecv   = "request-recv"
+	MetricRequestShed   = "request-shed"
+	MetricQueueDropped  = "queue-dropped"
+	MetricReplyRecv     = "reply-recv"
+	MetricPublishSent   = "publish-sent"
+	MetricPublishRecv   = "publish-recv"
+	MetricTunnelSent    = "tunnel-sent"
+	MetricTunnelRecv    = "tunnel-recv"
+	MetricDeadLetter    = "dead-letter"
+)
+
+// Collector of the iris layer metrics. Implementations must be safe for use by
+// multiple go-routines.
+type Metrics interface {
+	// Counts a single occurrence of an event (one of the above kinds).
+	Count(event string)
+}
+
+// Sink of the iris layer log messages, satisfied by *log.Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Logger forwarding to the standard logger.
+type stdLogger struct{}
+
+// Implements Logger.Printf.
+func (stdLogger) Printf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
+
+// Configuration option of an iris overlay.
+type Option func(*Overlay)
+
+// Sets the bootstrap ports to discover peers on, instead of config.BootPorts.
+func WithDiscovery(ports ...int) Option {
+	return func(o *Overlay) {
+		o.scribe.Host().SetBootPorts(ports)
+	}
+}
+
+// Sets the session handshake parameters of the overlay transport.
+func WithTransport(conf *session.Config) Option {
+	return func(o *Overlay) {
+		o.scribe.Host().SetShakeConfig(conf)
+	}
+}
+
+// Sets an admission policy to verify remote peers with.
+func WithAuthorizer(auth pastry.Authorizer) Option {
+	return func(o *Overlay) {
+		o.scribe.Host().SetAuthorizer(auth)
+	}
+}
+
+// Sets a collector to count the messaging events of the overlay with.
+func WithMetrics(metrics Metrics) Option {
+	return func(o *Overlay) {
+		o.metrics = metrics
+	}
+}
+
+// Sets the logger of the iris layer (the lower layers keep the standard one).
+func WithLogger(logger Logger) Option {
+	return func(o *Overlay) {
+		o.logger = logger
+	}
+}
+
+// Sets the store to buffer the events of offline durable subscriptions into,
+// instead of an in-memory one bounded by the durable limits.
+func WithStore(store Store) Option {
+	return func(o *Overlay) {
+		o.store = store
+	}
+}
+
+// Sets the strategy to balance the requests and tunnels of a cluster with. All
+// nodes of the overlay should use the same strategies.
+func WithBalancer(cluster string, strategy balancer.Strategy) Option {
+	return func(o *Overlay) {
+		for _, prefix := range clusterPrefixes {
+			o.scribe.SetStrategy(prefix+cluster, strategy)
+		}
+	}
+}
+
+// Switches the requests and tunnels of the given clusters to prefer members on
+// the local node, then the members on the lowest latency node, falling back to
+// the capacity weighted default if no latencies were measured yet.
+func WithLocality(clusters ...string) Option {
+	return func(o *Overlay) {
+		strategy := balancer.Nearest(o.latency, nil)
+		for _, cluster := range clusters {
+			for _, prefix := range clusterPrefixes {
+				o.scribe.SetStrategy(prefix+cluster, strategy)
+			}
+		}
+	}
+}
+
+// Switches the broadcasts of the given clusters into total order: all members
+// process them in the same order, sequenced by the rendezvous node of the topic.
+// Sampled acknowledged broadcasts are not ordered. All nodes of the overlay
+// should order the same clusters.
+func WithOrderedBroadcast(clusters ...string) Option {
+	return func(o *Overlay) {
+		for _, cluster := range clusters {
+			o.ordered[cluster] = true
+		}
+	}
+}
+
+// Partitions the given topics, hashing the events published with a key into one
+// of parts partitions, each consumed in order by a single subscriber. Keyless
+// events are spread over the partitions. All nodes of the overlay should use the
+// same partitioning.
+func WithPartitionedTopics(parts int, topics ...string) Option {
+	return func(o *Overlay) {
+		for _, topic := range topics {
+			o.partitions[topic] = parts
+		}
+	}
+}
+
+// Creates a new iris overlay, configured by the given options.
+func NewOverlay(overId string, key *rsa.PrivateKey, opts ...Option) *Overlay {
+	// Create and initialize the overlay
+	o := &Overlay{
+		conns:   make(map[uint64]*Connection),
+		subLive: make(map[string][]uint64),
+		subLock: make(map[string]sync.RWMutex),
+		durable: make(map[string]*durable),
+		ordered: make(map[string]bool),
+		reorder: make(map[string]*reorder),
+		chunks:  make(map[string]*assembly),
+		store:   newMemoryStore(),
+		logger:  stdLogger{},
+
+		partitions: make(map[string]int),
+
+		presQuit: make(chan chan struct{}),
+		down:     make(chan struct{}),
+	}
+	o.scribe = scribe.New(overId, key, o)
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// Retrieves the median round trip time to an overlay node, if measured.
+func (o *Overlay) latency(id *big.Int) (time.Duration, bool) {
+	if stat := o.scribe.Pastry().PeerLatency(id); stat != nil {
+		return stat.P50, true
+	}
+	return 0, false
+}
+
+// Counts an event occurrence if a metrics collector is set.
+func (o *Overlay) count(event string) {
+	if o.metrics != nil {
+		o.metrics.Count(event)
+	}
+}
+
+// Configuration option of a client connection.
+type ConnectionOption func(*Connection)
+
+// Sets the number of threads handling the events of the connection, instead of
+// config.IrisHandlerThreads.
+func WithHandlerThreads(threads int) ConnectionOption {
+	return func(c *Connection) {
+		c.workers = pool.NewThreadPool(threads)
+	}
+}
+
+// Appends interceptors to the outbound chain of the connection, wrapping the
+// broadcasts, requests and publishes issued through it.
+func WithOutbound(interceptors ...Interceptor) ConnectionOption {
+	return func(c *Connection) {
+		c.outbound = append(c.outbound, interceptors...)
+	}
+}
+
+// Appends interceptors to the inbound chain of the connection, wrapping the calls
+// of the connection and subscription handlers.
+func WithInbound(interceptors ...Interceptor) ConnectionOption {
+	return func(c *Connection) {
+		c.inbound = append(c.inbound, interceptors...)
+	}
+}
+
+// Behavior of a bounded handler queue of a connection when full.
+type Overflow int
+
+const (
+	OverflowBlock      Overflow = iota // Hold back the inbound delivery until there is space
+	OverflowReject                     // Drop the new work (requests fail with *OverloadError)
+	OverflowDropOldest                 // Evict the oldest pending work (requests fail with *OverloadError)
+)
+
+// Concurrency and queueing limits of the handlers of a connection.
+type HandlerLimits struct {
+	Requests   int           // Maximum concurrent HandleRequest calls (0 for config.IrisQueueThreads)
+	Broadcasts int           // Maximum concurrent HandleBroadcast calls (0 for config.IrisQueueThreads)
+	Queued     int           // Maximum pending requests, broadcasts or events per topic (0 for unbounded)
+	Overflow   Overflow      // Behavior of a full queue
+	RetryAfter time.Duration // Back-off hint sent to the requesters rejected on overflow
+}
+
+// Sets the concurrency and queueing limits of the connection handlers. Overall
+// concurrency is still capped by the number of handler threads.
+func WithHandlerLimits(limits HandlerLimits) ConnectionOption {
+	return func(c *Connection) {
+		c.limits = &limits
+	}
+}
+
+// Rate limits of a connection in operations per second, zero meaning unlimited.
+type RateLimits struct {
+	Requests  float64 // Outbound requests (including scatter-gathers and retries)
+	Publishes float64 // Outbound publishes and broadcasts
+	Handlers  float64 // Inbound request, broadcast and event handler invocations
+}
+
+// Sets the rate limits of the connection. Outbound operations exceeding them
+// fail with ErrRateLimited, inbound ones are shed like on a queue overflow.
+func WithRateLimits(limits RateLimits) ConnectionOption {
+	return func(c *Connection) {
+		c.rateReq = newBucket(limits.Requests)
+		c.ratePub = newBucket(limits.Publishes)
+		c.rateHand = newBucket(limits.Handlers)
+	}
+}
+
+// Retry policy of the requests issued through a connection.
+type RetryPolicy struct {
+	Attempts   int                  // Maximum number of attempts, including the first
+	Backoff    time.Duration        // Delay before the first retry, doubled after each
+	MaxBackoff time.Duration        // Upper limit of the retry delay (zero for none)
+	Retry      func(err error) bool // Classifies retriable failures (nil for the default)
+}
+
+// Sets the handler to notify of the progress of chunked transfers.
+func WithProgress(handler ProgressHandler) ConnectionOption {
+	return func(c *Connection) {
+		c.progress = handler
+	}
+}
+
+// Makes the tunnels opened through the connection resumable: if the underlying
+// link breaks, it is re-established within the grace period and the transfer
+// continues from the last acknowledged message.
+func WithTunnelResume(grace time.Duration) ConnectionOption {
+	return func(c *Connection) {
+		c.tunGrace = grace
+	}
+}
+
+// Sets the handler of the publishes and broadcasts reported undeliverable, which
+// are silently dropped otherwise.
+func WithDeadLetters(handler DeadLetterHandler) ConnectionOption {
+	return func(c *Connection) {
+		c.dead = handler
+	}
+}
+
+// Republishes the publishes and broadcasts reported undeliverable into topic,
+// with the failure details attached as metadata.
+func WithDeadLetterTopic(topic string) ConnectionOption {
+	return func(c *Connection) {
+		c.dead = &deadTopic{conn: c, topic: topic}
+	}
+}
+
+// Sets the tracer to notify of the spans of the calls issued and handled, whose
+// identifiers are then propagated in the message metadata.
+func WithTracer(tracer Tracer) ConnectionOption {
+	return func(c *Connection) {
+		c.spans = tracer
+	}
+}
+
+// Makes the connection compete for the leadership of its cluster, notifying the
+// handler when elected or deposed. The connection watches its own cluster for
+// the elections, which hence cannot be watched separately.
+func WithLeadership(handler LeaderHandler) ConnectionOption {
+	return func(c *Connection) {
+		c.elect = &elector{conn: c, handler: handler}
+	}
+}
+
+// Sets the codec of the typed payloads, which are JSON encoded otherwise.
+func WithCodec(codec Codec) ConnectionOption {
+	return func(c *Connection) {
+		c.codec = codec
+	}
+}
+
+// Sets the retry policy of the requests, which are issued only once otherwise.
+func WithRetry(policy RetryPolicy) ConnectionOption {
+	return func(c *Connection) {
+		c.retry = &policy
+	}
+}
+
+// Reports whether a failed request should be retried: timeouts and losses in
+// transit by default, never if the connection is terminating.
+func (p *RetryPolicy) retriable(err error) bool {
+	if err == ErrTerminating {
+		return false
+	}
+	if p.Retry != nil {
+		return p.Retry(err)
+	}
+	if _, ok := err.(*pastry.ForwardError); ok {
+		return true
+	}
+	return err == ErrTimeout
+}
+
+// Calculates the delay before the given retry (the first being one).
+func (p *RetryPolicy) delay(retry int) time.Duration {
+	return backoff(p.Backoff, p.MaxBackoff, retry)
+}
+
+// Calculates an exponential backoff delay before the given attempt (the first
+// being one), doubling the base after each and capping it at limit (if non-zero).
+func backoff(base, limit time.Duration, attempt int) time.Duration {
+	delay := base
+	for i := 1; i < attempt && (limit == 0 || delay < limit); i++ {
+		delay *= 2
+	}
+	if limit > 0 && delay > limit {
+		delay = limit
+	}
+	return delay
+}
+
+// Calculates the delay before retrying a failed attempt, honoring the back-off
+// hint of an overloaded member if longer than the policy's own.
+func (p *RetryPolicy) wait(retry int, err error) time.Duration {
+	delay := p.delay(retry)
+	if over, ok := err.(*OverloadError); ok && over.RetryAfter > delay {
+		delay = over.RetryAfter
+	}
+	return delay
+}
@@ -0,0 +1,106 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package iris
+
+import (
+	"bytes"
+	"crypto/x509"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Metrics collector counting the events in memory.
+type counter struct {
+	counts map[string]int
+	lock   sync.Mutex
+}
+
+func (c *counter) Count(event string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.counts[event]++
+}
+
+func (c *counter) count(event string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.counts[event]
+}
+
+// Tests that the overlay and connection options are applied.
+func TestOptions(t *testing.T) {
+	// Configure the test, discovering only on a dedicated port
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	metrics := &counter{counts: make(map[string]int)}
+
+	logs := new(bytes.Buffer)
+
+	node := NewOverlay("options-test", key, WithDiscovery(64999), WithMetrics(metrics), WithLogger(log.New(logs, "", 0)))
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := node.Shutdown(); err != nil {
+			t.Fatalf("failed to terminate iris node: %v.", err)
+		}
+	}()
+	handler := &broadcaster{make(chan []byte, 10)}
+	conn, err := node.Connect("options-test", handler, WithHandlerThreads(2))
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			t.Fatalf("failed to close iris connection: %v.", err)
+		}
+	}()
+	if conn.workers == nil {
+		t.Fatalf("connection worker pool missing.")
+	}
+	// Broadcast a few messages and verify the counted metrics
+	for i := 0; i < 5; i++ {
+		if err := conn.Broadcast("options-test", []byte{byte(i)}); err != nil {
+			t.Fatalf("failed to broadcast message: %v.", err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		select {
+		case <-handler.msgs:
+		case <-time.After(time.Second):
+			t.Fatalf("broadcast %d not delivered.", i)
+		}
+	}
+	if sent := metrics.count(MetricBroadcastSent); sent != 5 {
+		t.Fatalf("sent broadcast count mismatch: have %v, want %v.", sent, 5)
+	}
+	if recv := metrics.count(MetricBroadcastRecv); recv != 5 {
+		t.Fatalf("received broadcast count mismatch: have %v, want %v.", recv, 5)
+	}
+	if config.BootPorts[0] == "64999" {
+		t.Fatalf("global bootstrap ports modified.")
+	}
+}
@@ -0,0 +1,170 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the totally ordered broadcasts. Broadcasts into an ordered cluster are
+// sent to the rendezvous node of a single cluster topic, which stamps them with
+// consecutive sequence numbers before distributing them. The members reorder the
+// arriving events accordingly, skipping over lost ones after a timeout, and hand
+// them to the connections through serial sub-queues.
+
+package iris
+
+import (
+	"math/big"
+	"sync/atomic"
+	"time"
+
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto"
+)
+
+// An ordered event waiting for its turn.
+type sequenced struct {
+	src *big.Int
+	msg *proto.Message
+}
+
+// Reordering state of an ordered topic.
+type reorder struct {
+	root *big.Int              // Topic root assigning the sequence numbers
+	next uint64                // Sequence number of the next event to deliver
+	pend map[uint64]*sequenced // Events arrived ahead of their turn
+	gap  *time.Timer           // Timer skipping a missing event
+}
+
+// Retrieves the lowest sequence number still pending.
+func (r *reorder) first() uint64 {
+	first := uint64(0)
+	for seq := range r.pend {
+		if first == 0 || seq < first {
+			first = seq
+		}
+	}
+	return first
+}
+
+// Sends a broadcast message into a cluster, either through the topic root of an
+// ordered cluster, or into the next cluster split otherwise.
+func (c *Connection) disseminate(cluster string, msg *proto.Message) error {
+	o := c.carrier()
+
+	if o.ordered[cluster] {
+		return o.scribe.Sequence(clusterPrefixes[0]+cluster, msg)
+	}
+	prefixIdx := int(atomic.AddUint32(&c.splitId, 1)) % config.IrisClusterSplits
+	return o.scribe.Publish(clusterPrefixes[prefixIdx]+cluster, msg)
+}
+
+// Implements proto.scribe.OrderedCallback.HandleOrdered. Queues the event until
+// all the preceding ones are delivered, releasing the ready ones.
+func (o *Overlay) HandleOrdered(src *big.Int, topic string, root *big.Int, seq uint64, msg *proto.Message) {
+	o.orderLock.Lock()
+	defer o.orderLock.Unlock()
+
+	// Restart the sequence if the topic root changed (churn), flushing the old one
+	r, ok := o.reorder[topic]
+	if !ok || r.root.Cmp(root) != 0 {
+		if ok {
+			o.flush(topic, r)
+		}
+		r = &reorder{
+			root: root,
+			next: seq,
+			pend: make(map[uint64]*sequenced),
+		}
+		o.reorder[topic] = r
+	}
+	// Drop duplicates and events already skipped over
+	if seq < r.next {
+		return
+	}
+	r.pend[seq] = &sequenced{src, msg}
+	o.advance(topic, r)
+}
+
+// Delivers the consecutive pending events of an ordered topic, arming the gap
+// timer if some are still held back. The order lock is assumed held.
+func (o *Overlay) advance(topic string, r *reorder) {
+	for {
+		event, ok := r.pend[r.next]
+		if !ok {
+			break
+		}
+		delete(r.pend, r.next)
+		r.next++
+		o.dispatch(topic, event.src, event.msg)
+	}
+	if len(r.pend) > 0 && r.gap == nil {
+		r.gap = time.AfterFunc(config.IrisOrderTimeout, func() { o.skip(topic, r) })
+	}
+}
+
+// Gives up on the missing event of an ordered topic, continuing with the next
+// one still pending.
+func (o *Overlay) skip(topic string, r *reorder) {
+	o.orderLock.Lock()
+	defer o.orderLock.Unlock()
+
+	r.gap = nil
+	if o.reorder[topic] != r || len(r.pend) == 0 {
+		return
+	}
+	r.next = r.first()
+	o.advance(topic, r)
+}
+
+// Delivers all the pending events of an ordered topic, skipping any gaps. The
+// order lock is assumed held.
+func (o *Overlay) flush(topic string, r *reorder) {
+	if r.gap != nil {
+		r.gap.Stop()
+		r.gap = nil
+	}
+	for len(r.pend) > 0 {
+		r.next = r.first()
+		event := r.pend[r.next]
+		delete(r.pend, r.next)
+		o.dispatch(topic, event.src, event.msg)
+	}
+}
+
+// Hands an ordered broadcast to the local members of the topic, each through a
+// serial sub-queue to retain the order.
+func (o *Overlay) dispatch(topic string, src *big.Int, msg *proto.Message) {
+	head := msg.Head.Meta.(*header)
+
+	o.lock.RLock()
+	conns := make([]*Connection, 0, len(o.subLive[topic]))
+	for _, id := range o.subLive[topic] {
+		if id != bufferConn {
+			conns = append(conns, o.conns[id])
+		}
+	}
+	o.lock.RUnlock()
+
+	for _, conn := range conns {
+		conn := conn // Closure
+		o.count(MetricBroadcastRecv)
+		conn.serialize(orderedQueue(topic), func() {
+			if conn.handleBroadcast(msg.Data, head.Metadata) && head.AckId != 0 {
+				o.scribe.Direct(src, conn.assembleAck(head.Src, head.AckId))
+			}
+		})
+	}
+}
@@ -21,9 +21,9 @@
 package iris
 
 import (
+	"context"
 	"crypto/rsa"
 	"fmt"
-	"log"
 	"net"
 	"sync"
 
@@ -35,29 +35,38 @@ import (
 type Overlay struct {
 	scribe *scribe.Overlay // Overlay network to route the messages with
 
-	autoid uint64                 // Id to assign to the next connection
-	conns  map[uint64]*Connection // Live client connections
+	conns map[uint64]*Connection // Live client connections
 
 	subLive map[string][]uint64     // Live members of each subscribed topic
 	subLock map[string]sync.RWMutex // Locks protecting the individual topics
 
+	durable map[string]*durable // Durable subscriptions, online or buffering
+	store   Store               // Storage of the events of offline durables
+
+	partitions map[string]int // Partition counts of the partitioned topics
+
+	ordered   map[string]bool     // Clusters broadcasting in total order
+	reorder   map[string]*reorder // Reordering state of the ordered topics
+	orderLock sync.Mutex          // Mutex to protect the reordering state
+
+	chunks    map[string]*assembly // Partially received chunked messages
+	chunkLock sync.Mutex           // Mutex to protect the chunk reassembly
+
+	presQuit chan chan struct{} // Quit channel of the presence announcer
+	down     chan struct{}      // Channel closed when the overlay terminates
+
 	tunAddrs []string          // Listener addresses for the tunnel endpoints
 	tunQuits []chan chan error // Quit channels for the tunnel acceptors
 
+	metrics Metrics // Optional collector of the messaging events
+	logger  Logger  // Sink of the iris layer log messages
+
 	lock sync.RWMutex // Protects the overlay state
 }
 
-// Creates a new iris overlay.
+// Creates a new iris overlay with the default configuration.
 func New(overId string, key *rsa.PrivateKey) *Overlay {
-	// Create and initialize the overlay
-	o := &Overlay{
-		autoid:  1, // Zero's a special case with gob, skip it
-		conns:   make(map[uint64]*Connection),
-		subLive: make(map[string][]uint64),
-		subLock: make(map[string]sync.RWMutex),
-	}
-	o.scribe = scribe.New(overId, key, o)
-	return o
+	return NewOverlay(overId, key)
 }
 
 // Boots the overlay, returning the number of remote peers.
@@ -86,14 +95,41 @@ func (o *Overlay) Boot() (int, error) {
 			}
 		}
 	}
+	// Start announcing the presence of the local connections
+	go o.presencer(o.presQuit)
+
 	return peers, nil
 }
 
+// Blocks until the routing state of the underlay stabilizes or the context is
+// cancelled, signaling that the network is ready for use.
+func (o *Overlay) WaitConverged(ctx context.Context) error {
+	return o.scribe.Pastry().WaitConverged(ctx)
+}
+
+// Returns the number of remote peers the underlay is currently connected to.
+func (o *Overlay) Peers() int {
+	return len(o.scribe.Pastry().Snapshot().Peers)
+}
+
+// Returns a channel which is closed when the overlay starts terminating.
+func (o *Overlay) Done() <-chan struct{} {
+	return o.down
+}
+
 // Terminates the overlay and all lower layer network primitives.
 func (o *Overlay) Shutdown() error {
 	errs := []error{}
 	errc := make(chan error)
 
+	// Signal the termination to the reconnecting connections
+	close(o.down)
+
+	// Stop the presence announcements
+	done := make(chan struct{})
+	o.presQuit <- done
+	<-done
+
 	// Close the tunnel listeners to prevent new connections
 	for _, quit := range o.tunQuits {
 		quit <- errc
@@ -137,13 +173,72 @@ func (o *Overlay) subscribe(id uint64, topic string) error {
 	}
 	o.lock.Unlock()
 
-	// If a new subscription was requested, do it
+	// If a new subscription was requested, do it (dropping the member if failed)
 	if cascade {
-		return o.scribe.Subscribe(topic)
+		if err := o.scribe.Subscribe(topic); err != nil {
+			o.lock.Lock()
+			subs := o.subLive[topic]
+			for i, subId := range subs {
+				if id == subId {
+					subs = append(subs[:i], subs[i+1:]...)
+					break
+				}
+			}
+			if len(subs) == 0 {
+				delete(o.subLive, topic)
+				delete(o.subLock, topic)
+			} else {
+				o.subLive[topic] = subs
+			}
+			o.lock.Unlock()
+			return err
+		}
 	}
 	return nil
 }
 
+// Recalculates the event allowance of the local node for a topic and updates the
+// scribe subscriptions of all the split prefixes: unlimited if any connection is
+// in push mode, the largest remaining credit otherwise.
+func (o *Overlay) credit(topic string) {
+	for _, prefix := range topicPrefixes {
+		// Collect the live connections subscribed to the topic
+		o.lock.RLock()
+		subs := o.subLive[prefix+topic]
+		conns := make([]*Connection, 0, len(subs))
+		buffered := false
+		for _, id := range subs {
+			if conn, ok := o.conns[id]; ok {
+				conns = append(conns, conn)
+			}
+			buffered = buffered || id == bufferConn
+		}
+		o.lock.RUnlock()
+
+		if len(conns) == 0 && !buffered {
+			continue
+		}
+		// Aggregate the allowances (buffering is push mode) and notify scribe
+		demand := 0
+		if buffered {
+			demand = -1
+		}
+		for _, conn := range conns {
+			credits := conn.credits(prefix + topic)
+			if credits < 0 {
+				demand = -1
+				break
+			}
+			if credits > demand {
+				demand = credits
+			}
+		}
+		if err := o.scribe.Credit(prefix+topic, demand); err != nil {
+			o.logger.Printf("iris: failed to update topic credits: %v.", err)
+		}
+	}
+}
+
 // Unsubscribes a client from a topic, removing the scribe subscription too if
 // the last client.
 func (o *Overlay) unsubscribe(id uint64, topic string) error {
@@ -154,7 +249,7 @@ func (o *Overlay) unsubscribe(id uint64, topic string) error {
 	cascade := false
 	if lock, ok := o.subLock[topic]; !ok {
 		// This should *not* happen
-		log.Printf("iris: unsubscribe from non-existent topic: %v.", topic)
+		o.logger.Printf("iris: unsubscribe from non-existent topic: %v.", topic)
 		return ErrNotSubscribed
 	} else {
 		// Remove the subscription
@@ -173,7 +268,7 @@ func (o *Overlay) unsubscribe(id uint64, topic string) error {
 
 		// Actually check if anything was removed, just in case
 		if !done {
-			log.Printf("iris: remove non-existent subscription: %v:%v.", topic, id)
+			o.logger.Printf("iris: remove non-existent subscription: %v:%v.", topic, id)
 			return ErrNotSubscribed
 		}
 		if len(subs) == 0 {
@@ -0,0 +1,120 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the partitioned topics. The events of a partitioned topic are hashed
+// by their key into one of a fixed number of partitions, and instead of being
+// published to every subscriber, each is balanced to the single member the
+// partition is pinned to (by rendezvous hashing down the topic tree, then among
+// the local connections). The subscribers of the topic thus form a consumer
+// group sharing the partitions, every partition being consumed by one of them
+// in order, until the group changes and the partitions are remapped.
+//
+// Partitioned events are neither relayed to pattern subscribers, nor buffered
+// for offline durable subscriptions.
+
+package iris
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/karalabe/iris/config"
+)
+
+var ErrNotPartitioned = errors.New("topic not partitioned")
+
+// Publishes an event asynchronously to the partition of a partitioned topic the
+// key hashes to. Events with the same key are delivered in order to the same
+// member of the subscriber group.
+func (c *Connection) PublishKey(topic string, key string, msg []byte) error {
+	parts := c.carrier().partitions[topic]
+	if parts == 0 {
+		return ErrNotPartitioned
+	}
+	_, err := intercept(c.outbound, CallPublish, topic, msg, func(msg []byte) ([]byte, error) {
+		return nil, c.sendPartition(topic, partition(key, parts), msg, nil, 0)
+	})
+	return err
+}
+
+// Retrieves the partition an event key is hashed into.
+func partition(key string, parts int) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return int(hash.Sum32() % uint32(parts))
+}
+
+// Retrieves the routing key pinning a partition to a subscriber.
+func partitionKey(part int) string {
+	return strconv.Itoa(part)
+}
+
+// Generates the sub-queue name of a partition of a (prefixed) topic, executed
+// serially to retain the order of the events.
+func partitionQueue(topic string, part int) string {
+	return topicQueue(topic) + "#" + partitionKey(part)
+}
+
+// Sends an event into a partition of a topic, balancing it down the tree of the
+// topic split the partition belongs to.
+func (c *Connection) sendPartition(topic string, part int, msg []byte, meta Metadata, ackId uint64) (err error) {
+	o := c.carrier()
+
+	if !c.ratePub.take() {
+		return ErrRateLimited
+	}
+	o.count(MetricPublishSent)
+	c.statTopic(topic, func(s *TargetStats) { s.PublishesSent++ })
+
+	meta, span := c.traceOut(context.Background(), CallPublish, topic, meta)
+	defer func() { finish(span, err) }()
+
+	prefixIdx := part % config.IrisClusterSplits
+	event := c.retain(CallPublish, topic, attach(c.assemblePartition(part, ackId, msg), meta))
+	return o.scribe.BalanceKey(topicPrefixes[prefixIdx]+topic, partitionKey(part), event)
+}
+
+// Sends an event into the next partition of a topic, if partitioned, reporting
+// whether it did. Keyless events are spread evenly, without ordering.
+func (c *Connection) spread(topic string, msg []byte, meta Metadata, ackId uint64) (bool, error) {
+	parts := c.carrier().partitions[topic]
+	if parts == 0 {
+		return false, nil
+	}
+	part := int(atomic.AddUint32(&c.splitId, 1)) % parts
+	return true, c.sendPartition(topic, part, msg, meta, ackId)
+}
+
+// Picks the live local subscriber of a (prefixed) topic a partition is pinned
+// to, skipping the durable buffer. The overlay lock is assumed read locked.
+func (o *Overlay) partitionOwner(subs []uint64, part int) *Connection {
+	live := make([]uint64, 0, len(subs))
+	for _, id := range subs {
+		if id != bufferConn {
+			live = append(live, id)
+		}
+	}
+	if len(live) == 0 {
+		return nil
+	}
+	return o.conns[affinityConn(partitionKey(part), live)]
+}
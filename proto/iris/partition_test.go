@@ -0,0 +1,109 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package iris
+
+import (
+	"crypto/x509"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Tests that the events of a partitioned topic are consumed in order by a single
+// member of the subscriber group per key.
+func TestPartition(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	keys, events := 16, 32
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := NewOverlay("partition-test", key, WithPartitionedTopics(8, "partition-test-topic"))
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	// Start a few members subscribed to the partitioned topic
+	subs := make([]*subscriber, 3)
+	for i := range subs {
+		conn, err := node.Connect(fmt.Sprintf("partition-test-%d", i), nil)
+		if err != nil {
+			t.Fatalf("member %d: failed to connect to the iris overlay: %v.", i, err)
+		}
+		defer conn.Close()
+
+		subs[i] = &subscriber{make(chan []byte, keys*events)}
+		if err := conn.Subscribe("partition-test-topic", subs[i]); err != nil {
+			t.Fatalf("member %d: failed to subscribe to topic: %v.", i, err)
+		}
+	}
+	time.Sleep(250 * time.Millisecond)
+
+	// Publish ordered events for a bunch of keys
+	conn, err := node.Connect("partition-test-publisher", nil)
+	if err != nil {
+		t.Fatalf("failed to connect publisher to the iris overlay: %v.", err)
+	}
+	defer conn.Close()
+
+	for i := 0; i < events; i++ {
+		for k := 0; k < keys; k++ {
+			if err := conn.PublishKey("partition-test-topic", fmt.Sprintf("key-%d", k), []byte(fmt.Sprintf("%d/%d", k, i))); err != nil {
+				t.Fatalf("failed to publish event %d/%d: %v.", k, i, err)
+			}
+		}
+	}
+	// Verify that every key was consumed by a single member, in order
+	owners, next := make(map[int]int), make(map[int]int)
+	for recv := 0; recv < keys*events; recv++ {
+		select {
+		case msg := <-subs[0].msgs:
+			checkPartition(t, owners, next, 0, msg)
+		case msg := <-subs[1].msgs:
+			checkPartition(t, owners, next, 1, msg)
+		case msg := <-subs[2].msgs:
+			checkPartition(t, owners, next, 2, msg)
+		case <-time.After(time.Second):
+			t.Fatalf("event %d not delivered.", recv)
+		}
+	}
+	// Unpartitioned topics should reject keyed publishes
+	if err := conn.PublishKey("partition-test-plain", "key", nil); err != ErrNotPartitioned {
+		t.Fatalf("keyed publish error mismatch: have %v, want %v.", err, ErrNotPartitioned)
+	}
+}
+
+// Checks that a partitioned event was delivered to the owner of its key, in order.
+func checkPartition(t *testing.T, owners, next map[int]int, member int, msg []byte) {
+	var key, seq int
+	if _, err := fmt.Sscanf(string(msg), "%d/%d", &key, &seq); err != nil {
+		t.Fatalf("failed to parse event %s: %v.", msg, err)
+	}
+	if owner, ok := owners[key]; ok && owner != member {
+		t.Fatalf("key %d: owner mismatch: have %v, want %v.", key, member, owner)
+	}
+	owners[key] = member
+	if seq != next[key] {
+		t.Fatalf("key %d: sequence mismatch: have %v, want %v.", key, seq, next[key])
+	}
+	next[key]++
+}
@@ -0,0 +1,52 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the connection health checks. A ping is a delivery acknowledgement
+// the connection addresses to itself, sent through the overlay and handled by
+// the connection's event queues like any other, so its round trip verifies the
+// liveness of the whole local pipeline without a fake business request.
+
+package iris
+
+import (
+	"time"
+)
+
+// Measures the round trip of a probe sent through the overlay back into the
+// connection, verifying that both the node and the connection's event handling
+// are live. ErrTimeout is returned if the probe doesn't arrive in time.
+func (c *Connection) Ping(timeout time.Duration) (time.Duration, error) {
+	o := c.carrier()
+
+	ackId, acked := c.track(1)
+	defer c.untrack(ackId)
+
+	start := time.Now()
+	if err := o.scribe.Direct(o.scribe.Pastry().Self(), c.assembleAck(c.id, ackId)); err != nil {
+		return 0, err
+	}
+	select {
+	case <-c.term:
+		return 0, ErrTerminating
+	case <-time.After(timeout):
+		return 0, ErrTimeout
+	case <-acked.done:
+		return time.Since(start), nil
+	}
+}
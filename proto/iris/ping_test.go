@@ -0,0 +1,60 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package iris
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+// Tests that connections can be health checked through the overlay.
+func TestPing(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("ping-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	conn, err := node.Connect("ping-test", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	// Live connections should answer within the timeout
+	for i := 0; i < 3; i++ {
+		latency, err := conn.Ping(time.Second)
+		if err != nil {
+			t.Fatalf("ping %d failed: %v.", i, err)
+		}
+		if latency <= 0 || latency >= time.Second {
+			t.Fatalf("ping %d latency out of bounds: have %v, want (0, 1s).", i, latency)
+		}
+	}
+	// Closed connections should fail the health check
+	conn.Close()
+	if _, err := conn.Ping(time.Second); err != ErrTerminating {
+		t.Fatalf("closed ping error mismatch: have %v, want %v.", err, ErrTerminating)
+	}
+}
@@ -0,0 +1,247 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the cluster presence notifications. Every connection announces itself
+// into the presence channel of its cluster when connecting and leaving, and
+// periodically in between, so that watchers can track the live instances. New
+// watchers probe the channel, to which the members answer directly. Instances
+// silent for too long (e.g. crashed nodes) are reported gone by the watchers.
+
+package iris
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Prefix of the presence channel of a cluster.
+const presencePrefix = "p#-"
+
+// Handler receiving the presence changes of a watched cluster.
+type PresenceHandler interface {
+	// Handles the appearance of a new cluster instance (connection).
+	HandleJoin(instance string)
+
+	// Handles the departure (or silence timeout) of a cluster instance.
+	HandleLeave(instance string)
+}
+
+// Presence state of a cluster watched by a connection.
+type watcher struct {
+	handler PresenceHandler      // Handler notified of the presence changes
+	seen    map[string]time.Time // Live instances and their last announcement
+}
+
+// Generates the textual id of a cluster instance.
+func instanceId(node *big.Int, conn uint64) string {
+	return fmt.Sprintf("%v/%d", node, conn)
+}
+
+// Starts watching the presence of the cluster's instances. The handler is first
+// notified of the instances already live, then of any changes.
+func (c *Connection) Watch(cluster string, handler PresenceHandler) error {
+	o := c.carrier()
+
+	c.presLock.Lock()
+	select {
+	case <-c.term:
+		c.presLock.Unlock()
+		return ErrTerminating
+	default:
+		if _, ok := c.presWatch[cluster]; ok {
+			c.presLock.Unlock()
+			return ErrSubscribed
+		}
+	}
+	c.presWatch[cluster] = &watcher{
+		handler: handler,
+		seen:    make(map[string]time.Time),
+	}
+	c.presLock.Unlock()
+
+	// Join the presence channel (members already did) and query the instances
+	if cluster != c.cluster {
+		if err := o.subscribe(c.id, presencePrefix+cluster); err != nil {
+			return err
+		}
+	}
+	return o.scribe.Publish(presencePrefix+cluster, c.assemblePresence(opProbe, cluster))
+}
+
+// Stops watching the presence of the cluster's instances.
+func (c *Connection) Unwatch(cluster string) error {
+	c.presLock.Lock()
+	select {
+	case <-c.term:
+		c.presLock.Unlock()
+		return ErrTerminating
+	default:
+		if _, ok := c.presWatch[cluster]; !ok {
+			c.presLock.Unlock()
+			return ErrNotSubscribed
+		}
+	}
+	delete(c.presWatch, cluster)
+	c.presLock.Unlock()
+
+	if cluster != c.cluster {
+		return c.carrier().unsubscribe(c.id, presencePrefix+cluster)
+	}
+	return nil
+}
+
+// Retrieves the instances of a watched cluster currently deemed live.
+func (c *Connection) Instances(cluster string) ([]string, error) {
+	c.presLock.RLock()
+	defer c.presLock.RUnlock()
+
+	watch, ok := c.presWatch[cluster]
+	if !ok {
+		return nil, ErrNotSubscribed
+	}
+	instances := make([]string, 0, len(watch.seen))
+	for instance, _ := range watch.seen {
+		instances = append(instances, instance)
+	}
+	return instances, nil
+}
+
+// Joins the presence channel of the connection's cluster and announces itself.
+func (c *Connection) join() error {
+	if err := c.carrier().subscribe(c.id, presencePrefix+c.cluster); err != nil {
+		return err
+	}
+	return c.announce(opJoin)
+}
+
+// Announces the departure of the connection and leaves all presence channels.
+func (c *Connection) leave() {
+	o := c.carrier()
+
+	if err := c.announce(opLeave); err != nil {
+		o.logger.Printf("iris: failed to announce departure: %v.", err)
+	}
+	c.presLock.Lock()
+	for cluster, _ := range c.presWatch {
+		if cluster != c.cluster {
+			o.unsubscribe(c.id, presencePrefix+cluster)
+		}
+	}
+	c.presLock.Unlock()
+	o.unsubscribe(c.id, presencePrefix+c.cluster)
+}
+
+// Publishes a presence change of the connection to the watchers of its cluster.
+func (c *Connection) announce(op opcode) error {
+	return c.carrier().scribe.Publish(presencePrefix+c.cluster, c.assemblePresence(op, c.cluster))
+}
+
+// Processes a presence message from a remote (or local) connection.
+func (c *Connection) handlePresence(node *big.Int, head *header) {
+	// Answer probes of new watchers directly
+	if head.Op == opProbe {
+		if head.Cluster == c.cluster {
+			c.carrier().scribe.Direct(node, c.assembleAnnounce(head.Src))
+		}
+		return
+	}
+	// Update the watcher's instance set, noting any changes
+	instance := instanceId(node, head.Src)
+
+	c.presLock.Lock()
+	watch, ok := c.presWatch[head.Cluster]
+	if !ok {
+		c.presLock.Unlock()
+		return
+	}
+	_, known := watch.seen[instance]
+	switch head.Op {
+	case opJoin:
+		watch.seen[instance] = time.Now()
+	case opLeave:
+		delete(watch.seen, instance)
+	}
+	c.presLock.Unlock()
+
+	switch {
+	case head.Op == opJoin && !known:
+		watch.handler.HandleJoin(instance)
+	case head.Op == opLeave && known:
+		watch.handler.HandleLeave(instance)
+	}
+}
+
+// Reports the instances of the watched clusters silent beyond the timeout gone.
+func (c *Connection) expirePresence() {
+	type departure struct {
+		handler  PresenceHandler
+		instance string
+	}
+	gone := []departure{}
+
+	c.presLock.Lock()
+	cutoff := time.Now().Add(-config.IrisPresenceTimeout)
+	for _, watch := range c.presWatch {
+		for instance, seen := range watch.seen {
+			if seen.Before(cutoff) {
+				delete(watch.seen, instance)
+				gone = append(gone, departure{watch.handler, instance})
+			}
+		}
+	}
+	c.presLock.Unlock()
+
+	for _, dep := range gone {
+		dep.handler.HandleLeave(dep.instance)
+	}
+}
+
+// Periodically re-announces the live connections of the local node and expires
+// the silent instances of the watched clusters.
+func (o *Overlay) presencer(quit chan chan struct{}) {
+	for {
+		select {
+		case done := <-quit:
+			done <- struct{}{}
+			return
+		case <-time.After(config.IrisPresencePeriod):
+			o.lock.RLock()
+			conns := make([]*Connection, 0, len(o.conns))
+			for _, conn := range o.conns {
+				conns = append(conns, conn)
+			}
+			o.lock.RUnlock()
+
+			for _, conn := range conns {
+				select {
+				case <-conn.term:
+					continue
+				default:
+				}
+				if err := conn.announce(opJoin); err != nil {
+					o.logger.Printf("iris: failed to announce presence: %v.", err)
+				}
+				conn.expirePresence()
+			}
+		}
+	}
+}
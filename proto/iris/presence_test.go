@@ -0,0 +1,126 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package iris
+
+import (
+	"crypto/x509"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Presence handler collecting the notifications.
+type presenceCollector struct {
+	joins  chan string
+	leaves chan string
+}
+
+func (p *presenceCollector) HandleJoin(instance string) {
+	p.joins <- instance
+}
+
+func (p *presenceCollector) HandleLeave(instance string) {
+	p.leaves <- instance
+}
+
+// Waits for a presence notification, failing after a timeout.
+func waitPresence(t *testing.T, events chan string, kind string) string {
+	select {
+	case instance := <-events:
+		return instance
+	case <-time.After(time.Second):
+		t.Fatalf("%s notification timed out.", kind)
+	}
+	return ""
+}
+
+// Tests that watchers are notified of the cluster instances joining and leaving.
+func TestPresence(t *testing.T) {
+	// Configure the test, shortening the presence timeouts
+	swapConfigs()
+	defer swapConfigs()
+
+	period, timeout := config.IrisPresencePeriod, config.IrisPresenceTimeout
+	config.IrisPresencePeriod, config.IrisPresenceTimeout = 100*time.Millisecond, 300*time.Millisecond
+	defer func() { config.IrisPresencePeriod, config.IrisPresenceTimeout = period, timeout }()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("presence-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	// Start a cluster member and watch the cluster from another connection
+	member, err := node.Connect("presence-test", &requester{0, 0})
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	watcher, err := node.Connect("presence-test-watcher", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer watcher.Close()
+
+	events := &presenceCollector{make(chan string, 10), make(chan string, 10)}
+	if err := watcher.Watch("presence-test", events); err != nil {
+		t.Fatalf("failed to watch cluster: %v.", err)
+	}
+	if err := watcher.Watch("presence-test", events); err != ErrSubscribed {
+		t.Fatalf("double watch error mismatch: have %v, want %v.", err, ErrSubscribed)
+	}
+	first := waitPresence(t, events.joins, "existing join")
+
+	// Join a new member and make sure it's reported
+	second, err := node.Connect("presence-test", &requester{0, 0})
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer second.Close()
+
+	if join := waitPresence(t, events.joins, "new join"); join == first {
+		t.Fatalf("new instance reported with old id: %v.", join)
+	}
+	if instances, err := watcher.Instances("presence-test"); err != nil || len(instances) != 2 {
+		t.Fatalf("instance list mismatch: have %v/%v, want 2 instances.", instances, err)
+	}
+	// Close the first member and make sure it's reported gone
+	if err := member.Close(); err != nil {
+		t.Fatalf("failed to close iris connection: %v.", err)
+	}
+	if leave := waitPresence(t, events.leaves, "leave"); leave != first {
+		t.Fatalf("departed instance mismatch: have %v, want %v.", leave, first)
+	}
+	// Silent instances should expire, live ones get re-announced
+	watcher.handlePresence(big.NewInt(1), &header{Op: opJoin, Src: 1, Cluster: "presence-test"})
+	waitPresence(t, events.joins, "fake join")
+	if leave := waitPresence(t, events.leaves, "expiry"); leave != instanceId(big.NewInt(1), 1) {
+		t.Fatalf("expired instance mismatch: have %v, want %v.", leave, instanceId(big.NewInt(1), 1))
+	}
+	instances, _ := watcher.Instances("presence-test")
+	if len(instances) != 1 || instances[0] != instanceId(node.scribe.Pastry().Self(), second.id) {
+		t.Fatalf("live instance mismatch: have %v, want %v.", instances, instanceId(node.scribe.Pastry().Self(), second.id))
+	}
+	if err := watcher.Unwatch("presence-test"); err != nil {
+		t.Fatalf("failed to unwatch cluster: %v.", err)
+	}
+}
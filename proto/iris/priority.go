@@ -0,0 +1,66 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the request priorities. Higher priority requests are balanced to the
+// least loaded member of the destination cluster (instead of by the cluster's
+// strategy), and are served ahead of any lower priority ones pending in the
+// member's request queue, so that latency critical control traffic does not get
+// stuck behind bulk requests. Equal priority requests are served in order.
+
+package iris
+
+import (
+	"context"
+	"time"
+)
+
+// Priority level of a request.
+type Priority int8
+
+const (
+	PriorityLow    Priority = -1 // Bulk requests, served after all others
+	PriorityNormal Priority = 0  // Default priority of the requests
+	PriorityHigh   Priority = 1  // Latency critical requests, served first
+
+	priorities = int(PriorityHigh-PriorityLow) + 1 // Number of priority levels
+)
+
+// Retrieves the request queue lane of the priority, clamping unknown levels to
+// the nearest valid one.
+func (p Priority) lane() int {
+	switch {
+	case p < PriorityLow:
+		return 0
+	case p > PriorityHigh:
+		return priorities - 1
+	default:
+		return int(p - PriorityLow)
+	}
+}
+
+// Executes a synchronous request to cluster with the given priority, otherwise
+// behaving the same as Request.
+func (c *Connection) RequestPriority(cluster string, req []byte, timeout time.Duration, prio Priority) ([]byte, error) {
+	return intercept(c.outbound, CallRequest, cluster, req, func(req []byte) ([]byte, error) {
+		return c.retried(context.Background(), func() ([]byte, error) {
+			rep, _, err := c.request(context.Background(), cluster, req, nil, timeout, route{prio: prio})
+			return rep, err
+		})
+	})
+}
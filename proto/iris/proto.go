@@ -37,23 +37,57 @@ const (
 	opRep                 // Cluster reply
 	opPub                 // Topic publish
 	opTun                 // Tunneling request
+	opAck                 // Publish acknowledgement
+	opJoin                // Cluster instance presence announcement
+	opLeave               // Cluster instance departure
+	opProbe               // Cluster presence query of a watcher
+	opPull                // Chunk retrieval of a large request
 )
 
 // Extra headers for the Iris layer.
 type header struct {
 	Op   opcode // Operation code of the message
-	Src  uint64 // Connection id of the sender (requests, tunnel)
+	Src  uint64 // Connection id of the sender (requests, replies, tunnel)
 	Dest uint64 // Connection id of the recipient (direct messages)
 
+	// Optional application metadata (broadcasts, requests, replies and publishes)
+	Metadata Metadata
+
 	// Optional fields for requests and replies
 	ReqId   uint64        // Request/response identifier
 	ReqTime time.Duration // Maximum amount of time spendable on the request
+	ReqPrio Priority      // Priority of the request at the serving member
+	ReqKey  string        // Affinity key pinning the request to a member
+	RepFail failure       // Reason of a request failing unprocessed (replies)
+	RepHint time.Duration // Back-off suggested along with an overload failure
+	RepCode int           // Application failure code of a failed request
+	RepMsg  string        // Application failure message of a failed request
 
 	// Optional fields for tunnels
 	TunId    uint64        // Id of the tunnel being requested
 	TunKey   []byte        // Secret symmetric key of the tunnel
 	TunAddrs []string      // Tunnel listener endpoints
 	TunTime  time.Duration // Maximum time to establish tunnel
+	TunGrace time.Duration // Time allowed to resume a broken tunnel (0 if not resumable)
+
+	// Optional fields for wildcard and partitioned publishes
+	Topic string // Concrete topic of an event relayed to pattern subscribers
+	Part  int    // Partition of an event balanced within a partitioned topic
+
+	// Optional fields for presence notifications
+	Cluster string // Cluster the announced instance is a member of
+
+	// Optional fields for acknowledged publishes
+	AckId uint64 // Publish awaiting delivery acknowledgements (0 if none)
+
+	// Optional fields for dead lettered publishes and broadcasts
+	Letter uint64 // Id of the retained copy to dead letter on failure (0 if none)
+
+	// Optional fields for chunked messages
+	ChunkId  uint64 // Id of the chunked transfer, unique to the sender connection
+	ChunkIdx int    // Position of the chunk within the message
+	ChunkCnt int    // Total number of chunks of the message (0 if not chunked)
+	ChunkSum []byte // SHA-256 checksum of the reassembled payload
 }
 
 // Make sure the header struct is registered with gob.
@@ -71,33 +105,83 @@ func (c *Connection) assemblePacket(head *header, data []byte) *proto.Message {
 	}
 }
 
-// Assembles an application broadcast message. It consists of the bcast opcode
-// and the payload.
-func (c *Connection) assembleBroadcast(msg []byte) *proto.Message {
-	return c.assemblePacket(&header{Op: opBcast}, msg)
+// Assembles an application broadcast message. It consists of the bcast opcode,
+// the optional acknowledgement id and the payload.
+func (c *Connection) assembleBroadcast(ackId uint64, msg []byte) *proto.Message {
+	return c.assemblePacket(&header{Op: opBcast, Src: c.id, AckId: ackId}, msg)
 }
 
 // Assembles an application request message. It consists of the request opcode,
-// the locally unique request id and the payload.
-func (c *Connection) assembleRequest(reqId uint64, req []byte, timeout time.Duration) *proto.Message {
-	return c.assemblePacket(&header{Op: opReq, Src: c.id, ReqId: reqId, ReqTime: timeout}, req)
+// the locally unique request id, the routing preferences and the payload.
+func (c *Connection) assembleRequest(reqId uint64, req []byte, timeout time.Duration, r route) *proto.Message {
+	return c.assemblePacket(&header{Op: opReq, Src: c.id, ReqId: reqId, ReqTime: timeout, ReqPrio: r.prio, ReqKey: r.key}, req)
 }
 
 // Assembles the reply message to an application request. It consists of the
 // reply opcode, the original request's id and the payload itself.
 func (c *Connection) assembleReply(dest uint64, reqId uint64, rep []byte) *proto.Message {
-	return c.assemblePacket(&header{Op: opRep, Dest: dest, ReqId: reqId}, rep)
+	return c.assemblePacket(&header{Op: opRep, Src: c.id, Dest: dest, ReqId: reqId}, rep)
+}
+
+// Assembles the failure notification of an application request, consisting of
+// the reply opcode, the original request's id, the reason of the failure and an
+// optional back-off hint.
+func (c *Connection) assembleFailure(dest uint64, reqId uint64, reason failure, hint time.Duration) *proto.Message {
+	return c.assemblePacket(&header{Op: opRep, Src: c.id, Dest: dest, ReqId: reqId, RepFail: reason, RepHint: hint}, nil)
+}
+
+// Assembles the application failure of a request, consisting of the reply opcode,
+// the original request's id and the failure code and message.
+func (c *Connection) assembleError(dest uint64, reqId uint64, err *RemoteError) *proto.Message {
+	return c.assemblePacket(&header{Op: opRep, Src: c.id, Dest: dest, ReqId: reqId, RepFail: failRemote, RepCode: err.Code, RepMsg: err.Message}, nil)
+}
+
+// Assembles the retrieval of the remaining chunks of a large request, consisting
+// of the pull opcode, the chunked transfer's id and the pulling connection.
+func (c *Connection) assemblePull(dest uint64, chunkId uint64) *proto.Message {
+	return c.assemblePacket(&header{Op: opPull, Src: c.id, Dest: dest, ChunkId: chunkId}, nil)
 }
 
 // Assembles an event message to be published in a topic. It consists of the
-// publish opcode and the payload.
-func (c *Connection) assemblePublish(msg []byte) *proto.Message {
-	return c.assemblePacket(&header{Op: opPub}, msg)
+// publish opcode, the optional acknowledgement id and the payload.
+func (c *Connection) assemblePublish(ackId uint64, msg []byte) *proto.Message {
+	return c.assemblePacket(&header{Op: opPub, Src: c.id, AckId: ackId}, msg)
+}
+
+// Assembles an event message of a topic partition. It consists of the publish
+// opcode, the partition, the optional acknowledgement id and the payload.
+func (c *Connection) assemblePartition(part int, ackId uint64, msg []byte) *proto.Message {
+	return c.assemblePacket(&header{Op: opPub, Src: c.id, Part: part, AckId: ackId}, msg)
+}
+
+// Assembles an event message relayed to the pattern subscribers of one of the
+// topic's roots. It consists of the publish opcode, the concrete topic, the
+// optional acknowledgement id and the payload.
+func (c *Connection) assembleWildcard(topic string, ackId uint64, msg []byte) *proto.Message {
+	return c.assemblePacket(&header{Op: opPub, Src: c.id, Topic: topic, AckId: ackId}, msg)
+}
+
+// Assembles the delivery acknowledgement of a publish. It consists of the ack
+// opcode and the original publish's id.
+func (c *Connection) assembleAck(dest uint64, ackId uint64) *proto.Message {
+	return c.assemblePacket(&header{Op: opAck, Dest: dest, AckId: ackId}, nil)
+}
+
+// Assembles a presence message of a cluster instance or watcher, consisting of
+// the presence opcode, the cluster and the originating connection.
+func (c *Connection) assemblePresence(op opcode, cluster string) *proto.Message {
+	return c.assemblePacket(&header{Op: op, Src: c.id, Cluster: cluster}, nil)
+}
+
+// Assembles the presence announcement of the local instance directed to a single
+// watcher, as an answer to its probe.
+func (c *Connection) assembleAnnounce(dest uint64) *proto.Message {
+	return c.assemblePacket(&header{Op: opJoin, Src: c.id, Dest: dest, Cluster: c.cluster}, nil)
 }
 
 // Assembles a tunneling request message, consisting of the tunneling opcode,
-// local tunnel id, assigned secret key and reachability infos for the reverse
-// stream connection.
+// local tunnel id, assigned secret key, reachability infos for the reverse
+// stream connection and the resumption grace period.
 func (c *Connection) assembleTunnelRequest(tunId uint64, key []byte, addrs []string, timeout time.Duration) *proto.Message {
-	return c.assemblePacket(&header{Op: opTun, Src: c.id, TunId: tunId, TunKey: key, TunAddrs: addrs, TunTime: timeout}, nil)
+	return c.assemblePacket(&header{Op: opTun, Src: c.id, TunId: tunId, TunKey: key, TunAddrs: addrs, TunTime: timeout, TunGrace: c.tunGrace}, nil)
 }
@@ -67,9 +67,7 @@ func testPubSub(t *testing.T, nodes, conns, msgs int) {
 	defer swapConfigs()
 
 	olds := config.BootPorts
-	for i := 0; i < nodes; i++ {
-		config.BootPorts = append(config.BootPorts, 65000+i)
-	}
+	config.BootPorts = append(config.BootPorts, fmt.Sprintf("65000-%d", 65000+nodes-1))
 	defer func() { config.BootPorts = olds }()
 
 	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
@@ -156,3 +154,115 @@ func testPubSub(t *testing.T, nodes, conns, msgs int) {
 		}
 	}
 }
+
+// Tests that pull mode subscriptions only receive as many events as credited.
+func TestPubSubPull(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	topic := "pubsub-test-topic-pull"
+
+	// Boot a single iris node with a pull and a push subscriber
+	node := New("pubsub-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := node.Shutdown(); err != nil {
+			t.Fatalf("failed to terminate iris node: %v.", err)
+		}
+	}()
+	conn, err := node.Connect("pubsub-test-pull", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer conn.Close()
+
+	pusher, puller := &subscriber{make(chan []byte, 100)}, &subscriber{make(chan []byte, 100)}
+	if err := conn.Credit(topic, 1); err != ErrNotSubscribed {
+		t.Fatalf("credit error mismatch: have %v, want %v.", err, ErrNotSubscribed)
+	}
+	if err := conn.SubscribePull(topic, puller); err != nil {
+		t.Fatalf("failed to subscribe in pull mode: %v.", err)
+	}
+	if err := conn.Credit(topic, 10); err != nil {
+		t.Fatalf("failed to grant credits: %v.", err)
+	}
+	push, err := node.Connect("pubsub-test-push", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer push.Close()
+
+	if err := push.Subscribe(topic, pusher); err != nil {
+		t.Fatalf("failed to subscribe in push mode: %v.", err)
+	}
+	if err := push.Credit(topic, 1); err != ErrPushMode {
+		t.Fatalf("credit error mismatch: have %v, want %v.", err, ErrPushMode)
+	}
+	// Publish more events than credited and verify the limits
+	for i := 0; i < 50; i++ {
+		if err := conn.Publish(topic, []byte{byte(i)}); err != nil {
+			t.Fatalf("failed to publish message: %v.", err)
+		}
+	}
+	time.Sleep(250 * time.Millisecond)
+	if n := len(pusher.msgs); n != 50 {
+		t.Fatalf("push delivery count mismatch: have %d, want %d.", n, 50)
+	}
+	if n := len(puller.msgs); n != 10 {
+		t.Fatalf("pull delivery count mismatch: have %d, want %d.", n, 10)
+	}
+}
+
+// Tests that acknowledged publishes wait for the requested number of deliveries.
+func TestPubSubAck(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	topic := "pubsub-test-topic-ack"
+
+	// Boot a single iris node with a literal and a pattern subscriber
+	node := New("pubsub-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := node.Shutdown(); err != nil {
+			t.Fatalf("failed to terminate iris node: %v.", err)
+		}
+	}()
+	conn, err := node.Connect("pubsub-test-ack", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer conn.Close()
+
+	if err := conn.PublishAck(topic, []byte{0}, 1, 100*time.Millisecond); err != ErrTimeout {
+		t.Fatalf("unacknowledged publish error mismatch: have %v, want %v.", err, ErrTimeout)
+	}
+	literal, pattern := &subscriber{make(chan []byte, 100)}, &subscriber{make(chan []byte, 100)}
+	if err := conn.Subscribe(topic+"/event", literal); err != nil {
+		t.Fatalf("failed to subscribe to the topic: %v.", err)
+	}
+	if err := conn.Subscribe(topic+"/#", pattern); err != nil {
+		t.Fatalf("failed to subscribe to the pattern: %v.", err)
+	}
+	// Both subscriptions should acknowledge, but no more
+	if err := conn.PublishAck(topic+"/event", []byte{1}, 2, time.Second); err != nil {
+		t.Fatalf("failed to publish with acknowledgements: %v.", err)
+	}
+	if err := conn.PublishAck(topic+"/event", []byte{2}, 3, 250*time.Millisecond); err != ErrTimeout {
+		t.Fatalf("over-acknowledged publish error mismatch: have %v, want %v.", err, ErrTimeout)
+	}
+	if n := len(literal.msgs); n != 2 {
+		t.Fatalf("literal event count mismatch: have %d, want %d.", n, 2)
+	}
+	if n := len(pattern.msgs); n != 2 {
+		t.Fatalf("pattern event count mismatch: have %d, want %d.", n, 2)
+	}
+}
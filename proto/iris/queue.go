@@ -0,0 +1,270 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the per target sub-queues of a connection. Inbound work is
+// grouped by the cluster, topic or tunnel it belongs to, each group progressing
+// independently on the shared worker pool with a capped concurrency, so that a
+// stalled tunnel setup or a slow topic handler cannot starve the others (e.g.
+// the replies of unrelated requests).
+//
+// The application facing queues (requests, broadcasts and topic events) may be
+// bounded via the handler limits of the connection, in which case overflowing
+// work is held back, rejected or evicts the oldest pending one. Pending tasks
+// are kept in separate lanes per priority, higher priority ones being dequeued
+// (and surviving evictions) first.
+
+package iris
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/container/queue"
+	"github.com/karalabe/iris/pool"
+)
+
+// Sub-queue names of the connection scoped work.
+const (
+	queueBroadcast = "broadcast"
+	queueRequest   = "request"
+	queueReply     = "reply"
+	queuePresence  = "presence"
+)
+
+// Pending tasks of a single target, the number of them currently scheduled into
+// the worker pool and the maximum allowed to run concurrently.
+type subQueue struct {
+	tasks [priorities]*queue.Queue // Pending tasks, one lane per priority (lazy)
+	size  int
+	busy  int
+	limit int
+	freed chan struct{} // Closed when a pending task is dequeued (blocked producers)
+}
+
+// Pending task of a sub-queue, along with its priority and the notification to
+// run if the task is dropped due to an overflow (nil if none).
+type queued struct {
+	run  pool.Task
+	prio Priority
+	drop func()
+}
+
+// Inserts a task at the end of its priority lane.
+func (q *subQueue) push(task *queued) {
+	lane := task.prio.lane()
+	if q.tasks[lane] == nil {
+		q.tasks[lane] = queue.New()
+	}
+	q.tasks[lane].Push(task)
+	q.size++
+}
+
+// Retrieves the oldest task of the highest priority non-empty lane.
+func (q *subQueue) pop() *queued {
+	for lane := priorities - 1; lane >= 0; lane-- {
+		if q.tasks[lane] != nil && !q.tasks[lane].Empty() {
+			q.size--
+			return q.tasks[lane].Pop().(*queued)
+		}
+	}
+	return nil
+}
+
+// Retrieves the oldest task of the lowest priority non-empty lane, unless it has
+// a higher priority than prio (nil in that case).
+func (q *subQueue) evict(prio Priority) *queued {
+	for lane := 0; lane <= prio.lane(); lane++ {
+		if q.tasks[lane] != nil && !q.tasks[lane].Empty() {
+			q.size--
+			return q.tasks[lane].Pop().(*queued)
+		}
+	}
+	return nil
+}
+
+// Generates the sub-queue name of a (prefixed) topic, merging all the splits.
+func topicQueue(topic string) string {
+	return "topic/" + topic[strings.IndexByte(topic, '-')+1:]
+}
+
+// Generates the sub-queue name of an inbound tunnel, each getting its own.
+func tunnelQueue(conn uint64, id uint64) string {
+	return fmt.Sprintf("tunnel/%d/%d", conn, id)
+}
+
+// Generates the sub-queue name of an ordered topic, executed serially.
+func orderedQueue(topic string) string {
+	return "ordered/" + topic
+}
+
+// Schedules a task into the named sub-queue, passing it on to the worker pool if
+// the queue has spare concurrency, or holding it back otherwise.
+func (c *Connection) schedule(name string, task pool.Task) {
+	c.enqueue(name, c.concurrency(name), &queued{run: task})
+}
+
+// Schedules a task with the given priority into the named sub-queue, running drop
+// instead if the task is rejected or evicted by the overflow policy of a bounded
+// queue.
+func (c *Connection) admit(name string, prio Priority, task pool.Task, drop func()) {
+	c.enqueue(name, c.concurrency(name), &queued{run: task, prio: prio, drop: drop})
+}
+
+// Schedules a task into the named sub-queue, running its tasks one at a time in
+// the order they were scheduled.
+func (c *Connection) serialize(name string, task pool.Task) {
+	c.enqueue(name, 1, &queued{run: task})
+}
+
+// Retrieves the maximum number of concurrent tasks of a sub-queue.
+func (c *Connection) concurrency(name string) int {
+	if c.limits != nil {
+		switch {
+		case name == queueRequest && c.limits.Requests > 0:
+			return c.limits.Requests
+		case name == queueBroadcast && c.limits.Broadcasts > 0:
+			return c.limits.Broadcasts
+		}
+	}
+	return config.IrisQueueThreads
+}
+
+// Retrieves the maximum number of pending tasks of a sub-queue, zero if it is
+// unbounded. Only the application handler queues are bounded.
+func (c *Connection) bound(name string) int {
+	if c.limits == nil {
+		return 0
+	}
+	if handlerQueue(name) {
+		return c.limits.Queued
+	}
+	return 0
+}
+
+// Checks whether a sub-queue holds application handler invocations (requests,
+// broadcasts and topic events), which are the ones bounded and rate limited.
+func handlerQueue(name string) bool {
+	return name == queueRequest || name == queueBroadcast || strings.HasPrefix(name, "topic/")
+}
+
+// Schedules a task into the named sub-queue, creating it with the given limit of
+// concurrent tasks if not yet existing. If the queue is full, the overflow
+// policy of the connection is applied. Evictions never displace a task of higher
+// priority, rejecting the new one instead. Inbound work arriving during a drain
+// or exceeding the handler rate limit is turned away the same way.
+func (c *Connection) enqueue(name string, limit int, task *queued) {
+	if inbound(name) && c.draining() {
+		if task.drop != nil {
+			task.drop()
+		}
+		return
+	}
+	if handlerQueue(name) && !c.rateHand.take() {
+		c.overflow(task.drop)
+		return
+	}
+	c.queueLock.Lock()
+	for {
+		q, ok := c.queues[name]
+		if !ok {
+			q = &subQueue{limit: limit}
+			c.queues[name] = q
+		}
+		if q.busy < q.limit {
+			q.busy++
+			c.workers.Schedule(c.runner(name, q, task.run))
+			c.queueLock.Unlock()
+			return
+		}
+		if bound := c.bound(name); bound == 0 || q.size < bound {
+			q.push(task)
+			c.queueLock.Unlock()
+			return
+		}
+		// Queue full, apply the overflow policy
+		switch c.limits.Overflow {
+		case OverflowReject:
+			c.queueLock.Unlock()
+			c.overflow(task.drop)
+			return
+
+		case OverflowDropOldest:
+			old := q.evict(task.prio)
+			if old == nil {
+				old = task
+			} else {
+				q.push(task)
+			}
+			c.queueLock.Unlock()
+			c.overflow(old.drop)
+			return
+
+		default:
+			// Wait for a pending task to be dequeued and retry
+			if q.freed == nil {
+				q.freed = make(chan struct{})
+			}
+			freed := q.freed
+			c.queueLock.Unlock()
+
+			select {
+			case <-freed:
+			case <-c.term:
+				c.overflow(task.drop)
+				return
+			}
+			c.queueLock.Lock()
+		}
+	}
+}
+
+// Accounts for a task dropped due to a queue overflow, notifying its owner.
+func (c *Connection) overflow(drop func()) {
+	c.carrier().count(MetricQueueDropped)
+	if drop != nil {
+		drop()
+	}
+}
+
+// Wraps a task of a sub-queue so that on completion the next pending one in the
+// same queue is scheduled to the back of the worker pool, keeping the different
+// targets interleaved.
+func (c *Connection) runner(name string, q *subQueue, task pool.Task) pool.Task {
+	return func() {
+		defer func() {
+			c.queueLock.Lock()
+			defer c.queueLock.Unlock()
+
+			if q.size > 0 {
+				c.workers.Schedule(c.runner(name, q, q.pop().run))
+				if q.freed != nil {
+					close(q.freed)
+					q.freed = nil
+				}
+				return
+			}
+			if q.busy--; q.busy == 0 {
+				delete(c.queues, name)
+				c.settle()
+			}
+		}()
+		task()
+	}
+}
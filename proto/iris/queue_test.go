@@ -0,0 +1,189 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package iris
+
+import (
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/pool"
+)
+
+// Tests that a stalled target cannot hold up the tasks of other ones.
+func TestSubQueues(t *testing.T) {
+	conn := &Connection{
+		workers: pool.NewThreadPool(config.IrisHandlerThreads),
+		queues:  make(map[string]*subQueue),
+	}
+	conn.workers.Start()
+	defer conn.workers.Terminate(true)
+
+	// Stall a topic with more handlers than the whole pool can run
+	stall := make(chan struct{})
+	for i := 0; i < 2*config.IrisHandlerThreads; i++ {
+		conn.schedule(topicQueue(topicPrefixes[i%len(topicPrefixes)]+"slow"), func() { <-stall })
+	}
+	// Make sure an unrelated reply gets through
+	done := make(chan struct{})
+	conn.schedule(queueReply, func() { close(done) })
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("reply blocked by stalled topic.")
+	}
+	// Release the stalled topic and ensure all its tasks complete
+	close(stall)
+	for i := 0; ; i++ {
+		conn.queueLock.Lock()
+		left := len(conn.queues)
+		conn.queueLock.Unlock()
+		if left == 0 {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("sub-queues not drained: %d left.", left)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Tests the overflow policies of the bounded handler queues.
+func TestSubQueueOverflow(t *testing.T) {
+	for _, policy := range []Overflow{OverflowBlock, OverflowReject, OverflowDropOldest} {
+		conn := &Connection{
+			iris:    &Overlay{},
+			workers: pool.NewThreadPool(config.IrisHandlerThreads),
+			queues:  make(map[string]*subQueue),
+			limits:  &HandlerLimits{Requests: 1, Queued: 2, Overflow: policy},
+			term:    make(chan struct{}),
+		}
+		conn.workers.Start()
+
+		// Fill up the request queue with a stalled handler and pending work
+		stall := make(chan struct{})
+		ran, dropped := make(chan int, 4), make(chan int, 4)
+		for i := 0; i < 3; i++ {
+			id := i
+			conn.admit(queueRequest, PriorityNormal, func() { <-stall; ran <- id }, func() { dropped <- id })
+		}
+		// Overflow the queue and check the policy
+		admitted := make(chan struct{})
+		go func() {
+			conn.admit(queueRequest, PriorityNormal, func() { ran <- 3 }, func() { dropped <- 3 })
+			close(admitted)
+		}()
+		switch policy {
+		case OverflowBlock:
+			select {
+			case <-admitted:
+				t.Fatalf("overflowing task admitted into full queue.")
+			case <-time.After(100 * time.Millisecond):
+			}
+		case OverflowReject:
+			if id := <-dropped; id != 3 {
+				t.Fatalf("rejected task mismatch: have %d, want 3.", id)
+			}
+		case OverflowDropOldest:
+			if id := <-dropped; id != 1 {
+				t.Fatalf("evicted task mismatch: have %d, want 1.", id)
+			}
+		}
+		close(stall)
+		<-admitted
+
+		// Make sure the surviving tasks all run in order
+		var want []int
+		switch policy {
+		case OverflowBlock:
+			want = []int{0, 1, 2, 3}
+		case OverflowReject:
+			want = []int{0, 1, 2}
+		case OverflowDropOldest:
+			want = []int{0, 2, 3}
+		}
+		for _, id := range want {
+			select {
+			case have := <-ran:
+				if have != id {
+					t.Fatalf("policy %d: task order mismatch: have %d, want %d.", policy, have, id)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("policy %d: task %d didn't run.", policy, id)
+			}
+		}
+		if len(dropped) != 0 {
+			t.Fatalf("policy %d: extra tasks dropped: %d.", policy, len(dropped))
+		}
+		conn.workers.Terminate(true)
+	}
+}
+
+// Tests that pending tasks are dequeued by priority, and that evictions spare the
+// higher priority ones.
+func TestSubQueuePriority(t *testing.T) {
+	conn := &Connection{
+		iris:    &Overlay{},
+		workers: pool.NewThreadPool(config.IrisHandlerThreads),
+		queues:  make(map[string]*subQueue),
+		limits:  &HandlerLimits{Requests: 1, Queued: 3, Overflow: OverflowDropOldest},
+		term:    make(chan struct{}),
+	}
+	conn.workers.Start()
+	defer conn.workers.Terminate(true)
+
+	// Stall the request queue and fill it up with mixed priority work
+	stall := make(chan struct{})
+	ran, dropped := make(chan int, 6), make(chan int, 6)
+	conn.admit(queueRequest, PriorityNormal, func() { <-stall; ran <- 0 }, func() { dropped <- 0 })
+
+	prios := []Priority{PriorityLow, PriorityNormal, PriorityHigh, PriorityHigh, PriorityLow}
+	for i, prio := range prios {
+		id := i + 1
+		conn.admit(queueRequest, prio, func() { ran <- id }, func() { dropped <- id })
+	}
+	// The first low priority task should be evicted, then the new low one rejected
+	for _, id := range []int{1, 5} {
+		select {
+		case have := <-dropped:
+			if have != id {
+				t.Fatalf("dropped task mismatch: have %d, want %d.", have, id)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("task %d not dropped.", id)
+		}
+	}
+	close(stall)
+
+	// Make sure the surviving tasks run by priority, in order within each
+	for _, id := range []int{0, 3, 4, 2} {
+		select {
+		case have := <-ran:
+			if have != id {
+				t.Fatalf("task order mismatch: have %d, want %d.", have, id)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("task %d didn't run.", id)
+		}
+	}
+	if len(dropped) != 0 {
+		t.Fatalf("extra tasks dropped: %d.", len(dropped))
+	}
+}
@@ -0,0 +1,75 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the rate limiting of a connection. Each limited class of operations
+// has a token bucket refilled at the configured rate, holding at most a second's
+// worth of tokens (but at least one) to allow short bursts. Outbound operations
+// exceeding their rate fail with ErrRateLimited, inbound handler invocations are
+// shed the same way as queue overflows (requests rejected as overloaded).
+
+package iris
+
+import (
+	"sync"
+	"time"
+)
+
+// Token bucket limiting the rate of a class of operations.
+type bucket struct {
+	rate   float64   // Tokens added per second
+	burst  float64   // Maximum number of tokens held
+	tokens float64   // Tokens currently available
+	last   time.Time // Time of the last refill
+	lock   sync.Mutex
+}
+
+// Creates a full token bucket of the given rate, or nil if unlimited.
+func newBucket(rate float64) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	return &bucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Takes a token from the bucket if one is available, reporting whether it did.
+// Nil buckets are unlimited.
+func (b *bucket) take() bool {
+	if b == nil {
+		return true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,102 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package iris
+
+import (
+	"crypto/x509"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Tests that token buckets allow bursts up to their rate and refill over time.
+func TestBucket(t *testing.T) {
+	if b := newBucket(0); b != nil || !b.take() {
+		t.Fatalf("unlimited bucket should always allow.")
+	}
+	b := newBucket(10)
+	for i := 0; i < 10; i++ {
+		if !b.take() {
+			t.Fatalf("burst token %d denied.", i)
+		}
+	}
+	if b.take() {
+		t.Fatalf("token granted beyond the burst.")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if !b.take() {
+		t.Fatalf("token not refilled.")
+	}
+}
+
+// Tests that outbound and inbound operations are rate limited.
+func TestRateLimits(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("ratelimit-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	handler := &sleeper{}
+	server, err := node.Connect("ratelimit-server", handler, WithRateLimits(RateLimits{Handlers: 2}))
+	if err != nil {
+		t.Fatalf("failed to connect server to the iris overlay: %v.", err)
+	}
+	defer server.Close()
+
+	client, err := node.Connect("ratelimit-client", nil, WithRateLimits(RateLimits{Requests: 5, Publishes: 1}))
+	if err != nil {
+		t.Fatalf("failed to connect client to the iris overlay: %v.", err)
+	}
+	defer client.Close()
+
+	// Outbound publishes beyond the rate should fail locally
+	if err := client.Publish("ratelimit-topic", nil); err != nil {
+		t.Fatalf("failed to publish within rate: %v.", err)
+	}
+	if err := client.Publish("ratelimit-topic", nil); err != ErrRateLimited {
+		t.Fatalf("publish error mismatch: have %v, want %v.", err, ErrRateLimited)
+	}
+	// Inbound requests beyond the handler rate should be rejected
+	served, rejected := 0, 0
+	for i := 0; i < 5; i++ {
+		_, err := client.Request("ratelimit-server", []byte{byte(i)}, time.Second)
+		switch err.(type) {
+		case nil:
+			served++
+		case *OverloadError:
+			rejected++
+		default:
+			t.Fatalf("request %d: unexpected failure: %v.", i, err)
+		}
+	}
+	if served != 2 || rejected != 3 || atomic.LoadInt32(&handler.calls) != 2 {
+		t.Fatalf("handler rate mismatch: served %d, rejected %d, calls %d; want 2, 3, 2.", served, rejected, handler.calls)
+	}
+	// Outbound requests beyond the rate should fail locally
+	if _, err := client.Request("ratelimit-server", nil, time.Second); err != ErrRateLimited {
+		t.Fatalf("request error mismatch: have %v, want %v.", err, ErrRateLimited)
+	}
+}
@@ -0,0 +1,247 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the automatic reconnection of connections to a restarted carrier. Once
+// opted into, a connection watches its overlay and if it terminates, re-dials a
+// new one with exponential backoff, re-registers the cluster membership and all
+// live subscriptions (keeping the mode and remaining credits of the pull ones)
+// and watches, then resumes. In-flight requests fail with ErrDisconnected, and
+// the state transitions are reported to the connection handler if it implements
+// StateHandler. Durable subscriptions, tunnels and chunked transfers are not
+// carried over.
+
+package iris
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+var ErrDisconnected = errors.New("carrier disconnected")
+
+// Dialer of the carrier a connection re-establishes itself through. It is called
+// by every reconnecting connection, so it should hand out a shared, booted overlay
+// instead of creating one per call.
+type Dialer func() (*Overlay, error)
+
+// Backoff policy of the carrier re-dials of a reconnecting connection.
+type ReconnectPolicy struct {
+	Attempts   int           // Maximum number of re-dials before closing (zero for unlimited)
+	Backoff    time.Duration // Delay before the first re-dial, doubled after each
+	MaxBackoff time.Duration // Upper limit of the re-dial delay (zero for none)
+}
+
+// States of a reconnecting connection.
+type ConnState int
+
+const (
+	StateDisconnected ConnState = iota // Carrier lost, operations failing
+	StateReconnecting                  // Re-dialing the carrier
+	StateRestored                      // Carrier re-established, membership and subscriptions restored
+)
+
+// Returns the textual form of the connection state.
+func (s ConnState) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateRestored:
+		return "restored"
+	default:
+		return "unknown"
+	}
+}
+
+// Handler notified of the state transitions of a reconnecting connection,
+// optionally implemented by the connection handlers.
+type StateHandler interface {
+	// Handles a state transition of the connection, along with the failure of the
+	// previous re-dial when reconnecting (nil for the first attempt).
+	HandleState(state ConnState, err error)
+}
+
+// Re-establishes the connection through the dialer if its carrier terminates,
+// re-dialing according to the policy. The connection is closed if all re-dials
+// fail.
+func WithReconnect(dial Dialer, policy ReconnectPolicy) ConnectionOption {
+	return func(c *Connection) {
+		c.redial = &redialer{dial: dial, policy: policy}
+	}
+}
+
+// Reconnection state of a connection.
+type redialer struct {
+	dial   Dialer          // Dialer of the replacement carriers
+	policy ReconnectPolicy // Backoff policy of the re-dials
+}
+
+// Watches the carrier of the connection, reconnecting whenever it terminates till
+// the connection is closed.
+func (c *Connection) reconnector() {
+	for {
+		select {
+		case <-c.term:
+			return
+		case <-c.carrier().Done():
+		}
+		c.notifyState(StateDisconnected, nil)
+		c.disconnect()
+
+		if !c.reconnect() {
+			c.Close()
+			return
+		}
+		c.notifyState(StateRestored, nil)
+	}
+}
+
+// Re-dials the carrier with backoff till it succeeds, all attempts fail or the
+// connection is closed, rebinding the connection to the new overlay.
+func (c *Connection) reconnect() bool {
+	var err error
+	for attempt := 1; c.redial.policy.Attempts == 0 || attempt <= c.redial.policy.Attempts; attempt++ {
+		select {
+		case <-c.term:
+			return false
+		case <-time.After(backoff(c.redial.policy.Backoff, c.redial.policy.MaxBackoff, attempt)):
+		}
+		c.notifyState(StateReconnecting, err)
+
+		var overlay *Overlay
+		if overlay, err = c.redial.dial(); err != nil {
+			continue
+		}
+		if err = c.rebind(overlay); err != nil {
+			continue
+		}
+		return true
+	}
+	c.carrier().logger.Printf("iris: reconnect failed: %v.", err)
+	return false
+}
+
+// Fails the in-flight requests of a connection which lost its carrier.
+func (c *Connection) disconnect() {
+	c.reqLock.RLock()
+	defer c.reqLock.RUnlock()
+
+	for _, ch := range c.reqFail {
+		select {
+		case ch <- ErrDisconnected:
+		default:
+		}
+	}
+}
+
+// Registers the connection with a new carrier, re-joining its cluster and
+// re-subscribing its topics, patterns and watches. The connection keeps its id,
+// and a failed rebind is undone before returning, so a retry starts afresh.
+func (c *Connection) rebind(o *Overlay) error {
+	o.lock.Lock()
+	o.conns[c.id] = c
+	o.lock.Unlock()
+
+	c.irisLock.Lock()
+	c.iris = o
+	c.irisLock.Unlock()
+
+	// Collect the channels to re-join: cluster, topics, pattern roots and presence
+	topics := make([]string, 0, len(clusterPrefixes))
+	for _, prefix := range clusterPrefixes {
+		topics = append(topics, prefix+c.cluster)
+	}
+	pulls := []string{}
+
+	c.subLock.RLock()
+	for topic, _ := range c.subLive {
+		topics = append(topics, topic)
+		if strings.HasPrefix(topic, topicPrefixes[0]) {
+			pulls = append(pulls, strings.TrimPrefix(topic, topicPrefixes[0]))
+		}
+	}
+	roots := make(map[string]struct{})
+	for pattern, _ := range c.subWild {
+		roots[patternRoot(pattern)] = struct{}{}
+	}
+	c.subLock.RUnlock()
+
+	for root, _ := range roots {
+		for _, prefix := range wildcardPrefixes {
+			topics = append(topics, prefix+root)
+		}
+	}
+	topics = append(topics, presencePrefix+c.cluster)
+
+	c.presLock.RLock()
+	watched := make([]string, 0, len(c.presWatch))
+	for cluster, _ := range c.presWatch {
+		watched = append(watched, cluster)
+		if cluster != c.cluster {
+			topics = append(topics, presencePrefix+cluster)
+		}
+	}
+	c.presLock.RUnlock()
+
+	// Subscribe to all of them, restoring the allowances of the pull topics
+	for i, topic := range topics {
+		if err := o.subscribe(c.id, topic); err != nil {
+			c.unbind(o, topics[:i], pulls)
+			return err
+		}
+	}
+	for _, topic := range pulls {
+		o.credit(topic)
+	}
+	// Announce the instance and query the watched clusters
+	if err := c.announce(opJoin); err != nil {
+		c.unbind(o, topics, pulls)
+		return err
+	}
+	for _, cluster := range watched {
+		if err := o.scribe.Publish(presencePrefix+cluster, c.assemblePresence(opProbe, cluster)); err != nil {
+			c.unbind(o, topics, pulls)
+			return err
+		}
+	}
+	return nil
+}
+
+// Undoes a partial rebind, removing the connection and its subscriptions made so
+// far from the carrier.
+func (c *Connection) unbind(o *Overlay, topics []string, pulls []string) {
+	for _, topic := range topics {
+		o.unsubscribe(c.id, topic)
+	}
+	for _, topic := range pulls {
+		o.credit(topic)
+	}
+	o.lock.Lock()
+	delete(o.conns, c.id)
+	o.lock.Unlock()
+}
+
+// Notifies the connection handler of a state transition, if it handles them.
+func (c *Connection) notifyState(state ConnState, err error) {
+	if handler, ok := c.handler.(StateHandler); ok {
+		handler.HandleState(state, err)
+	}
+}
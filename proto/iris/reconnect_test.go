@@ -0,0 +1,223 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package iris
+
+import (
+	"bytes"
+	"crypto/x509"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Connection handler for the reconnection tests, echoing requests and recording
+// the state transitions.
+type restorer struct {
+	states chan ConnState
+}
+
+func (r *restorer) HandleBroadcast(msg []byte) {
+	panic("Broadcast passed to request handler")
+}
+
+func (r *restorer) HandleRequest(req []byte, timeout time.Duration) ([]byte, error) {
+	return req, nil
+}
+
+func (r *restorer) HandleTunnel(tun *Tunnel) {
+	panic("Inbound tunnel on request handler")
+}
+
+func (r *restorer) HandleState(state ConnState, err error) {
+	r.states <- state
+}
+
+// Tests that a reconnecting connection survives the termination of its carrier,
+// with its cluster membership and subscriptions restored on the new one.
+func TestReconnect(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	first := New("reconnect-test", key)
+	if _, err := first.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	// Create a dialer booting a single replacement carrier
+	var current *Overlay
+	var lock sync.Mutex
+	dial := func() (*Overlay, error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if current == nil {
+			node := New("reconnect-test", key)
+			if _, err := node.Boot(); err != nil {
+				return nil, err
+			}
+			current = node
+		}
+		return current, nil
+	}
+	defer func() {
+		if current != nil {
+			current.Shutdown()
+		}
+	}()
+	// Connect to the carrier and subscribe in both push and pull mode
+	handler := &restorer{states: make(chan ConnState, 16)}
+	server, err := first.Connect("reconnect-server", handler, WithReconnect(dial, ReconnectPolicy{Backoff: 10 * time.Millisecond}))
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer server.Close()
+
+	push := &subscriber{msgs: make(chan []byte, 16)}
+	if err := server.Subscribe("reconnect-push", push); err != nil {
+		t.Fatalf("failed to subscribe in push mode: %v.", err)
+	}
+	pull := &subscriber{msgs: make(chan []byte, 16)}
+	if err := server.SubscribePull("reconnect-pull", pull); err != nil {
+		t.Fatalf("failed to subscribe in pull mode: %v.", err)
+	}
+	if err := server.Credit("reconnect-pull", 1); err != nil {
+		t.Fatalf("failed to grant credits: %v.", err)
+	}
+	// Keep using the connection while its carrier is swapped beneath it
+	quit, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-quit:
+				return
+			default:
+				server.Publish("reconnect-noise", []byte("noise"))
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+	// Kill the carrier and wait for the connection to be restored
+	if err := first.Shutdown(); err != nil {
+		t.Fatalf("failed to terminate iris overlay: %v.", err)
+	}
+	for _, want := range []ConnState{StateDisconnected, StateReconnecting, StateRestored} {
+		select {
+		case state := <-handler.states:
+			if state != want {
+				t.Fatalf("state mismatch: have %v, want %v.", state, want)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("state %v not reported.", want)
+		}
+	}
+	close(quit)
+	<-done
+
+	if server.carrier() != current {
+		t.Fatalf("carrier not swapped.")
+	}
+	// Make sure requests reach the restored member
+	client, err := current.Connect("reconnect-client", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the new iris overlay: %v.", err)
+	}
+	defer client.Close()
+
+	if rep, err := client.Request("reconnect-server", []byte("ping"), time.Second); err != nil {
+		t.Fatalf("failed to request restored member: %v.", err)
+	} else if !bytes.Equal(rep, []byte("ping")) {
+		t.Fatalf("reply mismatch: have %s, want %s.", rep, "ping")
+	}
+	// Make sure the subscriptions are restored with their modes and credits
+	time.Sleep(100 * time.Millisecond)
+	if err := client.Publish("reconnect-push", []byte("push")); err != nil {
+		t.Fatalf("failed to publish push event: %v.", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := client.Publish("reconnect-pull", []byte("pull")); err != nil {
+			t.Fatalf("failed to publish pull event: %v.", err)
+		}
+	}
+	select {
+	case msg := <-push.msgs:
+		if !bytes.Equal(msg, []byte("push")) {
+			t.Fatalf("push event mismatch: have %s, want %s.", msg, "push")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("push event not delivered after reconnect.")
+	}
+	select {
+	case <-pull.msgs:
+	case <-time.After(time.Second):
+		t.Fatalf("pull event not delivered after reconnect.")
+	}
+	select {
+	case <-pull.msgs:
+		t.Fatalf("pull event delivered beyond the credits.")
+	case <-time.After(250 * time.Millisecond):
+	}
+}
+
+// Tests that a failed rebind leaves no registration or subscription behind on the
+// carrier, so that a retry does not duplicate them.
+func TestReconnectUndo(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	live := New("reconnect-test", key)
+	if _, err := live.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer live.Shutdown()
+
+	conn, err := live.Connect("reconnect-undo", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer conn.Close()
+	if err := conn.Subscribe("reconnect-topic", &subscriber{msgs: make(chan []byte, 1)}); err != nil {
+		t.Fatalf("failed to subscribe: %v.", err)
+	}
+	// Rebind onto a carrier already subscribed to the presence channel, failing midway
+	dead := New("reconnect-test", key)
+	if err := dead.scribe.Subscribe(presencePrefix + "reconnect-undo"); err != nil {
+		t.Fatalf("failed to subscribe carrier: %v.", err)
+	}
+	if err := conn.rebind(dead); err == nil {
+		t.Fatalf("rebind onto a conflicting carrier succeeded.")
+	}
+	dead.lock.RLock()
+	defer dead.lock.RUnlock()
+
+	if _, ok := dead.conns[conn.id]; ok {
+		t.Fatalf("connection left registered after failed rebind.")
+	}
+	for topic, ids := range dead.subLive {
+		for _, id := range ids {
+			if id == conn.id {
+				t.Fatalf("subscription to %s left behind after failed rebind.", topic)
+			}
+		}
+	}
+}
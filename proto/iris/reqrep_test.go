@@ -22,13 +22,17 @@ package iris
 import (
 	"bytes"
 	"crypto/x509"
+	"errors"
 	"fmt"
+	"math/big"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto"
+	"github.com/karalabe/iris/proto/pastry"
 )
 
 // Connection handler for the req/rep tests.
@@ -41,11 +45,11 @@ func (r *requester) HandleBroadcast(msg []byte) {
 	panic("Broadcast passed to request handler")
 }
 
-func (r *requester) HandleRequest(req []byte, timeout time.Duration) []byte {
+func (r *requester) HandleRequest(req []byte, timeout time.Duration) ([]byte, error) {
 	if r.self != int(req[0]) {
 		atomic.AddUint32(&r.remote, 1)
 	}
-	return req
+	return req, nil
 }
 
 func (r *requester) HandleTunnel(tun *Tunnel) {
@@ -80,9 +84,7 @@ func testReqRep(t *testing.T, nodes, conns, reqs int) {
 	defer swapConfigs()
 
 	olds := config.BootPorts
-	for i := 0; i < nodes; i++ {
-		config.BootPorts = append(config.BootPorts, 65000+i)
-	}
+	config.BootPorts = append(config.BootPorts, fmt.Sprintf("65000-%d", 65000+nodes-1))
 	defer func() { config.BootPorts = olds }()
 
 	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
@@ -161,3 +163,357 @@ func testReqRep(t *testing.T, nodes, conns, reqs int) {
 		}
 	}
 }
+
+// Tests that requests reported lost in transit fail without waiting for the timeout.
+func TestReqRepFastFail(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	config.BootPorts = append(config.BootPorts, "65000")
+	defer func() { config.BootPorts = olds }()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("reqrep-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	conn, err := node.Connect("reqrep-test-fail", &requester{0, 0})
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer conn.Close()
+
+	// Request a non-existent cluster and report the request lost
+	fail := &pastry.ForwardError{Reason: pastry.ErrLinkDown, Hop: big.NewInt(1), Dest: big.NewInt(2)}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		node.HandleFailure(&proto.Message{Head: proto.Header{Meta: &header{Op: opReq, Src: conn.id, ReqId: 0}}}, fail)
+	}()
+	start := time.Now()
+	if _, err := conn.Request("reqrep-test-missing", []byte{0x00}, 5*time.Second); err != fail {
+		t.Fatalf("request error mismatch: have %v, want %v.", err, fail)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("request failed slowly: have %v, want < 1s.", elapsed)
+	}
+}
+
+// Request handler failing the first few requests by not replying.
+type flaky struct {
+	fails int32 // Number of requests to leave unanswered
+	calls int32 // Number of requests received
+}
+
+func (f *flaky) HandleBroadcast(msg []byte) {
+	panic("Broadcast passed to request handler")
+}
+
+func (f *flaky) HandleRequest(req []byte, timeout time.Duration) ([]byte, error) {
+	if atomic.AddInt32(&f.calls, 1) <= f.fails {
+		return nil, nil
+	}
+	return req, nil
+}
+
+func (f *flaky) HandleTunnel(tun *Tunnel) {
+	panic("Inbound tunnel on request handler")
+}
+
+// Tests that requests are retried according to the connection's retry policy.
+func TestReqRepRetry(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("reqrep-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	handler := &flaky{fails: 2}
+	server, err := node.Connect("reqrep-test-retry", handler)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer server.Close()
+
+	// A client without retries should fail, one with enough attempts succeed
+	plain, err := node.Connect("reqrep-test-plain", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer plain.Close()
+
+	if _, err := plain.Request("reqrep-test-retry", []byte{0x01}, 100*time.Millisecond); err != ErrTimeout {
+		t.Fatalf("request error mismatch: have %v, want %v.", err, ErrTimeout)
+	}
+	policy := RetryPolicy{Attempts: 3, Backoff: 10 * time.Millisecond}
+	retrier, err := node.Connect("reqrep-test-retrier", nil, WithRetry(policy))
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer retrier.Close()
+
+	if rep, err := retrier.Request("reqrep-test-retry", []byte{0x02}, 100*time.Millisecond); err != nil {
+		t.Fatalf("failed to execute retried request: %v.", err)
+	} else if !bytes.Equal(rep, []byte{0x02}) {
+		t.Fatalf("reply mismatch: have %v, want %v.", rep, []byte{0x02})
+	}
+	if calls := atomic.LoadInt32(&handler.calls); calls != 3 {
+		t.Fatalf("request attempt count mismatch: have %d, want %d.", calls, 3)
+	}
+	// Non-retriable failures should be reported immediately
+	policy.Retry = func(err error) bool { return false }
+	picky, err := node.Connect("reqrep-test-picky", nil, WithRetry(policy))
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer picky.Close()
+
+	atomic.StoreInt32(&handler.calls, 0)
+	atomic.StoreInt32(&handler.fails, 1)
+	if _, err := picky.Request("reqrep-test-retry", []byte{0x03}, 100*time.Millisecond); err != ErrTimeout {
+		t.Fatalf("request error mismatch: have %v, want %v.", err, ErrTimeout)
+	}
+	if calls := atomic.LoadInt32(&handler.calls); calls != 1 {
+		t.Fatalf("request attempt count mismatch: have %d, want %d.", calls, 1)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	policy := &RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	for i, want := range []time.Duration{10, 20, 40, 50, 50} {
+		if delay := policy.delay(i + 1); delay != want*time.Millisecond {
+			t.Errorf("retry %d delay mismatch: have %v, want %v.", i+1, delay, want*time.Millisecond)
+		}
+	}
+}
+
+// Request handler taking a fixed time to serve each request.
+type sleeper struct {
+	delay time.Duration // Time to spend on each request
+	calls int32         // Number of requests received
+}
+
+func (s *sleeper) HandleBroadcast(msg []byte) {
+	panic("Broadcast passed to request handler")
+}
+
+func (s *sleeper) HandleRequest(req []byte, timeout time.Duration) ([]byte, error) {
+	atomic.AddInt32(&s.calls, 1)
+	time.Sleep(s.delay)
+	return req, nil
+}
+
+func (s *sleeper) HandleTunnel(tun *Tunnel) {
+	panic("Inbound tunnel on request handler")
+}
+
+func (s *sleeper) HandleDrop(reason error) {
+	panic("Connection dropped on request handler")
+}
+
+// Tests that requests expiring in the server queue are shed and reported.
+func TestReqRepShedding(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	margin := config.IrisShedMargin
+	config.IrisShedMargin = 300 * time.Millisecond
+	defer func() { config.IrisShedMargin = margin }()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("reqrep-test-shed", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	// Serve the requests one at a time, slowly
+	handler := &sleeper{delay: 300 * time.Millisecond}
+	serv, err := node.Connect("reqrep-test-shed", handler, WithHandlerThreads(1))
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer serv.Close()
+
+	conn, err := node.Connect("reqrep-test-shed-client", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer conn.Close()
+
+	// Issue a batch of requests that cannot all be served in time
+	reqs := 4
+	errs := make(chan error, reqs)
+	start := time.Now()
+	for i := 0; i < reqs; i++ {
+		go func() {
+			_, err := conn.Request("reqrep-test-shed", []byte{0x00}, 500*time.Millisecond)
+			errs <- err
+		}()
+	}
+	served, shed := 0, 0
+	for i := 0; i < reqs; i++ {
+		switch err := <-errs; err {
+		case nil:
+			served++
+		case ErrExpired:
+			shed++
+		default:
+			t.Fatalf("unexpected request failure: %v.", err)
+		}
+	}
+	if served == 0 || shed == 0 || served+shed != reqs {
+		t.Fatalf("served/shed mismatch: have %d/%d, want both non-zero.", served, shed)
+	}
+	if calls := atomic.LoadInt32(&handler.calls); int(calls) != served {
+		t.Fatalf("handler invocations mismatch: have %d, want %d.", calls, served)
+	}
+	if elapsed := time.Since(start); elapsed >= 500*time.Millisecond {
+		t.Fatalf("shed requests reported slowly: have %v, want < 500ms.", elapsed)
+	}
+}
+
+// Tests that saturated members reject requests with an explicit overload error.
+func TestReqRepOverload(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("reqrep-test-overload", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	// Serve one request at a time, queueing at most one more
+	limits := HandlerLimits{Requests: 1, Queued: 1, Overflow: OverflowReject, RetryAfter: 2 * time.Second}
+	serv, err := node.Connect("reqrep-test-overload", &sleeper{delay: 300 * time.Millisecond}, WithHandlerLimits(limits))
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer serv.Close()
+
+	conn, err := node.Connect("reqrep-test-overload-client", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer conn.Close()
+
+	// Saturate the member and check the excess requests are rejected fast
+	reqs := 4
+	errs := make(chan error, reqs)
+	for i := 0; i < reqs; i++ {
+		go func() {
+			_, err := conn.Request("reqrep-test-overload", []byte{0x00}, 2*time.Second)
+			errs <- err
+		}()
+	}
+	timeout := time.After(250 * time.Millisecond)
+	for i := 0; i < reqs-2; i++ {
+		select {
+		case err := <-errs:
+			over, ok := err.(*OverloadError)
+			if !ok {
+				t.Fatalf("rejection mismatch: have %v, want *OverloadError.", err)
+			}
+			if over.RetryAfter != limits.RetryAfter {
+				t.Fatalf("back-off hint mismatch: have %v, want %v.", over.RetryAfter, limits.RetryAfter)
+			}
+		case <-timeout:
+			t.Fatalf("overloaded requests not rejected in time.")
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("admitted request failed: %v.", err)
+		}
+	}
+	// Verify that retries honor the back-off hint
+	policy := &RetryPolicy{Attempts: 2, Backoff: 10 * time.Millisecond}
+	if wait := policy.wait(1, &OverloadError{RetryAfter: time.Second}); wait != time.Second {
+		t.Fatalf("retry wait mismatch: have %v, want %v.", wait, time.Second)
+	}
+	if wait := policy.wait(1, ErrTimeout); wait != policy.Backoff {
+		t.Fatalf("retry wait mismatch: have %v, want %v.", wait, policy.Backoff)
+	}
+}
+
+// Request handler failing each request with an application error.
+type failer struct {
+	err error // Failure to return for each request
+}
+
+func (f *failer) HandleBroadcast(msg []byte) {
+	panic("Broadcast passed to request handler")
+}
+
+func (f *failer) HandleRequest(req []byte, timeout time.Duration) ([]byte, error) {
+	return nil, f.err
+}
+
+func (f *failer) HandleTunnel(tun *Tunnel) {
+	panic("Inbound tunnel on request handler")
+}
+
+func (f *failer) HandleDrop(reason error) {
+	panic("Connection dropped on request handler")
+}
+
+// Tests that application failures are transported back to the requester.
+func TestReqRepRemoteError(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("reqrep-test-remote", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	conn, err := node.Connect("reqrep-test-remote-client", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer conn.Close()
+
+	// Check both coded and plain handler failures
+	tests := []struct {
+		fail error
+		want RemoteError
+	}{
+		{&RemoteError{Code: 404, Message: "not found"}, RemoteError{Code: 404, Message: "not found"}},
+		{errors.New("plain failure"), RemoteError{Message: "plain failure"}},
+	}
+	for i, tt := range tests {
+		cluster := fmt.Sprintf("reqrep-test-remote-%d", i)
+		serv, err := node.Connect(cluster, &failer{err: tt.fail})
+		if err != nil {
+			t.Fatalf("test %d: failed to connect to the iris overlay: %v.", i, err)
+		}
+		start := time.Now()
+		_, err = conn.Request(cluster, []byte{0x00}, time.Second)
+		remote, ok := err.(*RemoteError)
+		if !ok {
+			t.Fatalf("test %d: failure type mismatch: have %v, want remote error.", i, err)
+		}
+		if *remote != tt.want {
+			t.Errorf("test %d: failure mismatch: have %+v, want %+v.", i, *remote, tt.want)
+		}
+		if elapsed := time.Since(start); elapsed >= time.Second {
+			t.Errorf("test %d: failure reported slowly: have %v, want < 1s.", i, elapsed)
+		}
+		serv.Close()
+	}
+}
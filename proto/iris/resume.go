@@ -0,0 +1,460 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+// Contains the resumption of tunnels surviving the breakage of their network
+// link. Every message of a resumable tunnel is sequenced and kept until the
+// remote side acknowledges it. If the link fails without a graceful close, the
+// accepting side re-dials the initiator's tunnel listeners, both ends exchange
+// the last message they received in order, and the unacknowledged ones are
+// retransmitted. Each link generation derives fresh keys from the master secret,
+// so resumed links never reuse a key stream.
+//
+// Tunnels not resumed within the grace period are terminated, same as if the
+// remote side closed them.
+
+package iris
+
+import (
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"hash"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto"
+	"github.com/karalabe/iris/proto/link"
+	"github.com/karalabe/iris/proto/stream"
+)
+
+// Sequencing header of the messages passed through a resumable tunnel.
+type resumeHeader struct {
+	Seq uint64 // Sequence number of the message (0 for standalone acknowledgements)
+	Ack uint64 // Last message received in order by the sender
+	Fin bool   // Whether the sender closed the tunnel
+}
+
+// Make sure the resumption header is registered with gob.
+func init() {
+	gob.Register(&resumeHeader{})
+}
+
+// Stream dialed by the remote side to resume a broken tunnel.
+type resumeStream struct {
+	strm  *stream.Stream // Network stream of the new link
+	epoch uint32         // Link generation proposed by the remote side
+}
+
+// Network link of a single generation, along with its failure state.
+type resumeLink struct {
+	link *link.Link    // Encrypted data link of the generation
+	dead chan struct{} // Channel closed when the link terminates
+	down bool          // Flag set along with the dead channel (for lock holders)
+}
+
+// Resumption state of a tunnel.
+type resumer struct {
+	tun    *Tunnel       // Tunnel kept alive through link failures
+	grace  time.Duration // Time allowed for re-establishing a broken link
+	authId uint64        // Tunnel id authorizing the links (the initiator's)
+	secret []byte        // Master key from which to derive the link keys
+
+	remote uint64   // Connection id of the initiator (accepting side only)
+	addrs  []string // Tunnel listeners of the initiator (accepting side only)
+
+	active *resumeLink       // Currently active link generation
+	relink chan resumeStream // Streams dialed by the remote side (initiator only)
+	epoch  uint32            // Generation of the active link
+
+	sendSeq uint64   // Sequence number of the last queued outbound message
+	sentSeq uint64   // Sequence number of the last message handed to the link
+	ackSeq  uint64   // Sequence number of the last outbound message acknowledged
+	replay  [][]byte // Unacknowledged outbound messages, ackSeq+1 onwards
+	recvSeq uint64   // Sequence number of the last inbound message received
+	recvAck uint64   // Sequence number of the last inbound message acknowledged
+
+	closing bool  // Local side closed, fin pending
+	finSent bool  // Fin handed to the active link
+	finRecv bool  // Remote side closed gracefully
+	err     error // Terminal failure of the tunnel
+
+	inbox chan []byte   // In order inbound messages waiting to be received
+	flush chan struct{} // Signals the run loop that the fin was sent
+	stop  chan struct{} // Channel closed when the local side closes
+	quit  chan struct{} // Channel closed when the tunnel terminates
+
+	lock sync.Mutex // Mutex to protect the sequencing state
+	cond *sync.Cond // Signals the changes of the sequencing state
+}
+
+// Creates the resumption state of a freshly established tunnel.
+func newResumer(tun *Tunnel, grace time.Duration, authId uint64, secret []byte) *resumer {
+	r := &resumer{
+		tun:    tun,
+		grace:  grace,
+		authId: authId,
+		secret: secret,
+		relink: make(chan resumeStream, 1),
+		inbox:  make(chan []byte, config.IrisTunnelBuffer),
+		flush:  make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		quit:   make(chan struct{}),
+	}
+	r.cond = sync.NewCond(&r.lock)
+	return r
+}
+
+// Sets the initiator endpoints to re-dial, making this the resuming side.
+func (r *resumer) redial(remote uint64, addrs []string) {
+	r.remote, r.addrs = remote, addrs
+}
+
+// Derives the key material of a link generation from the master secret.
+func (r *resumer) kdf(epoch uint32) io.Reader {
+	info := make([]byte, len(config.HkdfInfo)+4)
+	copy(info, config.HkdfInfo)
+	binary.BigEndian.PutUint32(info[len(config.HkdfInfo):], epoch)
+
+	hasher := func() hash.Hash { return config.HkdfHash.New() }
+	return config.SessionKdf(hasher, r.secret, config.HkdfSalt, info)
+}
+
+// Keeps the tunnel alive, replacing failed links until the tunnel is closed or
+// the resumption grace period passes.
+func (r *resumer) run(conn *link.Link) {
+	for conn != nil {
+		active := r.start(conn)
+
+		// Wait for the link to fail, complete or be replaced
+		var pend *resumeStream
+		select {
+		case <-active.dead:
+		case <-r.flush:
+		case res := <-r.relink:
+			pend = &res
+			conn.Sock().Close()
+		}
+		conn.Close()
+		<-active.dead
+
+		r.lock.Lock()
+		done := r.finRecv || (r.closing && r.finSent)
+		r.lock.Unlock()
+		if done {
+			break
+		}
+		// Link broken, re-establish it within the grace period
+		r.tun.owner.carrier().logger.Printf("iris: tunnel link broken, resuming.")
+		conn = r.reconnect(pend)
+	}
+	// Tunnel over, fail any blocked operations
+	r.lock.Lock()
+	if r.err == nil {
+		r.err = ErrTerminating
+	}
+	r.cond.Broadcast()
+	r.lock.Unlock()
+
+	close(r.inbox)
+	close(r.quit)
+}
+
+// Activates a new link generation, starting its transfer goroutines.
+func (r *resumer) start(conn *link.Link) *resumeLink {
+	active := &resumeLink{
+		link: conn,
+		dead: make(chan struct{}),
+	}
+	r.lock.Lock()
+	r.active = active
+	r.lock.Unlock()
+
+	// Discard any completion signal of a previous generation
+	select {
+	case <-r.flush:
+	default:
+	}
+	go r.reader(active)
+	go r.writer(active)
+	return active
+}
+
+// Re-establishes a broken link, either by dialing the initiator or by waiting for
+// it to be dialed. Nil is returned if the grace period passes.
+func (r *resumer) reconnect(pend *resumeStream) *link.Link {
+	deadline := time.Now().Add(r.grace)
+
+	// Initiator side, wait for the remote to dial back
+	if r.addrs == nil {
+		timeout := time.After(r.grace)
+		for {
+			if pend == nil {
+				select {
+				case res := <-r.relink:
+					pend = &res
+				case <-timeout:
+					return nil
+				}
+			}
+			if conn, err := r.handshake(pend.strm, pend.epoch, true); err == nil {
+				return conn
+			} else {
+				r.tun.owner.carrier().logger.Printf("iris: failed to resume tunnel: %v.", err)
+				pend.strm.Close()
+			}
+			pend = nil
+		}
+	}
+	// Accepting side, dial the initiator until the grace period passes
+	for time.Now().Before(deadline) {
+		for _, addr := range r.addrs {
+			strm, err := stream.Dial(addr, deadline.Sub(time.Now()))
+			if err != nil {
+				continue
+			}
+			init := &initPacket{ConnId: r.remote, TunId: r.authId, Epoch: r.epoch + 1}
+			strm.Sock().SetDeadline(time.Now().Add(config.IrisTunnelInitTimeout))
+			if err = strm.Send(init); err == nil {
+				var conn *link.Link
+				if conn, err = r.handshake(strm, init.Epoch, false); err == nil {
+					return conn
+				}
+			}
+			r.tun.owner.carrier().logger.Printf("iris: failed to resume tunnel: %v.", err)
+			strm.Close()
+		}
+		time.Sleep(config.IrisTunnelRedial)
+	}
+	return nil
+}
+
+// Authorizes a new link generation, exchanging the last messages received in
+// order and rewinding the outbound stream to retransmit the lost ones.
+func (r *resumer) handshake(strm *stream.Stream, epoch uint32, server bool) (*link.Link, error) {
+	if epoch <= r.epoch {
+		return nil, errors.New("stale link generation")
+	}
+	strm.Sock().SetDeadline(time.Now().Add(config.IrisTunnelInitTimeout))
+	defer strm.Sock().SetDeadline(time.Time{})
+
+	conn := link.New(strm, r.kdf(epoch), config.SuiteAes, server)
+
+	// Send and retrieve an authorization, carrying the receive progress
+	r.lock.Lock()
+	recv := r.recvSeq
+	r.lock.Unlock()
+
+	auth := &proto.Message{
+		Head: proto.Header{
+			Meta: &authPacket{Id: r.authId, Recv: recv},
+		},
+	}
+	if err := conn.SendDirect(auth); err != nil {
+		return nil, err
+	}
+	msg, err := conn.RecvDirect()
+	if err != nil {
+		return nil, err
+	}
+	peer, ok := msg.Head.Meta.(*authPacket)
+	if !ok || peer.Id != r.authId {
+		return nil, errors.New("protocol violation")
+	}
+	// Drop everything the remote received and retransmit the rest
+	r.lock.Lock()
+	if peer.Recv < r.ackSeq || peer.Recv > r.sendSeq {
+		r.lock.Unlock()
+		return nil, errors.New("protocol violation")
+	}
+	r.acknowledge(peer.Recv)
+	r.sentSeq, r.recvAck, r.finSent = r.ackSeq, 0, false
+	r.epoch = epoch
+	r.lock.Unlock()
+
+	conn.Start(config.IrisTunnelBuffer)
+	return conn, nil
+}
+
+// Accepts a stream dialed by the remote side to resume the tunnel.
+func (r *resumer) relinked(strm *stream.Stream, epoch uint32) error {
+	select {
+	case r.relink <- resumeStream{strm: strm, epoch: epoch}:
+		return nil
+	default:
+		return errors.New("resumption already pending")
+	}
+}
+
+// Releases the outbound messages acknowledged by the remote side. The lock must
+// be held.
+func (r *resumer) acknowledge(seq uint64) {
+	if seq <= r.ackSeq {
+		return
+	}
+	r.replay = r.replay[seq-r.ackSeq:]
+	r.ackSeq = seq
+	if r.sentSeq < seq {
+		r.sentSeq = seq
+	}
+	r.cond.Broadcast()
+}
+
+// Transfers the inbound messages of a link generation into the inbox.
+func (r *resumer) reader(active *resumeLink) {
+	for packet := range active.link.Recv {
+		head, ok := packet.Head.Meta.(*resumeHeader)
+		if !ok || packet.Decrypt() != nil {
+			r.tun.owner.carrier().logger.Printf("iris: invalid resumable tunnel message, dropping link.")
+			active.link.Sock().Close()
+			continue
+		}
+		r.lock.Lock()
+		if head.Ack <= r.sendSeq {
+			r.acknowledge(head.Ack)
+		}
+		deliver := false
+		switch {
+		case head.Fin:
+			r.finRecv = true
+		case head.Seq == r.recvSeq+1:
+			r.recvSeq, deliver = head.Seq, true
+		case head.Seq > r.recvSeq+1:
+			// Gap in the sequence, resume to get the missing messages
+			r.lock.Unlock()
+			active.link.Sock().Close()
+			continue
+		}
+		// Request a standalone acknowledgement if the remote window runs low
+		if r.recvSeq-r.recvAck >= uint64(config.IrisTunnelBuffer+1)/2 {
+			r.cond.Broadcast()
+		}
+		r.lock.Unlock()
+
+		if deliver {
+			select {
+			case r.inbox <- packet.Data:
+			case <-r.stop:
+				// Locally closed, nobody is receiving
+			}
+		}
+	}
+	r.lock.Lock()
+	active.down = true
+	close(active.dead)
+	r.cond.Broadcast()
+	r.lock.Unlock()
+}
+
+// Sends the queued and unacknowledged outbound messages of a link generation.
+func (r *resumer) writer(active *resumeLink) {
+	threshold := uint64(config.IrisTunnelBuffer+1) / 2
+	for {
+		// Wait until something needs sending
+		r.lock.Lock()
+		for !active.down && r.sentSeq == r.sendSeq && r.recvSeq-r.recvAck < threshold && !(r.closing && !r.finSent) {
+			r.cond.Wait()
+		}
+		if active.down {
+			r.lock.Unlock()
+			return
+		}
+		head := &resumeHeader{Ack: r.recvSeq}
+		var data []byte
+		switch {
+		case r.sentSeq < r.sendSeq:
+			r.sentSeq++
+			head.Seq = r.sentSeq
+			data = append([]byte(nil), r.replay[r.sentSeq-r.ackSeq-1]...)
+		case r.closing && !r.finSent:
+			head.Fin, r.finSent = true, true
+		}
+		r.recvAck = r.recvSeq
+		r.lock.Unlock()
+
+		// Encrypt a copy (retransmits need the plaintext) and queue it for sending
+		packet := &proto.Message{Head: proto.Header{Meta: head}, Data: data}
+		if err := packet.Encrypt(); err != nil {
+			r.tun.owner.carrier().logger.Printf("iris: failed to encrypt tunnel message: %v.", err)
+			active.link.Sock().Close()
+			return
+		}
+		select {
+		case active.link.Send <- packet:
+		case <-active.dead:
+			return
+		}
+		if head.Fin {
+			select {
+			case r.flush <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// Queues an outbound message, blocking while the remote window is full.
+func (r *resumer) send(msg []byte) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for len(r.replay) >= config.IrisTunnelBuffer && r.err == nil && !r.closing {
+		r.cond.Wait()
+	}
+	if r.err != nil || r.closing {
+		return errors.New("closed")
+	}
+	r.replay = append(r.replay, msg)
+	r.sendSeq++
+	r.cond.Broadcast()
+	return nil
+}
+
+// Retrieves an inbound message, blocking until one arrives or the expiry channel
+// fires (nil to wait indefinitely).
+func (r *resumer) recv(expiry <-chan time.Time) ([]byte, error) {
+	select {
+	case msg, ok := <-r.inbox:
+		if !ok {
+			r.tun.termOnce.Do(func() { close(r.tun.term) })
+			return nil, ErrTerminating
+		}
+		return msg, nil
+	case <-expiry:
+		return nil, ErrTimeout
+	}
+}
+
+// Closes the tunnel after handing all the queued messages to the link, waiting
+// at most the grace period for a broken link to be resumed.
+func (r *resumer) close() error {
+	r.lock.Lock()
+	if r.closing {
+		r.lock.Unlock()
+		<-r.quit
+		return nil
+	}
+	r.closing = true
+	r.cond.Broadcast()
+	r.lock.Unlock()
+
+	close(r.stop)
+	<-r.quit
+	return nil
+}
@@ -0,0 +1,161 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+package iris
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// Connection handler echoing the tunnel messages until closed.
+type echoer struct{}
+
+func (r *echoer) HandleBroadcast(msg []byte) {
+	panic("Broadcast passed to tunnel handler")
+}
+
+func (r *echoer) HandleRequest(req []byte, timeout time.Duration) ([]byte, error) {
+	panic("Request passed to tunnel handler")
+}
+
+func (r *echoer) HandleTunnel(tun *Tunnel) {
+	defer tun.Close()
+	for {
+		msg, err := tun.Recv(10 * time.Second)
+		if err != nil {
+			return
+		}
+		if err := tun.Send(msg); err != nil {
+			return
+		}
+	}
+}
+
+func (r *echoer) HandleDrop(reason error) {
+	panic("Connection dropped on tunnel handler")
+}
+
+// Breaks the active network link of a resumable tunnel.
+func breakTunnel(tun *Tunnel) {
+	tun.resume.lock.Lock()
+	conn := tun.resume.active.link
+	tun.resume.lock.Unlock()
+
+	conn.Sock().Close()
+}
+
+func TestTunnelResume(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("resume-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	conn, err := node.Connect("resume-test", &echoer{}, WithTunnelResume(5*time.Second))
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer conn.Close()
+
+	tun, err := conn.Tunnel("resume-test", time.Second)
+	if err != nil {
+		t.Fatalf("failed to establish tunnel: %v.", err)
+	}
+	defer tun.Close()
+
+	// Stream a load of messages, breaking the link a few times midway
+	msgs := 3000
+	go func() {
+		for i := 0; i < msgs; i++ {
+			msg := make([]byte, 8)
+			binary.BigEndian.PutUint64(msg, uint64(i))
+			if err := tun.Send(msg); err != nil {
+				return
+			}
+		}
+	}()
+	for i := 0; i < msgs; i++ {
+		if i%1000 == 500 {
+			breakTunnel(tun)
+		}
+		msg, err := tun.Recv(5 * time.Second)
+		if err != nil {
+			t.Fatalf("failed to receive message #%d: %v.", i, err)
+		}
+		want := make([]byte, 8)
+		binary.BigEndian.PutUint64(want, uint64(i))
+		if !bytes.Equal(msg, want) {
+			t.Fatalf("message #%d mismatch: have %v, want %v.", i, msg, want)
+		}
+	}
+	// Make sure the resumed link works in both directions
+	if err := tun.Send([]byte("done")); err != nil {
+		t.Fatalf("failed to send over resumed tunnel: %v.", err)
+	}
+	if msg, err := tun.Recv(time.Second); err != nil || string(msg) != "done" {
+		t.Fatalf("failed to receive over resumed tunnel: %v, %v.", msg, err)
+	}
+}
+
+func TestTunnelResumeClose(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("resume-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	conn, err := node.Connect("resume-test", &echoer{}, WithTunnelResume(5*time.Second))
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer conn.Close()
+
+	tun, err := conn.Tunnel("resume-test", time.Second)
+	if err != nil {
+		t.Fatalf("failed to establish tunnel: %v.", err)
+	}
+	// Gracefully closing the tunnel should not trigger resumption
+	done := make(chan error, 1)
+	go func() { done <- tun.Close() }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("failed to close tunnel: %v.", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("tunnel close timed out.")
+	}
+	if err := tun.Send([]byte{0x00}); err == nil {
+		t.Fatalf("send succeeded on closed tunnel.")
+	}
+}
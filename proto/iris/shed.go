@@ -0,0 +1,107 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+// Contains the shedding of requests that spent their time limit queued at the
+// serving member. Requests are stamped on arrival, and if the time left by the
+// time a worker picks them up is below config.IrisShedMargin, they are dropped
+// without reaching the handler, and the requester is notified via an explicit
+// failure reply instead of waiting out its timeout.
+//
+// Requests rejected by a saturated member (i.e. a full bounded queue) are also
+// failed explicitly, with an *OverloadError carrying the member's back-off hint,
+// so that requesters can tell saturation apart from lost or slow requests.
+
+package iris
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+var ErrExpired = errors.New("expired before processing")
+
+// Failure of a request rejected by a saturated cluster member.
+type OverloadError struct {
+	RetryAfter time.Duration // Back-off suggested by the member (0 if none)
+}
+
+// Implements the error interface.
+func (e *OverloadError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("overloaded, retry after %v", e.RetryAfter)
+	}
+	return "overloaded, retry later"
+}
+
+// Application failure returned by the handler of a remote member, as opposed to the
+// failures of the transport itself.
+type RemoteError struct {
+	Code    int    // Application defined failure code (0 for plain errors)
+	Message string // Description of the failure
+}
+
+// Implements the error interface.
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("remote error %d: %s", e.Code, e.Message)
+}
+
+// Reason of a request failing at the serving member before producing a reply.
+type failure uint8
+
+const (
+	failNone       failure = iota // Request processed, reply attached
+	failExpired                   // Request timed out in the serving queue
+	failOverloaded                // Request dropped by a full serving queue
+	failRemote                    // Request failed by the application handler
+)
+
+// Converts the failure reason of a reply and the attached details into the error
+// reported to the requester.
+func (h *header) failure() error {
+	switch h.RepFail {
+	case failExpired:
+		return ErrExpired
+	case failOverloaded:
+		return &OverloadError{RetryAfter: h.RepHint}
+	case failRemote:
+		return &RemoteError{Code: h.RepCode, Message: h.RepMsg}
+	default:
+		return errors.New("unknown remote failure")
+	}
+}
+
+// Calculates the time left of a request arrived with the given limit, reporting
+// whether it is still worth processing.
+func remaining(arrived time.Time, timeout time.Duration) (time.Duration, bool) {
+	left := timeout - time.Since(arrived)
+	return left, left >= config.IrisShedMargin
+}
+
+// Notifies the requester that its request was dropped unprocessed, attaching the
+// back-off hint of the connection to overload rejections.
+func (c *Connection) reject(srcNode *big.Int, srcConn uint64, reqId uint64, reason failure) {
+	var hint time.Duration
+	if reason == failOverloaded && c.limits != nil {
+		hint = c.limits.RetryAfter
+	}
+	c.carrier().scribe.Direct(srcNode, c.assembleFailure(srcConn, reqId, reason, hint))
+}
@@ -0,0 +1,226 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the per cluster and per topic traffic statistics of the connections.
+// Each connection counts the requests, broadcasts, publishes and tunnel bytes
+// it exchanged with every cluster and topic, along with latency histograms of
+// the requests it issued and served. The overlay aggregates the statistics of
+// all its live connections.
+
+package iris
+
+import (
+	"sync"
+	"time"
+)
+
+// Upper bounds of the latency histogram buckets, doubling from a millisecond.
+var latencyBounds = func() []time.Duration {
+	bounds := make([]time.Duration, 15)
+	for i := range bounds {
+		bounds[i] = time.Millisecond << uint(i)
+	}
+	return bounds
+}()
+
+// Latency histogram with exponentially growing buckets.
+type Histogram struct {
+	Bounds []time.Duration // Upper bounds of the buckets (shared, do not modify)
+	Counts []uint64        // Samples per bucket, the last one being unbounded
+	Count  uint64          // Total number of samples
+	Sum    time.Duration   // Total of all the samples
+}
+
+// Creates an empty latency histogram.
+func newHistogram() Histogram {
+	return Histogram{Bounds: latencyBounds, Counts: make([]uint64, len(latencyBounds)+1)}
+}
+
+// Records a single latency sample.
+func (h *Histogram) add(latency time.Duration) {
+	i := 0
+	for i < len(h.Bounds) && latency > h.Bounds[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Count++
+	h.Sum += latency
+}
+
+// Merges the samples of another histogram into this one.
+func (h *Histogram) merge(other *Histogram) {
+	for i, count := range other.Counts {
+		h.Counts[i] += count
+	}
+	h.Count += other.Count
+	h.Sum += other.Sum
+}
+
+// Returns the mean of the samples, zero if none were recorded.
+func (h *Histogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// Returns an upper estimate of the q-th quantile (0 < q <= 1) of the samples: the
+// bound of the bucket containing it. Samples beyond the largest bound are reported
+// with twice that bound. Zero is returned if no samples were recorded.
+func (h *Histogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	rank, seen := uint64(q*float64(h.Count)+0.5), uint64(0)
+	if rank < 1 {
+		rank = 1
+	}
+	for i, count := range h.Counts {
+		if seen += count; seen >= rank && i < len(h.Bounds) {
+			return h.Bounds[i]
+		}
+	}
+	return 2 * h.Bounds[len(h.Bounds)-1]
+}
+
+// Traffic statistics of a single cluster or topic.
+type TargetStats struct {
+	RequestsSent    uint64    // Requests issued to the cluster
+	RequestsFailed  uint64    // Issued requests that failed or timed out
+	RequestsServed  uint64    // Requests of the cluster handled locally
+	BroadcastsSent  uint64    // Broadcasts sent to the cluster
+	BroadcastsRecv  uint64    // Broadcasts received as a member of the cluster
+	PublishesSent   uint64    // Events published to the topic
+	PublishesRecv   uint64    // Events of the topic delivered to the subscriptions
+	TunnelBytesSent uint64    // Payload bytes sent through tunnels to or from the cluster
+	TunnelBytesRecv uint64    // Payload bytes received through tunnels to or from the cluster
+	RequestLatency  Histogram // Round trips of the successful requests issued
+	ServeLatency    Histogram // Handling times of the requests served
+}
+
+// Creates an empty statistics set of a cluster or topic.
+func newTargetStats() *TargetStats {
+	return &TargetStats{RequestLatency: newHistogram(), ServeLatency: newHistogram()}
+}
+
+// Merges the statistics of another cluster or topic into this one.
+func (s *TargetStats) merge(other *TargetStats) {
+	s.RequestsSent += other.RequestsSent
+	s.RequestsFailed += other.RequestsFailed
+	s.RequestsServed += other.RequestsServed
+	s.BroadcastsSent += other.BroadcastsSent
+	s.BroadcastsRecv += other.BroadcastsRecv
+	s.PublishesSent += other.PublishesSent
+	s.PublishesRecv += other.PublishesRecv
+	s.TunnelBytesSent += other.TunnelBytesSent
+	s.TunnelBytesRecv += other.TunnelBytesRecv
+	s.RequestLatency.merge(&other.RequestLatency)
+	s.ServeLatency.merge(&other.ServeLatency)
+}
+
+// Snapshot of the traffic statistics, broken down by cluster and topic.
+type Stats struct {
+	Clusters map[string]*TargetStats
+	Topics   map[string]*TargetStats
+}
+
+// Creates an empty statistics snapshot.
+func newStats() *Stats {
+	return &Stats{
+		Clusters: make(map[string]*TargetStats),
+		Topics:   make(map[string]*TargetStats),
+	}
+}
+
+// Merges a statistics snapshot into this one.
+func (s *Stats) merge(other *Stats) {
+	for _, pair := range []struct{ dst, src map[string]*TargetStats }{{s.Clusters, other.Clusters}, {s.Topics, other.Topics}} {
+		for name, stats := range pair.src {
+			if _, ok := pair.dst[name]; !ok {
+				pair.dst[name] = newTargetStats()
+			}
+			pair.dst[name].merge(stats)
+		}
+	}
+}
+
+// Live traffic statistics of a connection.
+type tracer struct {
+	stats *Stats
+	lock  sync.Mutex
+}
+
+// Updates the statistics of a cluster or topic (taken from the given map).
+func (t *tracer) update(targets func(*Stats) map[string]*TargetStats, name string, update func(*TargetStats)) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.stats == nil {
+		t.stats = newStats()
+	}
+	stats, ok := targets(t.stats)[name]
+	if !ok {
+		stats = newTargetStats()
+		targets(t.stats)[name] = stats
+	}
+	update(stats)
+}
+
+// Selectors of the cluster and topic statistics.
+func clusters(s *Stats) map[string]*TargetStats { return s.Clusters }
+func topics(s *Stats) map[string]*TargetStats   { return s.Topics }
+
+// Updates the statistics of a cluster.
+func (c *Connection) statCluster(cluster string, update func(*TargetStats)) {
+	c.tracer.update(clusters, cluster, update)
+}
+
+// Updates the statistics of a topic.
+func (c *Connection) statTopic(topic string, update func(*TargetStats)) {
+	c.tracer.update(topics, topic, update)
+}
+
+// Retrieves a snapshot of the traffic statistics of the connection.
+func (c *Connection) Stats() *Stats {
+	c.tracer.lock.Lock()
+	defer c.tracer.lock.Unlock()
+
+	stats := newStats()
+	if c.tracer.stats != nil {
+		stats.merge(c.tracer.stats)
+	}
+	return stats
+}
+
+// Retrieves a snapshot of the traffic statistics of all the connections made
+// through the overlay (closed ones included), aggregated by cluster and topic.
+func (o *Overlay) Stats() *Stats {
+	o.lock.RLock()
+	conns := make([]*Connection, 0, len(o.conns))
+	for _, conn := range o.conns {
+		conns = append(conns, conn)
+	}
+	o.lock.RUnlock()
+
+	stats := newStats()
+	for _, conn := range conns {
+		stats.merge(conn.Stats())
+	}
+	return stats
+}
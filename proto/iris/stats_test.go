@@ -0,0 +1,112 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package iris
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+// Tests the latency histogram bucketing and estimates.
+func TestHistogram(t *testing.T) {
+	h := newHistogram()
+	if h.Mean() != 0 || h.Quantile(0.5) != 0 {
+		t.Fatalf("empty histogram estimates non-zero.")
+	}
+	for _, latency := range []time.Duration{time.Microsecond, 3 * time.Millisecond, 3 * time.Millisecond, time.Hour} {
+		h.add(latency)
+	}
+	if h.Count != 4 || h.Counts[0] != 1 || h.Counts[2] != 2 || h.Counts[len(h.Counts)-1] != 1 {
+		t.Fatalf("bucket counts mismatch: %v.", h.Counts)
+	}
+	if q := h.Quantile(0.5); q != 4*time.Millisecond {
+		t.Fatalf("median mismatch: have %v, want %v.", q, 4*time.Millisecond)
+	}
+	if q, want := h.Quantile(1), 2*latencyBounds[len(latencyBounds)-1]; q != want {
+		t.Fatalf("maximum mismatch: have %v, want %v.", q, want)
+	}
+}
+
+// Tests that the traffic is accounted per cluster and topic.
+func TestStats(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("stats-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	server, err := node.Connect("stats-server", &sleeper{})
+	if err != nil {
+		t.Fatalf("failed to connect server to the iris overlay: %v.", err)
+	}
+	defer server.Close()
+
+	sub := &subscriber{msgs: make(chan []byte, 10)}
+	if err := server.Subscribe("stats-topic", sub); err != nil {
+		t.Fatalf("failed to subscribe to topic: %v.", err)
+	}
+	client, err := node.Connect("stats-client", nil)
+	if err != nil {
+		t.Fatalf("failed to connect client to the iris overlay: %v.", err)
+	}
+	defer client.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// Generate some traffic and wait for it to settle
+	for i := 0; i < 3; i++ {
+		if _, err := client.Request("stats-server", []byte{byte(i)}, time.Second); err != nil {
+			t.Fatalf("request %d failed: %v.", i, err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := client.Publish("stats-topic", []byte{byte(i)}); err != nil {
+			t.Fatalf("publish %d failed: %v.", i, err)
+		}
+		<-sub.msgs
+	}
+	// Verify the statistics of both ends and the aggregate
+	sent := client.Stats()
+	if s := sent.Clusters["stats-server"]; s == nil || s.RequestsSent != 3 || s.RequestsFailed != 0 || s.RequestLatency.Count != 3 {
+		t.Fatalf("client cluster stats mismatch: %+v.", s)
+	}
+	if s := sent.Topics["stats-topic"]; s == nil || s.PublishesSent != 2 {
+		t.Fatalf("client topic stats mismatch: %+v.", s)
+	}
+	served := server.Stats()
+	if s := served.Clusters["stats-server"]; s == nil || s.RequestsServed != 3 || s.ServeLatency.Count != 3 {
+		t.Fatalf("server cluster stats mismatch: %+v.", s)
+	}
+	if s := served.Topics["stats-topic"]; s == nil || s.PublishesRecv != 2 {
+		t.Fatalf("server topic stats mismatch: %+v.", s)
+	}
+	total := node.Stats()
+	if s := total.Clusters["stats-server"]; s == nil || s.RequestsSent != 3 || s.RequestsServed != 3 {
+		t.Fatalf("aggregate cluster stats mismatch: %+v.", s)
+	}
+	if s := total.Topics["stats-topic"]; s == nil || s.PublishesSent != 2 || s.PublishesRecv != 2 {
+		t.Fatalf("aggregate topic stats mismatch: %+v.", s)
+	}
+}
@@ -0,0 +1,88 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the byte stream adapter of the message oriented tunnels, allowing
+// stdlib and third party protocols to run through Iris unmodified. Writes are
+// framed into messages of at most config.IrisTunnelFrame bytes, and reads drain
+// the frames in order, regardless of the original write boundaries. Flow control
+// is inherited from the tunnel windows: writes block while the remote side lags
+// more than config.IrisTunnelBuffer frames behind.
+
+package iris
+
+import (
+	"io"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Byte stream view of a tunnel, implementing io.ReadWriteCloser. Reads and writes
+// are individually not reentrant, but may run concurrently with each other.
+type TunnelStream struct {
+	tun *Tunnel // Message tunnel carrying the stream frames
+	buf []byte  // Unread remainder of the last received frame
+	err error   // Sticky read failure, reported once the buffer drains
+}
+
+// Creates a byte stream adapter on top of the tunnel. The tunnel should not be
+// used for message passing concurrently.
+func (t *Tunnel) Stream() *TunnelStream {
+	return &TunnelStream{tun: t}
+}
+
+// Reads data from the tunnel, blocking until at least one byte is available. The
+// io.EOF error is returned after the remote side closes the tunnel.
+func (s *TunnelStream) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		frame, err := s.tun.recv(nil)
+		if err == ErrTerminating {
+			err = io.EOF
+		}
+		s.buf, s.err = frame, err
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// Writes data into the tunnel, split into frames if needed. The frames are copies
+// of the input, as the tunnel encrypts the messages in place.
+func (s *TunnelStream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		size := len(p) - written
+		if size > config.IrisTunnelFrame {
+			size = config.IrisTunnelFrame
+		}
+		frame := append([]byte(nil), p[written:written+size]...)
+		if err := s.tun.Send(frame); err != nil {
+			return written, err
+		}
+		written += size
+	}
+	return written, nil
+}
+
+// Closes the underlying tunnel.
+func (s *TunnelStream) Close() error {
+	return s.tun.Close()
+}
@@ -0,0 +1,139 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the distributed trace propagation. If a connection has a tracer, a
+// span is started for every request, broadcast, publish and tunnel it issues,
+// and for every handler invocation they trigger remotely, the identifiers of the
+// calling span travelling along in the message metadata. The inbound handlers
+// see the identifiers of their own span in the metadata they receive, so calls
+// made while handling continue the same trace.
+
+package iris
+
+import (
+	"context"
+)
+
+// Metadata keys carrying the trace context of a message.
+const (
+	TraceIdKey = "trace-id"
+	SpanIdKey  = "span-id"
+)
+
+// Identifiers of a span within a distributed trace.
+type SpanContext struct {
+	TraceId string // Id of the trace the span belongs to
+	SpanId  string // Id of the span within the trace
+}
+
+// Direction of the call a span measures.
+type SpanKind int
+
+const (
+	SpanOutbound SpanKind = iota // Call issued through the connection
+	SpanInbound                  // Handler invocation of a remotely issued call
+)
+
+// Span measuring a single call, created by a Tracer.
+type Span interface {
+	// Returns the identifiers of the span, propagated to the remote side.
+	Context() SpanContext
+
+	// Finishes the span with the outcome of the call (nil if succeeded).
+	Finish(err error)
+}
+
+// Hooks into a tracing system (e.g. an OpenTelemetry adapter). Implementations
+// must be safe for use by multiple go-routines.
+type Tracer interface {
+	// Starts a span of a call (one of the Call* kinds, or CallTunnel) with the
+	// given target (cluster or topic), continuing the parent span if it is valid.
+	StartSpan(kind SpanKind, call, target string, parent SpanContext) Span
+}
+
+// Kind of tunnel calls passed to the tracer.
+const CallTunnel = "tunnel"
+
+// Context key of the active span.
+type spanKey struct{}
+
+// Returns a copy of the parent context carrying the span identifiers, which the
+// context bound operations continue.
+func ContextWithSpan(ctx context.Context, span SpanContext) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// Retrieves the span identifiers carried by a context, if any.
+func SpanFromContext(ctx context.Context) SpanContext {
+	span, _ := ctx.Value(spanKey{}).(SpanContext)
+	return span
+}
+
+// Retrieves the span identifiers attached to a message, if any.
+func SpanFromMetadata(meta Metadata) SpanContext {
+	return SpanContext{TraceId: meta[TraceIdKey], SpanId: meta[SpanIdKey]}
+}
+
+// Reports whether the span identifiers are set.
+func (s SpanContext) Valid() bool {
+	return s.TraceId != "" && s.SpanId != ""
+}
+
+// Returns a copy of the metadata with the span identifiers attached.
+func (s SpanContext) inject(meta Metadata) Metadata {
+	traced := make(Metadata, len(meta)+2)
+	for key, val := range meta {
+		traced[key] = val
+	}
+	traced[TraceIdKey], traced[SpanIdKey] = s.TraceId, s.SpanId
+	return traced
+}
+
+// Starts the span of an outbound call if the connection has a tracer, continuing
+// the span of the context, or else of the metadata. The metadata to send along
+// with the call is returned, and the span (nil without a tracer).
+func (c *Connection) traceOut(ctx context.Context, call, target string, meta Metadata) (Metadata, Span) {
+	if c.spans == nil {
+		return meta, nil
+	}
+	parent := SpanFromContext(ctx)
+	if !parent.Valid() {
+		parent = SpanFromMetadata(meta)
+	}
+	span := c.spans.StartSpan(SpanOutbound, call, target, parent)
+	return span.Context().inject(meta), span
+}
+
+// Starts the span of an inbound handler invocation if the connection has a
+// tracer, continuing the span attached to the message. The metadata to pass to
+// the handler is returned (carrying the new span), and the span.
+func (c *Connection) traceIn(call, target string, meta Metadata) (Metadata, Span) {
+	if c.spans == nil {
+		return meta, nil
+	}
+	span := c.spans.StartSpan(SpanInbound, call, target, SpanFromMetadata(meta))
+	return span.Context().inject(meta), span
+}
+
+// Finishes a span, if any was started.
+func finish(span Span, err error) {
+	if span != nil {
+		span.Finish(err)
+	}
+}
@@ -0,0 +1,147 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package iris
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Span recorded by the test tracer.
+type testSpan struct {
+	kind   SpanKind
+	call   string
+	parent SpanContext
+	self   SpanContext
+	done   chan error
+}
+
+func (s *testSpan) Context() SpanContext {
+	return s.self
+}
+
+func (s *testSpan) Finish(err error) {
+	s.done <- err
+}
+
+// Tracer recording all the started spans.
+type testTracer struct {
+	spans []*testSpan
+	lock  sync.Mutex
+}
+
+func (t *testTracer) StartSpan(kind SpanKind, call, target string, parent SpanContext) Span {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	span := &testSpan{
+		kind:   kind,
+		call:   call,
+		parent: parent,
+		self:   SpanContext{TraceId: parent.TraceId, SpanId: fmt.Sprintf("span-%d", len(t.spans))},
+		done:   make(chan error, 1),
+	}
+	if !parent.Valid() {
+		span.self.TraceId = fmt.Sprintf("trace-%d", len(t.spans))
+	}
+	t.spans = append(t.spans, span)
+	return span
+}
+
+// Tests that the trace context is propagated from the callers to the handlers.
+func TestTrace(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("trace-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	tracer := new(testTracer)
+	handler := &metaHandler{make(chan Metadata, 1), make(chan Metadata, 1)}
+	conn, err := node.Connect("trace-test", handler, WithTracer(tracer))
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer conn.Close()
+
+	// Requests should continue the span of the context
+	root := SpanContext{TraceId: "root-trace", SpanId: "root-span"}
+	if _, err := conn.RequestContext(ContextWithSpan(context.Background(), root), "trace-test", []byte{0x00}); err != nil {
+		t.Fatalf("failed to execute request: %v.", err)
+	}
+	tracer.lock.Lock()
+	spans := tracer.spans
+	tracer.spans = nil
+	tracer.lock.Unlock()
+
+	if len(spans) != 2 {
+		t.Fatalf("span count mismatch: have %v, want %v.", len(spans), 2)
+	}
+	if out := spans[0]; out.kind != SpanOutbound || out.call != CallRequest || out.parent != root {
+		t.Fatalf("outbound span mismatch: have %v/%v/%v, want %v/%v/%v.", out.kind, out.call, out.parent, SpanOutbound, CallRequest, root)
+	}
+	if in := spans[1]; in.kind != SpanInbound || in.call != CallRequest || in.parent != spans[0].self {
+		t.Fatalf("inbound span mismatch: have %v/%v/%v, want %v/%v/%v.", in.kind, in.call, in.parent, SpanInbound, CallRequest, spans[0].self)
+	}
+	for i, span := range spans {
+		select {
+		case err := <-span.done:
+			if err != nil {
+				t.Fatalf("span %d: finish error mismatch: have %v, want %v.", i, err, nil)
+			}
+		default:
+			t.Fatalf("span %d: not finished.", i)
+		}
+	}
+	// Broadcasts should start a new trace, handed to the handler in the metadata
+	if err := conn.Broadcast("trace-test", []byte{0x01}); err != nil {
+		t.Fatalf("failed to broadcast: %v.", err)
+	}
+	select {
+	case meta := <-handler.bcasts:
+		tracer.lock.Lock()
+		spans = tracer.spans
+		tracer.lock.Unlock()
+
+		if len(spans) != 2 {
+			t.Fatalf("span count mismatch: have %v, want %v.", len(spans), 2)
+		}
+		if spans[0].parent.Valid() {
+			t.Fatalf("outbound span continued invalid parent: %v.", spans[0].parent)
+		}
+		if have := SpanFromMetadata(meta); have != spans[1].self {
+			t.Fatalf("delivered span mismatch: have %v, want %v.", have, spans[1].self)
+		}
+		if spans[1].parent != spans[0].self {
+			t.Fatalf("inbound parent mismatch: have %v, want %v.", spans[1].parent, spans[0].self)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("broadcast not delivered.")
+	}
+}
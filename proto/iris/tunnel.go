@@ -20,18 +20,18 @@
 package iris
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/gob"
 	"errors"
 	"fmt"
 	"hash"
 	"io"
-	"log"
 	"net"
 	"sort"
+	"sync"
 	"time"
 
-	"code.google.com/p/go.crypto/hkdf"
 	"github.com/karalabe/iris/config"
 	"github.com/karalabe/iris/proto"
 	"github.com/karalabe/iris/proto/link"
@@ -42,11 +42,13 @@ import (
 type initPacket struct {
 	ConnId uint64 // Id of the Iris client connection requesting the tunnel
 	TunId  uint64 // Id of the tunnel being built
+	Epoch  uint32 // Link generation of a resumed tunnel (0 when first built)
 }
 
 // Authorization packet to send over the established encrypted tunnels.
 type authPacket struct {
-	Id uint64
+	Id   uint64
+	Recv uint64 // Last message received in order (resumed tunnels)
 }
 
 // Make sure the handshake packets are registered with gob.
@@ -91,9 +93,9 @@ func (o *Overlay) tunneler(ipnet *net.IPNet, live chan struct{}, quit chan chan
 
 			// Initialize and authorize the inbound tunnel
 			if err := o.initServerTunnel(strm); err != nil {
-				log.Printf("iris: failed to initialize server tunnel: %v.", err)
+				o.logger.Printf("iris: failed to initialize server tunnel: %v.", err)
 				if err := strm.Close(); err != nil {
-					log.Printf("iris: failed to terminate uninitialized tunnel stream: %v.", err)
+					o.logger.Printf("iris: failed to terminate uninitialized tunnel stream: %v.", err)
 				}
 			}
 		}
@@ -101,7 +103,7 @@ func (o *Overlay) tunneler(ipnet *net.IPNet, live chan struct{}, quit chan chan
 	// Terminate the peer listener
 	errv := sock.Close()
 	if errv != nil {
-		log.Printf("iris: failed to terminate tunnel listener: %v.", err)
+		o.logger.Printf("iris: failed to terminate tunnel listener: %v.", err)
 	}
 	errc <- errv
 }
@@ -109,25 +111,33 @@ func (o *Overlay) tunneler(ipnet *net.IPNet, live chan struct{}, quit chan chan
 // Communication stream between the local app and a remote endpoint. Ordered
 // message delivery is guaranteed.
 type Tunnel struct {
-	id    uint64      // Auto-incremented tunnel identifier
-	owner *Connection // Iris connection through which to communicate
+	id     uint64      // Auto-incremented tunnel identifier
+	owner  *Connection // Iris connection through which to communicate
+	target string      // Cluster of the remote endpoint if initiated, the local one otherwise
 
 	conn   *link.Link // Encrypted data link of the tunnel
 	secret []byte     // Master key from which to derive the link keys
 
-	init chan *link.Link // Channel to receive the reverse tunnel link
-	term chan struct{}   // Channel to signal termination to blocked go-routines
+	init     chan *link.Link // Channel to receive the reverse tunnel link
+	term     chan struct{}   // Channel to signal termination to blocked go-routines
+	termOnce sync.Once       // Guard against closing the termination channel twice
+
+	resume *resumer    // Resumption state of the tunnel (nil if not resumable)
+	trace  SpanContext // Span of the tunnel setup (zero if not traced)
 }
 
 // Initiates an outgoing tunnel to a remote cluster, by configuring a local
 // tunnel endpoint and requesting the remote client to connect to it.
-func (c *Connection) initiateTunnel(cluster string, timeout time.Duration) (*Tunnel, error) {
+func (c *Connection) initiateTunnel(ctx context.Context, cluster string, timeout time.Duration) (*Tunnel, error) {
+	o := c.carrier()
+
 	// Create a potential tunnel
 	c.tunLock.Lock()
 	tunId := c.tunIdx
 	tun := &Tunnel{
-		id:    tunId,
-		owner: c,
+		id:     tunId,
+		owner:  c,
+		target: cluster,
 
 		init: make(chan *link.Link, 1),
 		term: make(chan struct{}),
@@ -141,20 +151,33 @@ func (c *Connection) initiateTunnel(cluster string, timeout time.Duration) (*Tun
 	if _, err := io.ReadFull(rand.Reader, tun.secret); err != nil {
 		return nil, err
 	}
-	// Send the tunneling request
+	// Send the tunneling request, continuing the trace of the context
+	meta, span := c.traceOut(ctx, CallTunnel, cluster, nil)
+	if span != nil {
+		tun.trace = span.Context()
+	}
 	prefixIdx := int(tunId) % config.IrisClusterSplits
-	c.iris.scribe.Balance(clusterPrefixes[prefixIdx]+cluster, c.assembleTunnelRequest(tunId, tun.secret, c.iris.tunAddrs, timeout))
+	o.scribe.Balance(clusterPrefixes[prefixIdx]+cluster, attach(c.assembleTunnelRequest(tunId, tun.secret, o.tunAddrs, timeout), meta))
 
 	// Retrieve the results, time out or terminate
 	var err error
 	select {
 	case <-c.term:
 		err = ErrTerminating
+	case <-ctx.Done():
+		err = ctx.Err()
 	case <-time.After(timeout):
 		err = ErrTimeout
 	case tun.conn = <-tun.init:
-		// Clean up init fields
+		// Clean up init fields, keeping the secret if resumable
+		if c.tunGrace > 0 {
+			c.tunLock.Lock()
+			tun.resume = newResumer(tun, c.tunGrace, tunId, tun.secret)
+			c.tunLock.Unlock()
+			go tun.resume.run(tun.conn)
+		}
 		tun.secret, tun.init = nil, nil
+		finish(span, nil)
 		return tun, nil
 	}
 	// Tunneling failed, clean up and report error
@@ -162,21 +185,23 @@ func (c *Connection) initiateTunnel(cluster string, timeout time.Duration) (*Tun
 	delete(c.tunLive, tunId)
 	c.tunLock.Unlock()
 
+	finish(span, err)
 	return nil, err
 }
 
 // Accepts an incoming tunneling request from a remote, initializes and stores
 // the new tunnel into the connection state.
-func (c *Connection) buildTunnel(remote uint64, id uint64, key []byte, addrs []string, timeout time.Duration) (*Tunnel, error) {
+func (c *Connection) buildTunnel(remote uint64, id uint64, key []byte, addrs []string, timeout, grace time.Duration) (*Tunnel, error) {
 	deadline := time.Now().Add(timeout)
 
 	// Create the local tunnel endpoint
 	c.tunLock.Lock()
 	tunId := c.tunIdx
 	tun := &Tunnel{
-		id:    tunId,
-		owner: c,
-		term:  make(chan struct{}),
+		id:     tunId,
+		owner:  c,
+		target: c.cluster,
+		term:   make(chan struct{}),
 	}
 	c.tunIdx++
 	c.tunLive[tunId] = tun
@@ -196,7 +221,7 @@ func (c *Connection) buildTunnel(remote uint64, id uint64, key []byte, addrs []s
 		tun.conn, err = c.initClientTunnel(strm, remote, id, key, deadline)
 		if err != nil {
 			if err := strm.Close(); err != nil {
-				log.Printf("iris: failed to close uninitialized client tunnel stream: %v.", err)
+				c.carrier().logger.Printf("iris: failed to close uninitialized client tunnel stream: %v.", err)
 			}
 		}
 	}
@@ -207,6 +232,12 @@ func (c *Connection) buildTunnel(remote uint64, id uint64, key []byte, addrs []s
 		c.tunLock.Unlock()
 		return nil, err
 	}
+	// Keep the tunnel alive through link failures if requested
+	if grace > 0 {
+		tun.resume = newResumer(tun, grace, id, key)
+		tun.resume.redial(remote, addrs)
+		go tun.resume.run(tun.conn)
+	}
 	return tun, nil
 }
 
@@ -214,7 +245,6 @@ func (c *Connection) buildTunnel(remote uint64, id uint64, key []byte, addrs []s
 func (o *Overlay) initServerTunnel(strm *stream.Stream) error {
 	// Set a socket deadline for finishing the handshake
 	strm.Sock().SetDeadline(time.Now().Add(config.IrisTunnelInitTimeout))
-	defer strm.Sock().SetDeadline(time.Time{})
 
 	// Fetch the unencrypted client initiator
 	init := new(initPacket)
@@ -233,10 +263,23 @@ func (o *Overlay) initServerTunnel(strm *stream.Stream) error {
 	if !ok {
 		return errors.New("tunnel not found")
 	}
+	// Hand the streams of broken resumable tunnels over to their resumer, along
+	// with the handshake deadline
+	if init.Epoch > 0 {
+		c.tunLock.RLock()
+		res := tun.resume
+		c.tunLock.RUnlock()
+		if res == nil {
+			return errors.New("tunnel not resumable")
+		}
+		return res.relinked(strm, init.Epoch)
+	}
+	defer strm.Sock().SetDeadline(time.Time{})
+
 	// Create the encrypted link
 	hasher := func() hash.Hash { return config.HkdfHash.New() }
-	hkdf := hkdf.New(hasher, tun.secret, config.HkdfSalt, config.HkdfInfo)
-	conn := link.New(strm, hkdf, true)
+	hkdf := config.SessionKdf(hasher, tun.secret, config.HkdfSalt, config.HkdfInfo)
+	conn := link.New(strm, hkdf, config.SuiteAes, true)
 
 	// Send and retrieve an authorization to verify both directions
 	auth := &proto.Message{
@@ -272,8 +315,8 @@ func (c *Connection) initClientTunnel(strm *stream.Stream, remote uint64, id uin
 	}
 	// Create the encrypted link and authorize it
 	hasher := func() hash.Hash { return config.HkdfHash.New() }
-	hkdf := hkdf.New(hasher, key, config.HkdfSalt, config.HkdfInfo)
-	conn := link.New(strm, hkdf, false)
+	hkdf := config.SessionKdf(hasher, key, config.HkdfSalt, config.HkdfInfo)
+	conn := link.New(strm, hkdf, config.SuiteAes, false)
 
 	// Send and retrieve an authorization to verify both directions
 	auth := &proto.Message{
@@ -295,14 +338,36 @@ func (c *Connection) initClientTunnel(strm *stream.Stream, remote uint64, id uin
 	return conn, nil
 }
 
+// Returns the span context of the tunnel setup, which is only valid if the
+// connection has a tracer.
+func (t *Tunnel) Trace() SpanContext {
+	return t.trace
+}
+
 // Closes the tunnel connection.
 func (t *Tunnel) Close() error {
+	if t.resume != nil {
+		return t.resume.close()
+	}
 	// Terminate the encrypted link
 	return t.conn.Close()
 }
 
 // Sends an asynchronous message to the remote pair. Not reentrant (order).
 func (t *Tunnel) Send(msg []byte) error {
+	err := t.send(msg)
+	if err == nil {
+		t.owner.statCluster(t.target, func(s *TargetStats) { s.TunnelBytesSent += uint64(len(msg)) })
+	}
+	return err
+}
+
+// Sends an asynchronous message to the remote pair, either directly through the
+// link or via the resumption layer.
+func (t *Tunnel) send(msg []byte) error {
+	if t.resume != nil {
+		return t.resume.send(msg)
+	}
 	// Create and encrypt the message
 	packet := &proto.Message{Data: msg}
 	if err := packet.Encrypt(); err != nil {
@@ -320,12 +385,30 @@ func (t *Tunnel) Send(msg []byte) error {
 // Retrieves a message waiting in the local queue. If none is available, the
 // call blocks until either one arrives or a timeout is reached.
 func (t *Tunnel) Recv(timeout time.Duration) ([]byte, error) {
+	return t.recv(time.After(timeout))
+}
+
+// Retrieves a message waiting in the local queue, blocking until one arrives or
+// the expiry channel fires (nil to wait indefinitely).
+func (t *Tunnel) recv(expiry <-chan time.Time) ([]byte, error) {
+	msg, err := t.fetch(expiry)
+	if err == nil {
+		t.owner.statCluster(t.target, func(s *TargetStats) { s.TunnelBytesRecv += uint64(len(msg)) })
+	}
+	return msg, err
+}
+
+// Fetches a message either directly from the link or via the resumption layer.
+func (t *Tunnel) fetch(expiry <-chan time.Time) ([]byte, error) {
+	if t.resume != nil {
+		return t.resume.recv(expiry)
+	}
 	// Retrieve an encrypted packet from the tunnel link
 	select {
 	case packet, ok := <-t.conn.Recv:
 		// Terminate the tunnel if closed remotely
 		if !ok {
-			close(t.term)
+			t.termOnce.Do(func() { close(t.term) })
 			return nil, ErrTerminating
 		}
 		// Decrypt and pass upstream
@@ -334,7 +417,7 @@ func (t *Tunnel) Recv(timeout time.Duration) ([]byte, error) {
 		}
 		return packet.Data, nil
 
-	case <-time.After(timeout):
+	case <-expiry:
 		return nil, ErrTimeout
 	}
 }
@@ -21,8 +21,10 @@ package iris
 
 import (
 	"bytes"
+	"crypto/rand"
 	"crypto/x509"
 	"fmt"
+	"io"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -41,7 +43,7 @@ func (r *tunneler) HandleBroadcast(msg []byte) {
 	panic("Broadcast passed to tunnel handler")
 }
 
-func (r *tunneler) HandleRequest(req []byte, timeout time.Duration) []byte {
+func (r *tunneler) HandleRequest(req []byte, timeout time.Duration) ([]byte, error) {
 	panic("Request passed to tunnel handler")
 }
 
@@ -89,9 +91,7 @@ func testTunnel(t *testing.T, nodes, conns, tuns, msgs int) {
 	defer swapConfigs()
 
 	olds := config.BootPorts
-	for i := 0; i < nodes; i++ {
-		config.BootPorts = append(config.BootPorts, 65000+i)
-	}
+	config.BootPorts = append(config.BootPorts, fmt.Sprintf("65000-%d", 65000+nodes-1))
 	defer func() { config.BootPorts = olds }()
 
 	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
@@ -187,3 +187,84 @@ func testTunnel(t *testing.T, nodes, conns, tuns, msgs int) {
 		}
 	}
 }
+
+// Connection handler echoing the tunnel byte streams.
+type streamer struct{}
+
+func (r *streamer) HandleBroadcast(msg []byte) {
+	panic("Broadcast passed to stream handler")
+}
+
+func (r *streamer) HandleRequest(req []byte, timeout time.Duration) ([]byte, error) {
+	panic("Request passed to stream handler")
+}
+
+func (r *streamer) HandleTunnel(tun *Tunnel) {
+	strm := tun.Stream()
+	io.Copy(strm, strm)
+	strm.Close()
+}
+
+func (r *streamer) HandleDrop(reason error) {
+	panic("Connection dropped on stream handler")
+}
+
+// Tests that the byte stream adapter reframes arbitrary writes transparently.
+func TestTunnelStream(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	frame := config.IrisTunnelFrame
+	config.IrisTunnelFrame = 1000
+	defer func() { config.IrisTunnelFrame = frame }()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("tunnel-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	conn, err := node.Connect("tunnel-stream-test", &streamer{})
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer conn.Close()
+
+	tun, err := conn.Tunnel("tunnel-stream-test", time.Second)
+	if err != nil {
+		t.Fatalf("failed to establish tunnel: %v.", err)
+	}
+	strm := tun.Stream()
+	defer strm.Close()
+
+	// Write a large blob in uneven pieces and read it back echoed
+	data := make([]byte, 1024*1024)
+	rand.Read(data)
+
+	errc := make(chan error, 1)
+	go func() {
+		for i := 0; i < len(data); i += 7777 {
+			end := i + 7777
+			if end > len(data) {
+				end = len(data)
+			}
+			if _, err := strm.Write(data[i:end]); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- nil
+	}()
+	echo := make([]byte, len(data))
+	if _, err := io.ReadFull(strm, echo); err != nil {
+		t.Fatalf("failed to read echoed stream: %v.", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("failed to write stream: %v.", err)
+	}
+	if !bytes.Equal(echo, data) {
+		t.Fatalf("stream data mismatch.")
+	}
+}
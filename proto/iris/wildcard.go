@@ -0,0 +1,92 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the wildcard topic matching. Topics are hierarchical, their levels
+// separated by slashes. A subscription pattern may contain single level ("+")
+// and multi level ("#", only as the last level) wildcards. As topics are mapped
+// onto the overlay by hashing, pattern subscriptions join the channel of their
+// literal root (the levels before the first wildcard) instead, and publications
+// are relayed into the channels of all their ancestors too, filtered against the
+// patterns by the receiving nodes before reaching the applications.
+
+package iris
+
+import (
+	"strings"
+)
+
+// Checks whether a topic contains wildcard levels, i.e. whether it's a pattern.
+func isPattern(topic string) bool {
+	for _, level := range strings.Split(topic, "/") {
+		if level == "+" || level == "#" {
+			return true
+		}
+	}
+	return false
+}
+
+// Verifies that multi level wildcards are only used as the last pattern level.
+func checkPattern(pattern string) error {
+	levels := strings.Split(pattern, "/")
+	for i, level := range levels {
+		if level == "#" && i != len(levels)-1 {
+			return ErrInvalidPattern
+		}
+	}
+	return nil
+}
+
+// Retrieves the literal root of a pattern: the levels before the first wildcard.
+func patternRoot(pattern string) string {
+	levels := strings.Split(pattern, "/")
+	for i, level := range levels {
+		if level == "+" || level == "#" {
+			return strings.Join(levels[:i], "/")
+		}
+	}
+	return pattern
+}
+
+// Collects the roots a pattern subscribed to topic may join through: the empty
+// root and every prefix of the topic's levels, including the whole topic.
+func topicRoots(topic string) []string {
+	levels := strings.Split(topic, "/")
+
+	roots := make([]string, 0, len(levels)+1)
+	roots = append(roots, "")
+	for i := 1; i <= len(levels); i++ {
+		roots = append(roots, strings.Join(levels[:i], "/"))
+	}
+	return roots
+}
+
+// Matches a concrete topic against a subscription pattern. A multi level wildcard
+// also matches the parent level itself (i.e. "a/#" matches "a").
+func matchPattern(pattern, topic string) bool {
+	pats, levels := strings.Split(pattern, "/"), strings.Split(topic, "/")
+	for i, pat := range pats {
+		if pat == "#" {
+			return true
+		}
+		if i >= len(levels) || (pat != "+" && pat != levels[i]) {
+			return false
+		}
+	}
+	return len(pats) == len(levels)
+}
@@ -0,0 +1,148 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package iris
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		topic   string
+		match   bool
+	}{
+		{"sensors/+/temp", "sensors/kitchen/temp", true},
+		{"sensors/+/temp", "sensors/kitchen/humidity", false},
+		{"sensors/+/temp", "sensors/temp", false},
+		{"sensors/+/temp", "sensors/a/b/temp", false},
+		{"sensors/+", "sensors/kitchen", true},
+		{"sensors/+", "sensors", false},
+		{"logs/#", "logs", true},
+		{"logs/#", "logs/app/error", true},
+		{"logs/#", "logsx/app", false},
+		{"#", "anything/at/all", true},
+		{"+/+", "a/b", true},
+		{"+/+", "a/b/c", false},
+	}
+	for i, tt := range tests {
+		if match := matchPattern(tt.pattern, tt.topic); match != tt.match {
+			t.Errorf("test %d: match mismatch for %s on %s: have %v, want %v.", i, tt.pattern, tt.topic, match, tt.match)
+		}
+	}
+}
+
+func TestPatternRoots(t *testing.T) {
+	// Invalid patterns should be detected
+	if err := checkPattern("logs/#/error"); err != ErrInvalidPattern {
+		t.Fatalf("pattern check mismatch: have %v, want %v.", err, ErrInvalidPattern)
+	}
+	if err := checkPattern("logs/+/#"); err != nil {
+		t.Fatalf("failed to accept valid pattern: %v.", err)
+	}
+	// Every pattern matching a topic should be rooted in one of its roots
+	roots := make(map[string]bool)
+	for _, root := range topicRoots("sensors/kitchen/temp") {
+		roots[root] = true
+	}
+	for _, pattern := range []string{"#", "+/kitchen/temp", "sensors/#", "sensors/+/temp", "sensors/kitchen/+"} {
+		if root := patternRoot(pattern); !roots[root] {
+			t.Errorf("pattern %s root %s not among the topic roots: %v.", pattern, root, roots)
+		}
+	}
+}
+
+// Tests that wildcard subscriptions receive all matching events and only those.
+func TestPubSubWildcard(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Boot a single iris node with a few pattern subscribers
+	node := New("pubsub-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := node.Shutdown(); err != nil {
+			t.Fatalf("failed to terminate iris node: %v.", err)
+		}
+	}()
+	conn, err := node.Connect("pubsub-test-wildcard", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer conn.Close()
+
+	if err := conn.SubscribePull("sensors/+/temp", &subscriber{make(chan []byte, 1)}); err != ErrPatternPull {
+		t.Fatalf("pull pattern error mismatch: have %v, want %v.", err, ErrPatternPull)
+	}
+	if err := conn.Subscribe("logs/#/error", &subscriber{make(chan []byte, 1)}); err != ErrInvalidPattern {
+		t.Fatalf("invalid pattern error mismatch: have %v, want %v.", err, ErrInvalidPattern)
+	}
+	temps, logs := &subscriber{make(chan []byte, 100)}, &subscriber{make(chan []byte, 100)}
+	if err := conn.Subscribe("sensors/+/temp", temps); err != nil {
+		t.Fatalf("failed to subscribe to pattern: %v.", err)
+	}
+	if err := conn.Subscribe("logs/#", logs); err != nil {
+		t.Fatalf("failed to subscribe to pattern: %v.", err)
+	}
+	if err := conn.Subscribe("logs/#", logs); err != ErrSubscribed {
+		t.Fatalf("double subscription error mismatch: have %v, want %v.", err, ErrSubscribed)
+	}
+	// Publish a mix of matching and non-matching events
+	for _, topic := range []string{"sensors/kitchen/temp", "sensors/kitchen/humidity", "sensors/garage/temp", "logs", "logs/app/error", "other"} {
+		if err := conn.Publish(topic, []byte(topic)); err != nil {
+			t.Fatalf("failed to publish event: %v.", err)
+		}
+	}
+	if err := conn.Publish("sensors/+/temp", nil); err != ErrPatternTopic {
+		t.Fatalf("pattern publish error mismatch: have %v, want %v.", err, ErrPatternTopic)
+	}
+	time.Sleep(250 * time.Millisecond)
+
+	if n := len(temps.msgs); n != 2 {
+		t.Fatalf("temperature event count mismatch: have %d, want %d.", n, 2)
+	}
+	if n := len(logs.msgs); n != 2 {
+		t.Fatalf("log event count mismatch: have %d, want %d.", n, 2)
+	}
+	if msg := string(<-temps.msgs); msg != "sensors/kitchen/temp" && msg != "sensors/garage/temp" {
+		t.Fatalf("unexpected temperature event: %s.", msg)
+	}
+	// Unsubscribe and make sure no more events arrive
+	if err := conn.Unsubscribe("sensors/+/temp"); err != nil {
+		t.Fatalf("failed to unsubscribe from pattern: %v.", err)
+	}
+	if err := conn.Unsubscribe("sensors/+/temp"); err != ErrNotSubscribed {
+		t.Fatalf("double unsubscribe error mismatch: have %v, want %v.", err, ErrNotSubscribed)
+	}
+	if err := conn.Publish("sensors/attic/temp", nil); err != nil {
+		t.Fatalf("failed to publish event: %v.", err)
+	}
+	time.Sleep(250 * time.Millisecond)
+	if n := len(temps.msgs); n != 1 {
+		t.Fatalf("temperature event count mismatch: have %d, want %d.", n, 1)
+	}
+}
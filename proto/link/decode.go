@@ -0,0 +1,231 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the offline decoder of captured link traffic. Given the key
+// material of a direction (as logged into config.SessionKeyLog), the frames of
+// a raw TCP stream capture are authenticated, decrypted and decoded.
+
+package link
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/crypto/chacha20"
+	"github.com/karalabe/iris/proto"
+)
+
+// Lock serializing the writes into the key log.
+var keyLogLock sync.Mutex
+
+// Appends the key material of the two directions of a link to the key log, one
+// line each in the form of "<source> <destination> <suite> <hex keys>".
+func logKeys(sock net.Conn, suite string, in, out []byte) {
+	keyLogLock.Lock()
+	defer keyLogLock.Unlock()
+
+	file, err := os.OpenFile(config.SessionKeyLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		log.Printf("link: failed to open key log: %v.", err)
+		return
+	}
+	defer file.Close()
+
+	local, remote := sock.LocalAddr(), sock.RemoteAddr()
+	fmt.Fprintf(file, "%v %v %s %x\n", local, remote, suite, out)
+	fmt.Fprintf(file, "%v %v %s %x\n", remote, local, suite, in)
+}
+
+// Key log entry of a single link direction.
+type KeyLogEntry struct {
+	Source      string // Address of the sending endpoint
+	Destination string // Address of the receiving endpoint
+	Suite       string // Cipher suite of the keys
+	Keys        []byte // Raw key material of the direction
+}
+
+// Parses the contents of a key log.
+func ParseKeyLog(r io.Reader) ([]*KeyLogEntry, error) {
+	var entries []*KeyLogEntry
+	for {
+		var src, dst, suite, keys string
+		if n, err := fmt.Fscanln(r, &src, &dst, &suite, &keys); err != nil {
+			if err == io.EOF && n == 0 {
+				return entries, nil
+			}
+			return nil, fmt.Errorf("malformed key log entry: %v", err)
+		}
+		raw, err := hex.DecodeString(keys)
+		if err != nil {
+			return nil, fmt.Errorf("malformed key material: %v", err)
+		}
+		entries = append(entries, &KeyLogEntry{src, dst, suite, raw})
+	}
+}
+
+// A single frame decoded from a captured link direction.
+type Frame struct {
+	Index    int          // Position of the frame in the direction
+	Envelope int          // Envelope version the frame was wrapped in
+	Head     proto.Header // Decrypted message headers
+	Data     []byte       // Message payload (encrypted if the headers contain a key)
+	Suite    string       // Cipher suite the frame was protected with
+}
+
+// Offline decoder of a single link direction.
+type Decoder struct {
+	suite  string        // Cipher suite currently in effect
+	cipher cipher.Stream // Stream cipher of the headers
+	macer  hash.Hash     // MAC of the frames
+	secret []byte        // Secret to derive any renegotiated keys from
+
+	buffer bytes.Buffer // Decrypted header stream
+	coder  *gob.Decoder // Header decoder of the gob stream
+	frames int          // Number of frames decoded so far
+}
+
+// Creates a decoder of a link direction from its logged key material.
+func NewDecoder(keys []byte, suite string) (*Decoder, error) {
+	if err := checkSuite(suite); err != nil {
+		return nil, err
+	}
+	if size, err := keySize(suite); err != nil {
+		return nil, err
+	} else if len(keys) != size {
+		return nil, fmt.Errorf("key material size mismatch: have %d, want %d", len(keys), size)
+	}
+	d := &Decoder{suite: suite}
+	d.cipher, d.macer, d.secret = makeHalfDuplex(bytes.NewReader(keys), suite)
+	d.coder = gob.NewDecoder(&d.buffer)
+	return d, nil
+}
+
+// Calculates the size of the key material of a direction in the given suite.
+func keySize(suite string) (int, error) {
+	size := config.SessionHash().Size()
+	switch suite {
+	case config.SuiteAes:
+		block, err := config.SessionCipher(make([]byte, config.SessionCipherBits/8))
+		if err != nil {
+			return 0, err
+		}
+		size += config.SessionCipherBits/8 + block.BlockSize()
+	case config.SuiteChaCha:
+		size += chacha20.KeySize + chacha20.NonceSize
+	}
+	return size, nil
+}
+
+// Authenticates and decodes the next frame of the direction from its header,
+// payload and mac records. Frames must be fed in their original order.
+func (d *Decoder) Decode(head, data, mac []byte) (*Frame, error) {
+	d.macer.Write(head)
+	d.macer.Write(data)
+	if !bytes.Equal(mac, d.macer.Sum(nil)) {
+		return nil, errors.New("mac mismatch")
+	}
+	if err := checkEnvelope(head); err != nil {
+		return nil, err
+	}
+	frame := &Frame{
+		Index:    d.frames,
+		Envelope: int(head[1]),
+		Data:     data,
+		Suite:    d.suite,
+	}
+	plain := make([]byte, len(head)-envelopeSize)
+	d.cipher.XORKeyStream(plain, head[envelopeSize:])
+	d.buffer.Write(plain)
+	if err := d.coder.Decode(&frame.Head); err != nil {
+		return nil, err
+	}
+	d.frames++
+
+	// Follow any renegotiations to the new keys
+	if pkt, ok := frame.Head.Meta.(*renegPacket); ok {
+		if err := checkSuite(pkt.Suite); err != nil {
+			return nil, err
+		}
+		d.cipher, d.macer, d.secret = makeRenegotiated(d.secret, pkt.Suite)
+		d.suite = pkt.Suite
+	}
+	return frame, nil
+}
+
+// Decodes all the frames of a raw TCP direction capture, skipping the records
+// that are not link frames (i.e. the session handshake), invoking the handler
+// for each frame in order.
+func (d *Decoder) DecodeStream(r io.Reader, handler func(*Frame)) error {
+	dec := gob.NewDecoder(r)
+
+	var records [3][]byte
+	for {
+		// Fetch the next record, skipping anything not a byte slice
+		var rec []byte
+		if err := dec.Decode(&rec); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			if err == io.ErrUnexpectedEOF {
+				return err
+			}
+			continue
+		}
+		// Frames start with an envelope, followed by the payload and mac
+		if checkEnvelope(rec) != nil {
+			continue
+		}
+		records[0] = rec
+		for i := 1; i < len(records); i++ {
+			if err := dec.Decode(&records[i]); err != nil {
+				return fmt.Errorf("truncated frame %d: %v", d.frames, err)
+			}
+		}
+		frame, err := d.Decode(records[0], records[1], records[2])
+		if err != nil {
+			return fmt.Errorf("failed to decode frame %d: %v", d.frames, err)
+		}
+		handler(frame)
+	}
+}
+
+// Returns the name of a frame's control packet, or the type of its metadata.
+func (f *Frame) Kind() string {
+	switch f.Head.Meta.(type) {
+	case nil:
+		return "data"
+	case *closePacket:
+		return "close"
+	case *renegPacket:
+		return "renegotiate"
+	default:
+		return fmt.Sprintf("%T", f.Head.Meta)
+	}
+}
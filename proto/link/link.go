@@ -33,7 +33,9 @@ import (
 	"net"
 	"time"
 
+	"github.com/karalabe/iris/audit"
 	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/crypto/chacha20"
 	"github.com/karalabe/iris/proto"
 	"github.com/karalabe/iris/proto/stream"
 )
@@ -42,9 +44,44 @@ import (
 type closePacket struct {
 }
 
-// Make sure the close packet is registered with gob.
+// In-band renegotiation message, after which the sender direction switches to
+// fresh keys of the requested cipher suite. Requests are answered by a reply in
+// the reverse direction, switching that too.
+type renegPacket struct {
+	Suite string
+	Reply bool
+}
+
+// Plaintext marker prefixing the header part of every frame, identifying the
+// frame layout on the wire (magic byte and envelope version).
+const (
+	envelopeMagic   = 0x1e
+	envelopeVersion = 1
+	envelopeSize    = 2
+)
+
+// Failure reported if a frame is not wrapped in a known envelope.
+var ErrEnvelope = errors.New("unknown frame envelope")
+
+// Make sure the control packets are registered with gob.
 func init() {
 	gob.Register(&closePacket{})
+	gob.Register(&renegPacket{})
+}
+
+// Kinds of events reported by a live link.
+const (
+	EventRenegSend = "renegotiated-outbound" // Outbound direction switched keys
+	EventRenegRecv = "renegotiated-inbound"  // Inbound direction switched keys
+)
+
+// Number of unconsumed link events buffered before dropping new ones.
+const eventBuffer = 16
+
+// Notification about a change in the state of a live link.
+type Event struct {
+	Kind  string // Type of the event, one of the above kinds
+	Suite string // Cipher suite in effect after the event
 }
 
 // Accomplishes secure and authenticated full duplex communication. Note, only
@@ -59,6 +96,9 @@ type Link struct {
 	inMacer  hash.Hash
 	outMacer hash.Hash
 
+	inSecret  []byte // Secret to derive the next inbound keys from
+	outSecret []byte // Secret to derive the next outbound keys from
+
 	inBuffer  bytes.Buffer
 	outBuffer bytes.Buffer
 
@@ -70,24 +110,36 @@ type Link struct {
 
 	Send     chan *proto.Message
 	Recv     chan *proto.Message
+	Events   chan *Event       // Link state changes (dropped if not consumed)
+	reneg    chan *renegPacket // Pending outbound renegotiation
 	sendQuit chan chan error
 	recvQuit chan chan error
 }
 
-// Creates a new, full-duplex encrypted link from the negotiated secret. The
-// client is used to decide the key derivation order for the two half-duplex
-// channels (server keys first, client key second).
-func New(conn *stream.Stream, hkdf io.Reader, server bool) *Link {
+// Creates a new, full-duplex encrypted link from the negotiated secret and
+// cipher suite. The client is used to decide the key derivation order for the
+// two half-duplex channels (server keys first, client key second).
+func New(conn *stream.Stream, hkdf io.Reader, suite string, server bool) *Link {
 	l := &Link{
 		socket: conn,
 	}
-	// Create the duplex channel
-	sc, sm := makeHalfDuplex(hkdf)
-	cc, cm := makeHalfDuplex(hkdf)
+	// Create the duplex channel, capturing the raw key material if logging
+	var skeys, ckeys bytes.Buffer
+	sc, sm, ss := makeHalfDuplex(io.TeeReader(hkdf, &skeys), suite)
+	cc, cm, cs := makeHalfDuplex(io.TeeReader(hkdf, &ckeys), suite)
 	if server {
 		l.inCipher, l.outCipher, l.inMacer, l.outMacer = cc, sc, cm, sm
+		l.inSecret, l.outSecret = cs, ss
 	} else {
 		l.inCipher, l.outCipher, l.inMacer, l.outMacer = sc, cc, sm, cm
+		l.inSecret, l.outSecret = ss, cs
+	}
+	if config.SessionKeyLog != "" && conn != nil {
+		in, out := ckeys.Bytes(), skeys.Bytes()
+		if !server {
+			in, out = out, in
+		}
+		logKeys(conn.Sock(), suite, in, out)
 	}
 	// Create the gob coders
 	l.inCoder = gob.NewDecoder(&l.inBuffer)
@@ -97,8 +149,49 @@ func New(conn *stream.Stream, hkdf io.Reader, server bool) *Link {
 }
 
 // Assembles the crypto primitives needed for a one way communication channel:
-// the stream cipher for encryption and the mac for authentication.
-func makeHalfDuplex(hkdf io.Reader) (cipher.Stream, hash.Hash) {
+// the stream cipher of the suite for encryption and the mac for authentication.
+// The mac key is returned too, as the secret to derive any later keys from.
+func makeHalfDuplex(hkdf io.Reader, suite string) (cipher.Stream, hash.Hash, []byte) {
+	var stream cipher.Stream
+	switch suite {
+	case config.SuiteAes:
+		stream = makeCtrStream(hkdf)
+	case config.SuiteChaCha:
+		stream = makeChaChaStream(hkdf)
+	default:
+		panic(fmt.Sprintf("Unknown session cipher suite: %s", suite))
+	}
+	// Extract the HMAC key and create the session MACer
+	salt := make([]byte, config.SessionHash().Size())
+	n, err := io.ReadFull(hkdf, salt)
+	if n != len(salt) || err != nil {
+		panic(fmt.Sprintf("Failed to extract session mac salt: %v", err))
+	}
+	mac := hmac.New(config.SessionHash, salt)
+
+	return stream, mac, salt
+}
+
+// Derives the primitives of a one way channel after a renegotiation, expanding
+// the secret of the previous keys (bound to the new suite) with the session KDF.
+func makeRenegotiated(secret []byte, suite string) (cipher.Stream, hash.Hash, []byte) {
+	hasher := func() hash.Hash { return config.HkdfHash.New() }
+	return makeHalfDuplex(config.SessionKdf(hasher, secret, config.HkdfSalt, []byte("link renegotiation: "+suite)), suite)
+}
+
+// Verifies that a cipher suite is known and allowed in the current crypto mode.
+func checkSuite(suite string) error {
+	switch {
+	case suite != config.SuiteAes && suite != config.SuiteChaCha:
+		return fmt.Errorf("unknown cipher suite %s", suite)
+	case config.FipsMode && suite != config.SuiteAes:
+		return fmt.Errorf("cipher suite %s not allowed in fips mode", suite)
+	}
+	return nil
+}
+
+// Creates the counter mode block cipher stream of the AES suite.
+func makeCtrStream(hkdf io.Reader) cipher.Stream {
 	// Extract the symmetric key and create the block cipher
 	key := make([]byte, config.SessionCipherBits/8)
 	n, err := io.ReadFull(hkdf, key)
@@ -115,17 +208,27 @@ func makeHalfDuplex(hkdf io.Reader) (cipher.Stream, hash.Hash) {
 	if n != len(iv) || err != nil {
 		panic(fmt.Sprintf("Failed to extract session IV: %v", err))
 	}
-	stream := cipher.NewCTR(block, iv)
+	return cipher.NewCTR(block, iv)
+}
 
-	// Extract the HMAC key and create the session MACer
-	salt := make([]byte, config.SessionHash().Size())
-	n, err = io.ReadFull(hkdf, salt)
-	if n != len(salt) || err != nil {
-		panic(fmt.Sprintf("Failed to extract session mac salt: %v", err))
+// Creates the ChaCha20 stream of the software friendly suite.
+func makeChaChaStream(hkdf io.Reader) cipher.Stream {
+	// Extract the key and nonce for the stream cipher
+	key := make([]byte, chacha20.KeySize)
+	n, err := io.ReadFull(hkdf, key)
+	if n != len(key) || err != nil {
+		panic(fmt.Sprintf("Failed to extract session key: %v", err))
 	}
-	mac := hmac.New(config.SessionHash, salt)
-
-	return stream, mac
+	nonce := make([]byte, chacha20.NonceSize)
+	n, err = io.ReadFull(hkdf, nonce)
+	if n != len(nonce) || err != nil {
+		panic(fmt.Sprintf("Failed to extract session nonce: %v", err))
+	}
+	stream, err := chacha20.New(key, nonce)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create session cipher: %v", err))
+	}
+	return stream
 }
 
 // Creates the buffer channels and starts the transfer processes.
@@ -133,6 +236,8 @@ func (l *Link) Start(cap int) {
 	// Create the data and quit channels
 	l.Send = make(chan *proto.Message, cap)
 	l.Recv = make(chan *proto.Message, cap)
+	l.Events = make(chan *Event, eventBuffer)
+	l.reneg = make(chan *renegPacket, 1)
 	l.sendQuit = make(chan chan error)
 	l.recvQuit = make(chan chan error)
 
@@ -141,34 +246,113 @@ func (l *Link) Start(cap int) {
 	go l.receiver()
 }
 
+// Requests an in-band switch of the link to fresh keys of the given cipher suite
+// (renegotiating the current suite merely rekeys) without interrupting the data
+// transfers. The outbound direction switches as soon as the request is sent, the
+// inbound one when the remote side replies. Progress is reported on Events.
+func (l *Link) Renegotiate(suite string) error {
+	if err := checkSuite(suite); err != nil {
+		return err
+	}
+	if l.reneg == nil {
+		return errors.New("link not started")
+	}
+	select {
+	case l.reneg <- &renegPacket{Suite: suite}:
+		return nil
+	default:
+		return errors.New("renegotiation already pending")
+	}
+}
+
+// Sends a renegotiation packet and switches the outbound direction to the new
+// keys. Runs on the sender routine, which owns the outbound state.
+func (l *Link) renegotiate(pkt *renegPacket) error {
+	if err := l.SendDirect(&proto.Message{Head: proto.Header{Meta: pkt}}); err != nil {
+		return err
+	}
+	l.outCipher, l.outMacer, l.outSecret = makeRenegotiated(l.outSecret, pkt.Suite)
+
+	l.notify(EventRenegSend, pkt.Suite)
+	return nil
+}
+
+// Reports a link event, dropping it if the consumer is lagging.
+func (l *Link) notify(kind, suite string) {
+	select {
+	case l.Events <- &Event{Kind: kind, Suite: suite}:
+	default:
+	}
+}
+
+// Stages of a graceful link tear-down.
+const (
+	StageFlush = "flush" // Sending the queued messages and the close packet
+	StageDrain = "drain" // Receiving inbound messages until the remote close packet
+	StageClose = "close" // Delivering leftover socket data and closing it
+)
+
+// Progress report of a graceful link tear-down that failed or overran the time
+// budget of one of its stages, detailing what was abandoned.
+type CloseError struct {
+	Stage   string        // First stage that failed
+	Elapsed time.Duration // Time spent in the failing stage
+	Unsent  int           // Outbound messages abandoned in the send queue
+	Err     error         // Underlying failure
+}
+
+// Implements the error interface.
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("%s stage failed after %v (%d messages unsent): %v", e.Stage, e.Elapsed, e.Unsent, e.Err)
+}
+
+// Returns whether the stage was abandoned due to overrunning its deadline.
+func (e *CloseError) Timeout() bool {
+	nerr, ok := e.Err.(net.Error)
+	return ok && nerr.Timeout()
+}
+
 // Terminates any live data transfer go routines and closes the underlying sock.
+// Each stage of the tear-down is bounded by its own deadline, and the first one
+// failing or overrunning it is reported as a *CloseError.
 func (l *Link) Close() error {
-	var res error
-
-	// Set a maximum timeout for the graceful closes to finish
-	l.socket.Sock().SetDeadline(time.Now().Add(config.SessionGraceTimeout))
+	var res *CloseError
 
 	// Terminate the sender, giving it a chance to deliver queued messages
 	if l.sendQuit != nil {
+		start := time.Now()
+		l.socket.Sock().SetWriteDeadline(start.Add(config.SessionFlushTimeout))
+
 		errc := make(chan error)
 		l.sendQuit <- errc
-		if err := <-errc; res == nil {
-			res = err
+		if err := <-errc; err != nil {
+			res = &CloseError{Stage: StageFlush, Elapsed: time.Since(start), Unsent: len(l.Send), Err: err}
 		}
 	}
 	// Terminate the receiver, giving it a chance to deliver until remotely closed
 	if l.recvQuit != nil {
+		start := time.Now()
+		l.socket.Sock().SetReadDeadline(start.Add(config.SessionDrainTimeout))
+
 		errc := make(chan error)
 		l.recvQuit <- errc
-		if err := <-errc; res == nil {
-			res = err
+		if err := <-errc; err != nil && res == nil {
+			res = &CloseError{Stage: StageDrain, Elapsed: time.Since(start), Err: err}
 		}
 	}
-	// Terminate the network stream socket
-	if err := l.socket.Close(); res == nil {
-		res = err
+	// Terminate the network stream socket, cutting any stuck transfer short
+	start := time.Now()
+	l.socket.Sock().SetDeadline(start.Add(config.SessionCloseTimeout))
+	if err := l.socket.Close(); err != nil && res == nil {
+		res = &CloseError{Stage: StageClose, Elapsed: time.Since(start), Err: err}
+	}
+	if res != nil {
+		if res.Timeout() {
+			log.Printf("link: graceful close abandoned: %v.", res)
+		}
+		return res
 	}
-	return res
+	return nil
 }
 
 // The actual message sending logic. Calculates the payload MAC, encrypts the
@@ -182,11 +366,13 @@ func (l *Link) SendDirect(msg *proto.Message) error {
 		log.Printf("link: unsecured data, send denied.")
 		return errors.New("unsecured data, send denied")
 	}
-	// Flatten and encrypt the headers
+	// Flatten and encrypt the headers, leaving the envelope in plaintext
+	l.outBuffer.Write([]byte{envelopeMagic, envelopeVersion})
 	if err = l.outCoder.Encode(msg.Head); err != nil {
+		l.outBuffer.Reset()
 		return err
 	}
-	l.outCipher.XORKeyStream(l.outBuffer.Bytes(), l.outBuffer.Bytes())
+	l.outCipher.XORKeyStream(l.outBuffer.Bytes()[envelopeSize:], l.outBuffer.Bytes()[envelopeSize:])
 	defer l.outBuffer.Reset()
 
 	// Generate the MAC of the encrypted payload and headers
@@ -228,19 +414,44 @@ func (l *Link) RecvDirect() (*proto.Message, error) {
 	l.inMacer.Write(msg.Data)
 	if !bytes.Equal(l.inMacBuf, l.inMacer.Sum(nil)) {
 		err = errors.New(fmt.Sprintf("mac mismatch: have %v, want %v.", l.inMacer.Sum(nil), l.inMacBuf))
+		audit.Emit(&audit.Event{
+			Kind:      audit.MacFailure,
+			Component: "link",
+			Remote:    l.socket.Sock().RemoteAddr().String(),
+			Detail:    err.Error(),
+		})
 		return nil, err
 	}
 	// Extract the package contents
-	l.inCipher.XORKeyStream(l.inHeadBuf, l.inHeadBuf)
-	l.inBuffer.Write(l.inHeadBuf)
+	if err = checkEnvelope(l.inHeadBuf); err != nil {
+		return nil, err
+	}
+	head := l.inHeadBuf[envelopeSize:]
+	l.inCipher.XORKeyStream(head, head)
+	l.inBuffer.Write(head)
 	if err = l.inCoder.Decode(&msg.Head); err != nil {
 		return nil, err
 	}
+	// Switch to the new inbound keys if the remote side renegotiated
+	if pkt, ok := msg.Head.Meta.(*renegPacket); ok {
+		if err = checkSuite(pkt.Suite); err != nil {
+			return nil, err
+		}
+		l.inCipher, l.inMacer, l.inSecret = makeRenegotiated(l.inSecret, pkt.Suite)
+	}
 	// Set the message security knowingly to true
 	msg.KnownSecure()
 	return &msg, nil
 }
 
+// Verifies that the header part of a frame is wrapped in a supported envelope.
+func checkEnvelope(head []byte) error {
+	if len(head) < envelopeSize || head[0] != envelopeMagic || head[1] == 0 || head[1] > envelopeVersion {
+		return ErrEnvelope
+	}
+	return nil
+}
+
 // Sends messages from the upper layers into the encrypted link.
 func (l *Link) sender() {
 	var errc chan error
@@ -253,6 +464,8 @@ func (l *Link) sender() {
 			continue
 		case msg := <-l.Send:
 			errv = l.SendDirect(msg)
+		case pkt := <-l.reneg:
+			errv = l.renegotiate(pkt)
 		}
 	}
 	// If quit was requested, send all pending messages and close packet
@@ -298,6 +511,18 @@ func (l *Link) receiver() {
 		if _, ok := msg.Head.Meta.(*closePacket); ok {
 			break
 		}
+		// Report renegotiations, answering requests with our own direction
+		if pkt, ok := msg.Head.Meta.(*renegPacket); ok {
+			l.notify(EventRenegRecv, pkt.Suite)
+			if !pkt.Reply {
+				select {
+				case l.reneg <- &renegPacket{Suite: pkt.Suite, Reply: true}:
+				default:
+					// Local renegotiation already pending, that will switch too
+				}
+			}
+			continue
+		}
 		// Transfer upwards, or terminate
 		select {
 		case l.Recv <- msg:
@@ -321,6 +546,12 @@ func (l *Link) receiver() {
 }
 
 // Retrieves the raw connection object if special manipulations are needed.
-func (l *Link) Sock() *net.TCPConn {
+func (l *Link) Sock() net.Conn {
 	return l.socket.Sock()
 }
+
+// Retrieves the number of bytes received and sent on the wire, including the
+// encryption and framing overhead.
+func (l *Link) Traffic() (in, out uint64) {
+	return l.socket.Traffic()
+}
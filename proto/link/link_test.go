@@ -25,11 +25,14 @@ import (
 	"crypto/sha1"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"os"
 	"testing"
 	"time"
 
 	"code.google.com/p/go.crypto/hkdf"
+	"github.com/karalabe/iris/config"
 	"github.com/karalabe/iris/proto"
 	"github.com/karalabe/iris/proto/stream"
 )
@@ -38,6 +41,12 @@ import (
 func TestCiphers(t *testing.T) {
 	t.Parallel()
 
+	for _, suite := range []string{config.SuiteAes, config.SuiteChaCha} {
+		testCiphers(t, suite)
+	}
+}
+
+func testCiphers(t *testing.T, suite string) {
 	// Generate a secret key for the HKDF
 	secret := make([]byte, 16)
 	io.ReadFull(rand.Reader, secret)
@@ -46,8 +55,8 @@ func TestCiphers(t *testing.T) {
 	clientHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
 	serverHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
 
-	client := New(nil, clientHKDF, false)
-	server := New(nil, serverHKDF, true)
+	client := New(nil, clientHKDF, suite, false)
+	server := New(nil, serverHKDF, suite, true)
 
 	// Create some random data to operate on
 	clientData := make([]byte, 4096)
@@ -61,26 +70,26 @@ func TestCiphers(t *testing.T) {
 		client.inCipher.XORKeyStream(clientData, clientData)
 		server.outCipher.XORKeyStream(serverData, serverData)
 		if !bytes.Equal(clientData, serverData) {
-			t.Fatalf("cipher mismatch on the session endpoints")
+			t.Fatalf("%s: cipher mismatch on the session endpoints", suite)
 		}
 		client.outCipher.XORKeyStream(clientData, clientData)
 		server.inCipher.XORKeyStream(serverData, serverData)
 		if !bytes.Equal(clientData, serverData) {
-			t.Fatalf("cipher mismatch on the session endpoints")
+			t.Fatalf("%s: cipher mismatch on the session endpoints", suite)
 		}
 		client.inMacer.Write(clientData)
 		server.outMacer.Write(serverData)
 		clientData = client.inMacer.Sum(nil)
 		serverData = server.outMacer.Sum(nil)
 		if !bytes.Equal(clientData, serverData) {
-			t.Fatalf("macer mismatch on the session endpoints")
+			t.Fatalf("%s: macer mismatch on the session endpoints", suite)
 		}
 		client.outMacer.Write(clientData)
 		server.inMacer.Write(serverData)
 		clientData = client.outMacer.Sum(nil)
 		serverData = server.inMacer.Sum(nil)
 		if !bytes.Equal(clientData, serverData) {
-			t.Fatalf("macer mismatch on the session endpoints")
+			t.Fatalf("%s: macer mismatch on the session endpoints", suite)
 		}
 	}
 }
@@ -119,8 +128,8 @@ func TestDirectSendRecv(t *testing.T) {
 	clientHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
 	serverHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
 
-	clientLink := New(clientStrm, clientHKDF, false)
-	serverLink := New(serverStrm, serverHKDF, true)
+	clientLink := New(clientStrm, clientHKDF, config.Suite(), false)
+	serverLink := New(serverStrm, serverHKDF, config.Suite(), true)
 
 	// Generate some random messages and pass around both ways
 	for i := 0; i < 1000; i++ {
@@ -187,8 +196,8 @@ func TestSendRecv(t *testing.T) {
 	clientHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
 	serverHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
 
-	clientLink := New(clientStrm, clientHKDF, false)
-	serverLink := New(serverStrm, serverHKDF, true)
+	clientLink := New(clientStrm, clientHKDF, config.Suite(), false)
+	serverLink := New(serverStrm, serverHKDF, config.Suite(), true)
 
 	clientLink.Start(32)
 	serverLink.Start(32)
@@ -253,3 +262,269 @@ func TestSendRecv(t *testing.T) {
 		t.Fatalf("failed to close server link: %v.", err)
 	}
 }
+
+// Tests that an unresponsive remote side cannot stall a graceful tear-down.
+func TestCloseDeadline(t *testing.T) {
+	t.Parallel()
+
+	// Start a stream listener and connect to it
+	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to resolve local address: %v.", err)
+	}
+	listener, err := stream.Listen(addr)
+	if err != nil {
+		t.Fatalf("failed to listen for incoming streams: %v.", err)
+	}
+	listener.Accept(10 * time.Millisecond)
+	defer listener.Close()
+
+	host := fmt.Sprintf("%s:%d", "localhost", addr.Port)
+	clientStrm, err := stream.Dial(host, time.Millisecond)
+	if err != nil {
+		t.Fatalf("failed to connect to stream listener: %v.", err)
+	}
+	serverStrm := <-listener.Sink
+	defer serverStrm.Close()
+
+	// Start only the client link, the server never answers the close packet
+	secret := make([]byte, 16)
+	io.ReadFull(rand.Reader, secret)
+
+	clientLink := New(clientStrm, hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info")), config.Suite(), false)
+	clientLink.Start(32)
+
+	start := time.Now()
+	err = clientLink.Close()
+	if cerr, ok := err.(*CloseError); !ok || cerr.Stage != StageDrain || !cerr.Timeout() {
+		t.Fatalf("close report mismatch: have %v, want %s stage timeout.", err, StageDrain)
+	}
+	if elapsed := time.Since(start); elapsed < config.SessionDrainTimeout || elapsed > config.SessionDrainTimeout+config.SessionCloseTimeout+time.Second {
+		t.Fatalf("close duration mismatch: have %v, want ~%v.", elapsed, config.SessionDrainTimeout)
+	}
+}
+
+// Tests that a live link can switch cipher suites in-band without losing data.
+func TestRenegotiate(t *testing.T) {
+	t.Parallel()
+
+	// Start a stream listener and connect to it
+	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to resolve local address: %v.", err)
+	}
+	listener, err := stream.Listen(addr)
+	if err != nil {
+		t.Fatalf("failed to listen for incoming streams: %v.", err)
+	}
+	listener.Accept(10 * time.Millisecond)
+	defer listener.Close()
+
+	host := fmt.Sprintf("%s:%d", "localhost", addr.Port)
+	clientStrm, err := stream.Dial(host, time.Millisecond)
+	if err != nil {
+		t.Fatalf("failed to connect to stream listener: %v.", err)
+	}
+	serverStrm := <-listener.Sink
+
+	// Initialize the links with the hardware suite
+	secret := make([]byte, 16)
+	io.ReadFull(rand.Reader, secret)
+
+	clientLink := New(clientStrm, hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info")), config.SuiteAes, false)
+	serverLink := New(serverStrm, hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info")), config.SuiteAes, true)
+
+	clientLink.Start(32)
+	serverLink.Start(32)
+
+	if err := clientLink.Renegotiate("rot13"); err == nil {
+		t.Fatalf("renegotiated to unknown suite.")
+	}
+	// Pass messages both ways, switching suites midway
+	for i := 0; i < 100; i++ {
+		if i == 50 {
+			if err := clientLink.Renegotiate(config.SuiteChaCha); err != nil {
+				t.Fatalf("failed to renegotiate link: %v.", err)
+			}
+		}
+		for _, pair := range [][2]*Link{{clientLink, serverLink}, {serverLink, clientLink}} {
+			send := &proto.Message{
+				Head: proto.Header{
+					Meta: []byte{byte(i)},
+				},
+			}
+			pair[0].Send <- send
+			select {
+			case recv, ok := <-pair[1].Recv:
+				if !ok {
+					t.Fatalf("message %d: link closed prematurely.", i)
+				}
+				if !bytes.Equal(send.Head.Meta.([]byte), recv.Head.Meta.([]byte)) {
+					t.Fatalf("message %d: send/receive mismatch: have %+v, want %+v.", i, recv, send)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("message %d: receive timed out.", i)
+			}
+		}
+	}
+	// Verify that both directions were reported on both sides
+	for i, l := range []*Link{clientLink, serverLink} {
+		kinds := make(map[string]bool)
+		for j := 0; j < 2; j++ {
+			select {
+			case event := <-l.Events:
+				if event.Suite != config.SuiteChaCha {
+					t.Fatalf("link %d: event suite mismatch: have %v, want %v.", i, event.Suite, config.SuiteChaCha)
+				}
+				kinds[event.Kind] = true
+			case <-time.After(time.Second):
+				t.Fatalf("link %d: renegotiation event %d not reported.", i, j)
+			}
+		}
+		if !kinds[EventRenegSend] || !kinds[EventRenegRecv] {
+			t.Fatalf("link %d: event kinds mismatch: have %v.", i, kinds)
+		}
+	}
+	go clientLink.Close()
+	if err := serverLink.Close(); err != nil {
+		t.Fatalf("failed to close server link: %v.", err)
+	}
+}
+
+// Tests that a captured link direction can be decoded offline from the key log.
+func TestDecodeStream(t *testing.T) {
+	// Redirect the key material into a temporary log
+	keylog, err := ioutil.TempFile("", "iris-keylog")
+	if err != nil {
+		t.Fatalf("failed to create key log: %v.", err)
+	}
+	keylog.Close()
+	defer os.Remove(keylog.Name())
+
+	defer func(path string) { config.SessionKeyLog = path }(config.SessionKeyLog)
+	config.SessionKeyLog = keylog.Name()
+
+	// Start a stream listener and a capturing proxy in front of it
+	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to resolve local address: %v.", err)
+	}
+	listener, err := stream.Listen(addr)
+	if err != nil {
+		t.Fatalf("failed to listen for incoming streams: %v.", err)
+	}
+	listener.Accept(10 * time.Millisecond)
+	defer listener.Close()
+
+	proxy, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to start capturing proxy: %v.", err)
+	}
+	defer proxy.Close()
+
+	capture := new(bytes.Buffer)
+	captured := make(chan struct{})
+	go func() {
+		defer close(captured)
+
+		in, err := proxy.Accept()
+		if err != nil {
+			return
+		}
+		out, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", addr.Port))
+		if err != nil {
+			in.Close()
+			return
+		}
+		go func() {
+			io.Copy(in, out)
+			in.Close()
+		}()
+		io.Copy(io.MultiWriter(out, capture), in)
+		out.Close()
+	}()
+	clientStrm, err := stream.Dial(proxy.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect to capturing proxy: %v.", err)
+	}
+	serverStrm := <-listener.Sink
+
+	secret := make([]byte, 16)
+	io.ReadFull(rand.Reader, secret)
+
+	clientLink := New(clientStrm, hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info")), config.SuiteAes, false)
+	serverLink := New(serverStrm, hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info")), config.SuiteAes, true)
+
+	clientLink.Start(32)
+	serverLink.Start(32)
+
+	// Send a few messages, renegotiating the suite midway
+	for i := 0; i < 10; i++ {
+		if i == 5 {
+			if err := clientLink.Renegotiate(config.SuiteChaCha); err != nil {
+				t.Fatalf("failed to renegotiate link: %v.", err)
+			}
+		}
+		clientLink.Send <- &proto.Message{Head: proto.Header{Meta: []byte{byte(i)}}}
+		select {
+		case <-serverLink.Recv:
+		case <-time.After(time.Second):
+			t.Fatalf("message %d: receive timed out.", i)
+		}
+	}
+	go serverLink.Close()
+	if err := clientLink.Close(); err != nil {
+		t.Fatalf("failed to close client link: %v.", err)
+	}
+	<-captured
+
+	// Locate the client to server keys and decode the capture
+	file, err := os.Open(keylog.Name())
+	if err != nil {
+		t.Fatalf("failed to open key log: %v.", err)
+	}
+	defer file.Close()
+
+	entries, err := ParseKeyLog(file)
+	if err != nil {
+		t.Fatalf("failed to parse key log: %v.", err)
+	}
+	var keys *KeyLogEntry
+	for _, entry := range entries {
+		if entry.Source == clientStrm.Sock().LocalAddr().String() {
+			keys = entry
+		}
+	}
+	if keys == nil {
+		t.Fatalf("client keys not logged: %v.", entries)
+	}
+	dec, err := NewDecoder(keys.Keys, keys.Suite)
+	if err != nil {
+		t.Fatalf("failed to create decoder: %v.", err)
+	}
+	var data []int
+	var kinds []string
+	err = dec.DecodeStream(capture, func(frame *Frame) {
+		if frame.Envelope != envelopeVersion {
+			t.Errorf("frame %d: envelope mismatch: have %v, want %v.", frame.Index, frame.Envelope, envelopeVersion)
+		}
+		if meta, ok := frame.Head.Meta.([]byte); ok {
+			data = append(data, int(meta[0]))
+		}
+		kinds = append(kinds, frame.Kind())
+	})
+	if err != nil {
+		t.Fatalf("failed to decode capture: %v.", err)
+	}
+	if len(data) != 10 {
+		t.Fatalf("decoded message count mismatch: have %v, want %v.", len(data), 10)
+	}
+	for i, seq := range data {
+		if seq != i {
+			t.Fatalf("message %d: order mismatch: have %v.", i, seq)
+		}
+	}
+	if kinds[5] != "renegotiate" || kinds[len(kinds)-1] != "close" {
+		t.Fatalf("control frames mismatch: have %v.", kinds)
+	}
+}
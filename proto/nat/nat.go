@@ -0,0 +1,60 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Package nat implements port mapping on home routers through UPnP IGD and the
+// NAT port mapping protocol, allowing nodes behind a NAT to accept inbound
+// connections on an external address, and public address discovery via STUN.
+package nat
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// Failure reported if no gateway answered the discovery.
+var ErrNoGateway = errors.New("no nat gateway found")
+
+// Port mapper of a NAT gateway.
+type Mapper interface {
+	// Maps an internal port to an external one (best effort, the gateway may
+	// pick another) for the given lifetime, returning the mapped external port.
+	Map(protocol string, internal, external int, lifetime time.Duration) (int, error)
+
+	// Removes a previously added port mapping.
+	Unmap(protocol string, internal, external int) error
+
+	// Retrieves the external address of the gateway.
+	External() (net.IP, error)
+}
+
+// Looks for a NAT gateway on the local networks, trying NAT-PMP and UPnP in
+// parallel and returning the first one answering within the timeout.
+func Discover(timeout time.Duration) (Mapper, error) {
+	found := make(chan Mapper, 2)
+	go func() { found <- discoverPmp(timeout) }()
+	go func() { found <- discoverUpnp(timeout) }()
+
+	for i := 0; i < 2; i++ {
+		if m := <-found; m != nil {
+			return m, nil
+		}
+	}
+	return nil, ErrNoGateway
+}
@@ -0,0 +1,155 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package nat
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// Fake NAT-PMP gateway answering external address and mapping requests.
+func fakePmp(t *testing.T, external net.IP, offset int) *net.UDPAddr {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to start fake gateway: %v.", err)
+	}
+	go func() {
+		defer conn.Close()
+
+		buf := make([]byte, 64)
+		for {
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			var res []byte
+			switch {
+			case n == 2 && buf[1] == pmpOpExternal:
+				res = make([]byte, 12)
+				copy(res[8:], external.To4())
+			case n == 12 && (buf[1] == pmpOpMapTcp || buf[1] == pmpOpMapUdp):
+				res = make([]byte, 16)
+				copy(res[8:10], buf[4:6])
+				ext := binary.BigEndian.Uint16(buf[6:])
+				if ext != 0 {
+					ext += uint16(offset)
+				}
+				binary.BigEndian.PutUint16(res[10:], ext)
+				copy(res[12:], buf[8:12])
+			default:
+				continue
+			}
+			res[1] = buf[1] | 0x80
+			conn.WriteToUDP(res, from)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestPmp(t *testing.T) {
+	external := net.IPv4(203, 0, 113, 7)
+	m := &pmp{gateway: fakePmp(t, external, 1), timeout: time.Second}
+
+	ip, err := m.External()
+	if err != nil {
+		t.Fatalf("failed to retrieve external address: %v.", err)
+	}
+	if !ip.Equal(external) {
+		t.Fatalf("external address mismatch: have %v, want %v.", ip, external)
+	}
+	port, err := m.Map("tcp", 55555, 55555, time.Minute)
+	if err != nil {
+		t.Fatalf("failed to map port: %v.", err)
+	}
+	if port != 55556 {
+		t.Fatalf("mapped port mismatch: have %v, want %v.", port, 55556)
+	}
+	if err := m.Unmap("tcp", 55555, port); err != nil {
+		t.Fatalf("failed to unmap port: %v.", err)
+	}
+	if _, err := m.Map("sctp", 55555, 55555, time.Minute); err == nil {
+		t.Fatalf("unsupported protocol mapped.")
+	}
+}
+
+func TestPmpTimeout(t *testing.T) {
+	// Reserve a port and release it, so nobody answers
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to reserve port: %v.", err)
+	}
+	addr := conn.LocalAddr().(*net.UDPAddr)
+	conn.Close()
+
+	m := &pmp{gateway: addr, timeout: 300 * time.Millisecond}
+	start := time.Now()
+	if _, err := m.External(); err == nil {
+		t.Fatalf("request succeeded without a gateway.")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("request timeout exceeded: have %v, want < %v.", elapsed, time.Second)
+	}
+}
+
+func TestStun(t *testing.T) {
+	// Start a fake STUN server reporting a fixed public endpoint
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to start fake stun server: %v.", err)
+	}
+	defer server.Close()
+
+	public := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 42), Port: 40000}
+	go func() {
+		buf := make([]byte, 1500)
+		n, from, err := server.ReadFromUDP(buf)
+		if err != nil || n != 20 {
+			return
+		}
+		// Reply with an unknown attribute followed by the XOR mapped address
+		res := make([]byte, 20+8+12)
+		copy(res, buf[:20])
+		binary.BigEndian.PutUint16(res[0:], stunBindResponse)
+		binary.BigEndian.PutUint16(res[2:], 8+12)
+
+		binary.BigEndian.PutUint16(res[20:], 0x8022)
+		binary.BigEndian.PutUint16(res[22:], 3)
+
+		attr := res[28:]
+		binary.BigEndian.PutUint16(attr[0:], stunAttrXorMapped)
+		binary.BigEndian.PutUint16(attr[2:], 8)
+		attr[5] = 0x01
+		binary.BigEndian.PutUint16(attr[6:], uint16(public.Port)^(stunCookie>>16))
+		for i, b := range public.IP.To4() {
+			attr[8+i] = b ^ res[4+i]
+		}
+		server.WriteToUDP(res, from)
+	}()
+	addr, err := Stun(nil, server.LocalAddr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to query stun server: %v.", err)
+	}
+	if !addr.IP.Equal(public.IP) || addr.Port != public.Port {
+		t.Fatalf("public address mismatch: have %v, want %v.", addr, public)
+	}
+}
@@ -0,0 +1,179 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the client side of the NAT port mapping protocol (RFC 6886),
+// talking to the default gateway over UDP.
+
+package nat
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Port on which the gateway listens for NAT-PMP requests.
+const pmpPort = 5351
+
+// Operation codes of the NAT-PMP requests.
+const (
+	pmpOpExternal = 0
+	pmpOpMapUdp   = 1
+	pmpOpMapTcp   = 2
+)
+
+// Initial retransmission delay of the requests, doubled after each attempt.
+const pmpRetryDelay = 250 * time.Millisecond
+
+// NAT-PMP gateway.
+type pmp struct {
+	gateway *net.UDPAddr
+	timeout time.Duration
+}
+
+// Checks whether the default gateway speaks NAT-PMP.
+func discoverPmp(timeout time.Duration) Mapper {
+	gw, err := gateway()
+	if err != nil {
+		return nil
+	}
+	m := &pmp{
+		gateway: &net.UDPAddr{IP: gw, Port: pmpPort},
+		timeout: timeout,
+	}
+	if _, err := m.External(); err != nil {
+		return nil
+	}
+	return m
+}
+
+// Implements Mapper.External, requesting the public address of the gateway.
+func (m *pmp) External() (net.IP, error) {
+	res, err := m.call([]byte{0, pmpOpExternal}, 12)
+	if err != nil {
+		return nil, err
+	}
+	return net.IPv4(res[8], res[9], res[10], res[11]), nil
+}
+
+// Implements Mapper.Map, requesting a port mapping from the gateway.
+func (m *pmp) Map(protocol string, internal, external int, lifetime time.Duration) (int, error) {
+	op, err := pmpOp(protocol)
+	if err != nil {
+		return 0, err
+	}
+	req := make([]byte, 12)
+	req[1] = op
+	binary.BigEndian.PutUint16(req[4:], uint16(internal))
+	binary.BigEndian.PutUint16(req[6:], uint16(external))
+	binary.BigEndian.PutUint32(req[8:], uint32(lifetime/time.Second))
+
+	res, err := m.call(req, 16)
+	if err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint16(res[10:])), nil
+}
+
+// Implements Mapper.Unmap, deleting a mapping by requesting a zero lifetime.
+func (m *pmp) Unmap(protocol string, internal, external int) error {
+	_, err := m.Map(protocol, internal, 0, 0)
+	return err
+}
+
+// Converts a transport protocol name into the mapping operation code.
+func pmpOp(protocol string) (byte, error) {
+	switch strings.ToLower(protocol) {
+	case "tcp":
+		return pmpOpMapTcp, nil
+	case "udp":
+		return pmpOpMapUdp, nil
+	default:
+		return 0, fmt.Errorf("unsupported protocol %s", protocol)
+	}
+}
+
+// Sends a request to the gateway, retransmitting it with an exponential backoff
+// until a valid response arrives or the timeout is reached.
+func (m *pmp) call(req []byte, size int) ([]byte, error) {
+	conn, err := net.DialUDP("udp4", nil, m.gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(m.timeout)
+	res := make([]byte, 16)
+	for delay := pmpRetryDelay; time.Now().Before(deadline); delay *= 2 {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		wait := time.Now().Add(delay)
+		if wait.After(deadline) {
+			wait = deadline
+		}
+		conn.SetReadDeadline(wait)
+
+		n, err := conn.Read(res)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				continue
+			}
+			return nil, err
+		}
+		switch {
+		case n < size || res[0] != 0 || res[1] != req[1]|0x80:
+			return nil, errors.New("invalid nat-pmp response")
+		case binary.BigEndian.Uint16(res[2:]) != 0:
+			return nil, fmt.Errorf("nat-pmp request failed with code %d", binary.BigEndian.Uint16(res[2:]))
+		}
+		return res[:n], nil
+	}
+	return nil, errors.New("nat-pmp request timed out")
+}
+
+// Retrieves the default IPv4 gateway from the kernel routing table.
+func gateway() (net.IP, error) {
+	file, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags ..., addresses in little endian hex
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		raw, err := hex.DecodeString(fields[2])
+		if err != nil || len(raw) != 4 || fields[2] == "00000000" {
+			continue
+		}
+		return net.IPv4(raw[3], raw[2], raw[1], raw[0]), nil
+	}
+	return nil, errors.New("default gateway not found")
+}
@@ -0,0 +1,137 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains a minimal STUN client (RFC 5389), issuing binding requests
+// to learn the public address a NAT translates the local endpoint into.
+
+package nat
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+// Fixed cookie present in all STUN messages.
+const stunCookie = 0x2112a442
+
+// STUN message types and attributes of the binding exchange.
+const (
+	stunBindRequest  = 0x0001
+	stunBindResponse = 0x0101
+
+	stunAttrMapped    = 0x0001
+	stunAttrXorMapped = 0x0020
+)
+
+// Queries a STUN server through a socket bound to the local address (nil for
+// any), returning the public endpoint the server observed.
+func Stun(local *net.UDPAddr, server string, timeout time.Duration) (*net.UDPAddr, error) {
+	dest, err := net.ResolveUDPAddr("udp4", server)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", local)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// Assemble the binding request with a random transaction id
+	req := make([]byte, 20)
+	binary.BigEndian.PutUint16(req[0:], stunBindRequest)
+	binary.BigEndian.PutUint32(req[4:], stunCookie)
+	if _, err := rand.Read(req[8:]); err != nil {
+		return nil, err
+	}
+	// Retransmit until a matching response arrives or the timeout is reached
+	deadline := time.Now().Add(timeout)
+	res := make([]byte, 1500)
+	for delay := pmpRetryDelay; time.Now().Before(deadline); delay *= 2 {
+		if _, err := conn.WriteTo(req, dest); err != nil {
+			return nil, err
+		}
+		wait := time.Now().Add(delay)
+		if wait.After(deadline) {
+			wait = deadline
+		}
+		conn.SetReadDeadline(wait)
+		for {
+			n, _, err := conn.ReadFrom(res)
+			if err != nil {
+				if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if n >= 20 && bytes.Equal(res[8:20], req[8:20]) {
+				return parseStun(res[:n])
+			}
+		}
+	}
+	return nil, errors.New("stun request timed out")
+}
+
+// Extracts the mapped address from a STUN binding response, preferring the XOR
+// obfuscated one if present.
+func parseStun(res []byte) (*net.UDPAddr, error) {
+	if binary.BigEndian.Uint16(res[0:]) != stunBindResponse || binary.BigEndian.Uint32(res[4:]) != stunCookie {
+		return nil, errors.New("invalid stun response")
+	}
+	size := int(binary.BigEndian.Uint16(res[2:]))
+	if 20+size > len(res) {
+		return nil, errors.New("truncated stun response")
+	}
+	var mapped *net.UDPAddr
+	for attrs := res[20 : 20+size]; len(attrs) >= 4; {
+		kind := binary.BigEndian.Uint16(attrs[0:])
+		length := int(binary.BigEndian.Uint16(attrs[2:]))
+		if 4+length > len(attrs) {
+			break
+		}
+		value := attrs[4 : 4+length]
+
+		// Only IPv4 addresses are of interest (family 0x01)
+		if (kind == stunAttrMapped || kind == stunAttrXorMapped) && length >= 8 && value[1] == 0x01 {
+			port := binary.BigEndian.Uint16(value[2:])
+			ip := net.IPv4(value[4], value[5], value[6], value[7])
+			if kind == stunAttrXorMapped {
+				port ^= stunCookie >> 16
+				for i, b := range []byte{0x21, 0x12, 0xa4, 0x42} {
+					ip[12+i] ^= b
+				}
+				return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+			}
+			mapped = &net.UDPAddr{IP: ip, Port: int(port)}
+		}
+		// Attributes are padded to 4 byte boundaries
+		if next := 4 + (length+3)&^3; next <= len(attrs) {
+			attrs = attrs[next:]
+		} else {
+			break
+		}
+	}
+	if mapped == nil {
+		return nil, errors.New("no mapped address in stun response")
+	}
+	return mapped, nil
+}
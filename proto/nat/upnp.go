@@ -0,0 +1,283 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the UPnP Internet Gateway Device client: the gateway is
+// located via an SSDP multicast search, its description fetched to find the WAN
+// connection service, which is then controlled through SOAP calls.
+
+package nat
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Multicast address of the SSDP discovery.
+const ssdpAddr = "239.255.255.250:1900"
+
+// WAN connection services able to add port mappings, in order of preference.
+var upnpServices = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+// Description of a UPnP device, flattened to the relevant parts.
+type upnpDevice struct {
+	Services []upnpService `xml:"serviceList>service"`
+	Devices  []upnpDevice  `xml:"deviceList>device"`
+}
+
+// A single service of a UPnP device.
+type upnpService struct {
+	Type    string `xml:"serviceType"`
+	Control string `xml:"controlURL"`
+}
+
+// UPnP gateway with a WAN connection service.
+type upnp struct {
+	control string        // Absolute URL of the service control endpoint
+	service string        // Type of the controlled service
+	local   net.IP        // Local address through which the gateway is reached
+	timeout time.Duration // Time limit of the individual SOAP calls
+}
+
+// Searches for a UPnP internet gateway on the local networks.
+func discoverUpnp(timeout time.Duration) Mapper {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+
+	dest, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return nil
+	}
+	req := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpAddr + "\r\n" +
+		"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n\r\n"
+	if _, err := conn.WriteTo([]byte(req), dest); err != nil {
+		return nil
+	}
+	// Process the answers until a usable gateway is found
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil
+		}
+		location := ssdpLocation(buf[:n])
+		if location == "" {
+			continue
+		}
+		if m := newUpnp(location, from.IP, timeout); m != nil {
+			return m
+		}
+	}
+}
+
+// Extracts the device description location from an SSDP response.
+func ssdpLocation(res []byte) string {
+	for _, line := range strings.Split(string(res), "\r\n") {
+		if i := strings.Index(line, ":"); i > 0 && strings.EqualFold(strings.TrimSpace(line[:i]), "location") {
+			return strings.TrimSpace(line[i+1:])
+		}
+	}
+	return ""
+}
+
+// Fetches a gateway device description and looks for a WAN connection service.
+func newUpnp(location string, gateway net.IP, timeout time.Duration) *upnp {
+	client := &http.Client{Timeout: timeout}
+	res, err := client.Get(location)
+	if err != nil {
+		return nil
+	}
+	defer res.Body.Close()
+
+	desc := struct {
+		Device upnpDevice `xml:"device"`
+	}{}
+	if err := xml.NewDecoder(res.Body).Decode(&desc); err != nil {
+		return nil
+	}
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil
+	}
+	// Find the local address facing the gateway, needed for the mappings
+	probe, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: gateway, Port: 1900})
+	if err != nil {
+		return nil
+	}
+	local := probe.LocalAddr().(*net.UDPAddr).IP
+	probe.Close()
+
+	for _, kind := range upnpServices {
+		if service := findService(&desc.Device, kind); service != nil {
+			control, err := base.Parse(service.Control)
+			if err != nil {
+				return nil
+			}
+			return &upnp{
+				control: control.String(),
+				service: kind,
+				local:   local,
+				timeout: timeout,
+			}
+		}
+	}
+	return nil
+}
+
+// Recursively searches a device tree for a service of the given type.
+func findService(dev *upnpDevice, kind string) *upnpService {
+	for i := range dev.Services {
+		if dev.Services[i].Type == kind {
+			return &dev.Services[i]
+		}
+	}
+	for i := range dev.Devices {
+		if service := findService(&dev.Devices[i], kind); service != nil {
+			return service
+		}
+	}
+	return nil
+}
+
+// Implements Mapper.External, querying the external address of the gateway.
+func (m *upnp) External() (net.IP, error) {
+	res, err := m.call("GetExternalIPAddress", nil)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(res["NewExternalIPAddress"])
+	if ip == nil {
+		return nil, errors.New("invalid external address")
+	}
+	return ip, nil
+}
+
+// Implements Mapper.Map, adding a port mapping to the local address. UPnP maps
+// the requested external port exactly or fails.
+func (m *upnp) Map(protocol string, internal, external int, lifetime time.Duration) (int, error) {
+	_, err := m.call("AddPortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(external)},
+		{"NewProtocol", strings.ToUpper(protocol)},
+		{"NewInternalPort", strconv.Itoa(internal)},
+		{"NewInternalClient", m.local.String()},
+		{"NewEnabled", "1"},
+		{"NewPortMappingDescription", "iris"},
+		{"NewLeaseDuration", strconv.Itoa(int(lifetime / time.Second))},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return external, nil
+}
+
+// Implements Mapper.Unmap, deleting a port mapping.
+func (m *upnp) Unmap(protocol string, internal, external int) error {
+	_, err := m.call("DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(external)},
+		{"NewProtocol", strings.ToUpper(protocol)},
+	})
+	return err
+}
+
+// Invokes a SOAP action on the gateway service, returning the output arguments.
+func (m *upnp) call(action string, args [][2]string) (map[string]string, error) {
+	body := new(bytes.Buffer)
+	body.WriteString(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(body, `<u:%s xmlns:u="%s">`, action, m.service)
+	for _, arg := range args {
+		fmt.Fprintf(body, "<%s>", arg[0])
+		xml.EscapeText(body, []byte(arg[1]))
+		fmt.Fprintf(body, "</%s>", arg[0])
+	}
+	fmt.Fprintf(body, `</u:%s></s:Body></s:Envelope>`, action)
+
+	req, err := http.NewRequest("POST", m.control, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, m.service, action))
+
+	client := &http.Client{Timeout: m.timeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upnp %s failed with status %s", action, res.Status)
+	}
+	return soapResult(data)
+}
+
+// Extracts the output arguments of a SOAP response (the leaf elements of the
+// response body).
+func soapResult(data []byte) (map[string]string, error) {
+	result := make(map[string]string)
+
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	var name string
+	var text []byte
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			name, text = tok.Name.Local, nil
+		case xml.CharData:
+			text = append(text, tok...)
+		case xml.EndElement:
+			if name == tok.Name.Local {
+				result[name] = strings.TrimSpace(string(text))
+			}
+			name = ""
+		}
+	}
+	if len(result) == 0 && !bytes.Contains(data, []byte("Response")) {
+		return nil, errors.New("invalid soap response")
+	}
+	return result, nil
+}
@@ -0,0 +1,166 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the runtime managed access lists of the overlay: node ids
+// and network ranges either denied or exclusively allowed admission, each entry
+// optionally expiring after a while. Unlike the pluggable authorizer, the lists
+// may be altered while the overlay is running, ejecting the live peers no longer
+// admitted.
+
+package pastry
+
+import (
+	"errors"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+// Failure reported if an access list entry is neither a node id nor a network.
+var ErrAclEntry = errors.New("access entry neither node id nor cidr network")
+
+// A single access list entry, matching either a node id or a network range.
+type aclRule struct {
+	id     *big.Int   // Node id to match, if any
+	cidr   *net.IPNet // Network range to match, if any
+	expiry time.Time  // Time after which the rule is void (zero = never)
+}
+
+// Access lists consulted on peer admission.
+type acl struct {
+	allow map[string]*aclRule // Rules exclusively admitting peers (if non-empty)
+	deny  map[string]*aclRule // Rules refusing peers, overriding the allows
+	lock  sync.Mutex          // Mutex protecting the lists
+}
+
+// Creates a new, empty access list admitting everyone.
+func newAcl() *acl {
+	return &acl{
+		allow: make(map[string]*aclRule),
+		deny:  make(map[string]*aclRule),
+	}
+}
+
+// Parses an access list entry, either a decimal node id or a CIDR network, and
+// returns it along with its canonical form.
+func parseRule(entry string, expiry time.Time) (string, *aclRule, error) {
+	if id, ok := new(big.Int).SetString(entry, 10); ok && id.Sign() >= 0 {
+		return id.String(), &aclRule{id: id, expiry: expiry}, nil
+	}
+	if _, cidr, err := net.ParseCIDR(entry); err == nil {
+		return cidr.String(), &aclRule{cidr: cidr, expiry: expiry}, nil
+	}
+	return "", nil, ErrAclEntry
+}
+
+// Checks whether a rule covers a peer.
+func (r *aclRule) match(id *big.Int, ip net.IP) bool {
+	if r.id != nil {
+		return id != nil && r.id.Cmp(id) == 0
+	}
+	return ip != nil && r.cidr.Contains(ip)
+}
+
+// Checks whether a peer matches any of the live rules of a list, dropping the
+// expired ones along the way. The number of live rules is also returned.
+func expire(rules map[string]*aclRule, id *big.Int, ip net.IP, now time.Time) (bool, int) {
+	match := false
+	for key, rule := range rules {
+		if !rule.expiry.IsZero() && now.After(rule.expiry) {
+			delete(rules, key)
+			continue
+		}
+		match = match || rule.match(id, ip)
+	}
+	return match, len(rules)
+}
+
+// Decides whether a peer may join: it must not be denied, and if there are any
+// allow rules, it must match one of them.
+func (a *acl) admit(id *big.Int, ip net.IP) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	now := time.Now()
+	if denied, _ := expire(a.deny, id, ip, now); denied {
+		return false
+	}
+	allowed, rules := expire(a.allow, id, ip, now)
+	return allowed || rules == 0
+}
+
+// Denies admission to a node id or a CIDR network until the expiry (zero time
+// for a permanent ban). Matching live peers are disconnected.
+func (o *Overlay) Deny(entry string, expiry time.Time) error {
+	key, rule, err := parseRule(entry, expiry)
+	if err != nil {
+		return err
+	}
+	o.acl.lock.Lock()
+	o.acl.deny[key] = rule
+	o.acl.lock.Unlock()
+
+	o.enforce()
+	return nil
+}
+
+// Adds a node id or a CIDR network to the exclusive admission list until the
+// expiry (zero time for a permanent entry). Once the list is non-empty, live
+// peers matching none of its entries are disconnected.
+func (o *Overlay) Allow(entry string, expiry time.Time) error {
+	key, rule, err := parseRule(entry, expiry)
+	if err != nil {
+		return err
+	}
+	o.acl.lock.Lock()
+	o.acl.allow[key] = rule
+	o.acl.lock.Unlock()
+
+	o.enforce()
+	return nil
+}
+
+// Removes a node id or a CIDR network from both the deny and allow lists.
+func (o *Overlay) Revoke(entry string) error {
+	key, _, err := parseRule(entry, time.Time{})
+	if err != nil {
+		return err
+	}
+	o.acl.lock.Lock()
+	delete(o.acl.deny, key)
+	delete(o.acl.allow, key)
+	o.acl.lock.Unlock()
+
+	o.enforce()
+	return nil
+}
+
+// Schedules the disconnection of all live peers not admitted any more by the
+// access lists.
+func (o *Overlay) enforce() {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	for _, p := range o.livePeers {
+		if !o.acl.admit(p.nodeId, hostIP(p.raddr)) {
+			o.drop(p)
+		}
+	}
+}
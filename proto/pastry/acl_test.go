@@ -0,0 +1,130 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package pastry
+
+import (
+	"crypto/x509"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAclAdmit(t *testing.T) {
+	o := New(appId, nil, new(nopCallback))
+
+	peer, other := big.NewInt(314), big.NewInt(271)
+	inside, outside := net.ParseIP("10.0.1.2"), net.ParseIP("192.168.1.2")
+
+	// Malformed entries should be refused
+	for _, entry := range []string{"", "peer", "-1", "10.0.0.0/33"} {
+		if err := o.Deny(entry, time.Time{}); err != ErrAclEntry {
+			t.Fatalf("entry %q: error mismatch: have %v, want %v.", entry, err, ErrAclEntry)
+		}
+	}
+	// Empty lists admit everyone, deny rules refuse only matching peers
+	if !o.acl.admit(peer, inside) {
+		t.Fatalf("peer refused by empty lists.")
+	}
+	if err := o.Deny(peer.String(), time.Time{}); err != nil {
+		t.Fatalf("failed to deny node id: %v.", err)
+	}
+	if o.acl.admit(peer, outside) {
+		t.Fatalf("denied node id admitted.")
+	}
+	if !o.acl.admit(other, outside) {
+		t.Fatalf("unrelated node id refused.")
+	}
+	if err := o.Revoke(peer.String()); err != nil {
+		t.Fatalf("failed to revoke node id: %v.", err)
+	}
+	if !o.acl.admit(peer, outside) {
+		t.Fatalf("revoked node id refused.")
+	}
+	// Allow rules admit only matching peers, deny rules overriding them
+	if err := o.Allow("10.0.0.0/16", time.Time{}); err != nil {
+		t.Fatalf("failed to allow network: %v.", err)
+	}
+	if !o.acl.admit(peer, inside) || o.acl.admit(peer, outside) {
+		t.Fatalf("network allow mismatch: inside %v, outside %v.", o.acl.admit(peer, inside), o.acl.admit(peer, outside))
+	}
+	if err := o.Deny(peer.String(), time.Time{}); err != nil {
+		t.Fatalf("failed to deny node id: %v.", err)
+	}
+	if o.acl.admit(peer, inside) {
+		t.Fatalf("denied node id admitted from allowed network.")
+	}
+	// Expired rules should be void and discarded
+	if err := o.Deny(other.String(), time.Now().Add(50*time.Millisecond)); err != nil {
+		t.Fatalf("failed to deny node id: %v.", err)
+	}
+	if o.acl.admit(other, inside) {
+		t.Fatalf("temporarily denied node id admitted.")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !o.acl.admit(other, inside) {
+		t.Fatalf("expired ban still enforced.")
+	}
+	if _, ok := o.acl.deny[other.String()]; ok {
+		t.Fatalf("expired ban not discarded.")
+	}
+}
+
+func TestAclEject(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Boot two overlay nodes and wait for them to connect
+	alice := New(appId, key, new(nopCallback))
+	bob := New(appId, key, new(nopCallback))
+
+	for _, o := range []*Overlay{alice, bob} {
+		if _, err := o.Boot(); err != nil {
+			t.Fatalf("failed to boot overlay: %v.", err)
+		}
+		defer func(o *Overlay) {
+			if err := o.Shutdown(); err != nil {
+				t.Fatalf("failed to shutdown overlay: %v.", err)
+			}
+		}(o)
+	}
+	waitConverged(t, []*Overlay{alice, bob})
+
+	alice.lock.RLock()
+	_, ok := alice.livePeers[bob.nodeId.String()]
+	alice.lock.RUnlock()
+	if !ok {
+		t.Fatalf("bob (%v) not connected to alice.", bob.nodeId)
+	}
+	// Ban bob and ensure he's ejected and kept out
+	if err := alice.Deny(bob.nodeId.String(), time.Time{}); err != nil {
+		t.Fatalf("failed to deny bob: %v.", err)
+	}
+	time.Sleep(time.Second)
+
+	alice.lock.RLock()
+	defer alice.lock.RUnlock()
+	if _, ok := alice.livePeers[bob.nodeId.String()]; ok {
+		t.Fatalf("bob (%v) still in the pool of alice: %v.", bob.nodeId, alice.livePeers)
+	}
+}
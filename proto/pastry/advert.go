@@ -0,0 +1,192 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the address advertisement logic for multi-homed nodes. The
+// listener addresses are filtered and ordered according to the configured
+// preferences before being sent to remote peers as a plain address list, who in
+// turn rank them against their own interfaces (deriving the scope of each address
+// themselves) to pick the best address pair to connect through.
+
+package pastry
+
+import (
+	"log"
+	"net"
+	"sort"
+	"sync"
+)
+
+// Private and shared address ranges which are not publicly routable.
+var privateNets []*net.IPNet
+
+func init() {
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "169.254.0.0/16"} {
+		_, ipnet, _ := net.ParseCIDR(cidr)
+		privateNets = append(privateNets, ipnet)
+	}
+}
+
+// A single advertised listener address. The scope is used for the local ordering
+// alone, only the address itself is sent to the remote peers.
+type advert struct {
+	Addr   string // Listener address in host:port format
+	Public bool   // Whether the address is publicly routable
+}
+
+// Checks whether an IP address is publicly routable.
+func public(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return false
+	}
+	for _, ipnet := range privateNets {
+		if ipnet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Extracts the IP address from a host:port string, nil if invalid.
+func hostIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// Assembles the advertisement list from the local listener addresses, filtered
+// and ordered by the given networks and scope preference.
+func advertise(addrs []string, networks []string, preferPublic bool) []*advert {
+	// Parse the advertisement networks, skipping invalid ones
+	nets := make([]*net.IPNet, 0, len(networks))
+	for _, cidr := range networks {
+		if _, ipnet, err := net.ParseCIDR(cidr); err != nil {
+			log.Printf("pastry: invalid advertisement network %v: %v.", cidr, err)
+		} else {
+			nets = append(nets, ipnet)
+		}
+	}
+	// Rank each address by its network index, dropping non-matching ones
+	ranks := make(map[string]int)
+	ads := make([]*advert, 0, len(addrs))
+	for _, addr := range addrs {
+		ip := hostIP(addr)
+		if ip == nil {
+			continue
+		}
+		rank := 0
+		if len(nets) > 0 {
+			rank = -1
+			for i, ipnet := range nets {
+				if ipnet.Contains(ip) {
+					rank = i
+					break
+				}
+			}
+			if rank < 0 {
+				continue
+			}
+		}
+		ranks[addr] = rank
+		ads = append(ads, &advert{Addr: addr, Public: public(ip)})
+	}
+	// Order by network preference first, then by scope
+	sort.SliceStable(ads, func(i, j int) bool {
+		if ri, rj := ranks[ads[i].Addr], ranks[ads[j].Addr]; ri != rj {
+			return ri < rj
+		}
+		if ads[i].Public != ads[j].Public {
+			return ads[i].Public == preferPublic
+		}
+		return false
+	})
+	return ads
+}
+
+// Flattens an advertisement list into the plain address list.
+func flatten(ads []*advert) []string {
+	addrs := make([]string, len(ads))
+	for i, ad := range ads {
+		addrs[i] = ad.Addr
+	}
+	return addrs
+}
+
+// Outcomes of the past dial attempts, keyed by remote address.
+type dialLog struct {
+	reached map[string]bool // Whether the last dial to an address succeeded
+	lock    sync.Mutex      // Lock protecting the outcomes
+}
+
+// Creates an empty dial outcome log.
+func newDialLog() *dialLog {
+	return &dialLog{
+		reached: make(map[string]bool),
+	}
+}
+
+// Records the outcome of a dial attempt to a remote address.
+func (d *dialLog) record(addr string, ok bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.reached[addr] = ok
+}
+
+// Retrieves the outcome of the last dial to an address, and whether there was any.
+func (d *dialLog) outcome(addr string) (reached bool, known bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	reached, known = d.reached[addr]
+	return
+}
+
+// Orders a remote peer's addresses by how well they pair up with the local
+// interfaces: addresses that were reached before come first, then those on a
+// directly attached network, then those in the same scope as some local interface,
+// with addresses that failed last time at the very end, keeping the advertised
+// order among equally ranked ones.
+func rank(local []*net.IPNet, remote []*net.TCPAddr, past *dialLog) []*net.TCPAddr {
+	score := func(addr *net.TCPAddr) int {
+		if reached, known := past.outcome(addr.String()); known {
+			if reached {
+				return -1
+			}
+			return 3
+		}
+		best := 2
+		for _, ipnet := range local {
+			if ipnet.Contains(addr.IP) {
+				return 0
+			}
+			if public(ipnet.IP) == public(addr.IP) {
+				best = 1
+			}
+		}
+		return best
+	}
+	ranked := make([]*net.TCPAddr, len(remote))
+	copy(ranked, remote)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return score(ranked[i]) < score(ranked[j])
+	})
+	return ranked
+}
@@ -0,0 +1,134 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package pastry
+
+import (
+	"crypto/x509"
+	"net"
+	"reflect"
+	"testing"
+)
+
+type advertTest struct {
+	nets   []string
+	public bool
+	addrs  []string
+	ads    []string
+}
+
+var advertTests = []advertTest{
+	// Default configuration: private addresses first, order kept otherwise
+	{
+		addrs: []string{"10.0.0.1:1000", "8.8.8.8:2000", "192.168.1.1:3000"},
+		ads:   []string{"10.0.0.1:1000", "192.168.1.1:3000", "8.8.8.8:2000"},
+	},
+	// Public preference
+	{
+		public: true,
+		addrs:  []string{"10.0.0.1:1000", "8.8.8.8:2000", "192.168.1.1:3000"},
+		ads:    []string{"8.8.8.8:2000", "10.0.0.1:1000", "192.168.1.1:3000"},
+	},
+	// Explicit network list overrides the scope and filters
+	{
+		nets:  []string{"192.168.0.0/16", "8.0.0.0/8"},
+		addrs: []string{"10.0.0.1:1000", "8.8.8.8:2000", "192.168.1.1:3000"},
+		ads:   []string{"192.168.1.1:3000", "8.8.8.8:2000"},
+	},
+}
+
+func TestAdvertise(t *testing.T) {
+	for i, tt := range advertTests {
+		if ads := flatten(advertise(tt.addrs, tt.nets, tt.public)); !reflect.DeepEqual(ads, tt.ads) {
+			t.Errorf("test %d: advertisement mismatch: have %v, want %v.", i, ads, tt.ads)
+		}
+	}
+}
+
+func TestRank(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("192.168.1.0/24")
+	_, vpn, _ := net.ParseCIDR("10.8.0.0/16")
+
+	remote := []*net.TCPAddr{
+		{IP: net.ParseIP("8.8.8.8"), Port: 1},
+		{IP: net.ParseIP("10.1.0.1"), Port: 2},
+		{IP: net.ParseIP("10.8.0.7"), Port: 3},
+		{IP: net.ParseIP("192.168.1.7"), Port: 4},
+	}
+	want := []int{3, 4, 2, 1}
+
+	ranked := rank([]*net.IPNet{lan, vpn}, remote, newDialLog())
+	for i, addr := range ranked {
+		if addr.Port != want[i] {
+			t.Fatalf("rank mismatch at %d: have %v, want port %v.", i, addr, want[i])
+		}
+	}
+}
+
+func TestRankHistory(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("192.168.1.0/24")
+
+	remote := []*net.TCPAddr{
+		{IP: net.ParseIP("8.8.8.8"), Port: 1},
+		{IP: net.ParseIP("10.8.0.7"), Port: 2},
+		{IP: net.ParseIP("192.168.1.7"), Port: 3},
+	}
+	// Fail the directly attached address and reach the public one
+	past := newDialLog()
+	past.record(remote[2].String(), false)
+	past.record(remote[0].String(), true)
+
+	want := []int{1, 2, 3}
+	ranked := rank([]*net.IPNet{lan}, remote, past)
+	for i, addr := range ranked {
+		if addr.Port != want[i] {
+			t.Fatalf("rank mismatch at %d: have %v, want port %v.", i, addr, want[i])
+		}
+	}
+}
+
+func TestAnnounce(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	conf := DefaultConfig()
+	conf.Announce = []string{"10.99.0.1:14200"}
+
+	o := NewConfig(appId, key, new(nopCallback), conf)
+	if _, err := o.Boot(); err != nil {
+		t.Fatalf("failed to boot overlay: %v.", err)
+	}
+	defer o.Shutdown()
+
+	o.lock.RLock()
+	ads := flatten(o.adverts)
+	o.lock.RUnlock()
+
+	if len(ads) != len(o.addrs)+1 {
+		t.Fatalf("advertised address count mismatch: have %v, want %v.", len(ads), len(o.addrs)+1)
+	}
+	for _, ad := range ads {
+		if ad == conf.Announce[0] {
+			return
+		}
+	}
+	t.Fatalf("announced address not advertised: have %v, want %v.", ads, conf.Announce[0])
+}
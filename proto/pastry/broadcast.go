@@ -0,0 +1,130 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the native overlay broadcast. A message is disseminated along a
+// spanning tree implicitly defined by the routing tables: a node responsible for
+// the ids sharing its first L digits hands each deeper cell of its routing table
+// the responsibility of that cell's prefix, so every node receives the message
+// once and a broadcast costs O(n) messages in total. Leaves fill any holes of an
+// incomplete table, duplicates created by them being suppressed.
+
+package pastry
+
+import (
+	"fmt"
+	"math/big"
+	"sync/atomic"
+	"time"
+
+	"github.com/karalabe/iris/proto"
+)
+
+// Optional extension of the Callback, notified of the messages broadcast through
+// the overlay (including the ones originating locally).
+type BroadcastCallback interface {
+	Broadcast(msg *proto.Message, origin *big.Int)
+}
+
+// Disseminates a message to every node of the overlay, including the local one.
+func (o *Overlay) Broadcast(msg *proto.Message) {
+	seq := atomic.AddUint64(&o.bcastSeq, 1)
+	msg.Head.Meta = &header{Op: opBcast, Meta: msg.Head.Meta, Src: o.nodeId, Seq: seq}
+	o.spread(msg)
+}
+
+// Delivers a broadcast message locally and forwards it down the spanning tree
+// to the nodes responsible for the id ranges below the current level.
+func (o *Overlay) spread(msg *proto.Message) {
+	head := msg.Head.Meta.(*header)
+	if head.Src == nil || !o.fresh(fmt.Sprintf("%v:%d", head.Src, head.Seq)) {
+		return
+	}
+	// Forward the message to the children, each a level deeper
+	children := o.children(head.Level)
+	for p, level := range children {
+		cpy := new(proto.Message)
+		*cpy = *msg
+		hcpy := *head
+		hcpy.Level = level
+		cpy.Head.Meta = &hcpy
+
+		o.send(cpy, p)
+	}
+	// Pass a private copy to the application (the links may still encode the original)
+	if cb, ok := o.app.(BroadcastCallback); ok {
+		plain := &proto.Message{
+			Head: proto.Header{
+				Meta: head.Meta,
+			},
+			Data: append([]byte{}, msg.Data...),
+		}
+		cb.Broadcast(plain, head.Src)
+	}
+}
+
+// Collects the peers to forward a broadcast to from the given tree level, along
+// with the levels they become responsible for: a peer from each routing table
+// cell at or below the level, and the leaves covering the cells left empty.
+func (o *Overlay) children(level int) map[*peer]int {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	res := make(map[*peer]int)
+	for r := level; r < len(o.routes.routes); r++ {
+		for _, id := range o.routes.routes[r] {
+			if id == nil {
+				continue
+			}
+			if p, ok := o.livePeers[id.String()]; ok {
+				res[p] = r + 1
+			}
+		}
+	}
+	for _, leaf := range o.routes.leaves {
+		if leaf.Cmp(o.nodeId) == 0 {
+			continue
+		}
+		if r, c := o.geo.prefix(o.nodeId, leaf); r >= level && o.routes.routes[r][c] == nil {
+			if p, ok := o.livePeers[leaf.String()]; ok {
+				res[p] = r + 1
+			}
+		}
+	}
+	return res
+}
+
+// Checks whether a broadcast was not seen yet, marking it seen. The seen set is
+// kept in two generations, swapped after the configured memory period.
+func (o *Overlay) fresh(id string) bool {
+	o.bcastLock.Lock()
+	defer o.bcastLock.Unlock()
+
+	if time.Since(o.bcastTime) > o.conf.BroadcastMemory {
+		o.bcastPrev, o.bcastSeen = o.bcastSeen, make(map[string]struct{})
+		o.bcastTime = time.Now()
+	}
+	if _, ok := o.bcastSeen[id]; ok {
+		return false
+	}
+	if _, ok := o.bcastPrev[id]; ok {
+		return false
+	}
+	o.bcastSeen[id] = struct{}{}
+	return true
+}
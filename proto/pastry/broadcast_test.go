@@ -0,0 +1,94 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package pastry
+
+import (
+	"crypto/x509"
+	"fmt"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto"
+)
+
+// Overlay callback counting the broadcasts received from each origin.
+type broadcaster struct {
+	nopCallback
+	recvs map[string]int
+	lock  sync.Mutex
+}
+
+func (b *broadcaster) Broadcast(msg *proto.Message, origin *big.Int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.recvs[origin.String()]++
+}
+
+func TestBroadcast(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	nodes := 6
+	messages := 10
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+	config.BootPorts = append(config.BootPorts, fmt.Sprintf("65400-%d", 65400+nodes-1))
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Boot a handful of nodes and wait for convergence
+	apps := make([]*broadcaster, nodes)
+	overlays := make([]*Overlay, nodes)
+	for i := 0; i < nodes; i++ {
+		apps[i] = &broadcaster{recvs: make(map[string]int)}
+		overlays[i] = New(appId, key, apps[i])
+		if _, err := overlays[i].Boot(); err != nil {
+			t.Fatalf("failed to boot node #%d: %v.", i, err)
+		}
+		defer overlays[i].Shutdown()
+	}
+	waitConverged(t, overlays)
+
+	// Broadcast from every node and verify that each reached everybody exactly once
+	for _, o := range overlays {
+		for i := 0; i < messages; i++ {
+			msg := &proto.Message{Head: proto.Header{Meta: []byte{0x99}}, Data: []byte{0x01}}
+			msg.Encrypt()
+			o.Broadcast(msg)
+		}
+	}
+	time.Sleep(time.Second)
+
+	for i, app := range apps {
+		app.lock.Lock()
+		for _, o := range overlays {
+			if n := app.recvs[o.nodeId.String()]; n != messages {
+				t.Errorf("node #%d: broadcast count mismatch from %v: have %d, want %d.", i, o.nodeId, n, messages)
+			}
+		}
+		app.lock.Unlock()
+	}
+}
@@ -0,0 +1,175 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the instance scoped overlay configuration, allowing overlays with
+// different parameters to run side by side in the same process.
+
+package pastry
+
+import (
+	"time"
+
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto/session"
+)
+
+// Tunable parameters of a single overlay instance. The id resolver and the id
+// verification must be uniform over the whole network, hence those are still
+// taken from the global configuration.
+type Config struct {
+	Session *session.Config // Session handshake parameters (timeouts, retries)
+
+	Space  int // Bit length of the node ids (must match the whole network)
+	Base   int // Bit length of the routing table digits (must match the whole network)
+	Leaves int // Size of the leafset (even, nominally 2^(Base-1) or 2^Base)
+
+	BootPorts    []int         // Bootstrap ports to discover peers on
+	BootSeeds    []string      // Seed nodes to dial on startup
+	BootSeedFile string        // File listing further seed nodes (empty = none)
+	BootTimeout  time.Duration // Maximum time to wait for the initial convergence
+	ConvTimeout  time.Duration // Quiet period after which the overlay is deemed converged
+
+	BeatPeriod   time.Duration // Heartbeat period to check the peers' liveliness
+	KillCount    int           // Number of missed heartbeats to consider a peer down
+	PhiThreshold float64       // Suspicion level to consider a peer down (0 = kill count only)
+	PhiWindow    int           // Number of heartbeat intervals sampled per peer
+	PhiJitter    time.Duration // Minimum deviation of the heartbeat intervals
+
+	AcceptTimeout time.Duration // Accept timeout of the listeners, bounding termination
+	InitTimeout   time.Duration // Maximum time to wait for the overlay handshake
+	SendTimeout   time.Duration // Maximum time a message send may block
+	MaxHops       int           // Number of hops after which messages are dropped
+	RouteRetry    bool          // Whether to retry through another peer if the next hop fails
+	NetBuffer     int           // Number of messages to buffer on the peer links
+	AuthThreads   int           // Number of concurrent authentications per direction
+	ExchThreads   int           // Number of concurrent state exchanges
+
+	BroadcastMemory time.Duration // Time to remember seen broadcasts to drop duplicates
+
+	Advertise    []string      // Networks to advertise listener addresses from, in preference order
+	PreferPublic bool          // Whether to advertise public addresses before private ones
+	Announce     []string      // Extra addresses to advertise beside the listeners (VPN, WAN)
+	AddrPeriod   time.Duration // Period of checking the local interfaces for address changes
+
+	NatMapping   bool          // Whether to map the listener ports on NAT gateways
+	NatTimeout   time.Duration // Time allowance of the gateway and STUN queries
+	NatLease     time.Duration // Lifetime of the NAT port mappings
+	StunServers  []string      // STUN servers to discover the public addresses through
+	StunPeriod   time.Duration // Period of the public address rediscovery
+	HolePunch    bool          // Whether to hole punch towards unreachable peers
+	PunchTtl     int           // IP time to live of the hole punching packets
+	PunchTimeout time.Duration // Time allowance of a single punched connection attempt
+
+	MergePeriod time.Duration // Period of reprobing lost peers to heal partitions
+	MergeBatch  int           // Number of lost peers to probe per period
+	MergeExpiry time.Duration // Time after which to give up probing a lost peer
+
+	RttPeriod time.Duration // Period of the round trip time probes of the routing peers
+	RttWindow int           // Number of round trip time samples retained per peer
+
+	StateFile string // File persisting the node id and routing state (empty = none)
+	Memory    bool   // Whether to run over the in-process transport instead of the network
+
+	VirtualNodes int // Number of virtual nodes to run by a host (NewHost only)
+}
+
+// Creates an overlay configuration from the global defaults.
+func DefaultConfig() *Config {
+	return &Config{
+		Session: session.DefaultConfig(),
+
+		Space:  config.PastrySpace,
+		Base:   config.PastryBase,
+		Leaves: config.PastryLeaves,
+
+		BootPorts:    bootPorts(),
+		BootSeeds:    append([]string{}, config.BootSeeds...),
+		BootSeedFile: config.BootSeedFile,
+		BootTimeout:  config.PastryBootTimeout,
+		ConvTimeout:  config.PastryConvTimeout,
+
+		BeatPeriod:   config.PastryBeatPeriod,
+		KillCount:    config.PastryKillCount,
+		PhiThreshold: config.PastryPhiThreshold,
+		PhiWindow:    config.PastryPhiWindow,
+		PhiJitter:    config.PastryPhiJitter,
+
+		AcceptTimeout: config.PastryAcceptTimeout,
+		InitTimeout:   config.PastryInitTimeout,
+		SendTimeout:   config.PastrySendTimeout,
+		MaxHops:       config.PastryMaxHops,
+		RouteRetry:    config.PastryRouteRetry,
+		NetBuffer:     config.PastryNetBuffer,
+		AuthThreads:   config.PastryAuthThreads,
+		ExchThreads:   config.PastryExchThreads,
+
+		BroadcastMemory: config.PastryBroadcastMemory,
+
+		Advertise:    append([]string{}, config.PastryAdvertise...),
+		PreferPublic: config.PastryPreferPublic,
+		Announce:     append([]string{}, config.PastryAnnounce...),
+		AddrPeriod:   config.PastryAddrPeriod,
+
+		NatMapping:   config.PastryNatMapping,
+		NatTimeout:   config.PastryNatTimeout,
+		NatLease:     config.PastryNatLease,
+		StunServers:  append([]string{}, config.PastryStunServers...),
+		StunPeriod:   config.PastryStunPeriod,
+		HolePunch:    config.PastryHolePunch,
+		PunchTtl:     config.PastryPunchTtl,
+		PunchTimeout: config.PastryPunchTimeout,
+
+		MergePeriod: config.PastryMergePeriod,
+		MergeBatch:  config.PastryMergeBatch,
+		MergeExpiry: config.PastryMergeExpiry,
+
+		RttPeriod: config.PastryRttPeriod,
+		RttWindow: config.PastryRttWindow,
+
+		StateFile: config.PastryStateFile,
+
+		VirtualNodes: config.PastryVirtualNodes,
+	}
+}
+
+// Expands the globally configured bootstrap port specs. Invalid ones are caught
+// by the config validation, so they are simply skipped here.
+func bootPorts() []int {
+	specs := []string{}
+	for _, spec := range config.BootPorts {
+		if _, err := config.ParsePorts([]string{spec}); err == nil {
+			specs = append(specs, spec)
+		}
+	}
+	ports, _ := config.ParsePorts(specs)
+	return ports
+}
+
+// Creates a copy of the configuration, detaching the session parameters too (the
+// ticket cache remains shared).
+func (c *Config) copy() *Config {
+	res := *c
+	if c.Session != nil {
+		shake := *c.Session
+		res.Session = &shake
+	} else {
+		res.Session = session.DefaultConfig()
+	}
+	return &res
+}
@@ -0,0 +1,91 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the peer lifecycle event subscriptions, letting membership aware
+// services track the overlay without polling its internal state.
+
+package pastry
+
+import (
+	"math/big"
+)
+
+// Listener for the membership and routing events of an overlay node. Events are
+// delivered synchronously from the overlay's maintenance, so handlers should not
+// block (though they are free to query the overlay, e.g. for a snapshot).
+type Events interface {
+	// Called when a connection to a new remote peer is established.
+	PeerJoined(id *big.Int)
+
+	// Called when the connection to a remote peer is dropped.
+	PeerLeft(id *big.Int)
+
+	// Called when the leafset or routing table changes, with the new state.
+	RouteChanged(snap *Snapshot)
+
+	// Called when the overlay stabilizes, with the number of active peers.
+	Converged(peers int)
+}
+
+// Registers an event handler to be notified of overlay membership changes.
+func (o *Overlay) Subscribe(handler Events) {
+	o.subsLock.Lock()
+	defer o.subsLock.Unlock()
+
+	o.subs = append(o.subs, handler)
+}
+
+// Removes a previously registered event handler.
+func (o *Overlay) Unsubscribe(handler Events) {
+	o.subsLock.Lock()
+	defer o.subsLock.Unlock()
+
+	for i, sub := range o.subs {
+		if sub == handler {
+			o.subs = append(o.subs[:i], o.subs[i+1:]...)
+			return
+		}
+	}
+}
+
+// Delivers an event to all the subscribed handlers. Must not be called while
+// holding the overlay lock, as handlers may query the overlay.
+func (o *Overlay) notify(event func(Events)) {
+	o.subsLock.RLock()
+	subs := append([]Events{}, o.subs...)
+	o.subsLock.RUnlock()
+
+	for _, sub := range subs {
+		event(sub)
+	}
+}
+
+// Counts the remote peers actively used in the routing state.
+func (o *Overlay) activePeers() int {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	peers := 0
+	for _, p := range o.livePeers {
+		if o.active(p.nodeId) {
+			peers++
+		}
+	}
+	return peers
+}
@@ -0,0 +1,117 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package pastry
+
+import (
+	"crypto/x509"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Event handler recording the membership changes.
+type recorder struct {
+	joins  []*big.Int
+	lefts  []*big.Int
+	routes []*Snapshot
+	convs  []int
+	lock   sync.Mutex
+}
+
+func (r *recorder) PeerJoined(id *big.Int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.joins = append(r.joins, id)
+}
+
+func (r *recorder) PeerLeft(id *big.Int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.lefts = append(r.lefts, id)
+}
+
+func (r *recorder) RouteChanged(snap *Snapshot) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.routes = append(r.routes, snap)
+}
+
+func (r *recorder) Converged(peers int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.convs = append(r.convs, peers)
+}
+
+func TestEvents(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	// Parse encryption key
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Boot two nodes, recording the events of the first
+	events := new(recorder)
+	first := New(appId, key, new(nopCallback))
+	first.Subscribe(events)
+	if _, err := first.Boot(); err != nil {
+		t.Fatalf("failed to boot first node: %v.", err)
+	}
+	defer first.Shutdown()
+
+	second := New(appId, key, new(nopCallback))
+	if _, err := second.Boot(); err != nil {
+		t.Fatalf("failed to boot second node: %v.", err)
+	}
+	time.Sleep(time.Second)
+
+	// Verify the join related events
+	events.lock.Lock()
+	if len(events.joins) != 1 || events.joins[0].Cmp(second.Self()) != 0 {
+		t.Fatalf("join events mismatch: have %v, want [%v].", events.joins, second.Self())
+	}
+	if len(events.routes) == 0 {
+		t.Fatalf("no route change reported.")
+	} else if snap := events.routes[len(events.routes)-1]; len(snap.Leaves) != 2 {
+		t.Fatalf("leafset mismatch: have %v, want 2 leaves.", snap.Leaves)
+	}
+	if len(events.convs) == 0 || events.convs[len(events.convs)-1] != 1 {
+		t.Fatalf("convergence events mismatch: have %v, want trailing 1.", events.convs)
+	}
+	events.lock.Unlock()
+
+	// Terminate the second node and verify the departure
+	if err := second.Shutdown(); err != nil {
+		t.Fatalf("failed to terminate second node: %v.", err)
+	}
+	time.Sleep(time.Second)
+
+	events.lock.Lock()
+	defer events.lock.Unlock()
+	if len(events.lefts) != 1 || events.lefts[0].Cmp(second.Self()) != 0 {
+		t.Fatalf("leave events mismatch: have %v, want [%v].", events.lefts, second.Self())
+	}
+	// Unsubscribed handlers shouldn't be notified any more
+	first.Unsubscribe(events)
+	if len(first.subs) != 0 {
+		t.Fatalf("handler not unsubscribed: %v.", first.subs)
+	}
+}
@@ -0,0 +1,162 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the forwarding failure reports. Whenever an intermediate node cannot
+// pass an application message on (the next hop's link is missing or congested,
+// or the message exceeded its hop limit), a report carrying the upper layer
+// headers is routed back to the origin, so it does not have to wait for an end
+// to end timeout to notice the loss. Optionally, a failed next hop is first
+// worked around by retrying through another peer closer to the destination.
+
+package pastry
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/karalabe/iris/proto"
+)
+
+// Reasons for failing to forward a routed message.
+var (
+	ErrLinkDown    = errors.New("link down")
+	ErrOverloaded  = errors.New("overloaded")
+	ErrTtlExceeded = errors.New("ttl exceeded")
+
+	// Reached the destination, but the application there had no use for it
+	ErrUndeliverable = errors.New("undeliverable")
+)
+
+// Wire codes of the failure reasons (index + 1, zero is unknown).
+var failReasons = []error{ErrLinkDown, ErrOverloaded, ErrTtlExceeded, ErrUndeliverable}
+
+// Optional extension of the Callback, notified when an application message sent
+// by the local node could not be forwarded somewhere along its route.
+type FailureCallback interface {
+	Fail(msg *proto.Message, key *big.Int, err *ForwardError)
+}
+
+// Report of a routed message failing to get forwarded at an intermediate hop.
+type ForwardError struct {
+	Reason error    // One of ErrLinkDown, ErrOverloaded or ErrTtlExceeded
+	Hop    *big.Int // Node at which the forwarding failed
+	Dest   *big.Int // Destination the message was routed towards
+}
+
+// Implements the error interface.
+func (e *ForwardError) Error() string {
+	return fmt.Sprintf("forwarding to %v failed at %v: %v", e.Dest, e.Hop, e.Reason)
+}
+
+// Wire representation of a forward failure.
+type forwardFailure struct {
+	Code uint8
+	Hop  []byte
+	Dest []byte
+}
+
+// Implements gob.GobEncoder, replacing the reason with its wire code.
+func (e *ForwardError) GobEncode() ([]byte, error) {
+	fail := forwardFailure{Hop: e.Hop.Bytes(), Dest: e.Dest.Bytes()}
+	for i, reason := range failReasons {
+		if reason == e.Reason {
+			fail.Code = uint8(i + 1)
+		}
+	}
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(&fail); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Implements gob.GobDecoder, restoring the reason from its wire code.
+func (e *ForwardError) GobDecode(data []byte) error {
+	fail := new(forwardFailure)
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(fail); err != nil {
+		return err
+	}
+	e.Reason = errors.New("unknown failure")
+	if code := int(fail.Code); code > 0 && code <= len(failReasons) {
+		e.Reason = failReasons[code-1]
+	}
+	e.Hop = new(big.Int).SetBytes(fail.Hop)
+	e.Dest = new(big.Int).SetBytes(fail.Dest)
+	return nil
+}
+
+// Reports the failure to forward an application message back to its origin.
+// The payload is dropped, only the upper layer headers are returned to allow
+// identifying the lost message. Messages from peers predating the reports carry
+// no origin and are silently dropped as before.
+func (o *Overlay) report(head *header, meta interface{}, reason error) {
+	if head.Src == nil {
+		return
+	}
+	o.sendFailure(head.Src, meta, &ForwardError{Reason: reason, Hop: o.nodeId, Dest: head.Dest})
+}
+
+// Passes a forwarding failure report up to the application, if it is interested.
+func (o *Overlay) failed(head *header) {
+	if cb, ok := o.app.(FailureCallback); ok && head.Fail != nil {
+		msg := &proto.Message{
+			Head: proto.Header{
+				Meta: head.Meta,
+			},
+		}
+		cb.Fail(msg, head.Fail.Dest, head.Fail)
+	}
+}
+
+// Looks for a live peer, other than the failed next hop, that is closer to the
+// destination than the local node and can hence take over forwarding a message.
+// The leafset is preferred, falling back to the routing table otherwise.
+func (o *Overlay) alternate(dest, failed *big.Int) *peer {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	var best *peer
+	dist := o.geo.distance(o.nodeId, dest)
+
+	check := func(id *big.Int) {
+		if id == nil || id.Cmp(failed) == 0 || id.Cmp(o.nodeId) == 0 {
+			return
+		}
+		if p, ok := o.livePeers[id.String()]; ok {
+			if d := o.geo.distance(id, dest); d.Cmp(dist) < 0 {
+				best, dist = p, d
+			}
+		}
+	}
+	for _, leaf := range o.routes.leaves {
+		check(leaf)
+	}
+	if best != nil {
+		return best
+	}
+	for _, row := range o.routes.routes {
+		for _, id := range row {
+			check(id)
+		}
+	}
+	return best
+}
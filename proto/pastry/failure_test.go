@@ -0,0 +1,154 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package pastry
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/gob"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto"
+)
+
+// Overlay callback collecting the forwarding failure reports.
+type failer struct {
+	nopCallback
+	fails chan *ForwardError
+}
+
+func (f *failer) Fail(msg *proto.Message, key *big.Int, err *ForwardError) {
+	// Drop reports not retaining the upper layer headers
+	if meta, ok := msg.Head.Meta.([]byte); ok && bytes.Equal(meta, []byte{0x99}) {
+		f.fails <- err
+	}
+}
+
+func TestForwardErrorCoding(t *testing.T) {
+	for _, reason := range failReasons {
+		fail := &ForwardError{Reason: reason, Hop: big.NewInt(1), Dest: big.NewInt(2)}
+
+		buf := new(bytes.Buffer)
+		if err := gob.NewEncoder(buf).Encode(fail); err != nil {
+			t.Fatalf("failed to encode failure: %v.", err)
+		}
+		dec := new(ForwardError)
+		if err := gob.NewDecoder(buf).Decode(dec); err != nil {
+			t.Fatalf("failed to decode failure: %v.", err)
+		}
+		if dec.Reason != fail.Reason || dec.Hop.Cmp(fail.Hop) != 0 || dec.Dest.Cmp(fail.Dest) != 0 {
+			t.Fatalf("failure mismatch: have %v, want %v.", dec, fail)
+		}
+	}
+}
+
+func TestForwardFailure(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+	config.BootPorts = []string{"65520-65521"}
+
+	// Start two nodes collecting failures
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	apps := []*failer{}
+	nodes := []*Overlay{}
+	for i := 0; i < 2; i++ {
+		apps = append(apps, &failer{fails: make(chan *ForwardError, 1)})
+		nodes = append(nodes, New(appId, key, apps[i]))
+		if _, err := nodes[i].Boot(); err != nil {
+			t.Fatalf("failed to boot node: %v.", err)
+		}
+		defer nodes[i].Shutdown()
+	}
+	time.Sleep(time.Second)
+
+	// Inject messages out of hops both at the origin and at a remote node
+	for i, hop := range nodes {
+		dest := nodes[1-i].nodeId
+		msg := &proto.Message{
+			Head: proto.Header{
+				Meta: &header{Meta: []byte{0x99}, Dest: dest, Src: nodes[0].nodeId, Hops: config.PastryMaxHops},
+			},
+		}
+		hop.route(nil, msg)
+
+		select {
+		case fail := <-apps[0].fails:
+			if fail.Reason != ErrTtlExceeded || fail.Hop.Cmp(hop.nodeId) != 0 || fail.Dest.Cmp(dest) != 0 {
+				t.Fatalf("failure report mismatch: have %v.", fail)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("failure report not received.")
+		}
+	}
+	select {
+	case fail := <-apps[1].fails:
+		t.Fatalf("failure reported to non-origin: %v.", fail)
+	default:
+	}
+}
+
+func TestForwardRetry(t *testing.T) {
+	// Create an overlay with a hand crafted routing state
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+
+	o.nodeId = big.NewInt(100)
+	o.routes.leaves = []*big.Int{big.NewInt(50), o.nodeId, big.NewInt(150), big.NewInt(200)}
+	o.routes.routes[0][0] = big.NewInt(180)
+	for _, id := range []int64{50, 150, 180, 200} {
+		o.livePeers[big.NewInt(id).String()] = &peer{nodeId: big.NewInt(id)}
+	}
+	// Make sure the closest live alternate is chosen, falling back to the table
+	tests := []struct {
+		dest   int64
+		failed int64
+		dead   []int64
+		alt    int64 // -1 if none
+	}{
+		{190, 200, nil, 150},
+		{190, 200, []int64{150}, 180},
+		{190, 150, []int64{180, 200}, -1},
+		{60, 50, nil, -1},
+	}
+	for i, tt := range tests {
+		dead := make(map[string]*peer)
+		for _, id := range tt.dead {
+			dead[big.NewInt(id).String()] = o.livePeers[big.NewInt(id).String()]
+			delete(o.livePeers, big.NewInt(id).String())
+		}
+		alt := o.alternate(big.NewInt(tt.dest), big.NewInt(tt.failed))
+		switch {
+		case tt.alt < 0 && alt != nil:
+			t.Errorf("test %d: unexpected alternate: %v.", i, alt.nodeId)
+		case tt.alt >= 0 && (alt == nil || alt.nodeId.Int64() != tt.alt):
+			t.Errorf("test %d: alternate mismatch: have %v, want %v.", i, alt, tt.alt)
+		}
+		for id, p := range dead {
+			o.livePeers[id] = p
+		}
+	}
+}
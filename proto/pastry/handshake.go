@@ -24,6 +24,7 @@
 package pastry
 
 import (
+	"bytes"
 	"encoding/gob"
 	"fmt"
 	"log"
@@ -32,6 +33,7 @@ import (
 	"sort"
 	"time"
 
+	"github.com/karalabe/iris/audit"
 	"github.com/karalabe/iris/config"
 	"github.com/karalabe/iris/proto"
 	"github.com/karalabe/iris/proto/bootstrap"
@@ -41,7 +43,16 @@ import (
 // The initialization packet when the connection is set up.
 type initPacket struct {
 	Id    *big.Int
-	Addrs []string
+	Addrs []string // Advertised addresses, in order of preference
+
+	Space int // Bit length of the node ids
+	Base  int // Bit length of the routing table digits
+
+	Key   []byte // Public key the id is derived from (verifiable ids only)
+	Nonce uint64 // Puzzle solution of the id generation
+	Proof []byte // Signature of the session binding with the key
+
+	Hosted []*initPacket // Sibling virtual nodes of the sender (empty if standalone)
 }
 
 // Make sure the init packet is registered with gob.
@@ -50,33 +61,59 @@ func init() {
 }
 
 // Starts up the overlay networking on a specified interface and fans in all the
-// inbound connections into the overlay-global channels.
-func (o *Overlay) acceptor(ipnet *net.IPNet, quit chan chan error) {
+// inbound connections into the overlay-global channels. The outcome of setting
+// up the listener is reported on the live channel before accepting connections.
+func (o *Overlay) acceptor(ipnet *net.IPNet, live chan error, quit chan chan error) {
 	// Listen for incoming session on the given interface and random port.
 	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(ipnet.IP.String(), "0"))
 	if err != nil {
-		panic(fmt.Sprintf("failed to resolve interface (%v): %v.", ipnet.IP, err))
+		live <- err
+		return
 	}
-	sock, err := session.Listen(addr, o.authKey)
+	sock, err := session.ListenConfig(addr, o.authKey, o.conf.Session)
 	if err != nil {
-		panic(fmt.Sprintf("failed to start session listener: %v.", err))
+		live <- err
+		return
 	}
-	sock.Accept(config.PastryAcceptTimeout)
+	sock.Accept(o.conf.AcceptTimeout)
 
+	// Start the bootstrapper on the specified interface (the memory network has no
+	// broadcast, peers are found through the seeds only)
+	var boot *bootstrap.Bootstrapper
+	var discover chan *bootstrap.Event
+	if !o.conf.Memory {
+		boot, discover, err = bootstrap.NewPorts(ipnet, []byte(o.authId), o.nodeId, addr.Port, o.conf.BootPorts)
+		if err == nil {
+			err = boot.Boot()
+		}
+		if err != nil {
+			sock.Close()
+			live <- err
+			return
+		}
+	}
 	// Save the new listener address into the local (sorted) address list
 	o.lock.Lock()
 	o.addrs = append(o.addrs, addr.String())
 	sort.Strings(o.addrs)
+	o.nets = append(o.nets, ipnet)
+	o.adverts = o.advertise()
 	o.lock.Unlock()
 
-	// Start the bootstrapper on the specified interface
-	boot, discover, err := bootstrap.New(ipnet, []byte(o.authId), o.nodeId, addr.Port)
-	if err != nil {
-		panic(fmt.Sprintf("failed to create bootstrapper: %v.", err))
+	// Map the listener port on the NAT gateway if the interface is private
+	var natQuit chan chan struct{}
+	if o.conf.NatMapping && !public(ipnet.IP) {
+		natQuit = make(chan chan struct{})
+		go o.mapper(addr.Port, natQuit)
 	}
-	if err := boot.Boot(); err != nil {
-		panic(fmt.Sprintf("failed to boot bootstrapper: %v.", err))
+	// Discover the public address of the interface if it's private
+	var stunQuit chan chan struct{}
+	if len(o.conf.StunServers) > 0 && !public(ipnet.IP) {
+		stunQuit = make(chan chan struct{})
+		go o.stunner(ipnet.IP, addr.Port, stunQuit)
 	}
+	live <- nil
+
 	// Process incoming connection until termination is requested
 	var errc chan error
 	for errc == nil {
@@ -103,10 +140,19 @@ func (o *Overlay) acceptor(ipnet *net.IPNet, quit chan chan error) {
 			o.authAccept.Schedule(func() { o.shake(ses) })
 		}
 	}
-	// Terminate the bootstrapper and peer listener
-	errv := boot.Terminate()
-	if errv != nil {
-		log.Printf("pastry: failed to terminate bootstrapper: %v.", errv)
+	// Terminate the address discoverers, bootstrapper and peer listener
+	for _, quit := range []chan chan struct{}{natQuit, stunQuit} {
+		if quit != nil {
+			done := make(chan struct{})
+			quit <- done
+			<-done
+		}
+	}
+	var errv error
+	if boot != nil {
+		if errv = boot.Terminate(); errv != nil {
+			log.Printf("pastry: failed to terminate bootstrapper: %v.", errv)
+		}
 	}
 	if err := sock.Close(); err != nil {
 		log.Printf("pastry: failed to terminate session listener: %v.", err)
@@ -117,6 +163,20 @@ func (o *Overlay) acceptor(ipnet *net.IPNet, quit chan chan error) {
 	errc <- errv
 }
 
+// Connects to the statically configured seed nodes, complementing the peers
+// located by the bootstrappers.
+func (o *Overlay) seed() {
+	seeds, err := bootstrap.SeedsFrom(o.conf.BootSeeds, o.conf.BootSeedFile)
+	if err != nil {
+		log.Printf("pastry: failed to load seed nodes: %v.", err)
+		return
+	}
+	for _, addr := range seeds {
+		seed := addr // Closure
+		o.authInit.Schedule(func() { o.dial([]*net.TCPAddr{seed}) })
+	}
+}
+
 // Checks whether a bootstrap-located peer fits into the local routing table or
 // will be just discarded anyway.
 func (o *Overlay) filter(id *big.Int) bool {
@@ -133,21 +193,21 @@ func (o *Overlay) filter(id *big.Int) bool {
 	// Check for empty slot in leaf set
 	for i, leaf := range table.leaves {
 		if leaf.Cmp(o.nodeId) == 0 {
-			if delta(id, leaf).Sign() >= 0 && i < config.PastryLeaves/2 {
+			if o.geo.delta(id, leaf).Sign() >= 0 && i < o.geo.leaves/2 {
 				return false
 			}
-			if delta(leaf, id).Sign() >= 0 && len(table.leaves)-i < config.PastryLeaves/2 {
+			if o.geo.delta(leaf, id).Sign() >= 0 && len(table.leaves)-i < o.geo.leaves/2 {
 				return false
 			}
 			break
 		}
 	}
 	// Check for better leaf set
-	if delta(table.leaves[0], id).Sign() >= 0 && delta(id, table.leaves[len(table.leaves)-1]).Sign() >= 0 {
+	if o.geo.delta(table.leaves[0], id).Sign() >= 0 && o.geo.delta(id, table.leaves[len(table.leaves)-1]).Sign() >= 0 {
 		return false
 	}
 	// Check place in routing table
-	pre, col := prefix(o.nodeId, id)
+	pre, col := o.geo.prefix(o.nodeId, id)
 	if prev := table.routes[pre][col]; prev == nil {
 		return false
 	}
@@ -155,46 +215,59 @@ func (o *Overlay) filter(id *big.Int) bool {
 	return true
 }
 
-// Asynchronously connects to a remote overlay peer and executes handshake.
-func (o *Overlay) dial(addrs []*net.TCPAddr) {
+// Asynchronously connects to a remote overlay peer and executes handshake. The
+// returned flag reports whether any of the addresses could be connected to.
+func (o *Overlay) dial(addrs []*net.TCPAddr) bool {
 	// Sanity check to make sure self connections are not possible (i.e. malicious bootstrapper)
-	for _, ownAddr := range o.addrs {
+	o.lock.RLock()
+	own := append(append(append([]string{}, o.addrs...), o.mapped...), o.conf.Announce...)
+	o.lock.RUnlock()
+
+	for _, ownAddr := range own {
 		for _, peerAddr := range addrs {
 			if peerAddr.String() == ownAddr {
 				log.Printf("pastry: self connection not allowed: %v.", o.nodeId)
-				return
+				return false
 			}
 		}
 	}
-	// Dial away, trying interfaces one after the other until connection succeeds
+	// Reuse a session shared with the remote host if the node is a virtual one
+	if o.host != nil && o.host.attach(o, addrs) {
+		return true
+	}
+	// Dial away, trying the best matching interfaces first until connection succeeds
+	o.lock.RLock()
+	addrs = rank(o.nets, addrs, o.dials)
+	o.lock.RUnlock()
+
 	for _, addr := range addrs {
-		if ses, err := session.Dial(addr.IP.String(), addr.Port, o.authKey); err == nil {
+		if ses, err := session.DialConfig(addr.IP.String(), addr.Port, o.authKey, o.conf.Session); err == nil {
+			o.dials.record(addr.String(), true)
 			o.shake(ses)
-			return
+			return true
 		} else {
+			o.dials.record(addr.String(), false)
 			log.Printf("pastry: failed to dial remote peer at %v: %v.", addr, err)
 		}
 	}
+	return false
 }
 
 // Executes a two way overlay handshake where both peers exchange their server
 // addresses and virtual ids to enable them both to filter out multiple
 // connections. To prevent resource exhaustion, a timeout is attached to the
-// handshake, the violation of which results in a dropped connection.
+// handshake, the violation of which results in a dropped connection. Sessions
+// between two hosts of virtual nodes are multiplexed among all of them.
 func (o *Overlay) shake(ses *session.Session) {
 	// Start the message transfers and create the peer
-	ses.Start(config.PastryNetBuffer)
+	ses.Start(o.conf.NetBuffer)
 	p := o.newPeer(ses)
 
-	// Send an init packet to the remote peer
-	pkt := new(initPacket)
-	pkt.Id = new(big.Int).Set(o.nodeId)
-
-	o.lock.RLock()
-	pkt.Addrs = make([]string, len(o.addrs))
-	copy(pkt.Addrs, o.addrs)
-	o.lock.RUnlock()
-
+	// Send an init packet to the remote peer, listing the sibling virtual nodes
+	pkt := o.initPacket(ses)
+	if o.host != nil {
+		pkt.Hosted = o.host.initPackets(o, ses)
+	}
 	msg := new(proto.Message)
 	msg.Head.Meta = pkt
 	if err := p.send(msg); err != nil {
@@ -206,7 +279,7 @@ func (o *Overlay) shake(ses *session.Session) {
 	}
 	// Wait for an incoming init packet
 	select {
-	case <-time.After(config.PastryInitTimeout):
+	case <-time.After(o.conf.InitTimeout):
 		log.Printf("pastry: session initialization timed out.")
 		if err := ses.Close(); err != nil {
 			log.Printf("pastry: failed to close unacked session: %v.", err)
@@ -214,9 +287,20 @@ func (o *Overlay) shake(ses *session.Session) {
 	case msg, ok := <-p.conn.CtrlLink.Recv:
 		if ok {
 			pkt = msg.Head.Meta.(*initPacket)
+
+			// Multiplex the session if both sides are (distinct) hosts of virtual nodes
+			if o.host != nil && len(pkt.Hosted) > 0 && !o.host.Owns(pkt.Id) {
+				o.host.multiplex(ses, append([]*initPacket{pkt}, pkt.Hosted...))
+				return
+			}
 			p.nodeId = pkt.Id
 			p.addrs = pkt.Addrs
-
+			if kind := o.admit(p, pkt, ses); kind != "" {
+				if err := ses.Close(); err != nil {
+					log.Printf("pastry: failed to close %s session: %v.", kind, err)
+				}
+				return
+			}
 			// Everything ok, accept connection
 			o.dedup(p)
 		} else {
@@ -228,10 +312,90 @@ func (o *Overlay) shake(ses *session.Session) {
 	}
 }
 
+// Assembles the init packet of the local node, bound to the given session.
+func (o *Overlay) initPacket(ses *session.Session) *initPacket {
+	pkt := new(initPacket)
+	pkt.Id = new(big.Int).Set(o.nodeId)
+	pkt.Space, pkt.Base = o.geo.space, o.geo.base
+	if o.ident != nil {
+		pkt.Key, pkt.Nonce = o.ident.pub, o.ident.nonce
+		pkt.Proof = o.ident.prove(ses.Binding)
+	}
+
+	o.lock.RLock()
+	pkt.Addrs = flatten(o.adverts)
+	o.lock.RUnlock()
+
+	return pkt
+}
+
+// Checks whether a remote peer described by its init packet may be admitted into
+// the overlay. An empty string is returned if so, otherwise the kind of the
+// rejection, used to report the session close.
+func (o *Overlay) admit(p *peer, pkt *initPacket, ses *session.Session) string {
+	// Make sure the remote peer uses the same id space and routing table layout
+	if pkt.Space != o.geo.space || pkt.Base != o.geo.base {
+		log.Printf("pastry: remote peer %v at %v uses different geometry: space %d, base %d.", p.nodeId, p.raddr, pkt.Space, pkt.Base)
+		audit.Emit(&audit.Event{
+			Kind:      audit.PeerRejected,
+			Component: "pastry",
+			Remote:    p.raddr,
+			Peer:      p.nodeId.String(),
+			Detail:    fmt.Sprintf("id space geometry mismatch: space %d, base %d", pkt.Space, pkt.Base),
+		})
+		return "mismatched"
+	}
+	// Make sure the remote id is bound to its key if verification is enforced
+	if config.PastryVerifyIds {
+		if err := verifyId(pkt.Id, pkt.Key, pkt.Nonce, o.geo.space, pkt.Proof, ses.Binding); err != nil {
+			log.Printf("pastry: remote peer %v at %v failed id verification: %v.", p.nodeId, p.raddr, err)
+			audit.Emit(&audit.Event{
+				Kind:      audit.PeerRejected,
+				Component: "pastry",
+				Remote:    p.raddr,
+				Peer:      p.nodeId.String(),
+				Detail:    fmt.Sprintf("unverifiable node id: %v", err),
+			})
+			return "unverified"
+		}
+	}
+	// Refuse peers claiming the local id (self connection or collision)
+	if p.nodeId.Cmp(o.nodeId) == 0 {
+		o.collide(p)
+		return "colliding"
+	}
+	// Refuse peers banned by the access lists
+	if !o.acl.admit(p.nodeId, hostIP(p.raddr)) {
+		log.Printf("pastry: remote peer %v at %v denied by access lists.", p.nodeId, p.raddr)
+		audit.Emit(&audit.Event{
+			Kind:      audit.PeerRejected,
+			Component: "pastry",
+			Remote:    p.raddr,
+			Peer:      p.nodeId.String(),
+			Detail:    "denied by access lists",
+		})
+		return "banned"
+	}
+	// Consult the admission policy, if any
+	if o.authorize != nil && !o.authorize.Authorize(p.nodeId, ses.CtrlLink.Sock().RemoteAddr()) {
+		log.Printf("pastry: remote peer %v at %v denied admission.", p.nodeId, p.raddr)
+		audit.Emit(&audit.Event{
+			Kind:      audit.PeerRejected,
+			Component: "pastry",
+			Remote:    p.raddr,
+			Peer:      p.nodeId.String(),
+			Detail:    "denied by admission policy",
+		})
+		return "denied"
+	}
+	return ""
+}
+
 // Filters a new peer connection to ensure there are no duplicates.
 //  - Same network, same direction: keep the lower client
 //  - Same network, diff direction: keep the lower server
 //  - Diff network:                 keep the lower network
+//  - Shared between hosts:         keep the lower channel binding
 func (o *Overlay) dedup(p *peer) {
 	// Even though p might be a duplicate, parallel dedups might run in an inverse
 	// order at the remote side, thus it might start routing messages before being
@@ -247,6 +411,10 @@ func (o *Overlay) dedup(p *peer) {
 	keepOld := false
 	if ok {
 		switch {
+		// Shared sessions between hosts, both sides keep the lower binding
+		case old.mux != nil && p.mux != nil:
+			keepOld = bytes.Compare(old.conn.Binding, p.conn.Binding) < 0
+
 		// Same network, same direction
 		case old.laddr == p.laddr:
 			keepOld = old.raddr < p.raddr
@@ -290,9 +458,11 @@ func (o *Overlay) dedup(p *peer) {
 		} else if stat == done {
 			o.sendState(p)
 		}
-		// If brand new peer, start monitoring it
+		// If brand new peer, start monitoring it and notify the subscribers
 		if old == nil {
 			o.heart.heart.Monitor(p.nodeId)
+			o.notify(func(ev Events) { ev.PeerJoined(p.nodeId) })
+			o.reunite(p)
 		}
 	}
 	// Terminate the duplicate if any
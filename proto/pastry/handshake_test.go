@@ -23,7 +23,10 @@ import (
 	"crypto/x509"
 	"io/ioutil"
 	"log"
+	"math/big"
+	"net"
 	"os"
+	"sync"
 	"testing"
 )
 
@@ -158,3 +161,104 @@ func TestHandshake(t *testing.T) {
 		t.Fatalf("mallory (%v) found in the pool of bob: %v.", mallory.nodeId, bob.livePeers)
 	}
 }
+
+// Admission policy denying a single node, recording all the queries.
+type denyAuthorizer struct {
+	deny  *big.Int
+	asked map[string]net.Addr
+	lock  sync.Mutex
+}
+
+func (a *denyAuthorizer) Authorize(id *big.Int, addr net.Addr) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.asked[id.String()] = addr
+	return id.Cmp(a.deny) != 0
+}
+
+func TestAuthorizer(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Create the two overlay nodes, alice denying bob
+	alice := New(appId, key, new(nopCallback))
+	bob := New(appId, key, new(nopCallback))
+
+	auth := &denyAuthorizer{deny: bob.nodeId, asked: make(map[string]net.Addr)}
+	alice.SetAuthorizer(auth)
+
+	if _, err := alice.Boot(); err != nil {
+		t.Fatalf("failed to boot alice: %v.", err)
+	}
+	defer func() {
+		if err := alice.Shutdown(); err != nil {
+			t.Fatalf("failed to shutdown alice: %v.", err)
+		}
+	}()
+	if _, err := bob.Boot(); err != nil {
+		t.Fatalf("failed to boot bob: %v.", err)
+	}
+	defer func() {
+		if err := bob.Shutdown(); err != nil {
+			t.Fatalf("failed to shutdown bob: %v.", err)
+		}
+	}()
+	// Verify that the policy was consulted and bob was kept out
+	auth.lock.Lock()
+	addr, ok := auth.asked[bob.nodeId.String()]
+	auth.lock.Unlock()
+	if !ok || addr == nil {
+		t.Fatalf("authorizer not consulted for bob: %v.", auth.asked)
+	}
+	alice.lock.RLock()
+	defer alice.lock.RUnlock()
+	if _, ok := alice.livePeers[bob.nodeId.String()]; ok {
+		t.Fatalf("bob (%v) admitted into the pool of alice: %v.", bob.nodeId, alice.livePeers)
+	}
+}
+
+func TestGeometryHandshake(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Create two nodes in a lean id space and one in the default
+	lean := DefaultConfig()
+	lean.Space, lean.Base, lean.Leaves = 32, 2, 4
+
+	alice := NewConfig(appId, key, new(nopCallback), lean)
+	bob := NewConfig(appId, key, new(nopCallback), lean)
+	carol := New(appId, key, new(nopCallback))
+
+	for _, o := range []*Overlay{alice, bob, carol} {
+		if _, err := o.Boot(); err != nil {
+			t.Fatalf("failed to boot node: %v.", err)
+		}
+		defer o.Shutdown()
+	}
+	// Verify that only the nodes of the same geometry connected
+	for _, o := range []*Overlay{alice, bob, carol} {
+		o.lock.RLock()
+		peers := len(o.livePeers)
+		o.lock.RUnlock()
+
+		want := 1
+		if o == carol {
+			want = 0
+		}
+		if peers != want {
+			t.Fatalf("peer count mismatch: have %d, want %d.", peers, want)
+		}
+	}
+	// Verify that invalid geometries fail the boot
+	lean.Leaves = 3
+	if _, err := NewConfig(appId, key, new(nopCallback), lean).Boot(); err == nil {
+		t.Fatalf("invalid geometry booted.")
+	}
+}
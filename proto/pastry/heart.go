@@ -27,7 +27,6 @@ import (
 	"math/big"
 	"sync"
 
-	"github.com/karalabe/iris/config"
 	"github.com/karalabe/iris/heart"
 )
 
@@ -45,7 +44,10 @@ func newHeart(o *Overlay) *heartbeat {
 		owner: o,
 	}
 	// Insert the internal beater and return
-	h.heart = heart.New(config.PastryBeatPeriod, config.PastryKillCount, h)
+	h.heart = heart.New(o.conf.BeatPeriod, o.conf.KillCount, h)
+	if o.conf.PhiThreshold > 0 {
+		h.heart.SetAdaptive(o.conf.PhiThreshold, o.conf.PhiWindow, o.conf.PhiJitter)
+	}
 
 	return h
 }
@@ -87,6 +89,7 @@ func (h *heartbeat) Dead(id *big.Int) {
 	h.owner.lock.RUnlock()
 
 	if ok {
+		h.owner.suspect(dead)
 		h.owner.drop(dead)
 	}
 }
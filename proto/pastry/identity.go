@@ -0,0 +1,166 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the verifiable node identities, mitigating sybil and
+// eclipse attacks: instead of being freely chosen, node ids are derived from the
+// hash of a per-node public key, hardened by a proof of work puzzle to make the
+// generation of ids adjacent to a victim expensive. Possession of the key is
+// proven by signing the channel binding of each session.
+
+package pastry
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Failures reported when verifying the identity of a remote peer.
+var ErrIdPuzzle = errors.New("node id puzzle unsolved")
+var ErrIdBinding = errors.New("node id not bound to key")
+var ErrIdProof = errors.New("invalid key possession proof")
+
+// Verifiable identity of the local node.
+type identity struct {
+	key   *ecdsa.PrivateKey // Private key proving the ownership of the id
+	pub   []byte            // PKIX encoded public key, the id is derived from
+	nonce uint64            // Solution of the id generation puzzle
+	id    *big.Int          // Overlay node id derived from the key and nonce
+}
+
+// Generates a new identity key and solves the id puzzle at the configured
+// difficulty, deriving an id of the given bit length.
+func newIdentity(space int) *identity {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(fmt.Sprintf("failed to generate identity key: %v", err))
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		panic(fmt.Sprintf("failed to encode identity key: %v", err))
+	}
+	for nonce := uint64(0); ; nonce++ {
+		if id, err := deriveId(pub, nonce, space); err == nil {
+			return &identity{key: key, pub: pub, nonce: nonce, id: id}
+		}
+	}
+}
+
+// Reassembles a previously generated identity from its encoded private key and
+// puzzle solution, verifying it against the current configuration.
+func restoreIdentity(der []byte, nonce uint64, space int) (*identity, error) {
+	key, err := x509.ParseECPrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	id, err := deriveId(pub, nonce, space)
+	if err != nil {
+		return nil, err
+	}
+	return &identity{key: key, pub: pub, nonce: nonce, id: id}, nil
+}
+
+// Encodes the private key of the identity for persisting.
+func (ident *identity) marshal() []byte {
+	der, err := x509.MarshalECPrivateKey(ident.key)
+	if err != nil {
+		panic(fmt.Sprintf("failed to encode identity key: %v", err))
+	}
+	return der
+}
+
+// Derives the node id of the given bit length belonging to a public key and
+// puzzle nonce, failing if the puzzle is not solved at the configured difficulty.
+func deriveId(pub []byte, nonce uint64, space int) (*big.Int, error) {
+	buf := make([]byte, len(pub)+8)
+	copy(buf, pub)
+	binary.BigEndian.PutUint64(buf[len(pub):], nonce)
+
+	puzzle := sha256.Sum256(buf)
+	if zeroBits(puzzle[:]) < config.PastryIdDifficulty {
+		return nil, ErrIdPuzzle
+	}
+	hash := sha256.Sum256(puzzle[:])
+	return new(big.Int).Rsh(new(big.Int).SetBytes(hash[:]), uint(len(hash)*8-space)), nil
+}
+
+// Counts the leading zero bits of a hash.
+func zeroBits(hash []byte) int {
+	for i, b := range hash {
+		if b != 0 {
+			for bit := 7; bit >= 0; bit-- {
+				if b&(1<<uint(bit)) != 0 {
+					return i*8 + 7 - bit
+				}
+			}
+		}
+	}
+	return len(hash) * 8
+}
+
+// Assembles the message signed to prove the possession of an identity key in a
+// specific session.
+func proofDigest(binding []byte, id *big.Int) []byte {
+	hash := sha256.New()
+	hash.Write(binding)
+	hash.Write(id.Bytes())
+	return hash.Sum(nil)
+}
+
+// Signs the channel binding of a session, proving the ownership of the id.
+func (ident *identity) prove(binding []byte) []byte {
+	proof, err := ecdsa.SignASN1(rand.Reader, ident.key, proofDigest(binding, ident.id))
+	if err != nil {
+		panic(fmt.Sprintf("failed to sign identity proof: %v", err))
+	}
+	return proof
+}
+
+// Verifies that a remote node id was derived from the given public key with a
+// solved puzzle, and that the peer possesses the private key in this session.
+func verifyId(id *big.Int, pub []byte, nonce uint64, space int, proof, binding []byte) error {
+	derived, err := deriveId(pub, nonce, space)
+	if err != nil {
+		return err
+	}
+	if id == nil || derived.Cmp(id) != 0 {
+		return ErrIdBinding
+	}
+	key, err := x509.ParsePKIXPublicKey(pub)
+	if err != nil {
+		return err
+	}
+	ecKey, ok := key.(*ecdsa.PublicKey)
+	if !ok || !ecdsa.VerifyASN1(ecKey, proofDigest(binding, id), proof) {
+		return ErrIdProof
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package pastry
+
+import (
+	"crypto/x509"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+func TestIdentity(t *testing.T) {
+	binding := []byte("session binding")
+
+	// Generate an identity and make sure it verifies
+	ident := newIdentity(config.PastrySpace)
+	if err := verifyId(ident.id, ident.pub, ident.nonce, config.PastrySpace, ident.prove(binding), binding); err != nil {
+		t.Fatalf("failed to verify identity: %v.", err)
+	}
+	// Make sure tampered identities are rejected
+	if err := verifyId(new(big.Int).Add(ident.id, big.NewInt(1)), ident.pub, ident.nonce, config.PastrySpace, ident.prove(binding), binding); err != ErrIdBinding {
+		t.Fatalf("chosen id error mismatch: have %v, want %v.", err, ErrIdBinding)
+	}
+	if err := verifyId(ident.id, ident.pub, ident.nonce, config.PastrySpace, ident.prove(binding), []byte("other session")); err != ErrIdProof {
+		t.Fatalf("replayed proof error mismatch: have %v, want %v.", err, ErrIdProof)
+	}
+	other := newIdentity(config.PastrySpace)
+	if err := verifyId(other.id, other.pub, other.nonce, config.PastrySpace, ident.prove(binding), binding); err != ErrIdProof {
+		t.Fatalf("foreign proof error mismatch: have %v, want %v.", err, ErrIdProof)
+	}
+	// Make sure the puzzle difficulty is enforced
+	difficulty := config.PastryIdDifficulty
+	defer func() { config.PastryIdDifficulty = difficulty }()
+
+	config.PastryIdDifficulty = 0
+	weak := newIdentity(config.PastrySpace)
+
+	config.PastryIdDifficulty = 24
+	if _, err := deriveId(weak.pub, weak.nonce, config.PastrySpace); err != ErrIdPuzzle {
+		t.Fatalf("unsolved puzzle error mismatch: have %v, want %v.", err, ErrIdPuzzle)
+	}
+	// Make sure the identity survives persisting
+	config.PastryIdDifficulty = difficulty
+	restored, err := restoreIdentity(ident.marshal(), ident.nonce, config.PastrySpace)
+	if err != nil {
+		t.Fatalf("failed to restore identity: %v.", err)
+	}
+	if restored.id.Cmp(ident.id) != 0 {
+		t.Fatalf("restored id mismatch: have %v, want %v.", restored.id, ident.id)
+	}
+}
+
+func TestVerifiedIds(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	verify := config.PastryVerifyIds
+	defer func() { config.PastryVerifyIds = verify }()
+
+	// Parse encryption key
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Boot two verifiable nodes and an unverifiable one
+	config.PastryVerifyIds = true
+	first := New(appId, key, new(nopCallback))
+	second := New(appId, key, new(nopCallback))
+
+	config.PastryVerifyIds = false
+	rogue := New(appId, key, new(nopCallback))
+	config.PastryVerifyIds = true
+
+	for i, node := range []*Overlay{first, second} {
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot node #%d: %v.", i, err)
+		}
+		defer node.Shutdown()
+	}
+	time.Sleep(time.Second)
+	if peers := len(first.Snapshot().Peers); peers != 1 {
+		t.Fatalf("verified peer count mismatch: have %v, want %v.", peers, 1)
+	}
+	// The unverifiable node should be refused by the verifying ones
+	if peers, err := rogue.Boot(); err != nil || peers != 0 {
+		t.Fatalf("unverifiable node boot mismatch: have %v/%v, want %v/%v.", peers, err, 0, nil)
+	}
+	defer rogue.Shutdown()
+
+	if peers := len(first.Snapshot().Peers); peers != 1 {
+		t.Fatalf("verified peer count mismatch: have %v, want %v.", peers, 1)
+	}
+}
@@ -35,7 +35,6 @@ import (
 
 	"github.com/karalabe/iris/pool"
 
-	"github.com/karalabe/iris/config"
 	"github.com/karalabe/iris/ext/mathext"
 	"github.com/karalabe/iris/ext/sortext"
 )
@@ -54,7 +53,7 @@ func (o *Overlay) manager() {
 
 	// Mark the overlay as unstable
 	stable := false
-	stableTime := config.PastryBootTimeout
+	stableTime := o.conf.BootTimeout
 
 	var errc chan error
 	for errc == nil {
@@ -94,20 +93,23 @@ func (o *Overlay) manager() {
 			// No update arrived for a while, consider stable
 			if !stable {
 				stable = true
-				o.stable.Done()
+				o.settle(true)
+
+				peers := o.activePeers()
+				o.notify(func(ev Events) { ev.Converged(peers) })
 			}
 			continue
 		}
 		// Mark overlay as unstable and set a reduced convergence time
 		if stable {
 			stable = false
-			o.stable.Add(1)
+			o.settle(false)
 		}
-		stableTime = config.PastryConvTimeout
+		stableTime = o.conf.ConvTimeout
 
 		// Merge all state exchanges into the temporary routing table and drop unneeded nodes
-		for _, s := range exchs {
-			o.merge(routes, addrs, s)
+		for p, s := range exchs {
+			o.merge(routes, addrs, o.vet(p, s))
 		}
 		o.dropAll(drops, &pending)
 
@@ -123,11 +125,15 @@ func (o *Overlay) manager() {
 						peerAddrs = append(peerAddrs, addr)
 					}
 				}
-				// Initiate a connection to the remote peer (make sure the lock is not lost)
+				// Initiate a connection to the remote peer (make sure the lock is not lost),
+				// rendezvousing for a hole punch if it's unreachable
 				pending.Add(1)
+				peerId := id
 				err := o.authInit.Schedule(func() {
 					defer pending.Done()
-					o.dial(peerAddrs)
+					if !o.dial(peerAddrs) && o.conf.HolePunch {
+						o.sendPunch(peerId)
+					}
 				})
 				if err == pool.ErrTerminating {
 					pending.Done()
@@ -149,6 +155,9 @@ func (o *Overlay) manager() {
 			o.stat = done
 			o.lock.Unlock()
 
+			snap := o.Snapshot()
+			o.notify(func(ev Events) { ev.RouteChanged(snap) })
+
 			// Revert to read lock (don't hold up reads) and broadcast state
 			o.lock.RLock()
 			o.stateExch.Clear()
@@ -250,17 +259,25 @@ func (o *Overlay) dropAll(peers map[*peer]struct{}, pending *sync.WaitGroup) {
 		return
 	}
 	// Remove the peers from the overlay state
-	o.lock.Lock()
-	defer o.lock.Unlock()
+	left := []*big.Int{}
 
+	o.lock.Lock()
 	for d, _ := range peers {
 		id := d.nodeId.String()
 		if p, ok := o.livePeers[id]; ok && p == d {
 			// Delete the peer and stop monitoring it
 			delete(o.livePeers, id)
 			o.heart.heart.Unmonitor(d.nodeId)
+			left = append(left, d.nodeId)
 		}
 	}
+	o.lock.Unlock()
+
+	// Notify the subscribers of the departures
+	for _, id := range left {
+		id := id // Copy for closure!
+		o.notify(func(ev Events) { ev.PeerLeft(id) })
+	}
 }
 
 // Merges the received state into the provided routing table according to the
@@ -285,7 +302,7 @@ func (o *Overlay) merge(t *table, a map[string][]string, s *state) {
 
 	// Merge the received addresses into the routing table
 	for _, id := range ids {
-		row, col := prefix(o.nodeId, id)
+		row, col := o.geo.prefix(o.nodeId, id)
 		old := t.routes[row][col]
 		switch {
 		case old == nil:
@@ -300,8 +317,8 @@ func (o *Overlay) merge(t *table, a map[string][]string, s *state) {
 func (o *Overlay) mergeLeaves(a, b []*big.Int) []*big.Int {
 	// Append, circular sort and fetch uniques
 	res := append(a, b...)
-	sort.Sort(idSlice{o.nodeId, res})
-	res = res[:sortext.Unique(idSlice{o.nodeId, res})]
+	sort.Sort(idSlice{o.geo, o.nodeId, res})
+	res = res[:sortext.Unique(idSlice{o.geo, o.nodeId, res})]
 
 	// Look for the origin point
 	origin := 0
@@ -309,8 +326,8 @@ func (o *Overlay) mergeLeaves(a, b []*big.Int) []*big.Int {
 		origin++
 	}
 	// Fetch the nearest nodes in both directions
-	min := mathext.MaxInt(0, origin-config.PastryLeaves/2)
-	max := mathext.MinInt(len(res), origin+config.PastryLeaves/2)
+	min := mathext.MaxInt(0, origin-o.geo.leaves/2)
+	max := mathext.MinInt(len(res), origin+o.geo.leaves/2)
 	return res[min:max]
 }
 
@@ -375,7 +392,7 @@ func (o *Overlay) revoke(t *table, down []*big.Int) {
 					t.routes[r][c] = nil
 					o.lock.RLock()
 					for _, p := range o.livePeers {
-						if pre, dig := prefix(o.nodeId, p.nodeId); pre == r && dig == c {
+						if pre, dig := o.geo.prefix(o.nodeId, p.nodeId); pre == r && dig == c {
 							t.routes[r][c] = p.nodeId
 							break
 						}
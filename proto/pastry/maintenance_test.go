@@ -20,7 +20,9 @@
 package pastry
 
 import (
+	"context"
 	"crypto/x509"
+	"fmt"
 	"math/big"
 	"sort"
 	"testing"
@@ -31,55 +33,61 @@ import (
 )
 
 func checkRoutes(t *testing.T, nodes []*Overlay) {
-	// Synchronize overlay states
-	for _, o := range nodes {
-		o.lock.RLock()
-		defer o.lock.RUnlock()
+	// Snapshot the overlay states
+	snaps := make([]*Snapshot, len(nodes))
+	for i, o := range nodes {
+		snaps[i] = o.Snapshot()
 	}
 	// Extract the ids from the running nodes
 	ids := make([]*big.Int, len(nodes))
-	for i, o := range nodes {
-		ids[i] = o.nodeId
+	for i, snap := range snaps {
+		ids[i] = snap.Self
 	}
 	// Assemble the leafset of each node and verify
-	for _, o := range nodes {
-		sort.Sort(idSlice{o.nodeId, ids})
+	for _, snap := range snaps {
+		sort.Sort(idSlice{defaultGeometry, snap.Self, ids})
 		origin := 0
-		for o.nodeId.Cmp(ids[origin]) != 0 {
+		for snap.Self.Cmp(ids[origin]) != 0 {
 			origin++
 		}
 		min := mathext.MaxInt(0, origin-config.PastryLeaves/2)
 		max := mathext.MinInt(len(ids), origin+config.PastryLeaves/2)
 		leaves := ids[min:max]
 
-		if len(leaves) != len(o.routes.leaves) {
-			t.Fatalf("overlay %v: leafset mismatch: have %v, want %v.", o.nodeId, o.routes.leaves, leaves)
+		if len(leaves) != len(snap.Leaves) {
+			t.Fatalf("overlay %v: leafset mismatch: have %v, want %v.", snap.Self, snap.Leaves, leaves)
 		} else {
 			for i, leaf := range leaves {
-				if leaf.Cmp(o.routes.leaves[i]) != 0 {
-					t.Fatalf("overlay %v: leafset mismatch: have %v, want %v.", o.nodeId, o.routes.leaves, leaves)
+				if leaf.Cmp(snap.Leaves[i]) != 0 {
+					t.Fatalf("overlay %v: leafset mismatch: have %v, want %v.", snap.Self, snap.Leaves, leaves)
 					break
 				}
 			}
 		}
+		// Leaves must all be directly connected neighbors
+		for _, leaf := range snap.Leaves {
+			if _, ok := snap.Peers[leaf.String()]; !ok && leaf.Cmp(snap.Self) != 0 {
+				t.Fatalf("overlay %v: leaf not a neighbor: %v.", snap.Self, leaf)
+			}
+		}
 	}
 	// Check the routing table for each node
-	for _, o := range nodes {
-		for r, row := range o.routes.routes {
+	for _, snap := range snaps {
+		for r, row := range snap.Routes {
 			for c, p := range row {
 				if p == nil {
 					// Check that indeed no id is valid for this entry
 					for _, id := range ids {
-						if id.Cmp(o.nodeId) != 0 {
-							if pre, dig := prefix(o.nodeId, id); pre == r && dig == c {
-								t.Fatalf("overlay %v: entry {%v, %v} missing: %v.", o.nodeId, r, c, id)
+						if id.Cmp(snap.Self) != 0 {
+							if pre, dig := prefix(snap.Self, id); pre == r && dig == c {
+								t.Fatalf("overlay %v: entry {%v, %v} missing: %v.", snap.Self, r, c, id)
 							}
 						}
 					}
 				} else {
 					// Check that the id is valid and indeed not some leftover
-					if pre, dig := prefix(o.nodeId, p); pre != r || dig != c {
-						t.Fatalf("overlay %v: entry {%v, %v} invalid: %v.", o.nodeId, r, c, p)
+					if pre, dig := prefix(snap.Self, p); pre != r || dig != c {
+						t.Fatalf("overlay %v: entry {%v, %v} invalid: %v.", snap.Self, r, c, p)
 					}
 					alive := false
 					for _, id := range ids {
@@ -89,7 +97,7 @@ func checkRoutes(t *testing.T, nodes []*Overlay) {
 						}
 					}
 					if !alive {
-						t.Fatalf("overlay %v: entry {%v, %v} already dead: %v.", o.nodeId, r, c, p)
+						t.Fatalf("overlay %v: entry {%v, %v} already dead: %v.", snap.Self, r, c, p)
 					}
 				}
 			}
@@ -108,10 +116,7 @@ func TestMaintenance(t *testing.T) {
 	// Make sure there are enough ports to use
 	olds := config.BootPorts
 	defer func() { config.BootPorts = olds }()
-
-	for i := 0; i < originals+additions; i++ {
-		config.BootPorts = append(config.BootPorts, 65520+i)
-	}
+	config.BootPorts = append(config.BootPorts, fmt.Sprintf("65520-%d", 65520+originals+additions-1))
 	// Parse encryption key
 	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
 
@@ -159,9 +164,7 @@ func TestMaintenanceDOS(t *testing.T) {
 	// Make sure there are enough ports to use (use a huge number to simplify test code)
 	olds := config.BootPorts
 	defer func() { config.BootPorts = olds }()
-	for i := 0; i < 24; i++ {
-		config.BootPorts = append(config.BootPorts, 40000+i)
-	}
+	config.BootPorts = append(config.BootPorts, "40000-40023")
 	// Parse encryption key
 	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
 
@@ -211,3 +214,39 @@ func TestMaintenanceDOS(t *testing.T) {
 	}
 }
 */
+
+func TestWaitConverged(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// An unbooted overlay should block until the context is cancelled
+	alice := New(appId, key, new(nopCallback))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := alice.WaitConverged(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("unbooted convergence mismatch: have %v, want %v.", err, context.DeadlineExceeded)
+	}
+	// A booted overlay should be converged, and destabilize when a peer joins
+	if _, err := alice.Boot(); err != nil {
+		t.Fatalf("failed to boot alice: %v.", err)
+	}
+	defer alice.Shutdown()
+
+	if err := alice.WaitConverged(context.Background()); err != nil {
+		t.Fatalf("booted overlay not converged: %v.", err)
+	}
+	bob := New(appId, key, new(nopCallback))
+	if _, err := bob.Boot(); err != nil {
+		t.Fatalf("failed to boot bob: %v.", err)
+	}
+	defer bob.Shutdown()
+
+	waitConverged(t, []*Overlay{alice, bob})
+	if snap := alice.Snapshot(); len(snap.Leaves) != 2 {
+		t.Fatalf("converged leafset mismatch: have %v, want 2 entries.", snap.Leaves)
+	}
+}
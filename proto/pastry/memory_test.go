@@ -0,0 +1,85 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package pastry
+
+import (
+	"crypto/x509"
+	"sync"
+	"testing"
+
+	"github.com/karalabe/iris/proto/stream"
+)
+
+func TestMemoryTransport(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Boot a seed node on the in-process transport
+	conf := DefaultConfig()
+	conf.Memory = true
+
+	seed := NewConfig(appId, key, new(nopCallback), conf)
+	if _, err := seed.Boot(); err != nil {
+		t.Fatalf("failed to boot seed node: %v.", err)
+	}
+	defer seed.Shutdown()
+
+	seed.lock.RLock()
+	conf.BootSeeds = append([]string{}, seed.addrs...)
+	seed.lock.RUnlock()
+
+	// Boot a batch of nodes concurrently through the seed
+	nodes := []*Overlay{seed}
+	for i := 0; i < 15; i++ {
+		nodes = append(nodes, NewConfig(appId, key, new(nopCallback), conf))
+	}
+	var pend sync.WaitGroup
+	for _, o := range nodes[1:] {
+		pend.Add(1)
+		go func(o *Overlay) {
+			defer pend.Done()
+			if _, err := o.Boot(); err != nil {
+				t.Errorf("failed to boot overlay: %v.", err)
+			}
+		}(o)
+	}
+	pend.Wait()
+	defer func() {
+		for _, o := range nodes[1:] {
+			o.Shutdown()
+		}
+	}()
+	// Make sure no real network was touched and the routing state converged
+	memory := stream.MemoryNetwork()
+	for _, o := range nodes {
+		o.lock.RLock()
+		for _, addr := range o.addrs {
+			if ip := hostIP(addr); !memory.Contains(ip) {
+				t.Fatalf("overlay %v: listener outside memory network: %v.", o.nodeId, addr)
+			}
+		}
+		o.lock.RUnlock()
+	}
+	waitConverged(t, nodes)
+	checkRoutes(t, nodes)
+}
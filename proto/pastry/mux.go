@@ -0,0 +1,320 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the session multiplexing between hosts of virtual nodes. Instead of
+// each virtual node connecting to each remote one separately, a single session
+// is shared between two hosts, carrying the traffic of all the virtual node pairs
+// in an envelope naming the sending and receiving ids. Every pair is represented
+// by its own peer in the owning virtual node, so routing and maintenance are the
+// same as on dedicated sessions, while the shared session is closed only when the
+// last of its pairs is dropped.
+
+package pastry
+
+import (
+	"bytes"
+	"encoding/gob"
+	"log"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/karalabe/iris/proto"
+	"github.com/karalabe/iris/proto/link"
+	"github.com/karalabe/iris/proto/session"
+)
+
+// Envelope of the messages exchanged on a multiplexed session.
+type muxHeader struct {
+	Src  *big.Int    // Virtual node sending the message
+	Dest *big.Int    // Virtual node the message is addressed to
+	Meta interface{} // Overlay headers of the message
+}
+
+// Make sure the envelope is registered with gob.
+func init() {
+	gob.Register(&muxHeader{})
+}
+
+// Session shared by the virtual nodes of two hosts.
+type mux struct {
+	host   *Host
+	ses    *session.Session
+	remote map[string]*initPacket // Virtual nodes of the remote host, keyed by id
+
+	pairs  map[string]*peer    // Peers of the open virtual node pairs, keyed by local and remote id
+	denied map[string]struct{} // Virtual node pairs refused admission
+	closed bool                // Whether the session was closed locally
+	down   bool                // Whether the session was torn down
+	lock   sync.Mutex          // Lock protecting the pairs and the session state
+}
+
+// Assembles the key of a virtual node pair.
+func pairKey(local, remote *big.Int) string {
+	return local.String() + "/" + remote.String()
+}
+
+// Shares an initialized session with a remote host, pairing up all the local
+// virtual nodes with all the remote ones. The unneeded pairs are pruned by the
+// maintenance of the owning nodes, as any dedicated peer would be.
+func (h *Host) multiplex(ses *session.Session, remotes []*initPacket) {
+	m := &mux{
+		host:   h,
+		ses:    ses,
+		remote: make(map[string]*initPacket),
+		pairs:  make(map[string]*peer),
+		denied: make(map[string]struct{}),
+	}
+	for _, pkt := range remotes {
+		m.remote[pkt.Id.String()] = pkt
+	}
+	// Keep a single session per remote host, both sides retaining the one with the
+	// lowest channel binding
+	retired := []*mux{}
+
+	h.lock.Lock()
+	for old := range h.muxes {
+		if old.peers(m) {
+			if bytes.Compare(old.ses.Binding, ses.Binding) < 0 {
+				m = nil
+				break
+			}
+			retired = append(retired, old)
+		}
+	}
+	h.lock.Unlock()
+
+	if m == nil {
+		if err := ses.Close(); err != nil {
+			log.Printf("pastry: failed to close duplicate session: %v.", err)
+		}
+		return
+	}
+	for _, old := range retired {
+		old.retire()
+	}
+	// Pair up the virtual nodes, dropping the session if none were admitted
+	peers := []*peer{}
+
+	m.lock.Lock()
+	for _, node := range h.nodes {
+		for _, pkt := range remotes {
+			if p := m.pair(node, pkt); p != nil {
+				peers = append(peers, p)
+			}
+		}
+	}
+	m.lock.Unlock()
+
+	if len(peers) == 0 {
+		if err := ses.Close(); err != nil {
+			log.Printf("pastry: failed to close unpaired session: %v.", err)
+		}
+		return
+	}
+	h.lock.Lock()
+	h.muxes[m] = struct{}{}
+	h.lock.Unlock()
+
+	// Start routing the inbound messages and accept the pairs
+	go m.processor(ses.CtrlLink)
+	go m.processor(ses.DataLink)
+
+	for _, p := range peers {
+		p.owner.dedup(p)
+	}
+}
+
+// Creates the peer of a local and a remote virtual node, if the remote node is
+// admitted by the local one. The mux lock is assumed held.
+func (m *mux) pair(node *Overlay, pkt *initPacket) *peer {
+	key := pairKey(node.nodeId, pkt.Id)
+	if _, ok := m.denied[key]; ok {
+		return nil
+	}
+	p := node.newPeer(m.ses)
+	p.mux = m
+	p.nodeId, p.addrs = pkt.Id, pkt.Addrs
+	if kind := node.admit(p, pkt, m.ses); kind != "" {
+		m.denied[key] = struct{}{}
+		return nil
+	}
+	m.pairs[key] = p
+	return p
+}
+
+// Opens the pair of a local and a remote virtual node if not yet open, returning
+// its peer (nil if the pair is refused or the session is closed).
+func (m *mux) open(node *Overlay, pkt *initPacket) *peer {
+	m.lock.Lock()
+	if m.closed || m.down {
+		m.lock.Unlock()
+		return nil
+	}
+	if p, ok := m.pairs[pairKey(node.nodeId, pkt.Id)]; ok {
+		m.lock.Unlock()
+		return p
+	}
+	p := m.pair(node, pkt)
+	m.lock.Unlock()
+
+	if p != nil {
+		node.dedup(p)
+	}
+	return p
+}
+
+// Detaches a closed peer from the session, asking the remote virtual node to drop
+// its end of the pair too. The session is closed along with the last pair.
+func (m *mux) release(p *peer) error {
+	m.lock.Lock()
+	key := pairKey(p.owner.nodeId, p.nodeId)
+	if m.pairs[key] == p {
+		delete(m.pairs, key)
+	}
+	last := len(m.pairs) == 0 && !m.closed
+	if last {
+		m.closed = true
+	}
+	notify := !m.closed && !m.down
+	m.lock.Unlock()
+
+	if notify {
+		p.owner.sendClose(p)
+	}
+	if last {
+		m.host.forget(m)
+		return m.ses.Close()
+	}
+	return nil
+}
+
+// Checks whether two shared sessions lead to the same remote host.
+func (m *mux) peers(other *mux) bool {
+	for id := range other.remote {
+		if _, ok := m.remote[id]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Closes a shared session superseded by another one to the same remote host,
+// dropping all its pairs.
+func (m *mux) retire() {
+	m.lock.Lock()
+	if m.closed {
+		m.lock.Unlock()
+		return
+	}
+	m.closed = true
+	peers := make([]*peer, 0, len(m.pairs))
+	for _, p := range m.pairs {
+		peers = append(peers, p)
+	}
+	m.lock.Unlock()
+
+	m.host.forget(m)
+	for _, p := range peers {
+		p.owner.drop(p)
+	}
+	if err := m.ses.Close(); err != nil {
+		log.Printf("pastry: failed to close superseded session: %v.", err)
+	}
+}
+
+// Wraps a message into the envelope addressing it to the remote end of a pair,
+// leaving the original intact for any other recipients.
+func (m *mux) wrap(p *peer, msg *proto.Message) *proto.Message {
+	wrapped := *msg
+	wrapped.Head.Meta = &muxHeader{Src: p.owner.nodeId, Dest: p.nodeId, Meta: msg.Head.Meta}
+	return &wrapped
+}
+
+// Accepts inbound messages from one link of the session and routes them into the
+// virtual node they are addressed to. Pairs closed locally are reopened if the
+// remote side still uses them, unless it's closing them too.
+func (m *mux) processor(link *link.Link) {
+	for msg := range link.Recv {
+		env, ok := msg.Head.Meta.(*muxHeader)
+		if !ok {
+			log.Printf("pastry: unaddressed message on multiplexed session.")
+			continue
+		}
+		msg.Head.Meta = env.Meta
+
+		m.lock.Lock()
+		p, ok := m.pairs[pairKey(env.Dest, env.Src)]
+		m.lock.Unlock()
+
+		if !ok {
+			if head, ok := env.Meta.(*header); ok && head.Op == opClose {
+				continue
+			}
+			node, pkt := m.host.node(env.Dest), m.remote[env.Src.String()]
+			if node == nil || pkt == nil {
+				continue
+			}
+			if p = m.open(node, pkt); p == nil {
+				continue
+			}
+		}
+		atomic.AddUint64(&p.msgsIn, 1)
+		p.owner.route(p, msg)
+
+		// Signal a graceful tear-down of the pair by the remote side
+		if head, ok := env.Meta.(*header); ok && head.Op == opClose {
+			p.signal()
+		}
+	}
+	// Session went down, drop all the pairs sharing it
+	m.lock.Lock()
+	m.down = true
+	peers := make([]*peer, 0, len(m.pairs))
+	for _, p := range m.pairs {
+		peers = append(peers, p)
+	}
+	m.lock.Unlock()
+
+	for _, p := range peers {
+		p.signal()
+		p.owner.drop(p)
+	}
+}
+
+// Signals the remote tear-down of a multiplexed pair to a terminating owner.
+func (p *peer) signal() {
+	select {
+	case p.drop <- struct{}{}:
+	default:
+	}
+}
+
+// Checks whether a remote virtual node listens on any of the given addresses.
+func (pkt *initPacket) listens(addrs []*net.TCPAddr) bool {
+	for _, addr := range addrs {
+		for _, a := range pkt.Addrs {
+			if addr.String() == a {
+				return true
+			}
+		}
+	}
+	return false
+}
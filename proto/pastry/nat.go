@@ -0,0 +1,152 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the NAT traversal of the private listeners: the gateway is
+// asked to forward an external port to the local one (or the public address is
+// discovered via STUN), the resulting address advertised to remote peers, and
+// the mapping lease renewed until the listener terminates.
+
+package pastry
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/karalabe/iris/proto/nat"
+)
+
+// Assembles the advertisement list from the listener, the NAT mapped external and
+// the explicitly announced addresses. The overlay lock is assumed held.
+func (o *Overlay) advertise() []*advert {
+	addrs := make([]string, 0, len(o.addrs)+len(o.mapped)+len(o.conf.Announce))
+	addrs = append(addrs, o.addrs...)
+	addrs = append(addrs, o.mapped...)
+	addrs = append(addrs, o.conf.Announce...)
+	return advertise(addrs, o.conf.Advertise, o.conf.PreferPublic)
+}
+
+// Maps a local listener port on the NAT gateway and keeps renewing the lease
+// until termination is requested, after which the mapping is removed.
+func (o *Overlay) mapper(port int, quit chan chan struct{}) {
+	var (
+		gateway nat.Mapper // Gateway doing the port mapping, if found
+		addr    string     // External address currently advertised
+		renew   <-chan time.Time
+	)
+	// Locates the gateway if needed and (re)maps the listener port
+	refresh := func() {
+		if gateway == nil {
+			var err error
+			if gateway, err = nat.Discover(o.conf.NatTimeout); err != nil {
+				log.Printf("pastry: failed to locate nat gateway: %v.", err)
+				return
+			}
+		}
+		external, err := gateway.Map("tcp", port, port, o.conf.NatLease)
+		if err != nil {
+			log.Printf("pastry: failed to map listener port %d: %v.", port, err)
+			return
+		}
+		ip, err := gateway.External()
+		if err != nil {
+			log.Printf("pastry: failed to retrieve external address: %v.", err)
+			return
+		}
+		mapped := net.JoinHostPort(ip.String(), strconv.Itoa(external))
+		o.remap(addr, mapped)
+		addr = mapped
+	}
+	for {
+		refresh()
+		if addr != "" {
+			renew = time.After(o.conf.NatLease / 2)
+		} else {
+			renew = time.After(o.conf.NatTimeout)
+		}
+		select {
+		case done := <-quit:
+			// Remove the mapping and advertisement, and return
+			if addr != "" {
+				_, ext, _ := net.SplitHostPort(addr)
+				external, _ := strconv.Atoi(ext)
+				if err := gateway.Unmap("tcp", port, external); err != nil {
+					log.Printf("pastry: failed to unmap listener port %d: %v.", port, err)
+				}
+				o.remap(addr, "")
+			}
+			close(done)
+			return
+		case <-renew:
+		}
+	}
+}
+
+// Replaces an external address with a new one, updating the adverts.
+func (o *Overlay) remap(old, addr string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	mapped := make([]string, 0, len(o.mapped)+1)
+	for _, a := range o.mapped {
+		if a == old {
+			old = "" // Drop a single instance, others may share the address
+			continue
+		}
+		mapped = append(mapped, a)
+	}
+	if addr != "" {
+		mapped = append(mapped, addr)
+	}
+	o.mapped = mapped
+	o.adverts = o.advertise()
+}
+
+// Periodically queries the STUN servers for the public address of a private
+// listener, advertising it combined with the local port until termination. The
+// port is kept as is, so it is only reachable if the NAT preserves or forwards
+// it, but this is the common case for statically configured gateways.
+func (o *Overlay) stunner(ip net.IP, port int, quit chan chan struct{}) {
+	var addr string // External address currently advertised
+	for {
+		// Ask the servers in order until one answers
+		for _, server := range o.conf.StunServers {
+			public, err := nat.Stun(&net.UDPAddr{IP: ip}, server, o.conf.NatTimeout)
+			if err != nil {
+				log.Printf("pastry: failed to query stun server %v: %v.", server, err)
+				continue
+			}
+			if found := net.JoinHostPort(public.IP.String(), strconv.Itoa(port)); found != addr {
+				o.remap(addr, found)
+				addr = found
+			}
+			break
+		}
+		select {
+		case done := <-quit:
+			if addr != "" {
+				o.remap(addr, "")
+			}
+			close(done)
+			return
+		case <-time.After(o.conf.StunPeriod):
+		}
+	}
+}
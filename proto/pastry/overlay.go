@@ -22,17 +22,18 @@
 package pastry
 
 import (
-	"crypto/rand"
+	"context"
 	"crypto/rsa"
 	"fmt"
-	"io"
+	"log"
 	"math/big"
 	"net"
 	"sync"
+	"time"
 
-	"github.com/karalabe/iris/config"
 	"github.com/karalabe/iris/pool"
 	"github.com/karalabe/iris/proto"
+	"github.com/karalabe/iris/proto/session"
 )
 
 // Different status types in which the node can be.
@@ -50,25 +51,57 @@ type Callback interface {
 	Forward(msg *proto.Message, key *big.Int) bool
 }
 
+// Admission policy for remote peers, consulted after a session authenticated
+// successfully but before the peer is admitted into the overlay. Returning
+// false denies the peer and drops the session.
+type Authorizer interface {
+	Authorize(id *big.Int, addr net.Addr) bool
+}
+
 // Internal structure for the overlay state information.
 type Overlay struct {
 	app Callback // Upstream application callback
 
-	authId  string          // Iris network id
-	authKey *rsa.PrivateKey // Iris authentication key
-
-	nodeId *big.Int // Pastry peer id
-	addrs  []string // Listener addresses
+	authId    string          // Iris network id
+	authKey   *rsa.PrivateKey // Iris authentication key
+	authorize Authorizer      // Optional admission policy for remote peers
+	policy    RoutePolicy     // Optional customization of the next hop selection
+	acl       *acl            // Runtime managed allow and deny lists
+	conf      *Config         // Instance tunables (timeouts, ports, buffers)
+	geo       *geometry       // Id space and routing table layout
+	host      *Host           // Host of the sibling virtual nodes (nil if standalone)
+	invalid   error           // Configuration failure reported by the boot
+
+	nodeId  *big.Int     // Pastry peer id
+	ident   *identity    // Key the node id is derived from (nil if unverifiable)
+	addrs   []string     // Listener addresses
+	nets    []*net.IPNet // Networks of the listener interfaces
+	mapped  []string     // External addresses of the listeners behind NATs
+	adverts []*advert    // Advertised listener addresses, in order of preference
+	dials   *dialLog     // Outcomes of past dials, preferring the reachable addresses
+	known   []*savedPeer // Routing state and peers known from a previous run
+
+	record     *record            // Signed record of the local addresses (verified ids only)
+	records    map[string]*record // Freshest verified address records of remote nodes
+	recordLock sync.Mutex         // Lock protecting the address records
+
+	collided bool // Whether another live node was found with the local id
 
 	livePeers map[string]*peer // Active connection pool
 	heart     *heartbeat       // Beater for the active peers
 
+	lost      map[string]*absentee // Failed peers to probe for partition healing
+	lostLock  sync.Mutex           // Lock protecting the lost peers
+	probeQuit chan chan struct{}   // Quit sync channel for the lost peer prober
+	rttQuit   chan chan struct{}   // Quit sync channel for the round trip time prober
+
 	routes *table
 	time   uint64
 	stat   status
 
-	acceptQuit []chan chan error // Quit sync channels for the acceptors
-	maintQuit  chan chan error   // Quit sync channel for the maintenance routine
+	acceptQuit map[string]chan chan error // Quit sync channels for the acceptors, keyed by interface
+	addrQuit   chan chan struct{}         // Quit sync channel for the interface address watcher
+	maintQuit  chan chan error            // Quit sync channel for the maintenance routine
 
 	authInit   *pool.ThreadPool // Locally initiated authentication pool
 	authAccept *pool.ThreadPool // Remotely initiated authentication pool
@@ -80,19 +113,44 @@ type Overlay struct {
 	eventLock   sync.Mutex    // Lock protecting overlay events
 	eventNotify chan struct{} // Notifier for event changes
 
-	stable sync.WaitGroup // Syncer for reaching convergence
-	lock   sync.RWMutex   // Syncer for state mods after booting
+	bcastSeq  uint64              // Sequence number of the last local broadcast (atomic)
+	bcastSeen map[string]struct{} // Broadcasts seen in the current memory period
+	bcastPrev map[string]struct{} // Broadcasts seen in the previous memory period
+	bcastTime time.Time           // Start of the current memory period
+	bcastLock sync.Mutex          // Lock protecting the seen broadcasts
+
+	subs     []Events     // Subscribed membership event handlers
+	subsLock sync.RWMutex // Lock protecting the event subscriptions
+
+	stable     bool          // Whether the routing state is currently converged
+	stableWait chan struct{} // Channel closed upon the next convergence
+	stableLock sync.Mutex    // Lock protecting the convergence state
+
+	lock sync.RWMutex // Syncer for state mods after booting
 }
 
 // Creates a new overlay structure with all internal state initialized, ready to
 // be booted.
 func New(id string, key *rsa.PrivateKey, app Callback) *Overlay {
-	// Generate the random node id for this overlay peer
-	peerId := make([]byte, config.PastrySpace/8)
-	if n, err := io.ReadFull(rand.Reader, peerId); n < len(peerId) || err != nil {
-		panic(fmt.Sprintf("failed to generate node id: %v", err))
+	return NewConfig(id, key, app, DefaultConfig())
+}
+
+// Creates a new overlay structure similarly to New, but using the given tunables
+// instead of the global defaults. The configuration is copied, so it may be
+// reused for other overlays.
+func NewConfig(id string, key *rsa.PrivateKey, app Callback, conf *Config) *Overlay {
+	conf = conf.copy()
+
+	// Set up the id space, falling back to the defaults to fail the boot if invalid
+	geo, invalid := newGeometry(conf.Space, conf.Base, conf.Leaves)
+	if invalid != nil {
+		geo = defaultGeometry
 	}
-	nodeId := new(big.Int).SetBytes(peerId)
+	// Restore the persisted node id or generate a random one for this overlay peer
+	nodeId, ident, known := restore(conf.StateFile, geo)
+
+	// Bind the session keys to the overlay and the local peer
+	conf.Session.Overlay, conf.Session.Identity = id, nodeId.Bytes()
 
 	// Assemble and return the overlay instance
 	o := &Overlay{
@@ -100,63 +158,114 @@ func New(id string, key *rsa.PrivateKey, app Callback) *Overlay {
 
 		authId:  id,
 		authKey: key,
-
-		nodeId: nodeId,
-		addrs:  []string{},
+		acl:     newAcl(),
+		conf:    conf,
+		geo:     geo,
+		invalid: invalid,
+
+		nodeId:  nodeId,
+		ident:   ident,
+		addrs:   []string{},
+		nets:    []*net.IPNet{},
+		mapped:  []string{},
+		adverts: []*advert{},
+		dials:   newDialLog(),
+		known:   known,
+		records: make(map[string]*record),
 
 		livePeers: make(map[string]*peer),
-		routes:    newRoutingTable(nodeId),
+		lost:      make(map[string]*absentee),
+		probeQuit: make(chan chan struct{}),
+		rttQuit:   make(chan chan struct{}),
+		routes:    newRoutingTable(nodeId, geo),
 		time:      1,
 
-		acceptQuit: []chan chan error{},
+		acceptQuit: make(map[string]chan chan error),
+		addrQuit:   make(chan chan struct{}),
 		maintQuit:  make(chan chan error),
 
-		authInit:   pool.NewThreadPool(config.PastryAuthThreads),
-		authAccept: pool.NewThreadPool(config.PastryAuthThreads),
-		stateExch:  pool.NewThreadPool(config.PastryExchThreads),
+		authInit:   pool.NewThreadPool(conf.AuthThreads),
+		authAccept: pool.NewThreadPool(conf.AuthThreads),
+		stateExch:  pool.NewThreadPool(conf.ExchThreads),
 
 		exchSet:     make(map[*peer]*state),
 		dropSet:     make(map[*peer]struct{}),
 		eventNotify: make(chan struct{}, 1), // Buffer one notification
+
+		bcastSeen: make(map[string]struct{}),
+		bcastPrev: make(map[string]struct{}),
+		bcastTime: time.Now(),
+
+		stableWait: make(chan struct{}),
 	}
 	o.heart = newHeart(o)
 	return o
 }
 
+// Overrides the session handshake parameters (timeouts and retry policy) used
+// by this overlay. The overlay and identity bindings are filled in locally. Must
+// be called before booting.
+func (o *Overlay) SetShakeConfig(conf *session.Config) {
+	shake := *conf
+	shake.Overlay, shake.Identity = o.authId, o.nodeId.Bytes()
+	o.conf.Session = &shake
+}
+
+// Sets an admission policy to verify remote peers with before letting them in
+// the overlay (nil admits everyone). Must be called before booting.
+func (o *Overlay) SetAuthorizer(auth Authorizer) {
+	o.authorize = auth
+}
+
+// Overrides the ports used by the bootstrappers to discover peers, allowing side
+// by side overlays to use disjoint ports. Must be called before booting.
+func (o *Overlay) SetBootPorts(ports []int) {
+	o.conf.BootPorts = ports
+}
+
 // Boots the overlay network: it starts up boostrappers and connection acceptors
 // on all local IPv4 interfaces, after which the overlay management is booted.
 // The method returns the number of remote peers after convergence is reached.
 func (o *Overlay) Boot() (int, error) {
-	// Start the individual acceptors
-	addrs, err := net.InterfaceAddrs()
+	// Refuse to start with an unusable id space
+	if o.invalid != nil {
+		return 0, o.invalid
+	}
+	// Start the individual acceptors (a single one on the memory network if simulated)
+	ifaces, err := o.interfaces()
 	if err != nil {
 		return 0, err
 	}
-	for _, addr := range addrs {
-		if ipnet, ok := addr.(*net.IPNet); ok {
-			if !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
-				// Create a quit channel and start the acceptor
-				quit := make(chan chan error)
-				o.acceptQuit = append(o.acceptQuit, quit)
-				go o.acceptor(ipnet, quit)
-			}
+	for _, ipnet := range ifaces {
+		if err := o.bind(ipnet); err != nil {
+			log.Printf("pastry: failed to bind interface %v: %v.", ipnet.IP, err)
 		}
 	}
 	// Start the overlay processes
-	o.stable.Add(1)
 	go o.manager()
+	go o.prober(o.probeQuit)
+	go o.pinger(o.rttQuit)
+	go o.watcher(o.addrQuit)
 	o.heart.start()
 
 	o.authInit.Start()
 	o.authAccept.Start()
 	o.stateExch.Start()
 
+	// Dial any configured seed nodes to join beyond the local networks
+	o.seed()
+	o.rejoin()
+
 	// Wait for convergence and report remote connections
-	o.stable.Wait()
+	o.WaitConverged(context.Background())
 
 	o.lock.RLock()
 	defer o.lock.RUnlock()
 
+	if o.collided {
+		return 0, ErrIdCollision
+	}
+
 	peers := 0
 	for _, p := range o.livePeers {
 		if o.active(p.nodeId) {
@@ -166,12 +275,52 @@ func (o *Overlay) Boot() (int, error) {
 	return peers, nil
 }
 
+// Blocks until the routing state of the overlay stabilizes, i.e. no changes were
+// seen for the convergence window (the boot timeout on startup), or until the
+// context is cancelled. It returns immediately if the overlay is converged.
+func (o *Overlay) WaitConverged(ctx context.Context) error {
+	o.stableLock.Lock()
+	stable, wait := o.stable, o.stableWait
+	o.stableLock.Unlock()
+
+	if stable {
+		return nil
+	}
+	select {
+	case <-wait:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Updates the convergence state, releasing the waiters upon stabilization.
+func (o *Overlay) settle(stable bool) {
+	o.stableLock.Lock()
+	defer o.stableLock.Unlock()
+
+	switch {
+	case stable && !o.stable:
+		close(o.stableWait)
+	case !stable && o.stable:
+		o.stableWait = make(chan struct{})
+	}
+	o.stable = stable
+}
+
 // Sends a termination signal to all the go routines part of the overlay.
 func (o *Overlay) Shutdown() error {
 	errs := []error{}
 	errc := make(chan error)
 
-	// Close the peer listeners to prevent new connections
+	// Save the live peers for a quick rejoin after restart
+	o.persist()
+
+	// Stop tracking the interfaces and close the peer listeners to prevent new connections
+	stop := make(chan struct{})
+	o.addrQuit <- stop
+	<-stop
+
 	for _, quit := range o.acceptQuit {
 		quit <- errc
 	}
@@ -180,7 +329,15 @@ func (o *Overlay) Shutdown() error {
 			errs = append(errs, err)
 		}
 	}
-	// Wait for all pending handshakes to finish
+	// Stop probing lost peers and wait for all pending handshakes to finish
+	stop = make(chan struct{})
+	o.probeQuit <- stop
+	<-stop
+
+	stop = make(chan struct{})
+	o.rttQuit <- stop
+	<-stop
+
 	o.authAccept.Terminate(false)
 	o.authInit.Terminate(false)
 
@@ -207,6 +364,27 @@ func (o *Overlay) Shutdown() error {
 	}
 }
 
+// Switches the sessions of all live peers in-band to fresh keys of a new cipher
+// suite (e.g. after the configuration enabled one), without disconnecting them.
+// The number of renegotiated sessions is returned, along with the first failure.
+func (o *Overlay) Renegotiate(suite string) (int, error) {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	var res error
+	done := 0
+	for _, p := range o.livePeers {
+		if err := p.conn.Renegotiate(suite); err != nil {
+			if res == nil {
+				res = err
+			}
+			continue
+		}
+		done++
+	}
+	return done, res
+}
+
 // Returns the overlay node's identifier.
 func (o *Overlay) Self() *big.Int {
 	return o.nodeId
@@ -218,6 +396,7 @@ func (o *Overlay) Send(dest *big.Int, msg *proto.Message) {
 	head := &header{
 		Meta: msg.Head.Meta,
 		Dest: dest,
+		Src:  o.nodeId,
 	}
 	msg.Head.Meta = head
 
@@ -20,8 +20,10 @@
 package pastry
 
 import (
+	"context"
 	"log"
 	"math/big"
+	"testing"
 	"time"
 
 	"github.com/karalabe/iris/config"
@@ -86,6 +88,30 @@ func swapConfigs() {
 	config.PastryLeaves, pastryLeaves = pastryLeaves, config.PastryLeaves
 }
 
+// Waits until all the overlays converge, failing the test if they don't in time.
+// Since a node converging may still unsettle an earlier one, the wait is repeated
+// until a full pass finds every overlay stable.
+func waitConverged(t *testing.T, nodes []*Overlay) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for settled := false; !settled; {
+		settled = true
+		for _, o := range nodes {
+			o.stableLock.Lock()
+			stable := o.stable
+			o.stableLock.Unlock()
+
+			if !stable {
+				settled = false
+				if err := o.WaitConverged(ctx); err != nil {
+					t.Fatalf("overlay %v: failed to converge: %v.", o.nodeId, err)
+				}
+			}
+		}
+	}
+}
+
 // No-op overlay callback
 type nopCallback struct {
 }
@@ -0,0 +1,124 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the partition healing. Peers lost to failures are remembered for a
+// while and reprobed at a low rate, so that when a network split heals (e.g. a
+// rebooted switch), the halves reconnect and reconcile their leafsets through
+// state exchanges instead of living on as separate overlays.
+
+package pastry
+
+import (
+	"log"
+	"math/big"
+	"sort"
+	"time"
+)
+
+// A previously known peer, currently unreachable.
+type absentee struct {
+	id     *big.Int
+	addrs  []string  // Advertised addresses of the peer when last seen
+	lost   time.Time // Time instance the peer was lost
+	probed time.Time // Time instance the peer was last probed
+}
+
+// Sorts the lost peers by ascending probe times.
+type byProbe []*absentee
+
+func (a byProbe) Len() int           { return len(a) }
+func (a byProbe) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byProbe) Less(i, j int) bool { return a[i].probed.Before(a[j].probed) }
+
+// Remembers a failed peer for reprobing, if it was part of the routing state.
+// Passive connections dying are of no interest, nobody would redial them anyway.
+func (o *Overlay) suspect(p *peer) {
+	if len(p.addrs) == 0 {
+		return
+	}
+	o.lock.RLock()
+	active := o.active(p.nodeId)
+	o.lock.RUnlock()
+
+	if active {
+		o.lostLock.Lock()
+		o.lost[p.nodeId.String()] = &absentee{id: p.nodeId, addrs: p.addrs, lost: time.Now()}
+		o.lostLock.Unlock()
+	}
+}
+
+// Forgets a newly connected peer if it was lost before, requesting a repair to
+// merge the remote routing state (i.e. that of the other partition) into ours.
+func (o *Overlay) reunite(p *peer) {
+	o.lostLock.Lock()
+	_, ok := o.lost[p.nodeId.String()]
+	delete(o.lost, p.nodeId.String())
+	o.lostLock.Unlock()
+
+	if ok {
+		log.Printf("pastry: lost peer reconnected, merging states: %v.", p.nodeId)
+		o.sendRepair(p)
+	}
+}
+
+// Collects the next batch of lost peers to probe. Peers lost for too long or in
+// the meanwhile reconnected are forgotten, the rest served least recently probed
+// first.
+func (o *Overlay) candidates(now time.Time) []*absentee {
+	o.lostLock.Lock()
+	defer o.lostLock.Unlock()
+
+	o.lock.RLock()
+	due := make([]*absentee, 0, len(o.lost))
+	for sid, a := range o.lost {
+		if _, ok := o.livePeers[sid]; ok || now.Sub(a.lost) > o.conf.MergeExpiry {
+			delete(o.lost, sid)
+			continue
+		}
+		due = append(due, a)
+	}
+	o.lock.RUnlock()
+
+	sort.Sort(byProbe(due))
+	if len(due) > o.conf.MergeBatch {
+		due = due[:o.conf.MergeBatch]
+	}
+	for _, a := range due {
+		a.probed = now
+	}
+	return due
+}
+
+// Periodically redials a batch of lost peers until termination is requested. A
+// successful probe is handled as any other new connection, exchanging states.
+func (o *Overlay) prober(quit chan chan struct{}) {
+	for {
+		select {
+		case done := <-quit:
+			close(done)
+			return
+		case <-time.After(o.conf.MergePeriod):
+			for _, a := range o.candidates(time.Now()) {
+				if addrs := resolve(a.addrs); len(addrs) > 0 {
+					o.authInit.Schedule(func() { o.dial(addrs) })
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package pastry
+
+import (
+	"crypto/x509"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestPartitionCandidates(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	conf := DefaultConfig()
+	conf.MergeBatch, conf.MergeExpiry = 1, time.Minute
+	o := NewConfig(appId, key, new(nopCallback), conf)
+
+	// Lose a few peers, one of them long ago and one already reconnected
+	now := time.Now()
+	for i := int64(0); i < 5; i++ {
+		o.lost[big.NewInt(i).String()] = &absentee{id: big.NewInt(i), lost: now, probed: now.Add(time.Duration(i) * time.Second)}
+	}
+	o.lost["0"].lost = now.Add(-time.Hour)
+	o.livePeers["1"] = &peer{nodeId: big.NewInt(1)}
+
+	// Ensure batches are served least recently probed first, forgetting stale ones
+	order := [][]int64{{2}, {3}, {4}, {2}}
+	for i, want := range order {
+		due := o.candidates(now.Add(time.Duration(10+i) * time.Second))
+		if len(due) != len(want) {
+			t.Fatalf("round %d: batch size mismatch: have %d, want %d.", i, len(due), len(want))
+		}
+		for j, a := range due {
+			if a.id.Int64() != want[j] {
+				t.Fatalf("round %d, probe %d: peer mismatch: have %v, want %v.", i, j, a.id, want[j])
+			}
+		}
+	}
+	if len(o.lost) != 3 {
+		t.Fatalf("lost peer count mismatch: have %d, want 3.", len(o.lost))
+	}
+}
+
+func TestPartitionMerge(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	conf := DefaultConfig()
+	conf.MergePeriod = 250 * time.Millisecond
+
+	// Boot two nodes and wait for them to converge
+	first := NewConfig(appId, key, new(nopCallback), conf)
+	if _, err := first.Boot(); err != nil {
+		t.Fatalf("failed to boot first node: %v.", err)
+	}
+	defer first.Shutdown()
+
+	second := NewConfig(appId, key, new(nopCallback), conf)
+	if _, err := second.Boot(); err != nil {
+		t.Fatalf("failed to boot second node: %v.", err)
+	}
+	defer second.Shutdown()
+	time.Sleep(time.Second)
+
+	// Simulate a partition by reporting the peers dead to each other
+	first.heart.Dead(second.Self())
+	second.heart.Dead(first.Self())
+
+	first.lostLock.Lock()
+	if _, ok := first.lost[second.Self().String()]; !ok {
+		t.Fatalf("failed peer not remembered for probing.")
+	}
+	first.lostLock.Unlock()
+
+	// Wait for the split to heal and the states to merge
+	time.Sleep(3 * time.Second)
+
+	for _, o := range []*Overlay{first, second} {
+		snap := o.Snapshot()
+		if len(snap.Leaves) != 2 {
+			t.Fatalf("leafset not merged: have %v, want 2 leaves.", snap.Leaves)
+		}
+		o.lostLock.Lock()
+		if len(o.lost) != 0 {
+			t.Fatalf("reconnected peers still probed: %v.", o.lost)
+		}
+		o.lostLock.Unlock()
+	}
+}
@@ -27,19 +27,24 @@ import (
 	"math/big"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/karalabe/iris/proto/link"
 
-	"github.com/karalabe/iris/config"
 	"github.com/karalabe/iris/proto"
 	"github.com/karalabe/iris/proto/session"
 )
 
 // Peer state information.
 type peer struct {
+	// Message accounting (atomic, keep first for alignment)
+	msgsIn  uint64
+	msgsOut uint64
+
 	owner *Overlay
 	conn  *session.Session
+	mux   *mux // Session shared with the other virtual nodes (nil if dedicated)
 
 	// Virtual id and reachable addresses
 	nodeId *big.Int
@@ -54,6 +59,7 @@ type peer struct {
 	// Overlay state infos
 	time    uint64
 	passive bool
+	rtt     *rttWindow // Recent round trip time samples
 
 	// Maintenance fields
 	quit chan chan error // Synchronizes peer termination
@@ -74,14 +80,21 @@ func (o *Overlay) newPeer(ses *session.Session) *peer {
 		lhost: ses.CtrlLink.Sock().LocalAddr().(*net.TCPAddr).IP.String(),
 		rhost: ses.CtrlLink.Sock().LocalAddr().(*net.TCPAddr).IP.String(),
 
+		// Latency accounting
+		rtt: newRttWindow(o.conf.RttWindow),
+
 		// Transport and maintenance channels
 		quit: make(chan chan error),
 		drop: make(chan struct{}, 2),
 	}
 }
 
-// Starts the inbound message processor and router.
+// Starts the inbound message processor and router. Multiplexed peers are fed by
+// the processors of their shared session instead.
 func (p *peer) Start() {
+	if p.mux != nil {
+		return
+	}
 	go p.processor(p.conn.CtrlLink)
 	go p.processor(p.conn.DataLink)
 }
@@ -97,6 +110,10 @@ func (p *peer) Close() error {
 	}
 	p.term = true
 
+	// Detach from a shared session, closing it only after the last of its peers
+	if p.mux != nil {
+		return p.mux.release(p)
+	}
 	// Gracefully close the peer session, flushing pending messages
 	res := p.conn.Close()
 
@@ -118,11 +135,16 @@ func (p *peer) send(msg *proto.Message) error {
 	if len(msg.Data) == 0 {
 		link = p.conn.CtrlLink
 	}
+	// Address the message to the remote virtual node if the session is shared
+	if p.mux != nil {
+		msg = p.mux.wrap(p, msg)
+	}
 	// Send the message on the selected channel
 	select {
 	case link.Send <- msg:
+		atomic.AddUint64(&p.msgsOut, 1)
 		return nil
-	case <-time.After(config.PastrySendTimeout):
+	case <-time.After(p.owner.conf.SendTimeout):
 		return errors.New("timeout")
 	}
 }
@@ -145,6 +167,7 @@ func (p *peer) processor(link *link.Link) {
 				continue
 			}
 			// Route the control message
+			atomic.AddUint64(&p.msgsIn, 1)
 			p.owner.route(p, msg)
 		}
 	}
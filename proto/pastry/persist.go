@@ -0,0 +1,253 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the node state persistence, letting a restarted node rejoin
+// the overlay with its previous id (and reconnect its last known peers) instead
+// of churning the routing tables of the whole neighborhood. The leafset and the
+// routing table are snapshotted too, so the restarted node can redial its whole
+// routing state at once and converge in a single round.
+
+package pastry
+
+import (
+	"crypto/rand"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/karalabe/iris/audit"
+	"github.com/karalabe/iris/config"
+)
+
+// Failure reported by the boot if another live node was found using the local
+// node id. The persisted state is discarded, so a restart will pick a new one.
+var ErrIdCollision = errors.New("node id collision")
+
+// Node state persisted across restarts.
+type persisted struct {
+	Space  int          // Size of the id space the id was generated in
+	Id     *big.Int     // Overlay node id of the local peer
+	Key    []byte       // Encoded identity key, if the id is verifiable
+	Nonce  uint64       // Puzzle solution of the verifiable identity
+	Leaves []*savedPeer // Members of the leafset at shutdown
+	Routes []*savedPeer // Members of the routing table at shutdown
+	Peers  [][]string   // Advertised addresses of the other live peers
+}
+
+// A peer of the persisted routing state.
+type savedPeer struct {
+	Id    *big.Int // Overlay node id of the peer (nil if unknown)
+	Addrs []string // Advertised addresses of the peer
+}
+
+// Collects the peers of a persisted state to redial, the leafset first, as that
+// is the most vital to routing.
+func (s *persisted) known() []*savedPeer {
+	res := make([]*savedPeer, 0, len(s.Leaves)+len(s.Routes)+len(s.Peers))
+	res = append(res, s.Leaves...)
+	res = append(res, s.Routes...)
+	for _, addrs := range s.Peers {
+		res = append(res, &savedPeer{Addrs: addrs})
+	}
+	return res
+}
+
+// Generates a node id for this overlay peer: a random one, or one derived from a
+// fresh identity key if ids are verified.
+func generate(geo *geometry) (*big.Int, *identity) {
+	if config.PastryVerifyIds {
+		ident := newIdentity(geo.space)
+		return ident.id, ident
+	}
+	peerId, err := rand.Int(rand.Reader, geo.modulo)
+	if err != nil {
+		panic(fmt.Sprintf("failed to generate node id: %v", err))
+	}
+	return peerId, nil
+}
+
+// Retrieves the node id (and identity), along with the last known peers from the
+// given state file, or generates a fresh id (and saves it) if there is no usable
+// state.
+func restore(path string, geo *geometry) (*big.Int, *identity, []*savedPeer) {
+	if path == "" {
+		id, ident := generate(geo)
+		return id, ident, nil
+	}
+	state, err := loadState(path)
+	switch {
+	case err == nil && (state.Space != geo.space || state.Id == nil):
+		log.Printf("pastry: discarding persisted state of different id space: %v bits.", state.Space)
+	case err == nil && !config.PastryVerifyIds:
+		return state.Id, nil, state.known()
+	case err == nil:
+		ident, err := restoreIdentity(state.Key, state.Nonce, geo.space)
+		if err == nil && ident.id.Cmp(state.Id) == 0 {
+			return ident.id, ident, state.known()
+		}
+		log.Printf("pastry: discarding persisted state without verifiable identity.")
+	case !os.IsNotExist(err):
+		log.Printf("pastry: failed to load persisted state: %v.", err)
+	}
+	id, ident := generate(geo)
+	state = &persisted{Space: geo.space, Id: id}
+	if ident != nil {
+		state.Key, state.Nonce = ident.marshal(), ident.nonce
+	}
+	if err := saveState(path, state); err != nil {
+		log.Printf("pastry: failed to persist node state: %v.", err)
+	}
+	return id, ident, nil
+}
+
+// Loads a previously persisted node state.
+func loadState(path string) (*persisted, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	state := new(persisted)
+	if err := gob.NewDecoder(file).Decode(state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Atomically replaces the persisted node state with a new one.
+func saveState(path string, state *persisted) error {
+	temp := path + ".tmp"
+	file, err := os.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(file).Encode(state); err != nil {
+		file.Close()
+		os.Remove(temp)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return os.Rename(temp, path)
+}
+
+// Saves the local node id along with a snapshot of the routing state and the
+// addresses of the other live peers, if persistence is enabled.
+func (o *Overlay) persist() {
+	if o.conf.StateFile == "" {
+		return
+	}
+	state := &persisted{Space: o.geo.space, Id: o.nodeId}
+	if o.ident != nil {
+		state.Key, state.Nonce = o.ident.marshal(), o.ident.nonce
+	}
+
+	o.lock.RLock()
+	saved := make(map[string]struct{})
+	save := func(id *big.Int) *savedPeer {
+		p, ok := o.livePeers[id.String()]
+		if _, dup := saved[id.String()]; !ok || dup || len(p.addrs) == 0 {
+			return nil
+		}
+		saved[id.String()] = struct{}{}
+		return &savedPeer{Id: id, Addrs: p.addrs}
+	}
+	for _, id := range o.routes.leaves {
+		if p := save(id); p != nil {
+			state.Leaves = append(state.Leaves, p)
+		}
+	}
+	for _, row := range o.routes.routes {
+		for _, id := range row {
+			if id == nil {
+				continue
+			}
+			if p := save(id); p != nil {
+				state.Routes = append(state.Routes, p)
+			}
+		}
+	}
+	for id, p := range o.livePeers {
+		if _, ok := saved[id]; !ok && len(p.addrs) > 0 {
+			state.Peers = append(state.Peers, p.addrs)
+		}
+	}
+	o.lock.RUnlock()
+
+	if err := saveState(o.conf.StateFile, state); err != nil {
+		log.Printf("pastry: failed to persist node state: %v.", err)
+	}
+}
+
+// Dials the peers known from the persisted state of a previous run all at once,
+// so their state exchanges are merged together. Routing state members failing to
+// answer are handed over to the lost peer prober to retry later.
+func (o *Overlay) rejoin() {
+	for _, known := range o.known {
+		if addrs := resolve(known.Addrs); len(addrs) > 0 {
+			known := known // Closure
+			o.authInit.Schedule(func() {
+				if !o.dial(addrs) && known.Id != nil {
+					o.lostLock.Lock()
+					o.lost[known.Id.String()] = &absentee{id: known.Id, addrs: known.Addrs, lost: time.Now()}
+					o.lostLock.Unlock()
+				}
+			})
+		}
+	}
+}
+
+// Handles a remote peer claiming the local node id. Unless it's the local node
+// reached through an unknown address (e.g. NAT hairpinning), another instance
+// is running with the same id (i.e. a copied state file or stale process), so
+// the persisted state is dropped and the boot is failed.
+func (o *Overlay) collide(p *peer) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for _, addr := range p.addrs {
+		for _, own := range flatten(o.adverts) {
+			if addr == own {
+				log.Printf("pastry: self connection not allowed: %v.", o.nodeId)
+				return
+			}
+		}
+	}
+	log.Printf("pastry: remote peer at %v collides with local node id %v.", p.raddr, o.nodeId)
+	audit.Emit(&audit.Event{
+		Kind:      audit.PeerRejected,
+		Component: "pastry",
+		Remote:    p.raddr,
+		Peer:      o.nodeId.String(),
+		Detail:    "node id collision",
+	})
+	if !o.collided && o.conf.StateFile != "" {
+		if err := os.Remove(o.conf.StateFile); err != nil && !os.IsNotExist(err) {
+			log.Printf("pastry: failed to discard persisted state: %v.", err)
+		}
+	}
+	o.collided = true
+}
@@ -0,0 +1,176 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package pastry
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/karalabe/iris/config"
+)
+
+func TestPersistence(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	dir, err := ioutil.TempDir("", "iris-pastry")
+	if err != nil {
+		t.Fatalf("failed to create state directory: %v.", err)
+	}
+	defer os.RemoveAll(dir)
+
+	stateFile := config.PastryStateFile
+	config.PastryStateFile = filepath.Join(dir, "state")
+	defer func() { config.PastryStateFile = stateFile }()
+
+	// Parse encryption key
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Make sure the node id is reused in consecutive runs
+	first := New(appId, key, new(nopCallback))
+	if _, err := os.Stat(config.PastryStateFile); err != nil {
+		t.Fatalf("node state not persisted: %v.", err)
+	}
+	second := New(appId, key, new(nopCallback))
+	if first.nodeId.Cmp(second.nodeId) != 0 {
+		t.Fatalf("node id mismatch: have %v, want %v.", second.nodeId, first.nodeId)
+	}
+	// Make sure a live node using the same id is detected
+	if _, err := first.Boot(); err != nil {
+		t.Fatalf("failed to boot first node: %v.", err)
+	}
+	defer first.Shutdown()
+
+	if _, err := second.Boot(); err != ErrIdCollision {
+		t.Fatalf("collision mismatch: have %v, want %v.", err, ErrIdCollision)
+	}
+	defer second.Shutdown()
+
+	if _, err := os.Stat(config.PastryStateFile); !os.IsNotExist(err) {
+		t.Fatalf("colliding node state not discarded: %v.", err)
+	}
+}
+
+func TestInstanceConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iris-pastry")
+	if err != nil {
+		t.Fatalf("failed to create state directory: %v.", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Parse encryption key
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Create two overlays with different state files from the same base config
+	conf := DefaultConfig()
+	conf.StateFile = filepath.Join(dir, "first")
+	first := NewConfig(appId, key, new(nopCallback), conf)
+
+	conf.StateFile = filepath.Join(dir, "second")
+	conf.BootPorts = []int{65432}
+	second := NewConfig(appId, key, new(nopCallback), conf)
+
+	// Make sure the instances kept their own tunables and bindings
+	if first.conf.StateFile == second.conf.StateFile || len(first.conf.BootPorts) == 1 {
+		t.Fatalf("configuration shared between instances: %v, %v.", first.conf, second.conf)
+	}
+	if first.conf.Session == second.conf.Session || string(first.conf.Session.Identity) == string(second.conf.Session.Identity) {
+		t.Fatalf("session configuration shared between instances.")
+	}
+	for _, o := range []*Overlay{first, second} {
+		state, err := loadState(o.conf.StateFile)
+		if err != nil {
+			t.Fatalf("failed to load instance state: %v.", err)
+		}
+		if state.Id.Cmp(o.nodeId) != 0 {
+			t.Fatalf("instance state id mismatch: have %v, want %v.", state.Id, o.nodeId)
+		}
+	}
+}
+
+func TestRejoin(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	dir, err := ioutil.TempDir("", "iris-pastry")
+	if err != nil {
+		t.Fatalf("failed to create state directory: %v.", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Parse encryption key
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Boot a small overlay, one node persisting its state
+	conf := DefaultConfig()
+	conf.StateFile = filepath.Join(dir, "state")
+
+	alice := New(appId, key, new(nopCallback))
+	bob := New(appId, key, new(nopCallback))
+	carol := NewConfig(appId, key, new(nopCallback), conf)
+
+	for _, o := range []*Overlay{alice, bob, carol} {
+		if _, err := o.Boot(); err != nil {
+			t.Fatalf("failed to boot overlay: %v.", err)
+		}
+	}
+	defer alice.Shutdown()
+	defer bob.Shutdown()
+
+	waitConverged(t, []*Overlay{alice, bob, carol})
+	if err := carol.Shutdown(); err != nil {
+		t.Fatalf("failed to shutdown carol: %v.", err)
+	}
+	// Verify that the routing state was snapshotted
+	state, err := loadState(conf.StateFile)
+	if err != nil {
+		t.Fatalf("failed to load persisted state: %v.", err)
+	}
+	if len(state.Leaves) == 0 {
+		t.Fatalf("leafset snapshot missing.")
+	}
+	for _, p := range append(state.Leaves, state.Routes...) {
+		if p.Id.Cmp(alice.nodeId) != 0 && p.Id.Cmp(bob.nodeId) != 0 {
+			t.Fatalf("unknown peer in routing state snapshot: %v.", p.Id)
+		}
+	}
+	// Depending on the ids, the second peer might not be part of the routing state
+	if known := state.known(); len(known) != 2 {
+		t.Fatalf("known peer snapshot mismatch: have %v, want 2 peers.", len(known))
+	}
+	// Restart carol out of reach of the bootstrappers, rejoining from the snapshot
+	conf.BootPorts = []int{65300}
+	carol = NewConfig(appId, key, new(nopCallback), conf)
+
+	peers, err := carol.Boot()
+	if err != nil {
+		t.Fatalf("failed to reboot carol: %v.", err)
+	}
+	defer carol.Shutdown()
+
+	if peers != 2 {
+		t.Fatalf("rejoined peer count mismatch: have %v, want 2.", peers)
+	}
+}
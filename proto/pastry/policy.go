@@ -0,0 +1,111 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the pluggable routing policy. The overlay still decides where a
+// message may go, restricting the candidates to peers making progress towards
+// the destination (sharing at least as long a prefix with it as the local node
+// and being numerically closer), which keeps routing loop free whatever the
+// policy picks. Only the choice among those candidates is customizable.
+
+package pastry
+
+import (
+	"math/big"
+	"time"
+)
+
+// A possible next hop offered to the routing policy.
+type Hop struct {
+	Id   *big.Int      // Node id of the candidate peer
+	Addr string        // Remote network address of the connection
+	Rtt  time.Duration // Median round trip time to the peer (0 if not measured yet)
+}
+
+// Next hop selector consulted when forwarding a message. The first candidate is
+// the overlay's own pick. The policy is invoked with the routing state locked,
+// hence it must be fast and must not call back into the overlay.
+type RoutePolicy interface {
+	// Selects the next hop towards the destination, returning its index in the
+	// candidate list. Out of range indices fall back to the default pick.
+	NextHop(dest *big.Int, hops []*Hop) int
+}
+
+// Sets a routing policy to customize the next hop selection with (nil restores
+// the default). Must be called before booting.
+func (o *Overlay) SetRoutePolicy(policy RoutePolicy) {
+	o.policy = policy
+}
+
+// Consults the routing policy, if any, whether to forward a message towards the
+// destination through a different peer than the default pick. The overlay lock
+// is assumed read held.
+func (o *Overlay) steer(dest, best *big.Int) *big.Int {
+	if o.policy == nil {
+		return best
+	}
+	pre, _ := o.geo.prefix(o.nodeId, dest)
+	dist := o.geo.distance(o.nodeId, dest)
+
+	// Collect the default pick and all other live peers making progress
+	hops := []*Hop{o.hop(best)}
+	seen := map[string]struct{}{best.String(): {}}
+
+	check := func(id *big.Int) {
+		if id == nil || id.Cmp(o.nodeId) == 0 {
+			return
+		}
+		if _, ok := seen[id.String()]; ok {
+			return
+		}
+		seen[id.String()] = struct{}{}
+		if _, ok := o.livePeers[id.String()]; !ok {
+			return
+		}
+		if p, _ := o.geo.prefix(id, dest); p >= pre && o.geo.distance(id, dest).Cmp(dist) < 0 {
+			hops = append(hops, o.hop(id))
+		}
+	}
+	for _, leaf := range o.routes.leaves {
+		check(leaf)
+	}
+	for _, row := range o.routes.routes {
+		for _, id := range row {
+			check(id)
+		}
+	}
+	if len(hops) == 1 {
+		return best
+	}
+	if idx := o.policy.NextHop(dest, hops); idx >= 0 && idx < len(hops) {
+		return hops[idx].Id
+	}
+	return best
+}
+
+// Assembles the routing policy view of a peer.
+func (o *Overlay) hop(id *big.Int) *Hop {
+	hop := &Hop{Id: id}
+	if p, ok := o.livePeers[id.String()]; ok {
+		hop.Addr = p.raddr
+		if stat := p.rtt.stats(); stat != nil {
+			hop.Rtt = stat.P50
+		}
+	}
+	return hop
+}
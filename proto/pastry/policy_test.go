@@ -0,0 +1,129 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package pastry
+
+import (
+	"crypto/x509"
+	"math/big"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/proto"
+)
+
+// Routing policy always picking the last offered candidate, counting the times
+// it actually deviated from the default.
+type contrarian struct {
+	calls  int32
+	offers int32
+}
+
+func (c *contrarian) NextHop(dest *big.Int, hops []*Hop) int {
+	atomic.AddInt32(&c.calls, 1)
+	for _, hop := range hops {
+		if hop.Id == nil || hop.Addr == "" {
+			return 0
+		}
+	}
+	atomic.AddInt32(&c.offers, int32(len(hops)-1))
+	return len(hops) - 1
+}
+
+func TestRoutePolicy(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Boot a seed node on the in-process transport
+	conf := DefaultConfig()
+	conf.Memory = true
+
+	policy := new(contrarian)
+	apps := []*collector{new(collector)}
+
+	seed := NewConfig(appId, key, apps[0], conf)
+	seed.SetRoutePolicy(policy)
+	if _, err := seed.Boot(); err != nil {
+		t.Fatalf("failed to boot seed node: %v.", err)
+	}
+	defer seed.Shutdown()
+
+	seed.lock.RLock()
+	conf.BootSeeds = append([]string{}, seed.addrs...)
+	seed.lock.RUnlock()
+
+	// Boot a batch of overlays through the seed, all using the contrarian policy
+	nodes := []*Overlay{seed}
+	for i := 0; i < 15; i++ {
+		apps = append(apps, new(collector))
+		nodes = append(nodes, NewConfig(appId, key, apps[i+1], conf))
+		nodes[i+1].SetRoutePolicy(policy)
+	}
+	var pend sync.WaitGroup
+	for _, o := range nodes[1:] {
+		pend.Add(1)
+		go func(o *Overlay) {
+			defer pend.Done()
+			if _, err := o.Boot(); err != nil {
+				t.Errorf("failed to boot overlay: %v.", err)
+			}
+		}(o)
+	}
+	pend.Wait()
+	defer func() {
+		for _, o := range nodes[1:] {
+			o.Shutdown()
+		}
+	}()
+	waitConverged(t, nodes)
+
+	// Send a message from everybody to everybody, and check correct delivery
+	for _, src := range nodes {
+		for _, dst := range nodes {
+			msg := &proto.Message{
+				Head: proto.Header{Meta: []byte(dst.nodeId.String())},
+				Data: []byte{0x00},
+			}
+			msg.Encrypt()
+			src.Send(dst.nodeId, msg)
+		}
+	}
+	time.Sleep(time.Second)
+
+	for i, app := range apps {
+		app.lock.RLock()
+		if len(app.delivs) != len(nodes) {
+			t.Fatalf("node #%d: delivery count mismatch: have %d, want %d.", i, len(app.delivs), len(nodes))
+		}
+		for _, msg := range app.delivs {
+			if dest := string(msg.Head.Meta.([]byte)); dest != nodes[i].nodeId.String() {
+				t.Fatalf("node #%d: misrouted message: have %v, want %v.", i, dest, nodes[i].nodeId)
+			}
+		}
+		app.lock.RUnlock()
+	}
+	if atomic.LoadInt32(&policy.offers) == 0 {
+		t.Fatalf("routing policy never offered alternatives (%d calls).", atomic.LoadInt32(&policy.calls))
+	}
+}
@@ -24,6 +24,7 @@ package pastry
 import (
 	"encoding/gob"
 	"math/big"
+	"time"
 
 	"github.com/karalabe/iris/proto"
 )
@@ -33,18 +34,26 @@ type opcode uint8
 
 // Pastry operation types.
 const (
-	opNop     opcode = iota // Application layer message
-	opJoin                  // Join request
-	opRepair                // Routing table repair request
-	opActive                // Heartbeat for an active peer
-	opPassive               // Heartbeat for a passive peer
-	opExchage               // Pastry state exchange
-	opClose                 // Leave request
+	opNop      opcode = iota // Application layer message
+	opJoin                   // Join request
+	opRepair                 // Routing table repair request
+	opActive                 // Heartbeat for an active peer
+	opPassive                // Heartbeat for a passive peer
+	opExchage                // Pastry state exchange
+	opClose                  // Leave request
+	opFailure                // Forwarding failure report
+	opPunchReq               // Hole punching rendezvous request
+	opPunchRep               // Hole punching rendezvous reply
+	opBcast                  // Overlay wide broadcast
+	opPing                   // Round trip time probe
+	opPong                   // Round trip time probe reply
+	opAddress                // Local address change notification
 )
 
 // Routing state exchange message.
 type state struct {
 	Addrs   map[string][]string // Known peers and their network addresses
+	Records map[string]*record  // Signed address records vouching for the peers (verified ids only)
 	Version uint64              // Version counter to skip old messages
 }
 
@@ -54,6 +63,15 @@ type header struct {
 	Op    opcode      // The operation to execute
 	Dest  *big.Int    // Destination id
 	State *state      // Routing table state exchange
+
+	Src  *big.Int      // Originating node of application messages
+	Hops int           // Number of overlay hops taken so far
+	Fail *ForwardError // Forwarding failure being reported
+
+	Seq   uint64 // Sequence number of a broadcast, unique per origin
+	Level int    // Spanning tree level the broadcast recipient is responsible for
+
+	Stamp int64 // Send time of a round trip time probe, echoed back in the reply
 }
 
 // Make sure the header struct is registered with gob.
@@ -86,7 +104,7 @@ func (o *Overlay) sendPacket(dest *peer, head *header) {
 // network addresses, sending it towards the destination node.
 func (o *Overlay) sendJoin(dest *peer) {
 	state := &state{
-		Addrs: map[string][]string{o.nodeId.String(): o.addrs},
+		Addrs: map[string][]string{o.nodeId.String(): flatten(o.adverts)},
 	}
 	o.sendPacket(dest, &header{Op: opJoin, Dest: o.nodeId, State: state})
 }
@@ -120,14 +138,14 @@ func (o *Overlay) sendState(dest *peer) {
 	}
 
 	// Serialize our own addresses, the leaf set and common row
-	s.Addrs[o.nodeId.String()] = o.addrs
+	s.Addrs[o.nodeId.String()] = flatten(o.adverts)
 	for _, id := range o.routes.leaves {
 		sid := id.String()
 		if node, ok := o.livePeers[sid]; ok {
 			s.Addrs[sid] = node.addrs
 		}
 	}
-	idx, _ := prefix(o.nodeId, dest.nodeId)
+	idx, _ := o.geo.prefix(o.nodeId, dest.nodeId)
 	for _, id := range o.routes.routes[idx] {
 		if id != nil {
 			sid := id.String()
@@ -138,10 +156,78 @@ func (o *Overlay) sendState(dest *peer) {
 	}
 	o.lock.RUnlock()
 
+	// Vouch for the entries if they can be verified
+	if o.ident != nil {
+		s.Records = o.vouch(s.Addrs)
+	}
 	// Send the state exchange
 	o.sendPacket(dest, &header{Op: opExchage, Dest: dest.nodeId, State: s})
 }
 
+// Assembles a forwarding failure report, consisting of the failure opcode, the
+// upper layer headers of the undeliverable message and the failure details,
+// routing it back towards the origin of the message.
+func (o *Overlay) sendFailure(origin *big.Int, meta interface{}, fail *ForwardError) {
+	msg := &proto.Message{
+		Head: proto.Header{
+			Meta: &header{Op: opFailure, Dest: origin, Meta: meta, Fail: fail},
+		},
+	}
+	o.route(nil, msg)
+}
+
+// Assembles a hole punching rendezvous request, consisting of the punch opcode,
+// the local id and addresses, routing it through the overlay to the destination.
+func (o *Overlay) sendPunch(dest *big.Int) {
+	o.sendRendezvous(opPunchReq, dest)
+}
+
+// Assembles a hole punching rendezvous reply, routing it through the overlay back
+// to the node which requested the punch.
+func (o *Overlay) sendPunched(dest *big.Int) {
+	o.sendRendezvous(opPunchRep, dest)
+}
+
+// Routes a rendezvous message of the given kind through the overlay.
+func (o *Overlay) sendRendezvous(op opcode, dest *big.Int) {
+	o.lock.RLock()
+	state := &state{
+		Addrs: map[string][]string{o.nodeId.String(): flatten(o.adverts)},
+	}
+	o.lock.RUnlock()
+
+	msg := &proto.Message{
+		Head: proto.Header{
+			Meta: &header{Op: op, Dest: dest, Src: o.nodeId, State: state},
+		},
+	}
+	o.route(nil, msg)
+}
+
+// Assembles a round trip time probe, consisting of the ping opcode and the local
+// send time, sending it directly to the destination node.
+func (o *Overlay) sendPing(dest *peer) {
+	o.sendPacket(dest, &header{Op: opPing, Dest: dest.nodeId, Stamp: time.Now().UnixNano()})
+}
+
+// Assembles a round trip time probe reply, echoing back the send time of the
+// probe to the node which requested it.
+func (o *Overlay) sendPong(dest *peer, stamp int64) {
+	o.sendPacket(dest, &header{Op: opPong, Dest: dest.nodeId, Stamp: stamp})
+}
+
+// Assembles an address update, consisting of the address opcode and the current
+// local addresses, sending it directly to the destination node.
+func (o *Overlay) sendAddress(dest *peer) {
+	o.lock.RLock()
+	state := &state{
+		Addrs: map[string][]string{o.nodeId.String(): flatten(o.adverts)},
+	}
+	o.lock.RUnlock()
+
+	o.sendPacket(dest, &header{Op: opAddress, Dest: dest.nodeId, State: state})
+}
+
 // Assembles an overlay leave message, consisting of the close opcode and sends
 // it towards the destination.
 func (o *Overlay) sendClose(dest *peer) {
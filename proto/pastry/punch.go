@@ -0,0 +1,99 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the hole punching between peers that cannot dial each other
+// directly. The initiator routes a rendezvous request through the overlay (i.e.
+// via nodes reachable by both), upon which the target first tries to connect in
+// reverse, and failing that sends short lived connection attempts from its own
+// listener ports, opening its NAT mappings. A rendezvous reply then signals the
+// initiator to dial again through the opened holes. If that fails too, the two
+// peers keep reaching each other by relaying through the overlay routes.
+
+package pastry
+
+import (
+	"log"
+	"math/big"
+	"net"
+	"sync"
+
+	"github.com/karalabe/iris/proto/stream"
+)
+
+// Executes the local side of a hole punching rendezvous with a remote peer.
+func (o *Overlay) punch(op opcode, peer *big.Int, addrs []string) {
+	// Skip peers that have connected in the mean time
+	o.lock.RLock()
+	_, live := o.livePeers[peer.String()]
+	locals := append([]string{}, o.addrs...)
+	o.lock.RUnlock()
+	if live {
+		return
+	}
+	remotes := resolve(addrs)
+
+	switch op {
+	case opPunchReq:
+		// Try connecting in reverse first (initiator might be reachable)
+		if o.dial(remotes) {
+			return
+		}
+		// Open the local NAT mappings from the private listeners towards the
+		// public addresses of the initiator, and signal it to dial again
+		var pend sync.WaitGroup
+		for _, local := range resolve(locals) {
+			if public(local.IP) {
+				continue
+			}
+			for _, remote := range remotes {
+				if !public(remote.IP) {
+					continue
+				}
+				pend.Add(1)
+				go func(local, remote *net.TCPAddr) {
+					defer pend.Done()
+					if err := stream.Punch(local, remote, o.conf.PunchTtl, o.conf.PunchTimeout); err != nil {
+						log.Printf("pastry: failed to punch hole from %v to %v: %v.", local, remote, err)
+					}
+				}(local, remote)
+			}
+		}
+		pend.Wait()
+		o.sendPunched(peer)
+
+	case opPunchRep:
+		// Holes opened remotely, dial through them or fall back to relaying
+		if !o.dial(remotes) {
+			log.Printf("pastry: hole punching to %v failed, relaying through the overlay.", peer)
+		}
+	}
+}
+
+// Resolves a list of TCP addresses, dropping any invalid ones.
+func resolve(addrs []string) []*net.TCPAddr {
+	res := make([]*net.TCPAddr, 0, len(addrs))
+	for _, address := range addrs {
+		if addr, err := net.ResolveTCPAddr("tcp", address); err != nil {
+			log.Printf("pastry: failed to resolve address %v: %v.", address, err)
+		} else {
+			res = append(res, addr)
+		}
+	}
+	return res
+}
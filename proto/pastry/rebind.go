@@ -0,0 +1,158 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the tracking of the local interface addresses. The interfaces are
+// polled periodically, listeners started on new addresses and torn down on the
+// vanished ones, after which the live peers are notified of the new addresses
+// through the existing (authenticated) sessions, updating their state in place
+// instead of requiring a restart when a DHCP lease or cloud reschedule changes
+// the node's IP.
+
+package pastry
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/karalabe/iris/proto/stream"
+)
+
+// Source of the local interface addresses, replaceable to simulate changes.
+var interfaceAddrs = net.InterfaceAddrs
+
+// Collects the local IPv4 interfaces to run acceptors on, or the simulated one
+// if running on the in-process transport.
+func (o *Overlay) interfaces() ([]*net.IPNet, error) {
+	if o.conf.Memory {
+		return []*net.IPNet{stream.MemoryNetwork()}, nil
+	}
+	addrs, err := interfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	ifaces := []*net.IPNet{}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			if !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+				ifaces = append(ifaces, ipnet)
+			}
+		}
+	}
+	return ifaces, nil
+}
+
+// Starts an acceptor on the given interface, waiting until its listener is up.
+func (o *Overlay) bind(ipnet *net.IPNet) error {
+	live := make(chan error)
+	quit := make(chan chan error)
+	go o.acceptor(ipnet, live, quit)
+
+	if err := <-live; err != nil {
+		return err
+	}
+	o.acceptQuit[ipnet.IP.String()] = quit
+	return nil
+}
+
+// Terminates the acceptor of a vanished interface address, and removes all the
+// listener addresses bound to it from the advertised ones.
+func (o *Overlay) unbind(ip string) error {
+	quit := o.acceptQuit[ip]
+	delete(o.acceptQuit, ip)
+
+	errc := make(chan error)
+	quit <- errc
+	err := <-errc
+
+	o.lock.Lock()
+	addrs := make([]string, 0, len(o.addrs))
+	for _, addr := range o.addrs {
+		if host := hostIP(addr); host == nil || host.String() != ip {
+			addrs = append(addrs, addr)
+		}
+	}
+	nets := make([]*net.IPNet, 0, len(o.nets))
+	for _, ipnet := range o.nets {
+		if ipnet.IP.String() != ip {
+			nets = append(nets, ipnet)
+		}
+	}
+	o.addrs, o.nets = addrs, nets
+	o.adverts = o.advertise()
+	o.lock.Unlock()
+
+	return err
+}
+
+// Synchronizes the acceptors with the current interface addresses, returning
+// whether anything changed.
+func (o *Overlay) rebind() bool {
+	ifaces, err := o.interfaces()
+	if err != nil {
+		log.Printf("pastry: failed to retrieve interface addresses: %v.", err)
+		return false
+	}
+	current := make(map[string]*net.IPNet)
+	for _, ipnet := range ifaces {
+		current[ipnet.IP.String()] = ipnet
+	}
+	changed := false
+	for ip := range o.acceptQuit {
+		if _, ok := current[ip]; !ok {
+			log.Printf("pastry: interface address vanished: %v.", ip)
+			if err := o.unbind(ip); err != nil {
+				log.Printf("pastry: failed to terminate acceptor: %v.", err)
+			}
+			changed = true
+		}
+	}
+	for ip, ipnet := range current {
+		if _, ok := o.acceptQuit[ip]; !ok {
+			if err := o.bind(ipnet); err != nil {
+				log.Printf("pastry: failed to bind interface %v: %v.", ip, err)
+				continue
+			}
+			log.Printf("pastry: listening on new interface address: %v.", ip)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Periodically checks the local interfaces for address changes until termination
+// is requested, rebinding the listeners and pushing the new addresses to all the
+// live peers if anything changed.
+func (o *Overlay) watcher(quit chan chan struct{}) {
+	for {
+		select {
+		case done := <-quit:
+			close(done)
+			return
+		case <-time.After(o.conf.AddrPeriod):
+			if o.rebind() {
+				o.lock.RLock()
+				for _, p := range o.livePeers {
+					o.stateExch.Schedule(func() { o.sendAddress(p) })
+				}
+				o.lock.RUnlock()
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package pastry
+
+import (
+	"crypto/x509"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRebind(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	// Simulate the interfaces going down and up by hiding all addresses
+	var hidden int32
+	defer func(addrs func() ([]net.Addr, error)) { interfaceAddrs = addrs }(interfaceAddrs)
+	interfaceAddrs = func() ([]net.Addr, error) {
+		if atomic.LoadInt32(&hidden) == 1 {
+			return nil, nil
+		}
+		return net.InterfaceAddrs()
+	}
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	conf := DefaultConfig()
+	conf.AddrPeriod = 100 * time.Millisecond
+
+	// Boot two nodes and wait for them to converge
+	alice := NewConfig(appId, key, new(nopCallback), conf)
+	if _, err := alice.Boot(); err != nil {
+		t.Fatalf("failed to boot alice: %v.", err)
+	}
+	defer alice.Shutdown()
+
+	bob := NewConfig(appId, key, new(nopCallback), conf)
+	if _, err := bob.Boot(); err != nil {
+		t.Fatalf("failed to boot bob: %v.", err)
+	}
+	defer bob.Shutdown()
+	waitConverged(t, []*Overlay{alice, bob})
+
+	alice.lock.RLock()
+	old := flatten(alice.adverts)
+	alice.lock.RUnlock()
+
+	// Drop all the addresses and check that the listeners are torn down
+	atomic.StoreInt32(&hidden, 1)
+	time.Sleep(500 * time.Millisecond)
+
+	alice.lock.RLock()
+	addrs := len(alice.addrs)
+	alice.lock.RUnlock()
+	if addrs != 0 {
+		t.Fatalf("listener count mismatch: have %v, want 0.", addrs)
+	}
+	// Restore the addresses and check that the peers learned the new listeners
+	atomic.StoreInt32(&hidden, 0)
+	time.Sleep(500 * time.Millisecond)
+
+	for _, pair := range [][2]*Overlay{{alice, bob}, {bob, alice}} {
+		local, remote := pair[0], pair[1]
+
+		local.lock.RLock()
+		ads := flatten(local.adverts)
+		local.lock.RUnlock()
+
+		remote.lock.RLock()
+		p, ok := remote.livePeers[local.nodeId.String()]
+		remote.lock.RUnlock()
+
+		if !ok {
+			t.Fatalf("peer %v: connection lost during rebinding.", local.nodeId)
+		}
+		if len(ads) == 0 {
+			t.Fatalf("peer %v: no addresses advertised after rebinding.", local.nodeId)
+		}
+		remote.lock.RLock()
+		known := p.addrs
+		remote.lock.RUnlock()
+		if !reflect.DeepEqual(known, ads) {
+			t.Fatalf("peer %v: address update mismatch: have %v, want %v.", local.nodeId, known, ads)
+		}
+	}
+	alice.lock.RLock()
+	ads := flatten(alice.adverts)
+	alice.lock.RUnlock()
+	if reflect.DeepEqual(ads, old) {
+		t.Fatalf("listener addresses not rebound: have %v, old %v.", ads, old)
+	}
+}
@@ -0,0 +1,207 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the signed address records. With verifiable ids, each node
+// signs its own advertised addresses with its identity key, and these records
+// are relayed verbatim in the state exchanges. A compromised peer can thus not
+// fabricate or redirect entries on behalf of others, only omit them. Records
+// carry a freshness counter, so replaying an old (e.g. stale address) record
+// cannot override a newer one.
+
+package pastry
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Failures reported when verifying a relayed address record.
+var ErrRecordSig = errors.New("invalid address record signature")
+var ErrRecordStale = errors.New("stale address record")
+
+// Address record of a node, signed by its identity key.
+type record struct {
+	Addrs []string // Advertised addresses of the node
+	Seq   uint64   // Freshness counter, increasing with every new record
+	Key   []byte   // PKIX encoded public key the node id is derived from
+	Nonce uint64   // Solution of the id generation puzzle
+	Sig   []byte   // Signature over the id, counter and addresses
+}
+
+// Assembles the message signed by an address record.
+func recordDigest(id *big.Int, seq uint64, addrs []string) []byte {
+	hash := sha256.New()
+	hash.Write(id.Bytes())
+
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], seq)
+	hash.Write(buf[:])
+	for _, addr := range addrs {
+		hash.Write([]byte(addr))
+		hash.Write([]byte{0})
+	}
+	return hash.Sum(nil)
+}
+
+// Signs a set of addresses with the identity key, creating a new address record.
+func (ident *identity) sign(addrs []string, seq uint64) *record {
+	sig, err := ecdsa.SignASN1(rand.Reader, ident.key, recordDigest(ident.id, seq, addrs))
+	if err != nil {
+		panic(fmt.Sprintf("failed to sign address record: %v", err))
+	}
+	return &record{
+		Addrs: append([]string{}, addrs...),
+		Seq:   seq,
+		Key:   ident.pub,
+		Nonce: ident.nonce,
+		Sig:   sig,
+	}
+}
+
+// Verifies that an address record was signed by the owner of the given id.
+func (r *record) verify(id *big.Int, space int) error {
+	derived, err := deriveId(r.Key, r.Nonce, space)
+	if err != nil {
+		return err
+	}
+	if derived.Cmp(id) != 0 {
+		return ErrIdBinding
+	}
+	key, err := x509.ParsePKIXPublicKey(r.Key)
+	if err != nil {
+		return err
+	}
+	ecKey, ok := key.(*ecdsa.PublicKey)
+	if !ok || !ecdsa.VerifyASN1(ecKey, recordDigest(id, r.Seq, r.Addrs), r.Sig) {
+		return ErrRecordSig
+	}
+	return nil
+}
+
+// Retrieves the signed record of the local addresses, issuing a fresh one if the
+// advertisements changed since the last signing. The freshness counter is seeded
+// from the clock, so records issued after a restart still supersede older ones.
+func (o *Overlay) signed(addrs []string) *record {
+	o.recordLock.Lock()
+	defer o.recordLock.Unlock()
+
+	if o.record != nil && equalAddrs(o.record.Addrs, addrs) {
+		return o.record
+	}
+	seq := uint64(time.Now().UnixNano())
+	if o.record != nil && seq <= o.record.Seq {
+		seq = o.record.Seq + 1
+	}
+	o.record = o.ident.sign(addrs, seq)
+	return o.record
+}
+
+// Checks whether two address lists are identical.
+func equalAddrs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Collects the signed records vouching for the entries of an outbound state
+// exchange: the local one, and those of the relayed peers if known.
+func (o *Overlay) vouch(addrs map[string][]string) map[string]*record {
+	records := make(map[string]*record, len(addrs))
+	records[o.nodeId.String()] = o.signed(addrs[o.nodeId.String()])
+
+	o.recordLock.Lock()
+	for sid := range addrs {
+		if rec, ok := o.records[sid]; ok {
+			records[sid] = rec
+		}
+	}
+	o.recordLock.Unlock()
+
+	return records
+}
+
+// Accepts a verified address record if it's fresher than the one known already,
+// returning the freshest record of the node.
+func (o *Overlay) accept(sid string, rec *record) (*record, error) {
+	o.recordLock.Lock()
+	defer o.recordLock.Unlock()
+
+	if known, ok := o.records[sid]; ok && known.Seq > rec.Seq {
+		return known, ErrRecordStale
+	}
+	o.records[sid] = rec
+	return rec, nil
+}
+
+// Filters an inbound state exchange if ids are verifiable, dropping the entries
+// not vouched for by a valid record of their owner, and replacing stale ones by
+// their freshest known record. The sender's own entry is vouched for by the
+// authenticated session it arrived through.
+func (o *Overlay) vet(src *peer, s *state) *state {
+	if !config.PastryVerifyIds {
+		return s
+	}
+	vetted := &state{
+		Addrs:   make(map[string][]string, len(s.Addrs)),
+		Version: s.Version,
+	}
+	for sid, addrs := range s.Addrs {
+		id, ok := new(big.Int).SetString(sid, 10)
+		if !ok {
+			continue
+		}
+		rec := s.Records[sid]
+		if rec != nil {
+			if err := rec.verify(id, o.geo.space); err != nil {
+				log.Printf("pastry: peer %v relayed forged address record for %v: %v.", src.nodeId, sid, err)
+				rec = nil
+			}
+		}
+		switch {
+		case src.nodeId.Cmp(id) == 0:
+			// Sender's own entry, accept even if unsigned, storing any record for relaying
+			if rec != nil {
+				o.accept(sid, rec)
+			}
+			vetted.Addrs[sid] = addrs
+
+		case rec != nil:
+			// Relayed entry, use the addresses of the freshest record
+			fresh, _ := o.accept(sid, rec)
+			vetted.Addrs[sid] = fresh.Addrs
+		}
+	}
+	return vetted
+}
@@ -0,0 +1,97 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package pastry
+
+import (
+	"crypto/x509"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/karalabe/iris/config"
+)
+
+func TestRecord(t *testing.T) {
+	ident := newIdentity(config.PastrySpace)
+	addrs := []string{"10.0.0.1:1000", "8.8.8.8:2000"}
+
+	// Sign an address record and make sure it verifies
+	rec := ident.sign(addrs, 1)
+	if err := rec.verify(ident.id, config.PastrySpace); err != nil {
+		t.Fatalf("failed to verify address record: %v.", err)
+	}
+	// Make sure tampered records are rejected
+	if err := rec.verify(new(big.Int).Add(ident.id, big.NewInt(1)), config.PastrySpace); err != ErrIdBinding {
+		t.Fatalf("foreign id error mismatch: have %v, want %v.", err, ErrIdBinding)
+	}
+	forged := *rec
+	forged.Addrs = []string{"6.6.6.6:666"}
+	if err := forged.verify(ident.id, config.PastrySpace); err != ErrRecordSig {
+		t.Fatalf("forged address error mismatch: have %v, want %v.", err, ErrRecordSig)
+	}
+	forged = *rec
+	forged.Seq++
+	if err := forged.verify(ident.id, config.PastrySpace); err != ErrRecordSig {
+		t.Fatalf("forged counter error mismatch: have %v, want %v.", err, ErrRecordSig)
+	}
+}
+
+func TestVetState(t *testing.T) {
+	verify := config.PastryVerifyIds
+	defer func() { config.PastryVerifyIds = verify }()
+	config.PastryVerifyIds = true
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+
+	sender, victim := newIdentity(config.PastrySpace), newIdentity(config.PastrySpace)
+	src := &peer{nodeId: sender.id}
+	sid, vid := sender.id.String(), victim.id.String()
+
+	// Entries not vouched for by their owner should be dropped
+	vetted := o.vet(src, &state{
+		Addrs: map[string][]string{
+			sid: {"10.0.0.1:1000"},
+			vid: {"6.6.6.6:666"},
+		},
+		Records: map[string]*record{
+			vid: sender.sign([]string{"6.6.6.6:666"}, 1),
+		},
+	})
+	if want := map[string][]string{sid: {"10.0.0.1:1000"}}; !reflect.DeepEqual(vetted.Addrs, want) {
+		t.Fatalf("forged entry not dropped: have %v, want %v.", vetted.Addrs, want)
+	}
+	// Signed entries should be accepted, using the signed addresses
+	vetted = o.vet(src, &state{
+		Addrs:   map[string][]string{vid: {"6.6.6.6:666"}},
+		Records: map[string]*record{vid: victim.sign([]string{"10.0.0.2:2000"}, 2)},
+	})
+	if want := []string{"10.0.0.2:2000"}; !reflect.DeepEqual(vetted.Addrs[vid], want) {
+		t.Fatalf("signed entry mismatch: have %v, want %v.", vetted.Addrs[vid], want)
+	}
+	// Replayed stale records should be superseded by the freshest known one
+	vetted = o.vet(src, &state{
+		Addrs:   map[string][]string{vid: {"10.0.0.3:3000"}},
+		Records: map[string]*record{vid: victim.sign([]string{"10.0.0.3:3000"}, 1)},
+	})
+	if want := []string{"10.0.0.2:2000"}; !reflect.DeepEqual(vetted.Addrs[vid], want) {
+		t.Fatalf("replayed entry mismatch: have %v, want %v.", vetted.Addrs[vid], want)
+	}
+}
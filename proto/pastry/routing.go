@@ -29,12 +29,18 @@ import (
 	"log"
 	"math/big"
 	"net"
+	"time"
 
 	"github.com/karalabe/iris/proto"
 )
 
 // Pastry routing algorithm.
 func (o *Overlay) route(src *peer, msg *proto.Message) {
+	// Broadcasts are disseminated along the spanning tree instead of routed
+	if head := msg.Head.Meta.(*header); head.Op == opBcast {
+		o.spread(msg)
+		return
+	}
 	// Sync the routing table
 	o.lock.RLock() // Note, unlock is in deliver and forward!!!
 
@@ -45,11 +51,11 @@ func (o *Overlay) route(src *peer, msg *proto.Message) {
 	// Check the leaf set for direct delivery
 	// TODO: corner cases with if only handful of nodes?
 	// TODO: binary search with idSlice could be used (worthwhile?)
-	if delta(tab.leaves[0], dest).Sign() >= 0 && delta(dest, tab.leaves[len(tab.leaves)-1]).Sign() >= 0 {
+	if o.geo.delta(tab.leaves[0], dest).Sign() >= 0 && o.geo.delta(dest, tab.leaves[len(tab.leaves)-1]).Sign() >= 0 {
 		best := tab.leaves[0]
-		dist := Distance(best, dest)
+		dist := o.geo.distance(best, dest)
 		for _, leaf := range tab.leaves[1:] {
-			if d := Distance(leaf, dest); d.Cmp(dist) < 0 {
+			if d := o.geo.distance(leaf, dest); d.Cmp(dist) < 0 {
 				best, dist = leaf, d
 			}
 		}
@@ -57,29 +63,29 @@ func (o *Overlay) route(src *peer, msg *proto.Message) {
 		if o.nodeId.Cmp(best) == 0 {
 			o.deliver(src, msg)
 		} else {
-			o.forward(src, msg, best)
+			o.forward(src, msg, o.steer(dest, best))
 		}
 		return
 	}
 	// Check the routing table for indirect delivery
-	pre, col := prefix(o.nodeId, dest)
+	pre, col := o.geo.prefix(o.nodeId, dest)
 	if best := tab.routes[pre][col]; best != nil {
-		o.forward(src, msg, best)
+		o.forward(src, msg, o.steer(dest, best))
 		return
 	}
 	// Route to anybody closer than the local node
-	dist := Distance(o.nodeId, dest)
+	dist := o.geo.distance(o.nodeId, dest)
 	for _, peer := range tab.leaves {
-		if p, _ := prefix(peer, dest); p >= pre && Distance(peer, dest).Cmp(dist) < 0 {
-			o.forward(src, msg, peer)
+		if p, _ := o.geo.prefix(peer, dest); p >= pre && o.geo.distance(peer, dest).Cmp(dist) < 0 {
+			o.forward(src, msg, o.steer(dest, peer))
 			return
 		}
 	}
 	for _, row := range tab.routes {
 		for _, peer := range row {
 			if peer != nil {
-				if p, _ := prefix(peer, dest); p >= pre && Distance(peer, dest).Cmp(dist) < 0 {
-					o.forward(src, msg, peer)
+				if p, _ := o.geo.prefix(peer, dest); p >= pre && o.geo.distance(peer, dest).Cmp(dist) < 0 {
+					o.forward(src, msg, o.steer(dest, peer))
 					return
 				}
 			}
@@ -118,22 +124,43 @@ func (o *Overlay) forward(src *peer, msg *proto.Message, id *big.Int) {
 		}
 		return
 	}
-	// Upper layer message, pass up and check if forward is needed
+	// Upper layer message, drop and report if it's been circling for too long
 	o.lock.RUnlock()
+	if head.Hops >= o.conf.MaxHops {
+		o.report(head, head.Meta, ErrTtlExceeded)
+		return
+	}
+	// Pass up and check if forward is needed
 	msg.Head.Meta = head.Meta
 	allow := o.app.Forward(msg, head.Dest)
 
-	// Forwarding was allowed, repack headers and send
+	// Forwarding was allowed, repack headers and send, reporting any failure
 	if allow {
+		meta := msg.Head.Meta
+		head.Meta, head.Hops = meta, head.Hops+1
+		msg.Head.Meta = head
+
 		o.lock.RLock()
 		p, ok := o.livePeers[id.String()]
 		o.lock.RUnlock()
 
+		reason := ErrLinkDown
 		if ok {
-			head.Meta = msg.Head.Meta
-			msg.Head.Meta = head
-			o.send(msg, p)
+			if err := p.send(msg); err == nil {
+				return
+			}
+			o.drop(p)
+			reason = ErrOverloaded
 		}
+		// Next hop failed, retry via some other peer closer to the destination
+		if o.conf.RouteRetry {
+			if alt := o.alternate(head.Dest, id); alt != nil {
+				if err := alt.send(msg); err == nil {
+					return
+				}
+			}
+		}
+		o.report(head, meta, reason)
 	}
 }
 
@@ -142,8 +169,10 @@ func (o *Overlay) forward(src *peer, msg *proto.Message, id *big.Int) {
 // if newer, also always replying if a repair request was included. Finally the
 // heartbeat messages are checked and two-way idle connections dropped.
 func (o *Overlay) process(src *peer, head *header) {
-	// Notify the heartbeat mechanism that source is alive
-	o.heart.heart.Ping(src.nodeId)
+	// Notify the heartbeat mechanism that source is alive (nil if reported locally)
+	if src != nil {
+		o.heart.heart.Ping(src.nodeId)
+	}
 
 	// Extract the remote id and state
 	remId, remState := head.Dest.String(), head.State
@@ -204,6 +233,45 @@ func (o *Overlay) process(src *peer, head *header) {
 		o.drop(src)
 		o.lock.RLock()
 
+	case opFailure:
+		// Forwarding failure, report upwards if the local node was the origin
+		if o.nodeId.Cmp(head.Dest) == 0 {
+			o.lock.RUnlock()
+			o.failed(head)
+			o.lock.RLock()
+		}
+
+	case opPing:
+		// Round trip time probe, echo the stamp back without blocking the reader
+		stamp := head.Stamp
+		o.stateExch.Schedule(func() { o.sendPong(src, stamp) })
+
+	case opPong:
+		// Probe reply, account the measured round trip time
+		if src != nil {
+			src.rtt.add(time.Since(time.Unix(0, head.Stamp)))
+		}
+
+	case opAddress:
+		// Remote addresses changed, update in place. Only the sender's own entry is
+		// accepted, vouched for by the authenticated session it arrived through.
+		if src != nil && remState != nil {
+			if addrs, ok := remState.Addrs[src.nodeId.String()]; ok {
+				o.lock.RUnlock()
+				o.lock.Lock()
+				src.addrs = addrs
+				o.lock.Unlock()
+				o.lock.RLock()
+			}
+		}
+
+	case opPunchReq, opPunchRep:
+		// Hole punching rendezvous, act if the local node is the destination
+		if o.nodeId.Cmp(head.Dest) == 0 && head.Src != nil && remState != nil {
+			op, src, addrs := head.Op, head.Src, remState.Addrs[head.Src.String()]
+			o.authInit.Schedule(func() { o.punch(op, src, addrs) })
+		}
+
 	default:
 		log.Printf("pastry: unknown system message: %+v", head)
 	}
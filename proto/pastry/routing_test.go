@@ -23,6 +23,7 @@ import (
 	"bytes"
 	"crypto/rand"
 	"crypto/x509"
+	"fmt"
 	"io"
 	"math/big"
 	"sync"
@@ -61,9 +62,7 @@ func TestRouting(t *testing.T) {
 	// Make sure there are enough ports to use
 	olds := config.BootPorts
 	defer func() { config.BootPorts = olds }()
-	for i := 0; i < originals+additions; i++ {
-		config.BootPorts = append(config.BootPorts, 65500+i)
-	}
+	config.BootPorts = append(config.BootPorts, fmt.Sprintf("65500-%d", 65500+originals+additions-1))
 	// Parse encryption key
 	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
 
@@ -0,0 +1,166 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the round trip time probing of the routing peers. The leafset and
+// routing table entries are pinged periodically, and a sliding window of recent
+// samples is kept per peer to derive latency percentiles from, both for operator
+// dashboards and for proximity aware routing decisions.
+
+package pastry
+
+import (
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Latency statistics of a single overlay peer, derived from the recent probes.
+type PeerLatency struct {
+	Samples int // Number of round trip times the percentiles were derived from
+
+	Last time.Duration // Most recently measured round trip time
+	P50  time.Duration // Median round trip time
+	P90  time.Duration // 90th percentile round trip time
+	P99  time.Duration // 99th percentile round trip time
+}
+
+// Fixed size ring of the most recent round trip time samples of a peer.
+type rttWindow struct {
+	samples []time.Duration // Measured round trip times, oldest overwritten first
+	next    int             // Index of the next sample to overwrite
+	full    bool            // Whether the ring wrapped around already
+	lock    sync.Mutex      // Lock protecting the samples
+}
+
+// Creates a sample window retaining the given number of round trip times.
+func newRttWindow(size int) *rttWindow {
+	return &rttWindow{
+		samples: make([]time.Duration, size),
+	}
+}
+
+// Inserts a new round trip time sample, evicting the oldest if full.
+func (w *rttWindow) add(rtt time.Duration) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if len(w.samples) == 0 {
+		return
+	}
+	w.samples[w.next] = rtt
+	if w.next++; w.next == len(w.samples) {
+		w.next, w.full = 0, true
+	}
+}
+
+// Calculates the latency percentiles of the retained samples, or nil if the peer
+// was not measured yet.
+func (w *rttWindow) stats() *PeerLatency {
+	w.lock.Lock()
+	count, last := w.next, w.next-1
+	if w.full {
+		count = len(w.samples)
+	}
+	if count == 0 {
+		w.lock.Unlock()
+		return nil
+	}
+	if last < 0 {
+		last = len(w.samples) - 1
+	}
+	sorted := append([]time.Duration{}, w.samples[:count]...)
+	stat := &PeerLatency{Samples: count, Last: w.samples[last]}
+	w.lock.Unlock()
+
+	sort.Sort(byDuration(sorted))
+	stat.P50 = percentile(sorted, 50)
+	stat.P90 = percentile(sorted, 90)
+	stat.P99 = percentile(sorted, 99)
+	return stat
+}
+
+// Sorts round trip times in ascending order.
+type byDuration []time.Duration
+
+func (d byDuration) Len() int           { return len(d) }
+func (d byDuration) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d byDuration) Less(i, j int) bool { return d[i] < d[j] }
+
+// Picks the nearest rank percentile of an ascending sample set.
+func percentile(sorted []time.Duration, pct int) time.Duration {
+	rank := (pct*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// Retrieves the latency statistics of each measured live peer, keyed by node id.
+func (o *Overlay) Latency() map[string]*PeerLatency {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	stats := make(map[string]*PeerLatency, len(o.livePeers))
+	for id, p := range o.livePeers {
+		if stat := p.rtt.stats(); stat != nil {
+			stats[id] = stat
+		}
+	}
+	return stats
+}
+
+// Retrieves the latency statistics of a single live peer, or nil if it's not
+// connected or not measured yet.
+func (o *Overlay) PeerLatency(id *big.Int) *PeerLatency {
+	o.lock.RLock()
+	p, ok := o.livePeers[id.String()]
+	o.lock.RUnlock()
+
+	if !ok {
+		return nil
+	}
+	return p.rtt.stats()
+}
+
+// Periodically sends a round trip time probe to every peer in the routing state
+// until termination is requested. Passive connections are not measured, as they
+// are not used for routing and will be torn down soon anyway.
+func (o *Overlay) pinger(quit chan chan struct{}) {
+	for {
+		select {
+		case done := <-quit:
+			close(done)
+			return
+		case <-time.After(o.conf.RttPeriod):
+			o.lock.RLock()
+			peers := make([]*peer, 0, len(o.livePeers))
+			for _, p := range o.livePeers {
+				if o.active(p.nodeId) {
+					peers = append(peers, p)
+				}
+			}
+			o.lock.RUnlock()
+
+			for _, p := range peers {
+				o.stateExch.Schedule(func() { o.sendPing(p) })
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package pastry
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func TestRttWindow(t *testing.T) {
+	w := newRttWindow(10)
+	if stat := w.stats(); stat != nil {
+		t.Fatalf("unmeasured peer stats mismatch: have %+v, want nil.", stat)
+	}
+	// Overfill the window, ensuring only the most recent samples are retained
+	for i := 1; i <= 15; i++ {
+		w.add(time.Duration(i) * time.Millisecond)
+	}
+	stat := w.stats()
+	if stat.Samples != 10 {
+		t.Fatalf("sample count mismatch: have %d, want 10.", stat.Samples)
+	}
+	if stat.Last != 15*time.Millisecond {
+		t.Fatalf("last sample mismatch: have %v, want %v.", stat.Last, 15*time.Millisecond)
+	}
+	if stat.P50 != 10*time.Millisecond {
+		t.Fatalf("median mismatch: have %v, want %v.", stat.P50, 10*time.Millisecond)
+	}
+	if stat.P90 != 14*time.Millisecond {
+		t.Fatalf("90th percentile mismatch: have %v, want %v.", stat.P90, 14*time.Millisecond)
+	}
+	if stat.P99 != 15*time.Millisecond {
+		t.Fatalf("99th percentile mismatch: have %v, want %v.", stat.P99, 15*time.Millisecond)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	conf := DefaultConfig()
+	conf.RttPeriod = 100 * time.Millisecond
+
+	// Boot two nodes and wait for them to converge
+	first := NewConfig(appId, key, new(nopCallback), conf)
+	if _, err := first.Boot(); err != nil {
+		t.Fatalf("failed to boot first node: %v.", err)
+	}
+	defer first.Shutdown()
+
+	second := NewConfig(appId, key, new(nopCallback), conf)
+	if _, err := second.Boot(); err != nil {
+		t.Fatalf("failed to boot second node: %v.", err)
+	}
+	defer second.Shutdown()
+	waitConverged(t, []*Overlay{first, second})
+
+	// Wait for a few probes and verify both sides measured the other
+	time.Sleep(500 * time.Millisecond)
+	for _, o := range []*Overlay{first, second} {
+		stats := o.Latency()
+		if len(stats) != 1 {
+			t.Fatalf("measured peer count mismatch: have %d, want 1.", len(stats))
+		}
+		for id, stat := range stats {
+			if stat.Samples == 0 || stat.P50 <= 0 || stat.P50 > time.Second {
+				t.Fatalf("peer %v: invalid latency stats: %+v.", id, stat)
+			}
+		}
+	}
+}
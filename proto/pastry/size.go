@@ -0,0 +1,63 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the overlay size estimation based on the leafset density: the leaves
+// span a known fraction of the id space, which, assuming uniformly distributed
+// ids, extrapolates to the number of nodes in the whole ring.
+
+package pastry
+
+import (
+	"math/big"
+)
+
+// Estimates the number of nodes in the overlay network (including the local one)
+// from the density of the leafset. Small networks fitting in the leafset are
+// counted exactly.
+func (o *Overlay) EstimateSize() int {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	return o.geo.estimateSize(o.nodeId, o.routes.leaves)
+}
+
+// Extrapolates the size of the network from the ring ordered leafset around the
+// origin node.
+func (g *geometry) estimateSize(origin *big.Int, leaves []*big.Int) int {
+	// If neither side of the leafset is full, every node is known
+	below := 0
+	for below < len(leaves) && origin.Cmp(leaves[below]) != 0 {
+		below++
+	}
+	above := len(leaves) - below - 1
+	if below < g.leaves/2 && above < g.leaves/2-1 {
+		return len(leaves)
+	}
+	// Otherwise scale the leaf count by the fraction of the space they span
+	span := g.delta(leaves[0], leaves[len(leaves)-1])
+	if span.Sign() <= 0 {
+		return len(leaves)
+	}
+	size := new(big.Int).Mul(big.NewInt(int64(len(leaves)-1)), g.modulo)
+	size.Div(size.Add(size, new(big.Int).Rsh(span, 1)), span)
+	if !size.IsInt64() || size.Int64() < int64(len(leaves)) {
+		return len(leaves)
+	}
+	return int(size.Int64())
+}
@@ -0,0 +1,57 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package pastry
+
+import (
+	"math/big"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/karalabe/iris/config"
+)
+
+func TestEstimateSize(t *testing.T) {
+	// Small networks fitting into the leafset should be counted exactly
+	ids := []*big.Int{big.NewInt(10), big.NewInt(1000), big.NewInt(100000)}
+	if size := defaultGeometry.estimateSize(ids[1], ids); size != len(ids) {
+		t.Fatalf("small network size mismatch: have %v, want %v.", size, len(ids))
+	}
+	// Large networks should be estimated within reasonable bounds
+	for _, nodes := range []int{100, 1000, 10000} {
+		ids := make([]*big.Int, nodes)
+		for i := 0; i < nodes; i++ {
+			ids[i] = new(big.Int).Rand(rand.New(rand.NewSource(int64(i))), modulo)
+		}
+		total := 0
+		for i := 0; i < 32; i++ {
+			origin := ids[i]
+			ring := append([]*big.Int{}, ids...)
+			sort.Sort(idSlice{defaultGeometry, origin, ring})
+
+			pos := sort.Search(len(ring), func(j int) bool { return delta(origin, ring[j]).Sign() >= 0 })
+			min, max := pos-config.PastryLeaves/2, pos+config.PastryLeaves/2
+			total += defaultGeometry.estimateSize(origin, ring[min:max])
+		}
+		if avg := total / 32; avg < nodes/2 || avg > nodes*2 {
+			t.Errorf("network size mismatch: have %v, want ~%v.", avg, nodes)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the routing state inspection API, for operators monitoring a node and
+// tests verifying the overlay convergence.
+
+package pastry
+
+import (
+	"math/big"
+)
+
+// Point-in-time copy of an overlay node's routing state, decoupled from the
+// live data structures.
+type Snapshot struct {
+	Self   *big.Int            // Overlay id of the local node
+	Leaves []*big.Int          // Leafset in ring order, including the local node
+	Routes [][]*big.Int        // Routing table rows, with nil for empty entries
+	Peers  map[string][]string // Advertised addresses of the live neighbors, keyed by id
+}
+
+// Retrieves a snapshot of the current leafset, routing table and neighbors.
+func (o *Overlay) Snapshot() *Snapshot {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	snap := &Snapshot{
+		Self:   new(big.Int).Set(o.nodeId),
+		Leaves: make([]*big.Int, len(o.routes.leaves)),
+		Routes: make([][]*big.Int, len(o.routes.routes)),
+		Peers:  make(map[string][]string, len(o.livePeers)),
+	}
+	for i, leaf := range o.routes.leaves {
+		snap.Leaves[i] = new(big.Int).Set(leaf)
+	}
+	for r, row := range o.routes.routes {
+		snap.Routes[r] = make([]*big.Int, len(row))
+		for c, id := range row {
+			if id != nil {
+				snap.Routes[r][c] = new(big.Int).Set(id)
+			}
+		}
+	}
+	for id, p := range o.livePeers {
+		snap.Peers[id] = append([]string{}, p.addrs...)
+	}
+	return snap
+}
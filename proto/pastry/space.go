@@ -24,18 +24,67 @@
 package pastry
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"math/big"
 
 	"github.com/karalabe/iris/config"
 )
 
-var modulo = new(big.Int).SetBit(new(big.Int), config.PastrySpace, 1)
-var posmid = new(big.Int).Rsh(modulo, 1)
-var negmid = new(big.Int).Mul(posmid, big.NewInt(-1))
+// Failure reported if an overlay is configured with an unusable id space or
+// routing table layout.
+var ErrGeometry = errors.New("invalid id space geometry")
+
+// Identifier space and routing table layout of an overlay. All the nodes of an
+// overlay network must agree on the space and base, which is verified during
+// the handshake.
+type geometry struct {
+	space  int // Bit length of the node ids
+	base   int // Bit length of a routing table digit
+	leaves int // Size of the leafset
+
+	modulo *big.Int // Size of the circular id space
+	posmid *big.Int // Largest positive delta, half of the space
+	negmid *big.Int // Largest negative delta, half of the space
+}
+
+// Geometry of the global configuration, used by the package level operations.
+var defaultGeometry = makeGeometry(config.PastrySpace, config.PastryBase, config.PastryLeaves)
+
+// Creates a geometry without any sanity checks on the parameters.
+func makeGeometry(space, base, leaves int) *geometry {
+	modulo := new(big.Int).SetBit(new(big.Int), space, 1)
+	posmid := new(big.Int).Rsh(modulo, 1)
+	return &geometry{
+		space:  space,
+		base:   base,
+		leaves: leaves,
+		modulo: modulo,
+		posmid: posmid,
+		negmid: new(big.Int).Neg(posmid),
+	}
+}
+
+// Creates a geometry, checking that the parameters form a usable routing table
+// and fit into the id resolver (and verifiable id derivation if enabled).
+func newGeometry(space, base, leaves int) (*geometry, error) {
+	switch {
+	case base < 1 || space <= 0 || space%base != 0:
+		return nil, fmt.Errorf("%v: space %d not a positive multiple of base %d", ErrGeometry, space, base)
+	case leaves < 2 || leaves%2 != 0:
+		return nil, fmt.Errorf("%v: leafset size %d not a positive even number", ErrGeometry, leaves)
+	case config.PastryResolver().Size()*8 < space:
+		return nil, fmt.Errorf("%v: space %d exceeds resolver output", ErrGeometry, space)
+	case config.PastryVerifyIds && space > 256:
+		return nil, fmt.Errorf("%v: space %d exceeds verifiable id length", ErrGeometry, space)
+	}
+	return makeGeometry(space, base, leaves), nil
+}
 
 // Special id slice implementing sort.Interface.
 type idSlice struct {
+	geo    *geometry
 	origin *big.Int
 	data   []*big.Int
 }
@@ -47,8 +96,8 @@ func (p idSlice) Len() int {
 
 // Required for sort.Sort.
 func (p idSlice) Less(i, j int) bool {
-	di := delta(p.origin, p.data[i])
-	dj := delta(p.origin, p.data[j])
+	di := p.geo.delta(p.origin, p.data[i])
+	dj := p.geo.delta(p.origin, p.data[j])
 	return di.Cmp(dj) < 0
 }
 
@@ -58,50 +107,85 @@ func (p idSlice) Swap(i, j int) {
 }
 
 // Calculates the signed distance between two ids on the circular ID space
-func delta(a, b *big.Int) *big.Int {
+func (g *geometry) delta(a, b *big.Int) *big.Int {
 	d := new(big.Int).Sub(b, a)
 	switch {
-	case posmid.Cmp(d) < 0:
-		d.Sub(d, modulo)
-	case negmid.Cmp(d) > 0:
-		d.Add(d, modulo)
+	case g.posmid.Cmp(d) < 0:
+		d.Sub(d, g.modulo)
+	case g.negmid.Cmp(d) > 0:
+		d.Add(d, g.modulo)
 	}
 	return d
 }
 
 // Calculates the absolute distance between two ids on the circular ID space
-func Distance(a, b *big.Int) *big.Int {
-	return new(big.Int).Abs(delta(a, b))
+func (g *geometry) distance(a, b *big.Int) *big.Int {
+	return new(big.Int).Abs(g.delta(a, b))
 }
 
 // Calculate the length of the common prefix of two ids and the differing digit.
-func prefix(a, b *big.Int) (int, int) {
+func (g *geometry) prefix(a, b *big.Int) (int, int) {
 	p := 0
-	for bit := config.PastrySpace - 1; bit >= 0; bit-- {
+	for bit := g.space - 1; bit >= 0; bit-- {
 		if a.Bit(bit) != b.Bit(bit) {
-			p = (config.PastrySpace - 1 - bit) / config.PastryBase
+			p = (g.space - 1 - bit) / g.base
 			break
 		}
 	}
 	d := uint(0)
-	for bit := 0; bit < config.PastryBase; bit++ {
-		d |= b.Bit(config.PastrySpace-(p+1)*config.PastryBase+bit) << uint(bit)
+	for bit := 0; bit < g.base; bit++ {
+		d |= b.Bit(g.space-(p+1)*g.base+bit) << uint(bit)
 	}
 	return p, int(d)
 }
 
-// Converts a string id into an overlay id.
+// Calculates the signed distance between two ids on the default ID space
+func delta(a, b *big.Int) *big.Int {
+	return defaultGeometry.delta(a, b)
+}
+
+// Calculates the absolute distance between two ids on the default ID space
+func Distance(a, b *big.Int) *big.Int {
+	return defaultGeometry.distance(a, b)
+}
+
+// Calculate the common prefix length and differing digit in the default space.
+func prefix(a, b *big.Int) (int, int) {
+	return defaultGeometry.prefix(a, b)
+}
+
+// Converts a string id into an id of the globally configured space.
 func Resolve(id string) *big.Int {
+	return resolveId(id, config.PastrySpace)
+}
+
+// Converts a string id into an id of the geometry's space.
+func (g *geometry) resolve(id string) *big.Int {
+	return resolveId(id, g.space)
+}
+
+// Converts a string id into an id of the given bit length.
+func resolveId(id string, space int) *big.Int {
 	// Hash the textual id
 	h := config.PastryResolver()
 	io.WriteString(h, id)
 	sum := h.Sum(nil)
 
 	// Extract enough bits, and clear overflows
-	raw := sum[:(config.PastrySpace+7)/8]
-	for i := 0; i < len(raw)*8-config.PastrySpace; i++ {
+	raw := sum[:(space+7)/8]
+	for i := 0; i < len(raw)*8-space; i++ {
 		raw[0] &= ^byte(1 << (7 - uint(i)))
 	}
 	// Return the new id
 	return new(big.Int).SetBytes(raw)
 }
+
+// Converts a string id into an id of the overlay's space.
+func (o *Overlay) Resolve(id string) *big.Int {
+	return o.geo.resolve(id)
+}
+
+// Calculates the absolute distance between two ids on the overlay's ID space.
+func (o *Overlay) Distance(a, b *big.Int) *big.Int {
+	return o.geo.distance(a, b)
+}
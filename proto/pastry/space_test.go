@@ -41,6 +41,13 @@ type spaceTest struct {
 
 var one = big.NewInt(1)
 
+// Boundaries of the default id space.
+var (
+	modulo = defaultGeometry.modulo
+	posmid = defaultGeometry.posmid
+	negmid = defaultGeometry.negmid
+)
+
 // The tests assume the default 4 bit digits!
 var spaceTests = []spaceTest{
 	// Simple startup cases
@@ -128,3 +135,40 @@ func TestResolve(t *testing.T) {
 		}
 	}
 }
+
+func TestGeometry(t *testing.T) {
+	// Ensure unusable layouts are refused
+	invalid := [][3]int{
+		{0, 4, 16},  // Empty space
+		{30, 4, 16}, // Space not a multiple of base
+		{32, 0, 1},  // Zero digit length
+		{32, 4, 7},  // Uneven leafset
+		{256, 4, 8}, // Space wider than the resolver
+	}
+	for i, tt := range invalid {
+		if _, err := newGeometry(tt[0], tt[1], tt[2]); err == nil {
+			t.Errorf("test %d: invalid geometry accepted: %v.", i, tt)
+		}
+	}
+	// Ensure a lean layout sizes and walks the routing table accordingly
+	geo, err := newGeometry(16, 2, 4)
+	if err != nil {
+		t.Fatalf("failed to create lean geometry: %v.", err)
+	}
+	table := newRoutingTable(big.NewInt(0), geo)
+	if len(table.routes) != 8 || len(table.routes[0]) != 4 || cap(table.leaves) != 4 {
+		t.Fatalf("table layout mismatch: have %dx%d/%d, want 8x4/4.", len(table.routes), len(table.routes[0]), cap(table.leaves))
+	}
+	if d := geo.delta(big.NewInt(0), big.NewInt(65535)); d.Cmp(big.NewInt(-1)) != 0 {
+		t.Fatalf("delta mismatch: have %v, want -1.", d)
+	}
+	if p, d := geo.prefix(big.NewInt(0), big.NewInt(0x0300)); p != 3 || d != 3 {
+		t.Fatalf("prefix/digit mismatch: have %v/%v, want 3/3.", p, d)
+	}
+	if d := geo.distance(big.NewInt(65535), big.NewInt(1)); d.Cmp(big.NewInt(2)) != 0 {
+		t.Fatalf("distance mismatch: have %v, want 2.", d)
+	}
+	if id := geo.resolve("string"); id.Cmp(new(big.Int).Rsh(resolveId("string", 32), 16)) != 0 {
+		t.Fatalf("resolution mismatch: have %v, want the leading 16 bits.", id)
+	}
+}
@@ -0,0 +1,57 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the per peer traffic accounting, letting operators spot asymmetric
+// load distribution and abusive neighbors.
+
+package pastry
+
+import (
+	"sync/atomic"
+)
+
+// Traffic exchanged with a single overlay peer since its connection was set up.
+type PeerStats struct {
+	Addr   string // Remote network address of the connection
+	Active bool   // Whether the peer is part of the routing state
+
+	MsgsIn   uint64 // Number of messages received from the peer
+	MsgsOut  uint64 // Number of messages sent to the peer
+	BytesIn  uint64 // Number of bytes received, including the link overhead
+	BytesOut uint64 // Number of bytes sent, including the link overhead
+}
+
+// Retrieves the traffic accounting of each live peer, keyed by node id.
+func (o *Overlay) Stats() map[string]*PeerStats {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	stats := make(map[string]*PeerStats, len(o.livePeers))
+	for id, p := range o.livePeers {
+		stat := &PeerStats{
+			Addr:    p.raddr,
+			Active:  o.active(p.nodeId),
+			MsgsIn:  atomic.LoadUint64(&p.msgsIn),
+			MsgsOut: atomic.LoadUint64(&p.msgsOut),
+		}
+		stat.BytesIn, stat.BytesOut = p.conn.Traffic()
+		stats[id] = stat
+	}
+	return stats
+}
@@ -0,0 +1,75 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package pastry
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/proto"
+)
+
+func TestStats(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Boot two nodes, the second collecting the deliveries
+	app := &collector{delivs: []*proto.Message{}}
+	first := New(appId, key, new(nopCallback))
+	if _, err := first.Boot(); err != nil {
+		t.Fatalf("failed to boot first node: %v.", err)
+	}
+	defer first.Shutdown()
+
+	second := New(appId, key, app)
+	if _, err := second.Boot(); err != nil {
+		t.Fatalf("failed to boot second node: %v.", err)
+	}
+	defer second.Shutdown()
+	waitConverged(t, []*Overlay{first, second})
+
+	// Push a batch of data messages through and check the accounting
+	messages, payload := 100, make([]byte, 1024)
+	for i := 0; i < messages; i++ {
+		msg := &proto.Message{Head: proto.Header{Meta: []byte{0x99}}, Data: payload}
+		msg.Encrypt()
+		first.Send(second.nodeId, msg)
+	}
+	time.Sleep(time.Second)
+
+	out, ok := first.Stats()[second.nodeId.String()]
+	if !ok {
+		t.Fatalf("no stats for the remote peer.")
+	}
+	in := second.Stats()[first.nodeId.String()]
+	if out.MsgsOut < uint64(messages) || in.MsgsIn < uint64(messages) {
+		t.Fatalf("message count mismatch: sent %v, received %v, want at least %v.", out.MsgsOut, in.MsgsIn, messages)
+	}
+	if want := uint64(messages * len(payload)); out.BytesOut < want || in.BytesIn < want {
+		t.Fatalf("byte count mismatch: sent %v, received %v, want at least %v.", out.BytesOut, in.BytesIn, want)
+	}
+	if !out.Active || out.Addr == "" {
+		t.Fatalf("connection details mismatch: active %v, address %q.", out.Active, out.Addr)
+	}
+}
@@ -23,8 +23,6 @@ package pastry
 
 import (
 	"math/big"
-
-	"github.com/karalabe/iris/config"
 )
 
 // Simplified Pastry routing table.
@@ -33,18 +31,18 @@ type table struct {
 	routes [][]*big.Int
 }
 
-// Creates a new empty routing table.
-func newRoutingTable(origin *big.Int) *table {
+// Creates a new empty routing table, sized according to the id space geometry.
+func newRoutingTable(origin *big.Int, geo *geometry) *table {
 	res := new(table)
 
 	// Create the leaf set with only the origin point inside
-	res.leaves = make([]*big.Int, 1, config.PastryLeaves)
+	res.leaves = make([]*big.Int, 1, geo.leaves)
 	res.leaves[0] = origin
 
 	// Create the empty routing table of predefined size
-	res.routes = make([][]*big.Int, config.PastrySpace/config.PastryBase)
+	res.routes = make([][]*big.Int, geo.space/geo.base)
 	for i := 0; i < len(res.routes); i++ {
-		res.routes[i] = make([]*big.Int, 1<<uint(config.PastryBase))
+		res.routes[i] = make([]*big.Int, 1<<uint(geo.base))
 	}
 	return res
 }
@@ -54,7 +52,7 @@ func (t *table) copy() *table {
 	res := new(table)
 
 	// Copy the leafset
-	res.leaves = make([]*big.Int, len(t.leaves), config.PastryLeaves)
+	res.leaves = make([]*big.Int, len(t.leaves), cap(t.leaves))
 	copy(res.leaves, t.leaves)
 
 	// Copy the routing table
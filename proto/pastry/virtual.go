@@ -0,0 +1,239 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the virtual node support: a single physical node may host multiple
+// overlay ids, each owning its own share of the key space, so that stronger
+// machines can take over proportionally more load than weaker ones. The sessions
+// to other hosts are multiplexed among the virtual nodes (see mux.go).
+
+package pastry
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+
+	"github.com/karalabe/iris/proto"
+	"github.com/karalabe/iris/proto/session"
+)
+
+// Set of virtual overlay nodes hosted by a single physical node. Each virtual
+// node is a full overlay member with a distinct id, but they all share the same
+// session resumption state and the sessions to other hosts, which carry the
+// traffic of all the virtual node pairs between the two.
+type Host struct {
+	nodes []*Overlay
+
+	muxes map[*mux]struct{} // Sessions shared with other hosts
+	down  bool              // Whether the host is terminating
+	lock  sync.Mutex        // Lock protecting the shared sessions
+}
+
+// Creates a host of as many virtual overlay nodes as configured, all delivering
+// to the same application callback. Persisted states are kept in separate files,
+// suffixed by the index of the virtual node (except the first). A host of a single
+// node behaves as a standalone overlay.
+func NewHost(id string, key *rsa.PrivateKey, app Callback, conf *Config) *Host {
+	host := &Host{
+		nodes: make([]*Overlay, conf.VirtualNodes),
+		muxes: make(map[*mux]struct{}),
+	}
+	for i := range host.nodes {
+		vconf := conf.copy()
+		vconf.Session.Tickets = conf.Session.Tickets
+		if vconf.StateFile != "" && i > 0 {
+			vconf.StateFile = fmt.Sprintf("%s.%d", conf.StateFile, i)
+		}
+		host.nodes[i] = NewConfig(id, key, app, vconf)
+		if len(host.nodes) > 1 {
+			host.nodes[i].host = host
+		}
+	}
+	return host
+}
+
+// Overrides the session handshake parameters of all the virtual nodes, keeping
+// the resumption state shared. Must be called before booting.
+func (h *Host) SetShakeConfig(conf *session.Config) {
+	tickets := h.nodes[0].conf.Session.Tickets
+	for _, node := range h.nodes {
+		node.SetShakeConfig(conf)
+		node.conf.Session.Tickets = tickets
+	}
+}
+
+// Sets the admission policy of all the virtual nodes. Must be called before
+// booting.
+func (h *Host) SetAuthorizer(auth Authorizer) {
+	for _, node := range h.nodes {
+		node.SetAuthorizer(auth)
+	}
+}
+
+// Overrides the bootstrap ports of all the virtual nodes. Must be called before
+// booting.
+func (h *Host) SetBootPorts(ports []int) {
+	for _, node := range h.nodes {
+		node.SetBootPorts(ports)
+	}
+}
+
+// Returns the virtual nodes of the host, the first being the primary one.
+func (h *Host) Nodes() []*Overlay {
+	return h.nodes
+}
+
+// Checks whether an overlay id belongs to one of the hosted virtual nodes.
+func (h *Host) Owns(id *big.Int) bool {
+	for _, node := range h.nodes {
+		if node.nodeId.Cmp(id) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Boots all the virtual nodes concurrently, returning the number of remote peers
+// of the primary one after convergence.
+func (h *Host) Boot() (int, error) {
+	peers := make([]int, len(h.nodes))
+	errs := make([]error, len(h.nodes))
+
+	var pend sync.WaitGroup
+	for i, node := range h.nodes {
+		pend.Add(1)
+		go func(i int, node *Overlay) {
+			defer pend.Done()
+			peers[i], errs[i] = node.Boot()
+		}(i, node)
+	}
+	pend.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return peers[0], err
+		}
+	}
+	return peers[0], nil
+}
+
+// Terminates all the virtual nodes, reporting the first failure.
+func (h *Host) Shutdown() error {
+	h.lock.Lock()
+	h.down = true
+	h.lock.Unlock()
+
+	var res error
+	for _, node := range h.nodes {
+		if err := node.Shutdown(); err != nil && res == nil {
+			res = err
+		}
+	}
+	return res
+}
+
+// Sends a message to the closest node to the given destination, routing it from
+// the virtual node nearest to it.
+func (h *Host) Send(dest *big.Int, msg *proto.Message) {
+	h.nearest(dest).Send(dest, msg)
+}
+
+// Returns the id of the virtual node nearest to the given one.
+func (h *Host) Nearest(id *big.Int) *big.Int {
+	return h.nearest(id).nodeId
+}
+
+// Returns the virtual node nearest to the given id.
+func (h *Host) nearest(id *big.Int) *Overlay {
+	best := h.nodes[0]
+	dist := best.geo.distance(best.nodeId, id)
+	for _, node := range h.nodes[1:] {
+		if d := node.geo.distance(node.nodeId, id); d.Cmp(dist) < 0 {
+			best, dist = node, d
+		}
+	}
+	return best
+}
+
+// Assembles the init packets of the virtual nodes other than the one executing a
+// handshake, bound to the same session.
+func (h *Host) initPackets(self *Overlay, ses *session.Session) []*initPacket {
+	pkts := make([]*initPacket, 0, len(h.nodes)-1)
+	for _, node := range h.nodes {
+		if node != self {
+			pkts = append(pkts, node.initPacket(ses))
+		}
+	}
+	return pkts
+}
+
+// Retrieves the virtual node with the given id, or nil if there's none or the
+// host is terminating.
+func (h *Host) node(id *big.Int) *Overlay {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.down {
+		return nil
+	}
+	for _, node := range h.nodes {
+		if node.nodeId.Cmp(id) == 0 {
+			return node
+		}
+	}
+	return nil
+}
+
+// Pairs a virtual node with the remote ones listening on any of the given addresses
+// through the already shared sessions, returning whether any pair could be opened.
+func (h *Host) attach(node *Overlay, addrs []*net.TCPAddr) bool {
+	type target struct {
+		mux *mux
+		pkt *initPacket
+	}
+	targets := []target{}
+
+	h.lock.Lock()
+	for m := range h.muxes {
+		for _, pkt := range m.remote {
+			if pkt.listens(addrs) {
+				targets = append(targets, target{m, pkt})
+			}
+		}
+	}
+	h.lock.Unlock()
+
+	opened := false
+	for _, t := range targets {
+		if t.mux.open(node, t.pkt) != nil {
+			opened = true
+		}
+	}
+	return opened
+}
+
+// Removes a closed shared session from the host.
+func (h *Host) forget(m *mux) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	delete(h.muxes, m)
+}
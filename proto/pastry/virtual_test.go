@@ -0,0 +1,181 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package pastry
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"fmt"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto"
+)
+
+// Callback collecting the destination keys of the delivered messages.
+type keyCollector struct {
+	keys []*big.Int
+	lock sync.Mutex
+}
+
+func (c *keyCollector) Deliver(msg *proto.Message, key *big.Int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.keys = append(c.keys, key)
+}
+
+func (c *keyCollector) Forward(msg *proto.Message, key *big.Int) bool {
+	return true
+}
+
+func TestVirtualNodes(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	// Parse encryption key
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Create a host with a handful of virtual nodes and boot them
+	conf := DefaultConfig()
+	conf.VirtualNodes = 3
+
+	host := NewHost(appId, key, new(nopCallback), conf)
+	if _, err := host.Boot(); err != nil {
+		t.Fatalf("failed to boot virtual nodes: %v.", err)
+	}
+	defer host.Shutdown()
+
+	// Make sure the virtual nodes are distinct, yet share the session state
+	nodes := host.Nodes()
+	if len(nodes) != conf.VirtualNodes {
+		t.Fatalf("virtual node count mismatch: have %v, want %v.", len(nodes), conf.VirtualNodes)
+	}
+	for i, node := range nodes {
+		if !host.Owns(node.Self()) {
+			t.Fatalf("virtual node #%d not owned by host.", i)
+		}
+		if node.conf.Session.Tickets != conf.Session.Tickets {
+			t.Fatalf("virtual node #%d session state not shared.", i)
+		}
+		for j := 0; j < i; j++ {
+			if nodes[j].Self().Cmp(node.Self()) == 0 {
+				t.Fatalf("virtual nodes #%d and #%d share id %v.", j, i, node.Self())
+			}
+		}
+	}
+	// Each virtual node should be a full overlay member
+	time.Sleep(time.Second)
+	for i, node := range nodes {
+		if peers := len(node.Snapshot().Peers); peers != len(nodes)-1 {
+			t.Fatalf("virtual node #%d peer count mismatch: have %v, want %v.", i, peers, len(nodes)-1)
+		}
+	}
+}
+
+func TestVirtualMultiplex(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+	config.BootPorts = append(config.BootPorts, fmt.Sprintf("65500-%d", 65500+5))
+
+	// Parse encryption key
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Boot two hosts of virtual nodes and wait for them to converge
+	conf := DefaultConfig()
+	conf.VirtualNodes = 3
+
+	apps := []*keyCollector{new(keyCollector), new(keyCollector)}
+	hosts := []*Host{NewHost(appId, key, apps[0], conf), NewHost(appId, key, apps[1], conf)}
+	for i, host := range hosts {
+		if _, err := host.Boot(); err != nil {
+			t.Fatalf("failed to boot host #%d: %v.", i, err)
+		}
+		defer host.Shutdown()
+	}
+	nodes := append(append([]*Overlay{}, hosts[0].Nodes()...), hosts[1].Nodes()...)
+	waitConverged(t, nodes)
+
+	// Make sure the virtual nodes of the two hosts share a single session
+	sessions := make(map[interface{}]struct{})
+	for _, node := range hosts[0].Nodes() {
+		node.lock.RLock()
+		for _, remote := range hosts[1].Nodes() {
+			if p, ok := node.livePeers[remote.nodeId.String()]; ok {
+				if p.mux == nil {
+					t.Errorf("virtual node %v: peer %v not multiplexed.", node.nodeId, remote.nodeId)
+				}
+				sessions[p.conn] = struct{}{}
+			}
+		}
+		node.lock.RUnlock()
+	}
+	if len(sessions) != 1 {
+		t.Fatalf("shared session count mismatch: have %v, want 1.", len(sessions))
+	}
+	// Send a batch of random keys and make sure they spread across all virtual ids
+	keys := 600
+	for i := 0; i < keys; i++ {
+		dest, err := rand.Int(rand.Reader, nodes[0].geo.modulo)
+		if err != nil {
+			t.Fatalf("failed to generate key: %v.", err)
+		}
+		msg := &proto.Message{Data: []byte{byte(i)}}
+		msg.Encrypt()
+		hosts[i%2].Send(dest, msg)
+	}
+	time.Sleep(time.Second)
+
+	owned := make(map[string]int)
+	for i, app := range apps {
+		app.lock.Lock()
+		for _, key := range app.keys {
+			owner := nodes[0]
+			for _, node := range nodes[1:] {
+				if node.geo.distance(node.nodeId, key).Cmp(owner.geo.distance(owner.nodeId, key)) < 0 {
+					owner = node
+				}
+			}
+			if !hosts[i].Owns(owner.nodeId) {
+				t.Errorf("key %v delivered on host #%d, owned by %v.", key, i, owner.nodeId)
+			}
+			owned[owner.nodeId.String()]++
+		}
+		keys -= len(app.keys)
+		app.lock.Unlock()
+	}
+	if keys != 0 {
+		t.Fatalf("undelivered keys: %v.", keys)
+	}
+	for i, node := range nodes {
+		if owned[node.nodeId.String()] == 0 {
+			t.Errorf("virtual node #%d received no keys.", i)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the event coalescing logic of the interior tree nodes. Small
+// events forwarded to the same child are queued up and sent out in one frame
+// either when the batch fills up or when the oldest event's delay expires.
+
+package scribe
+
+import (
+	"math/big"
+	"time"
+
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto"
+)
+
+// Events pending coalescing towards a single child node.
+type batch struct {
+	msgs  []*proto.Message // Events queued up for the child
+	timer *time.Timer      // Timer to flush the batch after the allowed delay
+}
+
+// Queues an event for batched forwarding to a child node, flushing immediately
+// if the batch limit is reached.
+func (o *Overlay) queueBatch(dest *big.Int, msg *proto.Message) {
+	sid := dest.String()
+
+	o.batchLock.Lock()
+	b, ok := o.batches[sid]
+	if !ok {
+		b = &batch{msgs: make([]*proto.Message, 0, config.ScribeBatchLimit)}
+		b.timer = time.AfterFunc(config.ScribeBatchDelay, func() { o.flushBatch(dest) })
+		o.batches[sid] = b
+	}
+	b.msgs = append(b.msgs, msg)
+	if len(b.msgs) < config.ScribeBatchLimit {
+		o.batchLock.Unlock()
+		return
+	}
+	delete(o.batches, sid)
+	o.batchLock.Unlock()
+
+	// Batch full, send it out
+	b.timer.Stop()
+	o.sendBatch(dest, b.msgs)
+}
+
+// Sends out any events pending coalescing towards a child node.
+func (o *Overlay) flushBatch(dest *big.Int) {
+	sid := dest.String()
+
+	o.batchLock.Lock()
+	b, ok := o.batches[sid]
+	delete(o.batches, sid)
+	o.batchLock.Unlock()
+
+	if ok {
+		b.timer.Stop()
+		o.sendBatch(dest, b.msgs)
+	}
+}
+
+// Sends out all the events pending coalescing.
+func (o *Overlay) flushBatches() {
+	o.batchLock.Lock()
+	pend := o.batches
+	o.batches = make(map[string]*batch)
+	o.batchLock.Unlock()
+
+	for sid, b := range pend {
+		b.timer.Stop()
+		if dest, ok := new(big.Int).SetString(sid, 10); ok {
+			o.sendBatch(dest, b.msgs)
+		}
+	}
+}
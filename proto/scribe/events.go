@@ -48,6 +48,13 @@
 //  - Balance:
 //    It is essentially the same as publish, with the only difference that the
 //    message is send forward on only one edge of the multi-cast tree.
+//    Balances pinned by an affinity key are not caught midway, but balanced down
+//    from the topic root, so that all of them see the same tree.
+//
+//  - Delay:
+//    Delayed publishes are not caught midway either, but held at the topic root
+//    until their due time, after which they are distributed as virgin publishes
+//    from the root. If the topic has no members by then, they are undeliverable.
 //
 //  - Report:
 //    These are used to distribute load reports between members of a multi-cast
@@ -57,6 +64,18 @@
 //    As the name suggests, direct messages have a precise destination. Only the
 //    true recipient must handle it. Delivery to a non-precise destination means
 //    either the destination terminated, or pastry's mis-delivered (churn?).
+//
+//  - Batch:
+//    Interior nodes may coalesce bursts of small events heading towards the
+//    same child into a single frame, holding them back for a bounded delay.
+//    Batches are precisely addressed and unpacked into the original publishes.
+//
+//  - Credit:
+//    Pull mode subscribers grant their parent an event allowance. The parent
+//    forwards events only while credits remain, and if its whole subtree is in
+//    pull mode, requests the largest allowance from its own parent in turn.
+//    Credits are precisely addressed, and are resent on every heartbeat to
+//    tolerate parent changes and in-flight events.
 
 package scribe
 
@@ -65,7 +84,9 @@ import (
 	"fmt"
 	"log"
 	"math/big"
+	"time"
 
+	"github.com/karalabe/iris/config"
 	"github.com/karalabe/iris/proto"
 	"github.com/karalabe/iris/proto/pastry"
 	"github.com/karalabe/iris/proto/scribe/topic"
@@ -101,6 +122,11 @@ func (o *Overlay) Deliver(msg *proto.Message, key *big.Int) {
 		if hand, err := o.handlePublish(msg, head.Topic, head.Prev); !hand || err != nil {
 			// Simple race condition between unsubscribe and publish, left in for debug
 			log.Printf("scribe: %v failed to handle delivered publish (churn?): %v %v.", o.pastry.Self(), hand, err)
+
+			// Virgin publishes at the root of a topic without members are undeliverable
+			if !hand && err == nil && head.Prev == nil {
+				o.reportFailure(head, &pastry.ForwardError{Reason: pastry.ErrUndeliverable, Hop: o.pastry.Self(), Dest: key})
+			}
 		}
 	case opBalance:
 		// Non-virgin balances must be delivered precisely
@@ -112,6 +138,17 @@ func (o *Overlay) Deliver(msg *proto.Message, key *big.Int) {
 			// Simple race condition between unsubscribe and balance, left in for debug
 			log.Printf("scribe: failed to handle delivered balance: %v %v.", hand, err)
 		}
+	case opSequence:
+		// Ordered publishes are delivered to the topic root for sequencing
+		if hand, err := o.handleSequence(msg, head.Topic); !hand || err != nil {
+			log.Printf("scribe: %v failed to sequence delivered publish: %v %v.", o.pastry.Self(), hand, err)
+			if !hand && err == nil {
+				o.reportFailure(head, &pastry.ForwardError{Reason: pastry.ErrUndeliverable, Hop: o.pastry.Self(), Dest: key})
+			}
+		}
+	case opDelay:
+		// Delayed publishes are held at the topic root until due
+		o.handleDelay(msg, head.Topic, head.Due)
 	case opReport:
 		// Load reports are always addresses precisely, drop any other
 		if o.pastry.Self().Cmp(key) != 0 {
@@ -130,11 +167,60 @@ func (o *Overlay) Deliver(msg *proto.Message, key *big.Int) {
 		if err := o.handleDirect(msg); err != nil {
 			log.Printf("scribe: failed to handle direct message: %v.", err)
 		}
+	case opBatch:
+		// Batches are always addressed precisely, drop any other
+		if o.pastry.Self().Cmp(key) != 0 {
+			log.Printf("scribe: event batch delivered to wrong node (churn?): have %v, want %v.", key, o.pastry.Self())
+			return
+		}
+		o.handleBatch(head.Batch, key)
+	case opCredit:
+		// Credit grants are always addressed precisely, drop any other
+		if o.pastry.Self().Cmp(key) != 0 {
+			log.Printf("scribe: credit grant delivered to wrong node (churn?): have %v, want %v.", key, o.pastry.Self())
+			return
+		}
+		if err := o.handleCredit(head.Sender, head.Topic, head.Credit); err != nil {
+			log.Printf("scribe: failed to handle credit grant: %v.", err)
+		}
+	case opFailure:
+		// Failure reports are always addressed precisely, drop any other
+		if o.pastry.Self().Cmp(key) != 0 {
+			log.Printf("scribe: failure report delivered to wrong node (churn?): have %v, want %v.", key, o.pastry.Self())
+			return
+		}
+		o.handleFailure(head.Meta, head.Fail)
 	default:
 		log.Printf("unknown opcode received: %v, %v", head.Op, head)
 	}
 }
 
+// Implements the pastry.FailureCallback.Fail method. Balanced and direct messages
+// lost in transit are reported to their scribe level origin, which might not be
+// the node that sent the failing hop if the message was rerouted along a topic.
+// Publishes are reported only if lost before reaching the topic's tree.
+func (o *Overlay) Fail(msg *proto.Message, key *big.Int, err *pastry.ForwardError) {
+	head := msg.Head.Meta.(*header)
+	switch head.Op {
+	case opBalance, opDirect:
+		o.reportFailure(head, err)
+	case opPublish, opSequence, opDelay:
+		if head.Prev == nil {
+			o.reportFailure(head, err)
+		}
+	}
+}
+
+// Reports the failure of a message back to its scribe level origin, or passes it
+// directly upstream if originated locally.
+func (o *Overlay) reportFailure(head *header, err *pastry.ForwardError) {
+	if head.Sender.Cmp(o.pastry.Self()) == 0 {
+		o.handleFailure(head.Meta, err)
+	} else {
+		o.sendFailure(head.Sender, head.Meta, err)
+	}
+}
+
 // Implements the pastry.Callback.Forward method.
 func (o *Overlay) Forward(msg *proto.Message, key *big.Int) bool {
 	head := msg.Head.Meta.(*header)
@@ -166,8 +252,8 @@ func (o *Overlay) Forward(msg *proto.Message, key *big.Int) bool {
 			return !hand
 		}
 	}
-	// Catch virgin balance messages and only blindly forward if cannot handle
-	if head.Op == opBalance && head.Prev == nil {
+	// Catch virgin balance messages (unless pinned) and only blindly forward if cannot handle
+	if head.Op == opBalance && head.Prev == nil && head.Key == "" {
 		if hand, err := o.handleBalance(msg, head.Topic, head.Prev); err != nil {
 			log.Printf("scribe: failed to handle forwarding balance: %v %v.", hand, err)
 		} else {
@@ -187,14 +273,21 @@ func (o *Overlay) handleSubscribe(nodeId, topicId *big.Int) error {
 	top, ok := o.topics[sid]
 	if !ok {
 		top = topic.New(topicId, o.pastry.Self())
+		if strategy, ok := o.strategies[sid]; ok {
+			top.SetStrategy(strategy)
+		}
 		o.topics[sid] = top
 	}
 	o.lock.Unlock()
 
-	// Subscribe node to the topic
+	// Subscribe node to the topic, lifting any pull limits of the parent
+	prev := top.Demand()
 	if err := top.Subscribe(nodeId); err != nil {
 		return err
 	}
+	if parent := top.Parent(); parent != nil && prev >= 0 {
+		go o.sendCredit(parent, topicId, -1)
+	}
 	// If a remote node, start monitoring is and respond with an empty report (fast parent discovery)
 	if nodeId.Cmp(o.pastry.Self()) != 0 {
 		if err := o.monitor(topicId, nodeId); err != nil {
@@ -293,11 +386,64 @@ func (o *Overlay) handlePublish(msg *proto.Message, topicId *big.Int, prevHop *b
 			// Cannot decrypt, report handled and also the error
 			return true, err
 		}
-		o.app.HandlePublish(head.Sender, topName, plain)
+		if cb, ok := o.app.(OrderedCallback); ok && head.Seq != 0 {
+			cb.HandleOrdered(head.Sender, topName, head.Root, head.Seq, plain)
+		} else {
+			o.app.HandlePublish(head.Sender, topName, plain)
+		}
 	}
 	return true, nil
 }
 
+// Handles an ordered publish arriving at the topic root, stamping the next
+// sequence number and distributing it as a regular publish.
+func (o *Overlay) handleSequence(msg *proto.Message, topicId *big.Int) (bool, error) {
+	sid := topicId.String()
+
+	o.lock.Lock()
+	if _, ok := o.topics[sid]; !ok {
+		o.lock.Unlock()
+		return false, nil
+	}
+	o.sequences[sid]++
+	seq := o.sequences[sid]
+	o.lock.Unlock()
+
+	head := msg.Head.Meta.(*header)
+	head.Op, head.Seq, head.Root = opPublish, seq, o.pastry.Self()
+	return o.handlePublish(msg, topicId, nil)
+}
+
+// Handles a delayed publish arriving at the topic root, holding it back until
+// the due time and distributing it as a regular publish after.
+func (o *Overlay) handleDelay(msg *proto.Message, topicId *big.Int, due time.Time) {
+	// Refuse holding back publishes beyond the delay limit
+	if due.Sub(time.Now()) > config.IrisDelayLimit {
+		log.Printf("scribe: %v rejected delayed publish beyond limit: %v.", o.pastry.Self(), due)
+		o.reportFailure(msg.Head.Meta.(*header), &pastry.ForwardError{Reason: pastry.ErrUndeliverable, Hop: o.pastry.Self(), Dest: topicId})
+		return
+	}
+	var timer *time.Timer
+	release := func() {
+		o.lock.Lock()
+		delete(o.delays, timer)
+		o.lock.Unlock()
+
+		head := msg.Head.Meta.(*header)
+		head.Op, head.Due = opPublish, time.Time{}
+		if hand, err := o.handlePublish(msg, topicId, nil); !hand || err != nil {
+			log.Printf("scribe: %v failed to publish delayed event: %v %v.", o.pastry.Self(), hand, err)
+			if !hand && err == nil {
+				o.reportFailure(head, &pastry.ForwardError{Reason: pastry.ErrUndeliverable, Hop: o.pastry.Self(), Dest: topicId})
+			}
+		}
+	}
+	o.lock.Lock()
+	timer = time.AfterFunc(due.Sub(time.Now()), release)
+	o.delays[timer] = struct{}{}
+	o.lock.Unlock()
+}
+
 // Handles the load balancing event of a topio.
 func (o *Overlay) handleBalance(msg *proto.Message, topicId *big.Int, prevHop *big.Int) (bool, error) {
 	sid := topicId.String()
@@ -312,7 +458,14 @@ func (o *Overlay) handleBalance(msg *proto.Message, topicId *big.Int, prevHop *b
 		return false, nil
 	}
 	// Fetch the recipient and either forward or deliver
-	node, err := top.Balance(prevHop)
+	head := msg.Head.Meta.(*header)
+	var node *big.Int
+	var err error
+	if head.Key != "" {
+		node, err = top.BalanceKey(prevHop, head.Key)
+	} else {
+		node, err = top.Balance(prevHop, head.Urgent)
+	}
 	if err != nil {
 		return true, err
 	}
@@ -322,7 +475,6 @@ func (o *Overlay) handleBalance(msg *proto.Message, topicId *big.Int, prevHop *b
 		return true, nil
 	}
 	// Remove all carrier headers and decrypt
-	head := msg.Head.Meta.(*header)
 	msg.Head.Meta = head.Meta
 	if err := msg.Decrypt(); err != nil {
 		return true, err
@@ -345,6 +497,51 @@ func (o *Overlay) handleDirect(msg *proto.Message) error {
 	return nil
 }
 
+// Passes a failure report of a locally originated message upstream, if the app
+// is interested in such reports.
+func (o *Overlay) handleFailure(meta interface{}, err *pastry.ForwardError) {
+	if cb, ok := o.app.(FailureCallback); ok && err != nil {
+		msg := &proto.Message{
+			Head: proto.Header{
+				Meta: meta,
+			},
+		}
+		cb.HandleFailure(msg, err)
+	}
+}
+
+// Handles a batch of coalesced events by delivering them one by one, as if they
+// arrived individually.
+func (o *Overlay) handleBatch(msgs []*proto.Message, key *big.Int) {
+	for _, msg := range msgs {
+		// The batch frame was secured by the link, so are its contents
+		msg.KnownSecure()
+		o.Deliver(msg, key)
+	}
+}
+
+// Handles a credit grant from a topic member, propagating the subtree demand to
+// the parent node if it changed.
+func (o *Overlay) handleCredit(nodeId, topicId *big.Int, credit int) error {
+	o.lock.RLock()
+	top, ok := o.topics[topicId.String()]
+	o.lock.RUnlock()
+	if !ok {
+		return errors.New("non-existent topic")
+	}
+	// Update the member allowance and notify the parent of the new demand
+	prev := top.Demand()
+	if err := top.Credit(nodeId, credit); err != nil {
+		return err
+	}
+	if demand := top.Demand(); demand != prev {
+		if parent := top.Parent(); parent != nil {
+			go o.sendCredit(parent, topicId, demand)
+		}
+	}
+	return nil
+}
+
 // Handles a remote member report, possibly assigning a new parent to the topic.
 func (o *Overlay) handleReport(src *big.Int, rep *report) error {
 	// Error collector
@@ -370,7 +567,7 @@ func (o *Overlay) handleReport(src *big.Int, rep *report) error {
 			}
 			// Make sure the node is closer than oneself. Prevents a race condition
 			// between a child drop due to heart timeout and a late beat (report).
-			if pastry.Distance(o.pastry.Self(), id).Cmp(pastry.Distance(src, id)) < 0 {
+			if o.pastry.Distance(o.host.Nearest(id), id).Cmp(o.pastry.Distance(src, id)) < 0 {
 				errs = append(errs, fmt.Errorf("parent assignment denied: %v closer to %v than %v.", o.pastry.Self(), id, src))
 				continue
 			}
@@ -85,10 +85,13 @@ func (o *Overlay) Beat() {
 			panic("failed to extract node id.")
 		}
 	}
-	// Subscribe all root topics
+	// Subscribe all root topics and resync the allowance of pull mode subtrees
 	for _, top := range o.topics {
-		if top.Parent() == nil {
+		parent := top.Parent()
+		if parent == nil {
 			go o.sendSubscribe(top.Self())
+		} else if demand := top.Demand(); demand >= 0 {
+			go o.sendCredit(parent, top.Self(), demand)
 		}
 	}
 }
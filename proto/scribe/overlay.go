@@ -27,7 +27,9 @@ import (
 	"log"
 	"math/big"
 	"sync"
+	"time"
 
+	"github.com/karalabe/iris/balancer"
 	"github.com/karalabe/iris/config"
 	"github.com/karalabe/iris/heart"
 	"github.com/karalabe/iris/proto"
@@ -45,17 +47,39 @@ type Callback interface {
 	HandleDirect(sender *big.Int, msg *proto.Message)
 }
 
+// Optional extension of the Callback, receiving the ordered publishes along with
+// their sequence numbers and the topic root that assigned them.
+type OrderedCallback interface {
+	HandleOrdered(sender *big.Int, topic string, root *big.Int, seq uint64, msg *proto.Message)
+}
+
+// Optional extension of the Callback, notified when a balanced or direct message
+// sent by the local node was lost in transit, or a publish was lost before
+// reaching the topic's tree or found no members at all (pastry.ErrUndeliverable),
+// carrying only the upper headers.
+type FailureCallback interface {
+	HandleFailure(msg *proto.Message, err *pastry.ForwardError)
+}
+
 // The overlay implementation, receiving the overlay events and processing
 // them according to the protocol.
 type Overlay struct {
 	app Callback // Upstream application callback
 
-	pastry *pastry.Overlay // Overlay network to route the messages
+	host   *pastry.Host    // Virtual nodes of the overlay network to route the messages
+	pastry *pastry.Overlay // Primary virtual node, identifying the local scribe node
 	heart  *heart.Heart    // Heartbeat mechanism
 
 	topics map[string]*topic.Topic // Topics active in the local node
 	names  map[string]string       // Mapping from topic id to its textual name
 
+	strategies map[string]balancer.Strategy // Balancing strategies of select topics, keyed by id
+	sequences  map[string]uint64            // Last sequence numbers of the locally rooted topics
+	delays     map[*time.Timer]struct{}     // Delayed publishes held until due at the local roots
+
+	batches   map[string]*batch // Events pending coalescing, keyed by child node
+	batchLock sync.Mutex        // Lock protecting the pending batches
+
 	lock sync.RWMutex
 }
 
@@ -66,12 +90,30 @@ func New(overId string, key *rsa.PrivateKey, app Callback) *Overlay {
 		app:    app,
 		topics: make(map[string]*topic.Topic),
 		names:  make(map[string]string),
+
+		strategies: make(map[string]balancer.Strategy),
+		sequences:  make(map[string]uint64),
+		delays:     make(map[*time.Timer]struct{}),
+
+		batches: make(map[string]*batch),
 	}
-	o.pastry = pastry.New(overId, key, o)
+	o.host = pastry.NewHost(overId, key, o, pastry.DefaultConfig())
+	o.pastry = o.host.Nodes()[0]
 	o.heart = heart.New(config.ScribeBeatPeriod, config.ScribeKillCount, o)
 	return o
 }
 
+// Returns the primary pastry node underneath, identifying the local node.
+func (o *Overlay) Pastry() *pastry.Overlay {
+	return o.pastry
+}
+
+// Returns the pastry virtual nodes underneath, to allow configuring them before
+// booting.
+func (o *Overlay) Host() *pastry.Host {
+	return o.host
+}
+
 // Boots the overlay, returning the number of remote peers.
 func (o *Overlay) Boot() (int, error) {
 	log.Printf("scribe: booting with id %v.", o.pastry.Self())
@@ -80,7 +122,7 @@ func (o *Overlay) Boot() (int, error) {
 	o.heart.Start()
 
 	// Boot the overlay and wait until it converges
-	peers, err := o.pastry.Boot()
+	peers, err := o.host.Boot()
 	if err != nil {
 		return 0, err
 	}
@@ -98,15 +140,25 @@ func (o *Overlay) Shutdown() error {
 	}
 	o.lock.RUnlock()
 
+	// Send out any events still pending coalescing, dropping the delayed ones
+	o.flushBatches()
+
+	o.lock.Lock()
+	for timer := range o.delays {
+		timer.Stop()
+	}
+	o.delays = make(map[*time.Timer]struct{})
+	o.lock.Unlock()
+
 	// Terminate the heartbeat mechanism and shut down pastry
 	o.heart.Terminate()
-	return o.pastry.Shutdown()
+	return o.host.Shutdown()
 }
 
 // Subscribes to the specified scribe topic.
 func (o *Overlay) Subscribe(topic string) error {
 	// Resolve the topic id
-	id := pastry.Resolve(topic)
+	id := o.pastry.Resolve(topic)
 	sid := id.String()
 
 	// Make sure we can map the id back to the textual name
@@ -125,7 +177,7 @@ func (o *Overlay) Subscribe(topic string) error {
 // Removes the subscription from topic.
 func (o *Overlay) Unsubscribe(topic string) error {
 	// Resolve the topic id
-	id := pastry.Resolve(topic)
+	id := o.pastry.Resolve(topic)
 	sid := id.String()
 
 	// Remove the topic name mapping
@@ -137,21 +189,83 @@ func (o *Overlay) Unsubscribe(topic string) error {
 	return o.handleUnsubscribe(o.pastry.Self(), id)
 }
 
+// Sets the strategy to balance the messages of topic with, instead of the capacity
+// weighted default. As balancing decisions are made along the whole topic tree,
+// all nodes should be configured alike.
+func (o *Overlay) SetStrategy(topic string, strategy balancer.Strategy) {
+	sid := o.pastry.Resolve(topic).String()
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.strategies[sid] = strategy
+	if top, ok := o.topics[sid]; ok {
+		top.SetStrategy(strategy)
+	}
+}
+
+// Sets the number of events the local subscription to topic is willing to accept,
+// switching it into pull mode. A negative value reverts to push mode.
+func (o *Overlay) Credit(topic string, credit int) error {
+	id := o.pastry.Resolve(topic)
+	return o.handleCredit(o.pastry.Self(), id, credit)
+}
+
 // Publishes a message into topic to be broadcast to everyone.
 func (o *Overlay) Publish(topic string, msg *proto.Message) error {
 	if err := msg.Encrypt(); err != nil {
 		return err
 	}
-	o.sendPublish(pastry.Resolve(topic), msg)
+	o.sendPublish(o.pastry.Resolve(topic), msg)
+	return nil
+}
+
+// Publishes a message into a topic to be broadcast to everyone at the due time,
+// held back by the topic root until then.
+func (o *Overlay) Delay(topic string, due time.Time, msg *proto.Message) error {
+	if err := msg.Encrypt(); err != nil {
+		return err
+	}
+	o.sendDelay(o.pastry.Resolve(topic), due, msg)
+	return nil
+}
+
+// Publishes a message into a topic in total order: the message is sequenced by
+// the topic root and distributed from there, its number allowing the members to
+// deliver all such messages in the same order.
+func (o *Overlay) Sequence(topic string, msg *proto.Message) error {
+	if err := msg.Encrypt(); err != nil {
+		return err
+	}
+	o.sendSequence(o.pastry.Resolve(topic), msg)
 	return nil
 }
 
 // Balances a message to one of the subscribed nodes.
 func (o *Overlay) Balance(topic string, msg *proto.Message) error {
+	return o.balance(topic, msg, false, "")
+}
+
+// Balances a latency critical message to the least loaded subscribed node, as
+// opposed to picking through the topic's strategy.
+func (o *Overlay) BalanceUrgent(topic string, msg *proto.Message) error {
+	return o.balance(topic, msg, true, "")
+}
+
+// Balances a message to the subscribed node the affinity key is pinned to, the
+// same for the same key while the topic's tree does not change. To have a single
+// view of the tree, such messages are not caught in flight, but balanced down
+// from the topic root.
+func (o *Overlay) BalanceKey(topic string, key string, msg *proto.Message) error {
+	return o.balance(topic, msg, false, key)
+}
+
+// Encrypts and sends a balanced message towards the topic.
+func (o *Overlay) balance(topic string, msg *proto.Message, urgent bool, key string) error {
 	if err := msg.Encrypt(); err != nil {
 		return err
 	}
-	o.sendBalance(pastry.Resolve(topic), msg)
+	o.sendBalance(o.pastry.Resolve(topic), msg, urgent, key)
 	return nil
 }
 
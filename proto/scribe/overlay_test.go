@@ -21,6 +21,7 @@ package scribe
 
 import (
 	"crypto/x509"
+	"fmt"
 	"math/big"
 	"sync"
 	"testing"
@@ -28,6 +29,7 @@ import (
 
 	"github.com/karalabe/iris/config"
 	"github.com/karalabe/iris/proto"
+	"github.com/karalabe/iris/proto/pastry"
 )
 
 type collector struct {
@@ -60,6 +62,34 @@ func (c *collector) HandleDirect(sender *big.Int, msg *proto.Message) {
 
 // Tests whether topic publishing work as expected.
 func TestPublish(t *testing.T) {
+	testPublish(t)
+}
+
+// Tests whether topic publishing works with event batching enabled.
+func TestPublishBatched(t *testing.T) {
+	delay, limit := config.ScribeBatchDelay, config.ScribeBatchLimit
+	defer func() { config.ScribeBatchDelay, config.ScribeBatchLimit = delay, limit }()
+
+	config.ScribeBatchDelay, config.ScribeBatchLimit = 10*time.Millisecond, 16
+	testPublish(t)
+}
+
+// Tests whether topic publishing works in a non-default id space geometry.
+func TestPublishGeometry(t *testing.T) {
+	space, base := config.PastrySpace, config.PastryBase
+	defer func() { config.PastrySpace, config.PastryBase = space, base }()
+
+	config.PastrySpace, config.PastryBase = 64, 2
+
+	// Make sure the topics are resolved into the overlay's id space
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	if n := New(overId, key, nil).pastry.Resolve(topicId).BitLen(); n > config.PastrySpace {
+		t.Fatalf("topic id outside the id space: have %d bits, want at most %d.", n, config.PastrySpace)
+	}
+	testPublish(t)
+}
+
+func testPublish(t *testing.T) {
 	// Override the overlay configuration
 	swapConfigs()
 	defer swapConfigs()
@@ -70,10 +100,7 @@ func TestPublish(t *testing.T) {
 	// Make sure there are enough ports to use
 	olds := config.BootPorts
 	defer func() { config.BootPorts = olds }()
-
-	for i := 0; i < nodes; i++ {
-		config.BootPorts = append(config.BootPorts, 65500+i)
-	}
+	config.BootPorts = append(config.BootPorts, fmt.Sprintf("65500-%d", 65500+nodes-1))
 	// Load the private key and start a single scribe node
 	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
 
@@ -172,10 +199,7 @@ func TestBalance(t *testing.T) {
 	// Make sure there are enough ports to use
 	olds := config.BootPorts
 	defer func() { config.BootPorts = olds }()
-
-	for i := 0; i < nodes; i++ {
-		config.BootPorts = append(config.BootPorts, 65500+i)
-	}
+	config.BootPorts = append(config.BootPorts, fmt.Sprintf("65500-%d", 65500+nodes-1))
 	// Load the private key and start a single scribe node
 	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
 
@@ -274,10 +298,7 @@ func TestDirect(t *testing.T) {
 	// Make sure there are enough ports to use
 	olds := config.BootPorts
 	defer func() { config.BootPorts = olds }()
-
-	for i := 0; i < nodes; i++ {
-		config.BootPorts = append(config.BootPorts, 65500+i)
-	}
+	config.BootPorts = append(config.BootPorts, fmt.Sprintf("65500-%d", 65500+nodes-1))
 	// Load the private key and start a single scribe node
 	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
 
@@ -356,3 +377,51 @@ func TestDirect(t *testing.T) {
 		time.Sleep(time.Second)
 	}
 }
+
+// Collector additionally recording the failure reports.
+type failCollector struct {
+	collector
+	fails chan *pastry.ForwardError
+}
+
+func (c *failCollector) HandleFailure(msg *proto.Message, err *pastry.ForwardError) {
+	c.fails <- err
+}
+
+// Tests that the topic root refuses holding back publishes beyond the delay limit.
+func TestDelayLimit(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	coll := &failCollector{fails: make(chan *pastry.ForwardError, 1)}
+	node := New(overId, key, coll)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot scribe node: %v.", err)
+	}
+	defer node.Shutdown()
+
+	if err := node.Subscribe(topicId); err != nil {
+		t.Fatalf("failed to subscribe to topic: %v.", err)
+	}
+	// Send a delayed publish past the limit and verify the rejection
+	due := time.Now().Add(2 * config.IrisDelayLimit)
+	if err := node.Delay(topicId, due, &proto.Message{Data: []byte{0x00}}); err != nil {
+		t.Fatalf("failed to send delayed publish: %v.", err)
+	}
+	select {
+	case err := <-coll.fails:
+		if err.Reason != pastry.ErrUndeliverable {
+			t.Fatalf("failure reason mismatch: have %v, want %v.", err.Reason, pastry.ErrUndeliverable)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("delay limit failure not reported.")
+	}
+	node.lock.RLock()
+	defer node.lock.RUnlock()
+	if len(node.delays) != 0 {
+		t.Fatalf("delayed publish held back: %d pending.", len(node.delays))
+	}
+}
@@ -24,8 +24,11 @@ package scribe
 import (
 	"encoding/gob"
 	"math/big"
+	"time"
 
+	"github.com/karalabe/iris/config"
 	"github.com/karalabe/iris/proto"
+	"github.com/karalabe/iris/proto/pastry"
 )
 
 // Scribe operation code type.
@@ -39,6 +42,11 @@ const (
 	opBalance                   // Topic balance
 	opReport                    // Load report
 	opDirect                    // Direct send
+	opCredit                    // Pull mode credit grant
+	opBatch                     // Coalesced event batch
+	opFailure                   // Forwarding failure report
+	opSequence                  // Ordered publish heading to the topic root
+	opDelay                     // Delayed publish held at the topic root until due
 )
 
 // Extra headers for the scribe.
@@ -52,6 +60,17 @@ type header struct {
 	Topic  *big.Int // Topic id used during unsubscribing, broadcasting and balancing
 	Prev   *big.Int // Previous hop inside topic to prevent optimize routes
 	Report *report  // CPU load/capacity report
+	Credit int      // Event allowance of a pull mode subtree (-1 = push mode)
+	Urgent bool     // Balance to the least loaded member instead of by strategy
+	Key    string   // Affinity key pinning a balanced message to a member
+
+	Batch []*proto.Message     // Coalesced events forwarded to the same child
+	Fail  *pastry.ForwardError // Forwarding failure of a relayed message
+
+	Seq  uint64   // Sequence number of an ordered publish, stamped by the topic root
+	Root *big.Int // Topic root that stamped the sequence number
+
+	Due time.Time // Time to distribute a delayed publish at
 }
 
 // Creates a copy of the header needed by the broadcast.
@@ -78,7 +97,7 @@ func (o *Overlay) sendPacket(dest *big.Int, head *header) {
 			Meta: head,
 		},
 	}
-	o.pastry.Send(dest, msg)
+	o.host.Send(dest, msg)
 }
 
 // Envelopes a scribe header into an existing packet container and sends it to
@@ -90,14 +109,14 @@ func (o *Overlay) sendDataPacket(dest *big.Int, head *header, msg *proto.Message
 
 	// Insert the new header and fire away
 	msg.Head.Meta = head
-	o.pastry.Send(dest, msg)
+	o.host.Send(dest, msg)
 }
 
 // Forwards a scribe message to a new destination, leaving the original message
 // intact, except inserting the local node as the previous hop.
 func (o *Overlay) fwdDataPacket(dest *big.Int, msg *proto.Message) {
 	msg.Head.Meta.(*header).Prev = o.pastry.Self()
-	o.pastry.Send(dest, msg)
+	o.host.Send(dest, msg)
 }
 
 // Assembles a subscription message, consisting of the subscribe opcode and send
@@ -119,17 +138,41 @@ func (o *Overlay) sendPublish(topicId *big.Int, msg *proto.Message) {
 	o.sendDataPacket(topicId, &header{Op: opPublish, Topic: topicId}, msg)
 }
 
+// Assembles an ordered publish message, consisting of the sequence opcode and the
+// destination topic. The message is not caught in flight, but sequenced by the
+// topic root before being distributed.
+func (o *Overlay) sendSequence(topicId *big.Int, msg *proto.Message) {
+	o.sendDataPacket(topicId, &header{Op: opSequence, Topic: topicId}, msg)
+}
+
+// Assembles a delayed publish message, consisting of the delay opcode, the
+// destination topic and the due time. The message is not caught in flight, but
+// held back by the topic root until due.
+func (o *Overlay) sendDelay(topicId *big.Int, due time.Time, msg *proto.Message) {
+	o.sendDataPacket(topicId, &header{Op: opDelay, Topic: topicId, Due: due}, msg)
+}
+
 // Reroutes a publish message to a new destination to traverse the topic tree
-// directly instead of going up till he root and back down.
+// directly instead of going up till he root and back down. If batching is
+// enabled, small events are coalesced with others heading the same way.
 func (o *Overlay) fwdPublish(dest *big.Int, msg *proto.Message) {
+	if config.ScribeBatchDelay > 0 {
+		if len(msg.Data) <= config.ScribeBatchEvent {
+			msg.Head.Meta.(*header).Prev = o.pastry.Self()
+			o.queueBatch(dest, msg)
+			return
+		}
+		// Large event, flush any pending ones to retain ordering
+		o.flushBatch(dest)
+	}
 	o.fwdDataPacket(dest, msg)
 }
 
 // Assembles a topic balance message, consisting of the balance opcode, the
-// originating application (to allow replies) and the destination topic (to
-// allow catching balances midway).
-func (o *Overlay) sendBalance(topicId *big.Int, msg *proto.Message) {
-	o.sendDataPacket(topicId, &header{Op: opBalance, Topic: topicId}, msg)
+// originating application (to allow replies), the destination topic (to allow
+// catching balances midway), the urgency flag and the affinity key.
+func (o *Overlay) sendBalance(topicId *big.Int, msg *proto.Message, urgent bool, key string) {
+	o.sendDataPacket(topicId, &header{Op: opBalance, Topic: topicId, Urgent: urgent, Key: key}, msg)
 }
 
 // Reroutes a balanced message to a new destination to traverse the topic tree
@@ -143,6 +186,25 @@ func (o *Overlay) sendReport(nodeId *big.Int, rep *report) {
 	o.sendPacket(nodeId, &header{Op: opReport, Report: rep})
 }
 
+// Assembles a credit grant message, consisting of the credit opcode, the topic
+// and the event allowance of the local subtree, sending it to the topic parent.
+func (o *Overlay) sendCredit(parentId *big.Int, topicId *big.Int, credit int) {
+	o.sendPacket(parentId, &header{Op: opCredit, Topic: topicId, Credit: credit})
+}
+
+// Assembles a batch message, consisting of the batch opcode and the coalesced
+// events, sending it to the child node they were all destined to.
+func (o *Overlay) sendBatch(dest *big.Int, msgs []*proto.Message) {
+	o.sendPacket(dest, &header{Op: opBatch, Batch: msgs})
+}
+
+// Assembles a failure report, consisting of the failure opcode, the upper layer
+// headers of the lost message and the failure details, sending it to the node
+// that originally issued the message.
+func (o *Overlay) sendFailure(dest *big.Int, meta interface{}, fail *pastry.ForwardError) {
+	o.sendPacket(dest, &header{Op: opFailure, Meta: meta, Fail: fail})
+}
+
 // Sends out a message directed to a specific node.
 func (o *Overlay) sendDirect(dest *big.Int, msg *proto.Message) {
 	o.sendDataPacket(dest, &header{Op: opDirect}, msg)
@@ -44,6 +44,7 @@ type Topic struct {
 	parent  *big.Int            // Parent node in the topic tree
 	nodes   []*big.Int          // Remote children in the topic tree (+local if subbed)
 	members map[string]struct{} // Membership set to allow fast lookups
+	credits map[string]int      // Remaining event allowance of pull mode members
 
 	load *balancer.Balancer // Balancer to load-distribute messages
 	msgs int32              // Number of messages balanced to locals (atomic, take care)
@@ -59,6 +60,7 @@ func New(id, owner *big.Int) *Topic {
 		owner:   owner,
 		nodes:   []*big.Int{},
 		members: make(map[string]struct{}),
+		credits: make(map[string]int),
 		load:    balancer.New(),
 	}
 }
@@ -146,6 +148,7 @@ func (t *Topic) Unsubscribe(id *big.Int) error {
 	t.nodes = t.nodes[:last]
 	sortext.BigInts(t.nodes)
 	delete(t.members, id.String())
+	delete(t.credits, id.String())
 
 	// log.Printf("%v:%v: remed, state: %v.", t.owner, t.id, t.nodes)
 
@@ -164,14 +167,24 @@ func (t *Topic) Neighbor(id *big.Int) bool {
 }
 
 // Returns the list of nodes that a broadcast message should be sent to. An
-// optional ex node can be specified to exclude it from the list.
+// optional ex node can be specified to exclude it from the list. Pull mode
+// members are included only while they have credits left, consuming one.
 func (t *Topic) Broadcast(ex *big.Int) []*big.Int {
-	t.lock.RLock()
-	defer t.lock.RUnlock()
+	t.lock.Lock()
+	defer t.lock.Unlock()
 
-	// Gather all the nodes to broadcast to
-	nodes := make([]*big.Int, len(t.nodes), len(t.nodes)+1)
-	copy(nodes, t.nodes)
+	// Gather all the nodes to broadcast to, skipping exhausted pull members
+	nodes := make([]*big.Int, 0, len(t.nodes)+1)
+	for _, id := range t.nodes {
+		sid := id.String()
+		if credits, pull := t.credits[sid]; pull && (ex == nil || ex.Cmp(id) != 0) {
+			if credits == 0 {
+				continue
+			}
+			t.credits[sid] = credits - 1
+		}
+		nodes = append(nodes, id)
+	}
 	if t.parent != nil {
 		nodes = append(nodes, t.parent)
 	}
@@ -191,15 +204,77 @@ func (t *Topic) Broadcast(ex *big.Int) []*big.Int {
 	return nodes
 }
 
+// Sets the remaining event allowance of a member, switching it to pull mode. A
+// negative allowance reverts the member to push mode (unlimited events).
+func (t *Topic) Credit(id *big.Int, credits int) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// Ensure only children (or the local node) are credited
+	idx := sortext.SearchBigInts(t.nodes, id)
+	if idx == len(t.nodes) || id.Cmp(t.nodes[idx]) != 0 {
+		return ErrNotSubscribed
+	}
+	if credits < 0 {
+		delete(t.credits, id.String())
+	} else {
+		t.credits[id.String()] = credits
+	}
+	return nil
+}
+
+// Returns the number of events the local subtree is willing to accept from its
+// parent: the maximum allowance of all members if every one of them is in pull
+// mode, or -1 if at least one member is in push mode.
+func (t *Topic) Demand() int {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	demand := 0
+	for _, id := range t.nodes {
+		credits, pull := t.credits[id.String()]
+		if !pull {
+			return -1
+		}
+		if credits > demand {
+			demand = credits
+		}
+	}
+	return demand
+}
+
+// Sets the strategy the balancer picks the message targets with.
+func (t *Topic) SetStrategy(strategy balancer.Strategy) {
+	t.load.SetStrategy(strategy, t.owner)
+}
+
 // Returns a node id to which the balancer deemed the next message should be
 // sent. An optional ex node can be specified to prevent balancing there (if
-// others exist).
-func (t *Topic) Balance(ex *big.Int) (*big.Int, error) {
+// others exist). Urgent messages are balanced to the least loaded node.
+func (t *Topic) Balance(ex *big.Int, urgent bool) (*big.Int, error) {
+	if urgent {
+		return t.balance(ex, t.load.BalanceUrgent)
+	}
+	return t.balance(ex, t.load.Balance)
+}
+
+// Returns a node id to which the balancer deemed the next message with the given
+// affinity key should be sent, the same for the same key while the topic's tree
+// does not change. The ex node is as in Balance.
+func (t *Topic) BalanceKey(ex *big.Int, key string) (*big.Int, error) {
+	return t.balance(ex, func(ex *big.Int) (*big.Int, error) {
+		return t.load.BalanceKey(ex, key)
+	})
+}
+
+// Picks a balance target through the given balancer method, counting the ones
+// assigned to the local node.
+func (t *Topic) balance(ex *big.Int, pick func(ex *big.Int) (*big.Int, error)) (*big.Int, error) {
 	t.lock.RLock()
 	defer t.lock.RUnlock()
 
 	// Pick a balance target
-	id, err := t.load.Balance(ex)
+	id, err := pick(ex)
 	if err != nil {
 		return nil, err
 	}
@@ -86,7 +86,7 @@ func TestTopic(t *testing.T) {
 	// Check load balancing (without one entry)
 	ns = []*big.Int{}
 	for i := 0; i < 1000; i++ {
-		n, err := top.Balance(nodes[0])
+		n, err := top.Balance(nodes[0], false)
 		if err != nil {
 			t.Fatalf("failed to balance: %v.", err)
 		}
@@ -131,3 +131,53 @@ func TestTopic(t *testing.T) {
 		}
 	}
 }
+
+func TestCredits(t *testing.T) {
+	top := New(big.NewInt(314), big.NewInt(141))
+
+	push, pull := big.NewInt(1), big.NewInt(2)
+	top.Subscribe(push)
+	top.Subscribe(pull)
+
+	// Crediting a non-member should fail
+	if err := top.Credit(big.NewInt(3), 1); err != ErrNotSubscribed {
+		t.Fatalf("non-member credit error mismatch: have %v, want %v.", err, ErrNotSubscribed)
+	}
+	// Switch one member into pull mode and check the broadcast limits
+	if err := top.Credit(pull, 2); err != nil {
+		t.Fatalf("failed to credit member: %v.", err)
+	}
+	if demand := top.Demand(); demand != -1 {
+		t.Fatalf("mixed demand mismatch: have %v, want %v.", demand, -1)
+	}
+	for i, want := range []int{2, 2, 1, 1} {
+		if ns := top.Broadcast(nil); len(ns) != want {
+			t.Fatalf("broadcast %d: node count mismatch: have %v, want %v.", i, len(ns), want)
+		}
+	}
+	// Excluded pull members must not consume credits
+	top.Credit(pull, 1)
+	if ns := top.Broadcast(pull); len(ns) != 1 {
+		t.Fatalf("excluded broadcast node count mismatch: have %v, want %v.", len(ns), 1)
+	}
+	if ns := top.Broadcast(nil); len(ns) != 2 {
+		t.Fatalf("credited broadcast node count mismatch: have %v, want %v.", len(ns), 2)
+	}
+	// Check demand aggregation when everyone's pulling
+	top.Credit(push, 5)
+	top.Credit(pull, 3)
+	if demand := top.Demand(); demand != 5 {
+		t.Fatalf("pull demand mismatch: have %v, want %v.", demand, 5)
+	}
+	// Revert to push mode and ensure unlimited delivery
+	top.Credit(push, -1)
+	top.Unsubscribe(pull)
+	for i := 0; i < 10; i++ {
+		if ns := top.Broadcast(nil); len(ns) != 1 {
+			t.Fatalf("push broadcast %d: node count mismatch: have %v, want %v.", i, len(ns), 1)
+		}
+	}
+	if demand := top.Demand(); demand != -1 {
+		t.Fatalf("push demand mismatch: have %v, want %v.", demand, -1)
+	}
+}
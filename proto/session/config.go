@@ -0,0 +1,129 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the tunable parameters of the session handshake and the
+// structured errors reported when it fails.
+
+package session
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Failure reasons of a session handshake.
+var (
+	ErrTimeout  = errors.New("handshake timeout")
+	ErrAuth     = errors.New("authentication failure")
+	ErrProtocol = errors.New("protocol mismatch")
+	ErrNetwork  = errors.New("network failure")
+)
+
+// Error returned by a failed session handshake, classifying the cause.
+type HandshakeError struct {
+	Reason error // One of ErrTimeout, ErrAuth, ErrProtocol or ErrNetwork
+	Err    error // Underlying failure with the details
+}
+
+// Implements the error interface.
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Reason, e.Err)
+}
+
+// Returns whether the handshake failed due to a timeout.
+func (e *HandshakeError) Timeout() bool {
+	return e.Reason == ErrTimeout
+}
+
+// Returns whether the failure is transient and the handshake worth retrying.
+func (e *HandshakeError) Temporary() bool {
+	return e.Reason == ErrTimeout || e.Reason == ErrNetwork
+}
+
+// Creates a handshake error with an explicit reason.
+func shakeError(reason error, format string, args ...interface{}) error {
+	return &HandshakeError{
+		Reason: reason,
+		Err:    fmt.Errorf(format, args...),
+	}
+}
+
+// Wraps a stream failure into a handshake error, deciding whether the cause was
+// a timeout, a network failure or a garbled (i.e. protocol violating) message.
+func streamError(err error, format string, args ...interface{}) error {
+	reason := ErrProtocol
+	if nerr, ok := err.(net.Error); ok {
+		reason = ErrNetwork
+		if nerr.Timeout() {
+			reason = ErrTimeout
+		}
+	} else if err == io.EOF || err == io.ErrUnexpectedEOF {
+		reason = ErrNetwork
+	}
+	return &HandshakeError{
+		Reason: reason,
+		Err:    fmt.Errorf(format+": %v", append(args, err)...),
+	}
+}
+
+// Tunable parameters of the session handshake.
+type Config struct {
+	DialTimeout  time.Duration // Maximum allowed time to establish a stream connection
+	ShakeTimeout time.Duration // Maximum allowed time to complete the handshake
+	Retries      int           // Number of retries after a transient failure
+	Backoff      time.Duration // Initial delay between retries, doubled each time
+	MaxBackoff   time.Duration // Upper limit on the delay between retries
+
+	TicketLifetime time.Duration // Validity of issued resumption tickets (0 = disabled)
+	Tickets        *TicketCache  // Client side cache of received tickets (nil = disabled)
+
+	Overlay  string // Overlay the session belongs to, bound into the derived keys
+	Identity []byte // Local identity advertised and bound into the derived keys
+}
+
+// Creates a handshake configuration from the global defaults, with a private
+// resumption ticket cache.
+func DefaultConfig() *Config {
+	return &Config{
+		DialTimeout:    config.SessionDialTimeout,
+		ShakeTimeout:   config.SessionShakeTimeout,
+		Retries:        config.SessionShakeRetries,
+		Backoff:        config.SessionShakeBackoff,
+		MaxBackoff:     config.SessionShakeMaxBackoff,
+		TicketLifetime: config.SessionTicketLifetime,
+		Tickets:        NewTicketCache(),
+	}
+}
+
+// Calculates the delay to wait before the given retry attempt (zero based).
+func (c *Config) backoff(attempt int) time.Duration {
+	delay := c.Backoff
+	for i := 0; i < attempt && delay < c.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > c.MaxBackoff {
+		delay = c.MaxBackoff
+	}
+	return delay
+}
@@ -0,0 +1,47 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the session side enforcement of the FIPS crypto mode: both
+// peers announce whether they run restricted, and mismatching ones are refused
+// early with a proper reason instead of failing obscurely on the link MACs.
+
+package session
+
+import (
+	"crypto/rsa"
+	"fmt"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Verifies that the remote peer runs the same crypto mode as the local one.
+func checkSuite(fips bool) error {
+	if fips != config.FipsMode {
+		return shakeError(ErrProtocol, "crypto mode mismatch: local fips %v, remote fips %v", config.FipsMode, fips)
+	}
+	return nil
+}
+
+// Verifies that an authentication key is strong enough for the crypto mode.
+func checkKey(key *rsa.PrivateKey) error {
+	if config.FipsMode && key.N.BitLen() < config.FipsRsaBits {
+		return fmt.Errorf("rsa key too weak for fips mode: have %d bits, want %d", key.N.BitLen(), config.FipsRsaBits)
+	}
+	return nil
+}
@@ -20,6 +20,7 @@
 package session
 
 import (
+	"crypto/cipher"
 	"crypto/rand"
 	"crypto/rsa"
 	"encoding/gob"
@@ -32,6 +33,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/karalabe/iris/audit"
 	"github.com/karalabe/iris/config"
 	"github.com/karalabe/iris/crypto/sts"
 	"github.com/karalabe/iris/proto"
@@ -39,10 +41,18 @@ import (
 )
 
 // Session handshake request multiplexer to choose between the authenticated
-// control channel handshake or the secondary data channel handshake.
+// control channel handshake, the abbreviated ticket based resumption or the
+// secondary data channel handshake.
 type initRequest struct {
-	Auth *authRequest
-	Link *linkRequest
+	Auth   *authRequest
+	Resume *resumeRequest
+	Link   *linkRequest
+
+	Version int    // Highest handshake version supported by the client
+	Kdf     int    // Highest key derivation version supported by the client
+	Id      []byte // Identity of the client to bind the session keys to
+	Fips    bool   // Whether the client runs in FIPS crypto mode
+	Suite   string // Cipher suite preferred by the client
 }
 
 // Authenticated connection request message. Contains the originators ID for
@@ -52,10 +62,17 @@ type authRequest struct {
 }
 
 // Authentication challenge message. Contains the server exponential and the
-// server side auth token (both verification and challenge at the same time).
+// server side auth token (both verification and challenge at the same time),
+// along with the chosen handshake and key derivation versions, cipher suite,
+// the server identity and mode.
 type authChallenge struct {
-	Exp   *big.Int
-	Token []byte
+	Exp     *big.Int
+	Token   []byte
+	Version int
+	Kdf     int
+	Id      []byte
+	Fips    bool
+	Suite   string
 }
 
 // Authentication challenge response message. Contains the client side token.
@@ -64,8 +81,11 @@ type authResponse struct {
 }
 
 // Data channel linking request message. Used both to init, reply and verify.
+// The init message also carries the resumption ticket for future reconnects.
 type linkRequest struct {
-	Id int64
+	Id     int64
+	Ticket []byte
+	Expiry time.Time
 }
 
 // Make sure the link request packet is registered with gob.
@@ -81,15 +101,31 @@ type Listener struct {
 	pendLock sync.RWMutex                  // Lock to protect the pending map
 	pendWait sync.WaitGroup                // Counter to prevent closing the session sink prematurely
 
-	socket *stream.Listener // Stream listener socket to accept connections on
-	key    *rsa.PrivateKey  // Private RSA key to authenticate with
-	quit   chan chan error  // Termination synchronization channel
+	socket  *stream.Listener // Stream listener socket to accept connections on
+	key     *rsa.PrivateKey  // Private RSA key to authenticate with
+	sealer  cipher.AEAD      // Authenticated cipher sealing the resumption tickets
+	keyLock sync.RWMutex     // Lock to protect the keys during rotation
+	conf    *Config          // Handshake parameters to enforce on inbound sessions
+	quit    chan chan error  // Termination synchronization channel
 }
 
 // Starts a TCP listener to accept incoming sessions, returning the socket ready
 // to accept. If an auto-port (0) is requested, the port is updated in the arg.
 func Listen(addr *net.TCPAddr, key *rsa.PrivateKey) (*Listener, error) {
+	return ListenConfig(addr, key, DefaultConfig())
+}
+
+// Starts a TCP listener to accept incoming sessions, using the given handshake
+// parameters instead of the global defaults.
+func ListenConfig(addr *net.TCPAddr, key *rsa.PrivateKey, conf *Config) (*Listener, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
 	// Open the stream listener socket
+	sealer, err := newSealer()
+	if err != nil {
+		return nil, err
+	}
 	sock, err := stream.Listen(addr)
 	if err != nil {
 		return nil, err
@@ -100,6 +136,8 @@ func Listen(addr *net.TCPAddr, key *rsa.PrivateKey) (*Listener, error) {
 		pends:  make(map[int64]chan *stream.Stream),
 		socket: sock,
 		key:    key,
+		sealer: sealer,
+		conf:   conf,
 		quit:   make(chan chan error),
 	}, nil
 }
@@ -160,48 +198,70 @@ func (l *Listener) serverHandle(strm *stream.Stream, timeout time.Duration) {
 	defer l.pendWait.Done()
 
 	// Set an overall time limit for the handshake to complete
-	strm.Sock().SetDeadline(time.Now().Add(config.SessionShakeTimeout))
+	strm.Sock().SetDeadline(time.Now().Add(l.conf.ShakeTimeout))
 	defer strm.Sock().SetDeadline(time.Time{})
 
 	// Fetch the session request and multiplex on the contents
 	req := new(initRequest)
 	if err := strm.Recv(req); err != nil {
-		log.Printf("session: failed to retrieve initiation request: %v", err)
+		log.Printf("session: failed to retrieve initiation request: %v.", streamError(err, "failed to decode init request"))
 		if err = strm.Close(); err != nil {
 			log.Printf("session: failed to close uninitialized stream: %v.", err)
 		}
 		return
 	}
+	// Verify the crypto mode and pick the handshake and key derivation versions and
+	// the cipher suite for control channels
+	agreed := &offer{Kdf: kdfLegacy, Id: l.conf.Identity, Fips: config.FipsMode, Suite: pickSuite(req.Suite)}
+	if req.Link == nil {
+		err := checkSuite(req.Fips)
+		if err == nil {
+			agreed.Version, err = negotiateVersion(req.Version)
+		}
+		if err == nil {
+			agreed.Kdf, err = negotiateKdf(req.Kdf)
+		}
+		if err != nil {
+			log.Printf("session: failed to negotiate session parameters: %v.", err)
+			report(audit.HandshakeFailure, strm, req.Id, err)
+			if err = strm.Close(); err != nil {
+				log.Printf("session: failed to close unnegotiated stream: %v.", err)
+			}
+			return
+		}
+	}
+	info := kdfInfo(agreed.Kdf, l.conf.Overlay, req.Id, l.conf.Identity)
+	info = bindTranscript(info, agreed.Version, req.offer(), agreed)
+
 	switch {
 	case req.Auth != nil:
 		// Authenticate and clean up if unsuccessful
-		secret, err := l.serverAuth(strm, req.Auth)
+		secret, err := l.serverAuth(strm, req.Auth, agreed)
 		if err != nil {
 			log.Printf("session: failed to authenticate remote stream: %v.", err)
+			report(audit.HandshakeFailure, strm, req.Id, err)
 			if err = strm.Close(); err != nil {
 				log.Printf("session: failed to close unauthenticated stream: %v.", err)
 			}
 			return
 		}
-		// Create the session and link a data channel to it
-		sess := newSession(strm, secret, true)
-		if err = l.serverLink(sess); err != nil {
-			log.Printf("session: failed to retrieve data link: %v.", err)
+		sess := newSession(strm, secret, info, agreed, true)
+		l.serverSetup(strm, sess, req.Id, secret, time.Now().Add(l.conf.TicketLifetime), timeout)
+
+	case req.Resume != nil:
+		// Resume the previous session and clean up if unsuccessful
+		secret, master, expiry, err := l.serverResume(strm, req.Resume, agreed)
+		if err != nil {
+			log.Printf("session: failed to resume remote session: %v.", err)
+			report(audit.HandshakeFailure, strm, req.Id, err)
 			if err = strm.Close(); err != nil {
-				log.Printf("session: failed to close unlinked stream: %v.", err)
+				log.Printf("session: failed to close unresumed stream: %v.", err)
 			}
 			return
 		}
-		// Session setup complete, send upstream
-		select {
-		case l.Sink <- sess:
-			// Ok
-		case <-time.After(timeout):
-			log.Printf("session: established session not handled in %v, dropping.", timeout)
-			if err = sess.Close(); err != nil {
-				log.Printf("session: failed to close established session: %v.", err)
-			}
-		}
+		sess := newSession(strm, secret, info, agreed, true)
+		l.serverSetup(strm, sess, req.Id, master, expiry, timeout)
+
 	case req.Link != nil:
 		// Extract the temporary session id and link this stream to it
 		l.pendLock.Lock()
@@ -218,115 +278,241 @@ func (l *Listener) serverHandle(strm *stream.Stream, timeout time.Duration) {
 					log.Printf("session: failed to close established data stream: %v.", err)
 				}
 			}
+		} else {
+			// Control link already timed out, drop the data stream too
+			log.Printf("session: data stream of unknown session, dropping.")
+			if err := strm.Close(); err != nil {
+				log.Printf("session: failed to close orphaned data stream: %v.", err)
+			}
+		}
+	}
+}
+
+// Links a data channel to a freshly authenticated session and sends it upstream.
+// The master secret and expiry are sealed into the ticket handed out for later
+// resumption.
+func (l *Listener) serverSetup(strm *stream.Stream, sess *Session, peer []byte, master []byte, expiry time.Time, timeout time.Duration) {
+	if err := l.serverLink(sess, master, expiry); err != nil {
+		log.Printf("session: failed to retrieve data link: %v.", err)
+		report(audit.HandshakeFailure, strm, peer, err)
+		if err = strm.Close(); err != nil {
+			log.Printf("session: failed to close unlinked stream: %v.", err)
+		}
+		return
+	}
+	// Session setup complete, send upstream
+	report(audit.HandshakeSuccess, strm, peer, nil)
+	select {
+	case l.Sink <- sess:
+		// Ok
+	case <-time.After(timeout):
+		log.Printf("session: established session not handled in %v, dropping.", timeout)
+		if err := sess.Close(); err != nil {
+			log.Printf("session: failed to close established session: %v.", err)
 		}
 	}
 }
 
 // Connects to a remote node and negotiates a session.
 func Dial(host string, port int, key *rsa.PrivateKey) (*Session, error) {
-	// Open the stream connection
+	return DialConfig(host, port, key, DefaultConfig())
+}
+
+// Connects to a remote node and negotiates a session using the given handshake
+// parameters. Transient failures (timeouts and network errors) are retried with
+// an exponential backoff, whereas authentication and protocol failures abort.
+func DialConfig(host string, port int, key *rsa.PrivateKey, conf *Config) (*Session, error) {
+	if err := checkKey(key); err != nil {
+		return nil, shakeError(ErrAuth, "%v", err)
+	}
+	for attempt := 0; ; attempt++ {
+		sess, err := dial(host, port, key, conf)
+		if err == nil {
+			return sess, nil
+		}
+		if herr, ok := err.(*HandshakeError); !ok || !herr.Temporary() || attempt >= conf.Retries {
+			return nil, err
+		}
+		time.Sleep(conf.backoff(attempt))
+	}
+}
+
+// Executes a single session negotiation attempt with a remote node. If a valid
+// resumption ticket is cached, the abbreviated handshake is tried first, falling
+// back to the full one if the remote side rejects it.
+func dial(host string, port int, key *rsa.PrivateKey, conf *Config) (*Session, error) {
 	addr := fmt.Sprintf("%s:%d", host, port)
-	strm, err := stream.Dial(addr, config.SessionDialTimeout)
+	if conf.Tickets != nil {
+		if t := conf.Tickets.get(addr, &key.PublicKey); t != nil {
+			if sess, err := resume(addr, key, t, conf); err == nil {
+				return sess, nil
+			}
+			conf.Tickets.drop(addr, &key.PublicKey)
+		}
+	}
+	// Open the stream connection
+	strm, err := stream.Dial(addr, conf.DialTimeout)
 	if err != nil {
-		return nil, err
+		return nil, streamError(err, "failed to connect")
 	}
 	// Set up the authenticated session
-	secret, err := clientAuth(strm, key)
+	secret, info, agreed, err := clientAuth(strm, key, conf)
 	if err != nil {
-		log.Printf("session: failed to authenticate connection: %v.", err)
+		report(audit.HandshakeFailure, strm, nil, err)
 		if err := strm.Close(); err != nil {
 			log.Printf("session: failed to close unauthenticated connection: %v.", err)
 		}
+		return nil, err
+	}
+	return clientSetup(strm, newSession(strm, secret, info, agreed, false), agreed.Id, addr, key, secret, conf)
+}
+
+// Executes an abbreviated session negotiation based on a resumption ticket.
+func resume(addr string, key *rsa.PrivateKey, t *ticket, conf *Config) (*Session, error) {
+	// Open the stream connection
+	strm, err := stream.Dial(addr, conf.DialTimeout)
+	if err != nil {
+		return nil, streamError(err, "failed to connect")
+	}
+	// Resume the previous session
+	secret, info, agreed, err := clientResume(strm, t, conf)
+	if err != nil {
+		report(audit.HandshakeFailure, strm, nil, err)
+		if err := strm.Close(); err != nil {
+			log.Printf("session: failed to close unresumed connection: %v.", err)
+		}
+		return nil, err
 	}
-	// Link a new data connection to it
-	sess := newSession(strm, secret, false)
-	if err = clientLink(sess); err != nil {
-		log.Printf("session: failed to link data connection: %v.", err)
+	return clientSetup(strm, newSession(strm, secret, info, agreed, false), agreed.Id, addr, key, t.secret, conf)
+}
+
+// Links a new data stream to a freshly authenticated session, caching the
+// resumption ticket received for the master secret.
+func clientSetup(strm *stream.Stream, sess *Session, peer []byte, addr string, key *rsa.PrivateKey, master []byte, conf *Config) (*Session, error) {
+	link, err := clientLink(sess, conf)
+	if err != nil {
+		report(audit.HandshakeFailure, strm, peer, err)
 		if err := strm.Close(); err != nil {
 			log.Printf("session: failed to close unlinked connection: %v.", err)
 		}
 		return nil, err
 	}
+	if conf.Tickets != nil && link.Ticket != nil {
+		conf.Tickets.put(addr, &key.PublicKey, &ticket{
+			data:   link.Ticket,
+			secret: master,
+			expiry: link.Expiry,
+		})
+	}
+	report(audit.HandshakeSuccess, strm, peer, nil)
 	return sess, nil
 }
 
 // Client side of the STS session negotiation.
-func clientAuth(strm *stream.Stream, key *rsa.PrivateKey) ([]byte, error) {
+// Returns the agreed secret along with the key derivation info and the session
+// parameters chosen by the server.
+func clientAuth(strm *stream.Stream, key *rsa.PrivateKey, conf *Config) ([]byte, []byte, *offer, error) {
 	// Set an overall time limit for the handshake to complete
-	strm.Sock().SetDeadline(time.Now().Add(config.SessionShakeTimeout))
+	strm.Sock().SetDeadline(time.Now().Add(conf.ShakeTimeout))
 	defer strm.Sock().SetDeadline(time.Time{})
 
 	// Create a new empty session
 	stsSess, err := sts.New(rand.Reader, config.StsGroup, config.StsGenerator, config.StsCipher, config.StsCipherBits, config.StsSigHash)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create new session: %v", err)
+		return nil, nil, nil, shakeError(ErrAuth, "failed to create new session: %v", err)
 	}
 	// Initiate a key exchange, send the exponential
 	exp, err := stsSess.Initiate()
 	if err != nil {
-		return nil, fmt.Errorf("failed to initiate key exchange: %v", err)
+		return nil, nil, nil, shakeError(ErrAuth, "failed to initiate key exchange: %v", err)
 	}
 	req := &initRequest{
-		Auth: &authRequest{exp},
+		Auth:    &authRequest{exp},
+		Version: shakeVersion,
+		Kdf:     kdfBound,
+		Id:      conf.Identity,
+		Fips:    config.FipsMode,
+		Suite:   config.Suite(),
 	}
 	if err = strm.Send(req); err != nil {
-		return nil, fmt.Errorf("failed to send auth request: %v", err)
+		return nil, nil, nil, streamError(err, "failed to send auth request")
 	}
 	if err = strm.Flush(); err != nil {
-		return nil, fmt.Errorf("failed to flush auth request: %v", err)
+		return nil, nil, nil, streamError(err, "failed to flush auth request")
 	}
 	// Receive the foreign exponential and auth token and if verifies, send own auth
 	chall := new(authChallenge)
 	if err = strm.Recv(chall); err != nil {
-		return nil, fmt.Errorf("failed to receive auth challenge: %v", err)
+		return nil, nil, nil, streamError(err, "failed to receive auth challenge")
+	}
+	remote := &offer{Version: chall.Version, Kdf: chall.Kdf, Id: chall.Id, Fips: chall.Fips, Suite: chall.Suite}
+	agreed, err := acceptOffer(remote)
+	if err != nil {
+		return nil, nil, nil, err
 	}
 	token, err := stsSess.Verify(rand.Reader, key, &key.PublicKey, chall.Exp, chall.Token)
 	if err != nil {
-		return nil, fmt.Errorf("failed to verify acceptor auth token: %v", err)
+		return nil, nil, nil, shakeError(ErrAuth, "failed to verify acceptor auth token: %v", err)
 	}
 	if err = strm.Send(authResponse{token}); err != nil {
-		return nil, fmt.Errorf("failed to send auth response: %v", err)
+		return nil, nil, nil, streamError(err, "failed to send auth response")
 	}
 	if err = strm.Flush(); err != nil {
-		return nil, fmt.Errorf("failed to flush auth response: %v", err)
+		return nil, nil, nil, streamError(err, "failed to flush auth response")
 	}
-	return stsSess.Secret()
+	secret, err := stsSess.Secret()
+	if err != nil {
+		return nil, nil, nil, shakeError(ErrAuth, "failed to retrieve session secret: %v", err)
+	}
+	info := kdfInfo(agreed.Kdf, conf.Overlay, conf.Identity, chall.Id)
+	return secret, bindTranscript(info, agreed.Version, req.offer(), remote), agreed, nil
 }
 
 // Executes the server side authentication and returns either the agreed secret
-// session key or the a failure reason.
-func (l *Listener) serverAuth(strm *stream.Stream, req *authRequest) ([]byte, error) {
+// session key or the a failure reason. The agreed session parameters and the
+// local identity are sent along with the challenge.
+func (l *Listener) serverAuth(strm *stream.Stream, req *authRequest, agreed *offer) ([]byte, error) {
 	// Create a new STS session
 	stsSess, err := sts.New(rand.Reader, config.StsGroup, config.StsGenerator,
 		config.StsCipher, config.StsCipherBits, config.StsSigHash)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create STS session: %v", err)
+		return nil, shakeError(ErrAuth, "failed to create STS session: %v", err)
 	}
 	// Accept the incoming key exchange request and send back own exp + auth token
-	exp, token, err := stsSess.Accept(rand.Reader, l.key, req.Exp)
+	key := l.authKey()
+	exp, token, err := stsSess.Accept(rand.Reader, key, req.Exp)
 	if err != nil {
-		return nil, fmt.Errorf("failed to accept incoming exchange: %v", err)
+		return nil, shakeError(ErrAuth, "failed to accept incoming exchange: %v", err)
+	}
+	chall := authChallenge{
+		Exp:     exp,
+		Token:   token,
+		Version: agreed.Version,
+		Kdf:     agreed.Kdf,
+		Id:      agreed.Id,
+		Fips:    agreed.Fips,
+		Suite:   agreed.Suite,
 	}
-	if err = strm.Send(authChallenge{exp, token}); err != nil {
-		return nil, fmt.Errorf("failed to encode auth challenge: %v", err)
+	if err = strm.Send(chall); err != nil {
+		return nil, streamError(err, "failed to encode auth challenge")
 	}
 	if err = strm.Flush(); err != nil {
-		return nil, fmt.Errorf("failed to flush auth challenge: %v", err)
+		return nil, streamError(err, "failed to flush auth challenge")
 	}
 	// Receive the foreign auth token and if verifies conclude session
 	resp := new(authResponse)
 	if err = strm.Recv(resp); err != nil {
-		return nil, fmt.Errorf("failed to decode auth response: %v", err)
+		return nil, streamError(err, "failed to decode auth response")
 	}
-	if err = stsSess.Finalize(&l.key.PublicKey, resp.Token); err != nil {
-		return nil, fmt.Errorf("failed to finalize exchange: %v", err)
+	if err = stsSess.Finalize(&key.PublicKey, resp.Token); err != nil {
+		return nil, shakeError(ErrAuth, "failed to finalize exchange: %v", err)
 	}
 	return stsSess.Secret()
 }
 
 // Initializes a data channel linking process, waiting for the data stream to be
-// assigned.
-func (l *Listener) serverLink(sess *Session) error {
+// assigned. A resumption ticket sealing the master secret is handed out too.
+func (l *Listener) serverLink(sess *Session, master []byte, expiry time.Time) error {
 	var err error
 
 	// Create the a temporary channel to retrieve the data stream
@@ -342,65 +528,74 @@ func (l *Listener) serverLink(sess *Session) error {
 		l.pendLock.Unlock()
 	}()
 	// Send over the temporary session id to the client for data link setup
+	req := &linkRequest{Id: id}
+	if req.Ticket = l.issue(master, expiry); req.Ticket != nil {
+		req.Expiry = expiry
+	}
 	msg := &proto.Message{
 		Head: proto.Header{
-			Meta: &linkRequest{id},
+			Meta: req,
 		},
 	}
 	if err = sess.CtrlLink.SendDirect(msg); err != nil {
-		return fmt.Errorf("failed to send session id: %v", err)
+		return streamError(err, "failed to send session id")
 	}
 	// Wait for the data link or time out
 	select {
 	case strm := <-data:
 		sess.init(strm, true)
 	case <-time.After(config.SessionLinkTimeout):
-		return errors.New("link timeout")
+		return shakeError(ErrTimeout, "data link not established in %v", config.SessionLinkTimeout)
 	}
 	// Send the data link authentication
 	auth := &proto.Message{
 		Head: proto.Header{
-			Meta: &linkRequest{id},
+			Meta: &linkRequest{Id: id},
 		},
 	}
 	// Retrieve the remote data link authentication
 	if err = sess.DataLink.SendDirect(auth); err != nil {
-		return fmt.Errorf("failed to send data auth: %v", err)
+		return streamError(err, "failed to send data auth")
 	}
 	if msg, err := sess.DataLink.RecvDirect(); err != nil {
-		return fmt.Errorf("failed to retrieve data auth: %v", err)
+		return streamError(err, "failed to retrieve data auth")
 	} else if res, ok := msg.Head.Meta.(*linkRequest); !ok {
-		return errors.New("corrupt auth message")
+		return shakeError(ErrProtocol, "corrupt auth message")
 	} else if res.Id != id {
-		return errors.New("mismatched auth message")
+		return shakeError(ErrProtocol, "mismatched auth message")
 	}
 	return nil
 }
 
-// Initiates a data channel link to the specified control channel.
-func clientLink(sess *Session) error {
+// Initiates a data channel link to the specified control channel, returning the
+// link initiation message of the server (containing any resumption ticket too).
+func clientLink(sess *Session, conf *Config) (*linkRequest, error) {
 	// Wait for the server to specify the session id
 	msg, err := sess.CtrlLink.RecvDirect()
 	if err != nil {
-		return fmt.Errorf("failed to retrieve session id: %v", err)
+		return nil, streamError(err, "failed to retrieve session id")
+	}
+	id, ok := msg.Head.Meta.(*linkRequest)
+	if !ok {
+		return nil, shakeError(ErrProtocol, "corrupt session id message")
 	}
 	// Initiate a new stream connection to the server
 	addr := sess.CtrlLink.Sock().RemoteAddr().String()
-	strm, err := stream.Dial(addr, config.SessionDialTimeout)
+	strm, err := stream.Dial(addr, conf.DialTimeout)
 	if err != nil {
-		return fmt.Errorf("failed to establish data link: %v", err)
+		return nil, streamError(err, "failed to establish data link")
 	}
 	// Send the temporary id back on the data stream
 	req := &initRequest{
-		Link: &linkRequest{msg.Head.Meta.(*linkRequest).Id},
+		Link: &linkRequest{Id: id.Id},
 	}
 	if err = strm.Send(req); err != nil {
 		strm.Close()
-		return fmt.Errorf("failed to send link request: %v", err)
+		return nil, streamError(err, "failed to send link request")
 	}
 	if err = strm.Flush(); err != nil {
 		strm.Close()
-		return fmt.Errorf("failed to flush link request: %v", err)
+		return nil, streamError(err, "failed to flush link request")
 	}
 	// Finalize the session with the data stream
 	sess.init(strm, false)
@@ -413,14 +608,30 @@ func clientLink(sess *Session) error {
 	}
 	// Retrieve the remote data link authentication
 	if err = sess.DataLink.SendDirect(auth); err != nil {
-		return fmt.Errorf("failed to send data auth: %v", err)
+		return nil, streamError(err, "failed to send data auth")
 	}
 	if msg, err := sess.DataLink.RecvDirect(); err != nil {
-		return fmt.Errorf("failed to retrieve data auth: %v", err)
+		return nil, streamError(err, "failed to retrieve data auth")
 	} else if res, ok := msg.Head.Meta.(*linkRequest); !ok {
-		return errors.New("corrupt authentication message")
+		return nil, shakeError(ErrProtocol, "corrupt authentication message")
 	} else if res.Id != req.Link.Id {
-		return errors.New("mismatched authentication message")
+		return nil, shakeError(ErrProtocol, "mismatched authentication message")
 	}
-	return nil
+	return id, nil
+}
+
+// Reports the outcome of a session handshake into the security audit trail.
+func report(kind string, strm *stream.Stream, peer []byte, err error) {
+	event := &audit.Event{
+		Kind:      kind,
+		Component: "session",
+		Remote:    strm.Sock().RemoteAddr().String(),
+	}
+	if len(peer) > 0 {
+		event.Peer = new(big.Int).SetBytes(peer).String()
+	}
+	if err != nil {
+		event.Detail = err.Error()
+	}
+	audit.Emit(event)
 }
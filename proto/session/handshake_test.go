@@ -20,11 +20,18 @@
 package session
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
+	"fmt"
 	"net"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/karalabe/iris/audit"
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto"
 )
 
 // Tests whether the session handshake works.
@@ -68,6 +75,435 @@ func TestHandshake(t *testing.T) {
 	}
 }
 
+// Tests that handshake failures are reported with the correct reason.
+func TestHandshakeErrors(t *testing.T) {
+	t.Parallel()
+
+	addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+	bad, _ := rsa.GenerateKey(rand.Reader, 1024)
+
+	conf := &Config{
+		DialTimeout:  100 * time.Millisecond,
+		ShakeTimeout: 100 * time.Millisecond,
+		Retries:      2,
+		Backoff:      10 * time.Millisecond,
+		MaxBackoff:   20 * time.Millisecond,
+	}
+	// Start a session listener and a silent stream sink
+	sock, err := Listen(addr, key)
+	if err != nil {
+		t.Fatalf("failed to start the session listener: %v.", err)
+	}
+	sock.Accept(10 * time.Millisecond)
+	defer sock.Close()
+
+	mute, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to start the mute listener: %v.", err)
+	}
+	defer mute.Close()
+	go func() {
+		for {
+			if _, err := mute.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+	// Reserve a port and close it to have a guaranteed refusal
+	dead, _ := net.Listen("tcp", "localhost:0")
+	deadPort := dead.Addr().(*net.TCPAddr).Port
+	dead.Close()
+
+	// Verify the individual failure reasons
+	tests := []struct {
+		port   int
+		key    *rsa.PrivateKey
+		reason error
+	}{
+		{addr.Port, bad, ErrAuth},
+		{mute.Addr().(*net.TCPAddr).Port, key, ErrTimeout},
+		{deadPort, key, ErrNetwork},
+	}
+	for i, tt := range tests {
+		start := time.Now()
+		_, err := DialConfig("localhost", tt.port, tt.key, conf)
+		herr, ok := err.(*HandshakeError)
+		if !ok {
+			t.Fatalf("test %d: unstructured handshake error: %v.", i, err)
+		}
+		if herr.Reason != tt.reason {
+			t.Fatalf("test %d: failure reason mismatch: have %v, want %v.", i, herr.Reason, tt.reason)
+		}
+		// Timeouts should be retried, auth failures not
+		elapsed := time.Since(start)
+		switch tt.reason {
+		case ErrAuth:
+			if elapsed > conf.ShakeTimeout {
+				t.Fatalf("test %d: authentication failure retried: %v.", i, elapsed)
+			}
+		case ErrTimeout:
+			if elapsed < time.Duration(conf.Retries+1)*conf.ShakeTimeout {
+				t.Fatalf("test %d: timeout not retried: %v.", i, elapsed)
+			}
+		}
+	}
+}
+
+// Tests that sessions are resumed with cached tickets, and that key rotation
+// invalidates them, falling back to the full handshake.
+func TestResumption(t *testing.T) {
+	t.Parallel()
+
+	addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+	conf := DefaultConfig()
+
+	// Start the server
+	sock, err := ListenConfig(addr, key, conf)
+	if err != nil {
+		t.Fatalf("failed to start the session listener: %v.", err)
+	}
+	sock.Accept(10 * time.Millisecond)
+	defer sock.Close()
+
+	// Connects to the server and returns the expiry of the cached ticket
+	connect := func() time.Time {
+		client, err := DialConfig("localhost", addr.Port, key, conf)
+		if err != nil {
+			t.Fatalf("failed to connect to the server: %v.", err)
+		}
+		select {
+		case server := <-sock.Sink:
+			// Make sure the resumed keys match by exchanging a message
+			if err := client.CtrlLink.SendDirect(&proto.Message{Head: proto.Header{Meta: &linkRequest{Id: 1}}}); err != nil {
+				t.Fatalf("failed to send test message: %v.", err)
+			}
+			if _, err := server.CtrlLink.RecvDirect(); err != nil {
+				t.Fatalf("failed to receive test message: %v.", err)
+			}
+			client.Close()
+			server.Close()
+		case <-time.After(100 * time.Millisecond):
+			t.Fatalf("server-side handshake timed out.")
+		}
+		tick := conf.Tickets.get(fmt.Sprintf("localhost:%d", addr.Port), &key.PublicKey)
+		if tick == nil {
+			t.Fatalf("no resumption ticket cached.")
+		}
+		return tick.expiry
+	}
+	// Full handshake, then resumption (keeping the original ticket lifetime)
+	first := connect()
+	time.Sleep(10 * time.Millisecond)
+	if resumed := connect(); !resumed.Equal(first) {
+		t.Fatalf("session not resumed: ticket expiry changed from %v to %v.", first, resumed)
+	}
+	// Rotate the keys and ensure the ticket is rejected
+	if err := sock.Rotate(key); err != nil {
+		t.Fatalf("failed to rotate listener keys: %v.", err)
+	}
+	if renewed := connect(); !renewed.After(first) {
+		t.Fatalf("ticket accepted after key rotation: expiry %v, original %v.", renewed, first)
+	}
+}
+
+// Tests that session keys are bound to the overlay, and that legacy derivations
+// are refused when disallowed.
+func TestKdfBinding(t *testing.T) {
+	t.Parallel()
+
+	addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+
+	server := DefaultConfig()
+	server.Overlay, server.Identity = "overlay", []byte("server")
+
+	sock, err := ListenConfig(addr, key, server)
+	if err != nil {
+		t.Fatalf("failed to start the session listener: %v.", err)
+	}
+	sock.Accept(10 * time.Millisecond)
+	defer sock.Close()
+
+	// Connect from both the same and a different overlay
+	for i, overlay := range []string{"overlay", "impostor"} {
+		client := DefaultConfig()
+		client.Overlay, client.Identity = overlay, []byte("client")
+		client.Retries = 0
+
+		sess, err := DialConfig("localhost", addr.Port, key, client)
+		if i == 0 {
+			if err != nil {
+				t.Fatalf("failed to connect from the same overlay: %v.", err)
+			}
+			peer := <-sock.Sink
+			if len(sess.Binding) != bindingSize || !bytes.Equal(sess.Binding, peer.Binding) {
+				t.Fatalf("channel binding mismatch: have %x, want %x.", sess.Binding, peer.Binding)
+			}
+			sess.Close()
+			peer.Close()
+		} else if err == nil {
+			sess.Close()
+			t.Fatalf("connected from a different overlay.")
+		}
+	}
+	// Verify the derivation version negotiation
+	if kdf, err := negotiateKdf(kdfBound); err != nil || kdf != kdfBound {
+		t.Fatalf("bound derivation negotiation mismatch: have %v/%v, want %v.", kdf, err, kdfBound)
+	}
+	if kdf, err := negotiateKdf(0); err != nil || kdf != kdfLegacy {
+		t.Fatalf("legacy derivation negotiation mismatch: have %v/%v, want %v.", kdf, err, kdfLegacy)
+	}
+	legacy := config.HkdfLegacy
+	config.HkdfLegacy = false
+	_, err = negotiateKdf(0)
+	config.HkdfLegacy = legacy
+	if err == nil {
+		t.Fatalf("disallowed legacy derivation accepted.")
+	}
+	if !bytes.Equal(kdfInfo(kdfLegacy, "overlay", nil, nil), config.HkdfInfo) {
+		t.Fatalf("legacy derivation info mismatch.")
+	}
+	if bytes.Equal(kdfInfo(kdfBound, "overlay", []byte("ab"), []byte("c")), kdfInfo(kdfBound, "overlay", []byte("a"), []byte("bc"))) {
+		t.Fatalf("ambiguous bound derivation info.")
+	}
+}
+
+// Tests that sessions can be negotiated in FIPS mode, but weak keys and peers of
+// a different mode are refused. Not parallel since it swaps the primitives.
+func TestFipsMode(t *testing.T) {
+	stsCipher, stsHash, hkdfHash := config.StsCipher, config.StsSigHash, config.HkdfHash
+	sesCipher, sesHash, pktCipher := config.SessionCipher, config.SessionHash, config.PacketCipher
+	defer func() {
+		config.StsCipher, config.StsSigHash, config.HkdfHash = stsCipher, stsHash, hkdfHash
+		config.SessionCipher, config.SessionHash, config.PacketCipher = sesCipher, sesHash, pktCipher
+		config.FipsMode = false
+	}()
+	config.EnableFips()
+
+	addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
+	weak, _ := rsa.GenerateKey(rand.Reader, 1024)
+	if _, err := Listen(addr, weak); err == nil {
+		t.Fatalf("weak key accepted in fips mode.")
+	}
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	sock, err := Listen(addr, key)
+	if err != nil {
+		t.Fatalf("failed to start the session listener: %v.", err)
+	}
+	sock.Accept(10 * time.Millisecond)
+	defer sock.Close()
+
+	client, err := Dial("localhost", addr.Port, key)
+	if err != nil {
+		t.Fatalf("failed to connect in fips mode: %v.", err)
+	}
+	client.Close()
+	(<-sock.Sink).Close()
+
+	if err := checkSuite(false); err == nil {
+		t.Fatalf("non-fips peer accepted in fips mode.")
+	}
+}
+
+// Tests the negotiation of the session cipher suite.
+func TestSuiteNegotiation(t *testing.T) {
+	suite := config.SessionSuite
+	defer func() { config.SessionSuite = suite }()
+
+	// Check the server side choices against the local and remote preferences
+	for i, tt := range []struct {
+		local, remote, chosen string
+	}{
+		{config.SuiteAes, "", config.SuiteAes},
+		{config.SuiteChaCha, "", config.SuiteAes},
+		{config.SuiteAes, config.SuiteAes, config.SuiteAes},
+		{config.SuiteAes, config.SuiteChaCha, config.SuiteChaCha},
+		{config.SuiteChaCha, config.SuiteAes, config.SuiteChaCha},
+	} {
+		config.SessionSuite = tt.local
+		if chosen := pickSuite(tt.remote); chosen != tt.chosen {
+			t.Fatalf("test %d: suite mismatch: have %v, want %v.", i, chosen, tt.chosen)
+		}
+	}
+	if _, err := acceptSuite("rot13"); err == nil {
+		t.Fatalf("unknown suite accepted.")
+	}
+	// Establish a session over the software suite
+	config.SessionSuite = config.SuiteChaCha
+
+	addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+	sock, err := Listen(addr, key)
+	if err != nil {
+		t.Fatalf("failed to start the session listener: %v.", err)
+	}
+	sock.Accept(10 * time.Millisecond)
+	defer sock.Close()
+
+	client, err := Dial("localhost", addr.Port, key)
+	if err != nil {
+		t.Fatalf("failed to connect over %s: %v.", config.SuiteChaCha, err)
+	}
+	defer client.Close()
+	server := <-sock.Sink
+	defer server.Close()
+
+	if client.Suite != config.SuiteChaCha || server.Suite != config.SuiteChaCha {
+		t.Fatalf("session suite mismatch: have %v/%v, want %v.", client.Suite, server.Suite, config.SuiteChaCha)
+	}
+}
+
+// Tests the negotiation of the handshake version and that the negotiated session
+// parameters are bound into the derived keys.
+func TestVersionNegotiation(t *testing.T) {
+	minimum := config.SessionMinVersion
+	defer func() { config.SessionMinVersion = minimum }()
+
+	// Check the agreed versions against the remote announcements
+	for i, tt := range []struct {
+		remote, chosen int
+	}{
+		{0, shakeLegacy},
+		{shakeLegacy, shakeLegacy},
+		{shakeTranscript, shakeTranscript},
+		{shakeVersion + 1, shakeVersion},
+	} {
+		if version, err := negotiateVersion(tt.remote); err != nil || version != tt.chosen {
+			t.Fatalf("test %d: version mismatch: have %v/%v, want %v.", i, version, err, tt.chosen)
+		}
+	}
+	if _, err := acceptVersion(shakeVersion + 1); err == nil {
+		t.Fatalf("unsupported version accepted from server.")
+	}
+	// Tampering with any offer must change the derivation info, except for legacy peers
+	client := &offer{Version: shakeVersion, Kdf: kdfBound, Id: []byte("client"), Suite: config.SuiteChaCha}
+	server := &offer{Version: shakeVersion, Kdf: kdfBound, Id: []byte("server"), Suite: config.SuiteChaCha}
+	forged := &offer{Version: shakeVersion, Kdf: kdfBound, Id: []byte("client"), Suite: config.SuiteAes}
+
+	info := bindTranscript(config.HkdfInfo, shakeTranscript, client, server)
+	if bytes.Equal(info, bindTranscript(config.HkdfInfo, shakeTranscript, forged, server)) {
+		t.Fatalf("tampered offer not bound into derivation info.")
+	}
+	if !bytes.Equal(bindTranscript(config.HkdfInfo, shakeLegacy, forged, server), config.HkdfInfo) {
+		t.Fatalf("legacy derivation info modified.")
+	}
+	// Establish a session with the latest version, and refuse legacy peers if required
+	addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+	sock, err := Listen(addr, key)
+	if err != nil {
+		t.Fatalf("failed to start the session listener: %v.", err)
+	}
+	sock.Accept(10 * time.Millisecond)
+	defer sock.Close()
+
+	sess, err := Dial("localhost", addr.Port, key)
+	if err != nil {
+		t.Fatalf("failed to connect to the session listener: %v.", err)
+	}
+	defer sess.Close()
+	peer := <-sock.Sink
+	defer peer.Close()
+
+	if sess.Version != shakeVersion || peer.Version != shakeVersion {
+		t.Fatalf("session version mismatch: have %v/%v, want %v.", sess.Version, peer.Version, shakeVersion)
+	}
+	config.SessionMinVersion = shakeTranscript
+	if _, err := negotiateVersion(0); err == nil {
+		t.Fatalf("legacy peer accepted above minimum version.")
+	}
+}
+
+// Audit trail subscriber collecting the security events of the session layer.
+type auditor struct {
+	events []*audit.Event
+	lock   sync.Mutex
+}
+
+func (a *auditor) HandleAudit(event *audit.Event) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if event.Component == "session" {
+		a.events = append(a.events, event)
+	}
+}
+
+// Counts the collected events of a given kind.
+func (a *auditor) count(kind string) int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	n := 0
+	for _, event := range a.events {
+		if event.Kind == kind {
+			n++
+		}
+	}
+	return n
+}
+
+// Tests that handshake outcomes and key rotations are reported to the audit
+// trail.
+func TestAuditTrail(t *testing.T) {
+	trail := new(auditor)
+	audit.Subscribe(trail)
+	defer audit.Unsubscribe(trail)
+
+	addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+	sock, err := Listen(addr, key)
+	if err != nil {
+		t.Fatalf("failed to start the session listener: %v.", err)
+	}
+	sock.Accept(10 * time.Millisecond)
+	defer sock.Close()
+
+	// Establish a valid session, reported by both sides
+	client, err := Dial("localhost", addr.Port, key)
+	if err != nil {
+		t.Fatalf("failed to connect to the session listener: %v.", err)
+	}
+	(<-sock.Sink).Close()
+	client.Close()
+
+	if n := trail.count(audit.HandshakeSuccess); n != 2 {
+		t.Fatalf("handshake success count mismatch: have %v, want %v.", n, 2)
+	}
+	// Rotate the key and fail a handshake with the old one
+	rotated, _ := rsa.GenerateKey(rand.Reader, 1024)
+	if err := sock.Rotate(rotated); err != nil {
+		t.Fatalf("failed to rotate the listener key: %v.", err)
+	}
+	if n := trail.count(audit.KeyRotation); n != 1 {
+		t.Fatalf("key rotation count mismatch: have %v, want %v.", n, 1)
+	}
+	conf := DefaultConfig()
+	conf.Retries = 0
+	if sess, err := DialConfig("localhost", addr.Port, key, conf); err == nil {
+		sess.Close()
+		t.Fatalf("connected with a rotated out key.")
+	}
+	if n := trail.count(audit.HandshakeFailure); n == 0 {
+		t.Fatalf("handshake failure not reported.")
+	}
+}
+
+// Tests the exponential backoff calculation.
+func TestBackoff(t *testing.T) {
+	t.Parallel()
+
+	conf := &Config{Backoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	want := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, w := range want {
+		if have := conf.backoff(i); have != w*time.Millisecond {
+			t.Fatalf("backoff mismatch for attempt %d: have %v, want %v.", i, have, w*time.Millisecond)
+		}
+	}
+}
+
 // Benchmarks the session setup performance.
 func BenchmarkHandshake(b *testing.B) {
 	addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
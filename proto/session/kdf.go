@@ -0,0 +1,85 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the context binding of the session key derivation. Since
+// version 2, the HKDF info parameter commits to the overlay, the protocol version
+// and the identities of both peers, so keys negotiated for one context are
+// useless in any other. Peers omitting the version are still served with the
+// legacy derivation while config.HkdfLegacy permits it.
+
+package session
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash"
+	"io"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Size of the channel binding value exported from the sessions (bytes).
+const bindingSize = 32
+
+// Key derivation versions.
+const (
+	kdfLegacy = 1 // Static info parameter, no context binding
+	kdfBound  = 2 // Info bound to the overlay, protocol and peer identities
+)
+
+// Picks the key derivation version to use with a remote peer, or fails if the
+// peer only supports the legacy derivation and that is disallowed.
+func negotiateKdf(remote int) (int, error) {
+	if remote >= kdfBound {
+		return kdfBound, nil
+	}
+	if !config.HkdfLegacy {
+		return 0, shakeError(ErrProtocol, "legacy key derivation refused")
+	}
+	return kdfLegacy, nil
+}
+
+// Assembles the HKDF info parameter for the given derivation version, overlay
+// and the client and server identities.
+func kdfInfo(version int, overlay string, client, server []byte) []byte {
+	if version < kdfBound {
+		return config.HkdfInfo
+	}
+	// Length prefix each field to keep the encoding unambiguous
+	buf := new(bytes.Buffer)
+	for _, field := range [][]byte{config.HkdfLabel, []byte(overlay), []byte(config.ProtocolVersion), client, server} {
+		binary.Write(buf, binary.BigEndian, uint32(len(field)))
+		buf.Write(field)
+	}
+	return buf.Bytes()
+}
+
+// Exports a value unique to the session from the master secret, through a key
+// derivation separate from the link keys. Higher layers may sign it to prove an
+// identity to the remote peer, without the proof being replayable elsewhere.
+func channelBinding(secret, info []byte) []byte {
+	label := append(append([]byte{}, info...), "channel binding"...)
+
+	hasher := func() hash.Hash { return config.HkdfHash.New() }
+	binding := make([]byte, bindingSize)
+	if _, err := io.ReadFull(config.SessionKdf(hasher, secret, config.HkdfSalt, label), binding); err != nil {
+		panic(err)
+	}
+	return binding
+}
@@ -25,7 +25,6 @@ import (
 	"hash"
 	"io"
 
-	"code.google.com/p/go.crypto/hkdf"
 	"github.com/karalabe/iris/config"
 	"github.com/karalabe/iris/proto/link"
 	"github.com/karalabe/iris/proto/stream"
@@ -35,27 +34,35 @@ import (
 type Session struct {
 	kdf io.Reader // Key derivation function to expand the master key
 
+	Version int    // Handshake version negotiated with the remote peer
+	Suite   string // Cipher suite negotiated for the links
+	Binding []byte // Value unique to the session, known only to the two peers
+
 	CtrlLink *link.Link // Network connection for high priority control messages
 	DataLink *link.Link // Network connection for low priority data messages
 }
 
-// Creates a new, double link session for authenticated data transfer. The
-// initiator is used to decide the key derivation order for the channels.
-func newSession(conn *stream.Stream, secret []byte, server bool) *Session {
+// Creates a new, double link session for authenticated data transfer. The info
+// binds the derived keys to the session context, whereas the initiator is used
+// to decide the key derivation order for the channels.
+func newSession(conn *stream.Stream, secret, info []byte, agreed *offer, server bool) *Session {
 	// Create the key derivation function
 	hasher := func() hash.Hash { return config.HkdfHash.New() }
-	hkdf := hkdf.New(hasher, secret, config.HkdfSalt, config.HkdfInfo)
+	hkdf := config.SessionKdf(hasher, secret, config.HkdfSalt, info)
 
 	// Create the encrypted control link
 	return &Session{
 		kdf:      hkdf,
-		CtrlLink: link.New(conn, hkdf, server),
+		Version:  agreed.Version,
+		Suite:    agreed.Suite,
+		Binding:  channelBinding(secret, info),
+		CtrlLink: link.New(conn, hkdf, agreed.Suite, server),
 	}
 }
 
 // Finalizes a session by creating the secondary data link.
 func (s *Session) init(conn *stream.Stream, server bool) {
-	s.DataLink = link.New(conn, s.kdf, server)
+	s.DataLink = link.New(conn, s.kdf, s.Suite, server)
 }
 
 // Starts the session data transfers on the control and data channels.
@@ -64,6 +71,25 @@ func (s *Session) Start(cap int) {
 	s.DataLink.Start(cap)
 }
 
+// Switches both channels of a live session in-band to fresh keys of a new cipher
+// suite (or rekeys them with the current one), without disconnecting.
+func (s *Session) Renegotiate(suite string) error {
+	if err := s.CtrlLink.Renegotiate(suite); err != nil {
+		return err
+	}
+	return s.DataLink.Renegotiate(suite)
+}
+
+// Retrieves the number of bytes received and sent on the two channels together.
+func (s *Session) Traffic() (in, out uint64) {
+	in, out = s.CtrlLink.Traffic()
+	if s.DataLink != nil {
+		dataIn, dataOut := s.DataLink.Traffic()
+		in, out = in+dataIn, out+dataOut
+	}
+	return
+}
+
 // Terminates the data transfers on the two channels
 func (s *Session) Close() error {
 	res := s.CtrlLink.Close()
@@ -0,0 +1,57 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the negotiation of the session cipher suite. The client
+// advertises its preferred suite and the server settles on AES only if both
+// sides prefer it (i.e. both are likely accelerated), ChaCha20 otherwise, since
+// a single software AES endpoint would throttle the whole session. Peers not
+// advertising a suite predate the negotiation and always get AES.
+
+package session
+
+import (
+	"github.com/karalabe/iris/config"
+)
+
+// Picks the cipher suite to use with a remote client preferring the given one.
+func pickSuite(remote string) string {
+	switch {
+	case remote == "":
+		return config.SuiteAes
+	case remote == config.SuiteChaCha || config.Suite() == config.SuiteChaCha:
+		return config.SuiteChaCha
+	default:
+		return config.SuiteAes
+	}
+}
+
+// Verifies that the cipher suite chosen by the remote server is usable locally.
+func acceptSuite(chosen string) (string, error) {
+	switch chosen {
+	case "", config.SuiteAes:
+		return config.SuiteAes, nil
+	case config.SuiteChaCha:
+		if config.FipsMode {
+			return "", shakeError(ErrProtocol, "cipher suite %s not allowed in fips mode", chosen)
+		}
+		return chosen, nil
+	default:
+		return "", shakeError(ErrProtocol, "unknown cipher suite %s", chosen)
+	}
+}
@@ -0,0 +1,300 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the session resumption tickets. After a full handshake the
+// server hands the client an opaque ticket, sealing the master secret with a
+// listener local key. Within the ticket lifetime, the client may present it to
+// skip the public key operations, both sides mixing fresh nonces into the old
+// secret to derive the new session keys. Rotating the authentication key
+// invalidates all outstanding tickets on both sides.
+
+package session
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/karalabe/iris/audit"
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto/stream"
+)
+
+// Size of the nonces mixed into resumed session secrets.
+const resumeNonceSize = 16
+
+// Session resumption request, containing the ticket and the client nonce.
+type resumeRequest struct {
+	Ticket []byte
+	Nonce  []byte
+}
+
+// Session resumption response, containing the server nonce (nil if rejected),
+// the chosen handshake and key derivation versions, cipher suite, the server
+// identity and crypto mode.
+type resumeResponse struct {
+	Nonce   []byte
+	Version int
+	Kdf     int
+	Id      []byte
+	Fips    bool
+	Suite   string
+}
+
+// Client side cached resumption ticket.
+type ticket struct {
+	data   []byte    // Opaque sealed ticket issued by the server
+	secret []byte    // Master secret of the session the ticket was issued for
+	expiry time.Time // Time after which the server will reject the ticket
+}
+
+// Client side cache of resumption tickets, keyed by remote address and the
+// authentication key they were negotiated with.
+type TicketCache struct {
+	tickets map[string]*ticket
+	lock    sync.Mutex
+}
+
+// Creates a new, empty ticket cache.
+func NewTicketCache() *TicketCache {
+	return &TicketCache{
+		tickets: make(map[string]*ticket),
+	}
+}
+
+// Retrieves a still valid ticket for a remote address, if any.
+func (c *TicketCache) get(addr string, key *rsa.PublicKey) *ticket {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	id := addr + "/" + string(fingerprint(key))
+	t, ok := c.tickets[id]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(t.expiry) {
+		delete(c.tickets, id)
+		return nil
+	}
+	return t
+}
+
+// Stores a freshly issued ticket for a remote address.
+func (c *TicketCache) put(addr string, key *rsa.PublicKey, t *ticket) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.tickets[addr+"/"+string(fingerprint(key))] = t
+}
+
+// Drops the ticket of a remote address (e.g. after a rejection).
+func (c *TicketCache) drop(addr string, key *rsa.PublicKey) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.tickets, addr+"/"+string(fingerprint(key)))
+}
+
+// Calculates a fingerprint of an authentication key to bind tickets to.
+func fingerprint(key *rsa.PublicKey) []byte {
+	hash := sha256.New()
+	hash.Write(key.N.Bytes())
+	binary.Write(hash, binary.BigEndian, int64(key.E))
+	return hash.Sum(nil)
+}
+
+// Creates a new random ticket sealer.
+func newSealer() (cipher.AEAD, error) {
+	key := make([]byte, config.SessionCipherBits/8)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	block, err := config.SessionCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Derives the secret of a resumed session from the original master secret and
+// the nonces of the two parties.
+func resumeSecret(master, client, server []byte) []byte {
+	mac := hmac.New(config.SessionHash, master)
+	mac.Write(client)
+	mac.Write(server)
+	return mac.Sum(nil)
+}
+
+// Seals a master secret into a resumption ticket valid until the given expiry,
+// nil if tickets are disabled.
+func (l *Listener) issue(master []byte, expiry time.Time) []byte {
+	if l.conf.TicketLifetime <= 0 {
+		return nil
+	}
+	l.keyLock.RLock()
+	defer l.keyLock.RUnlock()
+
+	// Assemble the plaintext ticket contents
+	plain := make([]byte, 8+len(master))
+	binary.BigEndian.PutUint64(plain, uint64(expiry.UnixNano()))
+	copy(plain[8:], master)
+
+	// Seal it, binding to the authentication key
+	nonce := make([]byte, l.sealer.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil
+	}
+	return l.sealer.Seal(nonce, nonce, plain, fingerprint(&l.key.PublicKey))
+}
+
+// Opens a resumption ticket and returns the master secret and expiry within.
+func (l *Listener) open(data []byte) ([]byte, time.Time, error) {
+	l.keyLock.RLock()
+	defer l.keyLock.RUnlock()
+
+	size := l.sealer.NonceSize()
+	if len(data) < size {
+		return nil, time.Time{}, errors.New("truncated ticket")
+	}
+	plain, err := l.sealer.Open(nil, data[:size], data[size:], fingerprint(&l.key.PublicKey))
+	if err != nil || len(plain) < 8 {
+		return nil, time.Time{}, errors.New("invalid ticket")
+	}
+	expiry := time.Unix(0, int64(binary.BigEndian.Uint64(plain)))
+	if time.Now().After(expiry) {
+		return nil, time.Time{}, errors.New("expired ticket")
+	}
+	return plain[8:], expiry, nil
+}
+
+// Retrieves the current authentication key of the listener.
+func (l *Listener) authKey() *rsa.PrivateKey {
+	l.keyLock.RLock()
+	defer l.keyLock.RUnlock()
+
+	return l.key
+}
+
+// Replaces the authentication key of the listener and the ticket sealer with it,
+// invalidating all previously issued resumption tickets.
+func (l *Listener) Rotate(key *rsa.PrivateKey) error {
+	sealer, err := newSealer()
+	if err != nil {
+		return err
+	}
+	l.keyLock.Lock()
+	defer l.keyLock.Unlock()
+
+	l.key, l.sealer = key, sealer
+
+	audit.Emit(&audit.Event{
+		Kind:      audit.KeyRotation,
+		Component: "session",
+		Detail:    fmt.Sprintf("new key fingerprint %x", fingerprint(&key.PublicKey)),
+	})
+	return nil
+}
+
+// Client side of the abbreviated session negotiation, returning the derived
+// session secret, the key derivation info and the session parameters chosen by
+// the server.
+func clientResume(strm *stream.Stream, t *ticket, conf *Config) ([]byte, []byte, *offer, error) {
+	// Set an overall time limit for the handshake to complete
+	strm.Sock().SetDeadline(time.Now().Add(conf.ShakeTimeout))
+	defer strm.Sock().SetDeadline(time.Time{})
+
+	// Send the ticket with a fresh nonce
+	nonce := make([]byte, resumeNonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, nil, shakeError(ErrAuth, "failed to generate nonce: %v", err)
+	}
+	req := &initRequest{
+		Resume:  &resumeRequest{Ticket: t.data, Nonce: nonce},
+		Version: shakeVersion,
+		Kdf:     kdfBound,
+		Id:      conf.Identity,
+		Fips:    config.FipsMode,
+		Suite:   config.Suite(),
+	}
+	if err := strm.Send(req); err != nil {
+		return nil, nil, nil, streamError(err, "failed to send resume request")
+	}
+	if err := strm.Flush(); err != nil {
+		return nil, nil, nil, streamError(err, "failed to flush resume request")
+	}
+	// Retrieve the server nonce and derive the session secret
+	res := new(resumeResponse)
+	if err := strm.Recv(res); err != nil {
+		return nil, nil, nil, streamError(err, "failed to receive resume response")
+	}
+	if len(res.Nonce) != resumeNonceSize {
+		return nil, nil, nil, shakeError(ErrAuth, "resumption ticket rejected")
+	}
+	remote := &offer{Version: res.Version, Kdf: res.Kdf, Id: res.Id, Fips: res.Fips, Suite: res.Suite}
+	agreed, err := acceptOffer(remote)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	info := kdfInfo(agreed.Kdf, conf.Overlay, conf.Identity, res.Id)
+	return resumeSecret(t.secret, nonce, res.Nonce), bindTranscript(info, agreed.Version, req.offer(), remote), agreed, nil
+}
+
+// Executes the server side of the abbreviated session negotiation, returning the
+// derived secret session key along with the original master secret and ticket
+// expiry. Possession of the secret is proven implicitly by the link handshake.
+func (l *Listener) serverResume(strm *stream.Stream, req *resumeRequest, agreed *offer) ([]byte, []byte, time.Time, error) {
+	// Open the ticket, rejecting the resumption if invalid
+	master, expiry, err := l.open(req.Ticket)
+	if err == nil && len(req.Nonce) != resumeNonceSize {
+		err = errors.New("invalid nonce")
+	}
+	if err != nil {
+		strm.Send(&resumeResponse{})
+		strm.Flush()
+		return nil, nil, time.Time{}, shakeError(ErrAuth, "failed to resume session: %v", err)
+	}
+	// Accept the ticket and derive the new secret
+	nonce := make([]byte, resumeNonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, time.Time{}, shakeError(ErrAuth, "failed to generate nonce: %v", err)
+	}
+	res := &resumeResponse{
+		Nonce:   nonce,
+		Version: agreed.Version,
+		Kdf:     agreed.Kdf,
+		Id:      agreed.Id,
+		Fips:    agreed.Fips,
+		Suite:   agreed.Suite,
+	}
+	if err := strm.Send(res); err != nil {
+		return nil, nil, time.Time{}, streamError(err, "failed to send resume response")
+	}
+	if err := strm.Flush(); err != nil {
+		return nil, nil, time.Time{}, streamError(err, "failed to flush resume response")
+	}
+	return resumeSecret(master, req.Nonce, nonce), master, expiry, nil
+}
@@ -0,0 +1,127 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the versioning of the session handshake. Both sides announce
+// the highest version they speak, agreeing on the lower one. Since the opening
+// messages travel in the clear, from the transcript binding version onwards all
+// negotiated parameters are hashed into the key derivation info: any tampering
+// with the offers (e.g. forcing a weaker suite or derivation) leaves the two
+// sides with differing keys, failing the data link authentication. Stripping the
+// version announcements altogether to pose as legacy peers can only be prevented
+// by raising the minimum accepted version once a cluster is fully upgraded.
+
+package session
+
+import (
+	"encoding/binary"
+
+	"github.com/karalabe/iris/config"
+)
+
+const (
+	shakeLegacy     = 1 // Unversioned handshake, negotiated parameters unauthenticated
+	shakeTranscript = 2 // Negotiated parameters bound into the session keys
+)
+
+// Highest handshake version supported by the local node.
+const shakeVersion = shakeTranscript
+
+// Negotiable session parameters announced by one side of the handshake.
+type offer struct {
+	Version int
+	Kdf     int
+	Id      []byte
+	Fips    bool
+	Suite   string
+}
+
+// Extracts the parameters offered by the client in the session initiation.
+func (r *initRequest) offer() *offer {
+	return &offer{Version: r.Version, Kdf: r.Kdf, Id: r.Id, Fips: r.Fips, Suite: r.Suite}
+}
+
+// Picks the handshake version to use with a remote peer, refusing those below
+// the configured minimum. Unversioned peers are treated as legacy ones.
+func negotiateVersion(remote int) (int, error) {
+	if remote < shakeLegacy {
+		remote = shakeLegacy
+	}
+	version := remote
+	if version > shakeVersion {
+		version = shakeVersion
+	}
+	if version < config.SessionMinVersion {
+		return 0, shakeError(ErrProtocol, "handshake version %d below minimum %d", version, config.SessionMinVersion)
+	}
+	return version, nil
+}
+
+// Verifies the handshake version chosen by the remote server, returning it if
+// acceptable.
+func acceptVersion(chosen int) (int, error) {
+	if chosen > shakeVersion {
+		return 0, shakeError(ErrProtocol, "unsupported handshake version %d", chosen)
+	}
+	return negotiateVersion(chosen)
+}
+
+// Verifies the session parameters chosen by the remote server, returning them
+// in their normalized form if acceptable.
+func acceptOffer(remote *offer) (*offer, error) {
+	if err := checkSuite(remote.Fips); err != nil {
+		return nil, err
+	}
+	version, err := acceptVersion(remote.Version)
+	if err != nil {
+		return nil, err
+	}
+	kdf, err := negotiateKdf(remote.Kdf)
+	if err != nil {
+		return nil, err
+	}
+	suite, err := acceptSuite(remote.Suite)
+	if err != nil {
+		return nil, err
+	}
+	return &offer{Version: version, Kdf: kdf, Id: remote.Id, Fips: remote.Fips, Suite: suite}, nil
+}
+
+// Binds the handshake transcript (the client and server offers, exactly as they
+// were sent) into the key derivation info, if the negotiated version supports it.
+func bindTranscript(info []byte, version int, client, server *offer) []byte {
+	if version < shakeTranscript {
+		return info
+	}
+	hash := config.HkdfHash.New()
+	for _, o := range []*offer{client, server} {
+		fips := uint8(0)
+		if o.Fips {
+			fips = 1
+		}
+		binary.Write(hash, binary.BigEndian, []int64{int64(o.Version), int64(o.Kdf)})
+		binary.Write(hash, binary.BigEndian, fips)
+
+		// Length prefix the variable fields to keep the encoding unambiguous
+		for _, field := range [][]byte{o.Id, []byte(o.Suite)} {
+			binary.Write(hash, binary.BigEndian, uint32(len(field)))
+			hash.Write(field)
+		}
+	}
+	return append(append([]byte{}, info...), hash.Sum(nil)...)
+}
@@ -0,0 +1,353 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the in-process loopback transport. Listening on or dialing
+// an address of the reserved memory network connects streams through in-memory
+// pipes instead of kernel sockets, allowing large numbers of nodes to be run in
+// a single process for testing and simulation. The pipes are buffered like the
+// kernel sockets are, as the protocols rely on writes not waiting for the remote
+// side to read.
+
+package stream
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Failure reported when dialing a memory address nobody listens on.
+var ErrRefused = errors.New("memory connection refused")
+
+// Failure reported when accepting on a closed memory listener.
+var errClosed = errors.New("memory listener closed")
+
+// Host address of the in-process transport, within a benchmarking range (RFC 2544)
+// that never appears on real networks.
+var memNet = &net.IPNet{IP: net.IPv4(198, 18, 0, 1).To4(), Mask: net.CIDRMask(15, 32)}
+
+// Port ranges assigned to the memory listeners and dialers.
+const (
+	memListenBase = 1024
+	memDialBase   = 32768
+	memPortLimit  = 65536
+)
+
+// Number of dialed connections a memory listener queues up for accepting.
+const memBacklog = 128
+
+var (
+	memListeners = make(map[int]*memListener) // Live memory listeners by port
+	memListen    = memListenBase              // Next listener port to assign
+	memDial      = memDialBase                // Next ephemeral port to assign
+	memLock      sync.Mutex                   // Mutex protecting the memory network
+)
+
+// Retrieves the network of the in-process transport, to be used in place of a
+// real network interface.
+func MemoryNetwork() *net.IPNet {
+	return &net.IPNet{IP: append(net.IP{}, memNet.IP...), Mask: append(net.IPMask{}, memNet.Mask...)}
+}
+
+// Checks whether an address belongs to the in-process transport.
+func memory(ip net.IP) bool {
+	return ip != nil && memNet.Contains(ip)
+}
+
+// One direction of a memory pipe, buffering all the written but unread data.
+type memBuffer struct {
+	data     []byte        // Data written but not yet read
+	eof      bool          // Whether the writer closed its end
+	shut     bool          // Whether the reader closed its end
+	deadline time.Time     // Time instance after which reads fail
+	signal   chan struct{} // Channel closed on any state change
+	lock     sync.Mutex    // Mutex protecting the buffer state
+}
+
+// Creates a new, empty pipe buffer.
+func newMemBuffer() *memBuffer {
+	return &memBuffer{signal: make(chan struct{})}
+}
+
+// Wakes up any reader waiting for a change. The lock must be held.
+func (b *memBuffer) notify() {
+	close(b.signal)
+	b.signal = make(chan struct{})
+}
+
+// Retrieves buffered data, waiting for some to arrive if empty.
+func (b *memBuffer) read(p []byte) (int, error) {
+	for {
+		b.lock.Lock()
+		switch {
+		case b.shut:
+			b.lock.Unlock()
+			return 0, io.ErrClosedPipe
+		case len(b.data) > 0:
+			n := copy(p, b.data)
+			b.data = b.data[n:]
+			b.lock.Unlock()
+			return n, nil
+		case b.eof:
+			b.lock.Unlock()
+			return 0, io.EOF
+		case !b.deadline.IsZero() && !time.Now().Before(b.deadline):
+			b.lock.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+		signal, deadline := b.signal, b.deadline
+		b.lock.Unlock()
+
+		if deadline.IsZero() {
+			<-signal
+			continue
+		}
+		timer := time.NewTimer(deadline.Sub(time.Now()))
+		select {
+		case <-signal:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// Appends data to the buffer, never blocking.
+func (b *memBuffer) write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.eof || b.shut {
+		return 0, io.ErrClosedPipe
+	}
+	b.data = append(b.data, p...)
+	b.notify()
+	return len(p), nil
+}
+
+// Connection endpoint of a memory pipe, reporting TCP addresses for the upper
+// layers to treat it as any other network connection.
+type memConn struct {
+	in     *memBuffer   // Buffer of the inbound direction
+	out    *memBuffer   // Buffer of the outbound direction
+	local  *net.TCPAddr // Address of the local endpoint
+	remote *net.TCPAddr // Address of the remote endpoint
+
+	wdeadline time.Time  // Time instance after which writes fail
+	wlock     sync.Mutex // Mutex protecting the write deadline
+}
+
+// Creates the two endpoints of a buffered memory pipe.
+func memPipe(client, server *net.TCPAddr) (*memConn, *memConn) {
+	up, down := newMemBuffer(), newMemBuffer()
+	return &memConn{in: down, out: up, local: client, remote: server},
+		&memConn{in: up, out: down, local: server, remote: client}
+}
+
+// Implements net.Conn.Read.
+func (c *memConn) Read(p []byte) (int, error) {
+	return c.in.read(p)
+}
+
+// Implements net.Conn.Write, failing only if the deadline already passed.
+func (c *memConn) Write(p []byte) (int, error) {
+	c.wlock.Lock()
+	deadline := c.wdeadline
+	c.wlock.Unlock()
+
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	return c.out.write(p)
+}
+
+// Implements net.Conn.Close, failing the local reads and signaling the end of
+// the stream to the remote side.
+func (c *memConn) Close() error {
+	c.in.lock.Lock()
+	c.in.shut = true
+	c.in.notify()
+	c.in.lock.Unlock()
+
+	c.out.lock.Lock()
+	c.out.eof = true
+	c.out.notify()
+	c.out.lock.Unlock()
+
+	return nil
+}
+
+func (c *memConn) LocalAddr() net.Addr  { return c.local }
+func (c *memConn) RemoteAddr() net.Addr { return c.remote }
+
+// Implements net.Conn.SetDeadline.
+func (c *memConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// Implements net.Conn.SetReadDeadline, waking up any pending read.
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	c.in.lock.Lock()
+	defer c.in.lock.Unlock()
+
+	c.in.deadline = t
+	c.in.notify()
+	return nil
+}
+
+// Implements net.Conn.SetWriteDeadline.
+func (c *memConn) SetWriteDeadline(t time.Time) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+
+	c.wdeadline = t
+	return nil
+}
+
+// Listener of the in-process transport, accepting the pipes of memory dialers.
+type memListener struct {
+	addr     *net.TCPAddr  // Address the listener is registered at
+	conns    chan net.Conn // Backlog of the dialed connections
+	done     chan struct{} // Channel closed when the listener terminates
+	deadline time.Time     // Time instance after which accepts fail
+	lock     sync.Mutex    // Mutex protecting the deadline and the backlog
+}
+
+// Registers a memory listener at the requested port, or the next free one if
+// an auto-port (0) is requested.
+func listenMemory(addr *net.TCPAddr) (*memListener, error) {
+	memLock.Lock()
+	defer memLock.Unlock()
+
+	port := addr.Port
+	if port == 0 {
+		for i := memListenBase; i < memDialBase; i++ {
+			if memListen++; memListen >= memDialBase {
+				memListen = memListenBase
+			}
+			if _, ok := memListeners[memListen]; !ok {
+				port = memListen
+				break
+			}
+		}
+	}
+	if _, ok := memListeners[port]; ok || port == 0 {
+		return nil, &net.OpError{Op: "listen", Net: "tcp", Addr: addr, Err: errors.New("address already in use")}
+	}
+	l := &memListener{
+		addr:  &net.TCPAddr{IP: memNet.IP, Port: port},
+		conns: make(chan net.Conn, memBacklog),
+		done:  make(chan struct{}),
+	}
+	memListeners[port] = l
+	return l, nil
+}
+
+// Connects to a memory listener through a new pipe, queueing it in the backlog of
+// the listener. Similarly to kernel sockets, the connection is refused if the
+// backlog is full.
+func dialMemory(addr *net.TCPAddr) (net.Conn, error) {
+	memLock.Lock()
+	l, ok := memListeners[addr.Port]
+	if memDial++; memDial >= memPortLimit {
+		memDial = memDialBase
+	}
+	local := &net.TCPAddr{IP: memNet.IP, Port: memDial}
+	memLock.Unlock()
+
+	if !ok || !addr.IP.Equal(memNet.IP) {
+		return nil, ErrRefused
+	}
+	client, server := memPipe(local, l.addr)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	select {
+	case <-l.done:
+		return nil, ErrRefused
+	default:
+	}
+	select {
+	case l.conns <- server:
+		return client, nil
+	default:
+		return nil, ErrRefused
+	}
+}
+
+// Implements net.Listener.Accept, waiting for a dialer until the deadline.
+func (l *memListener) Accept() (net.Conn, error) {
+	l.lock.Lock()
+	deadline := l.deadline
+	l.lock.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timeout = time.After(deadline.Sub(time.Now()))
+	}
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errClosed
+	case <-timeout:
+		return nil, os.ErrDeadlineExceeded
+	}
+}
+
+// Sets the deadline of the accept operations.
+func (l *memListener) SetDeadline(t time.Time) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.deadline = t
+	return nil
+}
+
+// Unregisters the listener, refusing any further dialers and resetting the ones
+// still waiting in the backlog.
+func (l *memListener) Close() error {
+	memLock.Lock()
+	if memListeners[l.addr.Port] == l {
+		delete(memListeners, l.addr.Port)
+	}
+	memLock.Unlock()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	select {
+	case <-l.done:
+		return errClosed
+	default:
+		close(l.done)
+	}
+	for {
+		select {
+		case conn := <-l.conns:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package stream
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// Tests that streams on the memory network are served in-process, transferring
+// data, honoring deadlines and refusing connections to closed listeners.
+func TestMemory(t *testing.T) {
+	t.Parallel()
+
+	// Listen on an auto-port of the memory network
+	addr := &net.TCPAddr{IP: MemoryNetwork().IP}
+	sock, err := Listen(addr)
+	if err != nil {
+		t.Fatalf("failed to listen on memory network: %v.", err)
+	}
+	sock.Accept(time.Second)
+	if addr.Port == 0 {
+		t.Fatalf("memory listener port not assigned.")
+	}
+	// Connect to it and exchange data in both directions
+	client, err := Dial(addr.String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial memory listener: %v.", err)
+	}
+	server := <-sock.Sink
+
+	if local, remote := client.Sock().LocalAddr().String(), server.Sock().RemoteAddr().String(); local != remote {
+		t.Fatalf("endpoint address mismatch: client %v, server %v.", local, remote)
+	}
+	// Both sides sending first must not block (i.e. the pipe is buffered)
+	for _, strm := range []*Stream{client, server} {
+		if err := strm.Send("ping"); err != nil {
+			t.Fatalf("failed to send data: %v.", err)
+		}
+		if err := strm.Flush(); err != nil {
+			t.Fatalf("failed to flush data: %v.", err)
+		}
+	}
+	for _, strm := range []*Stream{client, server} {
+		var data string
+		if err := strm.Recv(&data); err != nil || data != "ping" {
+			t.Fatalf("failed to receive data: %v, %v.", data, err)
+		}
+	}
+	// Ensure read deadlines are honored
+	server.Sock().SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := server.Sock().Read(make([]byte, 1)); err != os.ErrDeadlineExceeded {
+		t.Fatalf("deadline error mismatch: have %v, want %v.", err, os.ErrDeadlineExceeded)
+	}
+	server.Sock().SetReadDeadline(time.Time{})
+
+	// Closing one side should terminate the other
+	client.Close()
+	if _, err := server.Sock().Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("closed stream error mismatch: have %v, want %v.", err, io.EOF)
+	}
+	server.Close()
+
+	// Closed listeners should refuse connections
+	if err := sock.Close(); err != nil {
+		t.Fatalf("failed to close memory listener: %v.", err)
+	}
+	if _, err := Dial(addr.String(), time.Second); err != ErrRefused {
+		t.Fatalf("dial error mismatch: have %v, want %v.", err, ErrRefused)
+	}
+}
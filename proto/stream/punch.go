@@ -0,0 +1,55 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the TCP hole punching primitive: a connection attempt from
+// a listener's port towards a remote endpoint, whose outbound packets open the
+// mapping of the local NAT for the remote side to connect through.
+
+package stream
+
+import (
+	"net"
+	"time"
+)
+
+// Sends connection attempts from the local (listener) address to the remote one
+// with a limited IP time to live, so they open the local NAT mapping but expire
+// before reaching (and being rejected by) the remote NAT. Any connection that
+// does get established is closed immediately. Only local failures (e.g. unable
+// to share the port) are reported.
+func Punch(laddr, raddr *net.TCPAddr, ttl int, timeout time.Duration) error {
+	dialer := &net.Dialer{
+		LocalAddr: laddr,
+		Timeout:   timeout,
+		Control:   punchControl(ttl),
+	}
+	conn, err := dialer.Dial("tcp", raddr.String())
+	if err == nil {
+		return conn.Close()
+	}
+	if oerr, ok := err.(*net.OpError); ok && oerr.Op == "dial" {
+		if nerr, ok := oerr.Err.(net.Error); ok && nerr.Timeout() {
+			return nil
+		}
+		if !isBindError(oerr) {
+			return nil
+		}
+	}
+	return err
+}
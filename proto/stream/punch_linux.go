@@ -0,0 +1,75 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the Linux socket options needed to share a listener port
+// with the hole punching connection attempts.
+
+package stream
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// Marks a socket as sharing its address and port with other sockets of the same
+// user, required to punch holes from the listener port or to hand it over to a
+// successor process.
+func ReuseControl(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		if serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); serr != nil {
+			return
+		}
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// Creates a socket control function sharing the port and limiting the time to
+// live of the outbound packets.
+func punchControl(ttl int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		if err := ReuseControl(network, address, c); err != nil {
+			return err
+		}
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}
+}
+
+// Checks whether a dial failure originated from binding the local address.
+func isBindError(err *net.OpError) bool {
+	if serr, ok := err.Err.(*net.OpError); ok {
+		err = serr
+	}
+	if serr, ok := err.Err.(*os.SyscallError); ok {
+		return serr.Syscall == "bind" || serr.Err == syscall.EADDRINUSE
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the fallback of the port sharing socket options for systems
+// where hole punching is not supported.
+
+//go:build !linux
+// +build !linux
+
+package stream
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// Leaves the listener sockets unshared.
+func ReuseControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
+
+// Rejects punching, as the listener ports cannot be shared.
+func punchControl(ttl int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return errors.New("hole punching not supported")
+	}
+}
+
+// All failures are local ones, punching being unsupported.
+func isBindError(err *net.OpError) bool {
+	return true
+}
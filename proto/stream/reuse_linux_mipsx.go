@@ -0,0 +1,30 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the port sharing socket option of the Linux architectures
+// inheriting their socket option numbering from other systems (mips, sparc).
+
+//go:build linux && (mips || mipsle || mips64 || mips64le || sparc64)
+// +build linux
+// +build mips mipsle mips64 mips64le sparc64
+
+package stream
+
+// Socket option to share a port between sockets, missing from the syscall package.
+const soReusePort = 0x200
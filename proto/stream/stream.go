@@ -18,6 +18,7 @@
 // Author: peterke@gmail.com (Peter Szilagyi)
 
 // Package stream wraps a TCP/IP network connection with the Go gob en/decoder.
+// Addresses of the memory network are served by an in-process transport.
 //
 // Note, in case of a serialization error (encoding or decoding failure), it is
 // assumed that there is either a protocol mismatch between the parties, or an
@@ -27,9 +28,11 @@ package stream
 
 import (
 	"bufio"
+	"context"
 	"encoding/gob"
 	"log"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
@@ -40,13 +43,42 @@ const acceptBlockTimeout = 250 * time.Millisecond
 type Listener struct {
 	Sink chan *Stream // Channel receiving the accepted connections
 
-	socket *net.TCPListener // Network socket to accept connections on
-	quit   chan chan error  // Termination synchronization channel
+	socket acceptor        // Network socket to accept connections on
+	quit   chan chan error // Termination synchronization channel
+}
+
+// Server socket of either the network or the in-process transport.
+type acceptor interface {
+	Accept() (net.Conn, error)
+	SetDeadline(t time.Time) error
+	Close() error
+}
+
+// Network socket wrapper counting the bytes transferred in each direction.
+type meter struct {
+	in   uint64   // Number of bytes read from the socket (atomic)
+	out  uint64   // Number of bytes written into the socket (atomic)
+	sock net.Conn // Network connection being measured
+}
+
+// Implements io.Reader, counting the bytes read.
+func (m *meter) Read(p []byte) (int, error) {
+	n, err := m.sock.Read(p)
+	atomic.AddUint64(&m.in, uint64(n))
+	return n, err
+}
+
+// Implements io.Writer, counting the bytes written.
+func (m *meter) Write(p []byte) (int, error) {
+	n, err := m.sock.Write(p)
+	atomic.AddUint64(&m.out, uint64(n))
+	return n, err
 }
 
 // TCP/IP based stream with a gob encoder on top.
 type Stream struct {
-	socket  *net.TCPConn      // Network connection to the remote endpoint
+	socket  net.Conn          // Network connection to the remote endpoint
+	meter   *meter            // Traffic counter of the network connection
 	buffers *bufio.ReadWriter // Buffered access to the network socket
 	encoder *gob.Encoder      // Gob encoder for data serialization
 	decoder *gob.Decoder      // Gob decoder for data deserialization
@@ -55,12 +87,23 @@ type Stream struct {
 // Opens a TCP server socket and returns a stream listener, ready to accept. If
 // an auto-port (0) is requested, the port is updated in the argument.
 func Listen(addr *net.TCPAddr) (*Listener, error) {
-	// Open the server socket
-	sock, err := net.ListenTCP("tcp", addr)
-	if err != nil {
-		return nil, err
+	var sock acceptor
+	if memory(addr.IP) {
+		// Register an in-process listener on the memory network
+		ln, err := listenMemory(addr)
+		if err != nil {
+			return nil, err
+		}
+		sock, addr.Port = ln, ln.addr.Port
+	} else {
+		// Open the server socket, sharing the port with any hole punching attempts
+		lc := net.ListenConfig{Control: ReuseControl}
+		ln, err := lc.Listen(context.Background(), "tcp", addr.String())
+		if err != nil {
+			return nil, err
+		}
+		sock, addr.Port = ln.(*net.TCPListener), ln.Addr().(*net.TCPAddr).Port
 	}
-	addr.Port = sock.Addr().(*net.TCPAddr).Port
 
 	// Initialize and return the listener
 	return &Listener{
@@ -97,7 +140,7 @@ func (l *Listener) accepter(timeout time.Duration) {
 		default:
 			// Accept an incoming connection but without blocking for too long
 			l.socket.SetDeadline(time.Now().Add(acceptBlockTimeout))
-			if conn, err := l.socket.AcceptTCP(); err == nil {
+			if conn, err := l.socket.Accept(); err == nil {
 				strm := newStream(conn)
 				select {
 				case l.Sink <- strm:
@@ -106,7 +149,7 @@ func (l *Listener) accepter(timeout time.Duration) {
 					log.Printf("stream: failed to handle accepted connection in %v, dropping.", timeout)
 					strm.Close()
 				}
-			} else if !err.(net.Error).Timeout() {
+			} else if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
 				log.Printf("stream: failed to accept connection: %v.", err)
 				errv = err
 			}
@@ -125,12 +168,14 @@ func (l *Listener) accepter(timeout time.Duration) {
 }
 
 // Creates a new, gob backed network stream based on a live TCP/IP connection.
-func newStream(sock *net.TCPConn) *Stream {
-	reader := bufio.NewReader(sock)
-	writer := bufio.NewWriter(sock)
+func newStream(sock net.Conn) *Stream {
+	meter := &meter{sock: sock}
+	reader := bufio.NewReader(meter)
+	writer := bufio.NewWriter(meter)
 
 	return &Stream{
 		socket:  sock,
+		meter:   meter,
 		buffers: bufio.NewReadWriter(reader, writer),
 		encoder: gob.NewEncoder(writer),
 		decoder: gob.NewDecoder(reader),
@@ -139,18 +184,30 @@ func newStream(sock *net.TCPConn) *Stream {
 
 // Connects to a remote host and returns the connection stream.
 func Dial(address string, timeout time.Duration) (*Stream, error) {
+	if addr, err := net.ResolveTCPAddr("tcp", address); err == nil && memory(addr.IP) {
+		sock, err := dialMemory(addr)
+		if err != nil {
+			return nil, err
+		}
+		return newStream(sock), nil
+	}
 	if sock, err := net.DialTimeout("tcp", address, timeout); err != nil {
 		return nil, err
 	} else {
-		return newStream(sock.(*net.TCPConn)), nil
+		return newStream(sock), nil
 	}
 }
 
 // Retrieves the raw connection object if special manipulations are needed.
-func (s *Stream) Sock() *net.TCPConn {
+func (s *Stream) Sock() net.Conn {
 	return s.socket
 }
 
+// Retrieves the number of bytes received and sent through the network connection.
+func (s *Stream) Traffic() (in, out uint64) {
+	return atomic.LoadUint64(&s.meter.in), atomic.LoadUint64(&s.meter.out)
+}
+
 // Serializes an object and sends it over the wire. In case of an error, the
 // connection is torn down.
 func (s *Stream) Send(data interface{}) error {
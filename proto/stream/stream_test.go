@@ -170,6 +170,15 @@ func TestSendRecv(t *testing.T) {
 			t.Fatalf("send/recv mismatch: have %v, want %v", recv1, send1)
 		}
 	}
+	// Ensure the traffic was accounted symmetrically on the two endpoints
+	clientIn, clientOut := client.Traffic()
+	serverIn, serverOut := server.Traffic()
+	if clientOut == 0 || clientOut != serverIn {
+		t.Fatalf("client to server traffic mismatch: sent %v, received %v.", clientOut, serverIn)
+	}
+	if serverOut == 0 || serverOut != clientIn {
+		t.Fatalf("server to client traffic mismatch: sent %v, received %v.", serverOut, clientIn)
+	}
 	// Close the active connections
 	if err = client.Close(); err != nil {
 		t.Fatalf("failed to close client stream: %v.", err)
@@ -182,3 +191,45 @@ func TestSendRecv(t *testing.T) {
 		t.Fatalf("failed to close listener: %v.", err)
 	}
 }
+
+// Tests that hole punching attempts can share the port of a live listener.
+func TestPunch(t *testing.T) {
+	t.Parallel()
+
+	// Start two listeners, one punching towards the other
+	local, err := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to resolve local address: %v.", err)
+	}
+	remote, err := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to resolve remote address: %v.", err)
+	}
+	localSock, err := Listen(local)
+	if err != nil {
+		t.Fatalf("failed to listen on local address: %v.", err)
+	}
+	defer localSock.Close()
+	localSock.Accept(10 * time.Millisecond)
+
+	remoteSock, err := Listen(remote)
+	if err != nil {
+		t.Fatalf("failed to listen on remote address: %v.", err)
+	}
+	defer remoteSock.Close()
+	remoteSock.Accept(100 * time.Millisecond)
+
+	// Punch from the local listener port and verify the source of the attempt
+	if err := Punch(local, remote, 64, time.Second); err != nil {
+		t.Fatalf("failed to punch hole: %v.", err)
+	}
+	select {
+	case strm := <-remoteSock.Sink:
+		if port := strm.Sock().RemoteAddr().(*net.TCPAddr).Port; port != local.Port {
+			t.Fatalf("punch source port mismatch: have %v, want %v.", port, local.Port)
+		}
+		strm.Close()
+	case <-time.After(time.Second):
+		t.Fatalf("punch attempt not received.")
+	}
+}
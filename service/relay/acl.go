@@ -0,0 +1,176 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the access control lists of the relay, restricting the authenticated
+// client identities in the clusters they may join, the topics they may subscribe
+// and publish to, and whether they may open tunnels. Topic rules use the wildcard
+// syntax of the subscriptions: "+" matching a single level and "#" any number of
+// trailing ones.
+
+package relay
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Permissions of a client identity.
+type ACL struct {
+	Clusters  []string // Clusters allowed to join as ("*" for any)
+	Subscribe []string // Topic rules allowed to subscribe to
+	Publish   []string // Topic rules allowed to publish to
+	Tunnel    bool     // Whether outbound tunnels may be opened
+}
+
+// Restricts the clients by the access control lists, keyed by the credential id
+// the client authenticated with. Identities without an entry of their own (or
+// all clients if authentication is disabled) fall back to the "*" entry, being
+// refused admission if there is none.
+func WithACL(acls map[string]*ACL) Option {
+	return func(r *Relay) {
+		r.acls = acls
+	}
+}
+
+// Loads the access control lists from a file, each non-empty line containing the
+// credential id followed by whitespace separated key=value permissions: join, sub
+// and pub take comma separated cluster and topic lists, tunnel takes yes or no.
+// Omitted permissions are denied. Lines starting with a hash are comments.
+func LoadACL(path string) (map[string]*ACL, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	acls := make(map[string]*ACL)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if _, ok := acls[fields[0]]; ok {
+			return nil, fmt.Errorf("relay: duplicate acl at line %d: %s", line, fields[0])
+		}
+		acl := new(ACL)
+		for _, field := range fields[1:] {
+			parts := strings.SplitN(field, "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("relay: invalid acl permission at line %d: %s", line, field)
+			}
+			switch parts[0] {
+			case "join":
+				acl.Clusters = strings.Split(parts[1], ",")
+			case "sub":
+				acl.Subscribe = strings.Split(parts[1], ",")
+			case "pub":
+				acl.Publish = strings.Split(parts[1], ",")
+			case "tunnel":
+				switch parts[1] {
+				case "yes":
+					acl.Tunnel = true
+				case "no":
+					acl.Tunnel = false
+				default:
+					return nil, fmt.Errorf("relay: invalid acl tunnel permission at line %d: have %s, want yes or no", line, parts[1])
+				}
+			default:
+				return nil, fmt.Errorf("relay: unknown acl permission at line %d: %s", line, parts[0])
+			}
+		}
+		acls[fields[0]] = acl
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return acls, nil
+}
+
+// Looks up the access control list of a client identity, falling back to the
+// default entry.
+func lookupACL(acls map[string]*ACL, id string) (*ACL, error) {
+	if acl, ok := acls[id]; ok {
+		return acl, nil
+	}
+	if acl, ok := acls["*"]; ok {
+		return acl, nil
+	}
+	return nil, fmt.Errorf("relay: access denied: no acl for identity: %q", id)
+}
+
+// Checks whether the list permits joining the given cluster. Nil lists are
+// unrestricted.
+func (a *ACL) joinable(cluster string) bool {
+	if a == nil {
+		return true
+	}
+	for _, allowed := range a.Clusters {
+		if allowed == "*" || allowed == cluster {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks whether the list permits subscribing to the given topic or pattern.
+func (a *ACL) subscribable(topic string) bool {
+	return a == nil || coveredBy(topic, a.Subscribe)
+}
+
+// Checks whether the list permits publishing to the given topic.
+func (a *ACL) publishable(topic string) bool {
+	return a == nil || coveredBy(topic, a.Publish)
+}
+
+// Checks whether the list permits opening tunnels.
+func (a *ACL) tunnelable() bool {
+	return a == nil || a.Tunnel
+}
+
+// Checks whether a topic or pattern is covered by any of the rules, i.e. whether
+// everything it matches is matched by a rule too.
+func coveredBy(topic string, rules []string) bool {
+	for _, rule := range rules {
+		if covers(rule, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks whether a single rule covers a topic or pattern, level by level.
+func covers(rule, topic string) bool {
+	rules, levels := strings.Split(rule, "/"), strings.Split(topic, "/")
+	for i, level := range rules {
+		if level == "#" {
+			return true
+		}
+		if i >= len(levels) || levels[i] == "#" {
+			return false
+		}
+		if level != "+" && level != levels[i] {
+			return false
+		}
+	}
+	return len(rules) == len(levels)
+}
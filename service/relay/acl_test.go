@@ -0,0 +1,243 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package relay
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+var loadACLTests = []struct {
+	contents string
+	acls     map[string]*ACL
+	fail     bool
+}{
+	// Comments, empty lines and all permissions
+	{
+		contents: "# comment\n\nalice join=app,web sub=news/#,chat/+ pub=chat/alice tunnel=yes\n",
+		acls: map[string]*ACL{
+			"alice": {
+				Clusters:  []string{"app", "web"},
+				Subscribe: []string{"news/#", "chat/+"},
+				Publish:   []string{"chat/alice"},
+				Tunnel:    true,
+			},
+		},
+	},
+	// Omitted permissions are denied, default entry
+	{
+		contents: "* join=* tunnel=no\nbob\n",
+		acls: map[string]*ACL{
+			"*":   {Clusters: []string{"*"}},
+			"bob": {},
+		},
+	},
+	// Duplicate id
+	{contents: "alice join=app\nalice join=web\n", fail: true},
+	// Permission without a value
+	{contents: "alice join\n", fail: true},
+	// Invalid tunnel flag
+	{contents: "alice tunnel=maybe\n", fail: true},
+	// Unknown permission
+	{contents: "alice admin=yes\n", fail: true},
+}
+
+// Tests the parsing of the access control list files.
+func TestLoadACL(t *testing.T) {
+	for i, tt := range loadACLTests {
+		path, cleanup := writeTempFile(t, tt.contents)
+		acls, err := LoadACL(path)
+		cleanup()
+
+		if tt.fail {
+			if err == nil {
+				t.Errorf("test %d: invalid acl accepted: %v.", i, acls)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %d: failed to load acl: %v.", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(acls, tt.acls) {
+			t.Errorf("test %d: acl mismatch: have %v, want %v.", i, acls, tt.acls)
+		}
+	}
+}
+
+// Tests that identities fall back to the default entry, if any.
+func TestLookupACL(t *testing.T) {
+	alice, fallback := &ACL{Tunnel: true}, &ACL{}
+
+	acls := map[string]*ACL{"alice": alice}
+	if acl, err := lookupACL(acls, "alice"); err != nil || acl != alice {
+		t.Errorf("own entry mismatch: have %v/%v, want %v.", acl, err, alice)
+	}
+	if acl, err := lookupACL(acls, "bob"); err == nil {
+		t.Errorf("missing entry found: %v.", acl)
+	}
+	acls["*"] = fallback
+	if acl, err := lookupACL(acls, "bob"); err != nil || acl != fallback {
+		t.Errorf("default entry mismatch: have %v/%v, want %v.", acl, err, fallback)
+	}
+}
+
+var coversTests = []struct {
+	rule   string
+	topic  string
+	covers bool
+}{
+	// Exact rules
+	{"news", "news", true},
+	{"news", "sports", false},
+	{"news/tech", "news/tech", true},
+	{"news/tech", "news", false},
+	{"news", "news/tech", false},
+
+	// Single level wildcards
+	{"news/+", "news/tech", true},
+	{"news/+", "news", false},
+	{"news/+", "news/tech/go", false},
+	{"+/tech", "news/tech", true},
+	{"news/+", "news/+", true},
+	{"news/+", "news/#", false},
+
+	// Multi level wildcards
+	{"#", "news", true},
+	{"news/#", "news/tech/go", true},
+	{"news/#", "news/#", true},
+	{"news/#", "news/+", true},
+	{"news/#", "sports/tech", false},
+	{"news/tech/#", "news/#", false},
+	{"news/+/#", "news/tech/go", true},
+
+	// Patterns wider than the rule
+	{"news/tech", "news/+", false},
+	{"news/tech", "news/#", false},
+}
+
+// Tests the wildcard rules covering topics and patterns.
+func TestCovers(t *testing.T) {
+	for i, tt := range coversTests {
+		if have := covers(tt.rule, tt.topic); have != tt.covers {
+			t.Errorf("test %d: coverage mismatch for rule %q, topic %q: have %v, want %v.", i, tt.rule, tt.topic, have, tt.covers)
+		}
+	}
+}
+
+// Tests the permission checks, including the unrestricted nil lists.
+func TestACLPermissions(t *testing.T) {
+	acl := &ACL{
+		Clusters:  []string{"app"},
+		Subscribe: []string{"news/#"},
+		Publish:   []string{"chat/+"},
+	}
+	if !acl.joinable("app") || acl.joinable("web") {
+		t.Errorf("join permission mismatch.")
+	}
+	if !acl.subscribable("news/tech") || acl.subscribable("chat/alice") {
+		t.Errorf("subscribe permission mismatch.")
+	}
+	if !acl.publishable("chat/alice") || acl.publishable("news/tech") {
+		t.Errorf("publish permission mismatch.")
+	}
+	if acl.tunnelable() {
+		t.Errorf("tunnel permission mismatch.")
+	}
+	var unrestricted *ACL
+	if !unrestricted.joinable("web") || !unrestricted.subscribable("#") || !unrestricted.publishable("chat") || !unrestricted.tunnelable() {
+		t.Errorf("nil acl restricted.")
+	}
+}
+
+// Tests that the access control lists are enforced by the relay over the live
+// protocol: joining, subscribing, publishing and tunneling.
+func TestACLEnforcement(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	creds := map[string]*Credential{
+		"alice": {Secret: []byte("s3cret")},
+		"bob":   {Secret: []byte("hunter2")},
+	}
+	acls := map[string]*ACL{
+		"alice": {
+			Clusters:  []string{"acl-test"},
+			Subscribe: []string{"news/#"},
+			Publish:   []string{"news/tech"},
+		},
+		"bob": {Clusters: []string{"other"}},
+	}
+	rel, stop := startRelay(t, WithAuth(creds), WithACL(acls))
+	defer stop()
+
+	// Make sure clients cannot join clusters not in their lists
+	bob := pipeRelay(rel)
+	defer bob.conn.Close()
+
+	if err := bob.login(relayVersionV2, "acl-test", "bob", []byte("hunter2")); err == nil {
+		t.Fatalf("forbidden cluster joined.")
+	}
+	// Join a permitted cluster and check the operation permissions
+	alice := pipeRelay(rel)
+	defer alice.conn.Close()
+
+	if err := alice.login(relayVersionV2, "acl-test", "alice", []byte("s3cret")); err != nil {
+		t.Fatalf("failed to join permitted cluster: %v.", err)
+	}
+	alice.conn.SetDeadline(time.Now().Add(time.Second))
+	if err := alice.send(opSub, "chat/alice"); err != nil {
+		t.Fatalf("failed to send subscription: %v.", err)
+	}
+	if err := alice.expectDenied(opSub, 0, "chat/alice"); err != nil {
+		t.Fatalf("forbidden subscription: %v.", err)
+	}
+	if err := alice.send(opPub, "news/sports", []byte("goal")); err != nil {
+		t.Fatalf("failed to send publish: %v.", err)
+	}
+	if err := alice.expectDenied(opPub, 0, "news/sports"); err != nil {
+		t.Fatalf("forbidden publish: %v.", err)
+	}
+	if err := alice.send(opTunReq, 7, "acl-test", 16, 100); err != nil {
+		t.Fatalf("failed to send tunnel request: %v.", err)
+	}
+	if err := alice.expectDenied(opTunReq, 7, ""); err != nil {
+		t.Fatalf("forbidden tunnel: %v.", err)
+	}
+	// Make sure the permitted operations go through
+	if err := alice.send(opSub, "news/#"); err != nil {
+		t.Fatalf("failed to send subscription: %v.", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := alice.send(opPub, "news/tech", []byte("release")); err != nil {
+		t.Fatalf("failed to send publish: %v.", err)
+	}
+	if err := alice.expect(opPub); err != nil {
+		t.Fatalf("failed to receive permitted publish: %v.", err)
+	}
+	if topic, err := alice.recvString(); err != nil || topic != "news/#" {
+		t.Fatalf("subscription mismatch: have %v/%v, want %v.", topic, err, "news/#")
+	}
+	if msg, err := alice.recvBinary(); err != nil || string(msg) != "release" {
+		t.Fatalf("message mismatch: have %s/%v, want %s.", msg, err, "release")
+	}
+}
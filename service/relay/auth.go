@@ -0,0 +1,132 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the client authentication of the relay. If credentials are configured,
+// the relay answers the init request of a client with a random challenge, which
+// the client must sign with the secret of one of the credentials (HMAC-SHA256),
+// sending back the credential id and the signature. Each credential restricts
+// the clusters its clients may join as.
+
+package relay
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Size of the random challenge sent to the authenticating clients.
+const authNonceSize = 32
+
+// Pre-shared credential of relay clients, along with its permissions.
+type Credential struct {
+	Secret   []byte   // Secret key signing the authentication challenges
+	Clusters []string // Clusters allowed to join as (empty or "*" for any)
+}
+
+// Requires the clients to authenticate with one of the credentials, keyed by id,
+// before being admitted into the Iris network.
+func WithAuth(creds map[string]*Credential) Option {
+	return func(r *Relay) {
+		r.creds = creds
+	}
+}
+
+// Loads the relay credentials from a file, each non-empty line containing the id,
+// the secret and optionally the comma separated list of clusters permitted, all
+// separated by whitespace. Lines starting with a hash are comments.
+func LoadCredentials(path string) (map[string]*Credential, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	creds := make(map[string]*Credential)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("relay: invalid credential at line %d: have %d fields, want 2 or 3", line, len(fields))
+		}
+		if _, ok := creds[fields[0]]; ok {
+			return nil, fmt.Errorf("relay: duplicate credential at line %d: %s", line, fields[0])
+		}
+		cred := &Credential{Secret: []byte(fields[1])}
+		if len(fields) == 3 {
+			cred.Clusters = strings.Split(fields[2], ",")
+		}
+		creds[fields[0]] = cred
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+// Checks whether the credential permits joining the given cluster.
+func (c *Credential) permits(cluster string) bool {
+	if len(c.Clusters) == 0 {
+		return true
+	}
+	for _, allowed := range c.Clusters {
+		if allowed == "*" || allowed == cluster {
+			return true
+		}
+	}
+	return false
+}
+
+// Challenges the client to prove the possession of a credential permitting it
+// to join the requested cluster, returning the id of the credential.
+func (r *relay) authenticate(app string, creds map[string]*Credential) (string, error) {
+	nonce := make([]byte, authNonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	if err := r.sendAuth(nonce); err != nil {
+		return "", err
+	}
+	id, proof, err := r.procAuth()
+	if err != nil {
+		return "", err
+	}
+	cred, ok := creds[id]
+	if !ok {
+		return "", fmt.Errorf("relay: authentication failed: unknown credential: %s", id)
+	}
+	mac := hmac.New(sha256.New, cred.Secret)
+	mac.Write(nonce)
+	if !hmac.Equal(proof, mac.Sum(nil)) {
+		return "", fmt.Errorf("relay: authentication failed: invalid proof for credential: %s", id)
+	}
+	if !cred.permits(app) {
+		return "", fmt.Errorf("relay: authentication failed: credential %s may not join %s", id, app)
+	}
+	return id, nil
+}
@@ -0,0 +1,225 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package relay
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Writes the contents into a temporary file, returning its path and a cleanup
+// function removing it.
+func writeTempFile(t *testing.T, contents string) (string, func()) {
+	dir, err := ioutil.TempDir("", "iris-relay")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v.", err)
+	}
+	path := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("failed to write temporary file: %v.", err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+// Signs an authentication challenge with a credential secret.
+func signNonce(secret, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+var loadCredentialsTests = []struct {
+	contents string
+	creds    map[string]*Credential
+	fail     bool
+}{
+	// Comments, empty lines and optional cluster lists
+	{
+		contents: "# comment\n\nalice s3cret\n  bob hunter2 app,web  \n",
+		creds: map[string]*Credential{
+			"alice": {Secret: []byte("s3cret")},
+			"bob":   {Secret: []byte("hunter2"), Clusters: []string{"app", "web"}},
+		},
+	},
+	// Wildcard cluster list
+	{
+		contents: "carol pass *\n",
+		creds:    map[string]*Credential{"carol": {Secret: []byte("pass"), Clusters: []string{"*"}}},
+	},
+	// Missing secret
+	{contents: "alice\n", fail: true},
+	// Too many fields
+	{contents: "alice s3cret app extra\n", fail: true},
+	// Duplicate id
+	{contents: "alice s3cret\nalice other\n", fail: true},
+}
+
+// Tests the parsing of the credential files.
+func TestLoadCredentials(t *testing.T) {
+	for i, tt := range loadCredentialsTests {
+		path, cleanup := writeTempFile(t, tt.contents)
+		creds, err := LoadCredentials(path)
+		cleanup()
+
+		if tt.fail {
+			if err == nil {
+				t.Errorf("test %d: invalid credentials accepted: %v.", i, creds)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %d: failed to load credentials: %v.", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(creds, tt.creds) {
+			t.Errorf("test %d: credential mismatch: have %v, want %v.", i, creds, tt.creds)
+		}
+	}
+	if _, err := LoadCredentials(filepath.Join(os.TempDir(), "iris-relay-missing")); err == nil {
+		t.Errorf("missing credential file accepted.")
+	}
+}
+
+var permitsTests = []struct {
+	clusters []string
+	cluster  string
+	permits  bool
+}{
+	{nil, "app", true},
+	{[]string{"*"}, "app", true},
+	{[]string{"web", "app"}, "app", true},
+	{[]string{"web"}, "app", false},
+	{[]string{"app"}, "app@other", false},
+}
+
+// Tests the cluster restrictions of the credentials.
+func TestCredentialPermits(t *testing.T) {
+	for i, tt := range permitsTests {
+		cred := &Credential{Clusters: tt.clusters}
+		if have := cred.permits(tt.cluster); have != tt.permits {
+			t.Errorf("test %d: permission mismatch for %q in %v: have %v, want %v.", i, tt.cluster, tt.clusters, have, tt.permits)
+		}
+	}
+}
+
+// Runs the authentication of a relay over an in-memory pipe, answering the
+// challenge with the proof computed by sign from the nonce. The nonce and the
+// result of the authentication are returned.
+func runAuth(t *testing.T, creds map[string]*Credential, app, id string, sign func([]byte) []byte) ([]byte, string, error) {
+	server, conn := net.Pipe()
+	defer conn.Close()
+
+	rel := new(Relay).newRelay(server, nil)
+	defer rel.close()
+
+	type result struct {
+		ident string
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		ident, err := rel.authenticate(app, creds)
+		done <- result{ident, err}
+	}()
+	client := newTestClient(conn)
+	if err := client.expect(opAuth); err != nil {
+		t.Fatalf("failed to retrieve challenge: %v.", err)
+	}
+	nonce, err := client.recvBinary()
+	if err != nil {
+		t.Fatalf("failed to retrieve nonce: %v.", err)
+	}
+	if err := client.send(opAuth, id, sign(nonce)); err != nil {
+		t.Fatalf("failed to send proof: %v.", err)
+	}
+	res := <-done
+	return nonce, res.ident, res.err
+}
+
+// Tests that the authentication admits only valid, fresh proofs of credentials
+// permitting the requested cluster.
+func TestAuthenticate(t *testing.T) {
+	creds := map[string]*Credential{
+		"alice": {Secret: []byte("s3cret")},
+		"bob":   {Secret: []byte("hunter2"), Clusters: []string{"web"}},
+	}
+	tests := []struct {
+		app  string
+		id   string
+		sign func([]byte) []byte
+		fail bool
+	}{
+		// Valid proofs
+		{"app", "alice", func(nonce []byte) []byte { return signNonce([]byte("s3cret"), nonce) }, false},
+		{"web", "bob", func(nonce []byte) []byte { return signNonce([]byte("hunter2"), nonce) }, false},
+
+		// Unknown credential
+		{"app", "carol", func(nonce []byte) []byte { return signNonce([]byte("s3cret"), nonce) }, true},
+
+		// Wrong secret and malformed proof
+		{"app", "alice", func(nonce []byte) []byte { return signNonce([]byte("hunter2"), nonce) }, true},
+		{"app", "alice", func(nonce []byte) []byte { return nil }, true},
+
+		// Cluster not permitted by the credential
+		{"app", "bob", func(nonce []byte) []byte { return signNonce([]byte("hunter2"), nonce) }, true},
+	}
+	for i, tt := range tests {
+		_, ident, err := runAuth(t, creds, tt.app, tt.id, tt.sign)
+		if tt.fail {
+			if err == nil {
+				t.Errorf("test %d: invalid authentication accepted.", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %d: failed to authenticate: %v.", i, err)
+		} else if ident != tt.id {
+			t.Errorf("test %d: identity mismatch: have %v, want %v.", i, ident, tt.id)
+		}
+	}
+}
+
+// Tests that a proof captured from one session cannot be replayed in another.
+func TestAuthenticateReplay(t *testing.T) {
+	creds := map[string]*Credential{"alice": {Secret: []byte("s3cret")}}
+
+	var captured []byte
+	nonce, _, err := runAuth(t, creds, "app", "alice", func(nonce []byte) []byte {
+		captured = signNonce([]byte("s3cret"), nonce)
+		return captured
+	})
+	if err != nil {
+		t.Fatalf("failed to authenticate: %v.", err)
+	}
+	replay, _, err := runAuth(t, creds, "app", "alice", func([]byte) []byte { return captured })
+	if hmac.Equal(nonce, replay) {
+		t.Fatalf("challenge reused across sessions: %x.", nonce)
+	}
+	if err == nil {
+		t.Fatalf("replayed proof accepted.")
+	}
+}
@@ -0,0 +1,137 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the graceful shutdown of the relay. Instead of dropping the clients,
+// the relay stops accepting connections, notifies each client with the reason of
+// the shutdown (delivered to its drop handler) and refuses its new operations,
+// while the in-flight requests and tunnels get a bounded time to finish. Each
+// client is then sent a close notification and disconnected.
+
+package relay
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Interval of checking whether the tunnels of a draining client closed.
+var drainPoll = 50 * time.Millisecond
+
+// Shutdown request to the acceptor.
+type shutdown struct {
+	reason string     // Reason of the shutdown to notify the clients with
+	errc   chan error // Channel to report the listener closure results on
+}
+
+// Gracefully terminates the relaying service: new connections are refused and
+// the clients notified of the shutdown with the given reason, after which they
+// are disconnected once their in-flight requests and tunnels finish, bounded by
+// config.RelayDrainTimeout.
+func (r *Relay) Drain(reason string) error {
+	errc := make(chan error, 1)
+	r.shut <- &shutdown{reason: reason, errc: errc}
+	return <-errc
+}
+
+// Checks whether the client is being drained.
+func (r *relay) draining() bool {
+	select {
+	case <-r.drain:
+		return true
+	default:
+		return false
+	}
+}
+
+// Checks whether the drain of the client finished.
+func (r *relay) drainDone() bool {
+	select {
+	case <-r.drained:
+		return true
+	default:
+		return false
+	}
+}
+
+// Checks whether a new operation of the client needs to be refused due to a
+// drain, counting and logging the refusal if so.
+func (r *relay) refused(op string, kind string, target string, size int) bool {
+	if !r.draining() {
+		return false
+	}
+	r.count(&r.stats.Refusals, 1, MetricRelayRefused)
+	r.logOp(op, kind, target, size, time.Now(), outcomeRefused)
+	return true
+}
+
+// Drains the client: it is notified of the shutdown, its new operations refused
+// and the in-flight ones waited for till the drain timeout, after which the Iris
+// connection is closed, the client sent a close notification and its reader
+// stopped. The tunnels still open and the inbound requests still unanswered at
+// the deadline are aborted.
+func (r *relay) shutdown(reason string) {
+	// Start the drain, unless the client is already terminating
+	r.drainLock.Lock()
+	if r.exiting {
+		r.drainLock.Unlock()
+		return
+	}
+	close(r.drain)
+	r.drainLock.Unlock()
+
+	if err := r.sendDrain(reason); err != nil {
+		log.Printf("relay: drain notification error: %v.", err)
+	}
+	deadline := time.Now().Add(config.RelayDrainTimeout)
+	expiry := time.AfterFunc(config.RelayDrainTimeout, func() { close(r.expire) })
+	defer expiry.Stop()
+
+	// Wait for the client to close its tunnels (or to disconnect)
+	ticker := time.NewTicker(drainPoll)
+	for atomic.LoadInt32(&r.tunOut) > 0 && time.Now().Before(deadline) {
+		select {
+		case <-ticker.C:
+		case <-r.term:
+			deadline = time.Now()
+		}
+	}
+	ticker.Stop()
+
+	r.tunLock.RLock()
+	tunIds := make([]uint64, 0, len(r.tunLive))
+	for tunId, _ := range r.tunLive {
+		tunIds = append(tunIds, tunId)
+	}
+	r.tunLock.RUnlock()
+	for _, tunId := range tunIds {
+		r.handleTunnelClose(tunId, true)
+	}
+	// Let the in-flight requests finish in the remaining time and disconnect
+	if err := r.iris.Drain(time.Until(deadline)); err != nil {
+		log.Printf("relay: client drain failed: %v.", err)
+	}
+	if err := r.sendClose(); err != nil {
+		log.Printf("relay: drain close notification error: %v.", err)
+	}
+	close(r.drained)
+	r.sock.SetReadDeadline(time.Now())
+}
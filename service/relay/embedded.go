@@ -0,0 +1,131 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the embedded connections of the relay: applications running inside
+// the node's process attach to the Iris networks served by the relay directly,
+// bypassing the relay protocol and its loopback socket. Otherwise they behave as
+// the relay clients do: the clusters are resolved to overlays the same way, the
+// same rate limits apply, and the connections are drained or closed along with
+// the clients when the relay terminates, the reason being delivered to the
+// handler's HandleDrop.
+
+package relay
+
+import (
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto/iris"
+)
+
+// Reason of the drop reported to the embedded connections on termination.
+var errTerminated = errors.New("relay: terminated")
+
+// Handler of a relayed connection's termination by the relay, optionally
+// implemented by the handlers of the embedded connections.
+type DropHandler interface {
+	// Handles the termination of the connection by the relay, with the reason of
+	// it. Called before the connection is drained or closed.
+	HandleDrop(reason error)
+}
+
+// Connects an in-process application to the Iris network, joining the cluster
+// (qualified as cluster@overlay for the additional overlays) with the rate limits
+// of the relay clients, followed by any extra options. The connection may be
+// closed by the application any time, otherwise the relay closes it (or drains
+// it) on termination, notifying the handler if it implements DropHandler.
+func (r *Relay) Connect(app string, handler iris.ConnectionHandler, opts ...iris.ConnectionOption) (*iris.Connection, error) {
+	overlay, name, cluster, err := r.resolve(app)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(append([]iris.ConnectionOption{iris.WithRateLimits(relayLimits())}, r.reconnectOpts(name)...), opts...)
+	conn, err := overlay.Connect(cluster, handler, opts...)
+	if err != nil {
+		return nil, err
+	}
+	// Track the connection till either side terminates it
+	r.embedLock.Lock()
+	if r.embedDone {
+		r.embedLock.Unlock()
+		conn.Close()
+		return nil, iris.ErrTerminating
+	}
+	r.embeds[conn] = handler
+	r.embedLock.Unlock()
+
+	go func() {
+		<-conn.Done()
+
+		r.embedLock.Lock()
+		delete(r.embeds, conn)
+		r.embedLock.Unlock()
+	}()
+	return conn, nil
+}
+
+// Stops accepting embedded connections, returning the active ones.
+func (r *Relay) detach() map[*iris.Connection]iris.ConnectionHandler {
+	r.embedLock.Lock()
+	defer r.embedLock.Unlock()
+
+	r.embedDone = true
+	embeds := make(map[*iris.Connection]iris.ConnectionHandler, len(r.embeds))
+	for conn, handler := range r.embeds {
+		embeds[conn] = handler
+	}
+	return embeds
+}
+
+// Notifies the handler of an embedded connection of its drop, if it handles it.
+func notifyDrop(handler iris.ConnectionHandler, reason error) {
+	if dropper, ok := handler.(DropHandler); ok {
+		dropper.HandleDrop(reason)
+	}
+}
+
+// Closes the embedded connections, notifying them of the reason first.
+func closeEmbeds(embeds map[*iris.Connection]iris.ConnectionHandler, reason error) {
+	for conn, handler := range embeds {
+		notifyDrop(handler, reason)
+		if err := conn.Close(); err != nil && err != iris.ErrTerminating {
+			log.Printf("relay: embedded connection close failed: %v.", err)
+		}
+	}
+}
+
+// Drains the embedded connections concurrently, notifying them of the reason
+// first. The returned group waits for the drains to finish.
+func drainEmbeds(embeds map[*iris.Connection]iris.ConnectionHandler, reason error) *sync.WaitGroup {
+	pend := new(sync.WaitGroup)
+	for conn, handler := range embeds {
+		pend.Add(1)
+		go func(conn *iris.Connection, handler iris.ConnectionHandler) {
+			defer pend.Done()
+
+			notifyDrop(handler, reason)
+			if err := conn.Drain(config.RelayDrainTimeout); err != nil && err != iris.ErrTerminating {
+				log.Printf("relay: embedded connection drain failed: %v.", err)
+			}
+		}(conn, handler)
+	}
+	return pend
+}
@@ -34,25 +34,43 @@ import (
 // Forwards an app broadcast arriving from the Iris network to the attached app.
 // Any error is considered a protocol violation.
 func (r *relay) HandleBroadcast(msg []byte) {
-	if err := r.sendBroadcast(msg); err != nil {
+	start := time.Now()
+	err := r.sendBroadcast(msg)
+	if err != nil {
 		log.Printf("relay: broadcast forward error: %v.", err)
 		r.drop()
+	} else {
+		r.count(&r.stats.BroadcastsRecv, 1, MetricRelayBroadcastRecv)
 	}
+	r.logOp("broadcast-recv", "cluster", r.app, len(msg), start, outcome(err))
 }
 
 // Forwards an app broadcast from the attached relay to the Iris network. Any
-// error is considered a protocol violation.
+// error is considered a protocol violation, apart from exceeding the rate limit,
+// which drops the broadcast.
 func (r *relay) handleBroadcast(app string, msg []byte) {
-	if err := r.iris.Broadcast(app, msg); err != nil {
+	start := time.Now()
+	err := r.iris.Broadcast(app, msg)
+	r.logOp("broadcast", "cluster", app, len(msg), start, outcome(err))
+
+	if err == iris.ErrRateLimited {
+		log.Printf("relay: broadcast dropped: %v.", err)
+		r.count(&r.stats.Refusals, 1, MetricRelayRefused)
+	} else if err != nil {
 		log.Printf("relay: broadcast error: %v.", err)
 		r.drop()
+	} else {
+		r.count(&r.stats.BroadcastsSent, 1, MetricRelayBroadcastSent)
 	}
 }
 
 // Forwards a request arriving from the Iris network to the attached app. Also a
 // local timer is started to ensure a faulty client doesn't fill the node with
 // stale requests. Any error is considered a protocol violation.
-func (r *relay) HandleRequest(req []byte, timeout time.Duration) []byte {
+func (r *relay) HandleRequest(req []byte, timeout time.Duration) ([]byte, error) {
+	start, result := time.Now(), outcomeTimeout
+	defer func() { r.logOp("serve", "cluster", r.app, len(req), start, result) }()
+
 	// Create a reply channel for the results
 	r.reqLock.Lock()
 	reqCh := make(chan []byte, 1)
@@ -73,15 +91,23 @@ func (r *relay) HandleRequest(req []byte, timeout time.Duration) []byte {
 	if err := r.sendRequest(reqId, req); err != nil {
 		log.Printf("relay: request error: %v.", err)
 		r.drop()
+		result = outcomeFailed
+	} else {
+		r.count(&r.stats.RequestsServed, 1, MetricRelayRequestRecv)
 	}
 	// Retrieve the results or time out
 	select {
 	case <-r.term:
-		return nil
+		return nil, nil
+	case <-r.expire:
+		return nil, nil
 	case <-time.After(timeout):
-		return nil
+		return nil, nil
 	case rep := <-reqCh:
-		return rep
+		if result != outcomeFailed {
+			result = outcomeOk
+		}
+		return rep, nil
 	}
 }
 
@@ -89,13 +115,31 @@ func (r *relay) HandleRequest(req []byte, timeout time.Duration) []byte {
 // waits for a reply to arrive back which can be forwarded. If the request times
 // out, a reply is sent back accordingly.
 func (r *relay) handleRequest(app string, reqId uint64, req []byte, timeout time.Duration) {
-	if rep, err := r.iris.Request(app, req, timeout); err != nil {
+	defer release(&r.reqOut)
+
+	start := time.Now()
+	r.count(&r.stats.RequestsSent, 1, MetricRelayRequestSent)
+	rep, err := r.iris.Request(app, req, timeout)
+	r.logOp("request", "cluster", app, len(req), start, outcome(err))
+
+	if err != nil {
+		r.count(&r.stats.RequestsFailed, 1, MetricRelayRequestFailed)
 		r.sendReply(reqId, nil, true)
 	} else {
 		r.sendReply(reqId, rep, false)
 	}
 }
 
+// Health checks the Iris connection on behalf of the attached app, and sends the
+// measured latency back, or a timeout if the connection didn't respond in time.
+func (r *relay) handlePing(pingId uint64, timeout time.Duration) {
+	if latency, err := r.iris.Ping(timeout); err != nil {
+		r.sendPong(pingId, 0, true)
+	} else {
+		r.sendPong(pingId, latency, false)
+	}
+}
+
 // Forwards a reply arriving from the attached app to the Iris node by looking
 // up the pending request channel and if still live, inserting the results.
 func (r *relay) handleReply(reqId uint64, msg []byte) {
@@ -117,10 +161,15 @@ type subscriptionHandler struct {
 // Forwards the arriving event from the Iris network to the attached app. Any
 // error is considered a protocol violation.
 func (s *subscriptionHandler) HandleEvent(msg []byte) {
-	if err := s.relay.sendPublish(s.topic, msg); err != nil {
+	start := time.Now()
+	err := s.relay.sendPublish(s.topic, msg)
+	if err != nil {
 		log.Printf("relay: publish forward error: %v.", err)
 		s.relay.drop()
+	} else {
+		s.relay.count(&s.relay.stats.PublishesRecv, 1, MetricRelayPublishRecv)
 	}
+	s.relay.logOp("event", "topic", s.topic, len(msg), start, outcome(err))
 }
 
 // Forwards a subscription event arriving from the attached app to the Iris node
@@ -132,34 +181,100 @@ func (r *relay) handleSubscribe(topic string) {
 		relay: r,
 		topic: topic,
 	}
+	start := time.Now()
+
+	// Reject the subscription if not permitted
+	if !r.acl.subscribable(topic) {
+		r.logOp("subscribe", "topic", topic, 0, start, outcomeRefused)
+		if err := r.sendDenied(opSub, 0, topic); err != nil {
+			log.Printf("relay: subscription denial notification error: %v.", err)
+			r.drop()
+		}
+		return
+	}
+	// Reserve the subscription slot, rejecting it if over quota
+	r.subLock.Lock()
+	if quota := config.RelaySubscriptionQuota; quota > 0 && len(r.subLive) >= quota {
+		r.subLock.Unlock()
+		r.logOp("subscribe", "topic", topic, 0, start, outcomeRefused)
+		if err := r.sendQuota(opSub, 0, topic); err != nil {
+			log.Printf("relay: subscription quota notification error: %v.", err)
+			r.drop()
+		}
+		return
+	}
+	r.subLive[topic] = struct{}{}
+	r.subLock.Unlock()
+
 	// Subscribe and drop conenction in case of an error
-	if err := r.iris.Subscribe(topic, handler); err != nil {
+	err := r.iris.Subscribe(topic, handler)
+	r.logOp("subscribe", "topic", topic, 0, start, outcome(err))
+	if err != nil {
 		log.Printf("relay: subscription error: %v.", err)
 		r.drop()
+
+		r.subLock.Lock()
+		delete(r.subLive, topic)
+		r.subLock.Unlock()
 	}
 }
 
 // Forwards a publish event arriving from the attached app to the Iris node. Any
-// error is considered a protocol violation.
+// error is considered a protocol violation, apart from exceeding the rate limit,
+// which drops the event. Topics not permitted by the ACL are refused.
 func (r *relay) handlePublish(topic string, msg []byte) {
-	if err := r.iris.Publish(topic, msg); err != nil {
+	start := time.Now()
+	if !r.acl.publishable(topic) {
+		r.logOp("publish", "topic", topic, len(msg), start, outcomeRefused)
+		if err := r.sendDenied(opPub, 0, topic); err != nil {
+			log.Printf("relay: publish denial notification error: %v.", err)
+			r.drop()
+		}
+		return
+	}
+	err := r.iris.Publish(topic, msg)
+	r.logOp("publish", "topic", topic, len(msg), start, outcome(err))
+
+	if err == iris.ErrRateLimited {
+		log.Printf("relay: publish dropped: %v.", err)
+		r.count(&r.stats.Refusals, 1, MetricRelayRefused)
+	} else if err != nil {
 		log.Printf("relay: publish error: %v.", err)
 		r.drop()
+	} else {
+		r.count(&r.stats.PublishesSent, 1, MetricRelayPublishSent)
 	}
 }
 
 // Forwards a subscription removel request arriving from the attached app to the
 // Iris node. Any error is considered a protocol violation.
 func (r *relay) handleUnsubscribe(topic string) {
-	if err := r.iris.Unsubscribe(topic); err != nil {
+	start := time.Now()
+	err := r.iris.Unsubscribe(topic)
+	r.logOp("unsubscribe", "topic", topic, 0, start, outcome(err))
+	if err != nil {
 		log.Printf("relay: unsubscription error: %v.", err)
 		r.drop()
+		return
 	}
+	r.subLock.Lock()
+	delete(r.subLive, topic)
+	r.subLock.Unlock()
 }
 
 // Forwards a tunneling request from the Iris network to the attached app. If no
 // reply comes within some alloted time, the tunnel and connection are dropped.
 func (r *relay) HandleTunnel(tun *iris.Tunnel) {
+	start := time.Now()
+
+	// Refuse the tunnel if the app already has its quota
+	if !reserve(&r.tunOut, config.RelayTunnelQuota) {
+		r.logOp("accept", "cluster", r.app, 0, start, outcomeRefused)
+		log.Printf("relay: inbound tunnel refused: quota exceeded.")
+		r.count(&r.stats.Refusals, 1, MetricRelayRefused)
+		tun.Close()
+		return
+	}
 	// Allocate a temporary tunnel id
 	r.tunLock.Lock()
 	tmpId := r.tunIdx
@@ -180,12 +295,14 @@ func (r *relay) HandleTunnel(tun *iris.Tunnel) {
 		// Tunneling timed out, protocol violation
 		log.Printf("relay: tunnel request timed out.")
 		r.drop()
+		r.logOp("accept", "cluster", r.app, 0, start, outcomeTimeout)
 	case <-initChan:
 		// Tunnel initialized, release timer
 		r.tunLock.Lock()
 		delete(r.tunInit, tmpId)
 		delete(r.tunPend, tmpId)
 		r.tunLock.Unlock()
+		r.logOp("accept", "cluster", r.app, 0, start, outcomeOk)
 	}
 }
 
@@ -194,8 +311,11 @@ func (r *relay) HandleTunnel(tun *iris.Tunnel) {
 // back to the application.
 func (r *relay) handleTunnelRequest(tunId uint64, app string, buf int, timeout time.Duration) {
 	// Create the tunnel
+	start := time.Now()
 	tun, err := r.iris.Tunnel(app, timeout)
+	r.logOp("tunnel", "cluster", app, 0, start, outcome(err))
 	if err != nil {
+		release(&r.tunOut)
 		if err := r.sendTunnelReply(tunId, 0, true); err != nil {
 			log.Printf("relay: tunnel timeout notification error: %v.", err)
 			r.drop()
@@ -256,6 +376,8 @@ func (r *relay) handleTunnelRecv(tunId uint64, msg []byte) {
 	if err := r.sendTunnelData(tunId, msg); err != nil {
 		log.Printf("relay: tunnel recv failed: %v.", err)
 		r.drop()
+	} else {
+		r.count(&r.stats.TunnelBytesRecv, uint64(len(msg)), MetricRelayTunnelRecv)
 	}
 }
 
@@ -282,6 +404,8 @@ func (r *relay) handleTunnelClose(tunId uint64, local bool) {
 	r.tunLock.Unlock()
 
 	if ok {
+		release(&r.tunOut)
+
 		// In case of a local close, signal the remote endpoint
 		if local {
 			go tun.tun.Close()
@@ -0,0 +1,111 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the length-prefixed framing of the v2 relay protocol. Clients opt in
+// by announcing the v2 version in the (unframed) init message, after which every
+// message in both directions is wrapped into a frame: the varint size of the body
+// followed by the body itself, the explicit opcode and the same fields as in v1.
+// Each frame is read in full before being parsed, so bindings can split the stream
+// without understanding the individual messages.
+
+package relay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Relay protocol version using length-prefixed frames.
+var relayVersionV2 = "v2.0"
+
+// Maximum body size of an inbound frame, protecting against huge allocations.
+const frameLimit = 1 << 26
+
+// Destination of the serialized message fields.
+type sink interface {
+	io.Writer
+	io.ByteWriter
+}
+
+// Origin of the deserialized message fields.
+type source interface {
+	io.Reader
+	io.ByteReader
+}
+
+// Returns the writer the message fields should be serialized into: the message
+// being assembled for the outbound queue.
+func (r *relay) sink() sink {
+	return &r.frameOut
+}
+
+// Returns the reader the message fields should be deserialized from: the frame
+// being parsed in v2, the socket buffer otherwise.
+func (r *relay) source() source {
+	if r.frameIn != nil {
+		return r.frameIn
+	}
+	return r.sockBuf
+}
+
+// Retrieves the assembled outbound message, prefixed by its size if framing was
+// negotiated, and resets the assembly buffer.
+func (r *relay) assemble() []byte {
+	defer r.frameOut.Reset()
+
+	if !r.framed {
+		return append([]byte(nil), r.frameOut.Bytes()...)
+	}
+	var size [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(size[:], uint64(r.frameOut.Len()))
+
+	msg := make([]byte, 0, n+r.frameOut.Len())
+	return append(append(msg, size[:n]...), r.frameOut.Bytes()...)
+}
+
+// Reads the next whole frame from the socket if framing was negotiated, making
+// it the source of the subsequent field reads.
+func (r *relay) recvFrame() error {
+	if !r.framed {
+		return nil
+	}
+	size, err := binary.ReadUvarint(r.sockBuf)
+	if err != nil {
+		return err
+	}
+	if size > frameLimit {
+		return fmt.Errorf("relay: protocol violation: frame too large: have %v, limit %v", size, frameLimit)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r.sockBuf, body); err != nil {
+		return err
+	}
+	r.frameIn = bytes.NewReader(body)
+	return nil
+}
+
+// Checks that the current frame was consumed in full by the message parser.
+func (r *relay) recvFrameEnd() error {
+	if r.frameIn != nil && r.frameIn.Len() > 0 {
+		return fmt.Errorf("relay: protocol violation: %d trailing bytes in frame", r.frameIn.Len())
+	}
+	return nil
+}
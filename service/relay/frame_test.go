@@ -0,0 +1,174 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package relay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Creates a relay over an in-memory pipe with the framing set as requested,
+// returning the client end too.
+func framedPipe(framed bool) (*relay, net.Conn) {
+	server, client := net.Pipe()
+	rel := new(Relay).newRelay(server, nil)
+	rel.framed = framed
+	return rel, client
+}
+
+// Tests that outbound messages are prefixed with their varint size only if the
+// framing was negotiated.
+func TestAssemble(t *testing.T) {
+	for _, size := range []int{0, 1, 127, 128, 300, 1 << 16} {
+		body := bytes.Repeat([]byte{0x42}, size)
+		for _, framed := range []bool{false, true} {
+			rel, client := framedPipe(framed)
+
+			rel.frameOut.Write(body)
+			msg := rel.assemble()
+			if rel.frameOut.Len() != 0 {
+				t.Errorf("size %d, framed %v: assembly buffer not reset.", size, framed)
+			}
+			want := body
+			if framed {
+				var prefix [binary.MaxVarintLen64]byte
+				want = append(prefix[:binary.PutUvarint(prefix[:], uint64(size))], body...)
+			}
+			if !bytes.Equal(msg, want) {
+				t.Errorf("size %d, framed %v: message mismatch: have %d bytes, want %d.", size, framed, len(msg), len(want))
+			}
+			rel.close()
+			client.Close()
+		}
+	}
+}
+
+// Tests that inbound frames are read in full, with the ones above the limit and
+// truncated ones rejected.
+func TestRecvFrame(t *testing.T) {
+	tests := []struct {
+		stream []byte
+		body   []byte
+		fail   bool
+	}{
+		{stream: []byte{0x00}, body: []byte{}},
+		{stream: []byte{0x03, opPing, 0x01, 0x02}, body: []byte{opPing, 0x01, 0x02}},
+		{stream: append([]byte{0x80, 0x01}, bytes.Repeat([]byte{0x7}, 128)...), body: bytes.Repeat([]byte{0x7}, 128)},
+		{stream: encode(uint64(frameLimit + 1)), fail: true},
+		{stream: encode(uint64(1 << 62)), fail: true},
+		{stream: []byte{0x05, opPing, 0x01}, fail: true},
+	}
+	for i, tt := range tests {
+		rel, client := framedPipe(true)
+		go func() {
+			client.Write(tt.stream)
+			client.Close()
+		}()
+		err := rel.recvFrame()
+		switch {
+		case tt.fail && err == nil:
+			t.Errorf("test %d: invalid frame accepted.", i)
+		case !tt.fail && err != nil:
+			t.Errorf("test %d: failed to read frame: %v.", i, err)
+		case !tt.fail:
+			body, _ := io.ReadAll(rel.frameIn)
+			if !bytes.Equal(body, tt.body) {
+				t.Errorf("test %d: frame body mismatch: have %x, want %x.", i, body, tt.body)
+			}
+		}
+		rel.close()
+	}
+}
+
+// Tests that frames not consumed in full by the message parser are rejected, and
+// that unframed streams are never checked.
+func TestRecvFrameEnd(t *testing.T) {
+	rel := new(relay)
+	if err := rel.recvFrameEnd(); err != nil {
+		t.Errorf("unframed stream rejected: %v.", err)
+	}
+	rel.frameIn = bytes.NewReader([]byte{0x01, 0x02})
+	rel.frameIn.ReadByte()
+	if err := rel.recvFrameEnd(); err == nil {
+		t.Errorf("trailing bytes accepted.")
+	}
+	rel.frameIn.ReadByte()
+	if err := rel.recvFrameEnd(); err != nil {
+		t.Errorf("consumed frame rejected: %v.", err)
+	}
+}
+
+// Tests the negotiation of the protocol version in the init exchange, and that
+// framed messages with trailing bytes drop the connection.
+func TestFrameNegotiation(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	rel, stop := startRelay(t)
+	defer stop()
+
+	// Unframed v1 replies are a bare opcode
+	v1 := pipeRelay(rel)
+	defer v1.conn.Close()
+
+	v1.conn.SetDeadline(time.Now().Add(time.Second))
+	if err := v1.sendInit(relayVersion, "frame-test"); err != nil {
+		t.Fatalf("failed to send v1 init: %v.", err)
+	}
+	reply := make([]byte, 1)
+	if _, err := io.ReadFull(v1.reader, reply); err != nil || reply[0] != opInit {
+		t.Fatalf("v1 init reply mismatch: have %x/%v, want %x.", reply, err, []byte{opInit})
+	}
+	// Framed v2 replies are prefixed with their size
+	v2 := pipeRelay(rel)
+	defer v2.conn.Close()
+
+	v2.conn.SetDeadline(time.Now().Add(time.Second))
+	if err := v2.sendInit(relayVersionV2, "frame-test"); err != nil {
+		t.Fatalf("failed to send v2 init: %v.", err)
+	}
+	reply = make([]byte, 2)
+	if _, err := io.ReadFull(v2.reader, reply); err != nil || !bytes.Equal(reply, []byte{0x01, opInit}) {
+		t.Fatalf("v2 init reply mismatch: have %x/%v, want %x.", reply, err, []byte{0x01, opInit})
+	}
+	// Unknown versions get refused
+	v3 := pipeRelay(rel)
+	defer v3.conn.Close()
+
+	if err := v3.sendInit("v3.0", "frame-test"); err != nil {
+		t.Fatalf("failed to send v3 init: %v.", err)
+	}
+	if err := v3.waitClose(time.Second); err != nil {
+		t.Fatalf("unknown version accepted: %v.", err)
+	}
+	// Frames with trailing bytes are protocol violations
+	msg := append(encode(opPing, 1, 1000), 0xff)
+	if _, err := v2.conn.Write(append(encode(len(msg)), msg...)); err != nil {
+		t.Fatalf("failed to send ping: %v.", err)
+	}
+	if err := v2.waitClose(time.Second); err != nil {
+		t.Fatalf("trailing bytes accepted: %v.", err)
+	}
+}
@@ -0,0 +1,301 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the handoff of the relay to a successor process, upgrading the node
+// binary without disconnecting the attached clients. The successor opens its own
+// listeners alongside the running ones (the ports being shared), and signals its
+// readiness over a Unix socket. The predecessor then stops accepting, pauses each
+// client between two messages, lets its in-flight requests finish and passes the
+// socket, along with the unparsed input and session state, to the successor,
+// which rejoins the Iris network and resubscribes on the client's behalf.
+//
+// Only plain TCP and Unix domain socket clients can be handed off: the WebSocket
+// and TLS ones carry protocol state that cannot leave the process, so they are
+// disconnected like on termination. Tunnels are closed during the handoff, as are
+// the inbound requests still waiting for a reply.
+
+package relay
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Returned by the readers of a relay paused for a handoff.
+var errHandoff = errors.New("relay: handed off")
+
+// Message signaling a successor's readiness to take over the clients.
+var handoffReady = []byte("ready")
+
+// State of a client session, passed to the successor process with its socket.
+type session struct {
+	Cluster  string   // Cluster joined, qualified with the overlay name if not the default
+	Ident    string   // Credential id the client authenticated with
+	Framed   bool     // Whether the v2 framing was negotiated
+	Topics   []string // Topics subscribed to
+	Buffered []byte   // Inbound data already read from the socket but not parsed
+}
+
+// Takes over the clients of a predecessor relay through the handoff socket once
+// booted, instead of only accepting new ones.
+func WithHandoff(conn *net.UnixConn) Option {
+	return func(r *Relay) {
+		r.handoff = conn
+	}
+}
+
+// Wraps an inherited handoff socket (the successor's end of a pair created with
+// NewHandoffPair) into a connection.
+func HandoffConn(file *os.File) (*net.UnixConn, error) {
+	conn, err := net.FileConn(file)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+
+	unix, ok := conn.(*net.UnixConn)
+	if !ok {
+		conn.Close()
+		return nil, errors.New("relay: handoff socket is not a unix socket")
+	}
+	return unix, nil
+}
+
+// Hands the clients over to a successor process on the other end of the handoff
+// socket, waiting for it to become ready first. If the successor fails before
+// that, the error is returned and the relay keeps serving. Otherwise the relay is
+// terminated, with sessions failing the transfer dropped and logged.
+func (r *Relay) Handoff(conn *net.UnixConn) error {
+	defer conn.Close()
+
+	buf := make([]byte, len(handoffReady))
+	if n, err := conn.Read(buf); err != nil {
+		return err
+	} else if string(buf[:n]) != string(handoffReady) {
+		return errors.New("relay: successor not ready")
+	}
+	errc := make(chan error, 1)
+	r.hand <- &handoff{conn: conn, errc: errc}
+	return <-errc
+}
+
+// Handoff request to the acceptor.
+type handoff struct {
+	conn *net.UnixConn // Socket to pass the sessions through
+	errc chan error    // Channel to report the listener closure results on
+}
+
+// Reader of a client socket which a handoff may pause between two messages. A
+// read deadline interrupts the blocked reader, but if the parser is in the middle
+// of a message, it is cleared and the read retried till the message completes.
+type pausable struct {
+	rel *relay
+}
+
+// Reads from the client socket, retrying interruptions inside a message.
+func (p *pausable) Read(data []byte) (int, error) {
+	for {
+		n, err := p.rel.sock.Read(data)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && p.rel.midMsg && p.rel.paused() {
+			p.rel.sock.SetReadDeadline(time.Time{})
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+// Checks whether the client was requested to pause for a handoff.
+func (r *relay) paused() bool {
+	select {
+	case <-r.pause:
+		return true
+	default:
+		return false
+	}
+}
+
+// Waits for the next inbound message to start arriving, returning errHandoff
+// instead if the client is paused for a handoff in the meantime.
+func (r *relay) recvNext() error {
+	if r.paused() {
+		return errHandoff
+	}
+	if _, err := r.sockBuf.Peek(1); err != nil {
+		if r.paused() {
+			return errHandoff
+		}
+		return err
+	}
+	return nil
+}
+
+// Checks whether the client's socket can be passed to another process: only
+// plain TCP and Unix domain socket ones can.
+func (r *relay) transferable() bool {
+	switch r.sock.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		return true
+	}
+	return false
+}
+
+// Requests the client's reader to stop at the next message boundary.
+func (r *relay) suspendRead() {
+	close(r.pause)
+	r.sock.SetReadDeadline(time.Now())
+}
+
+// Finishes the work of a client paused for a handoff: the already scheduled
+// messages are processed, the tunnels closed, the inbound requests still waiting
+// for the client aborted and the outbound ones waited for, after which the Iris
+// connection is closed. The socket itself is left open.
+func (r *relay) suspend() {
+	r.workers.Terminate(false)
+
+	r.tunLock.RLock()
+	tunIds := make([]uint64, 0, len(r.tunLive))
+	for tunId, _ := range r.tunLive {
+		tunIds = append(tunIds, tunId)
+	}
+	r.tunLock.RUnlock()
+	for _, tunId := range tunIds {
+		r.handleTunnelClose(tunId, true)
+	}
+	close(r.term)
+
+	if err := r.iris.Drain(config.RelayHandoffTimeout); err != nil {
+		log.Printf("relay: handoff drain failed: %v.", err)
+	}
+	r.stopSender()
+
+	// Only hand off clients still connected (i.e. not overflowed meanwhile)
+	select {
+	case <-r.dropped:
+	default:
+		r.suspended = true
+	}
+}
+
+// Assembles the session state of a suspended client.
+func (r *relay) session() (*session, error) {
+	sess := &session{
+		Cluster: r.app,
+		Ident:   r.ident,
+		Framed:  r.framed,
+	}
+	if r.overlay != "" {
+		sess.Cluster += "@" + r.overlay
+	}
+	for topic, _ := range r.subLive {
+		sess.Topics = append(sess.Topics, topic)
+	}
+	buffered, err := r.sockBuf.Reader.Peek(r.sockBuf.Reader.Buffered())
+	if err != nil {
+		return nil, err
+	}
+	sess.Buffered = buffered
+	return sess, nil
+}
+
+// Passes the suspended clients over to the successor, closing the local copies
+// of their sockets. Only the acceptor may call it.
+func (r *Relay) transfer(conn *net.UnixConn, clients []*relay) {
+	passed := 0
+	for _, rel := range clients {
+		if err := r.pass(conn, rel); err != nil {
+			log.Printf("relay: session handoff failed: %v.", err)
+		} else {
+			passed++
+		}
+		rel.sock.Close()
+	}
+	log.Printf("relay: handed off %d of %d clients.", passed, len(clients))
+}
+
+// Passes a single suspended client over to the successor.
+func (r *Relay) pass(conn *net.UnixConn, rel *relay) error {
+	sess, err := rel.session()
+	if err != nil {
+		return err
+	}
+	file, err := rel.sock.(interface {
+		File() (*os.File, error)
+	}).File()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return sendSession(conn, sess, file)
+}
+
+// Takes over the clients passed by the predecessor, signaling readiness first.
+// The sessions failing to reconnect are dropped. Only called before the acceptor
+// starts.
+func (r *Relay) resume() error {
+	defer r.handoff.Close()
+
+	if _, err := r.handoff.Write(handoffReady); err != nil {
+		return err
+	}
+	for {
+		sess, file, err := recvSession(r.handoff)
+		if err != nil {
+			return err
+		}
+		if sess == nil {
+			return nil
+		}
+		if rel, err := r.adopt(sess, file); err != nil {
+			log.Printf("relay: session takeover failed: %v.", err)
+		} else {
+			r.clients[rel] = struct{}{}
+		}
+	}
+}
+
+// Rebuilds a client relay from a session taken over from the predecessor.
+func (r *Relay) adopt(sess *session, file *os.File) (*relay, error) {
+	sock, err := net.FileConn(file)
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+	rel := r.newRelay(sock, sess.Buffered)
+	rel.framed = sess.Framed
+
+	if err := r.connectRelay(rel, sess.Cluster, sess.Ident); err != nil {
+		rel.drop()
+		return nil, err
+	}
+	rel.workers.Start()
+	for _, topic := range sess.Topics {
+		rel.handleSubscribe(topic)
+	}
+	go rel.process()
+	return rel, nil
+}
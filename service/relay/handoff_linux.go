@@ -0,0 +1,101 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the Linux specifics of the relay handoff: passing the client sockets
+// to the successor over a Unix socket.
+
+package relay
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+// Maximum size of a serialized session.
+const sessionLimit = 1 << 20
+
+// Creates the Unix socket pair to hand the relay off through, returning the local
+// end and the file to pass to the successor process.
+func NewHandoffPair() (*net.UnixConn, *os.File, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	local, err := HandoffConn(os.NewFile(uintptr(fds[0]), "relay-handoff"))
+	if err != nil {
+		syscall.Close(fds[1])
+		return nil, nil, err
+	}
+	return local, os.NewFile(uintptr(fds[1]), "relay-handoff"), nil
+}
+
+// Sends a session with its socket through the handoff connection.
+func sendSession(conn *net.UnixConn, sess *session, file *os.File) error {
+	data, err := json.Marshal(sess)
+	if err != nil {
+		return err
+	}
+	_, _, err = conn.WriteMsgUnix(data, syscall.UnixRights(int(file.Fd())), nil)
+	return err
+}
+
+// Receives a session with its socket from the handoff connection, or nil when the
+// predecessor finished (closed its end).
+func recvSession(conn *net.UnixConn) (*session, *os.File, error) {
+	data, oob := make([]byte, sessionLimit), make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(data, oob)
+	if err == io.EOF {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if n == 0 {
+		return nil, nil, nil
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(msgs) != 1 {
+		return nil, nil, errors.New("relay: session without socket")
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(fds) != 1 {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+		return nil, nil, errors.New("relay: session with multiple sockets")
+	}
+	file := os.NewFile(uintptr(fds[0]), "relay-client")
+
+	sess := new(session)
+	if err := json.Unmarshal(data[:n], sess); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return sess, file, nil
+}
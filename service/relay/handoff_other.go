@@ -0,0 +1,50 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the fallback of the relay handoff for systems where passing sockets
+// between processes is not supported.
+
+//go:build !linux
+// +build !linux
+
+package relay
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// Returned when attempting a handoff on an unsupported system.
+var errHandoffUnsupported = errors.New("relay: handoff not supported")
+
+// Rejects the handoff, as sockets cannot be passed to a successor.
+func NewHandoffPair() (*net.UnixConn, *os.File, error) {
+	return nil, nil, errHandoffUnsupported
+}
+
+// Rejects sending sessions, as sockets cannot be passed to a successor.
+func sendSession(conn *net.UnixConn, sess *session, file *os.File) error {
+	return errHandoffUnsupported
+}
+
+// Rejects receiving sessions, as sockets cannot be passed from a predecessor.
+func recvSession(conn *net.UnixConn) (*session, *os.File, error) {
+	return nil, nil, errHandoffUnsupported
+}
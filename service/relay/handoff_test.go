@@ -0,0 +1,195 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package relay
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// Creates a connected pair of sockets over the given network.
+func socketPair(t *testing.T, network, addr string) (net.Conn, net.Conn) {
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %v.", network, err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial(network, listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial %s: %v.", network, err)
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		client.Close()
+		t.Fatalf("failed to accept %s: %v.", network, err)
+	}
+	return server, client
+}
+
+// Tests that a reader paused for a handoff finishes the message it's in, stops
+// at the boundary, and that the data already buffered is resumed by the successor
+// without losing any bytes.
+func TestPausedReaderResume(t *testing.T) {
+	server, client := socketPair(t, "tcp", "localhost:0")
+	defer client.Close()
+
+	rel := new(Relay).newRelay(server, nil)
+
+	// Start reading a message and pause the client in the middle of it
+	client.Write([]byte("ab"))
+
+	head := make([]byte, 2)
+	rel.midMsg = true
+	if _, err := io.ReadFull(rel.sockBuf, head); err != nil {
+		t.Fatalf("failed to read message head: %v.", err)
+	}
+	rel.suspendRead()
+
+	// Complete the message along with the start of the next one, delayed past the pause
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		client.Write([]byte("cxy"))
+	}()
+	tail := make([]byte, 1)
+	if _, err := io.ReadFull(rel.sockBuf, tail); err != nil {
+		t.Fatalf("paused reader interrupted mid message: %v.", err)
+	}
+	if msg := string(head) + string(tail); msg != "abc" {
+		t.Fatalf("message mismatch: have %q, want %q.", msg, "abc")
+	}
+	// Make sure the reader stops at the boundary, keeping the rest buffered
+	rel.midMsg = false
+	if err := rel.recvNext(); err != errHandoff {
+		t.Fatalf("boundary error mismatch: have %v, want %v.", err, errHandoff)
+	}
+	rel.stopSender()
+
+	sess, err := rel.session()
+	if err != nil {
+		t.Fatalf("failed to assemble session: %v.", err)
+	}
+	// Resume the stream in a successor, with the rest of the data arriving later
+	server.SetReadDeadline(time.Time{})
+	next := new(Relay).newRelay(server, sess.Buffered)
+	defer next.close()
+
+	client.Write([]byte("z"))
+	msg := make([]byte, 3)
+	if _, err := io.ReadFull(next.sockBuf, msg); err != nil {
+		t.Fatalf("failed to read resumed message: %v.", err)
+	}
+	if string(msg) != "xyz" {
+		t.Fatalf("resumed message mismatch: have %q, want %q.", msg, "xyz")
+	}
+}
+
+// Socket stub returning its data along with a failure in the same read.
+type failingConn struct {
+	net.Conn
+	data []byte
+	err  error
+}
+
+func (c *failingConn) Read(b []byte) (int, error) {
+	return copy(b, c.data), c.err
+}
+
+// Tests that read failures reach the parser even if data arrived with them.
+func TestPausedReaderFailure(t *testing.T) {
+	rel := &relay{sock: &failingConn{data: []byte("ab"), err: io.ErrUnexpectedEOF}}
+
+	buf := make([]byte, 4)
+	n, err := (&pausable{rel}).Read(buf)
+	if n != 2 || err != io.ErrUnexpectedEOF {
+		t.Fatalf("read result mismatch: have %d/%v, want %d/%v.", n, err, 2, io.ErrUnexpectedEOF)
+	}
+}
+
+// Tests that the successor sees the predecessor closing the handoff socket as
+// the end of the sessions, but reports the failures of its own end.
+func TestRecvSessionEnd(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("handoff not supported")
+	}
+	local, file, err := NewHandoffPair()
+	if err != nil {
+		t.Fatalf("failed to create handoff pair: %v.", err)
+	}
+	remote, err := HandoffConn(file)
+	if err != nil {
+		t.Fatalf("failed to wrap handoff socket: %v.", err)
+	}
+	local.Close()
+	if sess, _, err := recvSession(remote); sess != nil || err != nil {
+		t.Fatalf("finished handoff mismatch: have %v/%v, want nil/nil.", sess, err)
+	}
+	remote.Close()
+	if _, _, err := recvSession(remote); err == nil {
+		t.Fatalf("closed handoff socket read succeeded.")
+	}
+}
+
+// Tests that only plain TCP and Unix domain socket clients may be handed off.
+func TestTransferable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iris-relay")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v.", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tcpServer, tcpClient := socketPair(t, "tcp", "localhost:0")
+	defer tcpServer.Close()
+	defer tcpClient.Close()
+
+	unixServer, unixClient := socketPair(t, "unix", filepath.Join(dir, "sock"))
+	defer unixServer.Close()
+	defer unixClient.Close()
+
+	pipeServer, pipeClient := net.Pipe()
+	defer pipeServer.Close()
+	defer pipeClient.Close()
+
+	tests := []struct {
+		name         string
+		sock         net.Conn
+		transferable bool
+	}{
+		{"tcp", tcpServer, true},
+		{"unix", unixServer, true},
+		{"websocket", &wsConn{Conn: tcpServer, buffer: bufio.NewReadWriter(bufio.NewReader(tcpServer), bufio.NewWriter(tcpServer))}, false},
+		{"tls", tls.Server(tcpServer, &tls.Config{}), false},
+		{"pipe", pipeServer, false},
+	}
+	for _, tt := range tests {
+		rel := &relay{sock: tt.sock}
+		if have := rel.transferable(); have != tt.transferable {
+			t.Errorf("%s: transferability mismatch: have %v, want %v.", tt.name, have, tt.transferable)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the sampled logging of the relay operations. Each forwarded request,
+// broadcast, publish, event, subscription and tunnel of the clients may be
+// logged as a single line of key=value fields: the operation, its cluster or
+// topic, the payload size, the latency and the outcome. Payloads themselves are
+// never logged, only their sizes.
+
+package relay
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/karalabe/iris/proto/iris"
+)
+
+// Outcomes of the logged relay operations.
+const (
+	outcomeOk      = "ok"
+	outcomeTimeout = "timeout"
+	outcomeLimited = "limited"
+	outcomeRefused = "refused"
+	outcomeFailed  = "failed"
+)
+
+// Sampled logger of the relay operations.
+type opLog struct {
+	logger iris.Logger // Sink of the operation log lines
+	rate   float64     // Fraction of the operations to log
+}
+
+// Logs a sampled fraction (0 < rate <= 1) of the client operations through the
+// given logger. A non-positive rate disables the operation log.
+func WithOpLog(logger iris.Logger, rate float64) Option {
+	return func(r *Relay) {
+		if rate > 0 {
+			r.oplog = &opLog{logger: logger, rate: rate}
+		} else {
+			r.oplog = nil
+		}
+	}
+}
+
+// Maps the error of a relayed operation to its logged outcome.
+func outcome(err error) string {
+	switch err {
+	case nil:
+		return outcomeOk
+	case iris.ErrTimeout:
+		return outcomeTimeout
+	case iris.ErrRateLimited:
+		return outcomeLimited
+	default:
+		return outcomeFailed
+	}
+}
+
+// Logs an operation of the client if sampled, addressed at the cluster or topic
+// (kind being the field name) and started at the given time.
+func (r *relay) logOp(op string, kind string, target string, size int, start time.Time, result string) {
+	if r.oplog == nil || (r.oplog.rate < 1 && rand.Float64() >= r.oplog.rate) {
+		return
+	}
+	app := r.app
+	if r.overlay != "" {
+		app += "@" + r.overlay
+	}
+	r.oplog.logger.Printf("relay: op=%s client=%q app=%q %s=%q size=%d latency=%v outcome=%s",
+		op, r.sock.RemoteAddr().String(), app, kind, target, size, time.Since(start), result)
+}
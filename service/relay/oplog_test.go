@@ -0,0 +1,121 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package relay
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Operation log sink collecting the lines in memory.
+type bufferLogger struct {
+	lines []string
+	lock  sync.Mutex
+}
+
+// Implements iris.Logger.Printf.
+func (b *bufferLogger) Printf(format string, v ...interface{}) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.lines = append(b.lines, fmt.Sprintf(format, v...))
+}
+
+// Returns the collected log output.
+func (b *bufferLogger) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return strings.Join(b.lines, "\n")
+}
+
+// Tests that the operation log records the relayed publishes and requests, but
+// never their payloads.
+func TestOpLogRedaction(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	logger := new(bufferLogger)
+	rel, stop := startRelay(t, WithOpLog(logger, 1))
+	defer stop()
+
+	client := pipeRelay(rel)
+	defer client.conn.Close()
+
+	client.conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if err := client.handshake(relayVersionV2, "oplog-test"); err != nil {
+		t.Fatalf("failed to handshake with relay: %v.", err)
+	}
+	// Publish a secret message to a subscribed topic
+	if err := client.send(opSub, "oplog/topic"); err != nil {
+		t.Fatalf("failed to send subscription: %v.", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := client.send(opPub, "oplog/topic", []byte("secret-publish")); err != nil {
+		t.Fatalf("failed to send publish: %v.", err)
+	}
+	if err := client.expect(opPub); err != nil {
+		t.Fatalf("failed to receive publish: %v.", err)
+	}
+	// Request a secret from ourselves, replying with another one
+	if err := client.send(opReq, 1, "oplog-test", []byte("secret-request"), 1000); err != nil {
+		t.Fatalf("failed to send request: %v.", err)
+	}
+	if err := client.expect(opReq); err != nil {
+		t.Fatalf("failed to receive request: %v.", err)
+	}
+	reqId, err := client.recvVarint()
+	if err != nil {
+		t.Fatalf("failed to read request id: %v.", err)
+	}
+	if req, err := client.recvBinary(); err != nil || !bytes.Equal(req, []byte("secret-request")) {
+		t.Fatalf("request mismatch: have %s/%v, want %s.", req, err, "secret-request")
+	}
+	if err := client.send(opRep, reqId, []byte("secret-reply")); err != nil {
+		t.Fatalf("failed to send reply: %v.", err)
+	}
+	if err := client.expect(opRep); err != nil {
+		t.Fatalf("failed to receive reply: %v.", err)
+	}
+	if id, err := client.recvVarint(); err != nil || id != 1 {
+		t.Fatalf("reply id mismatch: have %v/%v, want %v.", id, err, 1)
+	}
+	if timeout, err := client.recvBool(); err != nil || timeout {
+		t.Fatalf("request timed out: %v.", err)
+	}
+	// Verify that the operations were logged without their payloads
+	output := logger.String()
+	for _, op := range []string{"op=publish", "op=event", "op=request", "op=serve"} {
+		if !strings.Contains(output, op) {
+			t.Errorf("operation missing from the log: %s.", op)
+		}
+	}
+	for _, secret := range []string{"secret-publish", "secret-request", "secret-reply"} {
+		if strings.Contains(output, secret) {
+			t.Errorf("payload leaked into the log: %s.", secret)
+		}
+	}
+	if t.Failed() {
+		t.Logf("operation log:\n%s", output)
+	}
+}
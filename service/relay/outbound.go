@@ -0,0 +1,130 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the bounded outbound queue of the relay clients. Messages to the client
+// are assembled by the senders and queued for a dedicated writer, so a stalled
+// client cannot block the Iris handlers. If the queue fills up, the client is
+// considered a slow consumer: the messages beyond are discarded, an overflow
+// notification is queued last, and the connection is dropped once it's written
+// (or the write timeout expires).
+
+package relay
+
+import (
+	"log"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Queues an assembled message for writing to the client, handling an overflow
+// by notifying and disconnecting the client. Must be called with the socket
+// lock held.
+func (r *relay) enqueue(msg []byte) error {
+	if r.overflowed {
+		return nil
+	}
+	select {
+	case <-r.outStop:
+		return nil
+	default:
+	}
+	if len(r.outQueue) < cap(r.outQueue)-1 {
+		r.outQueue <- msg
+		return nil
+	}
+	// Slow consumer, queue the notification into the reserved slot and disconnect
+	log.Printf("relay: outbound queue overflow, disconnecting slow client.")
+	r.overflowed = true
+	close(r.outFull)
+
+	if err := r.sendByte(opOverflow); err != nil {
+		return err
+	}
+	r.outQueue <- r.assemble()
+	r.sock.SetWriteDeadline(time.Now().Add(config.RelayWriteTimeout))
+	return nil
+}
+
+// Writes the queued messages to the client till the relay is stopped or dropped,
+// batching them into as few network writes as possible.
+func (r *relay) sender() {
+	defer close(r.outDone)
+
+	for {
+		select {
+		case msg := <-r.outQueue:
+			if err := r.write(msg); err != nil {
+				r.drop()
+				return
+			}
+			// Disconnect the overflowed client after the notification
+			if len(r.outQueue) == 0 && r.full() {
+				r.drop()
+				return
+			}
+		case <-r.outStop:
+			// Flush the queued messages, bounded by the write timeout
+			r.sock.SetWriteDeadline(time.Now().Add(config.RelayWriteTimeout))
+			for {
+				select {
+				case msg := <-r.outQueue:
+					if err := r.write(msg); err != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		case <-r.dropped:
+			return
+		}
+	}
+}
+
+// Writes a single message into the socket buffer, flushing it if no other is
+// waiting.
+func (r *relay) write(msg []byte) error {
+	if _, err := r.sockBuf.Write(msg); err != nil {
+		return err
+	}
+	if len(r.outQueue) == 0 {
+		return r.sockBuf.Flush()
+	}
+	return nil
+}
+
+// Checks whether the outbound queue overflowed.
+func (r *relay) full() bool {
+	select {
+	case <-r.outFull:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stops the writer after flushing the queued messages, waiting for it to finish.
+func (r *relay) stopSender() {
+	r.sockLock.Lock()
+	close(r.outStop)
+	r.sockLock.Unlock()
+
+	<-r.outDone
+}
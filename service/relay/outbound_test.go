@@ -0,0 +1,137 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package relay
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Tests that a client not reading its messages gets disconnected once its queue
+// fills up, with an overflow notice written after the queued messages.
+func TestOutboundOverflow(t *testing.T) {
+	queue := config.RelayOutboundQueue
+	config.RelayOutboundQueue = 4
+	defer func() { config.RelayOutboundQueue = queue }()
+
+	server, conn := net.Pipe()
+	defer conn.Close()
+
+	rel := new(Relay).newRelay(server, nil)
+	defer rel.close()
+
+	// Fill up the queue while the client isn't reading (the writer blocking on the
+	// first message), and some more after the overflow
+	sent := 0
+	for ; !rel.full(); sent++ {
+		if sent > config.RelayOutboundQueue {
+			t.Fatalf("queue not overflowed after %d messages.", sent)
+		}
+		if err := rel.sendPublish("overflow", []byte{byte(sent)}); err != nil {
+			t.Fatalf("failed to send publish: %v.", err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if err := rel.sendPublish("overflow", []byte("discarded")); err != nil {
+			t.Fatalf("failed to send publish after overflow: %v.", err)
+		}
+	}
+	// Read the queued messages, expecting the notice and the disconnect afterwards
+	client := newTestClient(conn)
+	conn.SetDeadline(time.Now().Add(time.Second))
+	for i := 0; ; i++ {
+		op, err := client.recvOp()
+		if err != nil {
+			t.Fatalf("failed to read message #%d: %v.", i, err)
+		}
+		if op == opOverflow {
+			if i != sent-1 {
+				t.Fatalf("delivered message count mismatch: have %d, want %d.", i, sent-1)
+			}
+			break
+		}
+		if op != opPub {
+			t.Fatalf("message #%d: opcode mismatch: have %v, want %v.", i, op, opPub)
+		}
+		client.recvString()
+		if msg, err := client.recvBinary(); err != nil || len(msg) != 1 || msg[0] != byte(i) {
+			t.Fatalf("message #%d: payload mismatch: have %v/%v, want %v.", i, msg, err, []byte{byte(i)})
+		}
+	}
+	if err := client.waitClose(time.Second); err != nil {
+		t.Fatalf("slow client not disconnected: %v.", err)
+	}
+	select {
+	case <-rel.dropped:
+	case <-time.After(time.Second):
+		t.Fatalf("slow client not dropped.")
+	}
+	if errs := atomic.LoadUint64(&rel.stats.Errors); errs != 1 {
+		t.Fatalf("error count mismatch: have %d, want %d.", errs, 1)
+	}
+}
+
+// Tests that connections over the client limit are refused, counting the ones
+// still running their handshake too.
+func TestClientLimit(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	limit := config.RelayClientLimit
+	config.RelayClientLimit = 2
+	defer func() { config.RelayClientLimit = limit }()
+
+	rel, stop := startRelay(t)
+	defer stop()
+
+	// Fill up the relay with a joined and a handshaking client
+	joined := pipeRelay(rel)
+	defer joined.conn.Close()
+
+	if err := joined.handshake(relayVersionV2, "limit-test"); err != nil {
+		t.Fatalf("failed to handshake with relay: %v.", err)
+	}
+	silent := pipeRelay(rel)
+	defer silent.conn.Close()
+
+	// Make sure any further client is refused
+	refused := pipeRelay(rel)
+	defer refused.conn.Close()
+
+	if err := refused.waitClose(config.RelayHandshakeTimeout / 2); err != nil {
+		t.Fatalf("client over the limit not refused: %v.", err)
+	}
+	// Once the handshaking client times out, make sure its slot is released
+	if err := silent.waitClose(2 * config.RelayHandshakeTimeout); err != nil {
+		t.Fatalf("silent client not dropped: %v.", err)
+	}
+	client := pipeRelay(rel)
+	defer client.conn.Close()
+
+	client.conn.SetDeadline(time.Now().Add(time.Second))
+	if err := client.handshake(relayVersionV2, "limit-test"); err != nil {
+		t.Fatalf("failed to handshake with relay: %v.", err)
+	}
+}
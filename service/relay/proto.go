@@ -23,7 +23,10 @@ package relay
 
 import (
 	"fmt"
+	"io"
 	"time"
+
+	"github.com/karalabe/iris/config"
 )
 
 const (
@@ -40,14 +43,21 @@ const (
 	opTunData              // Tunnel data transfer
 	opTunAck               // Tunnel data acknowledgement
 	opTunClose             // Tunnel closing
+	opPing                 // Connection health check
+	opPong                 // Connection health check result
+	opAuth                 // Authentication challenge and response
+	opQuota                // Operation rejected for exceeding a quota
+	opDenied               // Operation rejected by the access control list
+	opOverflow             // Outbound queue overflowed, connection dropping
+	opDrain                // Relay shutting down, connection draining
 )
 
-// Relay protocol version
+// Relay protocol version using the unframed message stream
 var relayVersion = "v1.0"
 
 // Serializes a single byte into the relay.
 func (r *relay) sendByte(data byte) error {
-	if err := r.sockBuf.WriteByte(data); err != nil {
+	if err := r.sink().WriteByte(data); err != nil {
 		return err
 	}
 	return nil
@@ -83,7 +93,7 @@ func (r *relay) sendBinary(data []byte) error {
 	if err := r.sendVarint(uint64(len(data))); err != nil {
 		return err
 	}
-	if n, err := r.sockBuf.Write([]byte(data)); n != len(data) || err != nil {
+	if n, err := r.sink().Write([]byte(data)); n != len(data) || err != nil {
 		return err
 	}
 	return nil
@@ -94,12 +104,9 @@ func (r *relay) sendString(data string) error {
 	return r.sendBinary([]byte(data))
 }
 
-// Flushes the output buffer into the network stream.
+// Queues the assembled message for writing into the network stream.
 func (r *relay) sendFlush() error {
-	if err := r.sockBuf.Flush(); err != nil {
-		return err
-	}
-	return nil
+	return r.enqueue(r.assemble())
 }
 
 // Serializes the initialization confirmation.
@@ -110,6 +117,17 @@ func (r *relay) sendInit() error {
 	return r.sendFlush()
 }
 
+// Serializes the authentication challenge.
+func (r *relay) sendAuth(nonce []byte) error {
+	if err := r.sendByte(opAuth); err != nil {
+		return err
+	}
+	if err := r.sendBinary(nonce); err != nil {
+		return err
+	}
+	return r.sendFlush()
+}
+
 // Atomically sends an application broadcast message into the relay.
 func (r *relay) sendBroadcast(msg []byte) error {
 	r.sockLock.Lock()
@@ -163,6 +181,29 @@ func (r *relay) sendReply(reqId uint64, rep []byte, timeout bool) error {
 	return r.sendFlush()
 }
 
+// Atomically sends the result of a health check into the relay, the latency
+// being in microseconds.
+func (r *relay) sendPong(pingId uint64, latency time.Duration, timeout bool) error {
+	r.sockLock.Lock()
+	defer r.sockLock.Unlock()
+
+	if err := r.sendByte(opPong); err != nil {
+		return err
+	}
+	if err := r.sendVarint(pingId); err != nil {
+		return err
+	}
+	if err := r.sendBool(timeout); err != nil {
+		return err
+	}
+	if !timeout {
+		if err := r.sendVarint(uint64(latency / time.Microsecond)); err != nil {
+			return err
+		}
+	}
+	return r.sendFlush()
+}
+
 // Atomically sends a topic publish message into the relay.
 func (r *relay) sendPublish(topic string, msg []byte) error {
 	r.sockLock.Lock()
@@ -180,6 +221,54 @@ func (r *relay) sendPublish(topic string, msg []byte) error {
 	return r.sendFlush()
 }
 
+// Atomically sends a quota rejection into the relay, identifying the refused
+// operation by its opcode and either its request/tunnel id or its topic. The
+// refusal is counted in the client's statistics.
+func (r *relay) sendQuota(op byte, id uint64, topic string) error {
+	r.count(&r.stats.Refusals, 1, MetricRelayRefused)
+
+	r.sockLock.Lock()
+	defer r.sockLock.Unlock()
+
+	if err := r.sendByte(opQuota); err != nil {
+		return err
+	}
+	if err := r.sendByte(op); err != nil {
+		return err
+	}
+	if err := r.sendVarint(id); err != nil {
+		return err
+	}
+	if err := r.sendString(topic); err != nil {
+		return err
+	}
+	return r.sendFlush()
+}
+
+// Atomically sends an access denial into the relay, identifying the refused
+// operation by its opcode and either its tunnel id or its topic. The refusal is
+// counted in the client's statistics.
+func (r *relay) sendDenied(op byte, id uint64, topic string) error {
+	r.count(&r.stats.Refusals, 1, MetricRelayRefused)
+
+	r.sockLock.Lock()
+	defer r.sockLock.Unlock()
+
+	if err := r.sendByte(opDenied); err != nil {
+		return err
+	}
+	if err := r.sendByte(op); err != nil {
+		return err
+	}
+	if err := r.sendVarint(id); err != nil {
+		return err
+	}
+	if err := r.sendString(topic); err != nil {
+		return err
+	}
+	return r.sendFlush()
+}
+
 // Atomically sends a close message into the relay.
 func (r *relay) sendClose() error {
 	r.sockLock.Lock()
@@ -191,6 +280,21 @@ func (r *relay) sendClose() error {
 	return r.sendFlush()
 }
 
+// Atomically sends a drain notification into the relay, with the reason of the
+// shutdown to deliver to the client's drop handler.
+func (r *relay) sendDrain(reason string) error {
+	r.sockLock.Lock()
+	defer r.sockLock.Unlock()
+
+	if err := r.sendByte(opDrain); err != nil {
+		return err
+	}
+	if err := r.sendString(reason); err != nil {
+		return err
+	}
+	return r.sendFlush()
+}
+
 // Atomically sends a tunneling message into the relay.
 func (r *relay) sendTunnelRequest(tmpId uint64, buf int) error {
 	r.sockLock.Lock()
@@ -277,7 +381,7 @@ func (r *relay) sendTunnelClose(tunId uint64) error {
 
 // Retrieves a single byte from the relay.
 func (r *relay) recvByte() (byte, error) {
-	b, err := r.sockBuf.ReadByte()
+	b, err := r.source().ReadByte()
 	if err != nil {
 		return 0, err
 	}
@@ -310,14 +414,12 @@ func (r *relay) recvBinary() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if r.frameIn != nil && size > uint64(r.frameIn.Len()) {
+		return nil, fmt.Errorf("relay: protocol violation: field overflows frame: have %v, left %v", size, r.frameIn.Len())
+	}
 	data := make([]byte, size)
-	read := uint64(0)
-	for read < size {
-		if n, err := r.sockBuf.Read(data[read:]); err != nil {
-			return nil, err
-		} else {
-			read += uint64(n)
-		}
+	if _, err := io.ReadFull(r.source(), data); err != nil {
+		return nil, err
 	}
 	return data, nil
 }
@@ -342,8 +444,10 @@ func (r *relay) procInit() (string, error) {
 	// Retrieve and check the protocol version
 	if ver, err := r.recvString(); err != nil {
 		return "", err
+	} else if ver == relayVersionV2 {
+		r.framed = true
 	} else if ver != relayVersion {
-		return "", fmt.Errorf("relay: protocol violation: incompatible version: have %v, want %v", ver, relayVersion)
+		return "", fmt.Errorf("relay: protocol violation: incompatible version: have %v, want %v or %v", ver, relayVersion, relayVersionV2)
 	}
 	// Retrieve the app id
 	app, err := r.recvString()
@@ -353,6 +457,31 @@ func (r *relay) procInit() (string, error) {
 	return app, nil
 }
 
+// Retrieves the authentication response to the challenge, consisting of the
+// credential id and the signature.
+func (r *relay) procAuth() (string, []byte, error) {
+	if err := r.recvFrame(); err != nil {
+		return "", nil, err
+	}
+	if op, err := r.recvByte(); err != nil {
+		return "", nil, err
+	} else if op != opAuth {
+		return "", nil, fmt.Errorf("relay: protocol violation: invalid auth code: %v.", op)
+	}
+	id, err := r.recvString()
+	if err != nil {
+		return "", nil, err
+	}
+	proof, err := r.recvBinary()
+	if err != nil {
+		return "", nil, err
+	}
+	if err := r.recvFrameEnd(); err != nil {
+		return "", nil, err
+	}
+	return id, proof, nil
+}
+
 // Retrieves a local broadcast message from the relay and forwards to the Iris network.
 func (r *relay) procBroadcast() error {
 	app, err := r.recvString()
@@ -363,6 +492,9 @@ func (r *relay) procBroadcast() error {
 	if err != nil {
 		return err
 	}
+	if r.refused("broadcast", "cluster", app, len(msg)) {
+		return nil
+	}
 	r.workers.Schedule(func() { r.handleBroadcast(app, msg) })
 	return nil
 }
@@ -385,6 +517,13 @@ func (r *relay) procRequest() error {
 	if err != nil {
 		return err
 	}
+	if r.refused("request", "cluster", app, len(req)) {
+		return r.sendReply(reqId, nil, true)
+	}
+	if !reserve(&r.reqOut, config.RelayRequestQuota) {
+		r.logOp("request", "cluster", app, len(req), time.Now(), outcomeRefused)
+		return r.sendQuota(opReq, reqId, "")
+	}
 	go r.handleRequest(app, reqId, req, time.Duration(timeout)*time.Millisecond)
 	return nil
 }
@@ -409,6 +548,9 @@ func (r *relay) procSubscribe() error {
 	if err != nil {
 		return err
 	}
+	if r.refused("subscribe", "topic", topic, 0) {
+		return nil
+	}
 	r.workers.Schedule(func() { r.handleSubscribe(topic) })
 	return nil
 }
@@ -423,6 +565,9 @@ func (r *relay) procPublish() error {
 	if err != nil {
 		return err
 	}
+	if r.refused("publish", "topic", topic, len(msg)) {
+		return nil
+	}
 	r.workers.Schedule(func() { r.handlePublish(topic, msg) })
 	return nil
 
@@ -456,6 +601,17 @@ func (r *relay) procTunnelRequest() error {
 	if err != nil {
 		return err
 	}
+	if r.refused("tunnel", "cluster", app, 0) {
+		return r.sendTunnelReply(tunId, 0, true)
+	}
+	if !r.acl.tunnelable() {
+		r.logOp("tunnel", "cluster", app, 0, time.Now(), outcomeRefused)
+		return r.sendDenied(opTunReq, tunId, "")
+	}
+	if !reserve(&r.tunOut, config.RelayTunnelQuota) {
+		r.logOp("tunnel", "cluster", app, 0, time.Now(), outcomeRefused)
+		return r.sendQuota(opTunReq, tunId, "")
+	}
 	r.workers.Schedule(func() { r.handleTunnelRequest(tunId, app, int(buf), time.Duration(timeout)*time.Millisecond) })
 	return nil
 }
@@ -512,13 +668,37 @@ func (r *relay) procTunnelClose() error {
 	return nil
 }
 
+// Retrieves a health check request from the relay and pings the Iris connection.
+func (r *relay) procPing() error {
+	pingId, err := r.recvVarint()
+	if err != nil {
+		return err
+	}
+	timeout, err := r.recvVarint()
+	if err != nil {
+		return err
+	}
+	go r.handlePing(pingId, time.Duration(timeout)*time.Millisecond)
+	return nil
+}
+
 // Retrieves messages from the client connection and keeps processing them until
 // either side closes the socket or the connection drops.
 func (r *relay) process() {
 	var op byte
 	var err error
 	for closed := false; !closed && err == nil; {
-		// Retrieve the next message opcode
+		// Wait for the next message, stopping in between if handing off
+		r.midMsg = false
+		if err = r.recvNext(); err != nil {
+			break
+		}
+		r.midMsg = true
+
+		// Retrieve the next message (frame) and its opcode
+		if err = r.recvFrame(); err != nil {
+			break
+		}
 		if op, err = r.recvByte(); err == nil {
 			// Read the rest of the message and process
 			switch op {
@@ -544,6 +724,8 @@ func (r *relay) process() {
 				err = r.procTunnelAck()
 			case opTunClose:
 				err = r.procTunnelClose()
+			case opPing:
+				err = r.procPing()
 			case opClose:
 				err = r.sendClose()
 				closed = true
@@ -551,14 +733,38 @@ func (r *relay) process() {
 				err = fmt.Errorf("unknown opcode: %v", op)
 			}
 		}
+		if err == nil {
+			err = r.recvFrameEnd()
+		}
 	}
-	// Failure or deliberate close, clean up resources
-	r.sock.Close()
-	r.iris.Close()
-	r.workers.Terminate(true)
+	if err == errHandoff {
+		// Paused for a handoff, finish the pending work but keep the socket
+		r.suspend()
+	} else {
+		// Failure, deliberate close or drain end, clean up resources (counting any failure)
+		r.drainLock.Lock()
+		r.exiting = true
+		r.drainLock.Unlock()
 
-	// Signal termination to all blocked threads
-	close(r.term)
+		if err != nil && r.drainDone() {
+			err = nil
+		}
+		if err != nil {
+			r.drop()
+		}
+		r.stopSender()
+		r.sock.Close()
+		if !r.draining() {
+			r.iris.Close()
+		}
+		r.workers.Terminate(true)
+
+		// Signal termination to all blocked threads (and wait for any drain to finish)
+		close(r.term)
+		if r.draining() {
+			<-r.drained
+		}
+	}
 
 	// Notify the supervisor and report error if any
 	r.done <- r
@@ -0,0 +1,93 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the per client resource quotas of the relay: concurrent tunnels,
+// pending requests and subscriptions are counted against the configured limits
+// and refused through the protocol when exceeded, while the inbound bandwidth
+// is throttled by delaying the socket reads.
+
+package relay
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Reserves a slot of a counted resource, reporting whether the quota permitted
+// it. Non-positive quotas are unlimited.
+func reserve(count *int32, quota int) bool {
+	if used := atomic.AddInt32(count, 1); quota > 0 && int(used) > quota {
+		atomic.AddInt32(count, -1)
+		return false
+	}
+	return true
+}
+
+// Releases a previously reserved slot of a counted resource.
+func release(count *int32) {
+	atomic.AddInt32(count, -1)
+}
+
+// Token bucket limited reader, allowing a burst of one second worth of bytes.
+type throttle struct {
+	sock   io.Reader // Underlying network stream
+	rate   float64   // Bytes permitted per second
+	tokens float64   // Bytes currently permitted
+	last   time.Time // Time of the last refill
+}
+
+// Wraps a network stream into a reader limited to the given bytes per second,
+// or returns the stream as is if unlimited.
+func newThrottle(sock io.Reader, rate int) io.Reader {
+	if rate <= 0 {
+		return sock
+	}
+	return &throttle{sock: sock, rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// Reads from the underlying stream, blocking until the bucket permits at least a
+// single byte. Only one go-routine may read at a time.
+func (t *throttle) Read(p []byte) (int, error) {
+	t.refill()
+	if t.tokens < 1 {
+		time.Sleep(time.Duration((1 - t.tokens) / t.rate * float64(time.Second)))
+		t.refill()
+	}
+	allow := int(t.tokens)
+	if allow < 1 {
+		allow = 1 // Rounding errors of the sleep
+	}
+	if len(p) > allow {
+		p = p[:allow]
+	}
+	n, err := t.sock.Read(p)
+	t.tokens -= float64(n)
+	return n, err
+}
+
+// Adds the tokens accumulated since the last refill, capped at the burst size.
+func (t *throttle) refill() {
+	now := time.Now()
+	t.tokens += now.Sub(t.last).Seconds() * t.rate
+	if t.tokens > t.rate {
+		t.tokens = t.rate
+	}
+	t.last = now
+}
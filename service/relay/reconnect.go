@@ -0,0 +1,77 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the reconnection of the relayed connections to a restarted carrier.
+// The connections of the default overlay opt into the reconnection of the iris
+// package, each restoring its own cluster and subscriptions, while the relay
+// swaps in the re-dialed carrier for the clients joining afterwards. Additional
+// overlays are not reconnected.
+
+package relay
+
+import (
+	"log"
+
+	"github.com/karalabe/iris/proto/iris"
+)
+
+// Reconnects the relayed and embedded connections of the default overlay through
+// the dialer if the carrier terminates, re-dialing according to the policy. The
+// dialer should hand out a shared overlay, since each connection calls it.
+func WithReconnect(dial iris.Dialer, policy iris.ReconnectPolicy) Option {
+	return func(r *Relay) {
+		r.redial = func() (*iris.Overlay, error) {
+			overlay, err := dial()
+			if err == nil {
+				r.irisLock.Lock()
+				r.iris = overlay
+				r.irisLock.Unlock()
+			}
+			return overlay, err
+		}
+		r.policy = policy
+	}
+}
+
+// Retrieves the current carrier of the default overlay.
+func (r *Relay) carrier() *iris.Overlay {
+	r.irisLock.RLock()
+	defer r.irisLock.RUnlock()
+
+	return r.iris
+}
+
+// Assembles the reconnection options of a connection joining the named overlay
+// ("" if the default), if reconnection is enabled.
+func (r *Relay) reconnectOpts(name string) []iris.ConnectionOption {
+	if r.redial == nil || name != "" {
+		return nil
+	}
+	return []iris.ConnectionOption{iris.WithReconnect(r.redial, r.policy)}
+}
+
+// Logs the state transitions of a relayed connection reconnecting to a restarted
+// carrier.
+func (r *relay) HandleState(state iris.ConnState, err error) {
+	if err != nil {
+		log.Printf("relay: client %s %v: %v.", r.app, state, err)
+	} else {
+		log.Printf("relay: client %s %v.", r.app, state)
+	}
+}
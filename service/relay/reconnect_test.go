@@ -0,0 +1,163 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package relay
+
+import (
+	"bytes"
+	"crypto/x509"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/proto/iris"
+)
+
+// Embedded connection handler recording the reconnection state transitions.
+type stateRecorder struct {
+	states chan iris.ConnState
+}
+
+func (s *stateRecorder) HandleBroadcast(msg []byte) {}
+
+func (s *stateRecorder) HandleRequest(req []byte, timeout time.Duration) ([]byte, error) {
+	return req, nil
+}
+
+func (s *stateRecorder) HandleTunnel(tun *iris.Tunnel) {}
+
+func (s *stateRecorder) HandleState(state iris.ConnState, err error) {
+	s.states <- state
+}
+
+// Tests that the relayed connections survive a restart of the carrier, with the
+// membership and subscriptions of the clients restored on the new one.
+func TestReconnect(t *testing.T) {
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	first := iris.New("relay-test", key)
+	if _, err := first.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	// Create a dialer booting a single replacement carrier
+	var current *iris.Overlay
+	var lock sync.Mutex
+	dial := func() (*iris.Overlay, error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if current == nil {
+			node := iris.New("relay-test", key)
+			if _, err := node.Boot(); err != nil {
+				return nil, err
+			}
+			current = node
+		}
+		return current, nil
+	}
+	defer func() {
+		if current != nil {
+			current.Shutdown()
+		}
+	}()
+	// Start a reconnecting relay with a subscribed client and an embedded watcher
+	rel, err := New(0, first, WithReconnect(dial, iris.ReconnectPolicy{Backoff: 10 * time.Millisecond}))
+	if err != nil {
+		t.Fatalf("failed to create relay: %v.", err)
+	}
+	if err := rel.Boot(); err != nil {
+		t.Fatalf("failed to boot relay: %v.", err)
+	}
+	defer rel.Terminate()
+
+	client := dialRelay(t, rel)
+	defer client.conn.Close()
+	if err := client.handshake(relayVersionV2, "reconnect-test"); err != nil {
+		t.Fatalf("failed to join cluster: %v.", err)
+	}
+	if err := client.send(opSub, "reconnect/topic"); err != nil {
+		t.Fatalf("failed to send subscription: %v.", err)
+	}
+	watcher := &stateRecorder{states: make(chan iris.ConnState, 16)}
+	embed, err := rel.Connect("reconnect-watch", watcher)
+	if err != nil {
+		t.Fatalf("failed to connect embedded app: %v.", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Kill the carrier and wait for the connections to be restored
+	if err := first.Shutdown(); err != nil {
+		t.Fatalf("failed to terminate iris overlay: %v.", err)
+	}
+	for _, want := range []iris.ConnState{iris.StateDisconnected, iris.StateReconnecting, iris.StateRestored} {
+		select {
+		case state := <-watcher.states:
+			if state != want {
+				t.Fatalf("state mismatch: have %v, want %v.", state, want)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("state %v not reported.", want)
+		}
+	}
+	if rel.carrier() != current {
+		t.Fatalf("relay carrier not swapped.")
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Make sure the client's subscription and cluster membership are restored
+	client.conn.SetDeadline(time.Now().Add(time.Second))
+	if err := embed.Publish("reconnect/topic", []byte("event")); err != nil {
+		t.Fatalf("failed to publish event: %v.", err)
+	}
+	if err := client.expect(opPub); err != nil {
+		t.Fatalf("failed to receive event after reconnect: %v.", err)
+	}
+	if topic, err := client.recvString(); err != nil || topic != "reconnect/topic" {
+		t.Fatalf("topic mismatch: have %v/%v, want %v.", topic, err, "reconnect/topic")
+	}
+	if msg, err := client.recvBinary(); err != nil || !bytes.Equal(msg, []byte("event")) {
+		t.Fatalf("event mismatch: have %s/%v, want %s.", msg, err, "event")
+	}
+	replies := make(chan []byte, 1)
+	go func() {
+		rep, err := embed.Request("reconnect-test", []byte("ping"), time.Second)
+		if err != nil {
+			t.Errorf("failed to request restored client: %v.", err)
+		}
+		replies <- rep
+	}()
+	if err := client.expect(opReq); err != nil {
+		t.Fatalf("failed to receive request after reconnect: %v.", err)
+	}
+	reqId, err := client.recvVarint()
+	if err != nil {
+		t.Fatalf("failed to read request id: %v.", err)
+	}
+	if req, err := client.recvBinary(); err != nil || !bytes.Equal(req, []byte("ping")) {
+		t.Fatalf("request mismatch: have %s/%v, want %s.", req, err, "ping")
+	}
+	if err := client.send(opRep, reqId, []byte("pong")); err != nil {
+		t.Fatalf("failed to send reply: %v.", err)
+	}
+	if rep := <-replies; !bytes.Equal(rep, []byte("pong")) {
+		t.Fatalf("reply mismatch: have %s, want %s.", rep, "pong")
+	}
+}
@@ -23,8 +23,14 @@ package relay
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/karalabe/iris/config"
 	"github.com/karalabe/iris/pool"
@@ -34,85 +40,235 @@ import (
 // Message relay between the local carrier and an attached client app.
 type relay struct {
 	// Application layer fields
-	iris *iris.Connection // Interface into the iris overlay
+	iris    *iris.Connection // Interface into the iris overlay
+	app     string           // Cluster the attached app joined
+	overlay string           // Name of the overlay joined ("" if the default)
+	ident   string           // Credential id the app authenticated with ("" if none)
+	acl     *ACL             // Access control list of the client (nil if unrestricted)
 
 	reqIdx  uint64                 // Index to assign the next request
 	reqPend map[uint64]chan []byte // Active requests waiting for a reply
 	reqLock sync.RWMutex           // Mutex to protect the request map
+	reqOut  int32                  // Outbound requests in flight (atomic)
 
 	tunIdx  uint64                   // Temporary index to assign the next inbound tunnel
 	tunPend map[uint64]*iris.Tunnel  // Tunnels pending app confirmation
 	tunInit map[uint64]chan struct{} // Confirmation channels for the pending tunnels
 	tunLive map[uint64]*tunnel       // Active tunnels
 	tunLock sync.RWMutex             // Mutex to protect the tunnel maps
+	tunOut  int32                    // Tunnels live or being established (atomic)
+
+	subLive map[string]struct{} // Topics subscribed to by the app
+	subLock sync.RWMutex        // Mutex to protect the subscription set
+
+	stats   Stats        // Traffic statistics of the client (atomic)
+	metrics iris.Metrics // Collector to count the operations with (nil if none)
+	oplog   *opLog       // Sampled logger of the operations (nil if disabled)
 
 	// Network layer fields
-	sock     net.Conn          // Network connection to the attached client
-	sockBuf  *bufio.ReadWriter // Buffered access to the network socket
-	sockLock sync.Mutex        // Mutex to atomise message sending
+	sock       net.Conn          // Network connection to the attached client
+	sockBuf    *bufio.ReadWriter // Buffered access to the network socket
+	sockLock   sync.Mutex        // Mutex to atomise message sending
+	framed     bool              // Whether the length-prefixed v2 framing was negotiated
+	frameIn    *bytes.Reader     // Body of the inbound frame being parsed (v2 only)
+	frameOut   bytes.Buffer      // Outbound message being assembled for the queue
+	outQueue   chan []byte       // Bounded queue of the messages waiting to be written
+	outStop    chan struct{}     // Channel to signal the writer to flush and stop
+	outDone    chan struct{}     // Channel signaling the termination of the writer
+	outFull    chan struct{}     // Channel signaling the overflow of the outbound queue
+	dropped    chan struct{}     // Channel signaling the forced drop of the connection
+	dropOnce   sync.Once         // Guard to signal the drop only once
+	overflowed bool              // Whether the outbound queue overflowed (socket lock protected)
+	midMsg     bool              // Whether a message is being parsed (handoff pauses between them)
 
 	// Quality of service fields
 	workers *pool.ThreadPool // Concurrent threads handling the connection
 
 	// Bookkeeping fields
-	done chan *relay     // Channel on which to signal termination
-	quit chan chan error // Quit channe to synchronize relay termination
-	term chan struct{}   // Channel to signal termination to blocked go-routines
+	done    chan *relay     // Channel on which to signal termination
+	quit    chan chan error // Quit channe to synchronize relay termination
+	term    chan struct{}   // Channel to signal termination to blocked go-routines
+	pause   chan struct{}   // Channel to signal the reader to stop for a handoff
+	drain   chan struct{}   // Channel to signal a shutdown, refusing new operations
+	drained chan struct{}   // Channel signaling the end of the drain, stopping the reader
+	expire  chan struct{}   // Channel signaling the drain deadline, aborting the inbound requests
+
+	drainLock sync.Mutex // Mutex to order the start of a drain and the termination of the client
+	exiting   bool       // Whether the client started terminating (no drain may start)
+
+	suspended bool // Whether the client stopped for a handoff, keeping its socket
 }
 
-// Accepts an inbound relay connection, executing the initialization procedure.
-func (r *Relay) acceptRelay(sock net.Conn) (*relay, error) {
-	// Create the relay object
+// Creates the relay object of a client socket, with some inbound data possibly
+// already read from it (i.e. taken over from a previous process).
+func (r *Relay) newRelay(sock net.Conn, buffered []byte) *relay {
 	rel := &relay{
 		reqPend: make(map[uint64]chan []byte),
 		tunPend: make(map[uint64]*iris.Tunnel),
 		tunInit: make(map[uint64]chan struct{}),
 		tunLive: make(map[uint64]*tunnel),
+		subLive: make(map[string]struct{}),
+		metrics: r.metrics,
+		oplog:   r.oplog,
 
 		// Network layer
-		sock:    sock,
-		sockBuf: bufio.NewReadWriter(bufio.NewReader(sock), bufio.NewWriter(sock)),
+		sock:     sock,
+		outQueue: make(chan []byte, config.RelayOutboundQueue),
+		outStop:  make(chan struct{}),
+		outDone:  make(chan struct{}),
+		outFull:  make(chan struct{}),
+		dropped:  make(chan struct{}),
 
 		// Quality of service
 		workers: pool.NewThreadPool(config.RelayHandlerThreads),
 
 		// Misc
-		done: r.done,
-		quit: make(chan chan error),
-		term: make(chan struct{}),
+		done:    r.done,
+		quit:    make(chan chan error),
+		term:    make(chan struct{}),
+		pause:   make(chan struct{}),
+		drain:   make(chan struct{}),
+		drained: make(chan struct{}),
+		expire:  make(chan struct{}),
+	}
+	source := io.Reader(&pausable{rel: rel})
+	if len(buffered) > 0 {
+		source = io.MultiReader(bytes.NewReader(buffered), source)
+	}
+	rel.sockBuf = bufio.NewReadWriter(bufio.NewReader(newThrottle(source, config.RelayBandwidthQuota)), bufio.NewWriter(sock))
+
+	go rel.sender()
+	return rel
+}
+
+// Executes the initialization procedure of an inbound relay connection, bounded
+// by the handshake timeout. The client is connected to the Iris network, but not
+// started yet.
+func (r *Relay) acceptRelay(sock net.Conn) (*relay, error) {
+	// Bound the handshake (including any TLS one) by the timeout
+	deadline := time.Now().Add(config.RelayHandshakeTimeout)
+	if conn, ok := sock.(*tls.Conn); ok {
+		conn.SetDeadline(deadline)
+		if err := conn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetWriteDeadline(time.Time{})
 	}
+	sock.SetReadDeadline(deadline)
+
+	// Create the relay object
+	rel := r.newRelay(sock, nil)
+
 	// Lock the socket to ensure no writes pass during init
 	rel.sockLock.Lock()
 	defer rel.sockLock.Unlock()
 
-	// Initialize the relay
+	// Initialize the relay, authenticating the client if required
 	app, err := rel.procInit()
 	if err != nil {
 		rel.drop()
 		return nil, err
 	}
-	// Connect to the Iris network
-	conn, err := r.iris.Connect(app, rel)
-	if err != nil {
+	ident := ""
+	if r.creds != nil {
+		if ident, err = rel.authenticate(app, r.creds); err != nil {
+			rel.drop()
+			return nil, err
+		}
+	}
+	if err := r.connectRelay(rel, app, ident); err != nil {
 		rel.drop()
 		return nil, err
 	}
-	rel.iris = conn
-
-	// Report the connection accepted
+	// Report the connection accepted and lift the handshake deadline
 	if err := rel.sendInit(); err != nil {
 		rel.drop()
+		rel.iris.Close()
 		return nil, err
 	}
-	// Start accepting messages and return
-	rel.workers.Start()
-	go rel.process()
+	sock.SetReadDeadline(time.Time{})
 	return rel, nil
 }
 
+// Runs the handshake of an inbound connection, passing the initialized client
+// to the acceptor (or nil if the handshake failed).
+func (r *Relay) handshake(sock net.Conn) {
+	rel, err := r.acceptRelay(sock)
+	if err != nil {
+		log.Printf("relay: accept failed: %v.", err)
+		rel = nil
+	}
+	select {
+	case r.joins <- rel:
+	case <-r.term:
+		if rel != nil {
+			rel.abandon()
+		}
+	}
+}
+
+// Starts processing the messages of an initialized client.
+func (r *relay) start() {
+	r.workers.Start()
+	go r.process()
+}
+
+// Releases an initialized client which the terminating relay will not serve.
+func (r *relay) abandon() {
+	r.close()
+	r.iris.Close()
+}
+
+// Connects an initialized client to the Iris network it requested, enforcing
+// the access control list of its identity, if any.
+func (r *Relay) connectRelay(rel *relay, app string, ident string) error {
+	var err error
+	if r.acls != nil {
+		if rel.acl, err = lookupACL(r.acls, ident); err != nil {
+			return err
+		}
+		if !rel.acl.joinable(app) {
+			return fmt.Errorf("relay: access denied: %q may not join %s", ident, app)
+		}
+	}
+	// Connect to the requested Iris network, limiting the client's rates
+	overlay, name, cluster, err := r.resolve(app)
+	if err != nil {
+		return err
+	}
+	opts := append([]iris.ConnectionOption{iris.WithRateLimits(relayLimits())}, r.reconnectOpts(name)...)
+	conn, err := overlay.Connect(cluster, rel, opts...)
+	if err != nil {
+		return err
+	}
+	rel.iris, rel.app, rel.overlay, rel.ident = conn, cluster, name, ident
+	return nil
+}
+
+// Assembles the rate limits of the relayed connections from the configuration.
+func relayLimits() iris.RateLimits {
+	return iris.RateLimits{
+		Requests:  config.RelayRequestRate,
+		Publishes: config.RelayPublishRate,
+		Handlers:  config.RelayHandlerRate,
+	}
+}
+
 // Forcefully drops the relay connection. Used during irrecoverable errors.
 func (r *relay) drop() {
 	r.sock.Close()
+	r.dropOnce.Do(func() {
+		r.count(&r.stats.Errors, 1, MetricRelayError)
+		close(r.dropped)
+	})
+}
+
+// Closes the relay connection without the client being at fault. Used during the
+// termination of the relay service.
+func (r *relay) close() {
+	r.dropOnce.Do(func() { close(r.dropped) })
+	r.sock.Close()
 }
 
 // Fetches the closure report from the relay.
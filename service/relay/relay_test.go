@@ -0,0 +1,294 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/proto/iris"
+)
+
+// Boots an Iris overlay and a relay attached to it, listening on an ephemeral
+// port. The returned function tears both down.
+func startRelay(t *testing.T, opts ...Option) (*Relay, func()) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := iris.New("relay-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	rel, err := New(0, node, opts...)
+	if err != nil {
+		node.Shutdown()
+		t.Fatalf("failed to create relay: %v.", err)
+	}
+	if err := rel.Boot(); err != nil {
+		node.Shutdown()
+		t.Fatalf("failed to boot relay: %v.", err)
+	}
+	return rel, func() {
+		rel.Terminate()
+		node.Shutdown()
+	}
+}
+
+// Raw relay protocol endpoint, driving the relay the way a client binding would.
+type testClient struct {
+	conn   net.Conn      // Network connection to the relay
+	reader *bufio.Reader // Buffered access to the inbound stream
+	framed bool          // Whether the v2 framing was negotiated
+	frame  *bytes.Reader // Body of the inbound frame being parsed (v2 only)
+}
+
+// Dials the main endpoint of a relay.
+func dialRelay(t *testing.T, rel *Relay) *testClient {
+	conn, err := net.Dial("tcp", rel.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial relay: %v.", err)
+	}
+	return newTestClient(conn)
+}
+
+// Wraps an established network connection into a raw protocol endpoint.
+func newTestClient(conn net.Conn) *testClient {
+	return &testClient{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+}
+
+// Serializes a message from its fields: bytes and booleans as is, integers as
+// varints, strings and binaries length-tagged.
+func encode(fields ...interface{}) []byte {
+	buf := new(bytes.Buffer)
+	for _, field := range fields {
+		switch field := field.(type) {
+		case byte:
+			buf.WriteByte(field)
+		case bool:
+			if field {
+				buf.WriteByte(1)
+			} else {
+				buf.WriteByte(0)
+			}
+		case int:
+			writeUvarint(buf, uint64(field))
+		case uint64:
+			writeUvarint(buf, field)
+		case string:
+			writeUvarint(buf, uint64(len(field)))
+			buf.WriteString(field)
+		case []byte:
+			writeUvarint(buf, uint64(len(field)))
+			buf.Write(field)
+		default:
+			panic(fmt.Sprintf("unsupported field type: %T", field))
+		}
+	}
+	return buf.Bytes()
+}
+
+// Serializes a variable int into a buffer.
+func writeUvarint(buf *bytes.Buffer, num uint64) {
+	var blob [binary.MaxVarintLen64]byte
+	buf.Write(blob[:binary.PutUvarint(blob[:], num)])
+}
+
+// Sends the unframed init message, negotiating framing if v2 was requested.
+func (c *testClient) sendInit(version, app string) error {
+	c.framed = version == relayVersionV2
+	_, err := c.conn.Write(encode(opInit, version, app))
+	return err
+}
+
+// Sends a single message assembled from its fields, framed if v2 was negotiated.
+func (c *testClient) send(fields ...interface{}) error {
+	msg := encode(fields...)
+	if c.framed {
+		msg = append(encode(len(msg)), msg...)
+	}
+	_, err := c.conn.Write(msg)
+	return err
+}
+
+// Initializes the connection and waits for the relay's confirmation.
+func (c *testClient) handshake(version, app string) error {
+	if err := c.sendInit(version, app); err != nil {
+		return err
+	}
+	if op, err := c.recvOp(); err != nil {
+		return err
+	} else if op != opInit {
+		return fmt.Errorf("init reply mismatch: have %v, want %v", op, opInit)
+	}
+	return nil
+}
+
+// Returns the reader the message fields should be parsed from.
+func (c *testClient) source() interface {
+	io.Reader
+	io.ByteReader
+} {
+	if c.framed {
+		return c.frame
+	}
+	return c.reader
+}
+
+// Retrieves the opcode of the next message, reading its whole frame in v2.
+func (c *testClient) recvOp() (byte, error) {
+	if c.framed {
+		size, err := binary.ReadUvarint(c.reader)
+		if err != nil {
+			return 0, err
+		}
+		body := make([]byte, size)
+		if _, err := io.ReadFull(c.reader, body); err != nil {
+			return 0, err
+		}
+		c.frame = bytes.NewReader(body)
+	}
+	return c.recvByte()
+}
+
+// Retrieves the next message of the given opcode, skipping any other ones.
+func (c *testClient) expect(op byte) error {
+	for {
+		have, err := c.recvOp()
+		if err != nil {
+			return err
+		}
+		if have == op {
+			return nil
+		}
+		if !c.framed {
+			return fmt.Errorf("opcode mismatch: have %v, want %v", have, op)
+		}
+	}
+}
+
+// Retrieves a single byte of the current message.
+func (c *testClient) recvByte() (byte, error) {
+	return c.source().ReadByte()
+}
+
+// Retrieves a boolean of the current message.
+func (c *testClient) recvBool() (bool, error) {
+	b, err := c.recvByte()
+	return b == 1, err
+}
+
+// Retrieves a variable int of the current message.
+func (c *testClient) recvVarint() (uint64, error) {
+	return binary.ReadUvarint(c.source())
+}
+
+// Retrieves a length-tagged binary of the current message.
+func (c *testClient) recvBinary() ([]byte, error) {
+	size, err := c.recvVarint()
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c.source(), data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Retrieves a length-tagged string of the current message.
+func (c *testClient) recvString() (string, error) {
+	data, err := c.recvBinary()
+	return string(data), err
+}
+
+// Waits for the relay to close the connection, failing after the timeout.
+func (c *testClient) waitClose(timeout time.Duration) error {
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	defer c.conn.SetReadDeadline(time.Time{})
+
+	for {
+		if _, err := c.reader.ReadByte(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				return fmt.Errorf("connection not closed in %v", timeout)
+			}
+			return nil
+		}
+	}
+}
+
+// Connects to a relay over an in-memory pipe, passing the server end straight
+// to the acceptor.
+func pipeRelay(rel *Relay) *testClient {
+	server, client := net.Pipe()
+	rel.admit(server)
+	return newTestClient(client)
+}
+
+// Initializes the connection, answering the authentication challenge with the
+// given credential.
+func (c *testClient) login(version, app, id string, secret []byte) error {
+	if err := c.sendInit(version, app); err != nil {
+		return err
+	}
+	if err := c.expect(opAuth); err != nil {
+		return err
+	}
+	nonce, err := c.recvBinary()
+	if err != nil {
+		return err
+	}
+	if err := c.send(opAuth, id, signNonce(secret, nonce)); err != nil {
+		return err
+	}
+	return c.expect(opInit)
+}
+
+// Retrieves the next access denial, checking the refused operation.
+func (c *testClient) expectDenied(op byte, id uint64, topic string) error {
+	if err := c.expect(opDenied); err != nil {
+		return err
+	}
+	haveOp, err := c.recvByte()
+	if err != nil {
+		return err
+	}
+	haveId, err := c.recvVarint()
+	if err != nil {
+		return err
+	}
+	haveTopic, err := c.recvString()
+	if err != nil {
+		return err
+	}
+	if haveOp != op || haveId != id || haveTopic != topic {
+		return fmt.Errorf("denial mismatch: have %v/%v/%q, want %v/%v/%q", haveOp, haveId, haveTopic, op, id, topic)
+	}
+	return nil
+}
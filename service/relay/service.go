@@ -20,61 +20,253 @@
 package relay
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net"
-	"time"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
 
+	"github.com/karalabe/iris/config"
 	"github.com/karalabe/iris/proto/iris"
+	"github.com/karalabe/iris/proto/stream"
 )
 
-// Rate at which to check for relay termination.
-var acceptPollRate = time.Second
-
-// Relay service, listening on a local TCP port and accepting connections for
-// joining the Iris network.
+// Relay service, listening on a local TCP port (and optionally on WebSocket, Unix
+// domain socket and TLS endpoints) and accepting connections for joining the
+// Iris network.
 type Relay struct {
-	address  *net.TCPAddr     // Listener address
-	listener *net.TCPListener // Listener socket for the locally joining apps
-	iris     *iris.Overlay    // Overlay through which connections are relayed
+	address  *net.TCPAddr  // Listener address
+	listener net.Listener  // Listener socket for the locally joining apps
+	iris     *iris.Overlay // Overlay through which connections are relayed
+	irisLock sync.RWMutex  // Mutex to protect the carrier swapped on reconnection
+
+	redial iris.Dialer          // Dialer of the replacement carriers (nil if no reconnection)
+	policy iris.ReconnectPolicy // Backoff policy of the carrier re-dials
+
+	overlays map[string]*iris.Overlay // Additional overlays attachable by name
+
+	wsAddr   string      // Listener address of the WebSocket endpoint ("" if disabled)
+	unixPath string      // Path of the Unix domain socket endpoint ("" if disabled)
+	unixPerm os.FileMode // File permissions of the Unix domain socket
+	tlsAddr  string      // Listener address of the TLS endpoint ("" if disabled)
+	tlsConf  *tls.Config // Certificates and settings of the TLS endpoint
+
+	endpoints []net.Listener // Listener sockets of the optional endpoints
+
+	creds map[string]*Credential // Credentials of the admitted clients (nil if open)
+	acls  map[string]*ACL        // Access control lists of the client identities (nil if open)
+
+	statAddr string // Listener address of the HTTP status endpoint ("" if disabled)
+
+	metrics  iris.Metrics // Collector to count the client operations with (nil if none)
+	oplog    *opLog       // Sampled logger of the client operations (nil if disabled)
+	closed   Stats        // Aggregated traffic statistics of the closed clients
+	statLock sync.Mutex   // Mutex to protect the closed client statistics
+
+	handoff *net.UnixConn // Handoff socket to take over a predecessor's clients through (nil if none)
 
 	clients map[*relay]struct{} // Active client connections
+	joining int                 // Inbound connections still running their handshake
+
+	embeds    map[*iris.Connection]iris.ConnectionHandler // Active embedded connections
+	embedDone bool                                        // Whether the relay stopped accepting embedded connections
+	embedLock sync.Mutex                                  // Mutex to protect the embedded connections
 
-	done chan *relay     // Channel on which active clients signal termination
-	quit chan chan error // Quit channel to synchronize relay termination
+	socks chan net.Conn     // Channel on which the endpoints pass the accepted sockets
+	joins chan *relay       // Channel on which the handshakes pass the initialized clients
+	done  chan *relay       // Channel on which active clients signal termination
+	stat  chan chan *Status // Channel on which the status endpoint requests snapshots
+	hand  chan *handoff     // Channel on which to request handing off the clients
+	shut  chan *shutdown    // Channel on which to request a graceful shutdown
+	quit  chan chan error   // Quit channel to synchronize relay termination
+	term  chan struct{}     // Channel to signal termination to the endpoint listeners
+}
+
+// Configuration option of a relay service.
+type Option func(*Relay)
+
+// Serves an additional overlay through the relay, which clients attach to by
+// qualifying the cluster they join with the overlay's name (cluster@name).
+// Unqualified clusters are joined in the default overlay.
+func WithOverlay(name string, overlay *iris.Overlay) Option {
+	return func(r *Relay) {
+		if r.overlays == nil {
+			r.overlays = make(map[string]*iris.Overlay)
+		}
+		r.overlays[name] = overlay
+	}
+}
+
+// Serves the relay protocol over WebSocket too, framed into binary messages, on
+// the given listener address (host:port). Browser based and firewall restricted
+// clients may connect through it, the endpoint accepting any request path.
+func WithWebSocket(addr string) Option {
+	return func(r *Relay) {
+		r.wsAddr = addr
+	}
+}
+
+// Serves the relay protocol on a Unix domain socket too, created at the given
+// path with the given file permissions. Any stale socket file left over at the
+// path is replaced.
+func WithUnixSocket(path string, perm os.FileMode) Option {
+	return func(r *Relay) {
+		r.unixPath, r.unixPerm = path, perm
+	}
+}
+
+// Serves the relay protocol over TLS too, on the given listener address (host:port)
+// with the given configuration (certificates, client verification), allowing
+// clients on other hosts to connect securely.
+func WithTLS(addr string, config *tls.Config) Option {
+	return func(r *Relay) {
+		r.tlsAddr, r.tlsConf = addr, config
+	}
 }
 
 // Creates a new relay attached to a carrier and opens the listener socket on
 // the specified local port.
-func New(port int, overlay *iris.Overlay) (*Relay, error) {
+func New(port int, overlay *iris.Overlay, opts ...Option) (*Relay, error) {
 	// Assemble the listener address
 	addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("localhost:%d", port))
 	if err != nil {
 		return nil, err
 	}
 	// Return the relay service endpoint
-	return &Relay{
+	r := &Relay{
 		address: addr,
 		iris:    overlay,
 		clients: make(map[*relay]struct{}),
+		embeds:  make(map[*iris.Connection]iris.ConnectionHandler),
+		socks:   make(chan net.Conn),
+		joins:   make(chan *relay),
 		done:    make(chan *relay),
+		stat:    make(chan chan *Status),
+		hand:    make(chan *handoff),
+		shut:    make(chan *shutdown),
 		quit:    make(chan chan error),
-	}, nil
+		term:    make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r, nil
+}
+
+// Resolves the overlay a client's requested cluster should be joined in, along
+// with the name of the overlay ("" if the default) and the unqualified cluster.
+func (r *Relay) resolve(app string) (*iris.Overlay, string, string, error) {
+	if r.overlays != nil {
+		if idx := strings.LastIndex(app, "@"); idx >= 0 {
+			name := app[idx+1:]
+			if overlay, ok := r.overlays[name]; ok {
+				return overlay, name, app[:idx], nil
+			}
+			return nil, "", "", fmt.Errorf("relay: unknown overlay: %s", name)
+		}
+	}
+	return r.carrier(), "", app, nil
 }
 
 // Starts accepting local relay connections.
 func (r *Relay) Boot() error {
-	// Open the server socket
-	if sock, err := net.ListenTCP("tcp", r.address); err != nil {
+	// Open the server sockets
+	if sock, err := listenTCP(r.address.String()); err != nil {
 		return err
 	} else {
 		r.listener = sock
 	}
-	// Start accepting connections
+	if r.wsAddr != "" {
+		sock, err := listenTCP(r.wsAddr)
+		if err != nil {
+			r.closeListeners()
+			return err
+		}
+		r.endpoints = append(r.endpoints, sock)
+		go (&http.Server{Handler: http.HandlerFunc(r.upgrade), ReadHeaderTimeout: config.RelayHandshakeTimeout}).Serve(sock)
+	}
+	if r.unixPath != "" {
+		sock, err := r.listenUnix()
+		if err != nil {
+			r.closeListeners()
+			return err
+		}
+		r.endpoints = append(r.endpoints, sock)
+		go r.listen(sock)
+	}
+	if r.tlsAddr != "" {
+		sock, err := listenTCP(r.tlsAddr)
+		if err != nil {
+			r.closeListeners()
+			return err
+		}
+		sock = tls.NewListener(sock, r.tlsConf)
+		r.endpoints = append(r.endpoints, sock)
+		go r.listen(sock)
+	}
+	if r.statAddr != "" {
+		sock, err := listenTCP(r.statAddr)
+		if err != nil {
+			r.closeListeners()
+			return err
+		}
+		r.endpoints = append(r.endpoints, sock)
+		go (&http.Server{Handler: http.HandlerFunc(r.serveStatus), ReadHeaderTimeout: config.RelayHandshakeTimeout}).Serve(sock)
+	}
+	// Take over the clients of the predecessor, if any, and start accepting
+	go r.listen(r.listener)
+	if r.handoff != nil {
+		if err := r.resume(); err != nil {
+			log.Printf("relay: client takeover failed: %v.", err)
+		}
+		log.Printf("relay: took over %d clients.", len(r.clients))
+	}
 	go r.acceptor()
 	return nil
 }
 
+// Opens a TCP listener socket, sharing the port with the listeners of a handoff
+// successor.
+func listenTCP(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: stream.ReuseControl}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// Opens the Unix domain socket endpoint, removing any stale socket file first
+// and restricting the access permissions.
+func (r *Relay) listenUnix() (net.Listener, error) {
+	if info, err := os.Lstat(r.unixPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(r.unixPath); err != nil {
+			return nil, err
+		}
+	}
+	sock, err := net.Listen("unix", r.unixPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(r.unixPath, r.unixPerm); err != nil {
+		sock.Close()
+		return nil, err
+	}
+	return sock, nil
+}
+
+// Closes the listener sockets of all the endpoints, returning the first failure.
+func (r *Relay) closeListeners() error {
+	err := r.listener.Close()
+	for _, sock := range r.endpoints {
+		if serr := sock.Close(); err == nil {
+			err = serr
+		}
+	}
+	return err
+}
+
 // Closes all open connections and terminates the relaying service.
 func (r *Relay) Terminate() error {
 	errc := make(chan error, 1)
@@ -82,47 +274,120 @@ func (r *Relay) Terminate() error {
 	return <-errc
 }
 
+// Accepts inbound sockets on a listener till it is closed, passing them to the
+// acceptor.
+func (r *Relay) listen(sock net.Listener) {
+	for {
+		conn, err := sock.Accept()
+		if err != nil {
+			select {
+			case <-r.term:
+			default:
+				log.Printf("relay: accept failed: %v, terminating.", err)
+			}
+			return
+		}
+		r.admit(conn)
+	}
+}
+
+// Hands an accepted socket over to the acceptor, closing it if the relay is
+// already terminating.
+func (r *Relay) admit(conn net.Conn) {
+	select {
+	case r.socks <- conn:
+	case <-r.term:
+		conn.Close()
+	}
+}
+
 // Accepts inbound connections till the service is terminated. For each one it
 // starts a new handler and hands the socket over.
 func (r *Relay) acceptor() {
-	// Accept conenctions until termination request
+	// Accept conenctions until termination, shutdown or handoff request
 	var errc chan error
+	var hand *handoff
+	var shut *shutdown
 	for errc == nil {
 		select {
 		case errc = <-r.quit:
 			break
+		case hand = <-r.hand:
+			errc = hand.errc
+		case shut = <-r.shut:
+			errc = shut.errc
 		case client := <-r.done:
 			// A client terminated, remove from active list
 			delete(r.clients, client)
+			r.retire(client)
 			if err := client.report(); err != nil {
 				log.Printf("relay: closing client error: %v.", err)
 			}
-		default:
-			// Accept an incoming connection but without blocking for too long
-			r.listener.SetDeadline(time.Now().Add(acceptPollRate))
-			if sock, err := r.listener.Accept(); err == nil {
-				if rel, err := r.acceptRelay(sock); err != nil {
-					log.Printf("relay: accept failed: %v.", err)
-				} else {
-					r.clients[rel] = struct{}{}
-				}
-			} else if !err.(net.Error).Timeout() {
-				log.Printf("relay: accept failed: %v, terminating.", err)
+		case sock := <-r.socks:
+			if limit := config.RelayClientLimit; limit > 0 && len(r.clients)+r.joining >= limit {
+				log.Printf("relay: client limit of %d reached, refusing connection.", limit)
+				sock.Close()
+			} else {
+				r.joining++
+				go r.handshake(sock)
 			}
+		case rel := <-r.joins:
+			r.joining--
+			if rel != nil {
+				r.clients[rel] = struct{}{}
+				rel.start()
+			}
+		case reply := <-r.stat:
+			reply <- r.status()
 		}
 	}
-	// In case of failure, wait for termination request
-	if errc == nil {
-		errc = <-r.quit
-	}
-	// Forcefully close all active client connections
-	for rel, _ := range r.clients {
-		rel.drop()
-		<-r.done
+	// Stop the endpoints from accepting further connections
+	close(r.term)
+	err := r.closeListeners()
+	embeds := r.detach()
+	switch {
+	case shut != nil:
+		// Drain all active client connections, waiting for them to terminate
+		drained := drainEmbeds(embeds, errors.New(shut.reason))
+		for rel, _ := range r.clients {
+			go rel.shutdown(shut.reason)
+		}
+		for i := 0; i < len(r.clients); i++ {
+			r.retire(<-r.done)
+		}
+		drained.Wait()
+	case hand == nil:
+		// Forcefully close all active client connections
+		closeEmbeds(embeds, errTerminated)
+		for rel, _ := range r.clients {
+			rel.close()
+			r.retire(<-r.done)
+		}
+	default:
+		// Embedded connections cannot be handed off, close them
+		closeEmbeds(embeds, errHandoff)
+
+		// Pause the transferable clients for the handoff, dropping the rest
+		for rel, _ := range r.clients {
+			if rel.transferable() {
+				rel.suspendRead()
+			} else {
+				rel.close()
+			}
+		}
+		suspended := []*relay{}
+		for i := 0; i < len(r.clients); i++ {
+			rel := <-r.done
+			r.retire(rel)
+			if rel.suspended {
+				suspended = append(suspended, rel)
+			}
+		}
+		r.transfer(hand.conn, suspended)
 	}
 	for rel, _ := range r.clients {
 		rel.report()
 	}
-	// Clean up and report
-	errc <- r.listener.Close()
+	// Report the listener closure results
+	errc <- err
 }
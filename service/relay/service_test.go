@@ -0,0 +1,133 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package relay
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Tests that a client stalling its handshake does not block others from joining,
+// and that it gets dropped once the handshake timeout passes.
+func TestSilentClient(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	rel, stop := startRelay(t)
+	defer stop()
+
+	// Connect a client never sending its init
+	silent := dialRelay(t, rel)
+	defer silent.conn.Close()
+
+	// Make sure another client can join meanwhile
+	client := dialRelay(t, rel)
+	defer client.conn.Close()
+
+	client.conn.SetDeadline(time.Now().Add(config.RelayHandshakeTimeout / 2))
+	if err := client.handshake(relayVersionV2, "silent-test"); err != nil {
+		t.Fatalf("failed to handshake with relay: %v.", err)
+	}
+	client.conn.SetDeadline(time.Time{})
+
+	// Verify that the silent client is dropped, but the joined one isn't
+	if err := silent.waitClose(2 * config.RelayHandshakeTimeout); err != nil {
+		t.Fatalf("silent client not dropped: %v.", err)
+	}
+	if err := client.send(opPing, 1, 1000); err != nil {
+		t.Fatalf("failed to send ping: %v.", err)
+	}
+	if err := client.expect(opPong); err != nil {
+		t.Fatalf("failed to receive pong: %v.", err)
+	}
+}
+
+// Tests that the TLS handshake is bounded by the handshake timeout too, and does
+// not block other clients from joining.
+func TestSilentTLSClient(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	cert, err := selfSignedCert()
+	if err != nil {
+		t.Fatalf("failed to generate certificate: %v.", err)
+	}
+	rel, stop := startRelay(t, WithTLS("localhost:0", &tls.Config{Certificates: []tls.Certificate{cert}}))
+	defer stop()
+
+	addr := rel.endpoints[0].Addr().String()
+
+	// Connect a client never starting the TLS handshake
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial relay: %v.", err)
+	}
+	silent := newTestClient(conn)
+	defer silent.conn.Close()
+
+	// Make sure another client can join meanwhile
+	conn, err = tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("failed to dial relay over TLS: %v.", err)
+	}
+	client := newTestClient(conn)
+	defer client.conn.Close()
+
+	client.conn.SetDeadline(time.Now().Add(config.RelayHandshakeTimeout / 2))
+	if err := client.handshake(relayVersionV2, "silent-test"); err != nil {
+		t.Fatalf("failed to handshake with relay: %v.", err)
+	}
+	// Verify that the silent client is dropped
+	if err := silent.waitClose(2 * config.RelayHandshakeTimeout); err != nil {
+		t.Fatalf("silent client not dropped: %v.", err)
+	}
+}
+
+// Generates a self signed certificate for the relay's TLS endpoint.
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
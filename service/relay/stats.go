@@ -0,0 +1,147 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the traffic statistics of the relay: the requests, broadcasts and
+// publishes forwarded, the tunnel bytes transferred and the failures of every
+// client, aggregated over all of them too. Each operation is also counted by
+// the metrics collector of the relay, if one is set.
+
+package relay
+
+import (
+	"sync/atomic"
+
+	"github.com/karalabe/iris/proto/iris"
+)
+
+// Events counted by the metrics collector, alongside those of the overlays.
+const (
+	MetricRelayBroadcastSent = "relay-broadcast-sent"
+	MetricRelayBroadcastRecv = "relay-broadcast-recv"
+	MetricRelayRequestSent   = "relay-request-sent"
+	MetricRelayRequestFailed = "relay-request-failed"
+	MetricRelayRequestRecv   = "relay-request-recv"
+	MetricRelayPublishSent   = "relay-publish-sent"
+	MetricRelayPublishRecv   = "relay-publish-recv"
+	MetricRelayTunnelSent    = "relay-tunnel-sent"
+	MetricRelayTunnelRecv    = "relay-tunnel-recv"
+	MetricRelayRefused       = "relay-refused"
+	MetricRelayError         = "relay-error"
+)
+
+// Traffic statistics of a relay client, or of all of them in aggregate.
+type Stats struct {
+	RequestsSent    uint64 `json:"requestsSent"`    // Requests forwarded from the client into the network
+	RequestsFailed  uint64 `json:"requestsFailed"`  // Forwarded requests that failed or timed out
+	RequestsServed  uint64 `json:"requestsServed"`  // Requests of the network forwarded to the client
+	BroadcastsSent  uint64 `json:"broadcastsSent"`  // Broadcasts forwarded from the client into the network
+	BroadcastsRecv  uint64 `json:"broadcastsRecv"`  // Broadcasts of the network forwarded to the client
+	PublishesSent   uint64 `json:"publishesSent"`   // Events published by the client
+	PublishesRecv   uint64 `json:"publishesRecv"`   // Events fanned out to the subscriptions of the client
+	TunnelBytesSent uint64 `json:"tunnelBytesSent"` // Payload bytes forwarded from the client into tunnels
+	TunnelBytesRecv uint64 `json:"tunnelBytesRecv"` // Payload bytes forwarded from tunnels to the client
+	Refusals        uint64 `json:"refusals"`        // Operations refused by a quota, rate limit or the ACL
+	Errors          uint64 `json:"errors"`          // Protocol violations and forwarding failures
+}
+
+// Counts the traffic and failures of the relay clients with the given collector,
+// in addition to the per client statistics.
+func WithMetrics(metrics iris.Metrics) Option {
+	return func(r *Relay) {
+		r.metrics = metrics
+	}
+}
+
+// Atomically snapshots live statistics (updated concurrently).
+func (s *Stats) snapshot() *Stats {
+	return &Stats{
+		RequestsSent:    atomic.LoadUint64(&s.RequestsSent),
+		RequestsFailed:  atomic.LoadUint64(&s.RequestsFailed),
+		RequestsServed:  atomic.LoadUint64(&s.RequestsServed),
+		BroadcastsSent:  atomic.LoadUint64(&s.BroadcastsSent),
+		BroadcastsRecv:  atomic.LoadUint64(&s.BroadcastsRecv),
+		PublishesSent:   atomic.LoadUint64(&s.PublishesSent),
+		PublishesRecv:   atomic.LoadUint64(&s.PublishesRecv),
+		TunnelBytesSent: atomic.LoadUint64(&s.TunnelBytesSent),
+		TunnelBytesRecv: atomic.LoadUint64(&s.TunnelBytesRecv),
+		Refusals:        atomic.LoadUint64(&s.Refusals),
+		Errors:          atomic.LoadUint64(&s.Errors),
+	}
+}
+
+// Merges the statistics of another client into this one.
+func (s *Stats) merge(other *Stats) {
+	s.RequestsSent += other.RequestsSent
+	s.RequestsFailed += other.RequestsFailed
+	s.RequestsServed += other.RequestsServed
+	s.BroadcastsSent += other.BroadcastsSent
+	s.BroadcastsRecv += other.BroadcastsRecv
+	s.PublishesSent += other.PublishesSent
+	s.PublishesRecv += other.PublishesRecv
+	s.TunnelBytesSent += other.TunnelBytesSent
+	s.TunnelBytesRecv += other.TunnelBytesRecv
+	s.Refusals += other.Refusals
+	s.Errors += other.Errors
+}
+
+// Counts an operation of the client into one of its statistics (adding delta to
+// it) and reports the event to the metrics collector, if any.
+func (r *relay) count(stat *uint64, delta uint64, event string) {
+	atomic.AddUint64(stat, delta)
+	if r.metrics != nil {
+		r.metrics.Count(event)
+	}
+}
+
+// Merges the statistics of a terminated client into those of the closed ones.
+func (r *Relay) retire(rel *relay) {
+	r.statLock.Lock()
+	defer r.statLock.Unlock()
+
+	r.closed.merge(rel.stats.snapshot())
+}
+
+// Aggregates the statistics of the active clients and the closed ones. Only the
+// acceptor may call it.
+func (r *Relay) totals() *Stats {
+	r.statLock.Lock()
+	stats := r.closed
+	r.statLock.Unlock()
+
+	for rel, _ := range r.clients {
+		stats.merge(rel.stats.snapshot())
+	}
+	return &stats
+}
+
+// Retrieves the traffic statistics aggregated over all the clients of the relay
+// (closed ones included).
+func (r *Relay) Stats() *Stats {
+	reply := make(chan *Status, 1)
+	select {
+	case r.stat <- reply:
+		return (<-reply).Stats
+	case <-r.term:
+		r.statLock.Lock()
+		defer r.statLock.Unlock()
+
+		stats := r.closed
+		return &stats
+	}
+}
@@ -0,0 +1,142 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the optional HTTP status endpoint of the relay, reporting the attached
+// clients, their subscriptions, queue depths and traffic, and the overlay
+// connectivity as JSON for dashboards and health probes.
+
+package relay
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+)
+
+// Status snapshot of a relay service.
+type Status struct {
+	Peers    int             `json:"peers"`    // Remote peers of the overlay
+	Clusters []string        `json:"clusters"` // Distinct clusters joined by the clients (cluster@overlay if not the default)
+	Clients  []*ClientStatus `json:"clients"`  // Attached client connections
+	Stats    *Stats          `json:"stats"`    // Traffic of all the clients, closed ones included
+}
+
+// Status snapshot of a single attached client.
+type ClientStatus struct {
+	Overlay  string   `json:"overlay"`       // Overlay joined by the client ("" if the default)
+	Cluster  string   `json:"cluster"`       // Cluster joined by the client
+	Remote   string   `json:"remote"`        // Network address of the client
+	Topics   []string `json:"subscriptions"` // Topics subscribed to
+	Requests int      `json:"requests"`      // Inbound requests waiting for a reply
+	Tunnels  int      `json:"tunnels"`       // Live and pending tunnels
+	Queue    int      `json:"queue"`         // Inbound messages waiting for a handler
+	Outbound int      `json:"outbound"`      // Messages waiting to be written to the client
+	Stats    *Stats   `json:"stats"`         // Traffic of the client
+}
+
+// Serves the relay status over HTTP too, on the given listener address (host:port),
+// answering any request path with a JSON snapshot.
+func WithStatus(addr string) Option {
+	return func(r *Relay) {
+		r.statAddr = addr
+	}
+}
+
+// Snapshots the status of the active clients. Only the acceptor may call it.
+func (r *Relay) status() *Status {
+	stat := &Status{
+		Clusters: []string{},
+		Clients:  make([]*ClientStatus, 0, len(r.clients)),
+		Stats:    r.totals(),
+	}
+	clusters := make(map[string]struct{})
+	for rel, _ := range r.clients {
+		client := rel.status()
+
+		cluster := client.Cluster
+		if client.Overlay != "" {
+			cluster += "@" + client.Overlay
+		}
+		if _, ok := clusters[cluster]; !ok {
+			clusters[cluster] = struct{}{}
+			stat.Clusters = append(stat.Clusters, cluster)
+		}
+		stat.Clients = append(stat.Clients, client)
+	}
+	sort.Strings(stat.Clusters)
+	sort.Slice(stat.Clients, func(i, j int) bool {
+		if stat.Clients[i].Overlay != stat.Clients[j].Overlay {
+			return stat.Clients[i].Overlay < stat.Clients[j].Overlay
+		}
+		if stat.Clients[i].Cluster != stat.Clients[j].Cluster {
+			return stat.Clients[i].Cluster < stat.Clients[j].Cluster
+		}
+		return stat.Clients[i].Remote < stat.Clients[j].Remote
+	})
+	return stat
+}
+
+// Snapshots the status of a single client connection.
+func (r *relay) status() *ClientStatus {
+	stat := &ClientStatus{
+		Overlay:  r.overlay,
+		Cluster:  r.app,
+		Remote:   r.sock.RemoteAddr().String(),
+		Queue:    r.workers.Pending(),
+		Outbound: len(r.outQueue),
+		Stats:    r.stats.snapshot(),
+	}
+	r.subLock.RLock()
+	stat.Topics = make([]string, 0, len(r.subLive))
+	for topic, _ := range r.subLive {
+		stat.Topics = append(stat.Topics, topic)
+	}
+	r.subLock.RUnlock()
+	sort.Strings(stat.Topics)
+
+	r.reqLock.RLock()
+	stat.Requests = len(r.reqPend)
+	r.reqLock.RUnlock()
+
+	r.tunLock.RLock()
+	stat.Tunnels = len(r.tunPend) + len(r.tunLive)
+	r.tunLock.RUnlock()
+
+	return stat
+}
+
+// Answers a status request with a JSON snapshot fetched from the acceptor, or
+// with an unavailable error if the relay is terminating.
+func (r *Relay) serveStatus(w http.ResponseWriter, req *http.Request) {
+	reply := make(chan *Status, 1)
+	select {
+	case r.stat <- reply:
+	case <-r.term:
+		http.Error(w, "relay terminating", http.StatusServiceUnavailable)
+		return
+	}
+	stat := <-reply
+	stat.Peers = r.carrier().Peers()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stat); err != nil {
+		log.Printf("relay: status report failed: %v.", err)
+	}
+}
@@ -101,6 +101,7 @@ func (t *tunnel) sender() {
 		case msg := <-t.atoi:
 			// Send the message and ack the client (async)
 			if err = t.tun.Send(msg); err == nil {
+				t.rel.count(&t.rel.stats.TunnelBytesSent, uint64(len(msg)), MetricRelayTunnelSent)
 				go func() {
 					if err := t.rel.sendTunnelAck(t.id); err != nil {
 						log.Printf("relay: send ack failed: %v.", err)
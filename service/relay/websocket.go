@@ -0,0 +1,249 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the WebSocket endpoint of the relay. Clients complete the opening
+// handshake of RFC 6455, after which the relay protocol is carried as a plain byte
+// stream inside binary (or text) messages: message boundaries carry no meaning,
+// every flushed relay message being sent as a single frame. Pings are answered
+// and a close frame terminates the connection like a closed socket.
+
+package relay
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// GUID appended to the client key when computing the handshake accept key.
+const wsGuid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Maximum payload size of an inbound frame, protecting against huge allocations.
+const wsFrameLimit = 1 << 26
+
+// WebSocket frame opcodes.
+const (
+	wsContinuation byte = 0x0
+	wsText         byte = 0x1
+	wsBinary       byte = 0x2
+	wsClose        byte = 0x8
+	wsPing         byte = 0x9
+	wsPong         byte = 0xa
+)
+
+var errWsProtocol = errors.New("websocket protocol violation")
+
+// Socket adapter carrying a byte stream over the messages of a WebSocket.
+type wsConn struct {
+	net.Conn                   // Hijacked network connection (deadlines, addresses)
+	buffer   *bufio.ReadWriter // Buffers of the hijacked HTTP connection
+	payload  io.Reader         // Remainder of the data frame being read
+	mask     [4]byte           // Masking key of the data frame being read
+	offset   int               // Position within the masking key
+	closed   bool              // Whether a close frame was already sent
+	lock     sync.Mutex        // Mutex serializing the outbound frames
+}
+
+// Answers the opening handshake of a WebSocket client, hijacking the connection
+// and passing it on to the relay acceptor.
+func (r *Relay) upgrade(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" || !headerHas(req.Header, "Connection", "upgrade") || !headerHas(req.Header, "Upgrade", "websocket") {
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing websocket key", http.StatusBadRequest)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("relay: websocket hijack failed: %v.", err)
+		return
+	}
+	// Complete the handshake and hand the connection over
+	hash := sha1.Sum([]byte(key + wsGuid))
+	buf.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	buf.WriteString("Upgrade: websocket\r\n")
+	buf.WriteString("Connection: Upgrade\r\n")
+	buf.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(hash[:]) + "\r\n\r\n")
+	if err := buf.Flush(); err != nil {
+		log.Printf("relay: websocket handshake failed: %v.", err)
+		conn.Close()
+		return
+	}
+	r.admit(&wsConn{Conn: conn, buffer: buf})
+}
+
+// Checks whether a comma separated header contains a token (case insensitive).
+func headerHas(header http.Header, name, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Reads the payload of the inbound data frames as a contiguous stream, handling
+// any interleaved control frames.
+func (c *wsConn) Read(data []byte) (int, error) {
+	for c.payload == nil {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := c.payload.Read(data)
+	for i := 0; i < n; i++ {
+		data[i] ^= c.mask[c.offset%4]
+		c.offset++
+	}
+	if err == io.EOF {
+		c.payload, err = nil, nil
+	}
+	return n, err
+}
+
+// Reads the next frame header, setting up the payload reader of data frames and
+// processing the control frames in place.
+func (c *wsConn) nextFrame() error {
+	var head [2]byte
+	if _, err := io.ReadFull(c.buffer, head[:]); err != nil {
+		return err
+	}
+	op, masked, size := head[0]&0x0f, head[1]&0x80 != 0, uint64(head[1]&0x7f)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.buffer, ext[:]); err != nil {
+			return err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.buffer, ext[:]); err != nil {
+			return err
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	// Clients must mask all their frames
+	if !masked || size > wsFrameLimit {
+		return errWsProtocol
+	}
+	if _, err := io.ReadFull(c.buffer, c.mask[:]); err != nil {
+		return err
+	}
+	c.offset = 0
+
+	switch op {
+	case wsContinuation, wsText, wsBinary:
+		if size > 0 {
+			c.payload = io.LimitReader(c.buffer, int64(size))
+		}
+		return nil
+	case wsPing, wsPong, wsClose:
+		if size > 125 {
+			return errWsProtocol
+		}
+		body := make([]byte, size)
+		if _, err := io.ReadFull(c.buffer, body); err != nil {
+			return err
+		}
+		for i := range body {
+			body[i] ^= c.mask[i%4]
+		}
+		switch op {
+		case wsPing:
+			return c.writeFrame(wsPong, body)
+		case wsClose:
+			c.writeFrame(wsClose, nil)
+			return io.EOF
+		}
+		return nil
+	default:
+		return errWsProtocol
+	}
+}
+
+// Sends the data as a single unmasked data frame.
+func (c *wsConn) Write(data []byte) (int, error) {
+	if err := c.writeFrame(wsBinary, data); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// Serializes a final frame with the given opcode and payload into the socket.
+func (c *wsConn) writeFrame(op byte, data []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return io.ErrClosedPipe
+	}
+	if op == wsClose {
+		c.closed = true
+	}
+	head := []byte{0x80 | op, 0}
+	switch size := len(data); {
+	case size < 126:
+		head[1] = byte(size)
+	case size <= 0xffff:
+		head[1] = 126
+		head = append(head, byte(size>>8), byte(size))
+	default:
+		head[1] = 127
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(size))
+		head = append(head, ext[:]...)
+	}
+	if _, err := c.buffer.Write(head); err != nil {
+		return err
+	}
+	if _, err := c.buffer.Write(data); err != nil {
+		return err
+	}
+	return c.buffer.Flush()
+}
+
+// Sends a close frame if not yet done and closes the underlying connection.
+func (c *wsConn) Close() error {
+	c.writeFrame(wsClose, nil)
+	return c.Conn.Close()
+}
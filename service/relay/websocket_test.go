@@ -0,0 +1,293 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Masking key used by the test clients.
+var wsTestMask = [4]byte{0x37, 0xfa, 0x21, 0x3d}
+
+// Assembles a masked client frame with the given opcode and payload.
+func wsFrame(op byte, fin bool, payload []byte) []byte {
+	head := []byte{op, 0x80}
+	if fin {
+		head[0] |= 0x80
+	}
+	head = wsAppendSize(head, uint64(len(payload)))
+	head = append(head, wsTestMask[:]...)
+	for i, b := range payload {
+		head = append(head, b^wsTestMask[i%4])
+	}
+	return head
+}
+
+// Appends the (possibly extended) payload length to a frame header.
+func wsAppendSize(head []byte, size uint64) []byte {
+	switch {
+	case size < 126:
+		head[1] |= byte(size)
+	case size <= 0xffff:
+		head[1] |= 126
+		head = append(head, byte(size>>8), byte(size))
+	default:
+		head[1] |= 127
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], size)
+		head = append(head, ext[:]...)
+	}
+	return head
+}
+
+// Creates a WebSocket adapter over one end of an in-memory pipe, returning the
+// other end too.
+func wsPipe() (*wsConn, net.Conn) {
+	server, client := net.Pipe()
+	buf := bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server))
+	return &wsConn{Conn: server, buffer: buf}, client
+}
+
+// Reads a single unmasked server frame, returning its header byte and payload.
+func wsReadFrame(r io.Reader) (byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	size := uint64(head[1] & 0x7f)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return head[0], body, nil
+}
+
+// Tests that fragmented, masked messages are read as a contiguous stream.
+func TestWsConnReadFragmented(t *testing.T) {
+	conn, client := wsPipe()
+	defer conn.Conn.Close()
+	defer client.Close()
+
+	stream := append(wsFrame(wsBinary, false, []byte("hello ")), wsFrame(wsContinuation, false, []byte("websocket "))...)
+	stream = append(stream, wsFrame(wsContinuation, true, []byte("world"))...)
+	stream = append(stream, wsFrame(wsText, true, []byte("!"))...)
+	go client.Write(stream)
+
+	want := "hello websocket world!"
+	have := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, have); err != nil {
+		t.Fatalf("failed to read stream: %v.", err)
+	}
+	if string(have) != want {
+		t.Fatalf("stream mismatch: have %q, want %q.", have, want)
+	}
+}
+
+// Tests that interleaved pings are answered with pongs and don't corrupt the stream.
+func TestWsConnReadPing(t *testing.T) {
+	conn, client := wsPipe()
+	defer conn.Conn.Close()
+	defer client.Close()
+
+	stream := append(wsFrame(wsBinary, false, []byte("ping")), wsFrame(wsPing, true, []byte("beat"))...)
+	stream = append(stream, wsFrame(wsPong, true, nil)...)
+	stream = append(stream, wsFrame(wsContinuation, true, []byte("pong"))...)
+	go client.Write(stream)
+
+	pongc := make(chan []byte, 1)
+	go func() {
+		head, body, err := wsReadFrame(client)
+		if err != nil || head != 0x80|wsPong {
+			body = nil
+		}
+		pongc <- body
+	}()
+	have := make([]byte, 8)
+	if _, err := io.ReadFull(conn, have); err != nil {
+		t.Fatalf("failed to read stream: %v.", err)
+	}
+	if string(have) != "pingpong" {
+		t.Fatalf("stream mismatch: have %q, want %q.", have, "pingpong")
+	}
+	if pong := <-pongc; string(pong) != "beat" {
+		t.Fatalf("pong payload mismatch: have %q, want %q.", pong, "beat")
+	}
+}
+
+// Tests that a close frame ends the stream and is answered with a close.
+func TestWsConnReadClose(t *testing.T) {
+	conn, client := wsPipe()
+	defer conn.Conn.Close()
+	defer client.Close()
+
+	go client.Write(wsFrame(wsClose, true, []byte{0x03, 0xe8}))
+
+	closec := make(chan byte, 1)
+	go func() {
+		head, _, _ := wsReadFrame(client)
+		closec <- head
+	}()
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read error mismatch: have %v, want %v.", err, io.EOF)
+	}
+	if head := <-closec; head != 0x80|wsClose {
+		t.Fatalf("close reply mismatch: have %#x, want %#x.", head, 0x80|wsClose)
+	}
+	// Outbound data must be refused after the close
+	if _, err := conn.Write([]byte("late")); err != io.ErrClosedPipe {
+		t.Fatalf("write error mismatch: have %v, want %v.", err, io.ErrClosedPipe)
+	}
+}
+
+// Tests that protocol violations are rejected.
+func TestWsConnReadInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+	}{
+		{"unmasked", []byte{0x80 | wsBinary, 0x01, 'x'}},
+		{"oversized data", append(wsAppendSize([]byte{0x80 | wsBinary, 0x80}, wsFrameLimit+1), wsTestMask[:]...)},
+		{"huge data", append(wsAppendSize([]byte{0x80 | wsBinary, 0x80}, 1<<63), wsTestMask[:]...)},
+		{"oversized control", wsFrame(wsPing, true, make([]byte, 126))},
+		{"unknown opcode", wsFrame(0x3, true, []byte("x"))},
+	}
+	for _, tt := range tests {
+		conn, client := wsPipe()
+		go client.Write(tt.frame)
+
+		if _, err := conn.Read(make([]byte, 1)); err != errWsProtocol {
+			t.Errorf("%s: read error mismatch: have %v, want %v.", tt.name, err, errWsProtocol)
+		}
+		conn.Conn.Close()
+		client.Close()
+	}
+}
+
+// Tests that writes are sent as single unmasked binary frames, using the proper
+// length encoding for their size.
+func TestWsConnWrite(t *testing.T) {
+	for _, size := range []int{0, 125, 126, 0xffff, 0x10000} {
+		conn, client := wsPipe()
+
+		data := bytes.Repeat([]byte{0x5a}, size)
+		go conn.Write(data)
+
+		head, body, err := wsReadFrame(client)
+		if err != nil {
+			t.Fatalf("size %d: failed to read frame: %v.", size, err)
+		}
+		if head != 0x80|wsBinary {
+			t.Errorf("size %d: header mismatch: have %#x, want %#x.", size, head, 0x80|wsBinary)
+		}
+		if !bytes.Equal(body, data) {
+			t.Errorf("size %d: payload mismatch.", size)
+		}
+		conn.Conn.Close()
+		client.Close()
+	}
+}
+
+// Tests that a WebSocket client stalling after the upgrade does not block others
+// from joining, and that it gets dropped once the handshake timeout passes.
+func TestSilentWsClient(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	rel, stop := startRelay(t, WithWebSocket("localhost:0"))
+	defer stop()
+
+	addr := rel.endpoints[0].Addr().String()
+
+	// Connect a client never sending its request, and one never sending its init
+	headless, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial relay: %v.", err)
+	}
+	defer headless.Close()
+
+	silent := dialWebSocket(t, addr)
+	defer silent.Close()
+
+	// Make sure another client can join meanwhile
+	client := dialWebSocket(t, addr)
+	defer client.Close()
+
+	client.SetDeadline(time.Now().Add(config.RelayHandshakeTimeout / 2))
+	go client.Write(wsFrame(wsBinary, true, encode(opInit, relayVersion, "silent-test")))
+	if head, body, err := wsReadFrame(client); err != nil {
+		t.Fatalf("failed to handshake with relay: %v.", err)
+	} else if head != 0x80|wsBinary || !bytes.Equal(body, []byte{opInit}) {
+		t.Fatalf("init reply mismatch: have %#x %v, want %#x %v.", head, body, 0x80|wsBinary, []byte{opInit})
+	}
+	// Verify that the stalling clients are dropped
+	for i, conn := range []net.Conn{headless, silent} {
+		if err := newTestClient(conn).waitClose(2 * config.RelayHandshakeTimeout); err != nil {
+			t.Fatalf("client #%d: stalling client not dropped: %v.", i, err)
+		}
+	}
+}
+
+// Dials the WebSocket endpoint of a relay and completes the opening handshake.
+func dialWebSocket(t *testing.T, addr string) net.Conn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial relay: %v.", err)
+	}
+	req, _ := http.NewRequest("GET", "http://"+addr+"/", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("failed to send upgrade request: %v.", err)
+	}
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatalf("failed to read upgrade response: %v.", err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade status mismatch: have %v, want %v.", res.StatusCode, http.StatusSwitchingProtocols)
+	}
+	return conn
+}
@@ -0,0 +1,77 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the binary upgrade of a running node: a successor process
+// is started from the (replaced) executable with the same arguments, and the
+// relay clients are handed off to it once booted, without disconnecting them.
+
+package main
+
+import (
+	"net"
+	"os"
+	"os/exec"
+
+	"github.com/karalabe/iris/service/relay"
+)
+
+// Environment variable signaling a successor that it inherited a handoff socket.
+const handoffEnv = "IRIS_RELAY_HANDOFF"
+
+// File descriptor of the inherited handoff socket (the first extra file).
+const handoffFd = 3
+
+// Retrieves the handoff socket inherited from a predecessor, or nil if started
+// afresh.
+func inheritHandoff() (*net.UnixConn, error) {
+	if os.Getenv(handoffEnv) == "" {
+		return nil, nil
+	}
+	os.Unsetenv(handoffEnv)
+	return relay.HandoffConn(os.NewFile(handoffFd, "relay-handoff"))
+}
+
+// Starts a successor process from the current executable and hands the relay
+// off to it. On failure the relay keeps serving.
+func upgrade(rel *relay.Relay) error {
+	conn, file, err := relay.NewHandoffPair()
+	if err != nil {
+		return err
+	}
+	bin, err := os.Executable()
+	if err != nil {
+		conn.Close()
+		file.Close()
+		return err
+	}
+	cmd := exec.Command(bin, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), handoffEnv+"=1")
+	cmd.ExtraFiles = []*os.File{file}
+
+	err = cmd.Start()
+	file.Close()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	go cmd.Wait()
+
+	return rel.Handoff(conn)
+}